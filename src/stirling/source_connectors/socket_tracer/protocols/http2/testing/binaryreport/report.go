@@ -0,0 +1,242 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+// Package binaryreport inspects the greet server and client binaries built in the variants Stirling
+// attaches uprobes to, and reports what each makes available to it: symbols, debug info, the Go
+// build info and which TLS library it calls.
+package binaryreport
+
+import (
+	"debug/buildinfo"
+	"debug/elf"
+	"debug/gosym"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Version is the version of the report format.
+const Version = 1
+
+// The ways a binary is linked.
+const (
+	LinkingStatic  = "static"
+	LinkingDynamic = "dynamic"
+)
+
+// The TLS implementations a binary can call.
+const (
+	TLSGo      = "go"
+	TLSOpenSSL = "openssl"
+)
+
+// goTLSWrite is the function Stirling attaches its Go TLS uprobes to.
+const goTLSWrite = "crypto/tls.(*Conn).Write"
+
+// ErrNotELF is returned for files that are not ELF binaries.
+var ErrNotELF = errors.New("not an ELF binary")
+
+// BinaryReport is what a binary makes available to uprobes.
+type BinaryReport struct {
+	Path string `json:"path"`
+	// Linking is how the binary is linked. One of the Linking constants.
+	Linking string `json:"linking"`
+	// Interpreter is the dynamic linker of dynamically linked binaries.
+	Interpreter string `json:"interpreter,omitempty"`
+	// Needed are the shared libraries the binary depends on.
+	Needed []string `json:"needed,omitempty"`
+	// PIE is true if the binary is position independent, and so loaded at a random address.
+	PIE bool `json:"pie"`
+	// Sections are the names of the ELF sections, in file order.
+	Sections []string `json:"sections"`
+	// SymbolTable is true if the binary has a .symtab, which stripping removes.
+	SymbolTable bool `json:"symbol_table"`
+	// DWARF is true if the binary has debug info, which stripping removes.
+	DWARF bool `json:"dwarf"`
+	// Go is the Go build info, if the binary was built by Go.
+	Go *GoBuildInfo `json:"go,omitempty"`
+	// TLS are the TLS implementations the binary calls, sorted. Some of the TLS constants.
+	TLS []string `json:"tls"`
+	// GoTLSSymbol is true if goTLSWrite is in the symbol table, where uprobes are attached by name.
+	GoTLSSymbol bool `json:"go_tls_symbol"`
+	// GoTLSFunction is true if goTLSWrite is in the Go function table, which stripping keeps.
+	GoTLSFunction bool `json:"go_tls_function"`
+}
+
+// GoBuildInfo is the build info Go embeds in the binaries it builds.
+type GoBuildInfo struct {
+	Version string `json:"version"`
+	Path    string `json:"path"`
+	// Settings are the build settings, such as -buildmode, -ldflags and CGO_ENABLED.
+	Settings map[string]string `json:"settings,omitempty"`
+}
+
+// Stripped returns true if the binary has neither a symbol table nor debug info.
+func (r *BinaryReport) Stripped() bool {
+	return !r.SymbolTable && !r.DWARF
+}
+
+// Report is the capability report of a set of binaries.
+type Report struct {
+	Version  int             `json:"version"`
+	Binaries []*BinaryReport `json:"binaries"`
+}
+
+// Inspect reports what the binary at path makes available to uprobes.
+func Inspect(path string) (*BinaryReport, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		var formatErr *elf.FormatError
+		if errors.As(err, &formatErr) {
+			return nil, fmt.Errorf("%s: %w", path, ErrNotELF)
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	r := &BinaryReport{Path: path, Linking: LinkingStatic, PIE: f.Type == elf.ET_DYN, TLS: []string{}}
+	for _, s := range f.Sections {
+		if s.Name == "" {
+			continue
+		}
+		r.Sections = append(r.Sections, s.Name)
+		switch s.Name {
+		case ".symtab":
+			r.SymbolTable = true
+		case ".debug_info", ".zdebug_info":
+			r.DWARF = true
+		}
+	}
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_INTERP {
+			continue
+		}
+		b, err := io.ReadAll(p.Open())
+		if err != nil {
+			return nil, fmt.Errorf("%s: reading interpreter: %w", path, err)
+		}
+		r.Interpreter = strings.TrimRight(string(b), "\x00")
+		r.Linking = LinkingDynamic
+	}
+	// Static binaries have no dynamic section to list libraries from.
+	if r.Needed, err = f.ImportedLibraries(); err != nil {
+		r.Needed = nil
+	}
+	if len(r.Needed) > 0 {
+		r.Linking = LinkingDynamic
+	}
+
+	symbols := make(map[string]bool)
+	if r.SymbolTable {
+		syms, err := f.Symbols()
+		if err != nil {
+			return nil, fmt.Errorf("%s: reading symbols: %w", path, err)
+		}
+		for _, s := range syms {
+			symbols[s.Name] = true
+		}
+	}
+	// Dynamic symbols are kept by stripping, and name the OpenSSL functions a binary calls.
+	dynSymbols, _ := f.DynamicSymbols()
+	for _, s := range dynSymbols {
+		symbols[s.Name] = true
+	}
+	r.GoTLSSymbol = symbols[goTLSWrite]
+
+	if info, err := buildinfo.ReadFile(path); err == nil {
+		r.Go = &GoBuildInfo{Version: info.GoVersion, Path: info.Path}
+		for _, s := range info.Settings {
+			if r.Go.Settings == nil {
+				r.Go.Settings = make(map[string]string)
+			}
+			r.Go.Settings[s.Key] = s.Value
+		}
+		r.GoTLSFunction = hasGoFunction(f, goTLSWrite)
+	}
+
+	if r.GoTLSSymbol || r.GoTLSFunction {
+		r.TLS = append(r.TLS, TLSGo)
+	}
+	if symbols["SSL_write"] || hasLibrary(r.Needed, "libssl") {
+		r.TLS = append(r.TLS, TLSOpenSSL)
+	}
+	sort.Strings(r.TLS)
+	return r, nil
+}
+
+// hasGoFunction returns true if name is in the function table of the Go binary f.
+func hasGoFunction(f *elf.File, name string) bool {
+	pclntab := f.Section(".gopclntab")
+	text := f.Section(".text")
+	if pclntab == nil || text == nil {
+		return false
+	}
+	data, err := pclntab.Data()
+	if err != nil {
+		return false
+	}
+	table, err := gosym.NewTable(nil, gosym.NewLineTable(data, text.Addr))
+	if err != nil {
+		return false
+	}
+	return table.LookupFunc(name) != nil
+}
+
+// hasLibrary returns true if one of needed is the shared library named prefix.
+func hasLibrary(needed []string, prefix string) bool {
+	for _, lib := range needed {
+		if strings.HasPrefix(lib, prefix+".so") {
+			return true
+		}
+	}
+	return false
+}
+
+// InspectAll reports on every binary in paths.
+func InspectAll(paths []string) (*Report, error) {
+	report := &Report{Version: Version, Binaries: []*BinaryReport{}}
+	for _, path := range paths {
+		r, err := Inspect(path)
+		if err != nil {
+			return nil, err
+		}
+		report.Binaries = append(report.Binaries, r)
+	}
+	return report, nil
+}
+
+// WriteReport writes report as indented JSON.
+func WriteReport(w io.Writer, report *Report) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// ReadReport reads a report written by WriteReport.
+func ReadReport(r io.Reader) (*Report, error) {
+	report := &Report{}
+	if err := json.NewDecoder(r).Decode(report); err != nil {
+		return nil, err
+	}
+	if report.Version != Version {
+		return nil, fmt.Errorf("unsupported report version %d, want %d", report.Version, Version)
+	}
+	return report, nil
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package binaryreport_test
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/binaryreport"
+)
+
+// variant is a way the workload binaries are built, as their Bazel targets do.
+type variant struct {
+	name string
+	env  []string
+	args []string
+	// The report expected of the variant.
+	linking  string
+	pie      bool
+	stripped bool
+	cgo      string
+}
+
+var variants = []variant{
+	{name: "dynamic", env: []string{"CGO_ENABLED=1"}, linking: binaryreport.LinkingDynamic, cgo: "1"},
+	{name: "static", env: []string{"CGO_ENABLED=0"}, linking: binaryreport.LinkingStatic, cgo: "0"},
+	{name: "stripped", env: []string{"CGO_ENABLED=0"}, args: []string{"-ldflags=-s -w"}, linking: binaryreport.LinkingStatic, stripped: true, cgo: "0"},
+	{name: "pie", env: []string{"CGO_ENABLED=1"}, args: []string{"-buildmode=pie"}, linking: binaryreport.LinkingDynamic, pie: true, cgo: "1"},
+}
+
+// buildVariant builds testdata/tlsclient as v, skipping the test if the Go toolchain is missing, as
+// in the Bazel sandbox.
+func buildVariant(t *testing.T, v variant) string {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go not found")
+	}
+	if v.cgo == "1" {
+		if _, err := exec.LookPath("gcc"); err != nil {
+			t.Skip("gcc not found")
+		}
+	}
+	out := filepath.Join(t.TempDir(), v.name)
+	args := append([]string{"build", "-o", out}, v.args...)
+	cmd := exec.Command(goTool, append(args, "./testdata/tlsclient")...)
+	cmd.Env = append(os.Environ(), v.env...)
+	output, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(output))
+	return out
+}
+
+func TestInspect_Variants(t *testing.T) {
+	for _, v := range variants {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			r, err := binaryreport.Inspect(buildVariant(t, v))
+			require.NoError(t, err)
+			assert.Equal(t, v.linking, r.Linking)
+			if v.linking == binaryreport.LinkingDynamic {
+				assert.NotEmpty(t, r.Interpreter)
+			} else {
+				assert.Empty(t, r.Interpreter)
+				assert.Empty(t, r.Needed)
+			}
+			assert.Equal(t, v.pie, r.PIE)
+			assert.Equal(t, v.stripped, r.Stripped())
+			assert.Equal(t, !v.stripped, r.SymbolTable)
+			assert.Equal(t, !v.stripped, r.DWARF)
+			assert.Contains(t, r.Sections, ".text")
+			assert.Contains(t, r.Sections, ".gopclntab")
+
+			require.NotNil(t, r.Go)
+			assert.NotEmpty(t, r.Go.Version)
+			assert.Equal(t, v.cgo, r.Go.Settings["CGO_ENABLED"])
+			if v.pie {
+				assert.Equal(t, "pie", r.Go.Settings["-buildmode"])
+			}
+
+			assert.Equal(t, []string{binaryreport.TLSGo}, r.TLS)
+			// Stripping removes the symbol uprobes are attached by, but not the Go function table.
+			assert.Equal(t, !v.stripped, r.GoTLSSymbol)
+			assert.True(t, r.GoTLSFunction)
+		})
+	}
+}
+
+func TestInspect_OpenSSL(t *testing.T) {
+	cc, err := exec.LookPath("gcc")
+	if err != nil {
+		t.Skip("gcc not found")
+	}
+	out := filepath.Join(t.TempDir(), "openssl_client")
+	output, err := exec.Command(cc, "-o", out, "testdata/openssl_client.c", "-lssl", "-lcrypto").CombinedOutput()
+	if err != nil {
+		t.Skipf("OpenSSL not available: %s", output)
+	}
+
+	r, err := binaryreport.Inspect(out)
+	require.NoError(t, err)
+	assert.Equal(t, binaryreport.LinkingDynamic, r.Linking)
+	assert.Equal(t, []string{binaryreport.TLSOpenSSL}, r.TLS)
+	assert.Nil(t, r.Go)
+	assert.False(t, r.GoTLSSymbol)
+	assert.False(t, r.GoTLSFunction)
+}
+
+func TestInspect_NotELF(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "script.sh")
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\necho hello\n"), 0o755))
+	_, err := binaryreport.Inspect(path)
+	assert.ErrorIs(t, err, binaryreport.ErrNotELF)
+
+	_, err = binaryreport.Inspect(filepath.Join(t.TempDir(), "missing"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestReport_RoundTrip(t *testing.T) {
+	report := &binaryreport.Report{
+		Version: binaryreport.Version,
+		Binaries: []*binaryreport.BinaryReport{{
+			Path:        "/bin/server_static",
+			Linking:     binaryreport.LinkingStatic,
+			Sections:    []string{".text", ".gopclntab"},
+			SymbolTable: true,
+			Go:          &binaryreport.GoBuildInfo{Version: "go1.20", Settings: map[string]string{"CGO_ENABLED": "0"}},
+			TLS:         []string{binaryreport.TLSGo},
+			GoTLSSymbol: true,
+		}},
+	}
+	var buf bytes.Buffer
+	require.NoError(t, binaryreport.WriteReport(&buf, report))
+	read, err := binaryreport.ReadReport(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, report, read)
+
+	_, err = binaryreport.ReadReport(bytes.NewBufferString(`{"version": 2, "binaries": []}`))
+	assert.Error(t, err)
+}
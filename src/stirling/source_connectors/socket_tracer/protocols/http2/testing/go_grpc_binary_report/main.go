@@ -0,0 +1,59 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+// The binary report tool inspects builds of the greet server and client, such as the static,
+// stripped and PIE variants, and writes a JSON report of what each makes available to uprobes.
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/binaryreport"
+)
+
+func main() {
+	out := flag.String("out", "", "The file to write the report to. Defaults to stdout.")
+	flag.Usage = func() {
+		log.Printf("Usage: %s [-out report.json] binary...", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		log.Fatal("At least one binary must be given")
+	}
+	report, err := binaryreport.InspectAll(flag.Args())
+	if err != nil {
+		log.Fatalf("Failed to inspect binaries, error: %v", err)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("Failed to create report file, error: %v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := binaryreport.WriteReport(w, report); err != nil {
+		log.Fatalf("Failed to write report, error: %v", err)
+	}
+}
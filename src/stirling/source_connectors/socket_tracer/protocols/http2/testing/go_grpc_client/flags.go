@@ -0,0 +1,751 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/payloadgen"
+)
+
+// clientFlags holds the values of the command line flags of the client.
+type clientFlags struct {
+	address                     string
+	once                        bool
+	name                        string
+	https                       bool
+	clientStreaming             bool
+	serverStreaming             bool
+	bidirStreaming              bool
+	compression                 bool
+	count                       int
+	waitPeriodMills             int
+	cancelFraction              float64
+	cancelWindowMillis          int
+	seed                        int64
+	output                      string
+	streamCount                 int
+	recvIntervalMillis          int
+	timeoutMillis               int
+	dialTimeoutMillis           int
+	headerTimeoutMillis         int
+	churnRate                   float64
+	churnCalls                  int
+	churnDuration               time.Duration
+	heartbeatStreams            int
+	heartbeatDuration           time.Duration
+	heartbeatCheckpointFile     string
+	heartbeatCheckpointInterval time.Duration
+	uploadBytes                 int64
+	uploadDuration              time.Duration
+	escalationSizes             string
+	uploadMessageBytes          int
+	invoke                      string
+	data                        string
+	statsFile                   string
+	channelzFile                string
+	dialRaceStaggerMillis       int
+	export                      string
+	exportFile                  string
+	h2cUpgrade                  bool
+	abortive                    bool
+	verifyChecksums             bool
+	termination                 string
+	tlsMinVersion               string
+	tlsMaxVersion               string
+	clientCert                  string
+	clientKey                   string
+	cipherSuites                string
+	authority                   string
+	breakerThreshold            int
+	breakerOpenMillis           int
+	breakerProbes               int
+	breakerFile                 string
+	sharedConn                  bool
+	hedgeDelay                  time.Duration
+	retries                     bool
+	sizedCodec                  bool
+	deterministicCodec          bool
+	initialWindowSize           uint
+	initialConnWindowSize       uint
+	maxHeaderListSize           uint
+	unimplemented               string
+	warmCold                    bool
+	payloadSize                 string
+	payloadSeed                 uint64
+	payloadAlphabet             string
+	clockSyncMillis             int
+	clockFile                   string
+	otelOut                     string
+	binMetadataCount            int
+	binMetadataBytes            int
+	trailerBloatCount           int
+	trailerBloatBytes           int
+	binMetadataEcho             bool
+	payloadKey                  string
+	wireSampleEvery             int
+	wireSampleDir               string
+	wireSampleMaxBytes          int64
+	latencyMaxMillis            int64
+	latencyDigits               int
+	features                    bool
+	latencyFile                 string
+	maxInFlight                 int
+	loadProfile                 string
+	qpsFile                     string
+	asyncDuration               time.Duration
+	targetP99                   time.Duration
+	adaptiveInterval            time.Duration
+	adaptiveMaxInFlight         int
+	adaptiveFile                string
+	methodMix                   string
+	batchSize                   int
+	burstSize                   int
+	burstIntervalMillis         int
+	burstSameConn               bool
+	chaosProbability            float64
+	chaosCorruptions            string
+	chaosDryRun                 bool
+	tcpNoDelay                  bool
+	sendBuffer                  int
+	recvBuffer                  int
+	keepAliveMillis             int
+	socks5Proxy                 string
+	socks5Username              string
+	socks5Password              string
+	socks5ConnectTimeout        time.Duration
+	pingMillis                  int
+	pingWithoutCalls            bool
+	shapeBytesPerSecond         int64
+	shapeBurst                  int
+	shapeDelayMillis            int
+	replay                      string
+	noTiming                    bool
+	mode                        string
+	conformanceDeadlineMillis   int
+	tlsAddress                  string
+	quick                       bool
+	debugAddr                   string
+	replayToleranceMillis       int
+}
+
+// parseFlags registers the flags of the client on flag.CommandLine and parses the command line.
+func parseFlags() *clientFlags {
+	f := &clientFlags{}
+	flag.StringVar(&f.address, "address", "localhost:50051", "Server end point. A comma-separated list balances calls across several servers.")
+	flag.BoolVar(&f.once, "once", false, "If true, send one request and wait for response and exit.")
+	flag.StringVar(&f.name, "name", "world", "The name to greet.")
+	flag.BoolVar(&f.https, "https", false, "If true, uses https.")
+	flag.BoolVar(&f.clientStreaming, "client_streaming", false, "Whether or not to call client streaming RPC")
+	flag.BoolVar(&f.serverStreaming, "server_streaming", false, "Whether or not to call server streaming RPC")
+	flag.BoolVar(&f.bidirStreaming, "bidir_streaming", false, "Whether or not to call server streaming RPC")
+	flag.BoolVar(&f.compression, "compression", false, "Wether or not to use gRPC compression.")
+	flag.IntVar(&f.count, "count", 1, "The count of requests to make.")
+	flag.IntVar(&f.waitPeriodMills, "wait_period_millis", 500, "The waiting period between making successive requests.")
+	flag.Float64Var(&f.cancelFraction, "cancel_fraction", 0, "The fraction of calls to cancel before they complete.")
+	flag.IntVar(&f.cancelWindowMillis, "cancel_window_millis", 5, "Unary calls picked for cancellation are cancelled after a random delay up to this bound.")
+	flag.Int64Var(&f.seed, "seed", time.Now().UnixNano(), "Seed for the random choices made by the client.")
+	flag.StringVar(&f.output, "output", "", "If set, writes a JSON line per call to this file. Not written with -churn_rate.")
+	flag.IntVar(&f.streamCount, "stream_count", 0, "The number of replies to request from server streaming RPCs. Zero uses the server default.")
+	flag.IntVar(&f.recvIntervalMillis, "recv_interval_millis", 0, "If set, server streaming RPCs read one reply per interval to exercise HTTP/2 flow control.")
+	flag.IntVar(&f.timeoutMillis, "timeout_millis", 1000, "The deadline of every call.")
+	flag.IntVar(&f.dialTimeoutMillis, "dial_timeout_millis", 0, "If set, bounds how long a call waits for a connection to send its headers over, within -timeout_millis. Calls that exceed it fail with DEADLINE_EXCEEDED, recorded as exceeding the dial budget.")
+	flag.IntVar(&f.headerTimeoutMillis, "header_timeout_millis", 0, "If set, bounds how long a call waits for the response headers once it sent its own, within -timeout_millis. Calls that exceed it fail with DEADLINE_EXCEEDED, recorded as exceeding the header budget.")
+	flag.Float64Var(&f.churnRate, "churn_rate", 0, "If set, opens this many new connections per second, each making churn_calls calls before closing.")
+	flag.IntVar(&f.churnCalls, "churn_calls", 1, "The number of unary calls made over each churned connection.")
+	flag.DurationVar(&f.churnDuration, "churn_duration", 10*time.Second, "How long to keep opening churned connections.")
+	flag.IntVar(&f.heartbeatStreams, "heartbeat_streams", 0, "If set, holds this many server streaming calls greeting \"heartbeat\" open over a single connection for -heartbeat_duration, each getting a reply every --heartbeat_interval_millis of the server, which must be set.")
+	flag.DurationVar(&f.heartbeatDuration, "heartbeat_duration", time.Hour, "How long to hold -heartbeat_streams open.")
+	flag.StringVar(&f.heartbeatCheckpointFile, "heartbeat_checkpoint_file", "", "If set, the replies received over every -heartbeat_streams stream so far, and when the last one was, are written to this file every -heartbeat_checkpoint_interval, so that an observer can tell the streams are alive. The file is replaced at once, never left half written.")
+	flag.DurationVar(&f.heartbeatCheckpointInterval, "heartbeat_checkpoint_interval", 10*time.Second, "How often to write -heartbeat_checkpoint_file.")
+	flag.Int64Var(&f.uploadBytes, "upload_bytes", 0, "If positive, makes a single client streaming call over a single connection that sends this many payload bytes as fast as flow control allows, and logs the throughput and the bytes the server received. The run fails if they do not match.")
+	flag.DurationVar(&f.uploadDuration, "upload_duration", 0, "If positive, the upload sends for this long, or until -upload_bytes are sent if that is set too.")
+	flag.StringVar(&f.escalationSizes, "escalation_sizes", "", "If set, makes a single SayHelloServerStreaming call that the server answers with a reply for every one of these comma-separated payload sizes, in order, e.g. 1,100B,16KB,64KB-1,1MB, or default for sizes on both sides of the 16KiB frame and 64KiB window boundaries. Every reply declares the size and checksum of its payload, and the run fails with the first size that did not come through intact.")
+	flag.IntVar(&f.uploadMessageBytes, "upload_message_bytes", 64<<10, "The payload size of each request of an upload. It must stay under the maximum message size of the server.")
+	flag.StringVar(&f.invoke, "invoke", "", "If set, calls this method, e.g. /px.stirling.protocols.http2.testing.Greeter/SayHello, prints the replies as JSON and exits with the gRPC status code, or 64 if the method or requests are invalid.")
+	flag.StringVar(&f.data, "data", "", "The JSON requests for --invoke. Read from stdin if empty.")
+	flag.StringVar(&f.statsFile, "stats_file", "", "If set, per-connection stats are written to this file once all calls are done.")
+	flag.StringVar(&f.channelzFile, "channelz_file", "", "If set, a channelz snapshot of the channels, subchannels and sockets of the client is written to this file as JSON once all calls are done, before the shared connection is closed. The counters of every socket are checked against the per-connection stats.")
+	flag.IntVar(&f.dialRaceStaggerMillis, "dial_race_stagger_millis", 0, "If positive, the host of -address is resolved and its addresses are dialed the way happy eyeballs clients do, alternating IPv6 and IPv4, each this long after the one before. The first to connect is used and the others are aborted. Every attempt is recorded in -stats_file.")
+	flag.StringVar(&f.export, "export", "", "If csv, a row of every call, with its times, sizes, message counts, status, request ID and connection, is written to -export_file once all calls are done, for tooling that loads records into tables.")
+	flag.StringVar(&f.exportFile, "export_file", "", "The file -export writes to.")
+	flag.BoolVar(&f.h2cUpgrade, "h2c_upgrade", false, "If true, unary calls are made over new connections upgraded from HTTP/1.1 to h2c.")
+	flag.BoolVar(&f.abortive, "abortive", false, "If true, churned connections are closed with a TCP RST instead of a FIN.")
+	flag.BoolVar(&f.verifyChecksums, "verify_checksums", false, "If true, verifies the checksum of every reply and reply stream. Requires a server run with --checksums.")
+	flag.StringVar(&f.termination, "termination", "", "If set, every call is made over a connection of its own, ended this way: reset for a TCP RST after a unary reply, or half_close to shut down the write side while reading a -server_streaming call.")
+	flag.StringVar(&f.tlsMinVersion, "tls_min_version", "", "The minimum TLS version offered with -https, 1.2 or 1.3.")
+	flag.StringVar(&f.tlsMaxVersion, "tls_max_version", "", "The maximum TLS version offered with -https, 1.2 or 1.3.")
+	flag.StringVar(&f.clientCert, "client_cert", "", "If set, the client certificate presented with -https or -mode http3 to servers that request one, with -client_key. Replacing the files rotates the certificate of the connections dialed from then on.")
+	flag.StringVar(&f.clientKey, "client_key", "", "The key of -client_cert.")
+	flag.StringVar(&f.cipherSuites, "cipher_suites", "", "Comma-separated TLS 1.2 cipher suites offered with -https.")
+	flag.StringVar(&f.authority, "authority", "", "If set, the :authority of the calls made, instead of the address dialed. A comma-separated list is cycled through call by call, each authority over a connection of its own to the same address. Not supported with calls that set up connections of their own.")
+	flag.IntVar(&f.breakerThreshold, "breaker_threshold", 0, "If positive, unary calls go through a circuit breaker that opens after this many consecutive failures. While open, calls fail at once without being made. Failures then end the run no more.")
+	flag.IntVar(&f.breakerOpenMillis, "breaker_open_millis", 1000, "How long the circuit breaker of -breaker_threshold stays open before it lets probe calls through.")
+	flag.IntVar(&f.breakerProbes, "breaker_probes", 1, "The number of probe calls that must complete in a row to close the circuit breaker of -breaker_threshold.")
+	flag.StringVar(&f.breakerFile, "breaker_file", "", "If set, the state transitions of the circuit breaker of -breaker_threshold are written to this file as timestamped JSON lines.")
+	flag.BoolVar(&f.sharedConn, "shared_conn", false, "If true, a single address gets one connection for every call, which gRPC replaces if the server sends GOAWAY, instead of a new connection per call.")
+	flag.DurationVar(&f.hedgeDelay, "hedge_delay", 0, "If positive, unary calls are hedged: a second attempt, with the same x-request-id and an x-hedge-attempt of 2, is made of every call that has not returned within this delay, and the attempt that succeeds first wins, the other being cancelled. Records count the attempts of every call, and the logical calls and attempts on the wire are logged at the end. Not supported with -retries.")
+	flag.BoolVar(&f.retries, "retries", false, "If true, calls failing with UNAVAILABLE are retried, as well as transparently retried by gRPC when the server never saw them.")
+	flag.BoolVar(&f.sizedCodec, "sized_codec", false, "If true, messages are marshaled and unmarshaled with the greetpb SizedCodec rather than the default codec. Calls are then sent with the content-type application/grpc+proto.")
+	flag.BoolVar(&f.deterministicCodec, "deterministic_codec", false, "If true, messages are marshaled with the greetpb DeterministicCodec, so that every run sends the same request bytes. Calls are then sent with the content-type application/grpc+proto. Not supported with -sized_codec.")
+	flag.UintVar(&f.initialWindowSize, "initial_window_size", 0, "If set, the HTTP/2 flow control window of every stream, at least 65535.")
+	flag.UintVar(&f.initialConnWindowSize, "initial_conn_window_size", 0, "If set, the HTTP/2 flow control window of every connection, at least 65535.")
+	flag.UintVar(&f.maxHeaderListSize, "max_header_list_size", 0, "If set, replies with larger header lists are rejected.")
+	flag.StringVar(&f.unimplemented, "unimplemented", "", "If set, unary calls are made to provoke Unimplemented, which is expected rather than a failure: method calls a method of Greeter no server implements, service calls Greeter2.SayHi, which requires a server run with --greeter_only.")
+	flag.BoolVar(&f.warmCold, "warm_cold", false, "If true, unary calls alternate between cold ones, each over a new connection closed after it, and warm ones, over a connection set up before the first call. Records and latencies are tagged with the connection.")
+	flag.StringVar(&f.payloadSize, "payload_size", "", "If set, names are generated from -payload_seed instead of -name, with sizes in bytes drawn from this distribution: fixed:N, uniform:MIN:MAX, zipf:S:MAX or boundary. Each call takes the next names in sequence, from index 0.")
+	flag.Uint64Var(&f.payloadSeed, "payload_seed", 1, "The seed of the names generated with -payload_size.")
+	flag.StringVar(&f.payloadAlphabet, "payload_alphabet", payloadgen.AlphabetASCII, "The alphabet of the names generated with -payload_size: ascii, utf8, stress, huffman_favorable or huffman_unfavorable.")
+	flag.IntVar(&f.clockSyncMillis, "clock_sync_interval_millis", 0, "If positive, the clock of the server is probed at the start and end of the run, and this often in between, over a connection of its own. Requires a server that answers clock probes.")
+	flag.StringVar(&f.clockFile, "clock_file", "", "If set, the clock probes made with -clock_sync_interval_millis are written to this file, with the offset estimated from each.")
+	flag.StringVar(&f.otelOut, "otel_out", "", "If set, an OpenTelemetry span of every call is exported, with its traceparent sent to the server: to an OTLP/gRPC collector given as otlp://host:port, or else as JSON to this file at the end of the run.")
+	flag.IntVar(&f.binMetadataCount, "bin_metadata_count", 0, "If positive, every call is sent with this many binary metadata entries of -bin_metadata_bytes random bytes each, drawn from -seed. The server checks them against a digest and echoes the digest it received in a trailer. Large entries make header blocks that span CONTINUATION frames.")
+	flag.IntVar(&f.binMetadataBytes, "bin_metadata_bytes", 1024, "The size of every entry sent with -bin_metadata_count.")
+	flag.IntVar(&f.trailerBloatCount, "trailer_bloat_count", 0, "If positive, the trailer of every call is checked to hold this many x-bloat entries of -trailer_bloat_bytes each, drawn from its request ID, as a server started with the same --trailer_bloat_count and --trailer_bloat_bytes sends. Calls whose trailer does not hold them intact fail with DATA_LOSS.")
+	flag.IntVar(&f.trailerBloatBytes, "trailer_bloat_bytes", 1024, "The size of every entry checked with -trailer_bloat_count.")
+	flag.BoolVar(&f.binMetadataEcho, "bin_metadata_echo", false, "Whether or not to have the server send the entries of -bin_metadata_count back in its response headers, which are checked too.")
+	flag.StringVar(&f.payloadKey, "payload_key", "", "If set, the hex encoded AES key to seal the greet calls with, as the server's --payload_key: the name of every request is sealed into its payload, and the message of every reply opened from its own, with AES-GCM. Replies that fail authentication fail the call with DATA_LOSS.")
+	flag.IntVar(&f.wireSampleEvery, "wire_sample_every", 0, "If positive, one in this many messages, picked at random from -seed, is written to -wire_sample_dir as the codec marshaled or unmarshaled it, before compression, with the request ID of its call, for go_grpc_wire_samples to look up. Calls are then sent with the content-type application/grpc+proto.")
+	flag.StringVar(&f.wireSampleDir, "wire_sample_dir", "", "The directory of the spool -wire_sample_every writes to, created if need be.")
+	flag.Int64Var(&f.wireSampleMaxBytes, "wire_sample_max_bytes", 0, "The most bytes of samples -wire_sample_dir holds, the oldest being removed to make room for new ones. Zero keeps 64MiB.")
+	flag.Int64Var(&f.latencyMaxMillis, "latency_max_millis", 60000, "The largest latency tracked by the per-method latency histograms. Slower calls are counted as this.")
+	flag.IntVar(&f.latencyDigits, "latency_significant_digits", 3, "The number of significant decimal digits, 1 to 5, latencies are kept to in the histograms.")
+	flag.BoolVar(&f.features, "features", false, "If true, the configuration of every server, such as TLS, compressors, message size limits and injected faults, is fetched and logged as JSON before the first call.")
+	flag.StringVar(&f.latencyFile, "latency_file", "", "If set, the per-method latency histograms are written to this file as JSON once all calls are done. Not written with -churn_rate.")
+	flag.IntVar(&f.maxInFlight, "max_inflight", 0, "If positive, SayHello calls are made with a goroutine each, up to this many in flight at once, for -async_duration, instead of -count calls one after the other.")
+	flag.StringVar(&f.loadProfile, "load_profile", "", "If set, SayHello calls are started over a single connection at the rate of this profile, whether or not the calls before them finished, e.g. ramp:0-500qps/60s,hold:500qps/120s,step:1000qps/60s. The target and achieved rate of every second are logged.")
+	flag.StringVar(&f.qpsFile, "qps_file", "", "If set, the target and achieved rate of every second of -load_profile are written to this file as JSON.")
+	flag.DurationVar(&f.asyncDuration, "async_duration", 10*time.Second, "How long -max_inflight and -target_p99 keep starting new calls. Calls still in flight then are allowed to finish, and are recorded.")
+	flag.DurationVar(&f.targetP99, "target_p99", 0, "If positive, SayHello calls are made with a goroutine each over a single connection for -async_duration, with as many in flight as keeps their p99 latency under this: one more after every -adaptive_interval under it, and a tenth fewer after every interval over it. The rate they converge to is logged.")
+	flag.DurationVar(&f.adaptiveInterval, "adaptive_interval", greetworkload.DefaultAdaptiveInterval, "How often -target_p99 adjusts the calls in flight, from the p99 of the calls that completed over the interval.")
+	flag.IntVar(&f.adaptiveMaxInFlight, "adaptive_max_inflight", greetworkload.DefaultAdaptiveMaxConcurrency, "The most calls -target_p99 keeps in flight.")
+	flag.StringVar(&f.adaptiveFile, "adaptive_file", "", "If set, every adjustment of -target_p99, and the rate it converged to, are written to this file as JSON.")
+	flag.StringVar(&f.methodMix, "method_mix", "", "If set, every call is made to a method picked with these weights, e.g. SayHello:70,SayHi:20,Stream:10, from SayHello, SayHelloAgain, SayHi and server streaming Stream. The methods picked only depend on -seed, and their counts are logged at the end.")
+	flag.IntVar(&f.batchSize, "batch_size", 0, "If positive, SayHello calls are replaced by SayHelloBatch calls of this many requests each, named as the calls would be. Requests that fail do so in their results, without failing their call. The calls and requests made, and their rates, are logged apart at the end.")
+	flag.IntVar(&f.burstSize, "burst_size", 0, "If positive, SayHello calls are made in -count bursts of this many calls each, issued together, one burst every -burst_interval_millis, instead of one call after the other.")
+	flag.IntVar(&f.burstIntervalMillis, "burst_interval_millis", 100, "The time from the start of a -burst_size burst to the start of the next.")
+	flag.BoolVar(&f.burstSameConn, "burst_same_conn", false, "If true, the calls of every -burst_size burst share one connection, so that their frames may be coalesced, instead of each call of a burst taking a connection of its own.")
+	flag.Float64Var(&f.chaosProbability, "chaos_probability", 0, "If positive, the chance that each DATA frame the client writes is corrupted. Every corruption is logged. Not supported with -https, or with calls that set up connections of their own.")
+	flag.StringVar(&f.chaosCorruptions, "chaos_corruptions", "", "Comma-separated corruptions picked from with -chaos_probability: bit_flip, truncate, empty_data. Empty picks from all.")
+	flag.BoolVar(&f.chaosDryRun, "chaos_dry_run", false, "If true, the corruptions -chaos_probability would inject are only logged.")
+	flag.BoolVar(&f.tcpNoDelay, "tcp_nodelay", true, "Whether or not to set TCP_NODELAY on the connections dialed. False enables Nagle's algorithm.")
+	flag.IntVar(&f.sendBuffer, "so_sndbuf", 0, "If positive, the SO_SNDBUF of the connections dialed, in bytes.")
+	flag.IntVar(&f.recvBuffer, "so_rcvbuf", 0, "If positive, the SO_RCVBUF of the connections dialed, in bytes.")
+	flag.IntVar(&f.keepAliveMillis, "tcp_keepalive_millis", 0, "If positive, the TCP keepalive idle time and interval of the connections dialed. Negative disables keepalives.")
+	flag.StringVar(&f.socks5Proxy, "socks5_proxy", "", "If set, the host:port of a SOCKS5 proxy the connections are dialed through, dialed with the socket flags above. Host names in -address are resolved by the proxy. Not supported with -termination, -h2c_upgrade, -warm_cold, -churn_rate or -dial_race_stagger_millis.")
+	flag.StringVar(&f.socks5Username, "socks5_username", "", "If set, the username -socks5_proxy is authenticated with, along with -socks5_password.")
+	flag.StringVar(&f.socks5Password, "socks5_password", "", "The password of -socks5_username.")
+	flag.DurationVar(&f.socks5ConnectTimeout, "socks5_connect_timeout", 0, "If positive, bounds setting up every connection through -socks5_proxy, from dialing it to its reply.")
+	flag.IntVar(&f.pingMillis, "keepalive_time_millis", 0, "If positive, the client pings every connection it has heard nothing on for this long, with HTTP/2 keepalive pings. gRPC raises it to 10s. Servers that allow fewer pings close the connection with a too_many_pings GOAWAY, which fails the calls in flight; the summary counts them.")
+	flag.BoolVar(&f.pingWithoutCalls, "keepalive_permit_without_stream", false, "If true, -keepalive_time_millis pings connections with no calls in flight too.")
+	flag.Int64Var(&f.shapeBytesPerSecond, "shape_bytes_per_second", 0, "If positive, limits each direction of every connection dialed to this many bytes per second, as a slow network would. Not supported with calls that set up connections of their own.")
+	flag.IntVar(&f.shapeBurst, "shape_burst", 0, "The most bytes -shape_bytes_per_second lets through at once. 0 lets through a full HTTP/2 frame.")
+	flag.IntVar(&f.shapeDelayMillis, "shape_delay_millis", 0, "If positive, holds back the bytes the client writes to every connection dialed for this long, as a link with this one-way latency would.")
+	flag.StringVar(&f.replay, "replay", "", "If set, the calls recorded in this file, written with -output by a previous run, are made again with the same requests, cancellations and timing, and the run fails if any finishes with another status code. -output then records the replayed calls.")
+	flag.BoolVar(&f.noTiming, "no_timing", false, "If true, -replay makes every call as soon as the one before it finishes, rather than at its recorded offset.")
+	flag.StringVar(&f.mode, "mode", "", "If matrix, makes -count calls of every combination of method (SayHello, SayHelloAgain, SayHi and server streaming SayHello), transport, compression and payload size, against a server serving every service in plaintext on -address and over TLS on -tls_address, such as one run with --all_services and --tls_port. Logs whether each combination passed, with its latency, and stops at the first that fails. If conformance, makes a SayHello call for every status code, from OK to UNAUTHENTICATED, that a server run with --conformance_names fails with it, and logs whether each call finished with its code. Fails if any did not. If http3, which is experimental, makes -count SayHello calls over a single HTTP/3 connection to a server run with --http3_port on -address, through the minimal QUIC and HTTP/3 of the workload, only meant for loopback. Their records have the transport h3. Requires a client built with Go 1.21 or later.")
+	flag.IntVar(&f.conformanceDeadlineMillis, "conformance_deadline_millis", 0, "The deadline of the DEADLINE_EXCEEDED call of -mode conformance, which the server holds past it. The other calls take -timeout_millis. Zero uses 100ms.")
+	flag.StringVar(&f.tlsAddress, "tls_address", "", "The TLS end point of the server with -mode matrix.")
+	flag.BoolVar(&f.quick, "quick", false, "If true, -mode matrix only runs 8 of the 32 combinations, which still cover every pair of values of any two of method, transport, compression and payload size.")
+	flag.StringVar(&f.debugAddr, "debug_addr", "", "If set, serves the read-only debug endpoint on this address: pprof profiles, the open connections with their stats, and the effective flag values.")
+	flag.IntVar(&f.replayToleranceMillis, "replay_tolerance_millis", 10, "How much later than its recorded offset a call replayed with -replay may start before it is reported as late.")
+
+	flag.Parse()
+	return f
+}
+
+// clientOptions returns the options of the client the flags set up, or an error if they do not go
+// together.
+func (f *clientFlags) clientOptions() (*greetworkload.ClientOptions, error) {
+	tlsOpts := &greetworkload.TLSOptions{MinVersion: f.tlsMinVersion, MaxVersion: f.tlsMaxVersion}
+	if f.cipherSuites != "" {
+		tlsOpts.CipherSuites = strings.Split(f.cipherSuites, ",")
+	}
+	if (f.tlsMinVersion != "" || f.tlsMaxVersion != "" || f.cipherSuites != "") && !f.https {
+		return nil, badFlags("-tls_min_version, -tls_max_version and -cipher_suites require -https")
+	}
+	if f.sizedCodec && f.deterministicCodec {
+		return nil, badFlags("-sized_codec and -deterministic_codec cannot be combined")
+	}
+	if (f.export == "") != (f.exportFile == "") {
+		return nil, badFlags("-export and -export_file go together")
+	}
+	if f.export != "" && f.export != greetworkload.ExportCSV {
+		return nil, badFlags(fmt.Sprintf("unknown -export %q, only %s is supported", f.export, greetworkload.ExportCSV))
+	}
+	var clientCertReloader *greetworkload.CertReloader
+	if f.clientCert != "" || f.clientKey != "" {
+		if f.clientCert == "" || f.clientKey == "" || !f.https && f.mode != modeHTTP3 {
+			return nil, badFlags("-client_cert and -client_key go together, and require -https or -mode http3")
+		}
+		var err error
+		if clientCertReloader, err = greetworkload.NewCertReloader(f.clientCert, f.clientKey); err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate: %w", err)
+		}
+	}
+	// Checked now rather than when the first connection is dialed.
+	if err := tlsOpts.Apply(&tls.Config{}); err != nil {
+		return nil, fmt.Errorf("invalid TLS flags: %w", err)
+	}
+	http2Settings := &greetworkload.HTTP2Settings{
+		InitialWindowSize:     uint32(f.initialWindowSize),
+		InitialConnWindowSize: uint32(f.initialConnWindowSize),
+		MaxHeaderListSize:     uint32(f.maxHeaderListSize),
+	}
+	if err := http2Settings.Validate(false); err != nil {
+		return nil, fmt.Errorf("invalid HTTP/2 flags: %w", err)
+	}
+	socketOpts := &greetworkload.SocketOptions{
+		Nagle:      !f.tcpNoDelay,
+		SendBuffer: f.sendBuffer,
+		RecvBuffer: f.recvBuffer,
+		KeepAlive:  time.Duration(f.keepAliveMillis) * time.Millisecond,
+	}
+	if err := socketOpts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid socket flags: %w", err)
+	}
+	var socks5 *greetworkload.SOCKS5Dialer
+	if f.socks5Proxy != "" {
+		if f.termination != "" || f.h2cUpgrade || f.warmCold || f.churnRate > 0 || f.dialRaceStaggerMillis > 0 {
+			return nil, badFlags("-socks5_proxy dials the connections shared by calls, it does not apply to -termination, -h2c_upgrade, -warm_cold, -churn_rate or -dial_race_stagger_millis")
+		}
+		var err error
+		socks5, err = greetworkload.NewSOCKS5Dialer(&greetworkload.SOCKS5Options{
+			Address:        f.socks5Proxy,
+			Username:       f.socks5Username,
+			Password:       f.socks5Password,
+			ConnectTimeout: f.socks5ConnectTimeout,
+			Dial:           socketOpts.Dial,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid socks5 flags: %w", err)
+		}
+	}
+	keepaliveOpts := &greetworkload.KeepaliveOptions{
+		Time:                time.Duration(f.pingMillis) * time.Millisecond,
+		PermitWithoutStream: f.pingWithoutCalls,
+	}
+	if err := keepaliveOpts.Validate(false); err != nil {
+		return nil, fmt.Errorf("invalid keepalive flags: %w", err)
+	}
+	if keepaliveOpts.Time > 0 {
+		log.Printf("Pinging idle connections every %v", keepaliveOpts.ClientTime())
+	}
+	var otel greetworkload.SpanTracer
+	if f.otelOut != "" {
+		if newSpanTracer == nil {
+			return nil, fmt.Errorf("invalid otel flags: %w", badFlags("this binary was built without OpenTelemetry"))
+		}
+		var err error
+		otel, err = newSpanTracer(f.otelOut, "greet_client")
+		if err != nil {
+			return nil, fmt.Errorf("invalid otel flags: %w", err)
+		}
+	}
+	var binMetadata *greetworkload.BinaryMetadata
+	if f.binMetadataCount > 0 {
+		binOpts := &greetworkload.BinaryMetadataOptions{
+			Count: f.binMetadataCount,
+			Size:  f.binMetadataBytes,
+			Echo:  f.binMetadataEcho,
+			Seed:  f.seed,
+		}
+		var err error
+		if binMetadata, err = greetworkload.NewBinaryMetadata(binOpts); err != nil {
+			return nil, err
+		}
+		log.Printf("Sending %d binary metadata entries of %d bytes with every call, %d bytes of header list", binOpts.Count, binOpts.Size, binOpts.HeaderListSize())
+	} else if f.binMetadataEcho {
+		return nil, badFlags("-bin_metadata_echo requires -bin_metadata_count")
+	}
+	var trailerBloat *greetworkload.TrailerBloat
+	if f.trailerBloatCount > 0 {
+		var err error
+		if trailerBloat, err = greetworkload.NewTrailerBloat(&greetworkload.TrailerBloatOptions{Count: f.trailerBloatCount, Size: f.trailerBloatBytes}); err != nil {
+			return nil, err
+		}
+	}
+	var sealer *greetworkload.PayloadSealer
+	if f.payloadKey != "" {
+		if f.termination != "" || f.h2cUpgrade || f.invoke != "" {
+			return nil, badFlags("-payload_key seals the calls made over gRPC connections, it does not apply to -termination, -h2c_upgrade or -invoke")
+		}
+		key, err := greetworkload.ParsePayloadKey(f.payloadKey)
+		if err == nil {
+			sealer, err = greetworkload.NewPayloadSealer(key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload flags: %w", err)
+		}
+	}
+	if f.hedgeDelay > 0 && f.retries {
+		return nil, badFlags("-hedge_delay and -retries cannot be combined, as gRPC does not combine hedging and retries either")
+	}
+	var wireSampler *greetworkload.WireSampler
+	if f.wireSampleEvery > 0 {
+		if f.termination != "" || f.h2cUpgrade {
+			return nil, badFlags("-wire_sample_every samples the calls made over gRPC connections, it does not apply to -termination or -h2c_upgrade")
+		}
+		var err error
+		wireSampler, err = greetworkload.NewWireSampler(&greetworkload.WireSamplerOptions{
+			Every:    f.wireSampleEvery,
+			Dir:      f.wireSampleDir,
+			MaxBytes: f.wireSampleMaxBytes,
+			Seed:     f.seed,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid wire sample flags: %w", err)
+		}
+	} else if f.wireSampleDir != "" || f.wireSampleMaxBytes != 0 {
+		return nil, badFlags("-wire_sample_dir and -wire_sample_max_bytes require -wire_sample_every")
+	}
+	var authorities []string
+	if f.authority != "" {
+		if f.termination != "" || f.h2cUpgrade {
+			return nil, badFlags("-authority sets the :authority of the calls made over gRPC connections, it does not apply to -termination or -h2c_upgrade")
+		}
+		authorities = strings.Split(f.authority, ",")
+		if len(authorities) > 1 && strings.Contains(f.address, ",") {
+			return nil, badFlags("several -authority values need a single -address")
+		}
+	}
+	var breaker *greetworkload.CircuitBreaker
+	if f.breakerThreshold > 0 {
+		var err error
+		breaker, err = greetworkload.NewCircuitBreaker(&greetworkload.BreakerOptions{
+			Threshold:    f.breakerThreshold,
+			OpenDuration: time.Duration(f.breakerOpenMillis) * time.Millisecond,
+			Probes:       f.breakerProbes,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid breaker flags: %w", err)
+		}
+	} else if f.breakerFile != "" {
+		return nil, badFlags("-breaker_file requires -breaker_threshold")
+	}
+	return &greetworkload.ClientOptions{
+		Compression:        f.compression,
+		HTTPS:              f.https,
+		TLS:                tlsOpts,
+		ClientCert:         clientCertReloader,
+		Timeout:            time.Duration(f.timeoutMillis) * time.Millisecond,
+		DialTimeout:        time.Duration(f.dialTimeoutMillis) * time.Millisecond,
+		HeaderTimeout:      time.Duration(f.headerTimeoutMillis) * time.Millisecond,
+		CancelFraction:     f.cancelFraction,
+		CancelWindow:       time.Duration(f.cancelWindowMillis) * time.Millisecond,
+		Seed:               f.seed,
+		StreamCount:        int32(f.streamCount),
+		RecvInterval:       time.Duration(f.recvIntervalMillis) * time.Millisecond,
+		VerifyChecksums:    f.verifyChecksums,
+		Retries:            f.retries,
+		HedgeDelay:         f.hedgeDelay,
+		SizedCodec:         f.sizedCodec,
+		DeterministicCodec: f.deterministicCodec,
+		HTTP2:              http2Settings,
+		Authorities:        authorities,
+		Breaker:            breaker,
+		Keepalive:          keepaliveOpts,
+		Socket:             socketOpts,
+		SOCKS5:             socks5,
+		OTel:               otel,
+		BinaryMetadata:     binMetadata,
+		TrailerBloat:       trailerBloat,
+		Sealer:             sealer,
+		WireSampler:        wireSampler,
+	}, nil
+}
+
+// callOptions returns the options of the calls of the default mode, or an error if the flags that
+// pick them do not go together.
+func (f *clientFlags) callOptions() (*callOptions, error) {
+	switch f.termination {
+	case "":
+	case greetworkload.TerminationReset:
+		if f.clientStreaming || f.serverStreaming || f.bidirStreaming || f.h2cUpgrade {
+			return nil, badFlags("-termination=reset only applies to unary calls")
+		}
+	case greetworkload.TerminationHalfClose:
+		if !f.serverStreaming {
+			return nil, badFlags("-termination=half_close requires -server_streaming")
+		}
+	default:
+		return nil, fmt.Errorf("unknown -termination %q", f.termination)
+	}
+	if f.sharedConn && (f.termination != "" || f.h2cUpgrade) {
+		return nil, badFlags("-shared_conn does not apply to -termination and -h2c_upgrade, which set up a connection per call")
+	}
+	if f.unimplemented != "" {
+		if err := greetworkload.CheckUnimplementedMode(f.unimplemented); err != nil {
+			return nil, fmt.Errorf("invalid -unimplemented: %w", err)
+		}
+		if f.clientStreaming || f.serverStreaming || f.bidirStreaming || f.h2cUpgrade || f.termination != "" {
+			return nil, badFlags("-unimplemented only applies to unary calls over a gRPC connection")
+		}
+	}
+	if f.warmCold {
+		if f.clientStreaming || f.serverStreaming || f.bidirStreaming || f.h2cUpgrade || f.termination != "" || f.unimplemented != "" {
+			return nil, badFlags("-warm_cold only applies to SayHello calls over a gRPC connection")
+		}
+		if f.sharedConn || strings.Contains(f.address, ",") {
+			return nil, badFlags("-warm_cold sets up its own connections, it does not apply to -shared_conn or several addresses")
+		}
+	}
+	if f.termination != "" && strings.Contains(f.address, ",") {
+		return nil, badFlags("-termination does not support several addresses")
+	}
+	if f.clockSyncMillis > 0 && strings.Contains(f.address, ",") {
+		return nil, badFlags("-clock_sync_interval_millis does not support several addresses")
+	}
+
+	opts := &callOptions{}
+	if f.maxInFlight > 0 {
+		if f.clientStreaming || f.serverStreaming || f.bidirStreaming || f.termination != "" || f.h2cUpgrade || f.unimplemented != "" || f.warmCold || f.churnRate > 0 || f.payloadSize != "" || f.once {
+			return nil, badFlags("-max_inflight makes SayHello calls greeting -name over a single connection, it does not apply to flags that pick other calls or connections")
+		}
+	}
+	if f.loadProfile != "" {
+		if f.clientStreaming || f.serverStreaming || f.bidirStreaming || f.termination != "" || f.h2cUpgrade || f.unimplemented != "" || f.warmCold || f.churnRate > 0 || f.payloadSize != "" || f.once || f.maxInFlight > 0 || f.burstSize > 0 {
+			return nil, badFlags("-load_profile makes SayHello calls greeting -name over a single connection, it does not apply to flags that pick other calls or connections")
+		}
+		var err error
+		if opts.profile, err = greetworkload.ParseLoadProfile(f.loadProfile); err != nil {
+			return nil, fmt.Errorf("invalid -load_profile: %w", err)
+		}
+	} else if f.qpsFile != "" {
+		return nil, badFlags("-qps_file only applies to -load_profile")
+	}
+	if f.targetP99 > 0 {
+		if f.clientStreaming || f.serverStreaming || f.bidirStreaming || f.termination != "" || f.h2cUpgrade || f.unimplemented != "" || f.warmCold || f.churnRate > 0 || f.payloadSize != "" || f.once || f.maxInFlight > 0 || f.burstSize > 0 || f.loadProfile != "" {
+			return nil, badFlags("-target_p99 makes SayHello calls greeting -name over a single connection, it does not apply to flags that pick other calls or connections")
+		}
+		opts.adaptive = &greetworkload.AdaptiveOptions{
+			TargetP99:      f.targetP99,
+			Duration:       f.asyncDuration,
+			Interval:       f.adaptiveInterval,
+			MaxConcurrency: f.adaptiveMaxInFlight,
+		}
+		if err := opts.adaptive.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid -target_p99 flags: %w", err)
+		}
+	} else if f.adaptiveFile != "" {
+		return nil, badFlags("-adaptive_file only applies to -target_p99")
+	}
+	if f.burstSize > 0 {
+		if f.clientStreaming || f.serverStreaming || f.bidirStreaming || f.termination != "" || f.h2cUpgrade || f.unimplemented != "" || f.warmCold || f.churnRate > 0 || f.payloadSize != "" || f.once || f.maxInFlight > 0 || f.replay != "" {
+			return nil, badFlags("-burst_size makes SayHello calls greeting -name over connections set up beforehand, it does not apply to flags that pick other calls or connections")
+		}
+		if f.burstIntervalMillis < 0 {
+			return nil, badFlags("-burst_interval_millis must not be negative")
+		}
+	}
+	if f.methodMix != "" {
+		if f.clientStreaming || f.serverStreaming || f.bidirStreaming || f.termination != "" || f.h2cUpgrade || f.unimplemented != "" || f.warmCold || f.churnRate > 0 ||
+			f.maxInFlight > 0 || f.loadProfile != "" || f.targetP99 > 0 || f.burstSize > 0 || f.replay != "" || f.mode != "" || f.invoke != "" {
+			return nil, badFlags("-method_mix picks the method of every call, it does not apply to flags that pick the calls to make or run calls concurrently")
+		}
+		weights, err := greetworkload.ParseMethodMix(f.methodMix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -method_mix: %w", err)
+		}
+		if opts.mix, err = greetworkload.NewMethodMix(weights, f.seed); err != nil {
+			return nil, err
+		}
+	}
+	if f.dialTimeoutMillis < 0 || f.headerTimeoutMillis < 0 {
+		return nil, badFlags("-dial_timeout_millis and -header_timeout_millis must not be negative")
+	}
+	if f.batchSize < 0 {
+		return nil, badFlags(fmt.Sprintf("-batch_size must not be negative, got %d", f.batchSize))
+	}
+	if f.batchSize > 0 {
+		if f.clientStreaming || f.serverStreaming || f.bidirStreaming || f.termination != "" || f.h2cUpgrade || f.unimplemented != "" || f.warmCold || f.churnRate > 0 ||
+			f.maxInFlight > 0 || f.loadProfile != "" || f.targetP99 > 0 || f.burstSize > 0 || f.replay != "" || f.mode != "" || f.invoke != "" || f.methodMix != "" ||
+			f.hedgeDelay > 0 || f.payloadKey != "" {
+			return nil, badFlags("-batch_size batches the SayHello calls made one after the other, it does not apply to flags that pick other calls or run calls concurrently, or to -hedge_delay or -payload_key")
+		}
+	}
+	if f.payloadSize != "" {
+		size, err := payloadgen.ParseSizeDist(f.payloadSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -payload_size: %w", err)
+		}
+		opts.gen, err = payloadgen.New(&payloadgen.Options{Seed: f.payloadSeed, Alphabet: f.payloadAlphabet, Size: size})
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload flags: %w", err)
+		}
+	}
+	return opts, nil
+}
+
+// checkModeFlags returns an error if the flags do not go with -mode.
+func (f *clientFlags) checkModeFlags() error {
+	if f.channelzFile != "" && (f.churnRate > 0 || f.mode != "" || f.replay != "") {
+		return badFlags("-channelz_file does not apply to -churn_rate, -mode or -replay, whose connections are all closed once their calls are done")
+	}
+	switch f.mode {
+	case "":
+		if f.tlsAddress != "" || f.quick {
+			return badFlags("-tls_address and -quick only apply to -mode matrix")
+		}
+	case modeMatrix:
+		if f.https || f.compression || f.clientStreaming || f.serverStreaming || f.bidirStreaming || f.termination != "" || f.h2cUpgrade || f.unimplemented != "" || f.warmCold || f.churnRate > 0 ||
+			f.payloadSize != "" || f.once || f.maxInFlight > 0 || f.targetP99 > 0 || f.replay != "" || f.burstSize > 0 || f.invoke != "" || f.chaosProbability > 0 {
+			return badFlags("-mode matrix picks the method, transport, compression and payload of every call itself, it does not apply to flags that pick calls or connections, or to -chaos_probability")
+		}
+		if f.tlsAddress == "" || strings.Contains(f.address, ",") {
+			return badFlags("-mode matrix needs a single -address and a -tls_address")
+		}
+	case modeConformance:
+		if f.tlsAddress != "" || f.quick {
+			return badFlags("-tls_address and -quick only apply to -mode matrix")
+		}
+		if f.clientStreaming || f.serverStreaming || f.bidirStreaming || f.termination != "" || f.h2cUpgrade || f.unimplemented != "" || f.warmCold || f.churnRate > 0 ||
+			f.payloadSize != "" || f.once || f.maxInFlight > 0 || f.targetP99 > 0 || f.replay != "" || f.burstSize > 0 || f.invoke != "" || f.chaosProbability > 0 {
+			return badFlags("-mode conformance picks the calls it makes itself, it does not apply to flags that pick calls or connections, or to -chaos_probability")
+		}
+		if strings.Contains(f.address, ",") {
+			return badFlags("-mode conformance needs a single -address")
+		}
+		if f.conformanceDeadlineMillis < 0 {
+			return badFlags("-conformance_deadline_millis must not be negative")
+		}
+	case modeHTTP3:
+		if f.tlsAddress != "" || f.quick {
+			return badFlags("-tls_address and -quick only apply to -mode matrix")
+		}
+		if f.https || f.compression || f.clientStreaming || f.serverStreaming || f.bidirStreaming || f.termination != "" || f.h2cUpgrade || f.unimplemented != "" || f.warmCold || f.churnRate > 0 ||
+			f.payloadSize != "" || f.once || f.maxInFlight > 0 || f.targetP99 > 0 || f.replay != "" || f.burstSize > 0 || f.invoke != "" || f.chaosProbability > 0 {
+			return badFlags("-mode http3 makes unary SayHello calls over QUIC with TLS, it does not apply to flags that pick calls or connections, or to -chaos_probability")
+		}
+		if strings.Contains(f.address, ",") {
+			return badFlags("-mode http3 needs a single -address")
+		}
+	default:
+		return badFlags(fmt.Sprintf("unknown -mode %q", f.mode))
+	}
+	if f.mode != modeConformance && f.conformanceDeadlineMillis != 0 {
+		return badFlags("-conformance_deadline_millis only applies to -mode conformance")
+	}
+	return nil
+}
+
+// checkHeartbeatFlags returns an error if the flags do not go with -heartbeat_streams.
+func (f *clientFlags) checkHeartbeatFlags() error {
+	if f.heartbeatStreams > 0 {
+		if f.clientStreaming || f.serverStreaming || f.bidirStreaming || f.termination != "" || f.h2cUpgrade || f.unimplemented != "" || f.warmCold || f.churnRate > 0 ||
+			f.maxInFlight > 0 || f.loadProfile != "" || f.targetP99 > 0 || f.burstSize > 0 || f.replay != "" || f.mode != "" || f.invoke != "" || f.methodMix != "" || strings.Contains(f.address, ",") {
+			return badFlags("-heartbeat_streams holds calls of its own over a single connection, it does not apply to flags that pick other calls or connections, or to several addresses")
+		}
+	} else if f.heartbeatCheckpointFile != "" {
+		return badFlags("-heartbeat_checkpoint_file requires -heartbeat_streams")
+	}
+	return nil
+}
+
+// uploadOptions returns the options of the upload of -upload_bytes and -upload_duration, or nil if
+// neither is set.
+func (f *clientFlags) uploadOptions() (*greetworkload.UploadOptions, error) {
+	if f.uploadBytes <= 0 && f.uploadDuration <= 0 {
+		return nil, nil
+	}
+	if f.heartbeatStreams > 0 || f.clientStreaming || f.serverStreaming || f.bidirStreaming || f.termination != "" || f.h2cUpgrade || f.unimplemented != "" || f.warmCold || f.churnRate > 0 ||
+		f.maxInFlight > 0 || f.loadProfile != "" || f.targetP99 > 0 || f.burstSize > 0 || f.replay != "" || f.mode != "" || f.invoke != "" || f.methodMix != "" || strings.Contains(f.address, ",") {
+		return nil, badFlags("-upload_bytes and -upload_duration make a call of their own over a single connection, they do not apply to flags that pick other calls or connections, or to several addresses")
+	}
+	opts := &greetworkload.UploadOptions{MessageSize: f.uploadMessageBytes, Duration: f.uploadDuration, Bytes: f.uploadBytes}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// escalationSchedule returns the payload sizes of -escalation_sizes, or nil if it is not set.
+func (f *clientFlags) escalationSchedule() ([]int, error) {
+	if f.escalationSizes == "" {
+		return nil, nil
+	}
+	if f.uploadBytes > 0 || f.uploadDuration > 0 || f.heartbeatStreams > 0 || f.clientStreaming || f.serverStreaming || f.bidirStreaming || f.termination != "" || f.h2cUpgrade || f.unimplemented != "" || f.warmCold || f.churnRate > 0 ||
+		f.maxInFlight > 0 || f.loadProfile != "" || f.targetP99 > 0 || f.burstSize > 0 || f.replay != "" || f.mode != "" || f.invoke != "" || f.methodMix != "" || strings.Contains(f.address, ",") {
+		return nil, badFlags("-escalation_sizes makes a call of its own over a single connection, it does not apply to flags that pick other calls or connections, or to several addresses")
+	}
+	sizes, err := greetworkload.ParseEscalationSchedule(f.escalationSizes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -escalation_sizes: %w", err)
+	}
+	return sizes, nil
+}
+
+// newChaos returns the Chaos of -chaos_probability, or nil if it is not set.
+func (f *clientFlags) newChaos() (*greetworkload.Chaos, error) {
+	if f.chaosProbability <= 0 {
+		return nil, nil
+	}
+	if f.https || f.termination != "" || f.h2cUpgrade || f.warmCold || f.churnRate > 0 {
+		return nil, badFlags("-chaos_probability corrupts cleartext HTTP/2 frames on the connections shared by calls, it does not apply to -https, -termination, -h2c_upgrade, -warm_cold or -churn_rate")
+	}
+	opts := &greetworkload.ChaosOptions{Probability: f.chaosProbability, DryRun: f.chaosDryRun}
+	if f.chaosCorruptions != "" {
+		opts.Corruptions = strings.Split(f.chaosCorruptions, ",")
+	}
+	chaos, err := greetworkload.NewChaos(opts, f.seed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chaos flags: %w", err)
+	}
+	return chaos, nil
+}
+
+// newShaper returns the Shaper of -shape_bytes_per_second and -shape_delay_millis, or nil if
+// neither is set.
+func (f *clientFlags) newShaper() (*greetworkload.Shaper, error) {
+	if f.shapeBytesPerSecond <= 0 && f.shapeBurst <= 0 && f.shapeDelayMillis <= 0 {
+		return nil, nil
+	}
+	if f.termination != "" || f.h2cUpgrade || f.warmCold || f.churnRate > 0 {
+		return nil, badFlags("-shape_bytes_per_second and -shape_delay_millis shape the connections shared by calls, they do not apply to -termination, -h2c_upgrade, -warm_cold or -churn_rate")
+	}
+	shaper, err := greetworkload.NewShaper(&greetworkload.ShapingOptions{
+		BytesPerSecond: f.shapeBytesPerSecond,
+		Burst:          f.shapeBurst,
+		Delay:          time.Duration(f.shapeDelayMillis) * time.Millisecond,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid shaping flags: %w", err)
+	}
+	return shaper, nil
+}
+
+// checkReplayFlags returns an error if the flags do not go with -replay.
+func (f *clientFlags) checkReplayFlags() error {
+	if f.replay == "" {
+		return nil
+	}
+	if f.clientStreaming || f.serverStreaming || f.bidirStreaming || f.termination != "" || f.h2cUpgrade || f.unimplemented != "" || f.warmCold || f.churnRate > 0 {
+		return badFlags("-replay makes the calls recorded, it does not apply to flags that pick the calls to make")
+	}
+	if strings.Contains(f.address, ",") {
+		return badFlags("-replay does not support several addresses")
+	}
+	return nil
+}
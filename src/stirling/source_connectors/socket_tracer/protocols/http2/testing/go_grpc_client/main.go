@@ -20,191 +20,1015 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/credentials/insecure"
-	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/status"
 
-	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/payloadgen"
 )
 
-func getDialOpts(compression, https bool) []grpc.DialOption {
-	dialOpts := make([]grpc.DialOption, 0)
+// newSpanTracer creates the greetworkload.SpanTracer of -otel_out, exporting the spans of the
+// process named serviceName. It is nil in the binaries built without otel.go, such as those built
+// with Go releases the OpenTelemetry SDK does not support.
+var newSpanTracer func(out, serviceName string) (greetworkload.SpanTracer, error)
 
-	if compression {
-		dialOpts = append(dialOpts, grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)))
-	}
-
-	if https {
-		tlsConfig := &tls.Config{InsecureSkipVerify: true}
-		creds := credentials.NewTLS(tlsConfig)
-		dialOpts = append(dialOpts, grpc.WithTransportCredentials(creds))
-	} else {
-		dialOpts = append(dialOpts, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	}
+// fatal logs err and exits with the code greetworkload.ExitCode maps it to.
+func fatal(err error) {
+	log.Print(err)
+	os.Exit(greetworkload.ExitCode(err))
+}
 
-	return dialOpts
+// badFlags returns a greetworkload.ErrBadFlagCombination with msg.
+func badFlags(msg string) error {
+	return fmt.Errorf("%w: %s", greetworkload.ErrBadFlagCombination, msg)
 }
 
-func mustCreateGrpcClientConn(address string, compression, https bool) *grpc.ClientConn {
+func mustCreateGrpcClientConn(c *greetworkload.Client, address string, opts ...grpc.DialOption) *grpc.ClientConn {
 	// Set up a connection to the server.
-	var conn *grpc.ClientConn
-	var err error
-	conn, err = grpc.Dial(address, getDialOpts(compression, https)...)
+	conn, err := c.Dial(address, opts...)
 	if err != nil {
-		log.Fatalf("did not connect: %v", err)
+		fatal(err)
 	}
 	return conn
 }
 
-func streamGreet(address string, compression, https bool, name string) {
-	conn := mustCreateGrpcClientConn(address, compression, https)
+// exitInvalidInput is the exit code for an unknown --invoke method or malformed --data. It is above
+// every gRPC status code, so that it is not mistaken for the server rejecting the call.
+const exitInvalidInput = 64
 
-	defer conn.Close()
+// The -modes: modeMatrix runs greetworkload.RunMatrix, modeConformance
+// greetworkload.Client.RunConformance, and modeHTTP3 greetworkload.Client.SayHelloHTTP3.
+const (
+	modeMatrix      = "matrix"
+	modeConformance = "conformance"
+	modeHTTP3       = "http3"
+)
 
-	c := pb.NewStreamingGreeterClient(conn)
+// invokeMethod calls method with the JSON requests in data, or on stdin, and returns the process
+// exit code: the gRPC status code of the call, or exitInvalidInput.
+func invokeMethod(c *greetworkload.Client, address, method, data string, timeout time.Duration) int {
+	conn := mustCreateGrpcClientConn(c, address)
+	defer conn.Close()
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	in := io.Reader(os.Stdin)
+	if data != "" {
+		in = strings.NewReader(data)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
+	if err := greetworkload.Invoke(ctx, conn, method, in, os.Stdout); err != nil {
+		var inputErr *greetworkload.InvokeInputError
+		if errors.As(err, &inputErr) {
+			log.Printf("Invalid --invoke input: %v", err)
+			return exitInvalidInput
+		}
+		log.Printf("%s failed, error: %v", method, err)
+		return int(status.Code(err))
+	}
+	return 0
+}
 
-	stream, err := c.SayHelloServerStreaming(ctx, &pb.HelloRequest{Name: name})
+func main() {
+	f := parseFlags()
+	r, err := newRun(f, greetworkload.NewRunMetadata(f.seed, flag.CommandLine))
 	if err != nil {
-		log.Fatalf("Failed to make streaming RPC call SayHelloServerStreaming(), error: %v", err)
+		fatal(err)
+	}
+	if f.invoke != "" {
+		os.Exit(invokeMethod(r.c, f.address, f.invoke, f.data, r.opts.Timeout))
+	}
+	if err := r.start(); err != nil {
+		fatal(err)
 	}
-	for {
-		item, err := stream.Recv()
-		if err == io.EOF {
-			break
+
+	switch {
+	case f.churnRate > 0:
+		r.churn()
+	case f.heartbeatStreams > 0:
+		r.heartbeats()
+	case r.uploadOpts != nil:
+		r.upload()
+	case r.escalation != nil:
+		r.escalate()
+	case f.mode == modeMatrix:
+		r.matrix()
+	case f.mode == modeConformance:
+		r.conformance()
+	case f.mode == modeHTTP3:
+		r.http3()
+	case f.replay != "":
+		r.replay()
+	default:
+		r.makeCalls()
+	}
+}
+
+// callOptions are the options of the default mode, which makes -count calls one after the other,
+// or the calls of -load_profile, -target_p99, -max_inflight or -burst_size.
+type callOptions struct {
+	// gen generates the names of the calls with -payload_size, instead of -name.
+	gen      *payloadgen.Generator
+	profile  *greetworkload.LoadProfile
+	adaptive *greetworkload.AdaptiveOptions
+	mix      *greetworkload.MethodMix
+}
+
+// run is the state the modes of the client share: the client, the options of the mode picked, and
+// the connections of the calls.
+type run struct {
+	f    *clientFlags
+	meta *greetworkload.RunMetadata
+	opts *greetworkload.ClientOptions
+	c    *greetworkload.Client
+
+	callOpts   *callOptions
+	uploadOpts *greetworkload.UploadOptions
+	escalation []int
+	chaos      *greetworkload.Chaos
+	shaper     *greetworkload.Shaper
+
+	// Set by start.
+	latencyOpts   *greetworkload.HistogramOptions
+	latencies     *greetworkload.LatencyHistograms
+	connStats     *greetworkload.ConnStatsHandler
+	dialer        func(context.Context, string) (net.Conn, error)
+	stopClockSync func()
+}
+
+// newRun returns the run of the flags f, or an error if they do not go together.
+func newRun(f *clientFlags, meta *greetworkload.RunMetadata) (*run, error) {
+	r := &run{f: f, meta: meta}
+	var err error
+	if r.opts, err = f.clientOptions(); err != nil {
+		return nil, err
+	}
+	r.c = greetworkload.NewClient(r.opts)
+	if f.h2cUpgrade {
+		if err := r.c.CheckH2CUpgrade(); err != nil {
+			return nil, err
 		}
+	}
+	if r.callOpts, err = f.callOptions(); err != nil {
+		return nil, err
+	}
+	if err := f.checkModeFlags(); err != nil {
+		return nil, err
+	}
+	if err := f.checkHeartbeatFlags(); err != nil {
+		return nil, err
+	}
+	if r.uploadOpts, err = f.uploadOptions(); err != nil {
+		return nil, err
+	}
+	if r.escalation, err = f.escalationSchedule(); err != nil {
+		return nil, err
+	}
+	if r.chaos, err = f.newChaos(); err != nil {
+		return nil, err
+	}
+	if r.shaper, err = f.newShaper(); err != nil {
+		return nil, err
+	}
+	if err := f.checkReplayFlags(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// start sets up what the calls of every mode but -invoke go through: the latency histograms, the
+// dialer of their connections and the stats handler of those, the debug endpoint and clock sync.
+func (r *run) start() error {
+	f := r.f
+	r.latencyOpts = &greetworkload.HistogramOptions{
+		MaxValue:          (time.Duration(f.latencyMaxMillis) * time.Millisecond).Nanoseconds(),
+		SignificantDigits: f.latencyDigits,
+	}
+	var err error
+	if r.latencies, err = greetworkload.NewLatencyHistograms(r.latencyOpts); err != nil {
+		return fmt.Errorf("invalid latency histogram flags: %w", err)
+	}
+
+	if f.features {
+		logFeatures(r.c, strings.Split(f.address, ","), r.opts.Timeout)
+	}
+
+	r.connStats = greetworkload.NewConnStatsHandler()
+	if f.export != "" {
+		r.connStats.KeepRPCs()
+	}
+	dial := r.opts.Socket.Dial
+	if r.opts.SOCKS5 != nil {
+		dial = r.opts.SOCKS5.Dial
+	}
+	if f.dialRaceStaggerMillis > 0 {
+		racer, err := greetworkload.NewDialRacer(&greetworkload.DialRaceOptions{
+			Stagger: time.Duration(f.dialRaceStaggerMillis) * time.Millisecond,
+			Dial:    r.opts.Socket.Dial,
+		})
 		if err != nil {
-			log.Fatalf("SayHelloServerStreaming() failed, error: %v", err)
+			return err
 		}
-		log.Println(item.Message)
+		dial = racer.Dial
+	}
+	if r.shaper != nil {
+		dial = r.shaper.Dialer(dial)
+	}
+	// Only wrapped when the per-connection stats are read, as Stirling's Go uprobes only find the
+	// file descriptor of the net.Conn types of the standard library.
+	r.dialer = dial
+	if f.statsFile != "" || f.export != "" || f.debugAddr != "" || f.channelzFile != "" {
+		r.dialer = r.connStats.DialerFrom(dial)
+	}
+	if r.chaos != nil {
+		r.dialer = r.chaos.Dialer(r.dialer)
 	}
+	if f.debugAddr != "" {
+		go func() {
+			log.Printf("Serving debug endpoint on %s", f.debugAddr)
+			log.Fatal(http.ListenAndServe(f.debugAddr, greetworkload.NewDebugMux(r.connStats, flag.CommandLine)))
+		}()
+	}
+	r.stopClockSync = startClockSync(r.c, f.address, time.Duration(f.clockSyncMillis)*time.Millisecond, f.clockFile)
+	return nil
 }
 
-func clientStreamGreet(address string, compression, https bool, names []string) {
-	conn := mustCreateGrpcClientConn(address, compression, https)
+// dialOptions returns the options of the connections of the calls.
+func (r *run) dialOptions() []grpc.DialOption {
+	return []grpc.DialOption{grpc.WithStatsHandler(r.connStats), grpc.WithContextDialer(r.dialer)}
+}
 
-	defer conn.Close()
+// dial returns a new connection to -address.
+func (r *run) dial() *grpc.ClientConn {
+	return mustCreateGrpcClientConn(r.c, r.f.address, r.dialOptions()...)
+}
 
-	c := pb.NewStreamingGreeterClient(conn)
+// stop stops the clock sync and exports the spans not exported yet.
+func (r *run) stop() {
+	r.stopClockSync()
+	shutdownOTel(r.opts.OTel)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
+// writeRecords writes records to -output, if set.
+func (r *run) writeRecords(records []*greetworkload.CallRecord) {
+	if r.f.output == "" {
+		return
+	}
+	err := greetworkload.WriteOutputFile(r.f.output, func(w io.Writer) error {
+		return greetworkload.WriteRecords(w, r.meta, records)
+	})
+	if err != nil {
+		fatal(err)
+	}
+}
 
-	stream, err := c.SayHelloClientStreaming(ctx)
+// writeConnStats writes the connection stats to -stats_file and the calls to -export_file.
+func (r *run) writeConnStats() {
+	writeConnStats(r.f.statsFile, r.f.exportFile, r.meta, r.connStats)
+}
+
+// churn opens and closes connections at -churn_rate, and logs how they were closed.
+func (r *run) churn() {
+	f := r.f
+	if f.output != "" || f.latencyFile != "" {
+		log.Printf("Churned calls are not recorded, ignoring -output and -latency_file")
+	}
+	stats, err := r.c.Churn(context.Background(), f.address, &greetworkload.ChurnOptions{
+		Rate:         f.churnRate,
+		CallsPerConn: f.churnCalls,
+		Abortive:     f.abortive,
+		Duration:     f.churnDuration,
+	}, grpc.WithStatsHandler(r.connStats))
 	if err != nil {
-		log.Fatalf("Failed to make streaming RPC call SayHelloServerStreaming(), error: %v", err)
+		log.Fatalf("Churn failed, error: %v", err)
 	}
-	for _, name := range names {
-		if err := stream.Send(&pb.HelloRequest{Name: name}); err != nil {
-			if err == io.EOF {
-				break
-			}
-			log.Fatalf("Send(%v) failed, error: %v", name, err)
-		}
+	log.Printf("Opened %d connections, %d closed cleanly, %d reset, %d failed to close, %.2f RPCs per connection, %d failed RPCs",
+		stats.Opened, stats.ClosedCleanly, stats.Reset, stats.CloseErrors, stats.RPCsPerConn(), stats.FailedRPCs)
+	r.stop()
+	r.writeConnStats()
+}
+
+// heartbeats holds -heartbeat_streams open, and logs the heartbeats received over them.
+func (r *run) heartbeats() {
+	f := r.f
+	if f.output != "" || f.latencyFile != "" {
+		log.Printf("Heartbeat streams are not recorded, ignoring -output and -latency_file")
+	}
+	conn := r.dial()
+	checkpoint, err := r.c.Heartbeats(context.Background(), conn, &greetworkload.HeartbeatOptions{
+		Streams:            f.heartbeatStreams,
+		Duration:           f.heartbeatDuration,
+		CheckpointFile:     f.heartbeatCheckpointFile,
+		CheckpointInterval: f.heartbeatCheckpointInterval,
+	})
+	conn.Close()
+	r.stop()
+	r.writeConnStats()
+	if checkpoint != nil {
+		log.Printf("Received %d heartbeats over %d streams in %v", checkpoint.Heartbeats(), len(checkpoint.Streams), checkpoint.Time.Sub(checkpoint.Start).Round(time.Millisecond))
 	}
-	reply, err := stream.CloseAndRecv()
 	if err != nil {
-		log.Fatalf("Failed to close client stream, error: %v", err)
+		fatal(err)
 	}
-	log.Println(reply.Message)
 }
 
-func bidirStreamGreet(address string, compression, https bool, names []string) {
-	conn := mustCreateGrpcClientConn(address, compression, https)
+// upload makes the upload of -upload_bytes and -upload_duration. The run fails if the server did
+// not receive every byte sent.
+func (r *run) upload() {
+	if r.f.latencyFile != "" {
+		log.Printf("An upload is a single call, ignoring -latency_file")
+	}
+	conn := r.dial()
+	rec, result := r.c.Upload(context.Background(), conn, r.uploadOpts)
+	conn.Close()
+	r.stop()
+	r.writeRecords([]*greetworkload.CallRecord{rec})
+	r.writeConnStats()
+	if !rec.Completed() {
+		fatal(fmt.Errorf("upload failed after it %s: %s", result, rec.Error))
+	}
+	if !result.Reconciled() {
+		fatal(fmt.Errorf("the server received %d bytes of the %d uploaded", result.BytesReceived, result.BytesSent))
+	}
+}
 
-	defer conn.Close()
+// escalate makes the call of -escalation_sizes. The run fails with the first size that did not
+// come through intact.
+func (r *run) escalate() {
+	if r.f.latencyFile != "" {
+		log.Printf("An escalation is a single call, ignoring -latency_file")
+	}
+	conn := r.dial()
+	rec, result := r.c.Escalate(conn, r.escalation)
+	conn.Close()
+	r.stop()
+	r.writeRecords([]*greetworkload.CallRecord{rec})
+	r.writeConnStats()
+	if !result.OK() {
+		fatal(fmt.Errorf("escalation through %s failed: %s", greetworkload.FormatEscalationSchedule(r.escalation), result))
+	}
+}
 
-	c := pb.NewStreamingGreeterClient(conn)
+// matrix runs -mode matrix.
+func (r *run) matrix() {
+	f := r.f
+	err := runMatrix(&greetworkload.MatrixOptions{
+		Address:     f.address,
+		TLSAddress:  f.tlsAddress,
+		Count:       f.count,
+		Quick:       f.quick,
+		Client:      *r.opts,
+		Latency:     *r.latencyOpts,
+		DialOptions: r.dialOptions(),
+	})
+	r.stop()
+	r.writeConnStats()
+	if err != nil {
+		fatal(err)
+	}
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
+// conformance runs -mode conformance.
+func (r *run) conformance() {
+	conn := r.dial()
+	records, err := runConformance(r.c, conn, &greetworkload.ConformanceOptions{
+		Deadline: time.Duration(r.f.conformanceDeadlineMillis) * time.Millisecond,
+	})
+	conn.Close()
+	r.stop()
+	r.writeRecords(records)
+	r.writeConnStats()
+	if err != nil {
+		fatal(err)
+	}
+}
 
-	stream, err := c.SayHelloBidirStreaming(ctx)
+// http3 runs -mode http3.
+func (r *run) http3() {
+	f := r.f
+	conn, err := r.c.DialHTTP3(f.address)
 	if err != nil {
-		log.Fatalf("Failed to make streaming RPC call SayHelloServerStreaming(), error: %v", err)
+		fatal(err)
+	}
+	var records []*greetworkload.CallRecord
+	for i := 0; i < f.count; i++ {
+		rec := r.c.SayHelloHTTP3(conn, f.name)
+		if err := rec.Err(); err != nil {
+			fatal(err)
+		}
+		r.latencies.Record(rec)
+		records = append(records, rec)
+		time.Sleep(time.Duration(f.waitPeriodMills) * time.Millisecond)
+	}
+	conn.Close()
+	r.stop()
+	r.writeRecords(records)
+}
+
+// replay replays the calls of -replay.
+func (r *run) replay() {
+	f := r.f
+	replayCalls(r.c, f.address, f.replay, &greetworkload.ReplayOptions{
+		NoTiming:    f.noTiming,
+		Tolerance:   time.Duration(f.replayToleranceMillis) * time.Millisecond,
+		DialOptions: r.dialOptions(),
+	}, f.output, r.meta)
+	r.stop()
+	r.writeConnStats()
+}
+
+// makeCalls makes the calls of the default mode, logs a summary of them, and writes them and
+// their latencies to -output and -latency_file.
+func (r *run) makeCalls() {
+	f := r.f
+	var wc *greetworkload.WarmCold
+	if f.warmCold {
+		var err error
+		if wc, err = r.c.NewWarmCold(f.address, r.connStats); err != nil {
+			fatal(err)
+		}
 	}
-	for _, name := range names {
-		if err := stream.Send(&pb.HelloRequest{Name: name}); err != nil {
-			if err == io.EOF {
-				break
+	names := newCallNames(f.name, f.batchSize, r.callOpts.gen)
+	call := r.callFunc(wc, names)
+	newConn, closeConn, closeShared := r.conns(wc)
+
+	var records []*greetworkload.CallRecord
+	expected := make(map[string]int)
+	fn := func() {
+		conn := newConn()
+		defer closeConn(conn)
+
+		names.next()
+		rec := call(conn)
+		if f.clientStreaming || f.bidirStreaming || f.batchSize > 0 {
+			names.index += uint64(len(names.batch))
+		} else {
+			names.index++
+		}
+		if err := rec.Err(); err != nil {
+			switch {
+			case r.opts.Breaker != nil:
+				// Failures are what the breaker reacts to, and the calls it fails were never made.
+				log.Printf("Call failed with circuit breaker %s: %v", r.opts.Breaker.State(), err)
+			case rec.TooManyPings():
+				// The server closed the connection for the client's pings, and the next call
+				// reconnects. The summary counts these.
+				log.Printf("Call failed with a too_many_pings GOAWAY: %v", err)
+			case r.chaos == nil:
+				fatal(err)
+			default:
+				// Calls whose frames were corrupted are expected to fail.
+				log.Printf("Call failed with chaos: %v", err)
 			}
-			log.Fatalf("Send(%v) failed, error: %v", name, err)
 		}
-		reply, err := stream.Recv()
-		if err == io.EOF {
-			return
+		if rec.Expected() {
+			expected[rec.Code]++
+		}
+		records = append(records, rec)
+	}
+
+	runStart := time.Now()
+	switch {
+	case r.callOpts.profile != nil:
+		records = runProfile(r.c, newConn, closeConn, f.name, r.callOpts.profile, f.qpsFile)
+	case r.callOpts.adaptive != nil:
+		records = runAdaptive(r.c, newConn, closeConn, f.name, r.callOpts.adaptive, f.adaptiveFile)
+	case f.maxInFlight > 0:
+		records = runAsync(r.c, newConn, closeConn, f.name, &greetworkload.AsyncOptions{MaxInFlight: f.maxInFlight, Duration: f.asyncDuration})
+	case f.burstSize > 0:
+		records = runBursts(r.c, newConn, closeConn, f.name, f.burstSameConn, &greetworkload.BurstOptions{
+			Size:     f.burstSize,
+			Bursts:   f.count,
+			Interval: time.Duration(f.burstIntervalMillis) * time.Millisecond,
+		})
+	default:
+		count := f.count
+		if f.once {
+			count = 1
 		}
+		for i := 0; i < count; i++ {
+			fn()
+			if !f.once {
+				time.Sleep(time.Duration(f.waitPeriodMills) * time.Millisecond)
+			}
+		}
+	}
+	for _, rec := range records {
+		r.latencies.Record(rec)
+	}
+	runTime := time.Since(runStart)
+
+	if f.channelzFile != "" {
+		writeChannelz(f.channelzFile, r.connStats)
+	}
+	closeShared()
+	if wc != nil {
+		wc.Close()
+	}
+	r.stop()
+
+	r.logSummary(records, expected, runTime)
+	if f.latencyFile != "" {
+		err := greetworkload.WriteOutputFile(f.latencyFile, func(w io.Writer) error {
+			return greetworkload.WriteHistograms(w, r.latencies.Histograms())
+		})
 		if err != nil {
-			log.Fatalf("Failed to receive server stream, error: %v", err)
+			fatal(err)
 		}
-		log.Println(reply.Message)
 	}
-	err = stream.CloseSend()
+	r.writeRecords(records)
+	if f.breakerFile != "" {
+		err := greetworkload.WriteOutputFile(f.breakerFile, func(w io.Writer) error {
+			return greetworkload.WriteBreakerTransitions(w, r.meta, r.opts.Breaker.Transitions())
+		})
+		if err != nil {
+			fatal(err)
+		}
+	}
+	r.writeConnStats()
+}
+
+// callNames are the names of the next calls of the default mode: -name, or the names generated
+// with -payload_size from index on.
+type callNames struct {
+	// unary is the name of the next unary call, and batch those of the next streaming or batch call.
+	unary string
+	batch []string
+	index uint64
+	gen   *payloadgen.Generator
+}
+
+// newCallNames returns the callNames of calls greeting name, with batchSize names for batch calls
+// if positive, generated by gen if not nil.
+func newCallNames(name string, batchSize int, gen *payloadgen.Generator) *callNames {
+	n := &callNames{unary: name, batch: []string{name, name, name}, gen: gen}
+	if batchSize > 0 {
+		n.batch = make([]string, batchSize)
+		for i := range n.batch {
+			n.batch[i] = name
+		}
+	}
+	return n
+}
+
+// next generates the names of the next call, if generated.
+func (n *callNames) next() {
+	if n.gen == nil {
+		return
+	}
+	for i := range n.batch {
+		n.batch[i] = n.gen.Name(n.index + uint64(i))
+	}
+	n.unary = n.batch[0]
+}
+
+// callFunc returns the function that makes a call of the default mode with the names of names, over
+// the connection it is given, or one of its own.
+func (r *run) callFunc(wc *greetworkload.WarmCold, names *callNames) func(conn *grpc.ClientConn) *greetworkload.CallRecord {
+	f, c := r.f, r.c
+	switch {
+	case wc != nil:
+		return func(*grpc.ClientConn) *greetworkload.CallRecord { return wc.Call(names.unary) }
+	case f.termination == greetworkload.TerminationReset:
+		return func(*grpc.ClientConn) *greetworkload.CallRecord {
+			return c.SayHelloReset(f.address, names.unary, r.connStats)
+		}
+	case f.termination == greetworkload.TerminationHalfClose:
+		return func(*grpc.ClientConn) *greetworkload.CallRecord {
+			return c.ServerStreamingHalfClose(f.address, names.unary, r.connStats)
+		}
+	case f.clientStreaming:
+		return func(conn *grpc.ClientConn) *greetworkload.CallRecord { return c.ClientStreaming(conn, names.batch) }
+	case f.serverStreaming:
+		return func(conn *grpc.ClientConn) *greetworkload.CallRecord { return c.ServerStreaming(conn, names.unary) }
+	case f.bidirStreaming:
+		return func(conn *grpc.ClientConn) *greetworkload.CallRecord { return c.BidirStreaming(conn, names.batch) }
+	case f.unimplemented != "":
+		return func(conn *grpc.ClientConn) *greetworkload.CallRecord {
+			return c.CallUnimplemented(conn, f.unimplemented, names.unary)
+		}
+	case f.h2cUpgrade:
+		return func(*grpc.ClientConn) *greetworkload.CallRecord { return c.SayHelloH2CUpgrade(f.address, names.unary) }
+	case r.callOpts.mix != nil:
+		return func(conn *grpc.ClientConn) *greetworkload.CallRecord {
+			return r.callOpts.mix.Call(c, conn, names.unary)
+		}
+	case f.batchSize > 0:
+		return func(conn *grpc.ClientConn) *greetworkload.CallRecord {
+			return c.SayHelloBatch(conn, append([]string(nil), names.batch...))
+		}
+	default:
+		return func(conn *grpc.ClientConn) *greetworkload.CallRecord { return c.SayHello(conn, names.unary) }
+	}
+}
+
+// conns returns the functions that get the connection of the next call of the default mode, close
+// it once the call is done, and close the connections shared by the calls once they are all done.
+//
+// A single address gets a new connection per call, unless -shared_conn is set. Several addresses
+// share one connection that balances calls across them in round-robin order.
+func (r *run) conns(wc *greetworkload.WarmCold) (func() *grpc.ClientConn, func(*grpc.ClientConn), func()) {
+	f := r.f
+	noClose := func(*grpc.ClientConn) {}
+	backends := strings.Split(f.address, ",")
+	switch {
+	case f.h2cUpgrade || f.termination != "" || wc != nil:
+		// Every call sets up its own connection.
+		return func() *grpc.ClientConn { return nil }, noClose, func() {}
+	case len(backends) > 1:
+		conn, err := r.c.DialBackends(greetworkload.NewBackendResolver(backends), r.dialOptions()...)
+		if err != nil {
+			fatal(err)
+		}
+		return func() *grpc.ClientConn { return conn }, noClose, func() { conn.Close() }
+	case f.sharedConn && len(r.opts.Authorities) > 1:
+		conns, err := r.c.DialAuthorities(f.address, r.opts.Authorities, r.dialOptions()...)
+		if err != nil {
+			fatal(err)
+		}
+		return conns.Next, noClose, conns.Close
+	case f.sharedConn:
+		conn := r.dial()
+		return func() *grpc.ClientConn { return conn }, noClose, func() { conn.Close() }
+	default:
+		return r.dial, func(conn *grpc.ClientConn) { conn.Close() }, func() {}
+	}
+}
+
+// logSummary logs how the calls of the default mode went, from records, the calls that failed as
+// expected by code, and runTime.
+func (r *run) logSummary(records []*greetworkload.CallRecord, expected map[string]int, runTime time.Duration) {
+	f, c, opts := r.f, r.c, r.opts
+	if f.verifyChecksums {
+		log.Printf("%d checksum mismatches", c.ChecksumMismatches())
+	}
+	if opts.BinaryMetadata != nil {
+		log.Printf("Binary metadata: %d calls verified, %d mismatched", opts.BinaryMetadata.Verified(), opts.BinaryMetadata.Mismatches())
+	}
+	if opts.TrailerBloat != nil {
+		log.Printf("Trailer bloat: %d calls verified, %d mismatched", opts.TrailerBloat.Verified(), opts.TrailerBloat.Mismatches())
+	}
+	if opts.Sealer != nil {
+		log.Printf("Sealed payloads that failed authentication: %d", opts.Sealer.AuthFailures())
+	}
+	if opts.WireSampler != nil {
+		log.Printf("Wire samples: %d spooled to %s, %d dropped", opts.WireSampler.Sampled(), f.wireSampleDir, opts.WireSampler.Dropped())
+	}
+	if f.hedgeDelay > 0 {
+		h := c.HedgeStats()
+		log.Printf("Hedging: %d logical calls, %d attempts on the wire, %d calls hedged, %d won by the hedge, %d attempts cancelled", h.Calls, h.Attempts, h.Hedges, h.HedgeWins, h.Cancelled)
+	}
+	if f.batchSize > 0 {
+		// Calls and requests are counted apart, as a call carries -batch_size logical requests.
+		b := c.BatchStats()
+		log.Printf("Batches: %d calls, %d failed, at %.1f calls/s; %d requests, %d failed in their results, at %.1f requests/s",
+			b.Calls, b.FailedCalls, float64(b.Calls)/runTime.Seconds(), b.Requests, b.FailedRequests, float64(b.Requests)/runTime.Seconds())
+	}
+	if t := c.TimeoutStats(); t.Dial+t.Header+t.Deadline > 0 {
+		log.Printf("Timeouts: %d calls exceeded the dial budget, %d the header budget, %d their deadline", t.Dial, t.Header, t.Deadline)
+	}
+	if hits, misses := c.CacheCounts(); hits+misses > 0 {
+		log.Printf("Reply cache: %d hits, %d misses", hits, misses)
+	}
+	if opts.ClientCert != nil {
+		log.Printf("TLS handshakes by client certificate serial: %s", greetworkload.FormatSerialCounts(opts.ClientCert.Handshakes()))
+	}
+	if r.chaos != nil && f.chaosDryRun {
+		log.Printf("%d frames would have been corrupted", len(r.chaos.Events()))
+	} else if r.chaos != nil {
+		log.Printf("%d frames corrupted", len(r.chaos.Events()))
+	}
+	for code, n := range expected {
+		log.Printf("%d calls failed with %s as expected", n, code)
+	}
+	if opts.Breaker != nil {
+		log.Printf("Circuit breaker: %d transitions, %d calls failed while open, now %s", len(opts.Breaker.Transitions()), opts.Breaker.Rejected(), opts.Breaker.State())
+	}
+	for _, e := range greetworkload.TooManyPingsEvents(records) {
+		log.Printf("A too_many_pings GOAWAY at %s failed %d calls, of %d in flight", e.Time.Format(time.RFC3339Nano), e.Failed, e.InFlight)
+	}
+	if r.callOpts.mix != nil {
+		log.Printf("Calls by method: %s", greetworkload.FormatSerialCounts(r.callOpts.mix.Counts()))
+	}
+
+	for id, n := range greetworkload.TallyInstances(records) {
+		if id != "" {
+			log.Printf("Instance %s answered %d calls", id, n)
+		}
+	}
+
+	var table strings.Builder
+	if err := greetworkload.WritePercentiles(&table, r.latencies.Histograms(), greetworkload.DefaultPercentiles); err == nil {
+		log.Printf("Latency percentiles of completed calls:\n%s", table.String())
+	}
+	if deltas := greetworkload.HandshakeOverhead(r.latencies.Histograms(), "SayHello", greetworkload.DefaultPercentiles); deltas != nil {
+		var overhead strings.Builder
+		for _, d := range deltas {
+			fmt.Fprintf(&overhead, "  p%-6v %12v %+12v\n", d.Percentile, time.Duration(d.Other), time.Duration(d.Delta))
+		}
+		log.Printf("Latency of cold calls, and how it differs from warm ones:\n%s", overhead.String())
+	}
+}
+
+// writeChannelz writes a channelz snapshot of the client to path, and logs where its socket
+// counters disagree with connStats.
+func writeChannelz(path string, connStats *greetworkload.ConnStatsHandler) {
+	snap, err := greetworkload.LocalChannelz(context.Background())
 	if err != nil {
-		log.Fatalf("Failed to close send")
+		fatal(err)
+	}
+	for _, diff := range greetworkload.CompareChannelz(snap, connStats.Conns()) {
+		log.Printf("Channelz disagrees with the stats handler: %s", diff)
+	}
+	err = greetworkload.WriteOutputFile(path, func(w io.Writer) error {
+		return greetworkload.WriteChannelzSnapshot(w, snap)
+	})
+	if err != nil {
+		fatal(err)
 	}
 }
 
-func connectAndGreet(address string, compression, https bool, name string) {
-	// Set up a connection to the server.
-	conn := mustCreateGrpcClientConn(address, compression, https)
+// logFeatures logs the FeatureMatrix of the server at every address, over a connection of its own.
+// Servers that do not report one are logged as such rather than ending the run.
+func logFeatures(c *greetworkload.Client, addresses []string, timeout time.Duration) {
+	for _, address := range addresses {
+		conn := mustCreateGrpcClientConn(c, address)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		m, err := greetworkload.FetchFeatureMatrix(ctx, conn)
+		cancel()
+		conn.Close()
+		if err != nil {
+			log.Printf("Failed to fetch the features of %s: %v", address, err)
+			continue
+		}
+		b, err := json.Marshal(m)
+		if err != nil {
+			log.Printf("Failed to marshal the features of %s: %v", address, err)
+			continue
+		}
+		log.Printf("Features of %s: %s", address, b)
+	}
+}
 
-	defer conn.Close()
+// startClockSync probes the clock of the server at address now, then every interval, if positive,
+// until the returned function is called. It then probes the clock one last time, logs the offset
+// estimated, and writes the probes to path, if set.
+func startClockSync(c *greetworkload.Client, address string, interval time.Duration, path string) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+	conn := mustCreateGrpcClientConn(c, address)
+	syncer := greetworkload.NewClockSyncer(conn, greetworkload.SystemClock)
+	probe := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := syncer.Probe(ctx); err != nil {
+			log.Printf("Clock probe failed: %v", err)
+		}
+	}
+	probe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		syncer.Run(ctx, interval)
+	}()
 
-	c := pb.NewGreeterClient(conn)
+	return func() {
+		cancel()
+		<-done
+		probe()
+		conn.Close()
+		if est := syncer.Estimate(); est != nil {
+			log.Printf("Server clock offset: %v, within %v", time.Duration(est.OffsetNS), time.Duration(est.RTTNS/2))
+		}
+		if path == "" {
+			return
+		}
+		err := greetworkload.WriteOutputFile(path, func(w io.Writer) error {
+			return greetworkload.WriteClockSamples(w, syncer.Samples())
+		})
+		if err != nil {
+			fatal(err)
+		}
+	}
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	r, err := c.SayHello(ctx, &pb.HelloRequest{Name: name})
+// replayCalls replays the calls recorded in path against address, logs the calls that diverged or
+// started late, and writes the replayed calls to output, after runMeta, if set. The run fails if any call finished
+// with another status code than the call it replays.
+func replayCalls(c *greetworkload.Client, address, path string, opts *greetworkload.ReplayOptions, output string, runMeta *greetworkload.RunMetadata) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Failed to open -replay: %v", err)
+	}
+	records, err := greetworkload.ReadRecords(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("Failed to read -replay: %v", err)
+	}
+
+	calls, err := c.Replay(context.Background(), address, records, opts)
 	if err != nil {
-		log.Fatalf("could not greet: %v", err)
+		log.Fatalf("Replay failed, error: %v", err)
+	}
+	var late int
+	for _, call := range calls {
+		if call.Late {
+			late++
+		}
+		if call.CodeDiverged() || call.RepliesDiverged() {
+			log.Printf("%s request_id=%s diverged: %s with %d replies, replayed as request_id=%s: %s with %d replies",
+				call.Original.Method, call.Original.RequestID, call.Original.Code, call.Original.Replies,
+				call.Replayed.RequestID, call.Replayed.Code, call.Replayed.Replies)
+		}
+	}
+	if opts.NoTiming {
+		log.Printf("Replayed %d calls", len(calls))
 	} else {
-		log.Printf("Greeting: %s", r.Message)
+		log.Printf("Replayed %d calls, %d started later than %v", len(calls), late, opts.Tolerance)
+	}
+
+	if output != "" {
+		replayed := make([]*greetworkload.CallRecord, len(calls))
+		for i, call := range calls {
+			replayed[i] = call.Replayed
+		}
+		err := greetworkload.WriteOutputFile(output, func(w io.Writer) error {
+			return greetworkload.WriteRecords(w, runMeta, replayed)
+		})
+		if err != nil {
+			fatal(err)
+		}
+	}
+	if err := greetworkload.CheckReplay(calls); err != nil {
+		fatal(err)
 	}
 }
 
-func main() {
-	address := flag.String("address", "localhost:50051", "Server end point.")
-	once := flag.Bool("once", false, "If true, send one request and wait for response and exit.")
-	name := flag.String("name", "world", "The name to greet.")
-	https := flag.Bool("https", false, "If true, uses https.")
-	clientStreaming := flag.Bool("client_streaming", false, "Whether or not to call client streaming RPC")
-	serverStreaming := flag.Bool("server_streaming", false, "Whether or not to call server streaming RPC")
-	bidirStreaming := flag.Bool("bidir_streaming", false, "Whether or not to call server streaming RPC")
-	compression := flag.Bool("compression", false, "Wether or not to use gRPC compression.")
-	count := flag.Int("count", 1, "The count of requests to make.")
-	waitPeriodMills := flag.Int("wait_period_millis", 500, "The waiting period between making successive requests.")
-
-	flag.Parse()
-
-	var fn func()
-	switch {
-	case *clientStreaming:
-		fn = func() { clientStreamGreet(*address, *compression, *https, []string{*name, *name, *name}) }
-	case *serverStreaming:
-		fn = func() { streamGreet(*address, *compression, *https, *name) }
-	case *bidirStreaming:
-		fn = func() { bidirStreamGreet(*address, *compression, *https, []string{*name, *name, *name}) }
-	default:
-		fn = func() { connectAndGreet(*address, *compression, *https, *name) }
+// runProfile makes calls with RunProfile over a connection from newConn, logs the target and
+// achieved rate of every second, and writes them to qpsFile, if set.
+func runProfile(c *greetworkload.Client, newConn func() *grpc.ClientConn, closeConn func(*grpc.ClientConn), name string, profile *greetworkload.LoadProfile, qpsFile string) []*greetworkload.CallRecord {
+	conn := newConn()
+	defer closeConn(conn)
+	records, samples, err := c.RunProfile(context.Background(), conn, name, profile)
+	if err != nil {
+		log.Fatalf("Load profile run failed, error: %v", err)
+	}
+	var table strings.Builder
+	for _, s := range samples {
+		fmt.Fprintf(&table, "  %5ds  phase %-3d target %9.1f  achieved %6d  completed %6d\n",
+			s.Second, s.Phase+1, s.TargetQPS, s.AchievedQPS, s.CompletedQPS)
+	}
+	log.Printf("Calls per second of %s:\n%s", profile, table.String())
+	if qpsFile != "" {
+		err := greetworkload.WriteOutputFile(qpsFile, func(w io.Writer) error {
+			return greetworkload.WriteQPSSamples(w, samples)
+		})
+		if err != nil {
+			fatal(err)
+		}
+	}
+	return records
+}
+
+// runAdaptive makes calls with RunAdaptive over a connection from newConn, and logs every
+// adjustment and the rate the calls converged to. Calls that fail are counted rather than ending
+// the run.
+func runAdaptive(c *greetworkload.Client, newConn func() *grpc.ClientConn, closeConn func(*grpc.ClientConn), name string, opts *greetworkload.AdaptiveOptions, adaptiveFile string) []*greetworkload.CallRecord {
+	conn := newConn()
+	defer closeConn(conn)
+	records, result, err := c.RunAdaptive(context.Background(), conn, name, opts)
+	if err != nil {
+		log.Fatalf("Adaptive run failed, error: %v", err)
+	}
+	var table strings.Builder
+	for _, s := range result.Steps {
+		fmt.Fprintf(&table, "  %8v  in flight %5d  completed %6d  failed %4d  qps %9.1f  p99 %-12v %-8s -> %d\n",
+			time.Duration(s.ElapsedNS).Round(time.Millisecond), s.Concurrency, s.Completed, s.Failed, s.QPS,
+			time.Duration(s.P99NS), s.Action, s.Next)
 	}
+	log.Printf("Adjustments for a p99 under %v:\n%s", opts.TargetP99, table.String())
+	log.Printf("Adaptive run %s", result)
+	if adaptiveFile != "" {
+		err := greetworkload.WriteOutputFile(adaptiveFile, func(w io.Writer) error {
+			return greetworkload.WriteAdaptiveResult(w, result)
+		})
+		if err != nil {
+			fatal(err)
+		}
+	}
+	return records
+}
+
+// runAsync makes calls with RunAsync over a connection from newConn, and logs their stats. Calls
+// that fail are counted rather than ending the run.
+func runAsync(c *greetworkload.Client, newConn func() *grpc.ClientConn, closeConn func(*grpc.ClientConn), name string, opts *greetworkload.AsyncOptions) []*greetworkload.CallRecord {
+	conn := newConn()
+	defer closeConn(conn)
+	records, stats, err := c.RunAsync(context.Background(), conn, name, opts)
+	if err != nil {
+		log.Fatalf("Async run failed, error: %v", err)
+	}
+	log.Printf("Started %d calls, %d completed, %d failed, %d finished after %v; peak in flight %d, queue wait mean %v, max %v",
+		stats.Started, stats.Completed, stats.Failed, stats.FinishedLate, opts.Duration,
+		stats.PeakInFlight, stats.MeanQueueWait(), time.Duration(stats.MaxQueueWaitNS))
+	return records
+}
+
+// runBursts makes the bursts of calls of opts, over a single connection if sameConn is set, or
+// else over a connection per call of a burst, and logs how they went.
+func runBursts(c *greetworkload.Client, newConn func() *grpc.ClientConn, closeConn func(*grpc.ClientConn), name string, sameConn bool, opts *greetworkload.BurstOptions) []*greetworkload.CallRecord {
+	n := opts.Size
+	if sameConn {
+		n = 1
+	}
+	// Connections are set up before the first burst, so that dialing does not hold calls back.
+	conns := make([]*grpc.ClientConn, n)
+	for i := range conns {
+		conns[i] = newConn()
+		defer closeConn(conns[i])
+	}
+	records, stats, err := c.RunBursts(context.Background(), conns, name, opts)
+	if err != nil {
+		log.Fatalf("Burst run failed, error: %v", err)
+	}
+	var failed int
+	for _, r := range records {
+		if !r.Completed() {
+			failed++
+		}
+	}
+	log.Printf("Made %d bursts of %d calls, %d failed; bursts started up to %v late, and spread over up to %v",
+		stats.Bursts, opts.Size, failed, time.Duration(stats.MaxLatenessNS), time.Duration(stats.MaxSpreadNS))
+	return records
+}
 
-	if *once {
-		fn()
+// runMatrix runs the matrix of opts, and logs the outcome of every cell run.
+func runMatrix(opts *greetworkload.MatrixOptions) error {
+	results, err := greetworkload.RunMatrix(context.Background(), opts)
+	var summary strings.Builder
+	if err := greetworkload.WriteMatrixSummary(&summary, results); err == nil && len(results) > 0 {
+		log.Printf("Matrix of %d cells:\n%s", len(greetworkload.MatrixCells(opts.Quick)), summary.String())
+	}
+	return err
+}
+
+// runConformance runs the conformance calls of opts over conn, logs whether each passed, and
+// returns their records.
+func runConformance(c *greetworkload.Client, conn *grpc.ClientConn, opts *greetworkload.ConformanceOptions) ([]*greetworkload.CallRecord, error) {
+	results, err := c.RunConformance(context.Background(), conn, opts)
+	var table strings.Builder
+	if err := greetworkload.WriteConformanceTable(&table, results); err == nil && len(results) > 0 {
+		log.Printf("Conformance of %d status codes:\n%s", len(results), table.String())
+	}
+	records := make([]*greetworkload.CallRecord, len(results))
+	for i, r := range results {
+		records[i] = r.Record
+	}
+	return records, err
+}
+
+// shutdownOTel exports the spans of otel not exported yet, if not nil.
+func shutdownOTel(otel greetworkload.SpanTracer) {
+	if otel == nil {
 		return
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := otel.Shutdown(ctx); err != nil {
+		fatal(err)
+	}
+}
 
-	for i := 0; i < *count; i++ {
-		fn()
-		time.Sleep(time.Duration(*waitPeriodMills) * time.Millisecond)
+// writeConnStats writes the stats of the connections of connStats to path, and a row of every call
+// made over them to exportPath, each if not empty and each after runMeta.
+func writeConnStats(path, exportPath string, runMeta *greetworkload.RunMetadata, connStats *greetworkload.ConnStatsHandler) {
+	if path != "" {
+		err := greetworkload.WriteOutputFile(path, func(w io.Writer) error {
+			return greetworkload.WriteConnStats(w, runMeta, connStats.Conns())
+		})
+		if err != nil {
+			fatal(err)
+		}
+	}
+	if exportPath != "" {
+		err := greetworkload.WriteOutputFile(exportPath, func(w io.Writer) error {
+			return greetworkload.WriteRPCExport(w, runMeta, connStats.RPCs())
+		})
+		if err != nil {
+			fatal(err)
+		}
 	}
 }
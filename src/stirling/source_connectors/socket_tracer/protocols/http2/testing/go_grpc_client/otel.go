@@ -0,0 +1,34 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetotel"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+func init() {
+	newSpanTracer = func(out, serviceName string) (greetworkload.SpanTracer, error) {
+		t, err := greetotel.NewTracer(&greetotel.Options{Out: out, ServiceName: serviceName})
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+// The latency diff tool compares, percentile by percentile, the latency histograms written by two
+// runs of the greet client with -latency_file.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+func mustReadHistograms(path string) map[string]*greetworkload.Histogram {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Failed to open latency file, error: %v", err)
+	}
+	defer f.Close()
+	byMethod, err := greetworkload.ReadHistograms(f)
+	if err != nil {
+		log.Fatalf("Failed to read %s, error: %v", path, err)
+	}
+	return byMethod
+}
+
+func main() {
+	base := flag.String("base", "", "The latency file of the baseline run.")
+	other := flag.String("other", "", "The latency file of the run compared to the baseline.")
+	percentiles := flag.String("percentiles", "", "Comma-separated percentiles to compare. Defaults to 50,90,99,99.9,99.99,100.")
+	flag.Parse()
+
+	if *base == "" || *other == "" {
+		log.Fatal("-base and -other must be set")
+	}
+	ps := greetworkload.DefaultPercentiles
+	if *percentiles != "" {
+		ps = nil
+		for _, s := range strings.Split(*percentiles, ",") {
+			p, err := strconv.ParseFloat(s, 64)
+			if err != nil || p < 0 || p > 100 {
+				log.Fatalf("Invalid percentile %q, must be in [0, 100]", s)
+			}
+			ps = append(ps, p)
+		}
+	}
+
+	if err := greetworkload.WritePercentileDeltas(os.Stdout, mustReadHistograms(*base), mustReadHistograms(*other), ps); err != nil {
+		log.Fatalf("Failed to write deltas, error: %v", err)
+	}
+}
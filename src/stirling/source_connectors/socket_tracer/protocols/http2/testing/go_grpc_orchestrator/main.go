@@ -0,0 +1,81 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+// The orchestrator runs a greet server and its clients as separate processes, as described by a JSON
+// greetworkload.OrchestratorConfig, and writes the merged ground truth of the run as JSON.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+func main() {
+	configFile := flag.String("config", "", "The JSON file describing the server and clients to run.")
+	output := flag.String("output", "", "The file the results are written to. Defaults to results.json in the work dir of the config.")
+	flag.Parse()
+
+	if *configFile == "" {
+		log.Fatal("-config must be set")
+	}
+	cfg, err := greetworkload.LoadOrchestratorConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Failed to load config, error: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid config, error: %v", err)
+	}
+	if *output == "" {
+		*output = filepath.Join(cfg.WorkDir, "results.json")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	results, runErr := greetworkload.Orchestrate(ctx, cfg)
+	if results != nil {
+		for _, w := range results.Warnings {
+			log.Printf("Warning: %s", w)
+		}
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Failed to create output file, error: %v", err)
+		}
+		if err := greetworkload.WriteRunResults(f, results); err != nil {
+			log.Fatalf("Failed to write output file, error: %v", err)
+		}
+		f.Close()
+	}
+	if runErr == nil {
+		return
+	}
+
+	log.Printf("Run failed, error: %v", runErr)
+	// Exit with the code of the process that failed the run, so that callers can tell them apart.
+	var procErr *greetworkload.ProcessError
+	if errors.As(runErr, &procErr) && procErr.ExitCode > 0 {
+		os.Exit(procErr.ExitCode)
+	}
+	os.Exit(1)
+}
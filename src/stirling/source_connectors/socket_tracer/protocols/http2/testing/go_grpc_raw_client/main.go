@@ -0,0 +1,66 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+// The raw client calls Greeter.SayHello with HTTP/2 frames crafted by hand, deviating from the
+// protocol on command, and writes how the server reacted to each call as JSON, for negative tests
+// of the servers and of the tracer.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+func main() {
+	address := flag.String("address", "localhost:50051", "Server end point.")
+	name := flag.String("name", "world", "The name to greet.")
+	deviation := flag.String("deviation", greetworkload.DeviationNone, "The deviation from the protocol to make, one of none, wrong_content_type, missing_te_trailers, data_before_headers, bogus_stream_id, oversized_padding and truncated_message, or all to make a call with each.")
+	useTLS := flag.Bool("tls", false, "Speak HTTP/2 over TLS, without verifying the server certificate.")
+	timeoutMillis := flag.Int("timeout_millis", 5000, "How long to wait for the reaction of the server to each call.")
+	flag.Parse()
+
+	deviations := []string{*deviation}
+	if *deviation == "all" {
+		deviations = greetworkload.Deviations
+	}
+	var reactions []*greetworkload.RawReaction
+	for _, d := range deviations {
+		opts := &greetworkload.RawOptions{
+			Deviation: d,
+			TLS:       *useTLS,
+			Timeout:   time.Duration(*timeoutMillis) * time.Millisecond,
+		}
+		r, err := greetworkload.RawSayHello(context.Background(), *address, *name, opts)
+		if err != nil {
+			log.Fatalf("Failed to call with deviation %s, error: %v", d, err)
+		}
+		log.Printf("%s: %s", d, r)
+		reactions = append(reactions, r)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(reactions); err != nil {
+		log.Fatalf("Failed to write reactions, error: %v", err)
+	}
+}
@@ -0,0 +1,585 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// serverFlags holds the values of the command line flags of the server.
+type serverFlags struct {
+	port                    int
+	https                   bool
+	cert                    string
+	key                     string
+	clientCA                string
+	streaming               bool
+	allServices             bool
+	tlsPort                 int
+	instanceID              string
+	validateRequests        bool
+	rejectUnknownFields     bool
+	faultConfig             string
+	latency                 string
+	seed                    int64
+	debugAddr               string
+	killAfterNames          bool
+	adminAddr               string
+	streamReplyBytes        int
+	heartbeatIntervalMillis int
+	replyFrameBytes         int
+	streamReplyVariants     int
+	conformanceNames        bool
+	maxStreamReplies        int
+	callersFile             string
+	h2cHandler              bool
+	export                  string
+	exportFile              string
+	statsFile               string
+	greeterPort             int
+	greeter2Port            int
+	streamingPort           int
+	addressFile             string
+	maxCallers              int
+	tlsMinVersion           string
+	tlsMaxVersion           string
+	cipherSuites            string
+	checksums               bool
+	recordsFile             string
+	eventLogFile            string
+	eventLogCapacity        int
+	logRequests             bool
+	requestRingCapacity     int
+	requestRingFile         string
+	deterministicCodec      bool
+	sizedCodec              bool
+	clockFile               string
+	initialWindowSize       uint
+	initialConnWindowSize   uint
+	trailerBloatCount       int
+	trailerBloatBytes       int
+	maxHeaderListSize       uint
+	headerTableSize         uint
+	maxFrameSize            uint
+	greeterOnly             bool
+	halfCloseGraceMillis    int
+	maxRecvMsgSize          int
+	listenNetwork           string
+	listenHost              string
+	gatewayPort             int
+	gatewayTimeoutMillis    int
+	http3Port               int
+	maxSendMsgSize          int
+	chaosProbability        float64
+	chaosCorruptions        string
+	chaosDryRun             bool
+	tcpNoDelay              bool
+	sendBuffer              int
+	recvBuffer              int
+	keepAliveMillis         int
+	authorityLatency        string
+	pingMinMillis           int
+	pingWithoutCalls        bool
+	shapeBytesPerSecond     int64
+	shapeBurst              int
+	shapeDelayMillis        int
+	cacheSize               int
+	otelOut                 string
+	payloadKey              string
+	wireSampleEvery         int
+	wireSampleDir           string
+	wireSampleMaxBytes      int64
+	upstream                string
+	handoff                 bool
+	handoffBinary           string
+	reusePort               bool
+}
+
+// parseFlags registers the flags of the server on flag.CommandLine and parses the command line.
+func parseFlags() *serverFlags {
+	f := &serverFlags{}
+	flag.IntVar(&f.port, "port", 50051, "The port to listen. Ignored when a listening socket is passed by socket activation, in LISTEN_FDS and LISTEN_PID, which is served instead")
+	flag.BoolVar(&f.https, "https", false, "Whether or not to use https")
+	flag.StringVar(&f.cert, "cert", "", "Path to the .crt file.")
+	flag.StringVar(&f.key, "key", "", "Path to the .key file.")
+	flag.StringVar(&f.clientCA, "client_ca", "", "If set, TLS clients must present a certificate signed by a CA of this PEM file. The handshakes are counted by the serial of the client certificate")
+	flag.BoolVar(&f.streaming, "streaming", false, "Whether or not to call streaming RPC")
+	flag.BoolVar(&f.allServices, "all_services", false, "Whether or not to serve StreamingGreeter alongside Greeter and Greeter2, rather than instead of them with --streaming")
+	flag.IntVar(&f.tlsPort, "tls_port", -1, "If not negative, also serves the services of --port over TLS on this port, with the --cert and --key pair, so that a single server answers both plaintext and TLS calls. Not supported with --https")
+	flag.StringVar(&f.instanceID, "instance_id", "", "If set, stamped into every reply to identify this server. {pid} is replaced by the PID of the server")
+	flag.BoolVar(&f.validateRequests, "validate_requests", false, "Whether or not to reject malformed requests with InvalidArgument")
+	flag.BoolVar(&f.rejectUnknownFields, "reject_unknown_fields", false, "Whether or not to reject the requests holding fields greet.proto does not declare with InvalidArgument, rather than ignore them")
+	flag.StringVar(&f.faultConfig, "fault_config", "", "Path to a JSON FaultConfig, re-read on SIGUSR1, on the platforms that have it")
+	flag.StringVar(&f.latency, "latency", "", "If set, delays every RPC by a latency drawn from this distribution, on top of the latency_millis of --fault_config: fixed(D), lognormal(mu=D,sigma=S) of median D, pareto(xm=D,alpha=A) of minimum D, or bimodal(D1@P1%,D2@P2%), e.g. 'lognormal(mu=2ms,sigma=0.5)'. Cannot be combined with the latency of --fault_config, and is kept across its reloads")
+	flag.Int64Var(&f.seed, "seed", 0, "The seed the failures and latencies injected into RPCs are drawn from. If 0, one is derived from the current time")
+	flag.StringVar(&f.debugAddr, "debug_addr", "", "If set, serves the read-only debug endpoint on this address: pprof profiles, the open connections with their stats, and the effective flag values")
+	flag.BoolVar(&f.killAfterNames, "kill_after_names", false, "If set, closes the connection of every server streaming call named kill-after-N as soon as N replies were written to it, e.g. kill-after-3. Ignored when TLS is pinned, and with --h2c")
+	flag.StringVar(&f.adminAddr, "admin_addr", "", "If set, serves the admin endpoint on this address. It can send GOAWAY on the connections to --port, unless TLS is pinned or with --h2c")
+	flag.IntVar(&f.streamReplyBytes, "stream_reply_bytes", 0, "Pads every server streaming reply to at least this many bytes")
+	flag.IntVar(&f.heartbeatIntervalMillis, "heartbeat_interval_millis", 0, "If positive, server streaming calls greeting \"heartbeat\" get one small reply this often, whatever their count, until the client goes away, e.g. to hold streams that trickle data for hours")
+	flag.IntVar(&f.replyFrameBytes, "reply_frame_bytes", 0, "If set, splits every server streaming reply over as many messages as it takes for each to fit a DATA frame of at most this many bytes, from 64 to 16384, e.g. 1024 with --stream_reply_bytes 65536 for 1KB frames")
+	flag.IntVar(&f.streamReplyVariants, "stream_reply_variants", 0, "If set, numbers server streaming replies, rotating through this many numbers")
+	flag.BoolVar(&f.conformanceNames, "conformance_names", false, "Whether or not to fail the SayHello calls named status-N with the status code N, from 0 to 16, e.g. status-7 with PERMISSION_DENIED, for clients run with -mode conformance. status-4 is held past its deadline, and status-16 sends a www-authenticate trailer")
+	flag.IntVar(&f.maxStreamReplies, "max_stream_replies", greetworkload.DefaultMaxStreamReplies, "The most reply messages a server streaming call is sent, every piece of --reply_frame_bytes counted. Calls that ask for more are sent that many, then fail with RESOURCE_EXHAUSTED and an x-greet-stream-sent trailer of the number sent")
+	flag.StringVar(&f.callersFile, "callers_file", "", "If set, SayHelloAgain call counts are persisted to this file across restarts")
+	flag.BoolVar(&f.h2cHandler, "h2c", false, "Whether or not to also accept HTTP/1.1 Upgrade to h2c. Ignored with --https")
+	flag.StringVar(&f.export, "export", "", "If csv, a row of every call handled, with its times, sizes, message counts, status, request ID and connection, is written to --export_file on shutdown, for tooling that loads records into tables")
+	flag.StringVar(&f.exportFile, "export_file", "", "The file --export writes to")
+	flag.StringVar(&f.statsFile, "stats_file", "", "If set, per-connection stats are written to this file on shutdown. TLS is only recorded when its parameters are pinned, and the HTTP/2 settings sent only without --https. Only connections are tracked with --h2c, not calls")
+	flag.IntVar(&f.greeterPort, "greeter_port", -1, "If not negative, serves Greeter on this port instead of --port")
+	flag.IntVar(&f.greeter2Port, "greeter2_port", -1, "If not negative, serves Greeter2 on this port instead of --port")
+	flag.IntVar(&f.streamingPort, "streaming_port", -1, "If not negative, serves StreamingGreeter on this port instead of --port")
+	flag.StringVar(&f.addressFile, "address_file", "", "If set, the address of every service is written to this file")
+	flag.IntVar(&f.maxCallers, "max_callers", 0, "The number of names SayHelloAgain remembers before forgetting the least recent one, 0 for no limit")
+	flag.StringVar(&f.tlsMinVersion, "tls_min_version", "", "The minimum TLS version accepted with --https, 1.2 or 1.3")
+	flag.StringVar(&f.tlsMaxVersion, "tls_max_version", "", "The maximum TLS version accepted with --https, 1.2 or 1.3")
+	flag.StringVar(&f.cipherSuites, "cipher_suites", "", "Comma-separated TLS 1.2 cipher suites accepted with --https")
+	flag.BoolVar(&f.checksums, "checksums", false, "Whether or not to checksum every reply, and every reply stream in a trailer")
+	flag.StringVar(&f.recordsFile, "records_file", "", "If set, a record of every call handled, with its request ID and attempt number, is written to this file on shutdown")
+	flag.StringVar(&f.eventLogFile, "event_log", "", "If set, the record of every call handled is appended to this binary event log instead of being kept in memory, without taking a lock, for call rates at which records would hold the server back. --records_file is then decoded from it on shutdown. Only the method, request ID, attempt, start, duration and code of calls are kept")
+	flag.IntVar(&f.eventLogCapacity, "event_log_capacity", 1<<20, "The number of records --event_log holds, 128 bytes each. The records that do not fit are counted and logged on shutdown")
+	flag.BoolVar(&f.logRequests, "log_requests", false, "Whether or not to log every call handled, and every message of streaming calls, with its request ID")
+	flag.IntVar(&f.requestRingCapacity, "request_ring_capacity", greetworkload.DefaultRequestRingCapacity, "The number of calls handled whose records the server keeps, the newest overwriting the oldest, for the admin endpoint to serve at GET /requests and --request_ring_file. Dumps count the records overwritten. 0 keeps none")
+	flag.StringVar(&f.requestRingFile, "request_ring_file", "", "If set, the records --request_ring_capacity keeps are dumped to this file as JSON on SIGQUIT, on the platforms that have it, and the server keeps serving")
+	flag.BoolVar(&f.deterministicCodec, "deterministic_codec", false, "Whether or not to marshal messages with the greetpb DeterministicCodec, so that every run sends the same reply bytes. Not supported with --sized_codec")
+	flag.BoolVar(&f.sizedCodec, "sized_codec", false, "Whether or not to marshal and unmarshal messages with the greetpb SizedCodec rather than the default codec")
+	flag.StringVar(&f.clockFile, "clock_file", "", "If set, the clock probes answered are written to this file on shutdown, with the latest offset the client estimated before each")
+	flag.UintVar(&f.initialWindowSize, "initial_window_size", 0, "If set, the HTTP/2 flow control window of every stream. Below 65535 requires --h2c")
+	flag.UintVar(&f.initialConnWindowSize, "initial_conn_window_size", 0, "If set, the HTTP/2 flow control window of every connection. At least 65535, or 65536 with --h2c")
+	flag.IntVar(&f.trailerBloatCount, "trailer_bloat_count", 0, "If positive, the trailer of every call carries this many x-bloat entries of --trailer_bloat_bytes each, drawn from its request ID so that clients can check them. At most 16MB of header list, less 4KB")
+	flag.IntVar(&f.trailerBloatBytes, "trailer_bloat_bytes", 1024, "The size of every entry added with --trailer_bloat_count")
+	flag.UintVar(&f.maxHeaderListSize, "max_header_list_size", 0, "If set, calls with larger header lists are rejected. Not supported with --h2c")
+	flag.UintVar(&f.headerTableSize, "header_table_size", 0, "If set, the size of the HPACK table used to decode the headers received")
+	flag.UintVar(&f.maxFrameSize, "max_frame_size", 0, "If set, the largest HTTP/2 frame accepted, from 16384 to 16777215. Requires --h2c")
+	flag.BoolVar(&f.greeterOnly, "greeter_only", false, "Whether or not to leave Greeter2 unregistered, so that its calls fail with Unimplemented. Ignored with --streaming")
+	flag.IntVar(&f.halfCloseGraceMillis, "half_close_grace_millis", 0, "If positive, connections keep being served for this long after the client half-closes them, instead of being closed at once")
+	flag.IntVar(&f.maxRecvMsgSize, "max_recv_msg_size", greetworkload.DefaultMaxRecvMsgSize, "The largest message, in bytes, the server receives")
+	flag.StringVar(&f.listenNetwork, "listen_network", greetworkload.NetworkTCP, "The network to listen on: tcp4, tcp6, or tcp for both IPv4 and IPv6 unless --listen_host is a specified address")
+	flag.StringVar(&f.listenHost, "listen_host", "", "The IP address to listen on, e.g. ::1, [::1], 0.0.0.0 or fe80::1%eth0. Empty listens on every address")
+	flag.IntVar(&f.gatewayPort, "gateway_port", -1, "If not negative, serves an HTTP/1.1 JSON gateway to Greeter.SayHello on this port, at POST /say-hello")
+	flag.IntVar(&f.gatewayTimeoutMillis, "gateway_timeout_millis", 0, "If positive, the deadline of the calls made through the gateway")
+	flag.IntVar(&f.http3Port, "http3_port", -1, "Experimental: if not negative, also serves Greeter.SayHello over HTTP/3 on this UDP port, with the --cert and --key pair, through the minimal QUIC and HTTP/3 of the workload, only meant for loopback. The calls are counted, traced and failed like those of the gateway, and traced with the transport h3. Requires a server built with Go 1.21 or later")
+	flag.IntVar(&f.maxSendMsgSize, "max_send_msg_size", greetworkload.DefaultMaxSendMsgSize, "The largest message, in bytes, the server sends")
+	flag.Float64Var(&f.chaosProbability, "chaos_probability", 0, "If positive, the chance that each DATA frame the server writes is corrupted. Every corruption is logged. Not supported with --https or --h2c")
+	flag.StringVar(&f.chaosCorruptions, "chaos_corruptions", "", "Comma-separated corruptions picked from with --chaos_probability: bit_flip, truncate, empty_data. Empty picks from all")
+	flag.BoolVar(&f.chaosDryRun, "chaos_dry_run", false, "Whether or not to only log the corruptions --chaos_probability would inject")
+	flag.BoolVar(&f.tcpNoDelay, "tcp_nodelay", true, "Whether or not to set TCP_NODELAY on the connections accepted. False enables Nagle's algorithm")
+	flag.IntVar(&f.sendBuffer, "so_sndbuf", 0, "If positive, the SO_SNDBUF of the connections accepted, in bytes")
+	flag.IntVar(&f.recvBuffer, "so_rcvbuf", 0, "If positive, the SO_RCVBUF of the connections accepted, in bytes")
+	flag.IntVar(&f.keepAliveMillis, "tcp_keepalive_millis", 0, "If positive, the TCP keepalive idle time and interval of the connections accepted. Negative disables keepalives")
+	flag.StringVar(&f.authorityLatency, "authority_latency", "", "Comma-separated authority=millis pairs, e.g. slow.greeter.local=200, that delay the calls made with each :authority by millis, as virtual hosts routed to slower backends would. Every call handled logs and records its :authority")
+	flag.IntVar(&f.pingMinMillis, "keepalive_min_time_millis", 0, "If positive, the shortest interval between the HTTP/2 keepalive pings of a client the server allows. Clients that ping more often are sent a too_many_pings GOAWAY, which fails their calls in flight. 0 leaves gRPC's 5 minutes. Not supported with --h2c")
+	flag.BoolVar(&f.pingWithoutCalls, "keepalive_permit_without_stream", false, "Whether or not to allow pings on connections with no calls in flight. Not supported with --h2c")
+	flag.Int64Var(&f.shapeBytesPerSecond, "shape_bytes_per_second", 0, "If positive, limits each direction of every connection accepted to this many bytes per second, as a slow network would")
+	flag.IntVar(&f.shapeBurst, "shape_burst", 0, "The most bytes --shape_bytes_per_second lets through at once. 0 lets through a full HTTP/2 frame")
+	flag.IntVar(&f.shapeDelayMillis, "shape_delay_millis", 0, "If positive, holds back the bytes the server writes to every connection for this long, as a link with this one-way latency would")
+	flag.IntVar(&f.cacheSize, "cache_size", 0, "If positive, memoizes the replies to SayHello by name and count, keeping up to this many, and answers repeated requests with the same bytes, without the latency or failures --fault_config injects. Every reply carries an x-cache trailer of hit or miss. The gateway is not cached")
+	flag.StringVar(&f.otelOut, "otel_out", "", "If set, an OpenTelemetry span of every call handled is exported, as a child of the span the client sent in traceparent, if any: to an OTLP/gRPC collector given as otlp://host:port, or else as JSON to this file on shutdown. The gateway is not traced")
+	flag.StringVar(&f.payloadKey, "payload_key", "", "If set, the hex encoded AES key the greet calls are sealed with: the name of every request is opened from its payload, and the message of every reply sealed into its own, with AES-GCM. Requests that fail authentication fail with DATA_LOSS. The gateway is not sealed")
+	flag.IntVar(&f.wireSampleEvery, "wire_sample_every", 0, "If positive, one in this many messages of the calls handled, picked at random from --seed, is written to --wire_sample_dir as the codec marshaled or unmarshaled it, before compression, with the request ID of its call, for go_grpc_wire_samples to look up. The gateway is not sampled")
+	flag.StringVar(&f.wireSampleDir, "wire_sample_dir", "", "The directory of the spool --wire_sample_every writes to, created if need be")
+	flag.Int64Var(&f.wireSampleMaxBytes, "wire_sample_max_bytes", 0, "The most bytes of samples --wire_sample_dir holds, the oldest being removed to make room for new ones. Zero keeps 64MiB")
+	flag.StringVar(&f.upstream, "upstream", "", "If set, SayHello forwards every request to the Greeter at this address, as it was received, with the fields the server does not know, in plaintext, within the deadline of the call and with its x-request-id and traceparent, and replies with the upstream reply wrapped in its own, as the middle hop of a call chain. Upstream failures keep their status code")
+	flag.BoolVar(&f.handoff, "handoff", false, "Whether or not to hand the listening socket of --port off to a new server process on SIGHUP, on the platforms that have it: the server starts --handoff_binary with its own flags, passing it the socket, and once the new process serves, stops with GracefulStop, so that the port keeps serving throughout. Both log the same handoff_id. Files written on exit, such as --stats_file, are written by each process in turn. Not supported with listeners other than --port's")
+	flag.StringVar(&f.handoffBinary, "handoff_binary", "", "The binary started by --handoff. If empty, the one at the path of the running server, which picks up a new binary installed there")
+	flag.BoolVar(&f.reusePort, "reuseport", false, "Whether or not to set SO_REUSEPORT on the listening sockets, so that several servers started with it can serve the same port. The kernel spreads the connections between them")
+
+	flag.Parse()
+	f.instanceID = greetworkload.ExpandInstanceID(f.instanceID)
+	if f.seed == 0 {
+		f.seed = time.Now().UnixNano()
+	}
+	return f
+}
+
+// keyPairBase is the directory of the certificate and key used when --cert and --key are not set.
+const keyPairBase = "src/stirling/source_connectors/socket_tracer/protocols/http2/testing/go_grpc_server"
+
+// h2c returns true if the server accepts h2c, which it does not with --https.
+func (f *serverFlags) h2c() bool {
+	return f.h2cHandler && !f.https
+}
+
+// checkServiceFlags returns an error if the flags that pick the services served, how their
+// messages are marshaled, and what is exported of their calls do not go together.
+func (f *serverFlags) checkServiceFlags() error {
+	if f.tlsPort >= 0 && f.https {
+		return badFlags("--tls_port serves TLS beside the plaintext --port, it does not apply to --https")
+	}
+	if f.allServices && (f.streaming || f.greeterOnly) {
+		return badFlags("--all_services serves every service, it cannot be combined with --streaming or --greeter_only")
+	}
+	if f.greeterOnly && !f.streaming && f.greeter2Port >= 0 {
+		return badFlags("--greeter_only leaves Greeter2 unregistered, it cannot be given --greeter2_port")
+	}
+	if f.sizedCodec && f.deterministicCodec {
+		return badFlags("--sized_codec and --deterministic_codec cannot be combined")
+	}
+	if (f.export == "") != (f.exportFile == "") {
+		return badFlags("--export and --export_file go together")
+	}
+	if f.export != "" && f.export != greetworkload.ExportCSV {
+		return badFlags(fmt.Sprintf("unknown --export %q, only %s is supported", f.export, greetworkload.ExportCSV))
+	}
+	for _, size := range []int{f.maxRecvMsgSize, f.maxSendMsgSize} {
+		if size <= 0 || size > math.MaxInt32 {
+			return badFlags("--max_recv_msg_size and --max_send_msg_size must be from 1 to 2147483647")
+		}
+	}
+	return nil
+}
+
+// mainServices returns the services --port serves, unless they are given a port of their own.
+func (f *serverFlags) mainServices() []string {
+	services := []string{greetworkload.GreeterService, greetworkload.Greeter2Service}
+	if f.allServices {
+		log.Printf("Launching unary and streaming server")
+		services = append(services, greetworkload.StreamingGreeterService)
+	} else if f.streaming {
+		log.Printf("Launching streaming server")
+		services = []string{greetworkload.StreamingGreeterService}
+	} else {
+		log.Printf("Launching unary server")
+	}
+	if f.greeterOnly && !f.streaming {
+		services = []string{greetworkload.GreeterService}
+	}
+	return services
+}
+
+// separatePorts returns the port of every service, negative for those served on --port.
+func (f *serverFlags) separatePorts() map[string]int {
+	return map[string]int{
+		greetworkload.GreeterService:          f.greeterPort,
+		greetworkload.Greeter2Service:         f.greeter2Port,
+		greetworkload.StreamingGreeterService: f.streamingPort,
+	}
+}
+
+// serverTLS is the TLS the server is served with.
+type serverTLS struct {
+	// pinned is set when the TLS parameters are pinned. gRPC then terminates TLS, instead of the
+	// listener, so that the negotiated parameters reach the per-connection stats. Unlike the
+	// listener, gRPC also negotiates h2 with ALPN.
+	pinned bool
+	// config is the TLS of --port with --https, extraConfig that of --tls_port, and http3Config
+	// that of --http3_port.
+	config, extraConfig, http3Config *tls.Config
+	cert                             *greetworkload.CertReloader
+	clientSerials                    *greetworkload.SerialCounter
+}
+
+// tlsConfigs returns the TLS of --https, --tls_port or --http3_port, with the certificate of --cert
+// and --key, or an empty serverTLS if none is set.
+func (f *serverFlags) tlsConfigs() (*serverTLS, error) {
+	t := &serverTLS{pinned: f.tlsMinVersion != "" || f.tlsMaxVersion != "" || f.cipherSuites != ""}
+	if t.pinned && !f.https {
+		return nil, badFlags("--tls_min_version, --tls_max_version and --cipher_suites require --https")
+	}
+	if f.clientCA != "" && !f.https && f.tlsPort < 0 && f.http3Port < 0 {
+		return nil, badFlags("--client_ca requires --https, --tls_port or --http3_port")
+	}
+	if !f.https && f.tlsPort < 0 && f.http3Port < 0 {
+		return t, nil
+	}
+
+	certFile := keyPairBase + "/https-server.crt"
+	if len(f.cert) > 0 {
+		certFile = f.cert
+	}
+	keyFile := keyPairBase + "/https-server.key"
+	if len(f.key) > 0 {
+		keyFile = f.key
+	}
+	var err error
+	// Replacing the files rotates the certificate of the connections accepted from then on.
+	t.cert, err = greetworkload.NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certs: %v", err)
+	}
+	log.Printf("Using cert: %s key: %s", certFile, keyFile)
+	cfg := &tls.Config{GetCertificate: t.cert.GetCertificate}
+	if f.clientCA != "" {
+		cfg.ClientCAs, err = greetworkload.LoadCertPool(f.clientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client CAs: %v", err)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		t.clientSerials = greetworkload.NewSerialCounter()
+		cfg.VerifyConnection = t.clientSerials.VerifyConnection
+	}
+	if f.http3Port >= 0 {
+		// QUIC always negotiates TLS 1.3, whatever the options of --https pin.
+		t.http3Config = cfg.Clone()
+	}
+	if f.tlsPort >= 0 {
+		// Terminated by the listener, as with --https.
+		t.extraConfig = cfg
+		return t, nil
+	}
+	if !f.https {
+		return t, nil
+	}
+	t.config = cfg
+	opts := &greetworkload.TLSOptions{MinVersion: f.tlsMinVersion, MaxVersion: f.tlsMaxVersion}
+	if f.cipherSuites != "" {
+		opts.CipherSuites = strings.Split(f.cipherSuites, ",")
+	}
+	if err := opts.Apply(t.config); err != nil {
+		return nil, fmt.Errorf("invalid TLS options: %v", err)
+	}
+	return t, nil
+}
+
+// requestRing returns the RequestRing of --request_ring_capacity, or nil if it is 0.
+func (f *serverFlags) requestRing() (*greetworkload.RequestRing, error) {
+	if f.requestRingCapacity == 0 {
+		if f.requestRingFile != "" {
+			return nil, badFlags("--request_ring_file requires --request_ring_capacity")
+		}
+		return nil, nil
+	}
+	ring, err := greetworkload.NewRequestRing(f.requestRingCapacity)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --request_ring_capacity: %w", err)
+	}
+	return ring, nil
+}
+
+// http2Settings returns the HTTP/2 settings the server sends.
+func (f *serverFlags) http2Settings() (*greetworkload.HTTP2Settings, error) {
+	settings := &greetworkload.HTTP2Settings{
+		InitialWindowSize:     uint32(f.initialWindowSize),
+		InitialConnWindowSize: uint32(f.initialConnWindowSize),
+		MaxHeaderListSize:     uint32(f.maxHeaderListSize),
+		HeaderTableSize:       uint32(f.headerTableSize),
+		MaxFrameSize:          uint32(f.maxFrameSize),
+	}
+	if err := settings.Validate(f.h2c()); err != nil {
+		return nil, fmt.Errorf("invalid HTTP/2 settings: %w", err)
+	}
+	return settings, nil
+}
+
+// keepaliveOptions returns the keepalive pings the server allows its clients.
+func (f *serverFlags) keepaliveOptions() (*greetworkload.KeepaliveOptions, error) {
+	opts := &greetworkload.KeepaliveOptions{
+		MinTime:             time.Duration(f.pingMinMillis) * time.Millisecond,
+		PermitWithoutStream: f.pingWithoutCalls,
+	}
+	if err := opts.Validate(f.h2c()); err != nil {
+		return nil, fmt.Errorf("invalid keepalive flags: %w", err)
+	}
+	return opts, nil
+}
+
+// listenOptions returns where the server listens, and the socket options of the connections it
+// accepts.
+func (f *serverFlags) listenOptions() (*greetworkload.ListenOptions, error) {
+	opts := &greetworkload.ListenOptions{
+		Network: f.listenNetwork,
+		Host:    f.listenHost,
+		Socket: &greetworkload.SocketOptions{
+			Nagle:      !f.tcpNoDelay,
+			SendBuffer: f.sendBuffer,
+			RecvBuffer: f.recvBuffer,
+			KeepAlive:  time.Duration(f.keepAliveMillis) * time.Millisecond,
+			ReusePort:  f.reusePort,
+		},
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid listen flags: %w", err)
+	}
+	return opts, nil
+}
+
+// newChaos returns the Chaos of --chaos_probability, or nil if it is not set.
+func (f *serverFlags) newChaos() (*greetworkload.Chaos, error) {
+	if f.chaosProbability <= 0 {
+		return nil, nil
+	}
+	if f.https || f.h2cHandler || f.tlsPort >= 0 {
+		return nil, badFlags("--chaos_probability corrupts cleartext HTTP/2 frames, it does not apply to --https, --h2c or --tls_port")
+	}
+	opts := &greetworkload.ChaosOptions{Probability: f.chaosProbability, DryRun: f.chaosDryRun}
+	if f.chaosCorruptions != "" {
+		opts.Corruptions = strings.Split(f.chaosCorruptions, ",")
+	}
+	chaos, err := greetworkload.NewChaos(opts, time.Now().UnixNano())
+	if err != nil {
+		return nil, fmt.Errorf("invalid chaos flags: %v", err)
+	}
+	return chaos, nil
+}
+
+// newShaper returns the Shaper of --shape_bytes_per_second and --shape_delay_millis, or nil if
+// neither is set.
+func (f *serverFlags) newShaper() (*greetworkload.Shaper, error) {
+	if f.shapeBytesPerSecond <= 0 && f.shapeBurst <= 0 && f.shapeDelayMillis <= 0 {
+		return nil, nil
+	}
+	shaper, err := greetworkload.NewShaper(&greetworkload.ShapingOptions{
+		BytesPerSecond: f.shapeBytesPerSecond,
+		Burst:          f.shapeBurst,
+		Delay:          time.Duration(f.shapeDelayMillis) * time.Millisecond,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid shaping flags: %w", err)
+	}
+	return shaper, nil
+}
+
+// newCache returns the ReplyCache of --cache_size, or nil if it is 0.
+func (f *serverFlags) newCache() (*greetworkload.ReplyCache, error) {
+	if f.cacheSize == 0 {
+		return nil, nil
+	}
+	cache, err := greetworkload.NewReplyCache(f.cacheSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache flags: %w", err)
+	}
+	return cache, nil
+}
+
+// spanTracer returns the SpanTracer of --otel_out, or nil if it is not set.
+func (f *serverFlags) spanTracer() (greetworkload.SpanTracer, error) {
+	if f.otelOut == "" {
+		return nil, nil
+	}
+	if newSpanTracer == nil {
+		return nil, fmt.Errorf("invalid otel flags: %w", badFlags("this binary was built without OpenTelemetry"))
+	}
+	otel, err := newSpanTracer(f.otelOut, "greet_server")
+	if err != nil {
+		return nil, fmt.Errorf("invalid otel flags: %w", err)
+	}
+	return otel, nil
+}
+
+// newSealer returns the PayloadSealer of --payload_key, or nil if it is not set.
+func (f *serverFlags) newSealer() (*greetworkload.PayloadSealer, error) {
+	if f.payloadKey == "" {
+		return nil, nil
+	}
+	key, err := greetworkload.ParsePayloadKey(f.payloadKey)
+	var sealer *greetworkload.PayloadSealer
+	if err == nil {
+		sealer, err = greetworkload.NewPayloadSealer(key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload flags: %w", err)
+	}
+	return sealer, nil
+}
+
+// newWireSampler returns the WireSampler of --wire_sample_every, or nil if it is not set.
+func (f *serverFlags) newWireSampler() (*greetworkload.WireSampler, error) {
+	if f.wireSampleEvery <= 0 {
+		if f.wireSampleDir != "" || f.wireSampleMaxBytes != 0 {
+			return nil, badFlags("--wire_sample_dir and --wire_sample_max_bytes require --wire_sample_every")
+		}
+		return nil, nil
+	}
+	sampler, err := greetworkload.NewWireSampler(&greetworkload.WireSamplerOptions{
+		Every:    f.wireSampleEvery,
+		Dir:      f.wireSampleDir,
+		MaxBytes: f.wireSampleMaxBytes,
+		Seed:     f.seed,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid wire sample flags: %w", err)
+	}
+	return sampler, nil
+}
+
+// handoffSignal returns the signal that starts a --handoff, or nil if it is not set.
+func (f *serverFlags) handoffSignal() (os.Signal, error) {
+	if !f.handoff {
+		if f.handoffBinary != "" {
+			return nil, badFlags("--handoff_binary only applies to --handoff")
+		}
+		return nil, nil
+	}
+	if f.tlsPort >= 0 || f.gatewayPort >= 0 || f.http3Port >= 0 || f.greeterPort >= 0 || f.greeter2Port >= 0 || f.streamingPort >= 0 || f.adminAddr != "" || f.debugAddr != "" || f.h2cHandler {
+		return nil, badFlags("--handoff only hands off the listener of --port, it cannot be combined with --tls_port, --gateway_port, --http3_port, --greeter_port, --greeter2_port, --streaming_port, --admin_addr, --debug_addr or --h2c")
+	}
+	return greetworkload.HandoffSignal()
+}
+
+// loadFaultConfig reads --fault_config, if set, with the latency of --latency.
+func (f *serverFlags) loadFaultConfig() (*greetworkload.FaultConfig, error) {
+	cfg := &greetworkload.FaultConfig{}
+	if f.faultConfig != "" {
+		var err error
+		if cfg, err = greetworkload.LoadFaultConfig(f.faultConfig); err != nil {
+			return nil, fmt.Errorf("failed to load fault config: %v", err)
+		}
+	}
+	if err := withLatencyFlag(cfg, f.latency); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// newTrailerBloat returns the TrailerBloat of --trailer_bloat_count, or nil if it is not set.
+func (f *serverFlags) newTrailerBloat() (*greetworkload.TrailerBloat, error) {
+	if f.trailerBloatCount <= 0 {
+		return nil, nil
+	}
+	return greetworkload.NewTrailerBloat(&greetworkload.TrailerBloatOptions{Count: f.trailerBloatCount, Size: f.trailerBloatBytes})
+}
+
+// codec returns the name of the codec the messages are marshaled with.
+func (f *serverFlags) codec() string {
+	switch {
+	case f.deterministicCodec:
+		return greetworkload.CodecDeterministic
+	case f.sizedCodec:
+		return greetworkload.CodecSized
+	}
+	return greetworkload.CodecProto
+}
+
+// featureMatrix returns the features GreeterFeatures reports.
+func (f *serverFlags) featureMatrix(meta *greetworkload.RunMetadata) *pb.FeatureMatrix {
+	return &pb.FeatureMatrix{
+		Tls:              f.https,
+		TlsMinVersion:    f.tlsMinVersion,
+		TlsMaxVersion:    f.tlsMaxVersion,
+		Codec:            f.codec(),
+		MaxRecvMsgSize:   int32(f.maxRecvMsgSize),
+		MaxSendMsgSize:   int32(f.maxSendMsgSize),
+		Streaming:        f.streaming,
+		H2C:              f.h2c(),
+		Checksums:        f.checksums,
+		ValidateRequests: f.validateRequests,
+		InstanceId:       f.instanceID,
+		RunMetadata:      meta.String(),
+	}
+}
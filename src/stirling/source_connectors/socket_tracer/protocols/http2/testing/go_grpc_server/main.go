@@ -26,127 +26,758 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
-	"strings"
+	"syscall"
+	"time"
 
 	"google.golang.org/grpc"
+	channelzsvc "google.golang.org/grpc/channelz/service"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
 	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/encoding/proto"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/reflection"
 
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
 	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
 )
 
-// server is used to implement helloworld.GreeterServer.
-type server struct{}
+// newSpanTracer creates the greetworkload.SpanTracer of --otel_out, exporting the spans of the
+// process named serviceName. It is nil in the binaries built without otel.go, such as those built
+// with Go releases the OpenTelemetry SDK does not support.
+var newSpanTracer func(out, serviceName string) (greetworkload.SpanTracer, error)
 
-// SayHello implements helloworld.GreeterServer
-func (s *server) SayHello(ctx context.Context, in *pb.HelloRequest) (*pb.HelloReply, error) {
-	return &pb.HelloReply{Message: "Hello " + in.Name}, nil
+func main() {
+	f := parseFlags()
+	r, err := newRun(f, greetworkload.NewRunMetadata(f.seed, flag.CommandLine))
+	if err != nil {
+		fatal(err)
+	}
+	defer r.close()
+	if err := r.listen(); err != nil {
+		fatal(err)
+	}
+	fmt.Print(r.lis.Addr().(*net.TCPAddr).Port)
+	if err := r.start(); err != nil {
+		fatal(err)
+	}
+
+	s := r.newServer()
+	r.serveGateway()
+	r.serveHTTP3()
+	r.serveServices(s)
+	if f.h2c() {
+		r.serveH2C(s)
+	} else {
+		r.serve(s)
+	}
+	r.report()
 }
 
-func (s *server) SayHelloAgain(ctx context.Context, in *pb.HelloRequest) (*pb.HelloReply, error) {
-	return &pb.HelloReply{Message: "Hello " + in.Name}, nil
+// run is the state of the server: what the flags set up, the listener of --port, and the servers
+// of every port.
+type run struct {
+	f    *serverFlags
+	meta *greetworkload.RunMetadata
+
+	tls             *serverTLS
+	requestRing     *greetworkload.RequestRing
+	http2Settings   *greetworkload.HTTP2Settings
+	authorityDelays greetworkload.AuthorityLatency
+	keepaliveOpts   *greetworkload.KeepaliveOptions
+	listenOpts      *greetworkload.ListenOptions
+	chaos           *greetworkload.Chaos
+	shaper          *greetworkload.Shaper
+	cache           *greetworkload.ReplyCache
+	otel            greetworkload.SpanTracer
+	sealer          *greetworkload.PayloadSealer
+	wireSampler     *greetworkload.WireSampler
+	trailerBloat    *greetworkload.TrailerBloat
+	handoffSignal   os.Signal
+	connStats       *greetworkload.ConnStatsHandler
+
+	// handedOff is the handoff the listener of --port was passed by, if any. raw is that listener
+	// before it is wrapped, which --handoff passes on, and lis the listener served.
+	handedOff *greetworkload.Handoff
+	raw       net.Listener
+	lis       net.Listener
+	kills     *greetworkload.KillListener
+
+	faults       *greetworkload.FaultInjector
+	callers      *greetworkload.CallerCounter
+	callStats    *greetworkload.CallStats
+	clockSync    *greetworkload.ClockSyncServer
+	binMetadata  *greetworkload.BinaryMetadataVerifier
+	eventLog     *greetworkload.EventLog
+	tracer       *greetworkload.RequestTracer
+	healthSrv    *health.Server
+	rawRequests  *greetworkload.RawRequests
+	upstreamConn *grpc.ClientConn
+	greeter      *greetworkload.Server
+	features     *greetworkload.FeatureServer
+
+	tlsServer *grpc.Server
+	group     *greetworkload.ServiceGroup
 }
 
-func (s *server) SayHelloClientStreaming(srv pb.StreamingGreeter_SayHelloClientStreamingServer) error {
-	names := []string{}
-	for {
-		helloReq, err := srv.Recv()
-		if err == io.EOF {
-			return srv.SendAndClose(&pb.HelloReply{Message: "Hello " + strings.Join(names, ", ") + "!"})
-		}
-		if err != nil {
-			return err
+// newRun returns the run of the flags f, or an error if they do not go together.
+func newRun(f *serverFlags, meta *greetworkload.RunMetadata) (*run, error) {
+	r := &run{f: f, meta: meta}
+	if f.latency != "" {
+		if _, err := greetworkload.ParseLatencyDistribution(f.latency); err != nil {
+			return nil, fmt.Errorf("invalid --latency: %w", err)
 		}
-		names = append(names, helloReq.Name)
 	}
+	var err error
+	if r.requestRing, err = f.requestRing(); err != nil {
+		return nil, err
+	}
+	if err := f.checkServiceFlags(); err != nil {
+		return nil, err
+	}
+	if r.tls, err = f.tlsConfigs(); err != nil {
+		return nil, err
+	}
+	if r.http2Settings, err = f.http2Settings(); err != nil {
+		return nil, err
+	}
+	if r.authorityDelays, err = greetworkload.ParseAuthorityLatency(f.authorityLatency); err != nil {
+		return nil, fmt.Errorf("invalid --authority_latency: %w", err)
+	}
+	if r.keepaliveOpts, err = f.keepaliveOptions(); err != nil {
+		return nil, err
+	}
+	if r.listenOpts, err = f.listenOptions(); err != nil {
+		return nil, err
+	}
+	if r.chaos, err = f.newChaos(); err != nil {
+		return nil, err
+	}
+	if r.shaper, err = f.newShaper(); err != nil {
+		return nil, err
+	}
+	if r.cache, err = f.newCache(); err != nil {
+		return nil, err
+	}
+	if r.otel, err = f.spanTracer(); err != nil {
+		return nil, err
+	}
+	if r.sealer, err = f.newSealer(); err != nil {
+		return nil, err
+	}
+	if r.wireSampler, err = f.newWireSampler(); err != nil {
+		return nil, err
+	}
+	if r.trailerBloat, err = f.newTrailerBloat(); err != nil {
+		return nil, err
+	}
+	if r.handoffSignal, err = f.handoffSignal(); err != nil {
+		return nil, err
+	}
+	r.connStats = greetworkload.NewConnStatsHandler()
+	if f.export != "" {
+		r.connStats.KeepRPCs()
+	}
+	return r, nil
 }
 
-func (s *server) SayHelloServerStreaming(in *pb.HelloRequest, srv pb.StreamingGreeter_SayHelloServerStreamingServer) error {
-	log.Printf("SayHelloServerStreaming, in: %v\n", in)
-	// Send 3 responses each time. We do not care much about the exact number of responses, this is for executing the
-	// server streaming mechanism and observe the underlying HTTP2 framing data.
-	for i := 0; i < 3; i++ {
-		err := srv.Send(&pb.HelloReply{Message: "Hello " + in.Name})
-		if err != nil {
-			return err
+// wrap serves lis, a listener bound on a port or passed by socket activation, with cfg.
+func (r *run) wrap(lis net.Listener, cfg *tls.Config) net.Listener {
+	f := r.f
+	if r.shaper != nil {
+		lis = r.shaper.WrapListener(lis)
+	}
+	if f.halfCloseGraceMillis > 0 {
+		lis = greetworkload.NewHalfCloseListener(lis, time.Duration(f.halfCloseGraceMillis)*time.Millisecond)
+	}
+	// Only wrapped when the per-connection stats are read, as Stirling's Go uprobes only find the
+	// file descriptor of the net.Conn types of the standard library.
+	if f.statsFile != "" || f.export != "" || f.debugAddr != "" {
+		lis = r.connStats.WrapListener(lis)
+	}
+	if r.chaos != nil {
+		lis = r.chaos.WrapListener(lis)
+	}
+	if cfg != nil && !r.tls.pinned {
+		return tls.NewListener(lis, cfg)
+	}
+	return lis
+}
+
+// bind listens on port, without wrapping the listener.
+func (r *run) bind(port int, cfg *tls.Config) (net.Listener, error) {
+	portStr := ":" + strconv.Itoa(port)
+	if cfg != nil {
+		log.Printf("Starting https server on port : %s", portStr)
+	} else {
+		log.Printf("Starting http server on port : %s", portStr)
+	}
+	return r.listenOpts.Listen(port)
+}
+
+// listenWith listens on port, and serves the listener with cfg.
+func (r *run) listenWith(port int, cfg *tls.Config) (net.Listener, error) {
+	lis, err := r.bind(port, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return r.wrap(lis, cfg), nil
+}
+
+// listen sets up the listener of --port. A listener handed off by the server this one replaces,
+// or passed by socket activation, is served in place of --port, which is not bound.
+func (r *run) listen() error {
+	handedOff, err := greetworkload.InheritedHandoff()
+	if err != nil {
+		return err
+	}
+	inherited, err := greetworkload.InheritedListeners()
+	if err != nil {
+		return err
+	}
+	if handedOff != nil {
+		inherited = handedOff.Listeners
+	}
+	if len(inherited) > 1 {
+		return fmt.Errorf("%w: %d listening sockets passed, the server serves one", greetworkload.ErrSocketActivation, len(inherited))
+	}
+	r.handedOff = handedOff
+	switch {
+	case handedOff != nil:
+		log.Printf("Serving the listening socket handed off by PID %d, on %s, handoff_id=%s", os.Getppid(), greetworkload.CanonicalAddr(inherited[0].Addr()), handedOff.ID)
+		r.raw = r.listenOpts.Inherit(inherited[0])
+	case len(inherited) == 1:
+		log.Printf("Serving the listening socket passed by socket activation, on %s", greetworkload.CanonicalAddr(inherited[0].Addr()))
+		r.raw = r.listenOpts.Inherit(inherited[0])
+	default:
+		if r.raw, err = r.bind(r.f.port, r.tls.config); err != nil {
+			log.Fatalf("failed to listen: %v", err)
 		}
 	}
+	r.lis = r.wrap(r.raw, r.tls.config)
 	return nil
 }
 
-func (s *server) SayHelloBidirStreaming(stream pb.StreamingGreeter_SayHelloBidirStreamingServer) error {
-	for {
-		helloReq, err := stream.Recv()
-		if err == io.EOF {
-			return nil
+// start sets up what the calls of every port go through: the faults, the tracer, the handler of
+// the greet services and what it relies on, and the admin and debug endpoints.
+func (r *run) start() error {
+	f := r.f
+	faultCfg, err := f.loadFaultConfig()
+	if err != nil {
+		return err
+	}
+	if r.faults, err = greetworkload.NewFaultInjector(faultCfg, f.seed); err != nil {
+		return fmt.Errorf("invalid fault config: %v", err)
+	}
+	if faultCfg.Latency != "" {
+		// Cannot fail, NewFaultInjector parsed it already.
+		dist, _ := greetworkload.ParseLatencyDistribution(faultCfg.Latency)
+		r.meta.Latency = dist.String()
+	}
+
+	// Names are read from the HTTP/2 frames, which gRPC encrypts itself when TLS is pinned, and which
+	// h2c Upgrade connections don't start with.
+	if f.killAfterNames && !r.tls.pinned && !f.h2c() {
+		r.kills = greetworkload.NewKillListener(r.lis)
+		r.lis = r.kills
+	}
+	r.serveEndpoints()
+	r.handleDumpSignals()
+
+	if r.callers, err = greetworkload.NewCallerCounter(&greetworkload.CallerCounterOptions{
+		Path:     f.callersFile,
+		MaxNames: f.maxCallers,
+	}); err != nil {
+		return fmt.Errorf("failed to load callers: %v", err)
+	}
+	r.features = greetworkload.NewFeatureServer(f.featureMatrix(r.meta), r.faults)
+	r.callStats = greetworkload.NewCallStats()
+	r.clockSync = greetworkload.NewClockSyncServer(greetworkload.SystemClock)
+	r.binMetadata = greetworkload.NewBinaryMetadataVerifier()
+	if f.eventLogFile != "" {
+		if r.eventLog, err = greetworkload.CreateEventLog(f.eventLogFile, f.eventLogCapacity); err != nil {
+			return fmt.Errorf("invalid --event_log: %w", err)
 		}
-		if err != nil {
-			return err
+	}
+	r.tracer = greetworkload.NewRequestTracer(&greetworkload.RequestTracerOptions{
+		KeepRecords: f.recordsFile != "",
+		EventLog:    r.eventLog,
+		LogMessages: f.logRequests,
+		Ring:        r.requestRing,
+	})
+	// Reports SERVING once every port is being served, so that callers know when the server is ready.
+	r.healthSrv = health.NewServer()
+	r.healthSrv.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	// Relays forward the requests as they were received, with the fields they do not know.
+	if f.upstream != "" || f.rejectUnknownFields {
+		r.rawRequests = greetworkload.NewRawRequests(&greetworkload.RawRequestOptions{
+			Keep:                f.upstream != "",
+			RejectUnknownFields: f.rejectUnknownFields,
+		})
+	}
+	if f.upstream != "" {
+		var dialOpts []grpc.DialOption
+		if r.otel != nil {
+			dialOpts = append(dialOpts, grpc.WithUnaryInterceptor(r.otel.UnaryClientInterceptor()))
 		}
-		err = stream.Send(&pb.HelloReply{Message: "Hello " + helloReq.Name})
-		if err != nil {
-			return err
+		if r.upstreamConn, err = greetworkload.DialUpstream(f.upstream, dialOpts...); err != nil {
+			return fmt.Errorf("invalid --upstream: %w", err)
 		}
 	}
+	serverOpts := &greetworkload.ServerOptions{
+		ValidateRequests:    f.validateRequests,
+		InstanceID:          f.instanceID,
+		StreamReplyBytes:    f.streamReplyBytes,
+		StreamReplyVariants: f.streamReplyVariants,
+		Checksums:           f.checksums,
+		Callers:             r.callers,
+		ReplyFrameBytes:     f.replyFrameBytes,
+		MaxStreamReplies:    f.maxStreamReplies,
+		ConformanceNames:    f.conformanceNames,
+		HeartbeatInterval:   time.Duration(f.heartbeatIntervalMillis) * time.Millisecond,
+		Upstream:            r.upstreamConn,
+	}
+	if err := serverOpts.Validate(); err != nil {
+		return fmt.Errorf("invalid server options: %v", err)
+	}
+	r.greeter = greetworkload.NewServer(serverOpts)
+	return nil
 }
 
-func main() {
-	var port = flag.Int("port", 50051, "The port to listen.")
-	var https = flag.Bool("https", false, "Whether or not to use https")
-	var cert = flag.String("cert", "", "Path to the .crt file.")
-	var key = flag.String("key", "", "Path to the .key file.")
-	var streaming = flag.Bool("streaming", false, "Whether or not to call streaming RPC")
+// close closes the event log and the upstream connection, once the server has stopped.
+func (r *run) close() {
+	if r.eventLog != nil {
+		if err := r.eventLog.Close(); err != nil {
+			log.Printf("Failed to write the event log: %v", err)
+		}
+	}
+	if r.upstreamConn != nil {
+		r.upstreamConn.Close()
+	}
+}
 
-	const keyPairBase = "src/stirling/source_connectors/socket_tracer/protocols/http2/testing/go_grpc_server"
+// serveEndpoints serves the admin endpoint of --admin_addr and the debug endpoint of --debug_addr.
+func (r *run) serveEndpoints() {
+	f := r.f
+	if f.adminAddr != "" {
+		// GOAWAYs are written between the frames of the HTTP/2 connection, which gRPC encrypts itself
+		// when TLS is pinned, and which h2c Upgrade connections don't start with.
+		var goAways *greetworkload.GoAwayListener
+		if !r.tls.pinned && !f.h2c() {
+			goAways = greetworkload.NewGoAwayListener(r.lis)
+			r.lis = goAways
+		}
+		go func() {
+			log.Printf("Serving admin endpoint on %s", f.adminAddr)
+			log.Fatal(http.ListenAndServe(f.adminAddr, greetworkload.NewAdminMux(r.faults, goAways, r.requestRing)))
+		}()
+	}
 
-	flag.Parse()
+	if f.debugAddr != "" {
+		go func() {
+			log.Printf("Serving debug endpoint on %s", f.debugAddr)
+			log.Fatal(http.ListenAndServe(f.debugAddr, greetworkload.NewDebugMux(r.connStats, flag.CommandLine)))
+		}()
+	}
+}
 
-	portStr := ":" + strconv.Itoa(*port)
+// handleDumpSignals dumps the request ring to --request_ring_file, and re-reads --fault_config, on
+// the signals the platform has for them.
+func (r *run) handleDumpSignals() {
+	f := r.f
+	if f.requestRingFile != "" {
+		if dump, err := greetworkload.RequestRingDumpSignal(); err != nil {
+			log.Printf("--request_ring_file will not be written: %v", err)
+		} else {
+			go func() {
+				ch := make(chan os.Signal, 1)
+				signal.Notify(ch, dump)
+				for range ch {
+					d, err := r.requestRing.DumpToFile(f.requestRingFile)
+					if err != nil {
+						log.Printf("Failed to dump the request ring: %v", err)
+						continue
+					}
+					log.Printf("Dumped %d request records to %s, %d overwritten", len(d.Records), f.requestRingFile, d.Dropped)
+				}
+			}()
+		}
+	}
 
-	var lis net.Listener
-	var err error
-	if *https {
-		certFile := keyPairBase + "/https-server.crt"
-		if len(*cert) > 0 {
-			certFile = *cert
+	if f.faultConfig != "" {
+		if reload, err := greetworkload.FaultReloadSignal(); err != nil {
+			log.Printf("--fault_config will not be re-read: %v", err)
+		} else {
+			go func() {
+				ch := make(chan os.Signal, 1)
+				signal.Notify(ch, reload)
+				for range ch {
+					cfg, err := f.loadFaultConfig()
+					if err == nil {
+						err = r.faults.SetConfig(cfg)
+					}
+					if err != nil {
+						log.Printf("Failed to reload fault config: %v", err)
+						continue
+					}
+					log.Printf("Reloaded fault config: %+v", *cfg)
+				}
+			}()
+		}
+	}
+}
+
+// newServer returns a gRPC server with the interceptors, options and shared services of every
+// port, but none of the greet services.
+func (r *run) newServer() *grpc.Server {
+	f := r.f
+	var unary []grpc.UnaryServerInterceptor
+	var stream []grpc.StreamServerInterceptor
+	if r.wireSampler != nil {
+		// Ahead of everything, so that the replies it samples are those the server sends.
+		unary = append(unary, r.wireSampler.UnaryServerInterceptor())
+		stream = append(stream, r.wireSampler.StreamServerInterceptor())
+	}
+	if r.rawRequests != nil {
+		// Ahead of everything else too, so that the calls failed before their handler give up the
+		// bytes of their request.
+		unary = append(unary, r.rawRequests.UnaryServerInterceptor())
+		stream = append(stream, r.rawRequests.StreamServerInterceptor())
+	}
+	if r.otel != nil {
+		// First, so that the spans cover everything the server does with a call.
+		unary = append(unary, r.otel.UnaryServerInterceptor())
+		stream = append(stream, r.otel.StreamServerInterceptor())
+	}
+	if r.sealer != nil {
+		// Ahead of everything that looks at the requests and replies, which see them opened.
+		unary = append(unary, r.sealer.UnaryServerInterceptor())
+		stream = append(stream, r.sealer.StreamServerInterceptor())
+	}
+	// Binary metadata is checked ahead of the faults, so that every call sent with it is.
+	unary = append(unary, r.clockSync.UnaryServerInterceptor(), r.callStats.UnaryServerInterceptor(), r.tracer.UnaryServerInterceptor(), r.binMetadata.UnaryServerInterceptor())
+	stream = append(stream, r.callStats.StreamServerInterceptor(), r.tracer.StreamServerInterceptor(), r.binMetadata.StreamServerInterceptor())
+	if r.trailerBloat != nil {
+		// Ahead of the faults too, so that the calls they fail carry the entries.
+		unary = append(unary, r.trailerBloat.UnaryServerInterceptor())
+		stream = append(stream, r.trailerBloat.StreamServerInterceptor())
+	}
+	if r.cache != nil {
+		// Ahead of the faults, so that hits are answered without them.
+		unary = append(unary, r.cache.UnaryServerInterceptor())
+	}
+	unary = append(unary, r.authorityDelays.UnaryServerInterceptor(), r.faults.UnaryServerInterceptor())
+	stream = append(stream, r.authorityDelays.StreamServerInterceptor(), r.faults.StreamServerInterceptor())
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
+		grpc.StatsHandler(r.greeter.StatsHandler(r.connStats)),
+		grpc.MaxRecvMsgSize(f.maxRecvMsgSize),
+		grpc.MaxSendMsgSize(f.maxSendMsgSize),
+	}
+	opts = append(opts, r.http2Settings.ServerOptions()...)
+	opts = append(opts, r.keepaliveOpts.ServerOptions()...)
+	var codec encoding.Codec
+	if f.sizedCodec {
+		codec = pb.SizedCodec{}
+	}
+	if f.deterministicCodec {
+		codec = pb.DeterministicCodec{}
+	}
+	if (r.wireSampler != nil || r.rawRequests != nil) && codec == nil {
+		codec = encoding.GetCodec(proto.Name)
+	}
+	if codec != nil {
+		opts = append(opts, grpc.ForceServerCodec(r.wireSampler.ServerCodec(r.rawRequests.ServerCodec(codec))))
+	}
+	if r.tls.pinned {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(r.tls.config)))
+	}
+	gs := grpc.NewServer(opts...)
+	// Every port reports the calls handled by the whole process.
+	pb.RegisterGreeterStatsServer(gs, r.callStats)
+	pb.RegisterGreeterFeaturesServer(gs, r.features)
+	healthpb.RegisterHealthServer(gs, r.healthSrv)
+	// Register reflection service on gRPC server.
+	reflection.Register(gs)
+	// Channelz covers every server and channel of the process, whichever port it is asked on.
+	channelzsvc.RegisterChannelzServiceToServer(gs)
+	return gs
+}
+
+// serveGateway serves the HTTP/1.1 gateway of --gateway_port, if set.
+func (r *run) serveGateway() {
+	f := r.f
+	if f.gatewayPort < 0 {
+		return
+	}
+	gatewayLis, err := r.listenOpts.Listen(f.gatewayPort)
+	if err != nil {
+		log.Fatalf("failed to listen for the gateway: %v", err)
+	}
+	// The gateway's calls go through the same handler, and are counted, traced and failed alike.
+	gateway := greetworkload.NewGateway(r.greeter, &greetworkload.GatewayOptions{
+		Timeout:      time.Duration(f.gatewayTimeoutMillis) * time.Millisecond,
+		Interceptors: []grpc.UnaryServerInterceptor{r.callStats.UnaryServerInterceptor(), r.tracer.UnaryServerInterceptor(), r.faults.UnaryServerInterceptor()},
+	})
+	go func() {
+		log.Printf("Serving the HTTP/1.1 gateway on %s", greetworkload.CanonicalAddr(gatewayLis.Addr()))
+		log.Fatal(http.Serve(gatewayLis, gateway))
+	}()
+}
+
+// serveHTTP3 serves the experimental HTTP/3 of --http3_port, if set.
+func (r *run) serveHTTP3() {
+	f := r.f
+	if f.http3Port < 0 {
+		return
+	}
+	if err := greetworkload.CheckPlatform(greetworkload.FeatureHTTP3); err != nil {
+		fatal(err)
+	}
+	pc, err := r.listenOpts.ListenPacket(f.http3Port)
+	if err != nil {
+		log.Fatalf("failed to listen for HTTP/3: %v", err)
+	}
+	// As with the gateway, the calls go through the same handler, and are counted, traced and
+	// failed alike.
+	s := greetworkload.NewHTTP3Server(r.greeter, &greetworkload.HTTP3ServerOptions{
+		TLSConfig:    r.tls.http3Config,
+		Interceptors: []grpc.UnaryServerInterceptor{r.callStats.UnaryServerInterceptor(), r.tracer.UnaryServerInterceptor(), r.faults.UnaryServerInterceptor()},
+	})
+	go func() {
+		log.Printf("Serving experimental HTTP/3 on udp %s", greetworkload.CanonicalAddr(pc.LocalAddr()))
+		log.Fatal(s.Serve(pc))
+	}()
+}
+
+// serveServices registers the greet services served on --port on s, and serves those of
+// --tls_port and of the ports of their own, then writes --address_file.
+func (r *run) serveServices(s *grpc.Server) {
+	f := r.f
+	mainServices := f.mainServices()
+	// Services given a port of their own are served there instead of on --port.
+	separatePorts := f.separatePorts()
+	addrs := make(map[string]string)
+	for _, service := range mainServices {
+		if separatePorts[service] >= 0 {
+			continue
 		}
-		keyFile := keyPairBase + "/https-server.key"
-		if len(*key) > 0 {
-			keyFile = *key
+		if err := r.greeter.Register(s, service); err != nil {
+			log.Fatalf("failed to register %s: %v", service, err)
 		}
-		var c tls.Certificate
-		c, err = tls.LoadX509KeyPair(certFile, keyFile)
+		addrs[service] = greetworkload.CanonicalAddr(r.lis.Addr())
+	}
+	// The TLS port serves the same services as --port, from a server of its own.
+	if f.tlsPort >= 0 {
+		tlsLis, err := r.listenWith(f.tlsPort, r.tls.extraConfig)
 		if err != nil {
-			log.Fatalf("failed to load certs: %v", err)
+			log.Fatalf("failed to listen for TLS: %v", err)
 		}
-		tlsConfig := &tls.Config{Certificates: []tls.Certificate{c}}
-
-		log.Printf("Starting https server on port : %s cert: %s key: %s", portStr, certFile, keyFile)
-		lis, err = tls.Listen("tcp", portStr, tlsConfig)
-	} else {
-		log.Printf("Starting http server on port : %s", portStr)
-		lis, err = net.Listen("tcp", portStr)
+		r.tlsServer = r.newServer()
+		for _, service := range mainServices {
+			if separatePorts[service] < 0 {
+				// Registered on s above already.
+				_ = r.greeter.Register(r.tlsServer, service)
+			}
+		}
+		go func() {
+			if err := r.tlsServer.Serve(tlsLis); err != nil {
+				log.Fatalf("failed to serve TLS: %v", err)
+			}
+		}()
+		log.Printf("Serving TLS on %s", greetworkload.CanonicalAddr(tlsLis.Addr()))
 	}
+	listeners := make(map[string]net.Listener)
+	for service, port := range separatePorts {
+		if port < 0 {
+			continue
+		}
+		var err error
+		if listeners[service], err = r.listenWith(port, r.tls.config); err != nil {
+			log.Fatalf("failed to listen for %s: %v", service, err)
+		}
+	}
+	var err error
+	if r.group, err = greetworkload.NewServiceGroup(r.greeter, listeners, r.newServer); err != nil {
+		log.Fatalf("failed to create service group: %v", err)
+	}
+	for service, addr := range r.group.Addrs() {
+		addrs[service] = addr
+	}
+	if f.addressFile != "" {
+		if err := greetworkload.WriteAddressFile(f.addressFile, addrs); err != nil {
+			log.Fatalf("failed to write address file: %v", err)
+		}
+	}
+	go func() {
+		if err := r.group.Serve(); err != nil {
+			log.Fatalf("failed to serve: %v", err)
+		}
+	}()
+}
 
-	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+// stopOthers gracefully stops every server but that of --port, and reports NOT_SERVING.
+func (r *run) stopOthers() {
+	r.healthSrv.Shutdown()
+	r.group.GracefulStop()
+	if r.tlsServer != nil {
+		r.tlsServer.GracefulStop()
 	}
+}
 
-	fmt.Print(lis.Addr().(*net.TCPAddr).Port)
+// serveH2C serves s on --port with h2c, until SIGINT or SIGTERM.
+func (r *run) serveH2C(s *grpc.Server) {
+	log.Printf("Serving h2c with prior knowledge and HTTP/1.1 Upgrade")
+	srv := &http.Server{Handler: greetworkload.NewH2CHandler(s, r.http2Settings)}
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+		<-ch
+		r.stopOthers()
+		srv.Shutdown(context.Background())
+	}()
+	r.healthSrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	if err := srv.Serve(r.lis); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("failed to serve: %v", err)
+	}
+}
 
-	s := grpc.NewServer()
+// serve serves s on --port, until SIGINT or SIGTERM, or until the listener is handed off.
+func (r *run) serve(s *grpc.Server) {
+	stop := func() {
+		r.stopOthers()
+		s.GracefulStop()
+	}
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+		<-ch
+		stop()
+	}()
+	if r.handoffSignal != nil {
+		go r.handOffOn(r.handoffSignal, stop)
+	}
 
-	if *streaming {
-		log.Printf("Launching streaming server")
-		pb.RegisterStreamingGreeterServer(s, &server{})
-	} else {
-		log.Printf("Launching unary server")
-		pb.RegisterGreeterServer(s, &server{})
+	r.healthSrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	if r.handedOff != nil {
+		if err := r.handedOff.Ready(); err != nil {
+			fatal(err)
+		}
 	}
-	// Register reflection service on gRPC server.
-	reflection.Register(s)
-	if err := s.Serve(lis); err != nil {
+	if err := s.Serve(r.lis); err != nil {
 		log.Fatalf("failed to serve: %v", err)
 	}
 }
+
+// handOffOn hands the listener of --port off to a new server process on sig, then stops the
+// server with stop. Failed handoffs are logged, and the server keeps serving.
+func (r *run) handOffOn(sig os.Signal, stop func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig)
+	for range ch {
+		id, successor, err := greetworkload.StartHandoff(&greetworkload.HandoffOptions{
+			Binary:    r.f.handoffBinary,
+			Listeners: []net.Listener{r.raw},
+			Stdout:    os.Stdout,
+			Stderr:    os.Stderr,
+		})
+		if err != nil {
+			log.Printf("Handoff failed, still serving: %v handoff_id=%s", err, id)
+			continue
+		}
+		log.Printf("Handed off to PID %d, draining, handoff_id=%s", successor.Pid, id)
+		stop()
+		return
+	}
+}
+
+// report logs and writes out what the server observed, once it has stopped.
+func (r *run) report() {
+	f := r.f
+	log.Printf("Calls that ended by a context error: %d", r.greeter.ContextErrors())
+	if r.cache != nil {
+		stats := r.cache.Stats()
+		log.Printf("Reply cache: %d hits, %d misses, %d evictions", stats.Hits, stats.Misses, stats.Evictions)
+	}
+	if r.sealer != nil {
+		log.Printf("Sealed payloads that failed authentication: %d", r.sealer.AuthFailures())
+	}
+	if r.wireSampler != nil {
+		log.Printf("Wire samples: %d spooled, %d dropped", r.wireSampler.Sampled(), r.wireSampler.Dropped())
+	}
+	if r.kills != nil {
+		log.Printf("Connections killed mid-stream: %d", r.kills.Killed())
+	}
+	if r.tls.cert != nil {
+		log.Printf("TLS handshakes by server certificate serial: %s", greetworkload.FormatSerialCounts(r.tls.cert.Handshakes()))
+	}
+	if r.tls.clientSerials != nil {
+		log.Printf("TLS handshakes by client certificate serial: %s", greetworkload.FormatSerialCounts(r.tls.clientSerials.Counts()))
+	}
+	if err := r.callers.Close(); err != nil {
+		log.Printf("Failed to persist callers: %v", err)
+	}
+	if r.otel != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := r.otel.Shutdown(ctx); err != nil {
+			fatal(err)
+		}
+	}
+	if f.statsFile != "" {
+		writeFile(f.statsFile, "stats", func(w io.Writer) error {
+			return greetworkload.WriteConnStats(w, r.meta, r.connStats.Conns())
+		})
+	}
+	if f.exportFile != "" {
+		writeFile(f.exportFile, "export", func(w io.Writer) error {
+			return greetworkload.WriteRPCExport(w, r.meta, r.connStats.RPCs())
+		})
+	}
+	if f.recordsFile != "" {
+		writeFile(f.recordsFile, "records", func(w io.Writer) error {
+			return greetworkload.WriteRecords(w, r.meta, r.tracer.Records())
+		})
+	}
+	if f.clockFile != "" {
+		writeFile(f.clockFile, "clock", func(w io.Writer) error {
+			return greetworkload.WriteClockSamples(w, r.clockSync.Samples())
+		})
+	}
+}
+
+func writeFile(path, what string, write func(w io.Writer) error) {
+	if err := greetworkload.WriteOutputFile(path, write); err != nil {
+		fatal(fmt.Errorf("failed to write %s file: %w", what, err))
+	}
+}
+
+// fatal logs err and exits with the code greetworkload.ExitCode maps it to.
+func fatal(err error) {
+	log.Print(err)
+	os.Exit(greetworkload.ExitCode(err))
+}
+
+// withLatencyFlag sets the latency of cfg to that of --latency, if set, which cfg must then leave
+// unset.
+func withLatencyFlag(cfg *greetworkload.FaultConfig, latency string) error {
+	if latency == "" {
+		return nil
+	}
+	if cfg.Latency != "" {
+		return badFlags("--latency cannot be combined with the latency of --fault_config")
+	}
+	cfg.Latency = latency
+	return nil
+}
+
+// badFlags returns a greetworkload.ErrBadFlagCombination with msg.
+func badFlags(msg string) error {
+	return fmt.Errorf("%w: %s", greetworkload.ErrBadFlagCombination, msg)
+}
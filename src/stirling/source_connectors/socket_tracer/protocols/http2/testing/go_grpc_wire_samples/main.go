@@ -0,0 +1,54 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+// The wire samples tool prints the messages of a call that a greet client or server run with
+// -wire_sample_every spooled, as hex dumps of the bytes the codec marshaled or unmarshaled.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+func main() {
+	dir := flag.String("dir", "", "The -wire_sample_dir of the run.")
+	requestID := flag.String("request_id", "", "The x-request-id of the call to print the samples of.")
+	flag.Parse()
+
+	if *dir == "" || *requestID == "" {
+		log.Fatal("-dir and -request_id must be set")
+	}
+	samples, err := greetworkload.ReadWireSamples(*dir, *requestID)
+	if err != nil {
+		log.Fatalf("Failed to read the samples of %s, error: %v", *requestID, err)
+	}
+	if len(samples) == 0 {
+		log.Fatalf("No samples of %s in %s", *requestID, *dir)
+	}
+	for _, s := range samples {
+		direction := "received"
+		if s.Sent {
+			direction = "sent"
+		}
+		fmt.Printf("%s %s %s %s, %d bytes\n%s\n", s.Time.Format(time.RFC3339Nano), s.Method, s.Side, direction, len(s.Data), hex.Dump(s.Data))
+	}
+}
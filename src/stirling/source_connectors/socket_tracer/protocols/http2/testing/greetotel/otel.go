@@ -0,0 +1,376 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+// Package greetotel makes OpenTelemetry spans of the calls of the greet workload. It is kept out of
+// greetworkload so that the greet client and server can be built without the OpenTelemetry SDK,
+// which needs Go 1.18, for the older Go releases the tracer is tested against.
+package greetotel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// OTLPScheme prefixes the Options.Out of an OTLP/gRPC collector, e.g. "otlp://localhost:4317".
+const OTLPScheme = "otlp://"
+
+// requestIDAttribute is the span attribute that carries the RequestIDHeader of a call, named as
+// the OpenTelemetry conventions name gRPC request metadata.
+var requestIDAttribute = attribute.Key("rpc.grpc.request.metadata." + greetworkload.RequestIDHeader)
+
+// Options configure the spans exported by a Tracer.
+type Options struct {
+	// Out is where spans are exported: an OTLP/gRPC collector, given as OTLPScheme followed by its
+	// address, which is dialed without TLS, or else the path of the JSON file Shutdown writes.
+	Out string
+	// ServiceName names the process in the resource of its spans.
+	ServiceName string
+}
+
+// SpanRecord is a finished span, as written to the JSON file of a Tracer.
+type SpanRecord struct {
+	Name string `json:"name"`
+	// Kind is "client" or "server".
+	Kind         string    `json:"kind"`
+	TraceID      string    `json:"trace_id"`
+	SpanID       string    `json:"span_id"`
+	ParentSpanID string    `json:"parent_span_id,omitempty"`
+	StartTime    time.Time `json:"start_time"`
+	EndTime      time.Time `json:"end_time"`
+	// Attributes hold the rpc.* attributes of the span, including the gRPC status code and the
+	// request ID of the call, rendered as strings.
+	Attributes map[string]string `json:"attributes"`
+	// Error is the description of the status of a span that ended in error.
+	Error string `json:"error,omitempty"`
+}
+
+// Tracer is a greetworkload.SpanTracer making an OpenTelemetry span of every call made or handled
+// through its interceptors, apart from those to GreeterStats, GreeterFeatures, health and
+// reflection, and exporting them. Client spans are propagated to the server in the W3C traceparent
+// header, so that the server's span of a call is a child of the client's.
+type Tracer struct {
+	provider   *sdktrace.TracerProvider
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	// spans collects the spans to write to path, if not exported to a collector.
+	spans *spanCollector
+	path  string
+}
+
+// NewTracer creates a Tracer exporting its spans as opts say. Collectors are dialed
+// lazily, so that a collector that is not up yet only loses the spans exported before it is.
+func NewTracer(opts *Options) (*Tracer, error) {
+	if opts.Out == "" {
+		return nil, fmt.Errorf("%w: spans need an output", greetworkload.ErrBadFlagCombination)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(opts.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+	t := &Tracer{propagator: propagation.TraceContext{}}
+	var exportOpt sdktrace.TracerProviderOption
+	if strings.HasPrefix(opts.Out, OTLPScheme) {
+		addr := strings.TrimPrefix(opts.Out, OTLPScheme)
+		exporter, err := otlptracegrpc.New(context.Background(), otlptracegrpc.WithEndpoint(addr), otlptracegrpc.WithInsecure())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the OTLP exporter: %w", err)
+		}
+		exportOpt = sdktrace.WithBatcher(exporter)
+	} else {
+		// Exported as soon as they end, so that Spans returns every span of the calls made so far.
+		t.spans = &spanCollector{}
+		t.path = opts.Out
+		exportOpt = sdktrace.WithSyncer(t.spans)
+	}
+	t.provider = sdktrace.NewTracerProvider(exportOpt, sdktrace.WithResource(res), sdktrace.WithSampler(sdktrace.AlwaysSample()))
+	t.tracer = t.provider.Tracer("px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetotel")
+	return t, nil
+}
+
+// Spans returns the spans that ended so far, if they are written to a file, and nil otherwise.
+func (t *Tracer) Spans() []SpanRecord {
+	if t.spans == nil {
+		return nil
+	}
+	return t.spans.records()
+}
+
+// Shutdown exports the spans not exported yet, writing them to the JSON file if they go to one,
+// and stops the tracer. Spans that end afterwards are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if err := t.provider.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to export spans: %w", err)
+	}
+	if t.spans == nil {
+		return nil
+	}
+	return greetworkload.WriteOutputFile(t.path, func(w io.Writer) error {
+		return WriteSpans(w, t.spans.records())
+	})
+}
+
+// UnaryClientInterceptor returns an interceptor that makes a client span of every unary call, and
+// sends its context to the server.
+func (t *Tracer) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if greetworkload.OutsideWorkload(method) {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		ctx, span := t.startClient(ctx, method)
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		endSpan(span, err)
+		return err
+	}
+}
+
+// StreamClientInterceptor returns an interceptor that makes a client span of every streaming
+// call, ended once the call finishes, as the client reads the end of the stream or an error.
+func (t *Tracer) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if greetworkload.OutsideWorkload(method) {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+		ctx, span := t.startClient(ctx, method)
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+		s := &spannedClientStream{ClientStream: stream, span: span, serverStreams: desc.ServerStreams}
+		// Calls abandoned before the end of their stream end with their context.
+		go func() {
+			<-ctx.Done()
+			s.end(ctx.Err())
+		}()
+		return s, nil
+	}
+}
+
+// UnaryServerInterceptor returns an interceptor that makes a server span of every unary call
+// handled, as a child of the span the client sent, if any.
+func (t *Tracer) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if greetworkload.OutsideWorkload(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		ctx, span := t.startServer(ctx, info.FullMethod)
+		resp, err := handler(ctx, req)
+		endSpan(span, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor returns an interceptor that makes a server span of every streaming call
+// handled, as a child of the span the client sent, if any.
+func (t *Tracer) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if greetworkload.OutsideWorkload(info.FullMethod) {
+			return handler(srv, ss)
+		}
+		ctx, span := t.startServer(ss.Context(), info.FullMethod)
+		err := handler(srv, &spannedServerStream{ServerStream: ss, ctx: ctx})
+		endSpan(span, err)
+		return err
+	}
+}
+
+func (t *Tracer) startClient(ctx context.Context, method string) (context.Context, trace.Span) {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	ctx, span := t.tracer.Start(ctx, strings.TrimPrefix(method, "/"), trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(rpcAttributes(method, md)...))
+	md = md.Copy()
+	t.propagator.Inject(ctx, metadataCarrier(md))
+	return metadata.NewOutgoingContext(ctx, md), span
+}
+
+func (t *Tracer) startServer(ctx context.Context, method string) (context.Context, trace.Span) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = t.propagator.Extract(ctx, metadataCarrier(md))
+	return t.tracer.Start(ctx, strings.TrimPrefix(method, "/"), trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(rpcAttributes(method, md)...))
+}
+
+// rpcAttributes returns the attributes of the span of a call to method with the metadata md.
+func rpcAttributes(method string, md metadata.MD) []attribute.KeyValue {
+	service, name := strings.TrimPrefix(method, "/"), ""
+	if i := strings.Index(service, "/"); i >= 0 {
+		service, name = service[:i], service[i+1:]
+	}
+	attrs := []attribute.KeyValue{semconv.RPCSystemGRPC, semconv.RPCService(service), semconv.RPCMethod(name)}
+	if v := md.Get(greetworkload.RequestIDHeader); len(v) == 1 {
+		attrs = append(attrs, requestIDAttribute.String(v[0]))
+	}
+	return attrs
+}
+
+// endSpan ends span with the status of a call that returned err.
+func endSpan(span trace.Span, err error) {
+	s := status.Convert(err)
+	span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(s.Code())))
+	if err != nil {
+		span.SetStatus(otelcodes.Error, s.Message())
+	}
+	span.End()
+}
+
+// metadataCarrier carries the trace context in gRPC metadata.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// spannedClientStream ends the span of a streaming call once the call finishes.
+type spannedClientStream struct {
+	grpc.ClientStream
+	span          trace.Span
+	serverStreams bool
+	once          sync.Once
+}
+
+func (s *spannedClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	switch {
+	case err == io.EOF:
+		s.end(nil)
+	case err != nil:
+		s.end(err)
+	case !s.serverStreams:
+		// Calls without a reply stream finish with their only reply.
+		s.end(nil)
+	}
+	return err
+}
+
+func (s *spannedClientStream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+	if err != nil && err != io.EOF {
+		s.end(err)
+	}
+	return err
+}
+
+func (s *spannedClientStream) end(err error) {
+	s.once.Do(func() { endSpan(s.span, err) })
+}
+
+// spannedServerStream hands the context holding the server span to the handler.
+type spannedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *spannedServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// spanCollector is a span exporter keeping every span exported.
+type spanCollector struct {
+	mu    sync.Mutex
+	spans []SpanRecord
+}
+
+func (c *spanCollector) ExportSpans(_ context.Context, spans []sdktrace.ReadOnlySpan) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range spans {
+		c.spans = append(c.spans, spanRecord(s))
+	}
+	return nil
+}
+
+func (c *spanCollector) Shutdown(context.Context) error {
+	return nil
+}
+
+func (c *spanCollector) records() []SpanRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]SpanRecord(nil), c.spans...)
+}
+
+func spanRecord(s sdktrace.ReadOnlySpan) SpanRecord {
+	r := SpanRecord{
+		Name:       s.Name(),
+		Kind:       s.SpanKind().String(),
+		TraceID:    s.SpanContext().TraceID().String(),
+		SpanID:     s.SpanContext().SpanID().String(),
+		StartTime:  s.StartTime(),
+		EndTime:    s.EndTime(),
+		Attributes: make(map[string]string),
+	}
+	if s.Parent().IsValid() {
+		r.ParentSpanID = s.Parent().SpanID().String()
+	}
+	for _, kv := range s.Attributes() {
+		r.Attributes[string(kv.Key)] = kv.Value.Emit()
+	}
+	if s.Status().Code == otelcodes.Error {
+		r.Error = s.Status().Description
+	}
+	return r
+}
+
+// WriteSpans writes spans as a JSON array.
+func WriteSpans(w io.Writer, spans []SpanRecord) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(spans)
+}
+
+// ReadSpans reads the JSON array written by WriteSpans.
+func ReadSpans(r io.Reader) ([]SpanRecord, error) {
+	var spans []SpanRecord
+	if err := json.NewDecoder(r).Decode(&spans); err != nil {
+		return nil, err
+	}
+	return spans, nil
+}
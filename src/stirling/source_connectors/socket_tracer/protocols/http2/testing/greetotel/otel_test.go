@@ -0,0 +1,238 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetotel_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetotel"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+const requestIDAttribute = "rpc.grpc.request.metadata.x-request-id"
+
+func newTracer(t *testing.T, name string) *greetotel.Tracer {
+	otel, err := greetotel.NewTracer(&greetotel.Options{
+		Out:         filepath.Join(t.TempDir(), name+".json"),
+		ServiceName: name,
+	})
+	require.NoError(t, err)
+	return otel
+}
+
+// startOTelServer starts a server that traces the calls it handles with otel, then tracer, then
+// fails them as faults say.
+func startOTelServer(t *testing.T, otel *greetotel.Tracer, tracer *greetworkload.RequestTracer, faults *greetworkload.FaultInjector) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(otel.UnaryServerInterceptor(), tracer.UnaryServerInterceptor(), faults.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(otel.StreamServerInterceptor(), tracer.StreamServerInterceptor(), faults.StreamServerInterceptor()),
+	)
+	greeter := greetworkload.NewServer(nil)
+	pb.RegisterGreeterServer(s, greeter)
+	pb.RegisterStreamingGreeterServer(s, greeter)
+	healthpb.RegisterHealthServer(s, health.NewServer())
+	go func() { _ = s.Serve(lis) }()
+	t.Cleanup(s.Stop)
+	return lis.Addr().String()
+}
+
+// spanOf returns the span of kind with the request ID of r.
+func spanOf(t *testing.T, spans []greetotel.SpanRecord, kind string, r *greetworkload.CallRecord) greetotel.SpanRecord {
+	for _, s := range spans {
+		if s.Kind == kind && s.Attributes[requestIDAttribute] == r.RequestID {
+			return s
+		}
+	}
+	require.Failf(t, "span not found", "no %s span of %s %s", kind, r.Method, r.RequestID)
+	return greetotel.SpanRecord{}
+}
+
+func endOf(r *greetworkload.CallRecord) time.Time {
+	return r.StartTime.Add(time.Duration(r.DurationNS))
+}
+
+// assertWithin asserts that the span [start, end] lies within [outerStart, outerEnd].
+func assertWithin(t *testing.T, start, end, outerStart, outerEnd time.Time, msg string) {
+	assert.False(t, start.Before(outerStart), "%s starts %v early", msg, outerStart.Sub(start))
+	assert.False(t, end.After(outerEnd), "%s ends %v late", msg, end.Sub(outerEnd))
+}
+
+func TestTracer_ServerSpansAreChildrenOfClientSpans(t *testing.T) {
+	clientOTel := newTracer(t, "greet_client")
+	serverOTel := newTracer(t, "greet_server")
+	tracer := greetworkload.NewRequestTracer(&greetworkload.RequestTracerOptions{KeepRecords: true})
+	faults, err := greetworkload.NewFaultInjector(&greetworkload.FaultConfig{LatencyMillis: 20}, 1)
+	require.NoError(t, err)
+	addr := startOTelServer(t, serverOTel, tracer, faults)
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, StreamCount: 3, OTel: clientOTel})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	records := []*greetworkload.CallRecord{
+		c.SayHello(conn, "pixie"),
+		c.ServerStreaming(conn, "pixie"),
+		c.ClientStreaming(conn, []string{"a", "b"}),
+		c.BidirStreaming(conn, []string{"a", "b"}),
+	}
+	serverRecords := make(map[string]*greetworkload.CallRecord)
+	for _, r := range tracer.Records() {
+		serverRecords[r.RequestID] = r
+	}
+
+	clientSpans, serverSpans := clientOTel.Spans(), serverOTel.Spans()
+	require.Len(t, clientSpans, len(records))
+	require.Len(t, serverSpans, len(records))
+	for _, r := range records {
+		require.True(t, r.Completed(), r.Error)
+		client := spanOf(t, clientSpans, "client", r)
+		server := spanOf(t, serverSpans, "server", r)
+
+		assert.Empty(t, client.ParentSpanID, r.Method)
+		assert.Equal(t, client.TraceID, server.TraceID, r.Method)
+		assert.Equal(t, client.SpanID, server.ParentSpanID, r.Method)
+		for _, s := range []greetotel.SpanRecord{client, server} {
+			assert.Equal(t, "grpc", s.Attributes["rpc.system"])
+			assert.Equal(t, s.Attributes["rpc.service"]+"/"+r.Method, s.Name)
+			assert.Equal(t, "0", s.Attributes["rpc.grpc.status_code"], s.Name)
+			assert.Empty(t, s.Error, s.Name)
+		}
+		assert.Equal(t, client.Name, server.Name)
+		assert.Equal(t, r.Method, client.Attributes["rpc.method"])
+
+		// The spans nest on the way from the client's record of the call to the server's.
+		assertWithin(t, client.StartTime, client.EndTime, r.StartTime, endOf(r), "the client span of "+r.Method)
+		assertWithin(t, server.StartTime, server.EndTime, client.StartTime, client.EndTime, "the server span of "+r.Method)
+		serverRecord, ok := serverRecords[r.RequestID]
+		require.True(t, ok, r.Method)
+		assertWithin(t, serverRecord.StartTime, endOf(serverRecord), server.StartTime, server.EndTime, "the server record of "+r.Method)
+		assert.GreaterOrEqual(t, client.EndTime.Sub(client.StartTime), 20*time.Millisecond, r.Method)
+	}
+}
+
+func TestTracer_RecordsFailures(t *testing.T) {
+	clientOTel := newTracer(t, "greet_client")
+	serverOTel := newTracer(t, "greet_server")
+	faults, err := greetworkload.NewFaultInjector(&greetworkload.FaultConfig{ErrorRate: 1, Code: codes.Unavailable}, 1)
+	require.NoError(t, err)
+	addr := startOTelServer(t, serverOTel, greetworkload.NewRequestTracer(nil), faults)
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, OTel: clientOTel})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for _, r := range []*greetworkload.CallRecord{c.SayHello(conn, "pixie"), c.ServerStreaming(conn, "pixie")} {
+		require.Equal(t, codes.Unavailable.String(), r.Code)
+		for _, s := range []greetotel.SpanRecord{spanOf(t, clientOTel.Spans(), "client", r), spanOf(t, serverOTel.Spans(), "server", r)} {
+			assert.Equal(t, strconv.Itoa(int(codes.Unavailable)), s.Attributes["rpc.grpc.status_code"], s.Name)
+			assert.NotEmpty(t, s.Error, s.Name)
+		}
+	}
+}
+
+func TestTracer_UntracedClientMakesRootSpans(t *testing.T) {
+	serverOTel := newTracer(t, "greet_server")
+	faults, err := greetworkload.NewFaultInjector(nil, 1)
+	require.NoError(t, err)
+	addr := startOTelServer(t, serverOTel, greetworkload.NewRequestTracer(nil), faults)
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	r := c.SayHello(conn, "pixie")
+	require.True(t, r.Completed(), r.Error)
+	server := spanOf(t, serverOTel.Spans(), "server", r)
+	assert.Empty(t, server.ParentSpanID)
+	assert.NotEmpty(t, server.TraceID)
+}
+
+func TestTracer_SkipsObservationMethods(t *testing.T) {
+	clientOTel := newTracer(t, "greet_client")
+	serverOTel := newTracer(t, "greet_server")
+	faults, err := greetworkload.NewFaultInjector(nil, 1)
+	require.NoError(t, err)
+	addr := startOTelServer(t, serverOTel, greetworkload.NewRequestTracer(nil), faults)
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{OTel: clientOTel})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	assert.Empty(t, clientOTel.Spans())
+	assert.Empty(t, serverOTel.Spans())
+}
+
+func TestTracer_ShutdownWritesSpans(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	otel, err := greetotel.NewTracer(&greetotel.Options{Out: path, ServiceName: "greet_client"})
+	require.NoError(t, err)
+	faults, err := greetworkload.NewFaultInjector(nil, 1)
+	require.NoError(t, err)
+	addr := startOTelServer(t, newTracer(t, "greet_server"), greetworkload.NewRequestTracer(nil), faults)
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, OTel: otel})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	for i := 0; i < 3; i++ {
+		require.True(t, c.SayHello(conn, "pixie").Completed())
+	}
+	require.NoError(t, otel.Shutdown(context.Background()))
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	spans, err := greetotel.ReadSpans(f)
+	require.NoError(t, err)
+	require.Len(t, spans, 3)
+	for i, s := range spans {
+		want := otel.Spans()[i]
+		assert.Equal(t, want.SpanID, s.SpanID)
+		assert.True(t, want.StartTime.Equal(s.StartTime))
+		assert.Equal(t, want.Attributes, s.Attributes)
+	}
+}
+
+func TestNewTracer_RequiresOutput(t *testing.T) {
+	_, err := greetotel.NewTracer(&greetotel.Options{})
+	assert.ErrorIs(t, err, greetworkload.ErrBadFlagCombination)
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// The environment variables of socket activation, as systemd sets them: the process the listening
+// sockets are passed to, and how many are.
+const (
+	ListenPIDEnv = "LISTEN_PID"
+	ListenFDsEnv = "LISTEN_FDS"
+	// listenFDNamesEnv names the sockets passed. They are told apart by their order instead.
+	listenFDNamesEnv = "LISTEN_FDNAMES"
+)
+
+// ListenFDsStart is the file descriptor of the first listening socket passed by socket activation.
+// The others follow it.
+const ListenFDsStart = 3
+
+// ErrSocketActivation reports socket activation variables that are malformed, or file descriptors
+// passed that are not TCP listening sockets.
+var ErrSocketActivation = errors.New("invalid socket activation")
+
+// InheritedListeners returns the TCP listeners passed to the process by socket activation, the
+// way systemd passes them: the LISTEN_FDS file descriptors from ListenFDsStart on, for the process
+// LISTEN_PID. It returns none when LISTEN_FDS is not set, or when LISTEN_PID is another process,
+// which the sockets were not meant for. Unlike systemd, a LISTEN_FDS without a LISTEN_PID is an
+// error, so that a parent forgetting to set it does not leave the server binding the port itself.
+//
+// The variables are unset, so that the processes the server starts are not handed the sockets
+// again.
+func InheritedListeners() ([]net.Listener, error) {
+	fds, ok := os.LookupEnv(ListenFDsEnv)
+	if !ok {
+		return nil, nil
+	}
+	pid, pidSet := os.LookupEnv(ListenPIDEnv)
+	for _, env := range []string{ListenFDsEnv, ListenPIDEnv, listenFDNamesEnv} {
+		os.Unsetenv(env)
+	}
+	if !pidSet {
+		return nil, fmt.Errorf("%w: %s is set without %s", ErrSocketActivation, ListenFDsEnv, ListenPIDEnv)
+	}
+	p, err := strconv.Atoi(pid)
+	if err != nil || p <= 0 {
+		return nil, fmt.Errorf("%w: %s must be a process ID, got %q", ErrSocketActivation, ListenPIDEnv, pid)
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("%w: %s must be a positive number of file descriptors, got %q", ErrSocketActivation, ListenFDsEnv, fds)
+	}
+	if p != os.Getpid() {
+		return nil, nil
+	}
+
+	listeners := make([]net.Listener, 0, n)
+	for fd := ListenFDsStart; fd < ListenFDsStart+n; fd++ {
+		lis, err := fileListener(fd)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, lis)
+	}
+	return listeners, nil
+}
+
+// fileListener returns a TCP listener on the socket of fd, which is closed once the listener has a
+// copy of its own.
+func fileListener(fd int) (net.Listener, error) {
+	f := os.NewFile(uintptr(fd), "listen_fd_"+strconv.Itoa(fd))
+	defer f.Close()
+	lis, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("%w: file descriptor %d: %w", ErrSocketActivation, fd, err)
+	}
+	if _, ok := lis.(*net.TCPListener); !ok {
+		lis.Close()
+		return nil, fmt.Errorf("%w: file descriptor %d is a %s listener, not TCP", ErrSocketActivation, fd, lis.Addr().Network())
+	}
+	return lis, nil
+}
+
+// Inherit returns lis, a listener passed by socket activation, with the socket options of o that
+// are set on the connections it accepts: Nagle's algorithm and a positive keepalive. The others
+// are set on the listening socket, which the parent set up, and are left as it set them.
+func (o *ListenOptions) Inherit(lis net.Listener) net.Listener {
+	if o.Socket == nil || !o.Socket.configures() {
+		return lis
+	}
+	return &socketListener{Listener: lis, opts: o.Socket}
+}
@@ -0,0 +1,246 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+const activationHelperEnv = "GREET_ACTIVATION_HELPER"
+
+// TestActivationHelper is not a test: it stands in for the server when the test binary is started
+// with a listening socket passed by socket activation, with plaintext or tls in
+// GREET_ACTIVATION_HELPER. It serves Greeter on the inherited listener, and writes its address to
+// --address_file. Without an inherited listener, it listens on --port as the server does, which
+// fails as the parent still holds the port: the server serving at all shows it did not listen.
+func TestActivationHelper(t *testing.T) {
+	mode := os.Getenv(activationHelperEnv)
+	if mode == "" {
+		t.Skip("only run by the socket activation tests")
+	}
+	args := os.Args
+	for i, arg := range args {
+		if arg == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+	fs := flag.NewFlagSet(mode, flag.ExitOnError)
+	port := fs.Int("port", 0, "")
+	addressFile := fs.String("address_file", "", "")
+	_ = fs.Parse(args)
+
+	listenOpts := &greetworkload.ListenOptions{Host: "127.0.0.1"}
+	inherited, err := greetworkload.InheritedListeners()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(3)
+	}
+	var lis net.Listener
+	if len(inherited) == 1 {
+		lis = listenOpts.Inherit(inherited[0])
+	} else if lis, err = listenOpts.Listen(*port); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if mode == "tls" {
+		lis = tls.NewListener(lis, &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}})
+	}
+
+	s := grpc.NewServer()
+	pb.RegisterGreeterServer(s, greetworkload.NewServer(nil))
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGTERM)
+		<-ch
+		s.GracefulStop()
+	}()
+	addrs := map[string]string{greetworkload.GreeterService: greetworkload.CanonicalAddr(lis.Addr())}
+	if err := greetworkload.WriteAddressFile(*addressFile, addrs); err != nil {
+		os.Exit(2)
+	}
+	_ = s.Serve(lis)
+	os.Exit(0)
+}
+
+// startActivated starts the test binary as the server of mode, passed lis by socket activation,
+// with its stderr written to stderr. LISTEN_PID is only known once the process is started, so a shell sets it before it execs the
+// server, as systemd does between fork and exec.
+func startActivated(t *testing.T, mode string, port int, addressFile string, lis *os.File, stderr io.Writer) *exec.Cmd {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found")
+	}
+	cmd := exec.Command(sh, "-c", `LISTEN_PID=$$ exec "$0" "$@"`, os.Args[0], "-test.run=^TestActivationHelper$", "--",
+		"--port", strconv.Itoa(port), "--address_file", addressFile)
+	cmd.Env = append(os.Environ(), activationHelperEnv+"="+mode, greetworkload.ListenFDsEnv+"=1")
+	cmd.ExtraFiles = []*os.File{lis}
+	cmd.Stderr = stderr
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	return cmd
+}
+
+// readAddressFile waits for the address file at path to be written, and returns its addresses.
+func readAddressFile(t *testing.T, path string) map[string]string {
+	var b []byte
+	require.Eventually(t, func() bool {
+		var err error
+		b, err = os.ReadFile(path)
+		return err == nil && len(b) > 0
+	}, 10*time.Second, 10*time.Millisecond)
+	var entries []struct {
+		Service string `json:"service"`
+		Address string `json:"address"`
+	}
+	require.NoError(t, json.Unmarshal(b, &entries))
+	addrs := make(map[string]string)
+	for _, e := range entries {
+		addrs[e.Service] = e.Address
+	}
+	return addrs
+}
+
+func TestInheritedListeners_ServesSayHello(t *testing.T) {
+	for _, mode := range []string{"plaintext", "tls"} {
+		mode := mode
+		t.Run(mode, func(t *testing.T) {
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			f, err := lis.(*net.TCPListener).File()
+			require.NoError(t, err)
+			// The server is left the only holder of the socket. The port stays bound, so that
+			// listening on it again would fail.
+			lis.Close()
+			defer f.Close()
+			port := lis.Addr().(*net.TCPAddr).Port
+
+			addressFile := filepath.Join(t.TempDir(), "addresses.json")
+			cmd := startActivated(t, mode, port, addressFile, f, os.Stderr)
+			addr := readAddressFile(t, addressFile)[greetworkload.GreeterService]
+			assert.Equal(t, greetworkload.CanonicalAddr(lis.Addr()), addr)
+
+			c := greetworkload.NewClient(&greetworkload.ClientOptions{HTTPS: mode == "tls", Timeout: 10 * time.Second})
+			conn, err := c.Dial(addr)
+			require.NoError(t, err)
+			defer conn.Close()
+			r := c.SayHello(conn, "pixie")
+			assert.Equal(t, codes.OK.String(), r.Code, r.Error)
+
+			require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+			require.NoError(t, cmd.Wait())
+		})
+	}
+}
+
+func TestInheritedListeners_NotAListener(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "not-a-socket"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	var stderr bytes.Buffer
+	cmd := startActivated(t, "plaintext", 0, filepath.Join(t.TempDir(), "addresses.json"), f, &stderr)
+	var exitErr *exec.ExitError
+	require.ErrorAs(t, cmd.Wait(), &exitErr)
+	assert.Equal(t, 3, exitErr.ExitCode())
+	assert.Contains(t, stderr.String(), "invalid socket activation: file descriptor 3")
+}
+
+// setActivationEnv sets the socket activation variables for the test, unsetting those given "".
+func setActivationEnv(t *testing.T, pid, fds string) {
+	for env, value := range map[string]string{greetworkload.ListenPIDEnv: pid, greetworkload.ListenFDsEnv: fds} {
+		t.Setenv(env, value)
+		if value == "" {
+			os.Unsetenv(env)
+		}
+	}
+}
+
+func TestInheritedListeners_NotActivated(t *testing.T) {
+	setActivationEnv(t, "", "")
+	listeners, err := greetworkload.InheritedListeners()
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+}
+
+func TestInheritedListeners_OtherProcess(t *testing.T) {
+	setActivationEnv(t, strconv.Itoa(os.Getppid()), "1")
+	listeners, err := greetworkload.InheritedListeners()
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+	_, ok := os.LookupEnv(greetworkload.ListenFDsEnv)
+	assert.False(t, ok, "LISTEN_FDS is passed on")
+}
+
+func TestInheritedListeners_Malformed(t *testing.T) {
+	self := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name    string
+		pid     string
+		fds     string
+		wantErr string
+	}{
+		{name: "no pid", fds: "1", wantErr: "LISTEN_FDS is set without LISTEN_PID"},
+		{name: "pid not a number", pid: "self", fds: "1", wantErr: `LISTEN_PID must be a process ID, got "self"`},
+		{name: "pid zero", pid: "0", fds: "1", wantErr: `LISTEN_PID must be a process ID, got "0"`},
+		{name: "fds not a number", pid: self, fds: "one", wantErr: `LISTEN_FDS must be a positive number of file descriptors, got "one"`},
+		{name: "fds empty", pid: self, fds: " ", wantErr: `got " "`},
+		{name: "no fds", pid: self, fds: "0", wantErr: `got "0"`},
+		{name: "negative fds", pid: self, fds: "-1", wantErr: `got "-1"`},
+		// Malformed variables are errors even when meant for another process.
+		{name: "fds malformed for another process", pid: strconv.Itoa(os.Getppid()), fds: "1x", wantErr: `got "1x"`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			setActivationEnv(t, tc.pid, tc.fds)
+			listeners, err := greetworkload.InheritedListeners()
+			assert.ErrorIs(t, err, greetworkload.ErrSocketActivation)
+			assert.ErrorContains(t, err, tc.wantErr)
+			assert.Empty(t, listeners)
+			for _, env := range []string{greetworkload.ListenPIDEnv, greetworkload.ListenFDsEnv} {
+				_, ok := os.LookupEnv(env)
+				assert.False(t, ok, "%s is passed on", env)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// The adjustments RunAdaptive makes to its concurrency at the end of every interval.
+const (
+	// AdaptiveIncrease adds AdaptiveOptions.Increase calls in flight, after an interval whose p99
+	// was under target.
+	AdaptiveIncrease = "increase"
+	// AdaptiveDecrease multiplies the calls in flight by AdaptiveOptions.Backoff, after an interval
+	// whose p99 was over target.
+	AdaptiveDecrease = "decrease"
+	// AdaptiveHold keeps the calls in flight, after an interval in which no call completed, or
+	// under target at MaxConcurrency already.
+	AdaptiveHold = "hold"
+)
+
+// The defaults of AdaptiveOptions.
+const (
+	DefaultAdaptiveInterval       = time.Second
+	DefaultAdaptiveMaxConcurrency = 1024
+	DefaultAdaptiveBackoff        = 0.9
+)
+
+// AdaptiveOptions configure RunAdaptive.
+type AdaptiveOptions struct {
+	// TargetP99 is the latency the p99 of the calls completed over an interval is kept under.
+	TargetP99 time.Duration
+	// Duration is how long new calls keep being started. Calls still in flight once it elapses are
+	// allowed to finish, and are recorded.
+	Duration time.Duration
+	// Interval is how often the concurrency is adjusted. Zero is DefaultAdaptiveInterval.
+	Interval time.Duration
+	// InitialConcurrency is the number of calls in flight at first. Zero is 1.
+	InitialConcurrency int
+	// MaxConcurrency bounds the number of calls in flight. Zero is DefaultAdaptiveMaxConcurrency.
+	MaxConcurrency int
+	// Increase is the number of calls in flight added after an interval under target. Zero is 1.
+	Increase int
+	// Backoff, in (0, 1), multiplies the calls in flight after an interval over target. Zero is
+	// DefaultAdaptiveBackoff.
+	Backoff float64
+}
+
+func (o *AdaptiveOptions) interval() time.Duration {
+	if o.Interval == 0 {
+		return DefaultAdaptiveInterval
+	}
+	return o.Interval
+}
+
+func (o *AdaptiveOptions) initialConcurrency() int {
+	if o.InitialConcurrency == 0 {
+		return 1
+	}
+	return o.InitialConcurrency
+}
+
+func (o *AdaptiveOptions) maxConcurrency() int {
+	if o.MaxConcurrency == 0 {
+		return DefaultAdaptiveMaxConcurrency
+	}
+	return o.MaxConcurrency
+}
+
+func (o *AdaptiveOptions) increase() int {
+	if o.Increase == 0 {
+		return 1
+	}
+	return o.Increase
+}
+
+func (o *AdaptiveOptions) backoff() float64 {
+	if o.Backoff == 0 {
+		return DefaultAdaptiveBackoff
+	}
+	return o.Backoff
+}
+
+// Validate checks that the target, duration and interval are positive, and that the concurrency
+// can be adjusted as set.
+func (o *AdaptiveOptions) Validate() error {
+	if o.TargetP99 <= 0 || o.Duration <= 0 {
+		return badFlagsf("the target p99 and duration must be positive, got %v and %v", o.TargetP99, o.Duration)
+	}
+	if o.Interval < 0 || o.InitialConcurrency < 0 || o.MaxConcurrency < 0 || o.Increase < 0 {
+		return badFlagsf("the interval, concurrencies and increase cannot be negative")
+	}
+	if o.initialConcurrency() > o.maxConcurrency() {
+		return badFlagsf("the initial concurrency %d is above the max concurrency %d", o.initialConcurrency(), o.maxConcurrency())
+	}
+	if b := o.backoff(); b <= 0 || b >= 1 {
+		return badFlagsf("the backoff must be between 0 and 1, got %v", o.Backoff)
+	}
+	return nil
+}
+
+// next returns the concurrency after an interval at concurrency whose calls completed with p99,
+// and the adjustment that it is.
+func (o *AdaptiveOptions) next(concurrency int, completed int64, p99 time.Duration) (int, string) {
+	switch {
+	case completed == 0:
+		return concurrency, AdaptiveHold
+	case p99 > o.TargetP99:
+		return int(math.Max(1, math.Floor(float64(concurrency)*o.backoff()))), AdaptiveDecrease
+	case concurrency >= o.maxConcurrency():
+		return concurrency, AdaptiveHold
+	default:
+		return int(math.Min(float64(o.maxConcurrency()), float64(concurrency+o.increase()))), AdaptiveIncrease
+	}
+}
+
+// AdaptiveStep is an interval of a RunAdaptive run, and the adjustment made at its end.
+type AdaptiveStep struct {
+	// ElapsedNS is the offset of the end of the interval into the run.
+	ElapsedNS int64 `json:"elapsed_ns"`
+	// Concurrency is the number of calls kept in flight over the interval.
+	Concurrency int `json:"concurrency"`
+	// Completed and Failed are the number of calls that finished over the interval.
+	Completed int64 `json:"completed"`
+	Failed    int64 `json:"failed"`
+	// QPS is the number of calls that completed per second over the interval.
+	QPS float64 `json:"qps"`
+	// P99NS is the p99 latency of the calls that completed over the interval.
+	P99NS int64 `json:"p99_ns"`
+	// Action is one of the Adaptive adjustments, and Next the concurrency of the next interval.
+	Action string `json:"action"`
+	Next   int    `json:"next"`
+}
+
+// AdaptiveResult is the control trajectory of a RunAdaptive run, and the throughput it converged
+// to.
+type AdaptiveResult struct {
+	TargetP99NS int64          `json:"target_p99_ns"`
+	Steps       []AdaptiveStep `json:"steps"`
+	// ConvergedConcurrency and ConvergedQPS are the mean concurrency and rate of completed calls
+	// over the second half of the steps, by which the controller has settled around the highest
+	// concurrency that keeps the p99 under target.
+	ConvergedConcurrency float64 `json:"converged_concurrency"`
+	ConvergedQPS         float64 `json:"converged_qps"`
+}
+
+func (r *AdaptiveResult) converge() {
+	settled := r.Steps[len(r.Steps)/2:]
+	if len(settled) == 0 {
+		return
+	}
+	var concurrency, qps float64
+	for _, s := range settled {
+		concurrency += float64(s.Concurrency)
+		qps += s.QPS
+	}
+	r.ConvergedConcurrency = concurrency / float64(len(settled))
+	r.ConvergedQPS = qps / float64(len(settled))
+}
+
+func (r *AdaptiveResult) String() string {
+	return fmt.Sprintf("converged to %.1f calls per second with %.1f in flight, for a p99 under %v, over %d intervals",
+		r.ConvergedQPS, r.ConvergedConcurrency, time.Duration(r.TargetP99NS), len(r.Steps))
+}
+
+// WriteAdaptiveResult writes r to w as JSON.
+func WriteAdaptiveResult(w io.Writer, r *AdaptiveResult) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// p99 returns the p99 of latencies, by nearest rank, as Histogram.ValueAtPercentile does. It sorts
+// latencies.
+func p99(latencies []time.Duration) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	rank := int(math.Ceil(0.99 * float64(len(latencies))))
+	if rank < 1 {
+		rank = 1
+	}
+	return latencies[rank-1]
+}
+
+// RunAdaptive calls Greeter.SayHello over conn with name for opts.Duration, with a goroutine per
+// call, keeping as many calls in flight as keeps their p99 latency under opts.TargetP99: at the
+// end of every interval, the p99 of the calls that completed over it raises the concurrency by
+// opts.Increase if under target, or multiplies it by opts.Backoff if over, as TCP adjusts its
+// congestion window. RunAdaptive returns once every call has finished, with their records sorted
+// by start time, and the steps taken.
+//
+// If ctx is done, no new call starts, and the calls in flight are cancelled. RunAdaptive then
+// returns ctx.Err() along with the calls made so far. Cancelled calls are recorded too.
+func (c *Client) RunAdaptive(ctx context.Context, conn *grpc.ClientConn, name string, opts *AdaptiveOptions) ([]*CallRecord, *AdaptiveResult, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, nil, err
+	}
+	ctx = c.opts.Audit.root(ctx)
+	var (
+		mu          sync.Mutex
+		cond        = sync.NewCond(&mu)
+		stopped     bool
+		concurrency = opts.initialConcurrency()
+		inFlight    int
+		records     []*CallRecord
+		// latencies and failed are those of the calls that finished over the current interval.
+		latencies []time.Duration
+		failed    int64
+		wg        sync.WaitGroup
+	)
+	result := &AdaptiveResult{TargetP99NS: opts.TargetP99.Nanoseconds()}
+	stop := func() {
+		mu.Lock()
+		stopped = true
+		mu.Unlock()
+		cond.Broadcast()
+	}
+	deadline := time.AfterFunc(opts.Duration, stop)
+	defer deadline.Stop()
+
+	start := time.Now()
+	done := make(chan struct{})
+	var controller sync.WaitGroup
+	controller.Add(1)
+	go func() {
+		defer controller.Done()
+		ticker := time.NewTicker(opts.interval())
+		defer ticker.Stop()
+		last := start
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				stop()
+				return
+			case now := <-ticker.C:
+				mu.Lock()
+				if stopped {
+					mu.Unlock()
+					return
+				}
+				step := AdaptiveStep{
+					ElapsedNS:   now.Sub(start).Nanoseconds(),
+					Concurrency: concurrency,
+					Completed:   int64(len(latencies)),
+					Failed:      failed,
+					QPS:         float64(len(latencies)) / now.Sub(last).Seconds(),
+					P99NS:       p99(latencies).Nanoseconds(),
+				}
+				step.Next, step.Action = opts.next(concurrency, step.Completed, time.Duration(step.P99NS))
+				concurrency = step.Next
+				latencies, failed = latencies[:0], 0
+				result.Steps = append(result.Steps, step)
+				mu.Unlock()
+				cond.Broadcast()
+				last = now
+			}
+		}
+	}()
+
+	for {
+		mu.Lock()
+		for !stopped && inFlight >= concurrency {
+			cond.Wait()
+		}
+		if stopped {
+			mu.Unlock()
+			break
+		}
+		inFlight++
+		mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := c.Do(ctx, conn, &CallOverrides{Name: name})
+			mu.Lock()
+			inFlight--
+			records = append(records, r)
+			if r.Completed() {
+				latencies = append(latencies, time.Duration(r.DurationNS))
+			} else {
+				failed++
+			}
+			mu.Unlock()
+			cond.Broadcast()
+		}()
+	}
+	close(done)
+	controller.Wait()
+	wg.Wait()
+
+	result.converge()
+	sort.Slice(records, func(i, j int) bool { return records[i].StartTime.Before(records[j].StartTime) })
+	return records, result, ctx.Err()
+}
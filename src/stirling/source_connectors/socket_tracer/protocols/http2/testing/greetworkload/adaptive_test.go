@@ -0,0 +1,170 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// startQueueingServer answers Greeter calls after base, plus perCall for every call it is handling,
+// the call itself included, as a server whose queue grows with its load would. n calls in flight
+// then take base+n*perCall each, and the p99 stays under target up to (target-base)/perCall.
+func startQueueingServer(t *testing.T, base, perCall time.Duration) string {
+	var current int64
+	queue := func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		n := atomic.AddInt64(&current, 1)
+		defer atomic.AddInt64(&current, -1)
+		select {
+		case <-time.After(base + time.Duration(n)*perCall):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return handler(ctx, req)
+	}
+	return startServerWith(t, &serverSetup{GRPC: []grpc.ServerOption{grpc.UnaryInterceptor(queue)}}).Addr
+}
+
+func TestRunAdaptive_ConvergesToTheOperatingPoint(t *testing.T) {
+	const (
+		base    = 4 * time.Millisecond
+		perCall = 2 * time.Millisecond
+		target  = 25 * time.Millisecond
+	)
+	// The highest concurrency whose latency is under target, and the rate it completes calls at.
+	wantConcurrency := float64((target - base) / perCall)
+	wantQPS := wantConcurrency / (base + time.Duration(wantConcurrency)*perCall).Seconds()
+
+	addr := startQueueingServer(t, base, perCall)
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	records, result, err := c.RunAdaptive(context.Background(), conn, "pixie", &greetworkload.AdaptiveOptions{
+		TargetP99: target,
+		Duration:  4 * time.Second,
+		Interval:  100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, records)
+	require.GreaterOrEqual(t, len(result.Steps), 30)
+
+	// The controller climbs from a single call in flight, and backs off every interval over target.
+	assert.Equal(t, 1, result.Steps[0].Concurrency)
+	assert.Equal(t, greetworkload.AdaptiveIncrease, result.Steps[0].Action)
+	var decreases int
+	for i, s := range result.Steps {
+		if s.P99NS > target.Nanoseconds() {
+			assert.Equal(t, greetworkload.AdaptiveDecrease, s.Action, "step %d", i)
+			assert.Less(t, s.Next, s.Concurrency, "step %d", i)
+			decreases++
+		}
+		if i > 0 {
+			assert.Equal(t, result.Steps[i-1].Next, s.Concurrency, "step %d", i)
+		}
+	}
+	assert.Positive(t, decreases, "never went over target")
+
+	assert.InDelta(t, wantConcurrency, result.ConvergedConcurrency, 0.35*wantConcurrency, "%s", result)
+	assert.InDelta(t, wantQPS, result.ConvergedQPS, 0.35*wantQPS, "%s", result)
+}
+
+func TestRunAdaptive_HoldsAtMaxConcurrency(t *testing.T) {
+	addr := startQueueingServer(t, time.Millisecond, 0)
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, result, err := c.RunAdaptive(context.Background(), conn, "pixie", &greetworkload.AdaptiveOptions{
+		TargetP99:          time.Second,
+		Duration:           time.Second,
+		Interval:           50 * time.Millisecond,
+		InitialConcurrency: 2,
+		MaxConcurrency:     5,
+		Increase:           2,
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, result.Steps)
+	for _, s := range result.Steps {
+		assert.LessOrEqual(t, s.Next, 5)
+	}
+	assert.Equal(t, []int{2, 4, 5}, []int{result.Steps[0].Concurrency, result.Steps[1].Concurrency, result.Steps[2].Concurrency})
+	last := result.Steps[len(result.Steps)-1]
+	assert.Equal(t, greetworkload.AdaptiveHold, last.Action)
+	assert.Equal(t, 5.0, result.ConvergedConcurrency)
+
+	var buf bytes.Buffer
+	require.NoError(t, greetworkload.WriteAdaptiveResult(&buf, result))
+	var read greetworkload.AdaptiveResult
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &read))
+	assert.Equal(t, *result, read)
+}
+
+func TestRunAdaptive_Cancelled(t *testing.T) {
+	addr := startQueueingServer(t, 50*time.Millisecond, 0)
+	c, _ := newAuditedClient(t, &greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start := time.Now()
+	records, _, err := c.RunAdaptive(ctx, conn, "pixie", &greetworkload.AdaptiveOptions{TargetP99: time.Second, Duration: time.Minute})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 10*time.Second)
+	assert.NotEmpty(t, records)
+}
+
+func TestAdaptiveOptions_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    greetworkload.AdaptiveOptions
+		wantErr bool
+	}{
+		{name: "defaults", opts: greetworkload.AdaptiveOptions{TargetP99: time.Millisecond, Duration: time.Second}},
+		{name: "no target", opts: greetworkload.AdaptiveOptions{Duration: time.Second}, wantErr: true},
+		{name: "no duration", opts: greetworkload.AdaptiveOptions{TargetP99: time.Millisecond}, wantErr: true},
+		{name: "negative interval", opts: greetworkload.AdaptiveOptions{TargetP99: time.Millisecond, Duration: time.Second, Interval: -time.Second}, wantErr: true},
+		{name: "initial above max", opts: greetworkload.AdaptiveOptions{TargetP99: time.Millisecond, Duration: time.Second, InitialConcurrency: 10, MaxConcurrency: 5}, wantErr: true},
+		{name: "backoff of 1", opts: greetworkload.AdaptiveOptions{TargetP99: time.Millisecond, Duration: time.Second, Backoff: 1}, wantErr: true},
+		{name: "negative backoff", opts: greetworkload.AdaptiveOptions{TargetP99: time.Millisecond, Duration: time.Second, Backoff: -0.5}, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.opts.Validate()
+			if tc.wantErr {
+				assert.ErrorIs(t, err, greetworkload.ErrBadFlagCombination)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
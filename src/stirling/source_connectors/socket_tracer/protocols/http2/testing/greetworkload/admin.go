@@ -0,0 +1,82 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// NewAdminMux returns the handlers of the server's admin endpoint:
+//
+//	GET  /faults  returns the current FaultConfig as JSON.
+//	PUT  /faults  updates the FaultConfig. Fields missing from the JSON body keep their value.
+//	POST /goaway  sends a GOAWAY, with the debug_data query parameter as its debug data, on every
+//	              open connection of goAways, and returns {"connections": <number sent on>}. Only
+//	              served if goAways is not nil.
+//	GET  /requests  returns the RequestRingDump of ring as JSON. Only served if ring is not nil.
+func NewAdminMux(faults *FaultInjector, goAways *GoAwayListener, ring *RequestRing) *http.ServeMux {
+	mux := http.NewServeMux()
+	if ring != nil {
+		mux.HandleFunc("/requests", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = ring.WriteJSON(w)
+		})
+	}
+	if goAways != nil {
+		mux.HandleFunc("/goaway", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			n := goAways.GoAway(r.URL.Query().Get("debug_data"))
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]int{"connections": n})
+		})
+	}
+	mux.HandleFunc("/faults", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = faults.UpdateConfig(func(cfg *FaultConfig) error {
+				return json.Unmarshal(body, cfg)
+			})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(faults.Config())
+	})
+	return mux
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// AsyncOptions configure RunAsync.
+type AsyncOptions struct {
+	// MaxInFlight bounds the number of calls in flight at once. Calls wait for a slot to free up
+	// before they start.
+	MaxInFlight int
+	// Duration is how long new calls keep being started. Calls still in flight once it elapses are
+	// allowed to finish, and are recorded.
+	Duration time.Duration
+	// Overrides, if set, is called with the index, from 0, of every call in the order they start,
+	// and the call is made as the CallOverrides it returns say. Nil overrides, or overrides without
+	// a Name, greet the name of the run.
+	Overrides func(i int) *CallOverrides
+}
+
+// AsyncStats summarize a RunAsync run.
+type AsyncStats struct {
+	Started   int64 `json:"started"`
+	Completed int64 `json:"completed"`
+	// Failed is the number of calls that did not complete, cancelled ones included.
+	Failed int64 `json:"failed"`
+	// PeakInFlight is the largest number of calls in flight at once.
+	PeakInFlight int64 `json:"peak_in_flight"`
+	// QueueWaitNS is the time calls spent, in total, waiting for a slot, and MaxQueueWaitNS the
+	// longest a call waited.
+	QueueWaitNS    int64 `json:"queue_wait_ns"`
+	MaxQueueWaitNS int64 `json:"max_queue_wait_ns"`
+	// FinishedLate is the number of calls that finished after Duration elapsed.
+	FinishedLate int64 `json:"finished_late"`
+}
+
+// MeanQueueWait returns how long calls waited for a slot on average.
+func (s *AsyncStats) MeanQueueWait() time.Duration {
+	if s.Started == 0 {
+		return 0
+	}
+	return time.Duration(s.QueueWaitNS / s.Started)
+}
+
+// pooledHello holds the messages of a call made by RunAsync, so that they are reused by the calls
+// that follow it rather than allocated anew.
+type pooledHello struct {
+	req   pb.HelloRequest
+	reply pb.HelloReply
+}
+
+var helloPool = sync.Pool{New: func() interface{} { return &pooledHello{} }}
+
+// RunAsync calls Greeter.SayHello over conn with name for opts.Duration, with a goroutine per call
+// and up to opts.MaxInFlight calls in flight at once. A new call starts as soon as a slot frees up.
+// RunAsync returns once every call has finished, with their records sorted by start time.
+//
+// If ctx is done, no new call starts, and the calls in flight are cancelled. RunAsync then returns
+// ctx.Err() along with the calls made so far. Cancelled calls are recorded too.
+func (c *Client) RunAsync(ctx context.Context, conn *grpc.ClientConn, name string, opts *AsyncOptions) ([]*CallRecord, *AsyncStats, error) {
+	if opts.MaxInFlight <= 0 {
+		return nil, nil, errors.New("max in flight must be positive")
+	}
+	ctx = c.opts.Audit.root(ctx)
+	slots := make(chan struct{}, opts.MaxInFlight)
+	stats := &AsyncStats{}
+	var (
+		mu       sync.Mutex
+		records  []*CallRecord
+		inFlight int64
+		wg       sync.WaitGroup
+	)
+	end := time.Now().Add(opts.Duration)
+	deadline := time.NewTimer(opts.Duration)
+	defer deadline.Stop()
+
+	finish := func(r *CallRecord) {
+		mu.Lock()
+		defer mu.Unlock()
+		inFlight--
+		records = append(records, r)
+		if r.Completed() {
+			stats.Completed++
+		} else {
+			stats.Failed++
+		}
+		if r.StartTime.Add(time.Duration(r.DurationNS)).After(end) {
+			stats.FinishedLate++
+		}
+	}
+
+	var err error
+loop:
+	for {
+		waitStart := time.Now()
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			break loop
+		case <-deadline.C:
+			break loop
+		case slots <- struct{}{}:
+		}
+		wait := time.Since(waitStart)
+
+		mu.Lock()
+		inFlight++
+		i := int(stats.Started)
+		stats.Started++
+		if inFlight > stats.PeakInFlight {
+			stats.PeakInFlight = inFlight
+		}
+		stats.QueueWaitNS += wait.Nanoseconds()
+		if wait.Nanoseconds() > stats.MaxQueueWaitNS {
+			stats.MaxQueueWaitNS = wait.Nanoseconds()
+		}
+		mu.Unlock()
+
+		call := &CallOverrides{Name: name}
+		if opts.Overrides != nil {
+			if o := opts.Overrides(i); o != nil {
+				overridden := *o
+				if overridden.Name == "" {
+					overridden.Name = name
+				}
+				call = &overridden
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := c.sayHelloPooled(ctx, conn, call, wait)
+			<-slots
+			finish(r)
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(records, func(i, j int) bool { return records[i].StartTime.Before(records[j].StartTime) })
+	return records, stats, err
+}
+
+// sayHelloPooled makes the SayHello call of o, with messages from helloPool, for a call that waited
+// wait for a slot and is cancelled once ctx is done. Replies are not logged, as there may be too
+// many.
+func (c *Client) sayHelloPooled(ctx context.Context, conn *grpc.ClientConn, o *CallOverrides, wait time.Duration) *CallRecord {
+	r := newCallRecord("SayHello")
+	r.Names = []string{o.Name}
+	r.QueueWaitNS = wait.Nanoseconds()
+	p := o.plan(c)
+
+	callCtx, cancel := o.context(c, ctx)
+	defer cancel()
+	callCtx = o.outgoing(withRequestID(c.withPhases(callCtx, r), r))
+	if p.cancel {
+		t := time.AfterFunc(p.after, cancel)
+		defer t.Stop()
+	}
+
+	m := helloPool.Get().(*pooledHello)
+	defer func() {
+		m.req.Reset()
+		m.reply.Reset()
+		helloPool.Put(m)
+	}()
+	m.req.Name = o.Name
+	m.req.Payload = o.Payload
+
+	var trailer metadata.MD
+	err := conn.Invoke(callCtx, pb.Greeter_SayHello_FullMethodName, &m.req, &m.reply, o.callOptions(grpc.Trailer(&trailer), withRecord(r))...)
+	setAttempt(r, trailer)
+	c.setCache(r, trailer)
+	if err == nil {
+		r.InstanceID = m.reply.InstanceId
+		c.verifyReply(r, 0, &m.reply)
+	}
+	return c.finish(r, p, err)
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// slowServer answers Greeter calls after delay, and tracks how many it handles at once.
+type slowServer struct {
+	s    *grpc.Server
+	addr string
+	// current and peak count the calls being handled.
+	current int64
+	peak    int64
+}
+
+func startSlowServer(t *testing.T, delay time.Duration) *slowServer {
+	srv := &slowServer{}
+	slow := func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		n := atomic.AddInt64(&srv.current, 1)
+		defer atomic.AddInt64(&srv.current, -1)
+		for {
+			peak := atomic.LoadInt64(&srv.peak)
+			if n <= peak || atomic.CompareAndSwapInt64(&srv.peak, peak, n) {
+				break
+			}
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return handler(ctx, req)
+	}
+	s := startServerWith(t, &serverSetup{GRPC: []grpc.ServerOption{grpc.UnaryInterceptor(slow)}})
+	srv.s, srv.addr = s.GRPC, s.Addr
+	return srv
+}
+
+func TestRunAsync_BoundsInFlight(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+	srv := startSlowServer(t, 20*time.Millisecond)
+	defer srv.s.Stop()
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(srv.addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	const maxInFlight = 8
+	const duration = 200 * time.Millisecond
+	start := time.Now()
+	records, stats, err := c.RunAsync(context.Background(), conn, "pixie", &greetworkload.AsyncOptions{
+		MaxInFlight: maxInFlight,
+		Duration:    duration,
+	})
+	require.NoError(t, err)
+
+	assert.EqualValues(t, maxInFlight, stats.PeakInFlight)
+	assert.LessOrEqual(t, atomic.LoadInt64(&srv.peak), int64(maxInFlight))
+	require.Len(t, records, int(stats.Started))
+	assert.Equal(t, stats.Started, stats.Completed)
+	assert.Zero(t, stats.Failed)
+	// Every call takes at least 20ms, so at most 8 per 20ms fit in the run.
+	assert.LessOrEqual(t, stats.Started, int64(maxInFlight*(duration/(20*time.Millisecond)+1)))
+	assert.Greater(t, stats.QueueWaitNS, int64(0))
+	assert.Greater(t, stats.MeanQueueWait(), time.Duration(0))
+
+	// The calls in flight once the duration elapsed were recorded too.
+	assert.Positive(t, stats.FinishedLate)
+	var late, waited int64
+	for i, r := range records {
+		assert.True(t, r.Completed(), r.Error)
+		if i > 0 {
+			assert.False(t, r.StartTime.Before(records[i-1].StartTime))
+		}
+		if r.StartTime.Add(time.Duration(r.DurationNS)).After(start.Add(duration)) {
+			late++
+		}
+		waited += r.QueueWaitNS
+	}
+	assert.Equal(t, stats.FinishedLate, late)
+	assert.Equal(t, stats.QueueWaitNS, waited)
+}
+
+func TestRunAsync_Cancel(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+	srv := startSlowServer(t, time.Minute)
+	defer srv.s.Stop()
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Minute})
+	conn, err := c.Dial(srv.addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	records, stats, err := c.RunAsync(ctx, conn, "pixie", &greetworkload.AsyncOptions{
+		MaxInFlight: 100,
+		Duration:    time.Minute,
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	// Every call blocked, so exactly one per slot was made, and each was cut short by ctx.
+	assert.EqualValues(t, 100, stats.Started)
+	assert.EqualValues(t, 100, stats.Failed)
+	require.Len(t, records, 100)
+	for _, r := range records {
+		assert.Equal(t, codes.DeadlineExceeded.String(), r.Code)
+	}
+}
+
+func TestRunAsync_RejectsNoSlots(t *testing.T) {
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{})
+	_, _, err := c.RunAsync(context.Background(), nil, "pixie", &greetworkload.AsyncOptions{Duration: time.Second})
+	assert.Error(t, err)
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// authorityHeader is the pseudo-header that carries the authority of a call. gRPC servers pass it
+// on in the incoming metadata.
+const authorityHeader = ":authority"
+
+// IncomingAuthority returns the :authority of the call handled in ctx, or "" if it has none.
+func IncomingAuthority(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(authorityHeader); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// recordOption hands the record of a call to the interceptors of the connection it is made over.
+type recordOption struct {
+	grpc.EmptyCallOption
+	record *CallRecord
+}
+
+func withRecord(r *CallRecord) grpc.CallOption {
+	return recordOption{record: r}
+}
+
+func recordOf(opts []grpc.CallOption) *CallRecord {
+	for _, o := range opts {
+		if o, ok := o.(recordOption); ok {
+			return o.record
+		}
+	}
+	return nil
+}
+
+// authorityDialOptions set the :authority of the calls made over a connection to authority, and
+// record it in their records.
+func authorityDialOptions(authority string) []grpc.DialOption {
+	unary := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if r := recordOf(opts); r != nil {
+			r.Authority = authority
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	stream := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if r := recordOf(opts); r != nil {
+			r.Authority = authority
+		}
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+	return []grpc.DialOption{
+		grpc.WithAuthority(authority),
+		grpc.WithChainUnaryInterceptor(unary),
+		grpc.WithChainStreamInterceptor(stream),
+	}
+}
+
+// nextAuthority returns the authority of the next connection dialed, or "" to leave gRPC's
+// default.
+func (c *Client) nextAuthority() string {
+	if len(c.opts.Authorities) == 0 {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a := c.opts.Authorities[c.authorities%len(c.opts.Authorities)]
+	c.authorities++
+	return a
+}
+
+// AuthorityConns are connections to the same server, one per authority, that calls are spread
+// over in turn. gRPC sets the authority of a connection rather than of a call, so calls pick their
+// :authority by picking their connection.
+type AuthorityConns struct {
+	conns []*grpc.ClientConn
+
+	mu   sync.Mutex
+	next int
+}
+
+// DialAuthorities sets up a connection to the server at address for each of authorities, which
+// may be given as a host, host:port, or IPv6 literal in brackets.
+func (c *Client) DialAuthorities(address string, authorities []string, opts ...grpc.DialOption) (*AuthorityConns, error) {
+	if len(authorities) == 0 {
+		return nil, errors.New("no authorities to dial")
+	}
+	ac := &AuthorityConns{}
+	for _, a := range authorities {
+		conn, err := c.dial(dialTarget(address), false, a, opts...)
+		if err != nil {
+			ac.Close()
+			return nil, err
+		}
+		ac.conns = append(ac.conns, conn)
+	}
+	return ac, nil
+}
+
+// Next returns the connection of the next authority, in the order they were dialed.
+func (ac *AuthorityConns) Next() *grpc.ClientConn {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	conn := ac.conns[ac.next%len(ac.conns)]
+	ac.next++
+	return conn
+}
+
+// Close closes every connection.
+func (ac *AuthorityConns) Close() {
+	for _, conn := range ac.conns {
+		conn.Close()
+	}
+}
+
+// AuthorityLatency delays the calls a server handles by their :authority, so that authorities can
+// be routed like virtual hosts, e.g. "slow.greeter.local" to a slow backend.
+type AuthorityLatency map[string]time.Duration
+
+// ParseAuthorityLatency parses a comma-separated list of authority=millis pairs, e.g.
+// "slow.greeter.local=200,[::1]:50051=10".
+func ParseAuthorityLatency(s string) (AuthorityLatency, error) {
+	l := make(AuthorityLatency)
+	if s == "" {
+		return l, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%q is not authority=millis", pair)
+		}
+		millis, err := strconv.Atoi(pair[i+1:])
+		if err != nil || millis < 0 {
+			return nil, fmt.Errorf("%q is not authority=millis, with millis not negative", pair)
+		}
+		l[pair[:i]] = time.Duration(millis) * time.Millisecond
+	}
+	return l, nil
+}
+
+func (l AuthorityLatency) delay(ctx context.Context) error {
+	d := l[IncomingAuthority(ctx)]
+	if d == 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// UnaryServerInterceptor delays unary calls by their :authority.
+func (l AuthorityLatency) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !outsideWorkload(info.FullMethod) {
+			if err := l.delay(ctx); err != nil {
+				return nil, err
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor delays streaming calls by their :authority, before they are handled.
+func (l AuthorityLatency) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !outsideWorkload(info.FullMethod) {
+			if err := l.delay(ss.Context()); err != nil {
+				return err
+			}
+		}
+		return handler(srv, ss)
+	}
+}
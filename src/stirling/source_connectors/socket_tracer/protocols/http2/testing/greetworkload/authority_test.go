@@ -0,0 +1,127 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// startAuthorityServer serves Greeter and StreamingGreeter, tracing the calls handled and delaying
+// them by latency.
+func startAuthorityServer(t *testing.T, latency greetworkload.AuthorityLatency) (*greetworkload.RequestTracer, string) {
+	tracer := greetworkload.NewRequestTracer(&greetworkload.RequestTracerOptions{KeepRecords: true})
+	s := startServerWith(t, &serverSetup{GRPC: []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(tracer.UnaryServerInterceptor(), latency.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(tracer.StreamServerInterceptor(), latency.StreamServerInterceptor()),
+	}})
+	return tracer, s.Addr
+}
+
+func TestParseAuthorityLatency(t *testing.T) {
+	l, err := greetworkload.ParseAuthorityLatency("slow.greeter.local=200,[::1]:50051=10")
+	require.NoError(t, err)
+	assert.Equal(t, greetworkload.AuthorityLatency{
+		"slow.greeter.local": 200 * time.Millisecond,
+		"[::1]:50051":        10 * time.Millisecond,
+	}, l)
+
+	l, err = greetworkload.ParseAuthorityLatency("")
+	require.NoError(t, err)
+	assert.Empty(t, l)
+
+	for _, s := range []string{"slow.greeter.local", "=10", "a=b", "a=-1", "a=1,"} {
+		_, err := greetworkload.ParseAuthorityLatency(s)
+		assert.Error(t, err, s)
+	}
+}
+
+// Calls over the same target carry three authorities, which both sides record alike, and the slow
+// one is routed to extra latency.
+func TestDialAuthorities(t *testing.T) {
+	const slow = 200 * time.Millisecond
+	tracer, addr := startAuthorityServer(t, greetworkload.AuthorityLatency{"slow.greeter.local": slow})
+
+	authorities := []string{"slow.greeter.local", "greeter.local:8443", "[::1]:50051"}
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 10 * time.Second, StreamCount: 2})
+	conns, err := c.DialAuthorities(addr, authorities)
+	require.NoError(t, err)
+	defer conns.Close()
+
+	var records []*greetworkload.CallRecord
+	for range authorities {
+		records = append(records, c.SayHello(conns.Next(), "pixie"))
+	}
+	for range authorities {
+		records = append(records, c.ServerStreaming(conns.Next(), "pixie"))
+	}
+	for i, r := range records {
+		require.True(t, r.Completed(), r.Error)
+		assert.Equal(t, authorities[i%len(authorities)], r.Authority, r.Method)
+	}
+	assert.GreaterOrEqual(t, records[0].DurationNS, slow.Nanoseconds())
+	assert.GreaterOrEqual(t, records[3].DurationNS, slow.Nanoseconds())
+
+	byID := make(map[string]*greetworkload.CallRecord)
+	for _, r := range tracer.Records() {
+		byID[r.RequestID] = r
+	}
+	require.Len(t, byID, len(records))
+	for _, r := range records {
+		require.Contains(t, byID, r.RequestID)
+		assert.Equal(t, r.Authority, byID[r.RequestID].Authority, r.Method)
+	}
+}
+
+// Connections dialed by a client with authorities take them in turn, and those of other clients
+// carry the address dialed.
+func TestClientOptions_Authorities(t *testing.T) {
+	tracer, addr := startAuthorityServer(t, nil)
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 10 * time.Second, Authorities: []string{"a.greeter.local", "b.greeter.local"}})
+	var authorities []string
+	for i := 0; i < 3; i++ {
+		conn, err := c.Dial(addr)
+		require.NoError(t, err)
+		r := c.SayHello(conn, "pixie")
+		conn.Close()
+		require.True(t, r.Completed(), r.Error)
+		authorities = append(authorities, r.Authority)
+	}
+	assert.Equal(t, []string{"a.greeter.local", "b.greeter.local", "a.greeter.local"}, authorities)
+
+	c = greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 10 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	r := c.SayHello(conn, "pixie")
+	require.True(t, r.Completed(), r.Error)
+	assert.Empty(t, r.Authority)
+
+	var server []string
+	for _, r := range tracer.Records() {
+		server = append(server, r.Authority)
+	}
+	assert.Equal(t, append(authorities, addr), server)
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+)
+
+// NewBackendResolver returns a resolver that resolves to a static list of backend addresses.
+// The list can be replaced later with UpdateState.
+func NewBackendResolver(addrs []string) *manual.Resolver {
+	r := manual.NewBuilderWithScheme("greetbackends")
+	r.InitialState(backendState(addrs))
+	return r
+}
+
+func backendState(addrs []string) resolver.State {
+	s := resolver.State{}
+	for _, addr := range addrs {
+		s.Addresses = append(s.Addresses, resolver.Address{Addr: addr})
+	}
+	return s
+}
+
+// DialBackends sets up a connection that spreads calls over every backend resolved by r, in
+// round-robin order.
+func (c *Client) DialBackends(r resolver.Builder, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	opts = append([]grpc.DialOption{grpc.WithResolvers(r)}, opts...)
+	return c.dial(fmt.Sprintf("%s:///backends", r.Scheme()), true, c.nextAuthority(), opts...)
+}
+
+// TestResolverScheme is the scheme of the targets resolved by a BackendSet, e.g.
+// "greettest:///backends". Client.Dial balances the calls to such targets in round-robin order.
+const TestResolverScheme = "greettest"
+
+func init() {
+	resolver.Register(backendSetBuilder{})
+}
+
+var (
+	backendSetsMu sync.Mutex
+	backendSets   = make(map[string]*BackendSet)
+)
+
+// BackendSet is a named list of backend addresses, which connections dialed to its Target resolve
+// to. Updates to the list are pushed to every such connection, so that new calls are balanced over
+// the new list. Calls in progress on a removed backend are left to complete.
+type BackendSet struct {
+	name string
+
+	mu        sync.Mutex
+	addrs     []string
+	resolvers map[*backendSetResolver]struct{}
+}
+
+// NewBackendSet registers a set of backends under name, until it is closed.
+func NewBackendSet(name string, addrs []string) (*BackendSet, error) {
+	backendSetsMu.Lock()
+	defer backendSetsMu.Unlock()
+	if _, ok := backendSets[name]; ok {
+		return nil, fmt.Errorf("backend set %q already exists", name)
+	}
+	b := &BackendSet{
+		name:      name,
+		addrs:     append([]string(nil), addrs...),
+		resolvers: make(map[*backendSetResolver]struct{}),
+	}
+	backendSets[name] = b
+	return b, nil
+}
+
+// Target returns the target to dial to resolve to the backends in the set.
+func (b *BackendSet) Target() string {
+	return fmt.Sprintf("%s:///%s", TestResolverScheme, b.name)
+}
+
+// Addrs returns the addresses of the backends in the set.
+func (b *BackendSet) Addrs() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.addrs...)
+}
+
+// SetAddrs replaces the backends in the set.
+func (b *BackendSet) SetAddrs(addrs []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.addrs = append([]string(nil), addrs...)
+	b.pushLocked()
+}
+
+// Add adds a backend to the set, unless it is already in it.
+func (b *BackendSet) Add(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, a := range b.addrs {
+		if a == addr {
+			return
+		}
+	}
+	b.addrs = append(b.addrs, addr)
+	b.pushLocked()
+}
+
+// Remove removes a backend from the set.
+func (b *BackendSet) Remove(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	addrs := b.addrs[:0]
+	for _, a := range b.addrs {
+		if a != addr {
+			addrs = append(addrs, a)
+		}
+	}
+	b.addrs = addrs
+	b.pushLocked()
+}
+
+// Close unregisters the set. Connections already dialed keep the backends they last resolved to.
+func (b *BackendSet) Close() {
+	backendSetsMu.Lock()
+	defer backendSetsMu.Unlock()
+	delete(backendSets, b.name)
+}
+
+// pushLocked sends the current backends to every connection. Updates are sent while holding mu,
+// so that connections see them in order.
+func (b *BackendSet) pushLocked() {
+	state := backendState(b.addrs)
+	for r := range b.resolvers {
+		_ = r.cc.UpdateState(state)
+	}
+}
+
+type backendSetBuilder struct{}
+
+func (backendSetBuilder) Scheme() string {
+	return TestResolverScheme
+}
+
+func (backendSetBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	name := strings.TrimPrefix(target.URL.Path, "/")
+	backendSetsMu.Lock()
+	b, ok := backendSets[name]
+	backendSetsMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown backend set %q", name)
+	}
+
+	r := &backendSetResolver{set: b, cc: cc}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.resolvers[r] = struct{}{}
+	_ = cc.UpdateState(backendState(b.addrs))
+	return r, nil
+}
+
+type backendSetResolver struct {
+	set *BackendSet
+	cc  resolver.ClientConn
+}
+
+// ResolveNow does nothing, as every update is pushed to the connection as it happens.
+func (*backendSetResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (r *backendSetResolver) Close() {
+	r.set.mu.Lock()
+	defer r.set.mu.Unlock()
+	delete(r.set.resolvers, r)
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+func startBackend(t *testing.T, id string) (*grpc.Server, string) {
+	s := startServerWith(t, &serverSetup{Options: &greetworkload.ServerOptions{InstanceID: id}})
+	return s.GRPC, s.Addr
+}
+
+func TestDialBackends_RoundRobin(t *testing.T) {
+	const numBackends = 3
+	var addrs []string
+	var servers []*grpc.Server
+	for i := 0; i < numBackends; i++ {
+		s, addr := startBackend(t, fmt.Sprint(i))
+		addrs = append(addrs, addr)
+		servers = append(servers, s)
+	}
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.DialBackends(greetworkload.NewBackendResolver(addrs), grpc.WithBlock())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var records []*greetworkload.CallRecord
+	for i := 0; i < 300; i++ {
+		records = append(records, c.SayHello(conn, "pixie"))
+	}
+	tally := greetworkload.TallyInstances(records)
+	require.Len(t, tally, numBackends)
+	for id, n := range tally {
+		assert.InDelta(t, 100, n, 10, "backend %s", id)
+	}
+
+	// Take one backend away; its share moves to the survivors.
+	servers[2].Stop()
+	records = nil
+	failed := 0
+	for i := 0; i < 300; i++ {
+		r := c.SayHello(conn, "pixie")
+		if !r.Completed() {
+			failed++
+		}
+		records = append(records, r)
+	}
+	// Calls already picked for the stopped backend can fail while the balancer catches up.
+	assert.LessOrEqual(t, failed, 3)
+	tally = greetworkload.TallyInstances(records)
+	assert.LessOrEqual(t, tally["2"], 3)
+	assert.InDelta(t, 150, tally["0"], 15)
+	assert.InDelta(t, 150, tally["1"], 15)
+}
+
+func dialBackendSet(t *testing.T, c *greetworkload.Client, name string, addrs []string) (*greetworkload.BackendSet, *grpc.ClientConn) {
+	set, err := greetworkload.NewBackendSet(name, addrs)
+	require.NoError(t, err)
+	t.Cleanup(set.Close)
+	conn, err := c.Dial(set.Target(), grpc.WithBlock())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return set, conn
+}
+
+func TestBackendSet_AddBackend(t *testing.T) {
+	_, addr0 := startBackend(t, "0")
+	_, addr1 := startBackend(t, "1")
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	set, conn := dialBackendSet(t, c, "add", []string{addr0, addr1})
+	assert.Equal(t, "greettest:///add", set.Target())
+
+	_, addr2 := startBackend(t, "2")
+	set.Add(addr2)
+	assert.Eventually(t, func() bool {
+		return c.SayHello(conn, "pixie").InstanceID == "2"
+	}, 5*time.Second, time.Millisecond)
+
+	var records []*greetworkload.CallRecord
+	for i := 0; i < 300; i++ {
+		records = append(records, c.SayHello(conn, "pixie"))
+	}
+	tally := greetworkload.TallyInstances(records)
+	require.Len(t, tally, 3)
+	for id, n := range tally {
+		assert.InDelta(t, 100, n, 10, "backend %s", id)
+	}
+}
+
+func TestBackendSet_RemoveBackendDrains(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		_, addr := startBackend(t, fmt.Sprint(i))
+		addrs = append(addrs, addr)
+	}
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	set, conn := dialBackendSet(t, c, "remove", addrs)
+
+	// Keep calls in flight while the backend is removed.
+	const numCallers = 4
+	done := make(chan struct{})
+	results := make(chan []*greetworkload.CallRecord, numCallers)
+	for i := 0; i < numCallers; i++ {
+		go func() {
+			var records []*greetworkload.CallRecord
+			for {
+				select {
+				case <-done:
+					results <- records
+					return
+				default:
+				}
+				records = append(records, c.SayHello(conn, "pixie"))
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	set.Remove(addrs[2])
+	assert.Equal(t, addrs[:2], set.Addrs())
+	time.Sleep(100 * time.Millisecond)
+	close(done)
+	for i := 0; i < numCallers; i++ {
+		for _, r := range <-results {
+			// The removed backend is still up, so its calls in flight complete.
+			assert.True(t, r.Completed(), r.Error)
+		}
+	}
+
+	var records []*greetworkload.CallRecord
+	for i := 0; i < 200; i++ {
+		records = append(records, c.SayHello(conn, "pixie"))
+	}
+	tally := greetworkload.TallyInstances(records)
+	assert.Zero(t, tally["2"])
+	assert.InDelta(t, 100, tally["0"], 10)
+}
+
+func TestBackendSet_Errors(t *testing.T) {
+	set, err := greetworkload.NewBackendSet("errors", nil)
+	require.NoError(t, err)
+	_, err = greetworkload.NewBackendSet("errors", nil)
+	assert.Error(t, err)
+
+	set.Close()
+	_, err = greetworkload.NewClient(&greetworkload.ClientOptions{}).Dial(set.Target())
+	assert.ErrorContains(t, err, "unknown backend set")
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// SayHelloBatch implements greetpb.GreeterServer. Every request is answered as SayHello answers
+// it, but a request that fails does so in its result, and the call succeeds. Conformance calls
+// fail with their code without holding the call, and requests are not relayed upstream.
+func (s *Server) SayHelloBatch(ctx context.Context, in *pb.HelloBatchRequest) (*pb.HelloBatchReply, error) {
+	defer s.observeContext(ctx)
+	reply := &pb.HelloBatchReply{Results: make([]*pb.HelloBatchResult, 0, len(in.Requests))}
+	for _, req := range in.Requests {
+		reply.Results = append(reply.Results, s.batchResult(req))
+	}
+	return reply, nil
+}
+
+// batchResult answers a request of a batch.
+func (s *Server) batchResult(in *pb.HelloRequest) *pb.HelloBatchResult {
+	err := s.validate(in)
+	if code, ok := ParseConformanceName(in.Name); err == nil && ok && s.opts.ConformanceNames && code != codes.OK {
+		err = status.Errorf(code, "conformance: %s", code)
+	}
+	if err != nil {
+		st := status.Convert(err)
+		return &pb.HelloBatchResult{Code: int32(st.Code()), Error: st.Message()}
+	}
+	return &pb.HelloBatchResult{Reply: s.reply("Hello " + in.Name)}
+}
+
+// BatchStats counts the SayHelloBatch calls of a Client, and the requests they carried.
+type BatchStats struct {
+	// Calls is the number of calls made, and FailedCalls the number of those that failed as a
+	// whole.
+	Calls       int64 `json:"calls"`
+	FailedCalls int64 `json:"failed_calls"`
+	// Requests is the number of requests the calls carried, and FailedRequests the number of those
+	// that failed in their results, in calls that succeeded. The requests of failed calls are not
+	// counted as failed.
+	Requests       int64 `json:"requests"`
+	FailedRequests int64 `json:"failed_requests"`
+}
+
+// BatchStats returns the counts of the calls made with SayHelloBatch.
+func (c *Client) BatchStats() BatchStats {
+	return BatchStats{
+		Calls:          atomic.LoadInt64(&c.batches.Calls),
+		FailedCalls:    atomic.LoadInt64(&c.batches.FailedCalls),
+		Requests:       atomic.LoadInt64(&c.batches.Requests),
+		FailedRequests: atomic.LoadInt64(&c.batches.FailedRequests),
+	}
+}
+
+// SayHelloBatch calls Greeter.SayHelloBatch over conn with a request for every name, in order.
+// The record counts the requests that failed in their results in BatchFailures, and fails if the
+// server did not answer every request.
+func (c *Client) SayHelloBatch(conn *grpc.ClientConn, names []string) *CallRecord {
+	return c.sayHelloBatch(context.Background(), conn, names, c.planCancel(0))
+}
+
+func (c *Client) sayHelloBatch(parent context.Context, conn *grpc.ClientConn, names []string, p cancelPlan) *CallRecord {
+	r := newCallRecord("SayHelloBatch")
+	r.Names = names
+
+	ctx, cancel := c.callContextFrom(parent)
+	defer cancel()
+	ctx = withRequestID(c.withPhases(ctx, r), r)
+	if p.cancel {
+		t := time.AfterFunc(p.after, cancel)
+		defer t.Stop()
+	}
+
+	in := &pb.HelloBatchRequest{Requests: make([]*pb.HelloRequest, 0, len(names))}
+	for _, name := range names {
+		in.Requests = append(in.Requests, &pb.HelloRequest{Name: name})
+	}
+	var trailer metadata.MD
+	reply, err := pb.NewGreeterClient(conn).SayHelloBatch(ctx, in, grpc.Trailer(&trailer), withRecord(r))
+	setAttempt(r, trailer)
+	if err == nil && len(reply.Results) != len(names) {
+		err = fmt.Errorf("%d results for a batch of %d requests", len(reply.Results), len(names))
+	}
+	if err == nil {
+		for i, result := range reply.Results {
+			if result.Code != int32(codes.OK) || result.Reply == nil {
+				r.BatchFailures++
+				continue
+			}
+			r.InstanceID = result.Reply.GetInstanceId()
+			c.verifyReply(r, i, result.Reply)
+		}
+		log.Printf("Batch: %d greetings, %d failed request_id=%s", len(names)-r.BatchFailures, r.BatchFailures, r.RequestID)
+	}
+
+	atomic.AddInt64(&c.batches.Calls, 1)
+	atomic.AddInt64(&c.batches.Requests, int64(len(names)))
+	if err != nil {
+		atomic.AddInt64(&c.batches.FailedCalls, 1)
+	}
+	atomic.AddInt64(&c.batches.FailedRequests, int64(r.BatchFailures))
+	return c.finish(r, p, err)
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+func batchRequest(names ...string) *pb.HelloBatchRequest {
+	in := &pb.HelloBatchRequest{}
+	for _, name := range names {
+		in.Requests = append(in.Requests, &pb.HelloRequest{Name: name})
+	}
+	return in
+}
+
+func TestSayHelloBatch_AnswersInOrder(t *testing.T) {
+	conn := serveBufconn(t, &greetworkload.ServerOptions{InstanceID: "a1"}, nil)
+	reply, err := pb.NewGreeterClient(conn).SayHelloBatch(context.Background(), batchRequest("a", "b", "c"))
+	require.NoError(t, err)
+	require.Len(t, reply.Results, 3)
+	for i, name := range []string{"a", "b", "c"} {
+		assert.Equal(t, &pb.HelloBatchResult{Reply: &pb.HelloReply{Message: "Hello " + name, InstanceId: "a1"}}, reply.Results[i])
+	}
+}
+
+func TestSayHelloBatch_Empty(t *testing.T) {
+	conn := serveBufconn(t, nil, nil)
+	reply, err := pb.NewGreeterClient(conn).SayHelloBatch(context.Background(), batchRequest())
+	require.NoError(t, err)
+	assert.Empty(t, reply.Results)
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	r := c.SayHelloBatch(conn, nil)
+	assert.True(t, r.Completed(), r.Error)
+	assert.Zero(t, r.BatchFailures)
+	assert.Equal(t, greetworkload.BatchStats{Calls: 1}, c.BatchStats())
+}
+
+func TestSayHelloBatch_PartialFailures(t *testing.T) {
+	conn := serveBufconn(t, &greetworkload.ServerOptions{ValidateRequests: true, ConformanceNames: true, Checksums: true}, nil)
+	names := []string{
+		"a",
+		greetworkload.ConformanceName(codes.NotFound),
+		"",
+		greetworkload.ConformanceName(codes.OK),
+		greetworkload.ConformanceName(codes.DeadlineExceeded),
+		"b",
+	}
+
+	reply, err := pb.NewGreeterClient(conn).SayHelloBatch(context.Background(), batchRequest(names...))
+	require.NoError(t, err)
+	require.Len(t, reply.Results, len(names))
+	var got []codes.Code
+	for _, result := range reply.Results {
+		got = append(got, codes.Code(result.Code))
+		if result.Code == int32(codes.OK) {
+			assert.True(t, result.Reply.VerifyChecksum())
+		} else {
+			assert.Nil(t, result.Reply)
+			assert.NotEmpty(t, result.Error)
+		}
+	}
+	assert.Equal(t, []codes.Code{codes.OK, codes.NotFound, codes.InvalidArgument, codes.OK, codes.DeadlineExceeded, codes.OK}, got)
+	assert.Equal(t, "invalid name: must not be empty", reply.Results[2].Error)
+	// Conformance requests fail without holding the call until its deadline.
+	assert.Equal(t, "conformance: DeadlineExceeded", reply.Results[4].Error)
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, VerifyChecksums: true})
+	r := c.SayHelloBatch(conn, names)
+	assert.True(t, r.Completed(), r.Error)
+	assert.Equal(t, 3, r.BatchFailures)
+	assert.Equal(t, names, r.Names)
+	assert.Empty(t, r.ChecksumMismatches)
+	r = c.SayHelloBatch(conn, []string{"c", "d"})
+	assert.True(t, r.Completed(), r.Error)
+	assert.Zero(t, r.BatchFailures)
+	assert.Equal(t, greetworkload.BatchStats{Calls: 2, Requests: 8, FailedRequests: 3}, c.BatchStats())
+	assert.Zero(t, c.ChecksumMismatches())
+}
+
+// A batch as large as the server receives is answered, and one a request larger fails as a whole,
+// its requests not counted as failed.
+func TestSayHelloBatch_NearMessageLimit(t *testing.T) {
+	const limit = 64 << 10
+	conn := serveBufconnWith(t, nil, grpc.MaxRecvMsgSize(limit))
+
+	// Names of 200 bytes, the last padded so that the batch is exactly as large as the limit.
+	name := strings.Repeat("n", 200)
+	var names []string
+	for batchRequest(append(names, name)...).Size() <= limit {
+		names = append(names, name)
+	}
+	names[len(names)-1] += strings.Repeat("p", limit-batchRequest(names...).Size())
+	require.Equal(t, limit, batchRequest(names...).Size())
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	r := c.SayHelloBatch(conn, names)
+	assert.True(t, r.Completed(), r.Error)
+	assert.Zero(t, r.BatchFailures)
+
+	r = c.SayHelloBatch(conn, append(names, "x"))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(r.Err()))
+	assert.Zero(t, r.BatchFailures)
+	assert.Equal(t, greetworkload.BatchStats{Calls: 2, FailedCalls: 1, Requests: int64(2*len(names) + 1)}, c.BatchStats())
+}
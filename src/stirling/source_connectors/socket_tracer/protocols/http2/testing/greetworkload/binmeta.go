@@ -0,0 +1,297 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"log"
+	"math/rand"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// BinaryMetadataKey is the key of the binary metadata entries a call is sent with. Its -bin
+	// suffix has gRPC base64 encode the values on the wire, so that they can hold any byte.
+	BinaryMetadataKey = "x-blob-bin"
+	// BinaryMetadataDigestHeader carries the BinaryMetadataDigest of the entries a call is sent
+	// with, which the server checks the entries it receives against.
+	BinaryMetadataDigestHeader = "x-blob-digest"
+	// BinaryMetadataEchoHeader asks the server to send the entries back in its response headers.
+	BinaryMetadataEchoHeader = "x-blob-echo"
+	// BinaryMetadataDigestTrailer is the trailer in which the server sends the BinaryMetadataDigest
+	// of the entries it received.
+	BinaryMetadataDigestTrailer = "x-blob-digest-received"
+)
+
+// BinaryMetadataDigest returns the SHA-256, in hex, of values, each prefixed by its length so that
+// entries that are split or joined differently do not match.
+func BinaryMetadataDigest(values []string) string {
+	h := sha256.New()
+	var n [8]byte
+	for _, v := range values {
+		binary.BigEndian.PutUint64(n[:], uint64(len(v)))
+		h.Write(n[:])
+		io.WriteString(h, v)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// BinaryMetadataOptions configure the binary metadata entries a BinaryMetadata sends.
+type BinaryMetadataOptions struct {
+	// Count is the number of entries every call is sent with.
+	Count int
+	// Size is the number of random bytes of every entry.
+	Size int
+	// Echo asks the server to send the entries back in its response headers, where they are
+	// checked too.
+	Echo bool
+	// Seed seeds the bytes of the entries, which are the same for every call.
+	Seed int64
+}
+
+// HeaderListSize returns the size the entries add to the header list of a call, as HTTP/2
+// SETTINGS_MAX_HEADER_LIST_SIZE counts it: the base64 encoded value and the key of every entry,
+// plus 32 bytes of overhead each.
+func (o *BinaryMetadataOptions) HeaderListSize() uint32 {
+	encoded := (o.Size*8 + 5) / 6
+	return uint32(o.Count * (len(BinaryMetadataKey) + encoded + 32))
+}
+
+// BinaryMetadata sends binary metadata entries with every call made through its interceptors,
+// apart from those to GreeterStats, GreeterFeatures, health and reflection. Large entries make
+// header blocks that span CONTINUATION frames. The digest the server echoes, and the entries
+// themselves with Echo, are checked byte for byte, and calls that do not match fail with DataLoss.
+type BinaryMetadata struct {
+	opts   *BinaryMetadataOptions
+	values []string
+	digest string
+
+	verified   int64
+	mismatches int64
+}
+
+// NewBinaryMetadata creates a BinaryMetadata sending the entries opts describe.
+func NewBinaryMetadata(opts *BinaryMetadataOptions) (*BinaryMetadata, error) {
+	if opts.Count <= 0 || opts.Size <= 0 {
+		return nil, badFlagsf("binary metadata needs a positive count and size, got %d entries of %d bytes", opts.Count, opts.Size)
+	}
+	rng := rand.New(rand.NewSource(opts.Seed))
+	values := make([]string, opts.Count)
+	for i := range values {
+		b := make([]byte, opts.Size)
+		rng.Read(b)
+		values[i] = string(b)
+	}
+	return &BinaryMetadata{opts: opts, values: values, digest: BinaryMetadataDigest(values)}, nil
+}
+
+// Values returns the entries sent with every call.
+func (b *BinaryMetadata) Values() []string {
+	return append([]string(nil), b.values...)
+}
+
+// Verified returns the number of calls whose entries the server received intact.
+func (b *BinaryMetadata) Verified() int64 {
+	return atomic.LoadInt64(&b.verified)
+}
+
+// Mismatches returns the number of calls whose entries did not make it intact, either way.
+func (b *BinaryMetadata) Mismatches() int64 {
+	return atomic.LoadInt64(&b.mismatches)
+}
+
+func (b *BinaryMetadata) outgoing(ctx context.Context) context.Context {
+	kv := make([]string, 0, 2*len(b.values)+4)
+	for _, v := range b.values {
+		kv = append(kv, BinaryMetadataKey, v)
+	}
+	kv = append(kv, BinaryMetadataDigestHeader, b.digest)
+	if b.opts.Echo {
+		kv = append(kv, BinaryMetadataEchoHeader, "true")
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+// check checks the header and trailer of a call that completed, returning a DataLoss error if the
+// entries did not make it intact.
+func (b *BinaryMetadata) check(header, trailer metadata.MD) error {
+	if got := trailer.Get(BinaryMetadataDigestTrailer); len(got) != 1 || got[0] != b.digest {
+		atomic.AddInt64(&b.mismatches, 1)
+		return status.Errorf(codes.DataLoss, "server received binary metadata with digest %v, sent %s", got, b.digest)
+	}
+	if b.opts.Echo {
+		if got := BinaryMetadataDigest(header.Get(BinaryMetadataKey)); got != b.digest {
+			atomic.AddInt64(&b.mismatches, 1)
+			return status.Errorf(codes.DataLoss, "received %d binary metadata entries back with digest %s, sent %d with %s",
+				len(header.Get(BinaryMetadataKey)), got, len(b.values), b.digest)
+		}
+	}
+	atomic.AddInt64(&b.verified, 1)
+	return nil
+}
+
+// UnaryClientInterceptor returns an interceptor that sends the entries with every unary call, and
+// checks them once it completes.
+func (b *BinaryMetadata) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if outsideWorkload(method) {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		var header, trailer metadata.MD
+		opts = append(opts, grpc.Header(&header), grpc.Trailer(&trailer))
+		if err := invoker(b.outgoing(ctx), method, req, reply, cc, opts...); err != nil {
+			return err
+		}
+		return b.check(header, trailer)
+	}
+}
+
+// StreamClientInterceptor returns an interceptor that sends the entries with every streaming call,
+// and checks them once the client reads the end of the stream, or the only reply of a
+// client-streaming call.
+func (b *BinaryMetadata) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if outsideWorkload(method) {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+		cs, err := streamer(b.outgoing(ctx), desc, cc, method, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return &binaryMetadataStream{ClientStream: cs, b: b, serverStreams: desc.ServerStreams}, nil
+	}
+}
+
+type binaryMetadataStream struct {
+	grpc.ClientStream
+	b *BinaryMetadata
+	// serverStreams is set if the server may send several replies. Otherwise the stream ends with
+	// the only one, and gRPC reads the end of the stream itself.
+	serverStreams bool
+}
+
+func (s *binaryMetadataStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == io.EOF || (err == nil && !s.serverStreams) {
+		// The header is in by the time the stream ends.
+		header, _ := s.ClientStream.Header()
+		if checkErr := s.b.check(header, s.ClientStream.Trailer()); checkErr != nil {
+			return checkErr
+		}
+	}
+	return err
+}
+
+// BinaryMetadataVerifier checks the binary metadata entries of the calls handled by a server
+// against the digest they are sent with, and echoes the digest of the entries it received in the
+// trailer. Calls whose entries do not match fail with DataLoss. Calls without a digest are left
+// alone, as are calls to GreeterStats, GreeterFeatures, health and reflection.
+type BinaryMetadataVerifier struct {
+	verified   int64
+	mismatches int64
+}
+
+// NewBinaryMetadataVerifier creates a new BinaryMetadataVerifier.
+func NewBinaryMetadataVerifier() *BinaryMetadataVerifier {
+	return &BinaryMetadataVerifier{}
+}
+
+// Verified returns the number of calls whose entries were received intact.
+func (v *BinaryMetadataVerifier) Verified() int64 {
+	return atomic.LoadInt64(&v.verified)
+}
+
+// Mismatches returns the number of calls whose entries did not match their digest.
+func (v *BinaryMetadataVerifier) Mismatches() int64 {
+	return atomic.LoadInt64(&v.mismatches)
+}
+
+// verify returns the header to send back and the trailer to echo for the call made in ctx, or
+// false if it was not sent with a digest.
+func (v *BinaryMetadataVerifier) verify(ctx context.Context, fullMethod string) (header, trailer metadata.MD, ok bool, err error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	want := md.Get(BinaryMetadataDigestHeader)
+	if len(want) == 0 || outsideWorkload(fullMethod) {
+		return nil, nil, false, nil
+	}
+	values := md.Get(BinaryMetadataKey)
+	got := BinaryMetadataDigest(values)
+	trailer = metadata.Pairs(BinaryMetadataDigestTrailer, got)
+	if got != want[0] {
+		atomic.AddInt64(&v.mismatches, 1)
+		log.Printf("Binary metadata of %s does not match its digest: received %d entries with digest %s, expected %s", fullMethod, len(values), got, want[0])
+		return nil, trailer, true, status.Errorf(codes.DataLoss, "received %d binary metadata entries with digest %s, expected %s", len(values), got, want[0])
+	}
+	atomic.AddInt64(&v.verified, 1)
+	if len(md.Get(BinaryMetadataEchoHeader)) > 0 {
+		header = metadata.MD{BinaryMetadataKey: values}
+	}
+	return header, trailer, true, nil
+}
+
+// UnaryServerInterceptor verifies the entries of unary calls.
+func (v *BinaryMetadataVerifier) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		header, trailer, ok, err := v.verify(ctx, info.FullMethod)
+		if !ok {
+			return handler(ctx, req)
+		}
+		if setErr := grpc.SetTrailer(ctx, trailer); setErr != nil {
+			log.Printf("Failed to echo the binary metadata digest: %v", setErr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header != nil {
+			if setErr := grpc.SetHeader(ctx, header); setErr != nil {
+				log.Printf("Failed to echo the binary metadata: %v", setErr)
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor verifies the entries of streaming calls.
+func (v *BinaryMetadataVerifier) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		header, trailer, ok, err := v.verify(ss.Context(), info.FullMethod)
+		if !ok {
+			return handler(srv, ss)
+		}
+		ss.SetTrailer(trailer)
+		if err != nil {
+			return err
+		}
+		if header != nil {
+			if setErr := ss.SetHeader(header); setErr != nil {
+				log.Printf("Failed to echo the binary metadata: %v", setErr)
+			}
+		}
+		return handler(srv, ss)
+	}
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// startBinaryMetadataServer starts a server that verifies binary metadata with verifier, accepting
+// header lists of up to maxHeaderListSize bytes if not 0.
+func startBinaryMetadataServer(t *testing.T, verifier *greetworkload.BinaryMetadataVerifier, connStats *greetworkload.ConnStatsHandler, maxHeaderListSize uint32) string {
+	settings := &greetworkload.HTTP2Settings{MaxHeaderListSize: maxHeaderListSize}
+	opts := append(settings.ServerOptions(),
+		grpc.ChainUnaryInterceptor(verifier.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(verifier.StreamServerInterceptor()))
+	return startServerWith(t, &serverSetup{GRPC: opts, Wrap: connStats.WrapListener}).Addr
+}
+
+func newBinaryMetadata(t *testing.T, opts *greetworkload.BinaryMetadataOptions) *greetworkload.BinaryMetadata {
+	b, err := greetworkload.NewBinaryMetadata(opts)
+	require.NoError(t, err)
+	return b
+}
+
+func TestBinaryMetadata_SpansContinuationFrames(t *testing.T) {
+	verifier := greetworkload.NewBinaryMetadataVerifier()
+	serverStats := greetworkload.NewConnStatsHandler()
+	addr := startBinaryMetadataServer(t, verifier, serverStats, 0)
+
+	// 256KB of header values, base64 encoded, in both directions: well over a 16KB frame.
+	b := newBinaryMetadata(t, &greetworkload.BinaryMetadataOptions{Count: 8, Size: 32 << 10, Echo: true, Seed: 1})
+	clientStats := greetworkload.NewConnStatsHandler()
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 10 * time.Second, BinaryMetadata: b})
+	conn, err := c.Dial(addr, grpc.WithContextDialer(clientStats.Dialer()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for _, r := range []*greetworkload.CallRecord{
+		c.SayHello(conn, "pixie"),
+		c.ServerStreaming(conn, "pixie"),
+		c.ClientStreaming(conn, []string{"a", "b"}),
+		c.BidirStreaming(conn, []string{"a", "b"}),
+	} {
+		require.True(t, r.Completed(), "%s: %s", r.Method, r.Error)
+	}
+	assert.EqualValues(t, 4, b.Verified())
+	assert.Zero(t, b.Mismatches())
+	assert.EqualValues(t, 4, verifier.Verified())
+	assert.Zero(t, verifier.Mismatches())
+
+	// HPACK Huffman codes the base64 values back to about their 256KB, which still takes at least
+	// 15 CONTINUATION frames of 16KB after the HEADERS frame of every header block.
+	conns := clientStats.Conns()
+	require.Len(t, conns, 1)
+	assert.GreaterOrEqual(t, conns[0].ContinuationFramesOut, int64(4*15))
+	conns = serverStats.Conns()
+	require.Len(t, conns, 1)
+	assert.GreaterOrEqual(t, conns[0].ContinuationFramesOut, int64(4*15))
+}
+
+func TestBinaryMetadata_ArbitraryBytes(t *testing.T) {
+	b := newBinaryMetadata(t, &greetworkload.BinaryMetadataOptions{Count: 2, Size: 4096, Seed: 1})
+	seen := make(map[byte]bool)
+	for _, v := range b.Values() {
+		require.Len(t, v, 4096)
+		for i := 0; i < len(v); i++ {
+			seen[v[i]] = true
+		}
+	}
+	// Including the bytes that may not appear in the value of a header that is not -bin.
+	assert.Len(t, seen, 256)
+	assert.True(t, seen[0])
+	assert.True(t, seen['\n'])
+
+	verifier := greetworkload.NewBinaryMetadataVerifier()
+	addr := startBinaryMetadataServer(t, verifier, greetworkload.NewConnStatsHandler(), 0)
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 10 * time.Second, BinaryMetadata: b})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	r := c.SayHello(conn, "pixie")
+	require.True(t, r.Completed(), r.Error)
+	assert.EqualValues(t, 1, verifier.Verified())
+}
+
+func TestBinaryMetadataVerifier_Mismatch(t *testing.T) {
+	verifier := greetworkload.NewBinaryMetadataVerifier()
+	addr := startBinaryMetadataServer(t, verifier, greetworkload.NewConnStatsHandler(), 0)
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx,
+		greetworkload.BinaryMetadataKey, "\x00\xff",
+		greetworkload.BinaryMetadataDigestHeader, greetworkload.BinaryMetadataDigest([]string{"\x00\xfe"}))
+	var trailer metadata.MD
+	_, err = pb.NewGreeterClient(conn).SayHello(ctx, &pb.HelloRequest{Name: "pixie"}, grpc.Trailer(&trailer))
+	assert.Equal(t, codes.DataLoss, status.Code(err))
+	assert.Equal(t, []string{greetworkload.BinaryMetadataDigest([]string{"\x00\xff"})}, trailer.Get(greetworkload.BinaryMetadataDigestTrailer))
+	assert.EqualValues(t, 1, verifier.Mismatches())
+
+	// Calls without a digest are left alone.
+	_, err = pb.NewGreeterClient(conn).SayHello(ctx, &pb.HelloRequest{Name: "pixie"})
+	assert.Equal(t, codes.DataLoss, status.Code(err))
+	_, err = pb.NewGreeterClient(conn).SayHello(context.Background(), &pb.HelloRequest{Name: "pixie"})
+	require.NoError(t, err)
+	assert.Zero(t, verifier.Verified())
+}
+
+func TestBinaryMetadata_ServerLimit(t *testing.T) {
+	verifier := greetworkload.NewBinaryMetadataVerifier()
+	addr := startBinaryMetadataServer(t, verifier, greetworkload.NewConnStatsHandler(), 64<<10)
+
+	opts := &greetworkload.BinaryMetadataOptions{Count: 4, Size: 32 << 10, Seed: 1}
+	require.Greater(t, opts.HeaderListSize(), uint32(64<<10))
+	b := newBinaryMetadata(t, opts)
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, BinaryMetadata: b})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The first call may go out before the client learns the server's limit, and is then rejected
+	// by the server. Those after it are rejected by the client. Either way with INTERNAL.
+	for i := 0; i < 2; i++ {
+		r := c.SayHello(conn, "pixie")
+		assert.Equal(t, codes.Internal.String(), r.Code, r.Error)
+	}
+	assert.Zero(t, verifier.Verified())
+	assert.Zero(t, b.Verified())
+
+	// Entries within the limit make it.
+	small := newBinaryMetadata(t, &greetworkload.BinaryMetadataOptions{Count: 4, Size: 8 << 10, Seed: 1})
+	c = greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, BinaryMetadata: small})
+	conn, err = c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	r := c.SayHello(conn, "pixie")
+	require.True(t, r.Completed(), r.Error)
+	assert.EqualValues(t, 1, verifier.Verified())
+}
+
+func TestBinaryMetadata_ClientLimit(t *testing.T) {
+	verifier := greetworkload.NewBinaryMetadataVerifier()
+	addr := startBinaryMetadataServer(t, verifier, greetworkload.NewConnStatsHandler(), 0)
+
+	// The server accepts the entries, but may not send them back.
+	b := newBinaryMetadata(t, &greetworkload.BinaryMetadataOptions{Count: 4, Size: 32 << 10, Echo: true, Seed: 1})
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{
+		Timeout:        5 * time.Second,
+		BinaryMetadata: b,
+		HTTP2:          &greetworkload.HTTP2Settings{MaxHeaderListSize: 64 << 10},
+	})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The server gives up on sending the header, and resets the stream.
+	r := c.SayHello(conn, "pixie")
+	assert.Equal(t, codes.Internal.String(), r.Code, r.Error)
+	assert.Zero(t, b.Verified())
+}
+
+func TestNewBinaryMetadata_Invalid(t *testing.T) {
+	for _, opts := range []*greetworkload.BinaryMetadataOptions{{Count: 0, Size: 1}, {Count: 1, Size: 0}, {Count: -1, Size: -1}} {
+		_, err := greetworkload.NewBinaryMetadata(opts)
+		assert.True(t, errors.Is(err, greetworkload.ErrBadFlagCombination), "%+v: %v", opts, err)
+	}
+}
+
+func TestBinaryMetadataOptions_HeaderListSize(t *testing.T) {
+	opts := &greetworkload.BinaryMetadataOptions{Count: 3, Size: 10}
+	// 10 bytes are 14 base64 characters, unpadded.
+	assert.EqualValues(t, 3*(len(greetworkload.BinaryMetadataKey)+14+32), opts.HeaderListSize())
+}
+
+func TestBinaryMetadataDigest(t *testing.T) {
+	assert.Equal(t, greetworkload.BinaryMetadataDigest([]string{"ab", "c"}), greetworkload.BinaryMetadataDigest([]string{"ab", "c"}))
+	assert.NotEqual(t, greetworkload.BinaryMetadataDigest([]string{"ab", "c"}), greetworkload.BinaryMetadataDigest([]string{"a", "bc"}))
+	assert.NotEqual(t, greetworkload.BinaryMetadataDigest(nil), greetworkload.BinaryMetadataDigest([]string{""}))
+}
@@ -0,0 +1,229 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The states of a CircuitBreaker.
+const (
+	// BreakerClosed lets every call through.
+	BreakerClosed = "closed"
+	// BreakerOpen fails every call without making it.
+	BreakerOpen = "open"
+	// BreakerHalfOpen lets a few probe calls through, and fails the others without making them.
+	BreakerHalfOpen = "half_open"
+)
+
+// breakerOpenMessage is the message of the calls a CircuitBreaker fails without making them.
+const breakerOpenMessage = "circuit breaker is open"
+
+// BreakerOptions configure a CircuitBreaker.
+type BreakerOptions struct {
+	// Threshold is the number of consecutive failed calls that opens the breaker.
+	Threshold int
+	// OpenDuration is how long the breaker stays open before it lets probe calls through.
+	OpenDuration time.Duration
+	// Probes is the number of probe calls that must complete in a row, half open, to close the
+	// breaker. At most this many are in flight at once, and any failing opens it again.
+	Probes int
+}
+
+// Validate returns an error if the options are out of range.
+func (o *BreakerOptions) Validate() error {
+	switch {
+	case o.Threshold < 1:
+		return fmt.Errorf("breaker threshold must be positive, got %d", o.Threshold)
+	case o.OpenDuration <= 0:
+		return fmt.Errorf("breaker open duration must be positive, got %v", o.OpenDuration)
+	case o.Probes < 1:
+		return fmt.Errorf("breaker probes must be positive, got %d", o.Probes)
+	}
+	return nil
+}
+
+// BreakerTransition is a change of state of a CircuitBreaker.
+type BreakerTransition struct {
+	Time time.Time `json:"time"`
+	From string    `json:"from"`
+	To   string    `json:"to"`
+}
+
+// CircuitBreaker stops a client from making calls for a while after a run of failures, and then
+// probes whether the server has recovered before letting every call through again. Every error
+// but the client's own cancellations counts as a failure.
+type CircuitBreaker struct {
+	opts *BreakerOptions
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	// openedAt is when the breaker last opened.
+	openedAt time.Time
+	// probing and probed count the probes in flight, and those that completed, half open.
+	probing     int
+	probed      int
+	rejected    int64
+	transitions []BreakerTransition
+}
+
+// NewCircuitBreaker creates a closed CircuitBreaker.
+func NewCircuitBreaker(opts *BreakerOptions) (*CircuitBreaker, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return &CircuitBreaker{opts: opts, state: BreakerClosed}, nil
+}
+
+// setState moves the breaker to state at now. b.mu must be held.
+func (b *CircuitBreaker) setState(state string, now time.Time) {
+	log.Printf("Circuit breaker %s -> %s", b.state, state)
+	b.transitions = append(b.transitions, BreakerTransition{Time: now, From: b.state, To: state})
+	b.state = state
+	b.failures = 0
+	b.probing = 0
+	b.probed = 0
+	if state == BreakerOpen {
+		b.openedAt = now
+	}
+}
+
+// allow returns whether a call may be made now, and if so, whether it is a probe.
+func (b *CircuitBreaker) allow() (ok, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= b.opts.OpenDuration {
+		b.setState(BreakerHalfOpen, now)
+	}
+	switch b.state {
+	case BreakerClosed:
+		return true, false
+	case BreakerHalfOpen:
+		if b.probing+b.probed < b.opts.Probes {
+			b.probing++
+			return true, true
+		}
+	}
+	b.rejected++
+	return false, false
+}
+
+// done records the outcome of a call let through by allow.
+func (b *CircuitBreaker) done(probe bool, err error) {
+	failed := err != nil && status.Code(err) != codes.Canceled
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if probe {
+		if b.state != BreakerHalfOpen {
+			// Another probe already settled it.
+			return
+		}
+		b.probing--
+		switch {
+		case failed:
+			b.setState(BreakerOpen, now)
+		case err == nil:
+			b.probed++
+			if b.probed >= b.opts.Probes {
+				b.setState(BreakerClosed, now)
+			}
+		}
+		return
+	}
+	if b.state != BreakerClosed {
+		return
+	}
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.opts.Threshold {
+		b.setState(BreakerOpen, now)
+	}
+}
+
+// State returns the current state of the breaker, one of the Breaker constants.
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Rejected returns the number of calls the breaker failed without making them.
+func (b *CircuitBreaker) Rejected() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rejected
+}
+
+// Transitions returns the changes of state of the breaker so far, in order.
+func (b *CircuitBreaker) Transitions() []BreakerTransition {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]BreakerTransition(nil), b.transitions...)
+}
+
+// UnaryClientInterceptor fails the unary calls the breaker does not let through with UNAVAILABLE,
+// without making them, and feeds it the outcome of the others. It should come first, so that the
+// calls it fails are not seen by the interceptors after it.
+func (b *CircuitBreaker) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ok, probe := b.allow()
+		if !ok {
+			return status.Error(codes.Unavailable, breakerOpenMessage)
+		}
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		b.done(probe, err)
+		return err
+	}
+}
+
+// BreakerRejected returns true if the call was failed by a CircuitBreaker without being made.
+func (r *CallRecord) BreakerRejected() bool {
+	return r.Code == codes.Unavailable.String() && strings.Contains(r.Error, breakerOpenMessage)
+}
+
+// WriteBreakerTransitions writes transitions to w as JSON lines, after a line holding meta, if
+// not nil.
+func WriteBreakerTransitions(w io.Writer, meta *RunMetadata, transitions []BreakerTransition) error {
+	if err := writeRunMetadataLine(w, meta); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	for _, t := range transitions {
+		if err := enc.Encode(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+func TestBreakerOptions_Validate(t *testing.T) {
+	assert.NoError(t, (&greetworkload.BreakerOptions{Threshold: 1, OpenDuration: time.Second, Probes: 1}).Validate())
+	for _, opts := range []*greetworkload.BreakerOptions{
+		{OpenDuration: time.Second, Probes: 1},
+		{Threshold: 1, Probes: 1},
+		{Threshold: 1, OpenDuration: time.Second},
+	} {
+		_, err := greetworkload.NewCircuitBreaker(opts)
+		assert.Error(t, err, "%+v", opts)
+	}
+}
+
+// The server fails every call for a while. The breaker opens, makes no call while open, probes
+// until the server recovers, and then closes.
+func TestCircuitBreaker_ServerOutage(t *testing.T) {
+	faults, err := greetworkload.NewFaultInjector(&greetworkload.FaultConfig{ErrorRate: 1, Code: codes.Unavailable}, 1)
+	require.NoError(t, err)
+	var (
+		mu       sync.Mutex
+		arrivals []time.Time
+	)
+	arrive := func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		mu.Lock()
+		arrivals = append(arrivals, time.Now())
+		mu.Unlock()
+		return handler(ctx, req)
+	}
+	s := startServerWith(t, &serverSetup{GRPC: []grpc.ServerOption{grpc.ChainUnaryInterceptor(arrive, faults.UnaryServerInterceptor())}})
+
+	const openDuration = 200 * time.Millisecond
+	breaker, err := greetworkload.NewCircuitBreaker(&greetworkload.BreakerOptions{Threshold: 3, OpenDuration: openDuration, Probes: 2})
+	require.NoError(t, err)
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, Breaker: breaker})
+	conn, err := c.Dial(s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The outage outlasts a few open windows.
+	recovered := time.AfterFunc(time.Second, func() { _ = faults.SetConfig(&greetworkload.FaultConfig{}) })
+	defer recovered.Stop()
+	var records []*greetworkload.CallRecord
+	closed := func() bool {
+		tr := breaker.Transitions()
+		return len(tr) > 0 && tr[len(tr)-1].To == greetworkload.BreakerClosed
+	}
+	for deadline := time.Now().Add(10 * time.Second); !closed() && time.Now().Before(deadline); {
+		records = append(records, c.SayHello(conn, "pixie"))
+		time.Sleep(5 * time.Millisecond)
+	}
+	require.True(t, closed(), "%+v", breaker.Transitions())
+	r := c.SayHello(conn, "pixie")
+	require.True(t, r.Completed(), r.Error)
+	records = append(records, r)
+
+	tr := breaker.Transitions()
+	assert.Equal(t, greetworkload.BreakerClosed, tr[0].From)
+	assert.Equal(t, greetworkload.BreakerOpen, tr[0].To)
+	reopened := 0
+	for i := 1; i < len(tr); i++ {
+		assert.Equal(t, tr[i-1].To, tr[i].From)
+		if tr[i].To == greetworkload.BreakerHalfOpen {
+			assert.GreaterOrEqual(t, tr[i].Time.Sub(tr[i-1].Time), openDuration)
+		}
+		if tr[i].From == greetworkload.BreakerHalfOpen && tr[i].To == greetworkload.BreakerOpen {
+			reopened++
+		}
+	}
+	assert.Greater(t, reopened, 0, "no probe failed during the outage")
+	assert.Equal(t, greetworkload.BreakerHalfOpen, tr[len(tr)-1].From)
+
+	// No call reached the server while the breaker was open.
+	mu.Lock()
+	defer mu.Unlock()
+	for i, from := range tr {
+		if from.To != greetworkload.BreakerOpen {
+			continue
+		}
+		require.Greater(t, len(tr), i+1)
+		for _, a := range arrivals {
+			assert.False(t, a.After(from.Time) && a.Before(tr[i+1].Time), "a call arrived at %v, while open from %v to %v", a, from.Time, tr[i+1].Time)
+		}
+	}
+
+	// The calls the breaker failed are recorded as such, and were never made.
+	var rejected, failed int
+	for _, r := range records {
+		switch {
+		case r.BreakerRejected():
+			rejected++
+		case !r.Completed():
+			failed++
+		}
+	}
+	assert.Greater(t, rejected, 0)
+	assert.Equal(t, int64(rejected), breaker.Rejected())
+	assert.Equal(t, len(records)-rejected, len(arrivals))
+	assert.GreaterOrEqual(t, failed, 3)
+}
+
+func TestWriteBreakerTransitions(t *testing.T) {
+	start := time.Unix(1700000000, 0).UTC()
+	transitions := []greetworkload.BreakerTransition{
+		{Time: start, From: greetworkload.BreakerClosed, To: greetworkload.BreakerOpen},
+		{Time: start.Add(time.Second), From: greetworkload.BreakerOpen, To: greetworkload.BreakerHalfOpen},
+	}
+	var buf bytes.Buffer
+	meta := &greetworkload.RunMetadata{Seed: 1}
+	require.NoError(t, greetworkload.WriteBreakerTransitions(&buf, meta, transitions))
+	got, err := greetworkload.ReadRunMetadata(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, meta.Seed, got.Seed)
+
+	dec := json.NewDecoder(&buf)
+	var line map[string]interface{}
+	require.NoError(t, dec.Decode(&line))
+	assert.Contains(t, line, "run_metadata")
+	for _, want := range transitions {
+		var tr greetworkload.BreakerTransition
+		require.NoError(t, dec.Decode(&tr))
+		assert.Equal(t, want, tr)
+	}
+	assert.False(t, dec.More())
+}
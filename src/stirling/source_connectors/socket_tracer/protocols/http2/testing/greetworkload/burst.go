@@ -0,0 +1,130 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// BurstOptions configure RunBursts.
+type BurstOptions struct {
+	// Size is the number of calls of every burst, issued together with no delay between them.
+	Size int
+	// Bursts is the number of bursts.
+	Bursts int
+	// Interval is the time from the start of a burst to the start of the next. Bursts start on
+	// schedule, whether or not the calls of the one before have finished.
+	Interval time.Duration
+}
+
+// BurstStats summarize a RunBursts run.
+type BurstStats struct {
+	Bursts int `json:"bursts"`
+	// MaxLatenessNS is the longest a burst started after its scheduled time.
+	MaxLatenessNS int64 `json:"max_lateness_ns"`
+	// MaxSpreadNS is the longest time between the first and last call of a burst to start.
+	MaxSpreadNS int64 `json:"max_spread_ns"`
+}
+
+// RunBursts calls Greeter.SayHello with name in opts.Bursts bursts of opts.Size calls each. The
+// calls of a burst are spread round-robin over conns, so that, given a single connection, their
+// frames may be coalesced. Every call has a goroutine of its own, started before the burst is due,
+// so that the calls of a burst start within moments of each other. Records are numbered with the
+// burst they belong to, and returned sorted by start time once every call has finished.
+//
+// If ctx is done, no new burst starts, and the calls in flight are cancelled. RunBursts then
+// returns ctx.Err() along with the calls made so far.
+func (c *Client) RunBursts(ctx context.Context, conns []*grpc.ClientConn, name string, opts *BurstOptions) ([]*CallRecord, *BurstStats, error) {
+	switch {
+	case opts.Size <= 0 || opts.Bursts <= 0:
+		return nil, nil, errors.New("burst size and count must be positive")
+	case opts.Interval < 0:
+		return nil, nil, errors.New("burst interval must not be negative")
+	case len(conns) == 0:
+		return nil, nil, errors.New("bursts need at least one connection")
+	}
+	ctx = c.opts.Audit.root(ctx)
+	stats := &BurstStats{}
+	// bursts holds the records of every burst started, each filled in by the goroutines of its
+	// calls.
+	var bursts [][]*CallRecord
+	var wg sync.WaitGroup
+	var err error
+	first := time.Now()
+	for b := 0; b < opts.Bursts; b++ {
+		start, abort := make(chan struct{}), make(chan struct{})
+		burst := make([]*CallRecord, opts.Size)
+		for i := range burst {
+			wg.Add(1)
+			go func(i, b int) {
+				defer wg.Done()
+				select {
+				case <-start:
+				case <-abort:
+					return
+				}
+				r := c.Do(ctx, conns[i%len(conns)], &CallOverrides{Name: name})
+				r.Burst = b + 1
+				burst[i] = r
+			}(i, b)
+		}
+
+		due := first.Add(time.Duration(b) * opts.Interval)
+		if err = sleepUntil(ctx, due); err != nil {
+			close(abort)
+			break
+		}
+		close(start)
+		if late := time.Since(due).Nanoseconds(); late > stats.MaxLatenessNS {
+			stats.MaxLatenessNS = late
+		}
+		bursts = append(bursts, burst)
+	}
+	wg.Wait()
+
+	var records []*CallRecord
+	for _, burst := range bursts {
+		records = append(records, burst...)
+		if spread := burstSpread(burst).Nanoseconds(); spread > stats.MaxSpreadNS {
+			stats.MaxSpreadNS = spread
+		}
+	}
+	stats.Bursts = len(bursts)
+	sort.Slice(records, func(i, j int) bool { return records[i].StartTime.Before(records[j].StartTime) })
+	return records, stats, err
+}
+
+// burstSpread returns the time between the first and last of records to start.
+func burstSpread(records []*CallRecord) time.Duration {
+	var min, max time.Time
+	for i, r := range records {
+		if i == 0 || r.StartTime.Before(min) {
+			min = r.StartTime
+		}
+		if i == 0 || r.StartTime.After(max) {
+			max = r.StartTime
+		}
+	}
+	return max.Sub(min)
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"google.golang.org/grpc"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// burstStarts groups the start times of records by burst.
+func burstStarts(t *testing.T, records []*greetworkload.CallRecord) map[int][]time.Time {
+	starts := make(map[int][]time.Time)
+	for _, r := range records {
+		require.Positive(t, r.Burst)
+		starts[r.Burst] = append(starts[r.Burst], r.StartTime)
+	}
+	for _, s := range starts {
+		sort.Slice(s, func(i, j int) bool { return s[i].Before(s[j]) })
+	}
+	return starts
+}
+
+// burstJitter runs a few calibration bursts of size calls on conn and returns the median time
+// between the first and last of a burst's calls to start. That is the host's own spread, which is
+// over a millisecond on a single CPU or under -race.
+func burstJitter(t *testing.T, c *greetworkload.Client, conn *grpc.ClientConn, size int) time.Duration {
+	const bursts = 5
+	records, _, err := c.RunBursts(context.Background(), []*grpc.ClientConn{conn}, "pixie", &greetworkload.BurstOptions{
+		Size:     size,
+		Bursts:   bursts,
+		Interval: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	var spreads []time.Duration
+	for _, s := range burstStarts(t, records) {
+		spreads = append(spreads, s[len(s)-1].Sub(s[0]))
+	}
+	require.Len(t, spreads, bursts)
+	sort.Slice(spreads, func(i, j int) bool { return spreads[i] < spreads[j] })
+	return spreads[bursts/2]
+}
+
+func TestRunBursts_GapsAndClustering(t *testing.T) {
+	_, addr := startServer(t, nil)
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	const size, bursts, interval = 10, 10, 50 * time.Millisecond
+	// The calls of a burst start within 1ms of each other, or within twice the host's measured
+	// spread where that is worse. A burst can still be split by the host stalling the process, so
+	// this holds for most bursts rather than all of them.
+	window := time.Millisecond
+	if j := 2 * burstJitter(t, c, conn, size); j > window {
+		window = j
+	}
+	require.Less(t, window, interval/5)
+
+	records, stats, err := c.RunBursts(context.Background(), []*grpc.ClientConn{conn}, "pixie", &greetworkload.BurstOptions{
+		Size:     size,
+		Bursts:   bursts,
+		Interval: interval,
+	})
+	require.NoError(t, err)
+	require.Len(t, records, size*bursts)
+	assert.Equal(t, bursts, stats.Bursts)
+	for i, r := range records {
+		assert.True(t, r.Completed(), r.Error)
+		if i > 0 {
+			assert.False(t, r.StartTime.Before(records[i-1].StartTime))
+		}
+	}
+
+	starts := burstStarts(t, records)
+	require.Len(t, starts, bursts)
+	var clusteredBursts int
+	var maxSpread time.Duration
+	for b := 1; b <= bursts; b++ {
+		require.Len(t, starts[b], size)
+		first := starts[b][0]
+		if b > 1 {
+			gap := first.Sub(starts[b-1][0])
+			assert.InDelta(t, interval.Seconds(), gap.Seconds(), (5 * time.Millisecond).Seconds(), "gap before burst %d", b)
+		}
+		spread := starts[b][size-1].Sub(first)
+		if spread <= window {
+			clusteredBursts++
+		}
+		if spread > maxSpread {
+			maxSpread = spread
+		}
+	}
+	assert.GreaterOrEqual(t, clusteredBursts, bursts*8/10, "bursts whose calls started within %v", window)
+	assert.Equal(t, maxSpread.Nanoseconds(), stats.MaxSpreadNS)
+	assert.Less(t, time.Duration(stats.MaxLatenessNS), 5*time.Millisecond)
+}
+
+func TestRunBursts_SpreadsOverConns(t *testing.T) {
+	_, addr := startServer(t, nil)
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	connStats := greetworkload.NewConnStatsHandler()
+	var conns []*grpc.ClientConn
+	for i := 0; i < 3; i++ {
+		conn, err := c.Dial(addr, grpc.WithStatsHandler(connStats))
+		require.NoError(t, err)
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	records, _, err := c.RunBursts(context.Background(), conns, "pixie", &greetworkload.BurstOptions{Size: 6, Bursts: 4})
+	require.NoError(t, err)
+	require.Len(t, records, 24)
+	got := connStats.Conns()
+	require.Len(t, got, 3)
+	for _, s := range got {
+		assert.EqualValues(t, 8, s.RPCsCompleted)
+	}
+}
+
+func TestRunBursts_Cancel(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+	srv := startSlowServer(t, time.Minute)
+	defer srv.s.Stop()
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Minute})
+	conn, err := c.Dial(srv.addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Millisecond)
+	defer cancel()
+	records, stats, err := c.RunBursts(ctx, []*grpc.ClientConn{conn}, "pixie", &greetworkload.BurstOptions{
+		Size:     5,
+		Bursts:   100,
+		Interval: 50 * time.Millisecond,
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	// Bursts were due at 0, 50 and 100ms, and their calls were cut short by ctx.
+	assert.Equal(t, 3, stats.Bursts)
+	require.Len(t, records, 15)
+	for _, r := range records {
+		assert.LessOrEqual(t, r.Burst, 3)
+		assert.False(t, r.Completed())
+	}
+}
+
+func TestRunBursts_RejectsBadOptions(t *testing.T) {
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{})
+	conns := []*grpc.ClientConn{nil}
+	for _, opts := range []*greetworkload.BurstOptions{
+		{Bursts: 1},
+		{Size: 1},
+		{Size: 1, Bursts: 1, Interval: -1},
+	} {
+		_, _, err := c.RunBursts(context.Background(), conns, "pixie", opts)
+		assert.Error(t, err, "%+v", opts)
+	}
+	_, _, err := c.RunBursts(context.Background(), nil, "pixie", &greetworkload.BurstOptions{Size: 1, Bursts: 1})
+	assert.Error(t, err)
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// CacheTrailer is the trailer a ReplyCache sends on the calls it handles, set to CacheHit or
+// CacheMiss.
+const CacheTrailer = "x-cache"
+
+// The values of CacheTrailer.
+const (
+	// CacheHit is sent when the reply was taken from the cache.
+	CacheHit = "hit"
+	// CacheMiss is sent when the reply was made by the handler, and cached.
+	CacheMiss = "miss"
+)
+
+// ReplyCacheStats count the calls a ReplyCache handled.
+type ReplyCacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	// Entries is the number of replies cached.
+	Entries int `json:"entries"`
+}
+
+type cacheKey struct {
+	name  string
+	count int32
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	reply *cachedReply
+}
+
+// cacheFill is a reply being made for a key that is not cached yet. done is closed once the call
+// making it returns.
+type cacheFill struct {
+	done chan struct{}
+}
+
+// ReplyCache memoizes the replies to Greeter.SayHello, keyed by the name and count of the
+// request, in a cache that evicts the least recently used reply beyond its size. It keeps every
+// reply marshaled, and sends the same bytes on every hit, so that identical requests get
+// byte-identical replies.
+//
+// Concurrent misses for the same key are made once: the first call runs the handler, and the
+// others wait for its reply and count as hits. If that call fails, nothing is cached, and the
+// next waiting call runs the handler in turn.
+type ReplyCache struct {
+	size int
+
+	mu sync.Mutex
+	// lru holds the *cacheEntry of every reply cached, most recently used first.
+	lru      *list.List
+	entries  map[cacheKey]*list.Element
+	inflight map[cacheKey]*cacheFill
+	stats    ReplyCacheStats
+}
+
+// NewReplyCache creates a ReplyCache holding up to size replies.
+func NewReplyCache(size int) (*ReplyCache, error) {
+	if size <= 0 {
+		return nil, badFlagsf("the reply cache size must be positive, got %d", size)
+	}
+	return &ReplyCache{
+		size:     size,
+		lru:      list.New(),
+		entries:  make(map[cacheKey]*list.Element),
+		inflight: make(map[cacheKey]*cacheFill),
+	}, nil
+}
+
+// Stats returns the counts of the calls handled so far.
+func (c *ReplyCache) Stats() ReplyCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
+
+// UnaryServerInterceptor returns an interceptor that answers Greeter.SayHello from the cache, and
+// passes every other call on. Hits skip the interceptors chained after it, such as a
+// FaultInjector's, with the latency and failures they inject.
+func (c *ReplyCache) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		in, ok := req.(*pb.HelloRequest)
+		if !ok || info.FullMethod != pb.Greeter_SayHello_FullMethodName {
+			return handler(ctx, req)
+		}
+		key := cacheKey{name: in.Name, count: in.Count}
+		for {
+			reply, fill, wait := c.lookup(key)
+			if reply != nil {
+				_ = grpc.SetTrailer(ctx, metadata.Pairs(CacheTrailer, CacheHit))
+				return reply, nil
+			}
+			if wait {
+				select {
+				case <-fill.done:
+					continue
+				case <-ctx.Done():
+					return nil, status.FromContextError(ctx.Err()).Err()
+				}
+			}
+			resp, err := handler(ctx, req)
+			reply = c.fill(key, fill, resp, err)
+			if reply == nil {
+				return resp, err
+			}
+			_ = grpc.SetTrailer(ctx, metadata.Pairs(CacheTrailer, CacheMiss))
+			return reply, nil
+		}
+	}
+}
+
+// lookup returns the reply cached for key, if any. Otherwise it returns the fill of key, and
+// whether to wait for it, or to make the reply, if the fill was just started.
+func (c *ReplyCache) lookup(key cacheKey) (*cachedReply, *cacheFill, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		c.stats.Hits++
+		return e.Value.(*cacheEntry).reply, nil, false
+	}
+	if fill, ok := c.inflight[key]; ok {
+		return nil, fill, true
+	}
+	fill := &cacheFill{done: make(chan struct{})}
+	c.inflight[key] = fill
+	return nil, fill, false
+}
+
+// fill caches the reply the handler made for key, and returns it marshaled with
+// greetpb.MarshalDeterministic, unless the call failed. Either way, the calls waiting on fill are let go.
+func (c *ReplyCache) fill(key cacheKey, fill *cacheFill, resp interface{}, err error) *cachedReply {
+	var reply *cachedReply
+	if m, ok := resp.(*pb.HelloReply); ok && err == nil {
+		if b, err := pb.MarshalDeterministic(m); err == nil {
+			reply = &cachedReply{b: b}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.inflight, key)
+	close(fill.done)
+	if reply == nil {
+		return nil
+	}
+	c.stats.Misses++
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, reply: reply})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		c.stats.Evictions++
+	}
+	return reply
+}
+
+// cachedReply is a HelloReply marshaled once. The default codec and greetpb.DeterministicCodec,
+// through Marshal, and greetpb.SizedCodec, through Size and MarshalToSizedBuffer, send its bytes
+// as they are.
+type cachedReply struct {
+	b []byte
+}
+
+func (r *cachedReply) Marshal() ([]byte, error) {
+	return r.b, nil
+}
+
+func (r *cachedReply) Size() int {
+	return len(r.b)
+}
+
+func (r *cachedReply) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	return copy(dAtA[len(dAtA)-len(r.b):], r.b), nil
+}
+
+// Reset implements proto.Message. A cached reply is never reset, as it is only marshaled.
+func (r *cachedReply) Reset() {}
+
+// String renders the reply the bytes hold, for logging.
+func (r *cachedReply) String() string {
+	m := &pb.HelloReply{}
+	if err := m.Unmarshal(r.b); err != nil {
+		return err.Error()
+	}
+	return m.String()
+}
+
+// ProtoMessage implements proto.Message.
+func (*cachedReply) ProtoMessage() {}
+
+// setCache records in r whether the server answered the call from its reply cache, as it sent in
+// trailer, and counts it.
+func (c *Client) setCache(r *CallRecord, trailer metadata.MD) {
+	v := trailer.Get(CacheTrailer)
+	if len(v) != 1 {
+		return
+	}
+	switch r.Cache = v[0]; r.Cache {
+	case CacheHit:
+		atomic.AddInt64(&c.cacheHits, 1)
+	case CacheMiss:
+		atomic.AddInt64(&c.cacheMisses, 1)
+	}
+}
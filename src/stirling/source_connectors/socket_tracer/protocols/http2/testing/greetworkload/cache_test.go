@@ -0,0 +1,239 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+var sayHelloInfo = &grpc.UnaryServerInfo{FullMethod: "/px.stirling.protocols.http2.testing.Greeter/SayHello"}
+
+// countingHandler returns a SayHello handler that counts its calls, and waits for release, if
+// set, before replying.
+func countingHandler(calls *int64, release <-chan struct{}) grpc.UnaryHandler {
+	return func(ctx context.Context, req interface{}) (interface{}, error) {
+		atomic.AddInt64(calls, 1)
+		if release != nil {
+			<-release
+		}
+		return &pb.HelloReply{Message: "Hello " + req.(*pb.HelloRequest).Name}, nil
+	}
+}
+
+func callCached(t *testing.T, interceptor grpc.UnaryServerInterceptor, handler grpc.UnaryHandler, name string) {
+	_, err := interceptor(context.Background(), &pb.HelloRequest{Name: name}, sayHelloInfo, handler)
+	require.NoError(t, err)
+}
+
+func TestReplyCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	cache, err := greetworkload.NewReplyCache(2)
+	require.NoError(t, err)
+	interceptor := cache.UnaryServerInterceptor()
+	var calls int64
+	handler := countingHandler(&calls, nil)
+
+	callCached(t, interceptor, handler, "a")
+	callCached(t, interceptor, handler, "b")
+	// Makes b the least recently used.
+	callCached(t, interceptor, handler, "a")
+	callCached(t, interceptor, handler, "c")
+	assert.Equal(t, int64(3), atomic.LoadInt64(&calls))
+
+	callCached(t, interceptor, handler, "a")
+	callCached(t, interceptor, handler, "c")
+	assert.Equal(t, int64(3), atomic.LoadInt64(&calls))
+	callCached(t, interceptor, handler, "b")
+	assert.Equal(t, int64(4), atomic.LoadInt64(&calls))
+
+	assert.Equal(t, greetworkload.ReplyCacheStats{Hits: 3, Misses: 4, Evictions: 2, Entries: 2}, cache.Stats())
+}
+
+func TestReplyCache_KeysByNameAndCount(t *testing.T) {
+	cache, err := greetworkload.NewReplyCache(10)
+	require.NoError(t, err)
+	interceptor := cache.UnaryServerInterceptor()
+	var calls int64
+	handler := countingHandler(&calls, nil)
+
+	for _, req := range []*pb.HelloRequest{{Name: "a"}, {Name: "a", Count: 2}, {Name: "a"}, {Name: "a", Count: 2}} {
+		_, err := interceptor(context.Background(), req, sayHelloInfo, handler)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int64(2), atomic.LoadInt64(&calls))
+}
+
+func TestReplyCache_ConcurrentMissesCallHandlerOnce(t *testing.T) {
+	cache, err := greetworkload.NewReplyCache(10)
+	require.NoError(t, err)
+	interceptor := cache.UnaryServerInterceptor()
+	var calls int64
+	release := make(chan struct{})
+	handler := countingHandler(&calls, release)
+
+	const numCallers = 50
+	var wg sync.WaitGroup
+	replies := make([][]byte, numCallers)
+	for i := 0; i < numCallers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reply, err := interceptor(context.Background(), &pb.HelloRequest{Name: "pixie"}, sayHelloInfo, handler)
+			if assert.NoError(t, err) {
+				replies[i], err = encoding.GetCodec("proto").Marshal(reply)
+				assert.NoError(t, err)
+			}
+		}(i)
+	}
+	// Gives every caller time to find the reply being made.
+	require.Eventually(t, func() bool { return atomic.LoadInt64(&calls) == 1 }, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int64(1), atomic.LoadInt64(&calls))
+	for _, reply := range replies {
+		assert.Equal(t, replies[0], reply)
+	}
+	stats := cache.Stats()
+	assert.Equal(t, int64(1), stats.Misses)
+	assert.Equal(t, int64(numCallers-1), stats.Hits)
+}
+
+func TestReplyCache_FailuresAreNotCached(t *testing.T) {
+	cache, err := greetworkload.NewReplyCache(10)
+	require.NoError(t, err)
+	interceptor := cache.UnaryServerInterceptor()
+	var calls int64
+	failing := func(ctx context.Context, req interface{}) (interface{}, error) {
+		atomic.AddInt64(&calls, 1)
+		return nil, status.Error(codes.Unavailable, "injected")
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := interceptor(context.Background(), &pb.HelloRequest{Name: "pixie"}, sayHelloInfo, failing)
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	}
+	assert.Equal(t, int64(2), atomic.LoadInt64(&calls))
+	assert.Equal(t, greetworkload.ReplyCacheStats{}, cache.Stats())
+}
+
+func TestNewReplyCache_RejectsNonPositiveSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		_, err := greetworkload.NewReplyCache(size)
+		assert.ErrorIs(t, err, greetworkload.ErrBadFlagCombination)
+	}
+}
+
+// recordingCodec is the proto codec, recording the bytes of every message it unmarshals.
+type recordingCodec struct {
+	encoding.Codec
+
+	mu       sync.Mutex
+	messages [][]byte
+}
+
+func (c *recordingCodec) Unmarshal(data []byte, v interface{}) error {
+	c.mu.Lock()
+	c.messages = append(c.messages, append([]byte(nil), data...))
+	c.mu.Unlock()
+	return c.Codec.Unmarshal(data, v)
+}
+
+func startCachedServer(t *testing.T, cache *greetworkload.ReplyCache, faults *greetworkload.FaultInjector) string {
+	return startServerWith(t, &serverSetup{
+		Options: &greetworkload.ServerOptions{Checksums: true},
+		GRPC:    []grpc.ServerOption{grpc.ChainUnaryInterceptor(cache.UnaryServerInterceptor(), faults.UnaryServerInterceptor())},
+	}).Addr
+}
+
+func TestReplyCache_HitsSkipInjectedLatency(t *testing.T) {
+	cache, err := greetworkload.NewReplyCache(10)
+	require.NoError(t, err)
+	const latency = 300 * time.Millisecond
+	faults, err := greetworkload.NewFaultInjector(&greetworkload.FaultConfig{LatencyMillis: latency.Milliseconds()}, 1)
+	require.NoError(t, err)
+	addr := startCachedServer(t, cache, faults)
+
+	codec := &recordingCodec{Codec: encoding.GetCodec("proto")}
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec)))
+	require.NoError(t, err)
+	defer conn.Close()
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, VerifyChecksums: true})
+
+	miss := c.SayHello(conn, "pixie")
+	require.True(t, miss.Completed(), miss.Error)
+	assert.Equal(t, greetworkload.CacheMiss, miss.Cache)
+	assert.GreaterOrEqual(t, miss.DurationNS, latency.Nanoseconds())
+
+	for i := 0; i < 3; i++ {
+		hit := c.SayHello(conn, "pixie")
+		require.True(t, hit.Completed(), hit.Error)
+		assert.Equal(t, greetworkload.CacheHit, hit.Cache)
+		assert.Less(t, hit.DurationNS, latency.Nanoseconds())
+	}
+
+	hits, misses := c.CacheCounts()
+	assert.Equal(t, int64(3), hits)
+	assert.Equal(t, int64(1), misses)
+	assert.Zero(t, c.ChecksumMismatches())
+
+	codec.mu.Lock()
+	defer codec.mu.Unlock()
+	require.Len(t, codec.messages, 4)
+	for _, m := range codec.messages[1:] {
+		assert.Equal(t, codec.messages[0], m)
+	}
+}
+
+func TestReplyCache_OnlyCachesSayHello(t *testing.T) {
+	cache, err := greetworkload.NewReplyCache(10)
+	require.NoError(t, err)
+	faults, err := greetworkload.NewFaultInjector(nil, 1)
+	require.NoError(t, err)
+	addr := startCachedServer(t, cache, faults)
+
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for i := 0; i < 2; i++ {
+		var trailer metadata.MD
+		_, err := pb.NewGreeterClient(conn).SayHelloAgain(context.Background(), &pb.HelloRequest{Name: "pixie"}, grpc.Trailer(&trailer))
+		require.NoError(t, err)
+		assert.Empty(t, trailer.Get(greetworkload.CacheTrailer))
+	}
+	assert.Equal(t, greetworkload.ReplyCacheStats{}, cache.Stats())
+}
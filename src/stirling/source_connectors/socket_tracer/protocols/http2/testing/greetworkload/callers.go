@@ -0,0 +1,236 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CallerCounterOptions configure a CallerCounter.
+type CallerCounterOptions struct {
+	// Path, if set, is a file the counts are persisted to in the background and loaded from on
+	// creation, so that they survive server restarts. Counts from the last FlushInterval are lost
+	// if the process dies without calling Close.
+	Path string
+	// FlushInterval is how often changed counts are written to Path. Zero uses defaultFlushInterval.
+	FlushInterval time.Duration
+	// MaxNames bounds the number of names tracked. Once exceeded, the least recently seen name is
+	// evicted and its count starts over. Zero means unbounded.
+	MaxNames int
+}
+
+const defaultFlushInterval = time.Second
+
+// callerCount is the state kept for a single name. It is also the on-disk format.
+type callerCount struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+// CallerCounter counts the calls made by every name. It is safe for concurrent use.
+type CallerCounter struct {
+	opts *CallerCounterOptions
+
+	mu sync.Mutex
+	// lru holds *callerCount, most recently seen first.
+	lru   *list.List
+	names map[string]*list.Element
+	// dirty is set when the counts changed since they were last persisted.
+	dirty bool
+
+	// flushMu serializes writes to the backing file, which happen outside of mu.
+	flushMu   sync.Mutex
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewCallerCounter creates a CallerCounter, loading any counts previously persisted to opts.Path.
+// A nil opts keeps unbounded counts in memory only. With a Path, Close must be called to stop
+// persisting and flush the final counts.
+func NewCallerCounter(opts *CallerCounterOptions) (*CallerCounter, error) {
+	if opts == nil {
+		opts = &CallerCounterOptions{}
+	}
+	if opts.MaxNames < 0 {
+		return nil, errors.New("MaxNames must not be negative")
+	}
+	if opts.FlushInterval < 0 {
+		return nil, errors.New("FlushInterval must not be negative")
+	}
+	c := &CallerCounter{
+		opts:  opts,
+		lru:   list.New(),
+		names: make(map[string]*list.Element),
+		done:  make(chan struct{}),
+	}
+	if opts.Path == "" {
+		return c, nil
+	}
+
+	b, err := os.ReadFile(opts.Path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		var counts []callerCount
+		if err := json.Unmarshal(b, &counts); err != nil {
+			return nil, err
+		}
+		// The file lists names most recently seen first.
+		for i := range counts {
+			c.names[counts[i].Name] = c.lru.PushBack(&counts[i])
+		}
+		c.evict()
+	}
+
+	interval := opts.FlushInterval
+	if interval == 0 {
+		interval = defaultFlushInterval
+	}
+	c.wg.Add(1)
+	go c.flushLoop(interval)
+	return c, nil
+}
+
+// Increment records a call by name and returns the number of calls made by name so far,
+// including this one.
+func (c *CallerCounter) Increment(name string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.names[name]
+	if ok {
+		c.lru.MoveToFront(e)
+	} else {
+		e = c.lru.PushFront(&callerCount{Name: name})
+		c.names[name] = e
+	}
+	cc := e.Value.(*callerCount)
+	cc.Count++
+	c.evict()
+	c.dirty = true
+	return cc.Count
+}
+
+// Count returns the number of calls made by name, or 0 if name is not tracked.
+func (c *CallerCounter) Count(name string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.names[name]; ok {
+		return e.Value.(*callerCount).Count
+	}
+	return 0
+}
+
+// Len returns the number of names tracked.
+func (c *CallerCounter) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *CallerCounter) evict() {
+	for c.opts.MaxNames > 0 && c.lru.Len() > c.opts.MaxNames {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.names, e.Value.(*callerCount).Name)
+	}
+}
+
+func (c *CallerCounter) flushLoop(interval time.Duration) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.Flush(); err != nil {
+				log.Printf("Failed to persist callers, will retry: %v", err)
+			}
+		}
+	}
+}
+
+// Flush writes the counts to the backing file, if any and if they changed since the last flush.
+// The file is replaced atomically so that a server killed mid-write leaves the previous counts
+// behind. Calls are counted concurrently with the write; if it fails, the next flush retries.
+func (c *CallerCounter) Flush() error {
+	if c.opts.Path == "" {
+		return nil
+	}
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	counts := make([]callerCount, 0, c.lru.Len())
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		counts = append(counts, *e.Value.(*callerCount))
+	}
+	c.dirty = false
+	c.mu.Unlock()
+
+	if err := writeFileAtomic(c.opts.Path, counts); err != nil {
+		c.mu.Lock()
+		c.dirty = true
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Close stops persisting in the background and flushes the final counts.
+func (c *CallerCounter) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	c.wg.Wait()
+	return c.Flush()
+}
+
+func writeFileAtomic(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/status"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto/testutils"
+)
+
+func TestCallerCounter_ConcurrentIncrements(t *testing.T) {
+	c, err := greetworkload.NewCallerCounter(nil)
+	require.NoError(t, err)
+
+	const numGoroutines = 50
+	const callsPerName = 20
+	names := []string{"a", "b", "c"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < callsPerName; j++ {
+				for _, name := range names {
+					c.Increment(name)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, name := range names {
+		assert.Equal(t, int64(numGoroutines*callsPerName), c.Count(name), name)
+	}
+}
+
+func TestCallerCounter_UnknownNameStartsAtOne(t *testing.T) {
+	c, err := greetworkload.NewCallerCounter(nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(0), c.Count("pixie"))
+	assert.Equal(t, int64(1), c.Increment("pixie"))
+	assert.Equal(t, int64(2), c.Increment("pixie"))
+}
+
+func TestCallerCounter_EvictsLeastRecentlySeen(t *testing.T) {
+	c, err := greetworkload.NewCallerCounter(&greetworkload.CallerCounterOptions{MaxNames: 2})
+	require.NoError(t, err)
+
+	for _, name := range []string{"a", "b", "a", "c"} {
+		c.Increment(name)
+	}
+
+	// "b" was seen less recently than "a", so it is the one evicted when "c" arrives.
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, int64(2), c.Count("a"))
+	assert.Equal(t, int64(0), c.Count("b"))
+	assert.Equal(t, int64(1), c.Count("c"))
+
+	assert.Equal(t, int64(1), c.Increment("b"))
+}
+
+func TestCallerCounter_PersistsAcrossRestarts(t *testing.T) {
+	opts := &greetworkload.CallerCounterOptions{Path: filepath.Join(t.TempDir(), "callers.json"), MaxNames: 2}
+
+	c, err := greetworkload.NewCallerCounter(opts)
+	require.NoError(t, err)
+	for _, name := range []string{"a", "a", "b"} {
+		c.Increment(name)
+	}
+	require.NoError(t, c.Close())
+
+	restarted, err := greetworkload.NewCallerCounter(opts)
+	require.NoError(t, err)
+	defer restarted.Close()
+	assert.Equal(t, int64(2), restarted.Count("a"))
+	assert.Equal(t, int64(1), restarted.Count("b"))
+
+	// The recency order survives the restart too, so "a" is evicted first.
+	restarted.Increment("c")
+	assert.Equal(t, int64(0), restarted.Count("a"))
+	assert.Equal(t, int64(1), restarted.Count("b"))
+}
+
+func TestCallerCounter_FlushesInBackground(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "callers.json")
+	c, err := greetworkload.NewCallerCounter(&greetworkload.CallerCounterOptions{Path: path, FlushInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer c.Close()
+
+	c.Increment("pixie")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, err := os.ReadFile(path)
+		if err == nil && string(b) == `[{"name":"pixie","count":1}]` {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "counts were not flushed, last read %q, %v", b, err)
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCallerCounter_FailedFlushIsRetried(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "missing")
+	path := filepath.Join(dir, "callers.json")
+	// Flush only when asked to, so that the test controls when the write fails.
+	c, err := greetworkload.NewCallerCounter(&greetworkload.CallerCounterOptions{Path: path, FlushInterval: time.Hour})
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(1), c.Increment("pixie"))
+	assert.Error(t, c.Flush())
+	// A failed write does not lose or skip counts.
+	assert.Equal(t, int64(2), c.Increment("pixie"))
+
+	require.NoError(t, os.Mkdir(dir, 0777))
+	require.NoError(t, c.Close())
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"name":"pixie","count":2}]`, string(b))
+}
+
+func TestServer_SayHelloAgain(t *testing.T) {
+	calls, err := testutils.LoadFixture("testdata/say_hello_again.fixture")
+	require.NoError(t, err)
+
+	_, addr := startServer(t, &greetworkload.ServerOptions{ValidateRequests: true})
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i, call := range calls {
+		reply := &pb.HelloReply{}
+		err := conn.Invoke(ctx, call.Method, call.Request, reply)
+		if call.Err != nil {
+			want, got := status.Convert(call.Err), status.Convert(err)
+			assert.Equal(t, want.Code(), got.Code(), "call %d", i)
+			assert.Equal(t, want.Message(), got.Message(), "call %d", i)
+			continue
+		}
+		require.NoError(t, err, "call %d", i)
+		assert.Equal(t, call.Reply, reply, "call %d", i)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// CallOverrides describe a SayHello call, with options that override those of the Client for that
+// call only. Every field left at its zero value falls back to the ClientOptions, so that
+// CallOverrides with only a Name make the call the Client makes anyway:
+//
+//   - Timeout, if positive, replaces ClientOptions.Timeout.
+//   - Compressor, if set, replaces the compression of ClientOptions.Compression, "identity"
+//     sending the call uncompressed.
+//   - CancelAfter, if positive, cancels the call this long after it starts, in place of the
+//     cancellation ClientOptions.CancelFraction picks, which is still drawn so that the calls
+//     after it are cancelled as they would have been.
+//   - Metadata is sent on top of the metadata the Client sends anyway, after it, so that it cannot
+//     replace the RequestIDHeader of the call.
+//   - Payload, if not nil, is sent as the payload of the request, which is otherwise empty.
+type CallOverrides struct {
+	Name        string
+	Metadata    metadata.MD
+	Timeout     time.Duration
+	Compressor  string
+	CancelAfter time.Duration
+	Payload     []byte
+}
+
+// Do makes the SayHello call of o over conn, cancelled once ctx is done. Replies are not logged,
+// as there may be too many.
+func (c *Client) Do(ctx context.Context, conn *grpc.ClientConn, o *CallOverrides) *CallRecord {
+	return c.sayHelloPooled(c.opts.Audit.root(ctx), conn, o, 0)
+}
+
+// plan returns the cancelPlan of the call of o.
+func (o *CallOverrides) plan(c *Client) cancelPlan {
+	p := c.planCancel(0)
+	if o.CancelAfter > 0 {
+		p = cancelPlan{cancel: true, after: o.CancelAfter}
+	}
+	return p
+}
+
+// context returns the context of the call of o, cancelled once parent is done.
+func (o *CallOverrides) context(c *Client, parent context.Context) (context.Context, context.CancelFunc) {
+	if o.Timeout > 0 {
+		return c.withTimeout(parent, o.Timeout)
+	}
+	return c.callContextFrom(parent)
+}
+
+// outgoing adds the Metadata of o to ctx.
+func (o *CallOverrides) outgoing(ctx context.Context) context.Context {
+	if len(o.Metadata) == 0 {
+		return ctx
+	}
+	kv := make([]string, 0, 2*len(o.Metadata))
+	for k, vs := range o.Metadata {
+		for _, v := range vs {
+			kv = append(kv, k, v)
+		}
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+// callOptions returns the call options of o, on top of opts.
+func (o *CallOverrides) callOptions(opts ...grpc.CallOption) []grpc.CallOption {
+	if o.Compressor != "" {
+		opts = append(opts, grpc.UseCompressor(o.Compressor))
+	}
+	return opts
+}
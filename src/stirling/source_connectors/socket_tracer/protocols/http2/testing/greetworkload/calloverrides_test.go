@@ -0,0 +1,245 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// observedCall is what the server saw of a call.
+type observedCall struct {
+	name        string
+	payloadLen  int
+	md          metadata.MD
+	timeLeft    time.Duration
+	compression string
+}
+
+// callObserver records the calls a server handles by request ID, through its interceptor and its
+// stats handler, which sees the compression gRPC leaves out of the metadata.
+type callObserver struct {
+	mu    sync.Mutex
+	calls map[string]*observedCall
+}
+
+func (o *callObserver) call(md metadata.MD) *observedCall {
+	id := ""
+	if v := md.Get(greetworkload.RequestIDHeader); len(v) > 0 {
+		id = v[0]
+	}
+	if o.calls[id] == nil {
+		o.calls[id] = &observedCall{}
+	}
+	return o.calls[id]
+}
+
+func (o *callObserver) intercept(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	deadline, _ := ctx.Deadline()
+	o.mu.Lock()
+	call := o.call(md)
+	call.name = req.(*pb.HelloRequest).Name
+	call.payloadLen = len(req.(*pb.HelloRequest).Payload)
+	call.md = md
+	call.timeLeft = time.Until(deadline)
+	o.mu.Unlock()
+	return handler(ctx, req)
+}
+
+func (o *callObserver) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context { return ctx }
+func (o *callObserver) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+func (o *callObserver) HandleConn(context.Context, stats.ConnStats) {}
+
+func (o *callObserver) HandleRPC(_ context.Context, s stats.RPCStats) {
+	if h, ok := s.(*stats.InHeader); ok {
+		o.mu.Lock()
+		o.call(h.Header).compression = h.Compression
+		o.mu.Unlock()
+	}
+}
+
+func (o *callObserver) get(id string) *observedCall {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.calls[id]
+}
+
+func startCallObserver(t *testing.T) (*callObserver, string) {
+	o := &callObserver{calls: make(map[string]*observedCall)}
+	s := startServerWith(t, &serverSetup{GRPC: []grpc.ServerOption{grpc.UnaryInterceptor(o.intercept)}, Stats: o})
+	return o, s.Addr
+}
+
+func dialCallObserver(t *testing.T, addr string, opts *greetworkload.ClientOptions) (*greetworkload.Client, *grpc.ClientConn) {
+	c := greetworkload.NewClient(opts)
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return c, conn
+}
+
+func TestDo_OneOverriddenAmongMany(t *testing.T) {
+	o, addr := startCallObserver(t)
+	c, conn := dialCallObserver(t, addr, &greetworkload.ClientOptions{Timeout: 5 * time.Second})
+
+	const calls, special = 1000, 500
+	payload := bytes.Repeat([]byte{7}, 1024)
+	records := make([]*greetworkload.CallRecord, calls)
+	for i := range records {
+		call := &greetworkload.CallOverrides{Name: "pixie"}
+		if i == special {
+			call = &greetworkload.CallOverrides{
+				Name: "special",
+				// The request ID of the call is sent first, and still identifies it.
+				Metadata:   metadata.Pairs("x-special", "yes", greetworkload.RequestIDHeader, "forged"),
+				Timeout:    300 * time.Millisecond,
+				Compressor: gzip.Name,
+				Payload:    payload,
+			}
+		}
+		records[i] = c.Do(context.Background(), conn, call)
+		require.True(t, records[i].Completed(), records[i].Error)
+	}
+
+	for i, r := range records {
+		seen := o.get(r.RequestID)
+		require.NotNil(t, seen, "call #%d was not seen", i)
+		if i == special {
+			assert.Equal(t, []string{"special"}, r.Names)
+			assert.Equal(t, "special", seen.name)
+			assert.Equal(t, len(payload), seen.payloadLen)
+			assert.Equal(t, []string{"yes"}, seen.md.Get("x-special"))
+			assert.Equal(t, []string{r.RequestID, "forged"}, seen.md.Get(greetworkload.RequestIDHeader))
+			assert.Equal(t, gzip.Name, seen.compression)
+			assert.LessOrEqual(t, seen.timeLeft, 300*time.Millisecond)
+			continue
+		}
+		assert.Equal(t, "pixie", seen.name, "call #%d", i)
+		assert.Zero(t, seen.payloadLen, "call #%d", i)
+		assert.Empty(t, seen.md.Get("x-special"), "call #%d", i)
+		assert.Equal(t, []string{r.RequestID}, seen.md.Get(greetworkload.RequestIDHeader), "call #%d", i)
+		assert.Empty(t, seen.compression, "call #%d", i)
+		assert.Greater(t, seen.timeLeft, 4*time.Second, "call #%d", i)
+	}
+}
+
+func TestDo_OverridesClientOptions(t *testing.T) {
+	o, addr := startCallObserver(t)
+	c, conn := dialCallObserver(t, addr, &greetworkload.ClientOptions{Timeout: 5 * time.Second, Compression: true})
+
+	// Only a name falls back to the options of the client.
+	r := c.Do(context.Background(), conn, &greetworkload.CallOverrides{Name: "pixie"})
+	require.True(t, r.Completed(), r.Error)
+	assert.Equal(t, gzip.Name, o.get(r.RequestID).compression)
+	assert.Greater(t, o.get(r.RequestID).timeLeft, 4*time.Second)
+
+	r = c.Do(context.Background(), conn, &greetworkload.CallOverrides{Name: "pixie", Compressor: "identity", Timeout: time.Second})
+	require.True(t, r.Completed(), r.Error)
+	assert.Equal(t, "identity", o.get(r.RequestID).compression)
+	assert.LessOrEqual(t, o.get(r.RequestID).timeLeft, time.Second)
+}
+
+func TestDo_CancelAfter(t *testing.T) {
+	srv := startSlowServer(t, 500*time.Millisecond)
+	defer srv.s.Stop()
+	c, conn := dialCallObserver(t, srv.addr, &greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	r := c.Do(context.Background(), conn, &greetworkload.CallOverrides{Name: "pixie", CancelAfter: 20 * time.Millisecond})
+	assert.Equal(t, codes.Canceled.String(), r.Code, r.Error)
+	assert.True(t, r.Cancelled)
+	assert.True(t, r.CancelPlanned)
+	assert.EqualValues(t, 20*time.Millisecond, r.CancelAfterNS)
+	assert.Less(t, r.DurationNS, int64(400*time.Millisecond))
+}
+
+func TestDo_CancelAfterKeepsTheOtherPlans(t *testing.T) {
+	_, addr := startCallObserver(t)
+	plans := func(overridden int) []bool {
+		c, conn := dialCallObserver(t, addr, &greetworkload.ClientOptions{Timeout: 5 * time.Second, CancelFraction: 0.5, CancelWindow: time.Second, Seed: 1})
+		var planned []bool
+		for i := 0; i < 20; i++ {
+			call := &greetworkload.CallOverrides{Name: "pixie"}
+			if i == overridden {
+				call.CancelAfter = time.Nanosecond
+			}
+			planned = append(planned, c.Do(context.Background(), conn, call).CancelPlanned)
+		}
+		return planned
+	}
+	want := plans(-1)
+	got := plans(5)
+	assert.True(t, got[5])
+	want[5] = true
+	assert.Equal(t, want, got)
+}
+
+func TestRunAsync_Overrides(t *testing.T) {
+	o, addr := startCallObserver(t)
+	c, conn := dialCallObserver(t, addr, &greetworkload.ClientOptions{Timeout: 5 * time.Second})
+
+	var mu sync.Mutex
+	var indexes []int
+	records, stats, err := c.RunAsync(context.Background(), conn, "pixie", &greetworkload.AsyncOptions{
+		MaxInFlight: 4,
+		Duration:    200 * time.Millisecond,
+		Overrides: func(i int) *greetworkload.CallOverrides {
+			mu.Lock()
+			indexes = append(indexes, i)
+			mu.Unlock()
+			if i == 10 {
+				return &greetworkload.CallOverrides{Metadata: metadata.Pairs("x-special", "yes")}
+			}
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	require.Greater(t, stats.Started, int64(10))
+	require.Len(t, indexes, int(stats.Started))
+	for i, index := range indexes {
+		assert.Equal(t, i, index)
+	}
+
+	special := 0
+	for _, r := range records {
+		require.True(t, r.Completed(), r.Error)
+		seen := o.get(r.RequestID)
+		require.NotNil(t, seen)
+		// Overrides without a name greet the name of the run.
+		assert.Equal(t, "pixie", seen.name)
+		if len(seen.md.Get("x-special")) > 0 {
+			special++
+		}
+	}
+	assert.Equal(t, 1, special)
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload
+
+import (
+	"context"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// GreeterStatsService is the full name of the service that reports CallStats.
+const GreeterStatsService = pb.GreeterStats_ServiceName
+
+// numCodes is the number of gRPC status codes, OK through Unauthenticated.
+const numCodes = int(codes.Unauthenticated) + 1
+
+// CallStats counts the calls handled by a server by method and status code, and serves the
+// counts through the GreeterStats service. Calls to GreeterStats itself, and to the GreeterFeatures
+// and health services, are not counted.
+//
+// Counting only takes mu for reading, which calls share, so that it adds negligible overhead under
+// load.
+type CallStats struct {
+	// mu is held for reading while a call is counted, and for writing by the Snapshot that could
+	// not read the counters consistently without it.
+	mu sync.RWMutex
+	// counts maps a method to its *[numCodes]int64 counters.
+	counts sync.Map
+	// total is bumped after every counter, see Snapshot.
+	total int64
+}
+
+// NewCallStats creates a new CallStats.
+func NewCallStats() *CallStats {
+	return &CallStats{}
+}
+
+// isObservationMethod reports whether method belongs to the GreeterStats, GreeterFeatures, health or
+// channelz services, which report on a server rather than take part in its workload.
+func isObservationMethod(method string) bool {
+	return strings.HasPrefix(method, "/"+GreeterStatsService+"/") || strings.HasPrefix(method, "/"+GreeterFeaturesService+"/") ||
+		strings.HasPrefix(method, "/grpc.health.v1.Health/") || strings.HasPrefix(method, "/"+ChannelzService+"/")
+}
+
+func (s *CallStats) record(method string, err error) {
+	if isObservationMethod(method) {
+		return
+	}
+	code := status.Code(err)
+	if int(code) >= numCodes {
+		code = codes.Unknown
+	}
+	v, ok := s.counts.Load(method)
+	if !ok {
+		v, _ = s.counts.LoadOrStore(method, new([numCodes]int64))
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	atomic.AddInt64(&v.(*[numCodes]int64)[code], 1)
+	atomic.AddInt64(&s.total, 1)
+}
+
+// UnaryServerInterceptor counts unary calls. It should come first in the chain, so that it sees
+// the status of calls failed by other interceptors.
+func (s *CallStats) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		s.record(info.FullMethod, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor counts streaming calls. It should come first in the chain, so that it
+// sees the status of calls failed by other interceptors.
+func (s *CallStats) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		err := handler(srv, ss)
+		s.record(info.FullMethod, err)
+		return err
+	}
+}
+
+// maxSnapshotAttempts bounds the reads Snapshot makes without holding up the calls being counted,
+// so that it returns even when calls never stop finishing.
+const maxSnapshotAttempts = 100
+
+// Snapshot returns the non-zero counts, sorted by method then code.
+//
+// The counts are taken together: they are exactly those of the calls recorded before some point in
+// time, never a mix of older and newer counters. Every call bumps its own counter and then total,
+// so the counters are known to be consistent when they add up to total, and total did not change
+// while they were read. Otherwise the counters are read again, up to maxSnapshotAttempts times,
+// after which they are read once more with mu held, which briefly holds up the calls being counted.
+func (s *CallStats) Snapshot() []*pb.CallCount {
+	var counts []*pb.CallCount
+	for attempt := 1; ; attempt++ {
+		var consistent bool
+		if counts, consistent = s.read(); consistent {
+			break
+		}
+		if attempt == maxSnapshotAttempts {
+			s.mu.Lock()
+			counts, _ = s.read()
+			s.mu.Unlock()
+			break
+		}
+		// Calls finished while the counters were read; let them complete before trying again.
+		runtime.Gosched()
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Method != counts[j].Method {
+			return counts[i].Method < counts[j].Method
+		}
+		return counts[i].Code < counts[j].Code
+	})
+	return counts
+}
+
+// read reads every non-zero counter once, and reports whether they are consistent with total.
+func (s *CallStats) read() ([]*pb.CallCount, bool) {
+	before := atomic.LoadInt64(&s.total)
+	var sum int64
+	var counts []*pb.CallCount
+	s.counts.Range(func(k, v interface{}) bool {
+		for code := range v.(*[numCodes]int64) {
+			n := atomic.LoadInt64(&v.(*[numCodes]int64)[code])
+			if n == 0 {
+				continue
+			}
+			sum += n
+			counts = append(counts, &pb.CallCount{Method: k.(string), Code: codes.Code(code).String(), Count: n})
+		}
+		return true
+	})
+	return counts, sum == before && atomic.LoadInt64(&s.total) == before
+}
+
+// GetStats implements greetpb.GreeterStatsServer.
+func (s *CallStats) GetStats(context.Context, *pb.GetStatsRequest) (*pb.GetStatsReply, error) {
+	return &pb.GetStatsReply{Counts: s.Snapshot()}, nil
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+func TestCallStats_GetStats(t *testing.T) {
+	stats := greetworkload.NewCallStats()
+	s := startServerWith(t, &serverSetup{
+		Options: &greetworkload.ServerOptions{ValidateRequests: true},
+		GRPC: []grpc.ServerOption{
+			grpc.ChainUnaryInterceptor(stats.UnaryServerInterceptor()),
+			grpc.ChainStreamInterceptor(stats.StreamServerInterceptor()),
+		},
+		Register: func(s *grpc.Server, greeter *greetworkload.Server) {
+			registerGreeter(s, greeter)
+			pb.RegisterGreeterStatsServer(s, stats)
+		},
+	})
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	const numGoroutines = 100
+	const callsPerGoroutine = 20
+	var wg sync.WaitGroup
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < callsPerGoroutine; j++ {
+				assert.True(t, c.SayHello(conn, "pixie").Completed())
+			}
+		}()
+	}
+	wg.Wait()
+	// An empty name is rejected by validation.
+	assert.False(t, c.SayHello(conn, "").Completed())
+	assert.True(t, c.ServerStreaming(conn, "pixie").Completed())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply, err := pb.NewGreeterStatsClient(conn).GetStats(ctx, &pb.GetStatsRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, []*pb.CallCount{
+		{Method: "/px.stirling.protocols.http2.testing.Greeter/SayHello", Code: "InvalidArgument", Count: 1},
+		{Method: "/px.stirling.protocols.http2.testing.Greeter/SayHello", Code: "OK", Count: numGoroutines * callsPerGoroutine},
+		{Method: "/px.stirling.protocols.http2.testing.StreamingGreeter/SayHelloServerStreaming", Code: "OK", Count: 1},
+	}, reply.Counts)
+}
+
+func TestCallStats_SnapshotIsConsistent(t *testing.T) {
+	stats := greetworkload.NewCallStats()
+	intercept := stats.UnaryServerInterceptor()
+	ok := func(context.Context, interface{}) (interface{}, error) { return nil, nil }
+	call := func(method string) {
+		_, _ = intercept(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: method}, ok)
+	}
+
+	// Every writer calls the methods in order, so in counts taken together no method has more
+	// calls than the one before it, and the first has at most one more call per writer than the last.
+	const numWriters = 8
+	methods := make([]string, 10)
+	for i := range methods {
+		methods[i] = fmt.Sprintf("/M%d", i)
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < numWriters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, m := range methods {
+					call(m)
+				}
+			}
+		}()
+	}
+
+	last := make(map[string]int64)
+	for i := 0; i < 1000; i++ {
+		counts := make(map[string]int64)
+		for _, c := range stats.Snapshot() {
+			counts[c.Method] = c.Count
+		}
+		for j := 1; j < len(methods); j++ {
+			require.LessOrEqual(t, counts[methods[j]], counts[methods[j-1]])
+		}
+		require.LessOrEqual(t, counts[methods[0]]-counts[methods[len(methods)-1]], int64(numWriters))
+		for _, m := range methods {
+			require.GreaterOrEqual(t, counts[m], last[m])
+		}
+		last = counts
+	}
+	close(done)
+	wg.Wait()
+}
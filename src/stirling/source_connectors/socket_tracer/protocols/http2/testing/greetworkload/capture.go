@@ -0,0 +1,273 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	// defaultCaptureInterface is the interface the workload runs over.
+	defaultCaptureInterface = "lo"
+	// captureSnapLen is large enough for any frame on the loopback interface, whose MTU is 64KB.
+	captureSnapLen = 1<<16 + 64
+	// capturePollInterval bounds how long a capture takes to notice it is stopped.
+	capturePollInterval = 100 * time.Millisecond
+)
+
+// errCaptureTimeout is returned by packetSource.readPacket when no frame arrived in time.
+var errCaptureTimeout = errors.New("no packet arrived in time")
+
+// packetSource reads the Ethernet frames seen on a network interface.
+type packetSource interface {
+	// readPacket reads the next frame into b, and returns the length read and the length the frame
+	// had on the wire. It waits for up to capturePollInterval, then returns errCaptureTimeout.
+	readPacket(b []byte) (n, wireLen int, err error)
+	close() error
+}
+
+// packetCapture writes the TCP segments to or from a port, seen on a network interface, to a
+// pcapng file.
+type packetCapture struct {
+	src  packetSource
+	port uint16
+	file *os.File
+	w    *pcapngWriter
+
+	stop chan struct{}
+	// done is closed once the capture stopped, and err is set.
+	done chan struct{}
+	err  error
+}
+
+// startPacketCapture captures the TCP segments to or from port seen on iface into a new pcapng file
+// at path, whose section header carries comment. It needs CAP_NET_RAW, and is only supported on
+// Linux.
+func startPacketCapture(iface string, port int, path, comment string) (*packetCapture, error) {
+	src, err := openPacketSource(iface)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		src.close()
+		return nil, err
+	}
+	w := newPcapngWriter(f)
+	if err := w.writeHeader(comment, iface); err != nil {
+		src.close()
+		f.Close()
+		return nil, err
+	}
+	c := &packetCapture{
+		src:  src,
+		port: uint16(port),
+		file: f,
+		w:    w,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go c.run()
+	return c, nil
+}
+
+func (c *packetCapture) run() {
+	defer close(c.done)
+	buf := make([]byte, captureSnapLen)
+	for {
+		select {
+		case <-c.stop:
+			c.err = c.w.flush()
+			return
+		default:
+		}
+		n, wireLen, err := c.src.readPacket(buf)
+		if err == errCaptureTimeout {
+			continue
+		}
+		if err != nil {
+			c.err = err
+			return
+		}
+		if !matchTCPPort(buf[:n], c.port) {
+			continue
+		}
+		if err := c.w.writePacket(time.Now(), buf[:n], wireLen); err != nil {
+			c.err = err
+			return
+		}
+	}
+}
+
+// Stop stops the capture, once the segments already seen are written, and closes the file.
+func (c *packetCapture) Stop() error {
+	close(c.stop)
+	<-c.done
+	err := c.err
+	if closeErr := c.src.close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// matchTCPPort returns true if frame is an Ethernet frame that carries a TCP segment, over IPv4 or
+// IPv6 without extension headers, to or from port.
+func matchTCPPort(frame []byte, port uint16) bool {
+	const ethHeaderLen = 14
+	if len(frame) < ethHeaderLen {
+		return false
+	}
+	ip := frame[ethHeaderLen:]
+	var tcp []byte
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case 0x0800:
+		if len(ip) < 20 || ip[9] != 6 {
+			return false
+		}
+		// Only the first fragment carries the TCP header.
+		if binary.BigEndian.Uint16(ip[6:8])&0x1fff != 0 {
+			return false
+		}
+		headerLen := int(ip[0]&0x0f) * 4
+		if len(ip) < headerLen {
+			return false
+		}
+		tcp = ip[headerLen:]
+	case 0x86dd:
+		if len(ip) < 40 || ip[6] != 6 {
+			return false
+		}
+		tcp = ip[40:]
+	default:
+		return false
+	}
+	if len(tcp) < 4 {
+		return false
+	}
+	return binary.BigEndian.Uint16(tcp[0:2]) == port || binary.BigEndian.Uint16(tcp[2:4]) == port
+}
+
+// The pcapng blocks and options written by pcapngWriter. See
+// https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-05.html.
+const (
+	pcapngSectionHeader     = 0x0a0d0d0a
+	pcapngInterfaceDesc     = 0x00000001
+	pcapngEnhancedPacket    = 0x00000006
+	pcapngByteOrderMagic    = 0x1a2b3c4d
+	pcapngOptEnd            = 0
+	pcapngOptComment        = 1
+	pcapngOptIfName         = 2
+	pcapngLinkTypeEthernet  = 1
+	pcapngUnknownSectionLen = ^uint64(0)
+)
+
+// pcapngWriter writes a single section pcapng file, with a single Ethernet interface whose
+// timestamps are in microseconds.
+type pcapngWriter struct {
+	w *bufio.Writer
+}
+
+func newPcapngWriter(w io.Writer) *pcapngWriter {
+	return &pcapngWriter{w: bufio.NewWriter(w)}
+}
+
+// pad4 returns the padding that aligns n bytes to 32 bits.
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
+
+// appendUint16, appendUint32 and appendUint64 append v to b in little endian, as the
+// binary.LittleEndian methods of Go 1.19 do.
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v)), uint32(v>>32))
+}
+
+// appendOption appends a pcapng option to b.
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = appendUint16(b, code)
+	b = appendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, pad4(len(value)))...)
+}
+
+// writeBlock writes a block of type blockType with body, which must be aligned to 32 bits.
+func (p *pcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	total := uint32(12 + len(body))
+	b := appendUint32(nil, blockType)
+	b = appendUint32(b, total)
+	b = append(b, body...)
+	b = appendUint32(b, total)
+	_, err := p.w.Write(b)
+	return err
+}
+
+// writeHeader writes the section header block, with comment, and the interface description block
+// of iface.
+func (p *pcapngWriter) writeHeader(comment, iface string) error {
+	shb := appendUint32(nil, pcapngByteOrderMagic)
+	shb = appendUint16(shb, 1)
+	shb = appendUint16(shb, 0)
+	shb = appendUint64(shb, pcapngUnknownSectionLen)
+	if comment != "" {
+		shb = appendOption(shb, pcapngOptComment, []byte(comment))
+	}
+	shb = appendOption(shb, pcapngOptEnd, nil)
+	if err := p.writeBlock(pcapngSectionHeader, shb); err != nil {
+		return err
+	}
+
+	idb := appendUint16(nil, pcapngLinkTypeEthernet)
+	idb = appendUint16(idb, 0)
+	idb = appendUint32(idb, captureSnapLen)
+	idb = appendOption(idb, pcapngOptIfName, []byte(iface))
+	idb = appendOption(idb, pcapngOptEnd, nil)
+	return p.writeBlock(pcapngInterfaceDesc, idb)
+}
+
+// writePacket writes an enhanced packet block with frame, seen at t, which was wireLen bytes long.
+func (p *pcapngWriter) writePacket(t time.Time, frame []byte, wireLen int) error {
+	us := uint64(t.UnixNano() / int64(time.Microsecond))
+	epb := appendUint32(nil, 0)
+	epb = appendUint32(epb, uint32(us>>32))
+	epb = appendUint32(epb, uint32(us))
+	epb = appendUint32(epb, uint32(len(frame)))
+	epb = appendUint32(epb, uint32(wireLen))
+	epb = append(epb, frame...)
+	epb = append(epb, make([]byte, pad4(len(frame)))...)
+	return p.writeBlock(pcapngEnhancedPacket, epb)
+}
+
+func (p *pcapngWriter) flush() error {
+	return p.w.Flush()
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+const packetCaptureSupported = true
+
+// afPacketSource reads frames from an AF_PACKET socket bound to an interface.
+type afPacketSource struct {
+	fd int
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+func openPacketSource(iface string) (packetSource, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open a packet socket, which needs CAP_NET_RAW: %w", err)
+	}
+	tv := unix.NsecToTimeval(capturePollInterval.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	// Bursts of calls must not overflow the socket before the frames are written out.
+	_ = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, 8<<20)
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: ifi.Index}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &afPacketSource{fd: fd}, nil
+}
+
+func (s *afPacketSource) readPacket(b []byte) (int, int, error) {
+	for {
+		// MSG_TRUNC returns the length of the frame on the wire, even if b is shorter.
+		n, from, err := unix.Recvfrom(s.fd, b, unix.MSG_TRUNC)
+		switch {
+		case errors.Is(err, unix.EAGAIN), errors.Is(err, unix.EINTR):
+			return 0, 0, errCaptureTimeout
+		case err != nil:
+			return 0, 0, err
+		}
+		// Frames sent over the loopback interface are seen once sent and once received.
+		if ll, ok := from.(*unix.SockaddrLinklayer); ok && ll.Pkttype == unix.PACKET_OUTGOING {
+			continue
+		}
+		if n > len(b) {
+			return len(b), n, nil
+		}
+		return n, n, nil
+	}
+}
+
+func (s *afPacketSource) close() error {
+	return unix.Close(s.fd)
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// pcapng is what the tests check of a pcapng file.
+type pcapng struct {
+	comments []string
+	frames   [][]byte
+}
+
+// readPcapng reads a little-endian pcapng file with a single section.
+func readPcapng(t *testing.T, path string) *pcapng {
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	p := &pcapng{}
+	for len(b) > 0 {
+		require.GreaterOrEqual(t, len(b), 12)
+		blockType := binary.LittleEndian.Uint32(b)
+		total := int(binary.LittleEndian.Uint32(b[4:]))
+		require.LessOrEqual(t, total, len(b))
+		require.Equal(t, uint32(total), binary.LittleEndian.Uint32(b[total-4:]))
+		body := b[8 : total-4]
+		switch blockType {
+		case 0x0a0d0d0a:
+			require.Equal(t, uint32(0x1a2b3c4d), binary.LittleEndian.Uint32(body))
+			for opts := body[16:]; len(opts) >= 4; {
+				code := binary.LittleEndian.Uint16(opts)
+				n := int(binary.LittleEndian.Uint16(opts[2:]))
+				if code == 1 {
+					p.comments = append(p.comments, string(opts[4:4+n]))
+				}
+				opts = opts[4+n+(4-n%4)%4:]
+			}
+		case 6:
+			n := binary.LittleEndian.Uint32(body[12:])
+			p.frames = append(p.frames, body[20:20+n])
+		}
+		b = b[total:]
+	}
+	return p
+}
+
+// tcpStreams returns the TCP connections accepted on port, by the address of their client, from the
+// SYN-ACKs of the frames.
+func tcpStreams(frames [][]byte, port uint16) map[string]bool {
+	streams := make(map[string]bool)
+	for _, f := range frames {
+		var dst net.IP
+		var tcp []byte
+		switch binary.BigEndian.Uint16(f[12:14]) {
+		case 0x0800:
+			ip := f[14:]
+			dst = ip[16:20]
+			tcp = ip[int(ip[0]&0x0f)*4:]
+		case 0x86dd:
+			ip := f[14:]
+			dst = ip[24:40]
+			tcp = ip[40:]
+		default:
+			continue
+		}
+		const syn, ack = 0x02, 0x10
+		if binary.BigEndian.Uint16(tcp[0:2]) == port && tcp[13]&(syn|ack) == syn|ack {
+			streams[net.JoinHostPort(dst.String(), strconv.Itoa(int(binary.BigEndian.Uint16(tcp[2:4]))))] = true
+		}
+	}
+	return streams
+}
+
+func TestOrchestrate_Capture(t *testing.T) {
+	cfg := &greetworkload.OrchestratorConfig{
+		Server:            helperSpec("server", "server"),
+		Clients:           []greetworkload.ProcessSpec{helperSpec("a", "client"), helperSpec("b", "client")},
+		WorkDir:           t.TempDir(),
+		StopTimeoutMillis: 5000,
+		Capture:           true,
+	}
+	results, err := greetworkload.Orchestrate(context.Background(), cfg)
+	require.NoError(t, err)
+	if results.Capture == "" {
+		t.Skipf("packet capture is not available: %v", results.Warnings)
+	}
+	assert.Empty(t, results.Warnings)
+
+	p := readPcapng(t, results.Capture)
+	require.Len(t, p.comments, 1)
+	assert.Contains(t, p.comments[0], "server: -test.run=^TestOrchestratorHelper$ -- --port=0")
+	for _, c := range results.Clients {
+		assert.Contains(t, p.comments[0], fmt.Sprintf("\n%s: -test.run=^TestOrchestratorHelper$ -- -address=localhost:", c.Name))
+	}
+
+	require.Len(t, results.Clients[0].Conns, 1)
+	_, port, err := net.SplitHostPort(results.Clients[0].Conns[0].RemoteAddr)
+	require.NoError(t, err)
+	serverPort, err := strconv.Atoi(port)
+	require.NoError(t, err)
+	// Every client connects once, and so does the orchestrator to check the server's health.
+	streams := tcpStreams(p.frames, uint16(serverPort))
+	assert.Len(t, streams, 3)
+	for _, c := range results.Clients {
+		assert.True(t, streams[c.Conns[0].LocalAddr], "%s is not in %v", c.Conns[0].LocalAddr, streams)
+	}
+}
+
+func TestOrchestrate_CaptureFailureWarns(t *testing.T) {
+	cfg := &greetworkload.OrchestratorConfig{
+		Server:            helperSpec("server", "server"),
+		Clients:           []greetworkload.ProcessSpec{helperSpec("a", "client")},
+		WorkDir:           t.TempDir(),
+		StopTimeoutMillis: 5000,
+		Capture:           true,
+		// Fails like a missing CAP_NET_RAW would, when the packet socket is set up.
+		CaptureInterface: "nonexistent0",
+	}
+	results, err := greetworkload.Orchestrate(context.Background(), cfg)
+	require.NoError(t, err)
+	assert.Empty(t, results.Capture)
+	require.Len(t, results.Warnings, 1)
+	assert.Contains(t, results.Warnings[0], "packet capture on nonexistent0 failed to start")
+	require.Len(t, results.Clients, 1)
+	assert.Len(t, results.Clients[0].Records, 3)
+}
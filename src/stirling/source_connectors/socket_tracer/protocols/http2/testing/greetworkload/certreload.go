@@ -0,0 +1,208 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CertSerial returns the serial number of cert in hex, as it is counted by SerialCounter.
+func CertSerial(cert *x509.Certificate) string {
+	return cert.SerialNumber.Text(16)
+}
+
+// SerialCounter counts TLS handshakes by the serial number of a certificate.
+type SerialCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+// NewSerialCounter creates a new SerialCounter.
+func NewSerialCounter() *SerialCounter {
+	return &SerialCounter{counts: make(map[string]int64)}
+}
+
+func (c *SerialCounter) add(cert *x509.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[CertSerial(cert)]++
+}
+
+// VerifyConnection counts the handshakes by the serial of the certificate the peer presented, if
+// any. It is meant for tls.Config.VerifyConnection, and never fails a handshake.
+func (c *SerialCounter) VerifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) > 0 {
+		c.add(cs.PeerCertificates[0])
+	}
+	return nil
+}
+
+// Counts returns a copy of the number of handshakes by certificate serial.
+func (c *SerialCounter) Counts() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]int64, len(c.counts))
+	for serial, n := range c.counts {
+		counts[serial] = n
+	}
+	return counts
+}
+
+// FormatSerialCounts formats counts as "serial=n" pairs sorted by serial, e.g. "1a=3, 1b=2".
+func FormatSerialCounts(counts map[string]int64) string {
+	serials := make([]string, 0, len(counts))
+	for serial := range counts {
+		serials = append(serials, serial)
+	}
+	sort.Strings(serials)
+	pairs := make([]string, len(serials))
+	for i, serial := range serials {
+		pairs[i] = fmt.Sprintf("%s=%d", serial, counts[serial])
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// fileVersion identifies the content of a file by its modification time and size.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func statVersion(path string) (fileVersion, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	return fileVersion{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// CertReloader presents the certificate and key pair of a pair of files in TLS handshakes, and
+// re-reads them whenever either changes on disk, so that replacing them rotates the identity of
+// the connections set up from then on. Connections already set up keep theirs.
+//
+// The files are checked at every handshake, by modification time and size. A pair that fails to
+// load, such as a certificate replaced before its key, is retried at the next handshake, and the
+// previous pair is presented until then.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	certVer  fileVersion
+	keyVer   fileVersion
+	reloads  int64
+	presents *SerialCounter
+}
+
+// NewCertReloader creates a CertReloader of the pair of files, which must load.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile, presents: NewSerialCounter()}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the pair of files if either changed since it was last loaded. r.mu must be held,
+// unless r is being created.
+func (r *CertReloader) reload() error {
+	certVer, err := statVersion(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyVer, err := statVersion(r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && certVer == r.certVer && keyVer == r.keyVer {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	if r.cert != nil {
+		r.reloads++
+	}
+	r.cert, r.certVer, r.keyVer = &cert, certVer, keyVer
+	return nil
+}
+
+// present returns the pair to present in a handshake.
+func (r *CertReloader) present() *tls.Certificate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// The previous pair is kept if the files cannot be loaded right now.
+	_ = r.reload()
+	r.presents.add(r.cert.Leaf)
+	return r.cert
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.present(), nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.present(), nil
+}
+
+// Serial returns the serial of the certificate presented now, as of the last handshake.
+func (r *CertReloader) Serial() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return CertSerial(r.cert.Leaf)
+}
+
+// Reloads returns how many times the pair was replaced after it was first loaded.
+func (r *CertReloader) Reloads() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reloads
+}
+
+// Handshakes returns the number of handshakes the pair was presented in, by certificate serial.
+func (r *CertReloader) Handshakes() map[string]int64 {
+	return r.presents.Counts()
+}
+
+// LoadCertPool reads the PEM certificates of a file into a new pool, such as the CAs client
+// certificates are verified against.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s: no PEM certificates", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,248 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// testCA issues client certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "greet test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM certificate and key of a new client certificate with the given serial.
+func (ca *testCA) issue(t *testing.T, serial int64) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: fmt.Sprintf("greet client %d", serial)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFile writes b to path, dated later than its previous content, as coarse file system
+// timestamps could otherwise hide the change.
+func writeFile(t *testing.T, path string, b []byte, version int) {
+	require.NoError(t, os.WriteFile(path, b, 0o600))
+	date := time.Now().Add(time.Duration(version) * time.Second)
+	require.NoError(t, os.Chtimes(path, date, date))
+}
+
+// writeCert writes a new client certificate with the given serial to the cert and key files.
+func (ca *testCA) writeCert(t *testing.T, certFile, keyFile string, serial int64) {
+	certPEM, keyPEM := ca.issue(t, serial)
+	writeFile(t, certFile, certPEM, int(serial))
+	writeFile(t, keyFile, keyPEM, int(serial))
+}
+
+func TestCertReloader_ReloadsOnChange(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	ca.writeCert(t, certFile, keyFile, 0x1a)
+
+	r, err := greetworkload.NewCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, "1a", r.Serial())
+	for i := 0; i < 2; i++ {
+		cert, err := r.GetClientCertificate(nil)
+		require.NoError(t, err)
+		assert.Equal(t, "1a", greetworkload.CertSerial(cert.Leaf))
+	}
+
+	ca.writeCert(t, certFile, keyFile, 0x1b)
+	cert, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "1b", greetworkload.CertSerial(cert.Leaf))
+	assert.Equal(t, int64(1), r.Reloads())
+	assert.Equal(t, map[string]int64{"1a": 2, "1b": 1}, r.Handshakes())
+}
+
+func TestCertReloader_KeepsPairUntilItLoads(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	ca.writeCert(t, certFile, keyFile, 1)
+	r, err := greetworkload.NewCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+
+	// The certificate is replaced before its key.
+	certPEM, keyPEM := ca.issue(t, 2)
+	writeFile(t, certFile, certPEM, 2)
+	cert, err := r.GetClientCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "1", greetworkload.CertSerial(cert.Leaf))
+
+	writeFile(t, keyFile, keyPEM, 2)
+	cert, err = r.GetClientCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "2", greetworkload.CertSerial(cert.Leaf))
+	assert.Equal(t, int64(1), r.Reloads())
+}
+
+func TestNewCertReloader_Errors(t *testing.T) {
+	dir := t.TempDir()
+	_, err := greetworkload.NewCertReloader(filepath.Join(dir, "missing.crt"), filepath.Join(dir, "missing.key"))
+	assert.Error(t, err)
+
+	certFile := filepath.Join(dir, "bad.crt")
+	require.NoError(t, os.WriteFile(certFile, []byte("not a certificate"), 0o600))
+	_, err = greetworkload.NewCertReloader(certFile, certFile)
+	assert.Error(t, err)
+
+	_, err = greetworkload.LoadCertPool(certFile)
+	assert.Error(t, err)
+}
+
+func TestFormatSerialCounts(t *testing.T) {
+	assert.Equal(t, "", greetworkload.FormatSerialCounts(nil))
+	assert.Equal(t, "1a=3, 1b=2", greetworkload.FormatSerialCounts(map[string]int64{"1b": 2, "1a": 3}))
+}
+
+// TestClient_RotatesClientCert rotates the client certificate while a stream is in flight: new
+// connections present the new certificate, while the stream carries on over its connection.
+func TestClient_RotatesClientCert(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(caFile, ca.pem, 0o600))
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	ca.writeCert(t, certFile, keyFile, 0xa1)
+
+	clientCAs, err := greetworkload.LoadCertPool(caFile)
+	require.NoError(t, err)
+	clientSerials := greetworkload.NewSerialCounter()
+	cfg := &tls.Config{
+		Certificates:     []tls.Certificate{selfSignedCert(t)},
+		ClientAuth:       tls.RequireAndVerifyClientCert,
+		ClientCAs:        clientCAs,
+		VerifyConnection: clientSerials.VerifyConnection,
+	}
+	streaming := make(chan struct{})
+	release := make(chan struct{})
+	serverStats := greetworkload.NewConnStatsHandler()
+	addr := startServerWith(t, &serverSetup{
+		Options: &greetworkload.ServerOptions{
+			// Holds the stream after its first reply until the certificate is rotated.
+			OnStreamSend: func(index int, _ time.Time) {
+				if index == 0 {
+					close(streaming)
+					<-release
+				}
+			},
+		},
+		GRPC:  []grpc.ServerOption{grpc.Creds(credentials.NewTLS(cfg))},
+		Stats: serverStats,
+	}).Addr
+
+	clientCert, err := greetworkload.NewCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{
+		HTTPS:       true,
+		ClientCert:  clientCert,
+		Timeout:     10 * time.Second,
+		StreamCount: 3,
+	})
+	// callOnNewConn makes a call over a connection of its own.
+	callOnNewConn := func(name string) *greetworkload.CallRecord {
+		conn, err := c.Dial(addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		return c.SayHello(conn, name)
+	}
+
+	var records []*greetworkload.CallRecord
+	records = append(records, callOnNewConn("before"))
+	streamConn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer streamConn.Close()
+	streamDone := make(chan *greetworkload.CallRecord)
+	go func() { streamDone <- c.ServerStreaming(streamConn, "in flight") }()
+	<-streaming
+
+	ca.writeCert(t, certFile, keyFile, 0xb2)
+	for i := 0; i < 3; i++ {
+		records = append(records, callOnNewConn(fmt.Sprintf("after #%d", i)))
+	}
+	close(release)
+	records = append(records, <-streamDone)
+	// The connection of the stream keeps the certificate it was set up with.
+	records = append(records, c.SayHello(streamConn, "after, over the stream's connection"))
+
+	for _, r := range records {
+		assert.True(t, r.Completed(), "%s: %s", r.Method, r.Error)
+	}
+	assert.Equal(t, int64(1), clientCert.Reloads())
+	assert.Equal(t, map[string]int64{"a1": 2, "b2": 3}, clientCert.Handshakes())
+	assert.Equal(t, map[string]int64{"a1": 2, "b2": 3}, clientSerials.Counts())
+	serials := map[string]int{}
+	for _, conn := range serverStats.Conns() {
+		serials[conn.PeerCertSerial]++
+	}
+	assert.Equal(t, map[string]int{"a1": 2, "b2": 3}, serials)
+}
@@ -0,0 +1,340 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	channelzpb "google.golang.org/grpc/channelz/grpc_channelz_v1"
+	"google.golang.org/grpc/channelz/service"
+)
+
+// ChannelzService is the full name of the gRPC channelz service.
+const ChannelzService = "grpc.channelz.v1.Channelz"
+
+// ChannelzSnapshot is what gRPC channelz reports of the channels and servers of a process at a
+// point in time, with the sockets under them.
+type ChannelzSnapshot struct {
+	Time     time.Time         `json:"time"`
+	Channels []ChannelzChannel `json:"channels"`
+	Servers  []ChannelzServer  `json:"servers"`
+}
+
+// ChannelzChannel is a channel, such as a grpc.ClientConn, or one of its subchannels.
+type ChannelzChannel struct {
+	ID             int64  `json:"id"`
+	Target         string `json:"target,omitempty"`
+	State          string `json:"state"`
+	CallsStarted   int64  `json:"calls_started"`
+	CallsSucceeded int64  `json:"calls_succeeded"`
+	CallsFailed    int64  `json:"calls_failed"`
+	// Subchannels are those of a top channel. Subchannels hold the sockets.
+	Subchannels []ChannelzChannel `json:"subchannels,omitempty"`
+	Sockets     []ChannelzSocket  `json:"sockets,omitempty"`
+}
+
+// ChannelzServer is a grpc.Server, with the sockets it accepted.
+type ChannelzServer struct {
+	ID             int64            `json:"id"`
+	CallsStarted   int64            `json:"calls_started"`
+	CallsSucceeded int64            `json:"calls_succeeded"`
+	CallsFailed    int64            `json:"calls_failed"`
+	Sockets        []ChannelzSocket `json:"sockets,omitempty"`
+}
+
+// ChannelzSocket is a connection. Channelz counts streams and messages, but not bytes, which only
+// ConnStats has.
+type ChannelzSocket struct {
+	ID int64 `json:"id"`
+	// LocalAddr and RemoteAddr are rendered by CanonicalAddr, as in ConnStats.
+	LocalAddr        string `json:"local_addr"`
+	RemoteAddr       string `json:"remote_addr"`
+	StreamsStarted   int64  `json:"streams_started"`
+	StreamsSucceeded int64  `json:"streams_succeeded"`
+	StreamsFailed    int64  `json:"streams_failed"`
+	MessagesSent     int64  `json:"messages_sent"`
+	MessagesReceived int64  `json:"messages_received"`
+	KeepAlivesSent   int64  `json:"keepalives_sent"`
+	// LocalFlowControlWindow and RemoteFlowControlWindow are the HTTP/2 connection windows, if
+	// known.
+	LocalFlowControlWindow  *int64 `json:"local_flow_control_window,omitempty"`
+	RemoteFlowControlWindow *int64 `json:"remote_flow_control_window,omitempty"`
+}
+
+// Sockets returns every socket in the snapshot, those of channels first.
+func (s *ChannelzSnapshot) Sockets() []ChannelzSocket {
+	var sockets []ChannelzSocket
+	var add func(channels []ChannelzChannel)
+	add = func(channels []ChannelzChannel) {
+		for _, c := range channels {
+			sockets = append(sockets, c.Sockets...)
+			add(c.Subchannels)
+		}
+	}
+	add(s.Channels)
+	for _, srv := range s.Servers {
+		sockets = append(sockets, srv.Sockets...)
+	}
+	return sockets
+}
+
+// channelzAPI is the part of the channelz service a snapshot is taken with.
+type channelzAPI interface {
+	GetTopChannels(context.Context, *channelzpb.GetTopChannelsRequest) (*channelzpb.GetTopChannelsResponse, error)
+	GetServers(context.Context, *channelzpb.GetServersRequest) (*channelzpb.GetServersResponse, error)
+	GetServerSockets(context.Context, *channelzpb.GetServerSocketsRequest) (*channelzpb.GetServerSocketsResponse, error)
+	GetSubchannel(context.Context, *channelzpb.GetSubchannelRequest) (*channelzpb.GetSubchannelResponse, error)
+	GetSocket(context.Context, *channelzpb.GetSocketRequest) (*channelzpb.GetSocketResponse, error)
+}
+
+// remoteChannelz calls the channelz service of another process.
+type remoteChannelz struct {
+	c channelzpb.ChannelzClient
+}
+
+func (r remoteChannelz) GetTopChannels(ctx context.Context, in *channelzpb.GetTopChannelsRequest) (*channelzpb.GetTopChannelsResponse, error) {
+	return r.c.GetTopChannels(ctx, in)
+}
+
+func (r remoteChannelz) GetServers(ctx context.Context, in *channelzpb.GetServersRequest) (*channelzpb.GetServersResponse, error) {
+	return r.c.GetServers(ctx, in)
+}
+
+func (r remoteChannelz) GetServerSockets(ctx context.Context, in *channelzpb.GetServerSocketsRequest) (*channelzpb.GetServerSocketsResponse, error) {
+	return r.c.GetServerSockets(ctx, in)
+}
+
+func (r remoteChannelz) GetSubchannel(ctx context.Context, in *channelzpb.GetSubchannelRequest) (*channelzpb.GetSubchannelResponse, error) {
+	return r.c.GetSubchannel(ctx, in)
+}
+
+func (r remoteChannelz) GetSocket(ctx context.Context, in *channelzpb.GetSocketRequest) (*channelzpb.GetSocketResponse, error) {
+	return r.c.GetSocket(ctx, in)
+}
+
+// channelzRegistrar keeps the implementation of the service registered with it.
+type channelzRegistrar struct {
+	impl interface{}
+}
+
+func (r *channelzRegistrar) RegisterService(_ *grpc.ServiceDesc, impl interface{}) {
+	r.impl = impl
+}
+
+// FetchChannelz takes a snapshot of the channelz service served over conn.
+func FetchChannelz(ctx context.Context, conn *grpc.ClientConn) (*ChannelzSnapshot, error) {
+	return snapshotChannelz(ctx, remoteChannelz{channelzpb.NewChannelzClient(conn)})
+}
+
+// LocalChannelz takes a snapshot of the channels and servers of this process, which channelz
+// tracks once this package is linked in. It is taken without a connection, so that none shows up
+// in it.
+func LocalChannelz(ctx context.Context) (*ChannelzSnapshot, error) {
+	r := &channelzRegistrar{}
+	service.RegisterChannelzServiceToServer(r)
+	return snapshotChannelz(ctx, r.impl.(channelzpb.ChannelzServer))
+}
+
+func snapshotChannelz(ctx context.Context, api channelzAPI) (*ChannelzSnapshot, error) {
+	snap := &ChannelzSnapshot{Time: time.Now(), Channels: []ChannelzChannel{}, Servers: []ChannelzServer{}}
+	for start := int64(0); ; {
+		resp, err := api.GetTopChannels(ctx, &channelzpb.GetTopChannelsRequest{StartChannelId: start})
+		if err != nil {
+			return nil, fmt.Errorf("channelz top channels: %w", err)
+		}
+		for _, ch := range resp.Channel {
+			c := channelzChannel(ch.Ref.GetChannelId(), ch.Data)
+			for _, ref := range ch.SubchannelRef {
+				sub, err := fetchSubchannel(ctx, api, ref.SubchannelId)
+				if err != nil {
+					return nil, err
+				}
+				c.Subchannels = append(c.Subchannels, *sub)
+			}
+			if c.Sockets, err = fetchSockets(ctx, api, ch.SocketRef); err != nil {
+				return nil, err
+			}
+			snap.Channels = append(snap.Channels, c)
+			start = c.ID + 1
+		}
+		if resp.End || len(resp.Channel) == 0 {
+			break
+		}
+	}
+	for start := int64(0); ; {
+		resp, err := api.GetServers(ctx, &channelzpb.GetServersRequest{StartServerId: start})
+		if err != nil {
+			return nil, fmt.Errorf("channelz servers: %w", err)
+		}
+		for _, srv := range resp.Server {
+			s := ChannelzServer{
+				ID:             srv.Ref.GetServerId(),
+				CallsStarted:   srv.Data.GetCallsStarted(),
+				CallsSucceeded: srv.Data.GetCallsSucceeded(),
+				CallsFailed:    srv.Data.GetCallsFailed(),
+			}
+			if s.Sockets, err = fetchServerSockets(ctx, api, s.ID); err != nil {
+				return nil, err
+			}
+			snap.Servers = append(snap.Servers, s)
+			start = s.ID + 1
+		}
+		if resp.End || len(resp.Server) == 0 {
+			break
+		}
+	}
+	return snap, nil
+}
+
+func channelzChannel(id int64, data *channelzpb.ChannelData) ChannelzChannel {
+	return ChannelzChannel{
+		ID:             id,
+		Target:         data.GetTarget(),
+		State:          data.GetState().GetState().String(),
+		CallsStarted:   data.GetCallsStarted(),
+		CallsSucceeded: data.GetCallsSucceeded(),
+		CallsFailed:    data.GetCallsFailed(),
+	}
+}
+
+func fetchSubchannel(ctx context.Context, api channelzAPI, id int64) (*ChannelzChannel, error) {
+	resp, err := api.GetSubchannel(ctx, &channelzpb.GetSubchannelRequest{SubchannelId: id})
+	if err != nil {
+		return nil, fmt.Errorf("channelz subchannel %d: %w", id, err)
+	}
+	c := channelzChannel(id, resp.Subchannel.GetData())
+	if c.Sockets, err = fetchSockets(ctx, api, resp.Subchannel.GetSocketRef()); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func fetchServerSockets(ctx context.Context, api channelzAPI, serverID int64) ([]ChannelzSocket, error) {
+	var refs []*channelzpb.SocketRef
+	for start := int64(0); ; {
+		resp, err := api.GetServerSockets(ctx, &channelzpb.GetServerSocketsRequest{ServerId: serverID, StartSocketId: start})
+		if err != nil {
+			return nil, fmt.Errorf("channelz sockets of server %d: %w", serverID, err)
+		}
+		refs = append(refs, resp.SocketRef...)
+		if resp.End || len(resp.SocketRef) == 0 {
+			break
+		}
+		start = resp.SocketRef[len(resp.SocketRef)-1].SocketId + 1
+	}
+	return fetchSockets(ctx, api, refs)
+}
+
+func fetchSockets(ctx context.Context, api channelzAPI, refs []*channelzpb.SocketRef) ([]ChannelzSocket, error) {
+	var sockets []ChannelzSocket
+	for _, ref := range refs {
+		resp, err := api.GetSocket(ctx, &channelzpb.GetSocketRequest{SocketId: ref.SocketId})
+		if err != nil {
+			return nil, fmt.Errorf("channelz socket %d: %w", ref.SocketId, err)
+		}
+		data := resp.Socket.GetData()
+		s := ChannelzSocket{
+			ID:               ref.SocketId,
+			LocalAddr:        channelzAddr(resp.Socket.GetLocal()),
+			RemoteAddr:       channelzAddr(resp.Socket.GetRemote()),
+			StreamsStarted:   data.GetStreamsStarted(),
+			StreamsSucceeded: data.GetStreamsSucceeded(),
+			StreamsFailed:    data.GetStreamsFailed(),
+			MessagesSent:     data.GetMessagesSent(),
+			MessagesReceived: data.GetMessagesReceived(),
+			KeepAlivesSent:   data.GetKeepAlivesSent(),
+		}
+		if w := data.GetLocalFlowControlWindow(); w != nil {
+			v := w.Value
+			s.LocalFlowControlWindow = &v
+		}
+		if w := data.GetRemoteFlowControlWindow(); w != nil {
+			v := w.Value
+			s.RemoteFlowControlWindow = &v
+		}
+		sockets = append(sockets, s)
+	}
+	return sockets, nil
+}
+
+// channelzAddr renders a as CanonicalAddr does, or returns "" if it is not a TCP address.
+func channelzAddr(a *channelzpb.Address) string {
+	tcp := a.GetTcpipAddress()
+	if tcp == nil {
+		return ""
+	}
+	return CanonicalAddr(&net.TCPAddr{IP: net.IP(tcp.IpAddress), Port: int(tcp.Port)})
+}
+
+// CompareChannelz compares the counters channelz keeps of every socket with those a
+// ConnStatsHandler keeps of the connection, taken at the same time, and describes every
+// discrepancy: a bug in one of the two. Only the connections in conns that were still open, and
+// so in the snapshot, are compared.
+func CompareChannelz(snap *ChannelzSnapshot, conns []ConnStats) []string {
+	sockets := make(map[connKey]ChannelzSocket)
+	for _, s := range snap.Sockets() {
+		sockets[connKey{local: s.LocalAddr, remote: s.RemoteAddr}] = s
+	}
+	var diffs []string
+	for _, c := range conns {
+		if c.CloseTime != nil && c.CloseTime.Before(snap.Time) {
+			continue
+		}
+		s, ok := sockets[connKey{local: c.LocalAddr, remote: c.RemoteAddr}]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("%s -> %s: open, but not in channelz", c.LocalAddr, c.RemoteAddr))
+			continue
+		}
+		for _, counter := range []struct {
+			name              string
+			channelz, handler int64
+		}{
+			{"streams started", s.StreamsStarted, c.RPCsStarted},
+			{"messages sent", s.MessagesSent, c.MessagesOut},
+			{"messages received", s.MessagesReceived, c.MessagesIn},
+		} {
+			if counter.channelz != counter.handler {
+				diffs = append(diffs, fmt.Sprintf("%s -> %s: %s is %d in channelz, %d in the stats handler",
+					c.LocalAddr, c.RemoteAddr, counter.name, counter.channelz, counter.handler))
+			}
+		}
+	}
+	return diffs
+}
+
+// WriteChannelzSnapshot writes snap to w as JSON.
+func WriteChannelzSnapshot(w io.Writer, snap *ChannelzSnapshot) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(snap)
+}
+
+// ReadChannelzSnapshot reads the JSON written by WriteChannelzSnapshot.
+func ReadChannelzSnapshot(r io.Reader) (*ChannelzSnapshot, error) {
+	snap := &ChannelzSnapshot{}
+	if err := json.NewDecoder(r).Decode(snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
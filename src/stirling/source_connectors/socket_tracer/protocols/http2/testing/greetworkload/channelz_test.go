@@ -0,0 +1,141 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	channelzsvc "google.golang.org/grpc/channelz/service"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+func TestChannelz_AgreesWithConnStats(t *testing.T) {
+	serverStats := greetworkload.NewConnStatsHandler()
+	s := startServerWith(t, &serverSetup{
+		Stats: serverStats,
+		Register: func(s *grpc.Server, greeter *greetworkload.Server) {
+			registerGreeter(s, greeter)
+			channelzsvc.RegisterChannelzServiceToServer(s)
+		},
+	})
+
+	clientStats := greetworkload.NewConnStatsHandler()
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(s.Addr, grpc.WithStatsHandler(clientStats))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for _, name := range []string{"a", "pixie", "stirling"} {
+		r := c.SayHello(conn, name)
+		require.True(t, r.Completed(), r.Error)
+	}
+	r := c.ServerStreaming(conn, "pixie")
+	require.True(t, r.Completed(), r.Error)
+	r = c.BidirStreaming(conn, []string{"a", "b", "c"})
+	require.True(t, r.Completed(), r.Error)
+
+	var snap *greetworkload.ChannelzSnapshot
+	var conns []greetworkload.ConnStats
+	var diffs []string
+	// The server may record the end of the last call after the client has seen it.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		snap, err = greetworkload.LocalChannelz(context.Background())
+		require.NoError(t, err)
+		conns = append(clientStats.Conns(), serverStats.Conns()...)
+		diffs = greetworkload.CompareChannelz(snap, conns)
+		if len(diffs) == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Empty(t, diffs)
+
+	require.Len(t, conns, 2)
+	assert.Equal(t, int64(5), conns[0].RPCsStarted)
+	assert.Equal(t, conns[0].MessagesOut, conns[1].MessagesIn)
+	assert.Equal(t, conns[0].MessagesIn, conns[1].MessagesOut)
+	sockets := map[string]greetworkload.ChannelzSocket{}
+	for _, s := range snap.Sockets() {
+		sockets[s.LocalAddr] = s
+	}
+	for _, c := range conns {
+		s, ok := sockets[c.LocalAddr]
+		require.True(t, ok, c.LocalAddr)
+		assert.Equal(t, c.RemoteAddr, s.RemoteAddr)
+		assert.NotNil(t, s.LocalFlowControlWindow)
+	}
+}
+
+func TestCompareChannelz(t *testing.T) {
+	closed := time.Unix(1, 0)
+	snap := &greetworkload.ChannelzSnapshot{
+		Time: time.Unix(2, 0),
+		Channels: []greetworkload.ChannelzChannel{{
+			Subchannels: []greetworkload.ChannelzChannel{{
+				Sockets: []greetworkload.ChannelzSocket{
+					{LocalAddr: "127.0.0.1:1", RemoteAddr: "127.0.0.1:2", StreamsStarted: 2, MessagesSent: 2, MessagesReceived: 2},
+				},
+			}},
+		}},
+		Servers: []greetworkload.ChannelzServer{{
+			Sockets: []greetworkload.ChannelzSocket{
+				{LocalAddr: "127.0.0.1:2", RemoteAddr: "127.0.0.1:1", StreamsStarted: 2, MessagesSent: 1, MessagesReceived: 2},
+			},
+		}},
+	}
+	diffs := greetworkload.CompareChannelz(snap, []greetworkload.ConnStats{
+		{LocalAddr: "127.0.0.1:1", RemoteAddr: "127.0.0.1:2", RPCsStarted: 2, MessagesOut: 2, MessagesIn: 2},
+		{LocalAddr: "127.0.0.1:2", RemoteAddr: "127.0.0.1:1", RPCsStarted: 2, MessagesOut: 2, MessagesIn: 2},
+		// Closed before the snapshot, so not compared.
+		{LocalAddr: "127.0.0.1:3", RemoteAddr: "127.0.0.1:2", CloseTime: &closed},
+		{LocalAddr: "127.0.0.1:4", RemoteAddr: "127.0.0.1:2"},
+	})
+	assert.Equal(t, []string{
+		"127.0.0.1:2 -> 127.0.0.1:1: messages sent is 1 in channelz, 2 in the stats handler",
+		"127.0.0.1:4 -> 127.0.0.1:2: open, but not in channelz",
+	}, diffs)
+}
+
+func TestWriteChannelzSnapshot(t *testing.T) {
+	window := int64(65535)
+	snap := &greetworkload.ChannelzSnapshot{
+		Time: time.Unix(1, 0).UTC(),
+		Channels: []greetworkload.ChannelzChannel{{
+			ID: 1, Target: "localhost:1", State: "READY", CallsStarted: 3, CallsSucceeded: 3,
+			Subchannels: []greetworkload.ChannelzChannel{{
+				ID: 2, State: "READY",
+				Sockets: []greetworkload.ChannelzSocket{{ID: 3, LocalAddr: "127.0.0.1:2", RemoteAddr: "127.0.0.1:1", StreamsStarted: 3, LocalFlowControlWindow: &window}},
+			}},
+		}},
+		Servers: []greetworkload.ChannelzServer{{ID: 4, CallsStarted: 3}},
+	}
+	var buf bytes.Buffer
+	require.NoError(t, greetworkload.WriteChannelzSnapshot(&buf, snap))
+	decoded, err := greetworkload.ReadChannelzSnapshot(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, snap, decoded)
+	assert.Len(t, decoded.Sockets(), 1)
+}
@@ -0,0 +1,354 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+// The corruptions Chaos injects into the HTTP/2 frames written to a connection.
+const (
+	// CorruptionBitFlip flips a bit in the payload of a DATA frame.
+	CorruptionBitFlip = "bit_flip"
+	// CorruptionTruncate drops the second half of a DATA frame in which a gRPC message ends, and
+	// shortens the length in its header to match. The frames stay well-formed, but the message is
+	// cut short.
+	CorruptionTruncate = "truncate"
+	// CorruptionEmptyData writes an extra zero-length DATA frame, on the same stream, before a DATA
+	// frame.
+	CorruptionEmptyData = "empty_data"
+)
+
+// corruptions are the Corruption constants, in the order they are picked from.
+var corruptions = []string{CorruptionBitFlip, CorruptionTruncate, CorruptionEmptyData}
+
+// ChaosOptions configure the corruptions injected by Chaos.
+type ChaosOptions struct {
+	// Probability is the chance, in [0, 1], that each non-empty DATA frame written is corrupted.
+	Probability float64
+	// Corruptions are the Corruption constants picked from at random, among those that apply to a
+	// frame. Empty picks from all of them.
+	Corruptions []string
+	// DryRun logs and records the corruptions that would be injected, without injecting them.
+	DryRun bool
+}
+
+// Validate checks that the options can be applied.
+func (o *ChaosOptions) Validate() error {
+	if o.Probability < 0 || o.Probability > 1 {
+		return fmt.Errorf("chaos probability must be in [0, 1], got %v", o.Probability)
+	}
+	for _, c := range o.Corruptions {
+		switch c {
+		case CorruptionBitFlip, CorruptionTruncate, CorruptionEmptyData:
+		default:
+			return fmt.Errorf("unknown corruption %q, expected bit_flip, truncate or empty_data", c)
+		}
+	}
+	return nil
+}
+
+// ChaosEvent is a corruption injected by Chaos, or that would have been in a dry run.
+type ChaosEvent struct {
+	// ConnID numbers the connections wrapped by a Chaos, from 1, in the order they were set up.
+	ConnID     uint64 `json:"conn_id"`
+	LocalAddr  string `json:"local_addr"`
+	RemoteAddr string `json:"remote_addr"`
+	StreamID   uint32 `json:"stream_id"`
+	// Offset is where the corruption is in the bytes written to the connection, counting those
+	// injected before: the byte flipped, the first byte dropped, or the start of the frame
+	// injected. In a dry run, it is where it would have been.
+	Offset     int64  `json:"offset"`
+	Corruption string `json:"corruption"`
+	DryRun     bool   `json:"dry_run,omitempty"`
+}
+
+// Chaos corrupts the HTTP/2 frames written to the connections it wraps, so that parsers are fed
+// protocol violations from a real gRPC stack. Every corruption is logged, and recorded as a
+// ChaosEvent.
+//
+// The connections must carry cleartext HTTP/2 from their first byte, or from the client preface:
+// Chaos must sit above TLS, and can't be used with h2c Upgrade.
+type Chaos struct {
+	opts *ChaosOptions
+
+	mu     sync.Mutex
+	rng    *rand.Rand
+	nextID uint64
+	events []ChaosEvent
+}
+
+// NewChaos creates a new Chaos, making its random choices from seed.
+func NewChaos(opts *ChaosOptions, seed int64) (*Chaos, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return &Chaos{opts: opts, rng: rand.New(rand.NewSource(seed))}, nil
+}
+
+// WrapListener wraps lis so that the frames the server writes to the connections it accepts are
+// corrupted.
+func (c *Chaos) WrapListener(lis net.Listener) net.Listener {
+	return &chaosListener{Listener: lis, chaos: c}
+}
+
+// Dialer wraps dial, a dialer for grpc.WithContextDialer, so that the frames the client writes to
+// the connections it dials are corrupted. The client preface is written as is.
+func (c *Chaos) Dialer(dial func(context.Context, string) (net.Conn, error)) func(context.Context, string) (net.Conn, error) {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return c.wrapConn(conn, true), nil
+	}
+}
+
+// Events returns the corruptions injected so far.
+func (c *Chaos) Events() []ChaosEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]ChaosEvent(nil), c.events...)
+}
+
+func (c *Chaos) wrapConn(conn net.Conn, client bool) net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	cc := &chaosConn{Conn: conn, chaos: c, id: c.nextID, streams: make(map[uint32]*grpcMessageScanner)}
+	if client {
+		cc.preface = len(http2.ClientPreface)
+	}
+	return cc
+}
+
+// pick returns the corruption to inject into a frame, if any, among those that apply to it.
+func (c *Chaos) pick(endsMessage bool) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.opts.Probability <= 0 || c.rng.Float64() >= c.opts.Probability {
+		return ""
+	}
+	allowed := c.opts.Corruptions
+	if len(allowed) == 0 {
+		allowed = corruptions
+	}
+	var candidates []string
+	for _, corruption := range allowed {
+		if corruption != CorruptionTruncate || endsMessage {
+			candidates = append(candidates, corruption)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[c.rng.Intn(len(candidates))]
+}
+
+func (c *Chaos) intn(n int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rng.Intn(n)
+}
+
+func (c *Chaos) record(e ChaosEvent) {
+	log.Printf("Chaos: conn=%d local=%s remote=%s stream=%d offset=%d corruption=%s dry_run=%t",
+		e.ConnID, e.LocalAddr, e.RemoteAddr, e.StreamID, e.Offset, e.Corruption, e.DryRun)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events = append(c.events, e)
+}
+
+type chaosListener struct {
+	net.Listener
+	chaos *Chaos
+}
+
+func (l *chaosListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.chaos.wrapConn(conn, false), nil
+}
+
+// grpcMessageScanner follows the gRPC messages in the DATA frames of a stream, to find where they
+// end.
+type grpcMessageScanner struct {
+	prefix    [MessagePrefixLen]byte
+	prefixLen int
+	// remaining is the number of bytes of the current message still to come, once its prefix is
+	// complete.
+	remaining uint32
+}
+
+// scan follows b, the payload of a DATA frame, and returns true if a message ends in it.
+func (s *grpcMessageScanner) scan(b []byte) bool {
+	ends := false
+	for len(b) > 0 {
+		if s.prefixLen < MessagePrefixLen {
+			n := copy(s.prefix[s.prefixLen:], b)
+			s.prefixLen += n
+			b = b[n:]
+			if s.prefixLen < MessagePrefixLen {
+				break
+			}
+			s.remaining = binary.BigEndian.Uint32(s.prefix[1:])
+		} else {
+			n := uint32(len(b))
+			if n > s.remaining {
+				n = s.remaining
+			}
+			s.remaining -= n
+			b = b[n:]
+		}
+		if s.prefixLen == MessagePrefixLen && s.remaining == 0 {
+			s.prefixLen = 0
+			ends = true
+		}
+	}
+	return ends
+}
+
+// chaosConn buffers the frames written to it until they are complete, so that they can be
+// corrupted before they are written out.
+type chaosConn struct {
+	net.Conn
+	chaos *Chaos
+	id    uint64
+
+	mu sync.Mutex
+	// preface is the number of bytes of the client preface still to be written.
+	preface int
+	buf     []byte
+	// offset is the number of bytes written out.
+	offset  int64
+	streams map[uint32]*grpcMessageScanner
+}
+
+func (c *chaosConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(b)
+	if c.preface > 0 {
+		m := c.preface
+		if m > len(b) {
+			m = len(b)
+		}
+		if err := c.writeOut(b[:m]); err != nil {
+			return 0, err
+		}
+		c.preface -= m
+		b = b[m:]
+	}
+	c.buf = append(c.buf, b...)
+	for len(c.buf) >= http2FrameHeaderLen {
+		length := int(c.buf[0])<<16 | int(c.buf[1])<<8 | int(c.buf[2])
+		if len(c.buf) < http2FrameHeaderLen+length {
+			break
+		}
+		frame := c.buf[:http2FrameHeaderLen+length]
+		if err := c.writeOut(c.corrupt(frame)...); err != nil {
+			return 0, err
+		}
+		c.buf = c.buf[len(frame):]
+	}
+	if len(c.buf) == 0 {
+		c.buf = nil
+	}
+	return n, nil
+}
+
+func (c *chaosConn) writeOut(pieces ...[]byte) error {
+	for _, p := range pieces {
+		m, err := c.Conn.Write(p)
+		c.offset += int64(m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// corrupt returns the pieces to write out in place of frame, which it may modify.
+func (c *chaosConn) corrupt(frame []byte) [][]byte {
+	if http2.FrameType(frame[3]) != http2.FrameData {
+		return [][]byte{frame}
+	}
+	streamID := binary.BigEndian.Uint32(frame[5:9]) & (1<<31 - 1)
+	payload := frame[http2FrameHeaderLen:]
+	s, ok := c.streams[streamID]
+	if !ok {
+		s = &grpcMessageScanner{}
+		c.streams[streamID] = s
+	}
+	endsMessage := s.scan(payload)
+	if http2.Flags(frame[4]).Has(http2.FlagDataEndStream) {
+		delete(c.streams, streamID)
+	}
+	if len(payload) == 0 {
+		return [][]byte{frame}
+	}
+	corruption := c.chaos.pick(endsMessage)
+	if corruption == "" {
+		return [][]byte{frame}
+	}
+
+	e := ChaosEvent{
+		ConnID:     c.id,
+		LocalAddr:  CanonicalAddr(c.LocalAddr()),
+		RemoteAddr: CanonicalAddr(c.RemoteAddr()),
+		StreamID:   streamID,
+		Offset:     c.offset,
+		Corruption: corruption,
+		DryRun:     c.chaos.opts.DryRun,
+	}
+	out := [][]byte{frame}
+	switch corruption {
+	case CorruptionBitFlip:
+		i := c.chaos.intn(len(payload))
+		e.Offset += int64(http2FrameHeaderLen + i)
+		if !e.DryRun {
+			payload[i] ^= 1 << c.chaos.intn(8)
+		}
+	case CorruptionTruncate:
+		length := len(payload) - (len(payload)+1)/2
+		e.Offset += int64(http2FrameHeaderLen + length)
+		if !e.DryRun {
+			frame[0], frame[1], frame[2] = byte(length>>16), byte(length>>8), byte(length)
+			out = [][]byte{frame[:http2FrameHeaderLen+length]}
+		}
+	case CorruptionEmptyData:
+		if !e.DryRun {
+			empty := make([]byte, http2FrameHeaderLen)
+			empty[3] = byte(http2.FrameData)
+			binary.BigEndian.PutUint32(empty[5:], streamID)
+			out = [][]byte{empty, frame}
+		}
+	}
+	c.chaos.record(e)
+	return out
+}
@@ -0,0 +1,215 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc/codes"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// recordingConn keeps the bytes written to it rather than sending them.
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	return c.written.Write(b)
+}
+
+// dialRecording wraps a recordingConn in the client side of chaos.
+func dialRecording(t *testing.T, chaos *greetworkload.Chaos) (net.Conn, *recordingConn) {
+	end, other := net.Pipe()
+	t.Cleanup(func() { end.Close(); other.Close() })
+	rec := &recordingConn{Conn: end}
+	conn, err := chaos.Dialer(func(context.Context, string) (net.Conn, error) { return rec, nil })(context.Background(), "")
+	require.NoError(t, err)
+	return conn, rec
+}
+
+// grpcMessage returns a gRPC message, with its prefix, of n bytes of payload.
+func grpcMessage(n int) []byte {
+	b := make([]byte, greetworkload.MessagePrefixLen+n)
+	binary.BigEndian.PutUint32(b[1:], uint32(n))
+	for i := range b[greetworkload.MessagePrefixLen:] {
+		b[greetworkload.MessagePrefixLen+i] = byte(i)
+	}
+	return b
+}
+
+// clientStream returns the client preface, a SETTINGS frame, and a DATA frame per payload on
+// stream 1.
+func clientStream(t *testing.T, payloads ...[]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(http2.ClientPreface)
+	fr := http2.NewFramer(&buf, nil)
+	require.NoError(t, fr.WriteSettings())
+	for i, p := range payloads {
+		require.NoError(t, fr.WriteData(1, i == len(payloads)-1, p))
+	}
+	return buf.Bytes()
+}
+
+func newChaos(t *testing.T, opts *greetworkload.ChaosOptions) *greetworkload.Chaos {
+	chaos, err := greetworkload.NewChaos(opts, 1)
+	require.NoError(t, err)
+	return chaos
+}
+
+func TestChaos_BitFlip(t *testing.T) {
+	chaos := newChaos(t, &greetworkload.ChaosOptions{Probability: 1, Corruptions: []string{greetworkload.CorruptionBitFlip}})
+	conn, rec := dialRecording(t, chaos)
+	in := clientStream(t, grpcMessage(100))
+	// Frames may be written in pieces.
+	for _, b := range in {
+		_, err := conn.Write([]byte{b})
+		require.NoError(t, err)
+	}
+
+	out := rec.written.Bytes()
+	require.Len(t, out, len(in))
+	events := chaos.Events()
+	require.Len(t, events, 1)
+	e := events[0]
+	assert.Equal(t, uint64(1), e.ConnID)
+	assert.Equal(t, uint32(1), e.StreamID)
+	assert.Equal(t, greetworkload.CorruptionBitFlip, e.Corruption)
+	assert.False(t, e.DryRun)
+	for i := range in {
+		if int64(i) == e.Offset {
+			diff := in[i] ^ out[i]
+			assert.True(t, diff != 0 && diff&(diff-1) == 0, "byte %d differs by %08b", i, diff)
+		} else {
+			assert.Equal(t, in[i], out[i], "byte %d", i)
+		}
+	}
+}
+
+func TestChaos_Truncate(t *testing.T) {
+	chaos := newChaos(t, &greetworkload.ChaosOptions{Probability: 1, Corruptions: []string{greetworkload.CorruptionTruncate}})
+	conn, rec := dialRecording(t, chaos)
+	// The message spans two frames: only the second, in which it ends, is truncated.
+	msg := grpcMessage(100)
+	in := clientStream(t, msg[:60], msg[60:])
+	_, err := conn.Write(in)
+	require.NoError(t, err)
+
+	events := chaos.Events()
+	require.Len(t, events, 1)
+	e := events[0]
+	assert.Equal(t, greetworkload.CorruptionTruncate, e.Corruption)
+
+	out := rec.written.Bytes()
+	// The second frame, of 45 bytes, loses its last 23.
+	require.Len(t, out, len(in)-23)
+	assert.Equal(t, int64(len(out)), e.Offset)
+	fr := http2.NewFramer(nil, bytes.NewReader(out[len(http2.ClientPreface):]))
+	var data [][]byte
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			break
+		}
+		if d, ok := f.(*http2.DataFrame); ok {
+			data = append(data, append([]byte(nil), d.Data()...))
+		}
+	}
+	require.Len(t, data, 2)
+	assert.Equal(t, msg[:60], data[0])
+	assert.Equal(t, msg[60:82], data[1])
+}
+
+func TestChaos_EmptyData(t *testing.T) {
+	chaos := newChaos(t, &greetworkload.ChaosOptions{Probability: 1, Corruptions: []string{greetworkload.CorruptionEmptyData}})
+	conn, rec := dialRecording(t, chaos)
+	in := clientStream(t, grpcMessage(10))
+	_, err := conn.Write(in)
+	require.NoError(t, err)
+
+	events := chaos.Events()
+	require.Len(t, events, 1)
+	out := rec.written.Bytes()
+	require.Len(t, out, len(in)+9)
+	at := events[0].Offset
+	assert.Equal(t, in[:at], out[:at])
+	assert.Equal(t, []byte{0, 0, 0, byte(http2.FrameData), 0, 0, 0, 0, 1}, out[at:at+9])
+	assert.Equal(t, in[at:], out[at+9:])
+}
+
+func TestChaos_DryRun(t *testing.T) {
+	chaos := newChaos(t, &greetworkload.ChaosOptions{Probability: 1, DryRun: true})
+	conn, rec := dialRecording(t, chaos)
+	in := clientStream(t, grpcMessage(10), grpcMessage(20), grpcMessage(30))
+	_, err := conn.Write(in)
+	require.NoError(t, err)
+
+	assert.Equal(t, in, rec.written.Bytes())
+	events := chaos.Events()
+	require.Len(t, events, 3)
+	for _, e := range events {
+		assert.True(t, e.DryRun)
+		assert.Less(t, e.Offset, int64(len(in)))
+	}
+}
+
+func TestChaos_Probability(t *testing.T) {
+	chaos := newChaos(t, &greetworkload.ChaosOptions{Probability: 0})
+	conn, rec := dialRecording(t, chaos)
+	in := clientStream(t, grpcMessage(10), grpcMessage(20))
+	_, err := conn.Write(in)
+	require.NoError(t, err)
+	assert.Equal(t, in, rec.written.Bytes())
+	assert.Empty(t, chaos.Events())
+
+	for _, opts := range []*greetworkload.ChaosOptions{
+		{Probability: 1.5},
+		{Probability: 0.5, Corruptions: []string{"reorder"}},
+	} {
+		_, err := greetworkload.NewChaos(opts, 1)
+		assert.Error(t, err)
+	}
+}
+
+func TestChaos_CorruptsServerReplies(t *testing.T) {
+	chaos := newChaos(t, &greetworkload.ChaosOptions{Probability: 1, Corruptions: []string{greetworkload.CorruptionTruncate}})
+	addr := startServerWith(t, &serverSetup{Wrap: chaos.WrapListener}).Addr
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	r := c.SayHello(conn, "pixie")
+	assert.Equal(t, codes.Internal.String(), r.Code, r.Error)
+
+	events := chaos.Events()
+	require.Len(t, events, 1)
+	assert.Equal(t, uint64(1), events[0].ConnID)
+	assert.Equal(t, greetworkload.CorruptionTruncate, events[0].Corruption)
+	assert.Equal(t, addr, events[0].LocalAddr)
+}
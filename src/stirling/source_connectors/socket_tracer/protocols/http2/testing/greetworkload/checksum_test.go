@@ -0,0 +1,156 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// corrupt flips a bit of the message of reply. With resign, the checksum of the reply is updated to
+// match, as if the corruption happened before the server checksummed it.
+func corrupt(reply *pb.HelloReply, resign bool) {
+	b := []byte(reply.Message)
+	b[0] ^= 1
+	reply.Message = string(b)
+	if resign {
+		reply.SetChecksum()
+	}
+}
+
+func corruptUnary(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if err == nil {
+		corrupt(reply.(*pb.HelloReply), false)
+	}
+	return err
+}
+
+// corruptingStream corrupts the index-th reply received.
+type corruptingStream struct {
+	grpc.ClientStream
+	index    int
+	resign   bool
+	received int
+}
+
+func (s *corruptingStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == nil {
+		if s.received == s.index {
+			corrupt(m.(*pb.HelloReply), s.resign)
+		}
+		s.received++
+	}
+	return err
+}
+
+func corruptStreams(index int, resign bool) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		s, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return &corruptingStream{ClientStream: s, index: index, resign: resign}, nil
+	}
+}
+
+func dialChecksummed(t *testing.T, opts ...grpc.DialOption) (*greetworkload.Client, *grpc.ClientConn) {
+	_, addr := startServer(t, &greetworkload.ServerOptions{Checksums: true, StreamReplyVariants: 4})
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{
+		Timeout:         5 * time.Second,
+		StreamCount:     10,
+		VerifyChecksums: true,
+	})
+	conn, err := c.Dial(addr, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return c, conn
+}
+
+func TestChecksums_Verified(t *testing.T) {
+	c, conn := dialChecksummed(t)
+	names := []string{"a", "b", "c"}
+	for _, r := range []*greetworkload.CallRecord{
+		c.SayHello(conn, "pixie"),
+		c.ServerStreaming(conn, "pixie"),
+		c.ClientStreaming(conn, names),
+		c.BidirStreaming(conn, names),
+	} {
+		assert.True(t, r.Completed(), "%s: %s", r.Method, r.Error)
+		assert.Empty(t, r.ChecksumMismatches, r.Method)
+		assert.False(t, r.StreamChecksumMismatch, r.Method)
+	}
+	assert.Zero(t, c.ChecksumMismatches())
+}
+
+func TestChecksums_CorruptedUnaryReply(t *testing.T) {
+	c, conn := dialChecksummed(t, grpc.WithUnaryInterceptor(corruptUnary))
+	r := c.SayHello(conn, "pixie")
+	require.True(t, r.Completed(), r.Error)
+	assert.Equal(t, []int{0}, r.ChecksumMismatches)
+	assert.Equal(t, int64(1), c.ChecksumMismatches())
+}
+
+func TestChecksums_CorruptedStreamReply(t *testing.T) {
+	c, conn := dialChecksummed(t, grpc.WithStreamInterceptor(corruptStreams(2, false)))
+
+	r := c.ServerStreaming(conn, "pixie")
+	require.True(t, r.Completed(), r.Error)
+	assert.Equal(t, []int{2}, r.ChecksumMismatches)
+	assert.True(t, r.StreamChecksumMismatch)
+
+	r = c.BidirStreaming(conn, []string{"a", "b", "c", "d"})
+	require.True(t, r.Completed(), r.Error)
+	assert.Equal(t, []int{2}, r.ChecksumMismatches)
+	assert.True(t, r.StreamChecksumMismatch)
+
+	assert.Equal(t, int64(4), c.ChecksumMismatches())
+}
+
+func TestChecksums_StreamChecksumCatchesResignedReply(t *testing.T) {
+	c, conn := dialChecksummed(t, grpc.WithStreamInterceptor(corruptStreams(5, true)))
+
+	r := c.ServerStreaming(conn, "pixie")
+	require.True(t, r.Completed(), r.Error)
+	assert.Empty(t, r.ChecksumMismatches)
+	assert.True(t, r.StreamChecksumMismatch)
+	assert.Equal(t, int64(1), c.ChecksumMismatches())
+}
+
+func TestChecksums_MissingStreamChecksum(t *testing.T) {
+	_, addr := startServer(t, nil)
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, VerifyChecksums: true})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// A server that does not send checksums fails verification.
+	r := c.ServerStreaming(conn, "pixie")
+	require.True(t, r.Completed(), r.Error)
+	assert.Equal(t, []int{0, 1, 2}, r.ChecksumMismatches)
+	assert.True(t, r.StreamChecksumMismatch)
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// ChurnOptions configure a connection churn run.
+type ChurnOptions struct {
+	// Rate is the number of connections opened per second.
+	Rate float64
+	// CallsPerConn is the number of unary calls made over each connection before it is closed.
+	CallsPerConn int
+	// Abortive closes connections with a TCP RST, by setting SO_LINGER to 0, instead of a FIN.
+	Abortive bool
+	// Duration is how long new connections keep being opened. Connections still open when it
+	// elapses are allowed to finish.
+	Duration time.Duration
+}
+
+// ChurnStats summarize a connection churn run. Connections are counted as they are observed on the
+// socket: opened once a TCP connection is established, and closed once gRPC closes it.
+type ChurnStats struct {
+	// Opened is the number of TCP connections established.
+	Opened int64
+	// ClosedCleanly is the number of connections closed with a FIN.
+	ClosedCleanly int64
+	// Reset is the number of connections closed with a RST, either by setting SO_LINGER to 0 before
+	// closing them or by the server resetting them first.
+	Reset int64
+	// CloseErrors is the number of connections whose close failed.
+	CloseErrors int64
+	// RPCs is the number of calls completed successfully, across every connection.
+	RPCs int64
+	// FailedRPCs is the number of calls that did not complete successfully.
+	FailedRPCs int64
+}
+
+// RPCsPerConn returns the average number of successful calls made over each connection.
+func (s *ChurnStats) RPCsPerConn() float64 {
+	if s.Opened == 0 {
+		return 0
+	}
+	return float64(s.RPCs) / float64(s.Opened)
+}
+
+// churnConn counts how the connection it wraps is closed.
+type churnConn struct {
+	net.Conn
+	stats *ChurnStats
+	// linger is set if SO_LINGER is 0, so that closing the connection resets it.
+	linger bool
+	// reset is set once a read or write saw the connection reset by the server.
+	reset  int32
+	once   sync.Once
+	closed *sync.WaitGroup
+}
+
+func (c *churnConn) observe(err error) {
+	if errors.Is(err, syscall.ECONNRESET) {
+		atomic.StoreInt32(&c.reset, 1)
+	}
+}
+
+func (c *churnConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.observe(err)
+	return n, err
+}
+
+func (c *churnConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.observe(err)
+	return n, err
+}
+
+func (c *churnConn) Close() error {
+	err := c.Conn.Close()
+	if errors.Is(err, net.ErrClosed) {
+		// gRPC may close a connection from several goroutines; the close that won counts it.
+		return err
+	}
+	c.once.Do(func() {
+		defer c.closed.Done()
+		switch {
+		case err != nil:
+			atomic.AddInt64(&c.stats.CloseErrors, 1)
+		case c.linger || atomic.LoadInt32(&c.reset) == 1:
+			atomic.AddInt64(&c.stats.Reset, 1)
+		default:
+			atomic.AddInt64(&c.stats.ClosedCleanly, 1)
+		}
+	})
+	return err
+}
+
+// churnDialer dials the TCP connections of a churn run and counts them in stats. With abortive,
+// connections are reset rather than shut down when closed. closed is done once every connection
+// dialed has been closed.
+func churnDialer(stats *ChurnStats, abortive bool, closed *sync.WaitGroup) func(context.Context, string) (net.Conn, error) {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if abortive {
+			if err := conn.(*net.TCPConn).SetLinger(0); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		atomic.AddInt64(&stats.Opened, 1)
+		closed.Add(1)
+		return &churnConn{Conn: conn, stats: stats, linger: abortive, closed: closed}, nil
+	}
+}
+
+// Churn opens new connections to address at opts.Rate for opts.Duration. Each connection makes
+// opts.CallsPerConn calls to Greeter.SayHello before it is closed. Churn returns once every
+// connection has been closed, or early if ctx is done, the calls in flight being cancelled and no
+// new one made. dialOpts are added to those of Dial.
+func (c *Client) Churn(ctx context.Context, address string, opts *ChurnOptions, dialOpts ...grpc.DialOption) (*ChurnStats, error) {
+	if !(opts.Rate > 0) {
+		return nil, errors.New("churn rate must be positive")
+	}
+	interval := time.Duration(float64(time.Second) / opts.Rate)
+	if interval <= 0 {
+		return nil, fmt.Errorf("churn rate %v is above one connection per nanosecond", opts.Rate)
+	}
+
+	ctx = c.opts.Audit.root(ctx)
+	stats := &ChurnStats{}
+	var closed sync.WaitGroup
+	dialOpts = append(dialOpts, grpc.WithContextDialer(churnDialer(stats, opts.Abortive, &closed)))
+
+	var wg sync.WaitGroup
+	churn := func() {
+		defer wg.Done()
+		conn, err := c.Dial(address, dialOpts...)
+		if err != nil {
+			atomic.AddInt64(&stats.FailedRPCs, int64(opts.CallsPerConn))
+			return
+		}
+		for i := 0; i < opts.CallsPerConn && ctx.Err() == nil; i++ {
+			if c.sayHello(ctx, conn, "churn", c.planCancel(0)).Completed() {
+				atomic.AddInt64(&stats.RPCs, 1)
+			} else {
+				atomic.AddInt64(&stats.FailedRPCs, 1)
+			}
+		}
+		conn.Close()
+	}
+	// Connections are closed by gRPC, which may still be at it once conn.Close returns.
+	wait := func() {
+		wg.Wait()
+		closed.Wait()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	deadline := time.NewTimer(opts.Duration)
+	defer deadline.Stop()
+
+	// Every connection gets its own goroutine, so that slow calls do not lower the churn rate.
+	for {
+		select {
+		case <-ctx.Done():
+			wait()
+			return stats, ctx.Err()
+		case <-deadline.C:
+			wait()
+			return stats, nil
+		case <-ticker.C:
+			wg.Add(1)
+			go churn()
+		}
+	}
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+func numFDs(t *testing.T) int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	require.NoError(t, err)
+	return len(fds)
+}
+
+// closeObserver records how the server side saw each accepted connection end: with an EOF when the
+// client sent a FIN, or ECONNRESET when it sent a RST.
+type closeObserver struct {
+	net.Listener
+	eofs   int64
+	resets int64
+}
+
+func (l *closeObserver) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &observedConn{Conn: conn, l: l}, nil
+}
+
+func (l *closeObserver) ends() (eofs, resets int64) {
+	return atomic.LoadInt64(&l.eofs), atomic.LoadInt64(&l.resets)
+}
+
+type observedConn struct {
+	net.Conn
+	l    *closeObserver
+	once sync.Once
+}
+
+func (c *observedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.once.Do(func() { atomic.AddInt64(&c.l.eofs, 1) })
+	case errors.Is(err, syscall.ECONNRESET):
+		c.once.Do(func() { atomic.AddInt64(&c.l.resets, 1) })
+	}
+	return n, err
+}
+
+func startObservedServer(t *testing.T) (*closeObserver, string) {
+	var observer *closeObserver
+	s := startServerWith(t, &serverSetup{Wrap: func(lis net.Listener) net.Listener {
+		observer = &closeObserver{Listener: lis}
+		return observer
+	}})
+	return observer, s.Addr
+}
+
+func TestClient_Churn(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("requires /proc/self/fd")
+	}
+
+	for _, abortive := range []bool{false, true} {
+		name := "clean"
+		if abortive {
+			name = "abortive"
+		}
+		t.Run(name, func(t *testing.T) {
+			observer, addr := startObservedServer(t)
+			c, _ := newAuditedClient(t, &greetworkload.ClientOptions{Timeout: 5 * time.Second})
+
+			goroutines := runtime.NumGoroutine()
+			fds := numFDs(t)
+
+			const rate = 100
+			const duration = time.Second
+			const callsPerConn = 3
+			stats, err := c.Churn(context.Background(), addr, &greetworkload.ChurnOptions{
+				Rate:         rate,
+				CallsPerConn: callsPerConn,
+				Abortive:     abortive,
+				Duration:     duration,
+			})
+			require.NoError(t, err)
+
+			expected := rate * duration.Seconds()
+			assert.InDelta(t, expected, float64(stats.Opened), 0.1*expected)
+			assert.Equal(t, int64(0), stats.FailedRPCs)
+			assert.Equal(t, int64(0), stats.CloseErrors)
+			assert.Equal(t, float64(callsPerConn), stats.RPCsPerConn())
+			assert.Equal(t, stats.Opened, stats.Reset+stats.ClosedCleanly)
+
+			// Connection teardown finishes asynchronously on both the client and server side. Poll
+			// from this goroutine, since assert.Eventually would add one of its own to the count.
+			settled := func() bool {
+				eofs, resets := observer.ends()
+				return runtime.NumGoroutine() <= goroutines && numFDs(t) <= fds && eofs+resets >= stats.Opened
+			}
+			for deadline := time.Now().Add(5 * time.Second); !settled() && time.Now().Before(deadline); {
+				time.Sleep(50 * time.Millisecond)
+			}
+			assert.LessOrEqual(t, runtime.NumGoroutine(), goroutines, "leaked goroutines")
+			assert.LessOrEqual(t, numFDs(t), fds, "leaked file descriptors")
+
+			// The client's counts match how the server saw the connections end.
+			eofs, resets := observer.ends()
+			assert.Equal(t, stats.Opened, eofs+resets)
+			if abortive {
+				// The server can see a few reset connections end with an EOF first, as happens
+				// under -race, so those are allowed.
+				tolerance := stats.Opened / 20
+				assert.Equal(t, stats.Opened, stats.Reset)
+				assert.GreaterOrEqual(t, resets, stats.Opened-tolerance)
+			} else {
+				assert.Equal(t, stats.ClosedCleanly, eofs)
+				assert.Equal(t, stats.Opened, eofs)
+			}
+		})
+	}
+}
+
+func TestClient_ChurnCountsOnlyEstablishedConnections(t *testing.T) {
+	// Nothing listens on the address, so no connection is ever established.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+	require.NoError(t, lis.Close())
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: time.Second})
+	stats, err := c.Churn(context.Background(), addr, &greetworkload.ChurnOptions{
+		Rate:         20,
+		CallsPerConn: 1,
+		Duration:     200 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), stats.Opened)
+	assert.Equal(t, int64(0), stats.ClosedCleanly+stats.Reset)
+	assert.Greater(t, stats.FailedRPCs, int64(0))
+}
+
+func TestClient_ChurnRejectsInvalidRate(t *testing.T) {
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{})
+	for _, rate := range []float64{0, -1, math.NaN(), 2e9, math.Inf(1)} {
+		_, err := c.Churn(context.Background(), "localhost:1", &greetworkload.ChurnOptions{Rate: rate, Duration: time.Second})
+		assert.Error(t, err, "rate %v", rate)
+	}
+}
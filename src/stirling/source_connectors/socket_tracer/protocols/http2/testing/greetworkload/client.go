@@ -0,0 +1,670 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/encoding/proto"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// ClientOptions configure the connections and calls made by a Client.
+type ClientOptions struct {
+	Compression bool
+	HTTPS       bool
+	// TLS restricts the TLS versions and cipher suites used with HTTPS.
+	TLS *TLSOptions
+	// ClientCert, if not nil, is presented to servers that request a client certificate with
+	// HTTPS. Rotating its files changes the certificate of the connections dialed from then on.
+	ClientCert *CertReloader
+	// Timeout is the deadline applied to every call.
+	Timeout time.Duration
+	// DialTimeout, if positive, bounds how long a call waits for a connection to send its headers
+	// over, and HeaderTimeout, if positive, how long it then waits for the response headers. A call
+	// that exceeds either fails with DEADLINE_EXCEEDED, as if it exceeded Timeout, its record
+	// noting which it exceeded. Calls are followed through their phases by the stats handler of
+	// their connection, so connections dialed with a stats handler of their own only keep to them
+	// with a ConnStatsHandler.
+	DialTimeout   time.Duration
+	HeaderTimeout time.Duration
+	// CancelFraction is the fraction of calls, in [0, 1], that the client cancels before they complete.
+	CancelFraction float64
+	// CancelWindow bounds the random delay after which a unary call picked for cancellation is cancelled.
+	CancelWindow time.Duration
+	// Seed seeds the random choices made by the client.
+	Seed int64
+	// StreamCount is the number of replies requested from server-streaming calls. Zero leaves the
+	// choice to the server.
+	StreamCount int32
+	// RecvInterval throttles server-streaming calls to read one reply per interval, so that the
+	// server is held back by HTTP/2 flow control.
+	RecvInterval time.Duration
+	// VerifyChecksums checks the checksum of every reply, and of every reply stream, against the
+	// messages received. The server must be set up to send checksums, see ServerOptions.Checksums.
+	VerifyChecksums bool
+	// Retries retries the calls that fail with UNAVAILABLE, on top of the transparent retries gRPC
+	// makes of the calls the server never saw.
+	Retries bool
+	// HedgeDelay, if positive, hedges unary calls: a second attempt of a call is made if the first
+	// has not returned within HedgeDelay, and the attempt that succeeds first wins, the other being
+	// cancelled. See HedgeAttemptHeader and Client.HedgeStats. Not supported with Retries, as gRPC
+	// does not combine retries and hedging either.
+	HedgeDelay time.Duration
+	// SizedCodec marshals and unmarshals messages with greetpb.SizedCodec. Calls are then sent with
+	// the content-type "application/grpc+proto".
+	SizedCodec bool
+	// DeterministicCodec marshals messages with greetpb.DeterministicCodec, so that the requests
+	// recorded on the wire are the same bytes on every run. Calls are then sent with the
+	// content-type "application/grpc+proto". Not supported with SizedCodec.
+	DeterministicCodec bool
+	// HTTP2 are the HTTP/2 settings the client advertises, if not nil.
+	HTTP2 *HTTP2Settings
+	// Authorities are the :authority of the connections dialed, which take them in turn. Empty
+	// leaves gRPC's default, the address dialed. See DialAuthorities for calls over one target
+	// that vary it.
+	Authorities []string
+	// Breaker fails unary calls without making them while it is open, if not nil.
+	Breaker *CircuitBreaker
+	// Keepalive are the HTTP/2 keepalive pings the client sends, if not nil.
+	Keepalive *KeepaliveOptions
+	// Socket are the socket options of the connections the client dials, if not nil. Dial options
+	// that set a dialer of their own, such as ConnStatsHandler.Dialer, must use DialerWith to keep
+	// them.
+	Socket *SocketOptions
+	// SOCKS5 dials the connections through a SOCKS5 proxy, if not nil, in place of Socket, which
+	// its SOCKS5Options.Dial should use to dial the proxy. Dial options that set a dialer of their
+	// own must dial through its Dial.
+	SOCKS5 *SOCKS5Dialer
+	// OTel makes a span of every call, if not nil.
+	OTel SpanTracer
+	// BinaryMetadata sends binary metadata entries with every call, and checks that they make it
+	// intact, if not nil.
+	BinaryMetadata *BinaryMetadata
+	// TrailerBloat checks that the trailer of every call holds its entries intact, if not nil.
+	TrailerBloat *TrailerBloat
+	// Sealer seals the requests of every call, and opens their replies, if not nil.
+	Sealer *PayloadSealer
+	// WireSampler spools a sample of the messages of every call, as the codec marshals and
+	// unmarshals them, if not nil. Calls are then sent with the content-type
+	// "application/grpc+proto".
+	WireSampler *WireSampler
+	// Audit tracks the context of every call, to find those that go on once the context they were
+	// made under is done, if not nil. Meant for tests.
+	Audit *ContextAudit
+}
+
+// Client issues calls against the greet services and records their outcome.
+type Client struct {
+	opts *ClientOptions
+
+	mu  sync.Mutex
+	rng *rand.Rand
+	// checksumMismatches counts the replies and reply streams that failed checksum verification.
+	checksumMismatches int64
+	// cacheHits and cacheMisses count the calls the server answered from its reply cache, and
+	// those it cached the reply of.
+	cacheHits   int64
+	cacheMisses int64
+	// hedges counts the calls hedged with ClientOptions.HedgeDelay.
+	hedges HedgeStats
+	// batches counts the calls made with SayHelloBatch.
+	batches BatchStats
+	// timeouts counts the calls that exceeded each of their budgets.
+	timeouts TimeoutStats
+	// authorities counts the connections dialed with one of ClientOptions.Authorities.
+	authorities int
+}
+
+// NewClient creates a new Client.
+func NewClient(opts *ClientOptions) *Client {
+	return &Client{
+		opts: opts,
+		rng:  rand.New(rand.NewSource(opts.Seed)),
+	}
+}
+
+func (c *Client) dialOpts() ([]grpc.DialOption, error) {
+	// Dial options that set a stats handler of their own replace it, see ClientOptions.DialTimeout.
+	dialOpts := []grpc.DialOption{grpc.WithStatsHandler(phaseHandler{})}
+
+	if c.opts.Compression {
+		dialOpts = append(dialOpts, grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)))
+	}
+
+	if c.opts.HedgeDelay > 0 && c.opts.Retries {
+		return nil, badFlagsf("hedging and retries cannot be combined")
+	}
+
+	var codec encoding.Codec
+	if c.opts.SizedCodec {
+		codec = pb.SizedCodec{}
+	}
+
+	if c.opts.DeterministicCodec {
+		if c.opts.SizedCodec {
+			return nil, badFlagsf("the sized and deterministic codecs cannot be combined")
+		}
+		codec = pb.DeterministicCodec{}
+	}
+
+	if c.opts.WireSampler != nil && codec == nil {
+		codec = encoding.GetCodec(proto.Name)
+	}
+	if codec != nil {
+		dialOpts = append(dialOpts, grpc.WithDefaultCallOptions(grpc.ForceCodec(c.opts.WireSampler.ClientCodec(codec))))
+	}
+
+	if c.opts.HTTP2 != nil {
+		opts, err := c.opts.HTTP2.DialOptions()
+		if err != nil {
+			return nil, err
+		}
+		dialOpts = append(dialOpts, opts...)
+	}
+
+	if c.opts.Keepalive != nil {
+		dialOpts = append(dialOpts, c.opts.Keepalive.DialOptions()...)
+	}
+
+	if c.opts.Socket != nil {
+		dialOpts = append(dialOpts, grpc.WithContextDialer(c.opts.Socket.Dial))
+	}
+
+	if c.opts.SOCKS5 != nil {
+		// After Socket, so that it dials instead.
+		dialOpts = append(dialOpts, grpc.WithContextDialer(c.opts.SOCKS5.Dial))
+	}
+
+	if c.opts.Breaker != nil {
+		// First, so that the calls it fails are not traced, sealed or counted.
+		dialOpts = append(dialOpts, grpc.WithChainUnaryInterceptor(c.opts.Breaker.UnaryClientInterceptor()))
+	}
+
+	if c.opts.OTel != nil {
+		dialOpts = append(dialOpts, grpc.WithChainUnaryInterceptor(c.opts.OTel.UnaryClientInterceptor()),
+			grpc.WithChainStreamInterceptor(c.opts.OTel.StreamClientInterceptor()))
+	}
+
+	if c.opts.BinaryMetadata != nil {
+		dialOpts = append(dialOpts, grpc.WithChainUnaryInterceptor(c.opts.BinaryMetadata.UnaryClientInterceptor()),
+			grpc.WithChainStreamInterceptor(c.opts.BinaryMetadata.StreamClientInterceptor()))
+	}
+
+	if c.opts.TrailerBloat != nil {
+		dialOpts = append(dialOpts, grpc.WithChainUnaryInterceptor(c.opts.TrailerBloat.UnaryClientInterceptor()),
+			grpc.WithChainStreamInterceptor(c.opts.TrailerBloat.StreamClientInterceptor()))
+	}
+
+	if c.opts.Sealer != nil {
+		// After the interceptors above, so that they see the calls opened.
+		dialOpts = append(dialOpts, grpc.WithChainUnaryInterceptor(c.opts.Sealer.UnaryClientInterceptor()),
+			grpc.WithChainStreamInterceptor(c.opts.Sealer.StreamClientInterceptor()))
+	}
+
+	if c.opts.WireSampler != nil {
+		// After the sealer, so that the messages it samples are those sent and received.
+		dialOpts = append(dialOpts, grpc.WithChainUnaryInterceptor(c.opts.WireSampler.UnaryClientInterceptor()),
+			grpc.WithChainStreamInterceptor(c.opts.WireSampler.StreamClientInterceptor()))
+	}
+
+	if c.opts.HTTPS {
+		tlsConfig := &tls.Config{InsecureSkipVerify: true}
+		if c.opts.ClientCert != nil {
+			tlsConfig.GetClientCertificate = c.opts.ClientCert.GetClientCertificate
+		}
+		if c.opts.TLS != nil {
+			if err := c.opts.TLS.Apply(tlsConfig); err != nil {
+				return nil, err
+			}
+		}
+		creds := credentials.NewTLS(tlsConfig)
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(creds))
+	} else {
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+
+	return dialOpts, nil
+}
+
+// handshake returns how the connections set up by Dial start HTTP/2.
+func (c *Client) handshake() string {
+	if c.opts.HTTPS {
+		return HandshakeTLS
+	}
+	// grpc-go only speaks h2c with prior knowledge.
+	return HandshakeH2CPriorKnowledge
+}
+
+// Dial sets up a connection to the server at address, which may be an IPv6 literal with a zone,
+// e.g. "[fe80::1%eth0]:50051". Calls to a BackendSet target are balanced over its backends in
+// round-robin order. Failures to set up the connection wrap ErrDialFailed.
+func (c *Client) Dial(address string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	if strings.HasPrefix(address, TestResolverScheme+":") {
+		return c.dial(address, true, c.nextAuthority(), opts...)
+	}
+	return c.dial(dialTarget(address), false, c.nextAuthority(), opts...)
+}
+
+// dial sets up a connection to target, with the :authority authority if not empty.
+func (c *Client) dial(target string, roundRobin bool, authority string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	dialOpts, err := c.dialOpts()
+	if err != nil {
+		return nil, err
+	}
+	if sc := c.serviceConfig(roundRobin); sc != "" {
+		dialOpts = append(dialOpts, grpc.WithDefaultServiceConfig(sc))
+	}
+	if authority != "" {
+		dialOpts = append(dialOpts, authorityDialOptions(authority)...)
+	}
+	conn, err := grpc.Dial(target, append(dialOpts, opts...)...)
+	if err != nil {
+		// The connection errors of grpc.FailOnNonTempDialError only hold the dialer's error as their
+		// origin, which errors.Is and errors.As do not see.
+		if ce, ok := err.(interface{ Origin() error }); ok {
+			err = ce.Origin()
+		}
+		return nil, dialError(target, err)
+	}
+	return conn, nil
+}
+
+// retryPolicy retries the calls to the greet services that fail with UNAVAILABLE, as they do when
+// they are cut short by their connection going away.
+const retryPolicy = `{
+	"maxAttempts": 4,
+	"initialBackoff": "0.01s",
+	"maxBackoff": "0.1s",
+	"backoffMultiplier": 2,
+	"retryableStatusCodes": ["UNAVAILABLE"]
+}`
+
+// serviceConfig returns the default service config of the connections dialed, or "" for none.
+func (c *Client) serviceConfig(roundRobin bool) string {
+	var fields []string
+	if roundRobin {
+		fields = append(fields, `"loadBalancingConfig": [{"round_robin": {}}]`)
+	}
+	if c.opts.Retries {
+		fields = append(fields, fmt.Sprintf(`"methodConfig": [{"name": [{"service": %q}, {"service": %q}, {"service": %q}], "retryPolicy": %s}]`,
+			GreeterService, Greeter2Service, StreamingGreeterService, retryPolicy))
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(fields, ", ") + "}"
+}
+
+// ChecksumMismatches returns the number of replies, and of reply streams, whose checksum did not
+// match so far.
+func (c *Client) ChecksumMismatches() int64 {
+	return atomic.LoadInt64(&c.checksumMismatches)
+}
+
+// CacheCounts returns the number of calls the server answered from its reply cache so far, and
+// the number it cached the reply of.
+func (c *Client) CacheCounts() (hits, misses int64) {
+	return atomic.LoadInt64(&c.cacheHits), atomic.LoadInt64(&c.cacheMisses)
+}
+
+// verifyReply records a mismatch in r if reply is the index-th of the call and its checksum does
+// not match its message.
+func (c *Client) verifyReply(r *CallRecord, index int, reply *pb.HelloReply) {
+	if !c.opts.VerifyChecksums || reply.VerifyChecksum() {
+		return
+	}
+	log.Printf("Checksum mismatch in reply #%d of %s", index, r.Method)
+	r.ChecksumMismatches = append(r.ChecksumMismatches, index)
+	atomic.AddInt64(&c.checksumMismatches, 1)
+}
+
+// verifyStream records a mismatch in r if the checksum in trailer does not match sum, the checksum of
+// the replies received.
+func (c *Client) verifyStream(r *CallRecord, trailer metadata.MD, sum pb.StreamChecksum) {
+	if !c.opts.VerifyChecksums {
+		return
+	}
+	if v := trailer.Get(pb.StreamChecksumTrailer); len(v) == 1 {
+		if sent, err := pb.ParseStreamChecksum(v[0]); err == nil && sent == sum {
+			return
+		}
+	}
+	log.Printf("Stream checksum mismatch in %s", r.Method)
+	r.StreamChecksumMismatch = true
+	atomic.AddInt64(&c.checksumMismatches, 1)
+}
+
+// cancelPlan describes when, if at all, a call is cancelled by the client.
+type cancelPlan struct {
+	cancel bool
+	// after is the delay before cancelling a unary call.
+	after time.Duration
+	// afterMessages is the number of stream messages exchanged before cancelling a streaming call.
+	afterMessages int
+}
+
+func (c *Client) planCancel(maxMessages int) cancelPlan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.opts.CancelFraction <= 0 || c.rng.Float64() >= c.opts.CancelFraction {
+		return cancelPlan{}
+	}
+	p := cancelPlan{cancel: true}
+	if c.opts.CancelWindow > 0 {
+		p.after = time.Duration(c.rng.Int63n(int64(c.opts.CancelWindow)))
+	}
+	if maxMessages > 0 {
+		p.afterMessages = c.rng.Intn(maxMessages)
+	}
+	return p
+}
+
+func (c *Client) callContext() (context.Context, context.CancelFunc) {
+	return c.callContextFrom(context.Background())
+}
+
+// callContextFrom is callContext, for a call also cancelled once parent is done.
+func (c *Client) callContextFrom(parent context.Context) (context.Context, context.CancelFunc) {
+	timeout := c.opts.Timeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+	return c.withTimeout(parent, timeout)
+}
+
+// withTimeout is context.WithTimeout for the context of a call, which ClientOptions.Audit, if set,
+// tracks until it is cancelled.
+func (c *Client) withTimeout(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	return ctx, c.opts.Audit.track(parent, ctx, cancel)
+}
+
+// recordedCancelPlan returns the cancelPlan recorded in r.
+func recordedCancelPlan(r *CallRecord) cancelPlan {
+	return cancelPlan{
+		cancel:        r.CancelPlanned,
+		after:         time.Duration(r.CancelAfterNS),
+		afterMessages: r.CancelAfterMessages,
+	}
+}
+
+func (c *Client) finish(r *CallRecord, p cancelPlan, err error) *CallRecord {
+	r.DurationNS = time.Since(r.StartTime).Nanoseconds()
+	if p.cancel {
+		r.CancelPlanned = true
+		r.CancelAfterNS = p.after.Nanoseconds()
+		r.CancelAfterMessages = p.afterMessages
+	}
+	s := status.Convert(err)
+	r.status = s
+	r.Code = s.Code().String()
+	if err != nil {
+		r.Error = err.Error()
+	}
+	r.Cancelled = p.cancel && isClientCancel(err)
+	if r.phases != nil {
+		r.phases.record(c, r, s.Code())
+		r.phases = nil
+	}
+	if r.Handshake == "" {
+		r.Handshake = c.handshake()
+	}
+	return r
+}
+
+// SayHello calls Greeter.SayHello over conn.
+func (c *Client) SayHello(conn *grpc.ClientConn, name string) *CallRecord {
+	return c.sayHello(context.Background(), conn, name, c.planCancel(0))
+}
+
+func (c *Client) sayHello(parent context.Context, conn *grpc.ClientConn, name string, p cancelPlan) *CallRecord {
+	return c.unary(parent, "SayHello", name, p, pb.NewGreeterClient(conn).SayHello)
+}
+
+// SayHelloAgain calls Greeter.SayHelloAgain over conn.
+func (c *Client) SayHelloAgain(conn *grpc.ClientConn, name string) *CallRecord {
+	return c.unary(context.Background(), "SayHelloAgain", name, c.planCancel(0), pb.NewGreeterClient(conn).SayHelloAgain)
+}
+
+// SayHi calls Greeter2.SayHi over conn.
+func (c *Client) SayHi(conn *grpc.ClientConn, name string) *CallRecord {
+	return c.unary(context.Background(), "SayHi", name, c.planCancel(0), pb.NewGreeter2Client(conn).SayHi)
+}
+
+// unary makes the unary call to method with name, through call.
+func (c *Client) unary(parent context.Context, method, name string, p cancelPlan,
+	call func(ctx context.Context, in *pb.HelloRequest, opts ...grpc.CallOption) (*pb.HelloReply, error)) *CallRecord {
+	r := newCallRecord(method)
+	r.Names = []string{name}
+
+	ctx, cancel := c.callContextFrom(parent)
+	defer cancel()
+	ctx = withRequestID(c.withPhases(ctx, r), r)
+	if p.cancel {
+		t := time.AfterFunc(p.after, cancel)
+		defer t.Stop()
+	}
+
+	var reply *pb.HelloReply
+	var trailer metadata.MD
+	var err error
+	if c.opts.HedgeDelay > 0 {
+		reply, trailer, err = c.hedge(ctx, r, &pb.HelloRequest{Name: name}, call)
+	} else {
+		reply, err = call(ctx, &pb.HelloRequest{Name: name}, grpc.Trailer(&trailer), withRecord(r))
+	}
+	setAttempt(r, trailer)
+	c.setCache(r, trailer)
+	if err == nil {
+		log.Printf("Greeting: %s request_id=%s", reply.Message, r.RequestID)
+		r.InstanceID = reply.InstanceId
+		c.verifyReply(r, 0, reply)
+	}
+	return c.finish(r, p, err)
+}
+
+// ServerStreaming calls StreamingGreeter.SayHelloServerStreaming over conn and reads every reply.
+func (c *Client) ServerStreaming(conn *grpc.ClientConn, name string) *CallRecord {
+	return c.serverStreaming(context.Background(), conn, name, c.opts.StreamCount, c.planServerStreamingCancel(), nil)
+}
+
+// planServerStreamingCancel plans the cancellation of a server streaming call asking for
+// ClientOptions.StreamCount replies.
+func (c *Client) planServerStreamingCancel() cancelPlan {
+	expected := int(c.opts.StreamCount)
+	if expected <= 0 {
+		// The server sends 3 replies per call by default.
+		expected = 3
+	}
+	return c.planCancel(expected)
+}
+
+// serverStreaming is ServerStreaming, asking for count replies, cancelled as planned by p, and
+// calling onFirstReply, if not nil, once the first reply is received.
+func (c *Client) serverStreaming(parent context.Context, conn *grpc.ClientConn, name string, count int32, p cancelPlan, onFirstReply func()) *CallRecord {
+	r := newCallRecord("SayHelloServerStreaming")
+	r.Names = []string{name}
+	r.StreamCount = count
+	if _, ok := KillAfter(name); ok {
+		// A KillListener cuts the stream short, which the client sees as its connection closing.
+		r.ExpectedCode = codes.Unavailable.String()
+	}
+
+	ctx, cancel := c.callContextFrom(parent)
+	defer cancel()
+	ctx = withRequestID(c.withPhases(ctx, r), r)
+
+	req := &pb.HelloRequest{Name: name, Count: count}
+	stream, err := pb.NewStreamingGreeterClient(conn).SayHelloServerStreaming(ctx, req, withRecord(r))
+	if err != nil {
+		return c.finish(r, p, err)
+	}
+	var sum pb.StreamChecksum
+	for i := 0; ; i++ {
+		if p.cancel && i == p.afterMessages {
+			cancel()
+		}
+		if c.opts.RecvInterval > 0 {
+			time.Sleep(c.opts.RecvInterval)
+		}
+		item, err := stream.Recv()
+		if c.opts.RecvInterval > 0 && err == nil {
+			r.RecvTimesNS = append(r.RecvTimesNS, time.Now().UnixNano())
+		}
+		if err != nil {
+			setAttempt(r, stream.Trailer())
+		}
+		if err == io.EOF {
+			c.verifyStream(r, stream.Trailer(), sum)
+			return c.finish(r, p, nil)
+		}
+		if err != nil {
+			return c.finish(r, p, err)
+		}
+		if c.opts.RecvInterval == 0 {
+			log.Printf("%s request_id=%s seq=%d", item.Message, r.RequestID, i)
+		}
+		r.Replies++
+		r.InstanceID = item.InstanceId
+		c.verifyReply(r, i, item)
+		sum.Add(item.Message)
+		if i == 0 && onFirstReply != nil {
+			onFirstReply()
+		}
+	}
+}
+
+// ClientStreaming calls StreamingGreeter.SayHelloClientStreaming over conn, sending one request per name.
+func (c *Client) ClientStreaming(conn *grpc.ClientConn, names []string) *CallRecord {
+	return c.clientStreaming(context.Background(), conn, names, c.planCancel(len(names)))
+}
+
+func (c *Client) clientStreaming(parent context.Context, conn *grpc.ClientConn, names []string, p cancelPlan) *CallRecord {
+	r := newCallRecord("SayHelloClientStreaming")
+	r.Names = append([]string(nil), names...)
+
+	ctx, cancel := c.callContextFrom(parent)
+	defer cancel()
+	ctx = withRequestID(c.withPhases(ctx, r), r)
+
+	stream, err := pb.NewStreamingGreeterClient(conn).SayHelloClientStreaming(ctx, withRecord(r))
+	if err != nil {
+		return c.finish(r, p, err)
+	}
+	for i, name := range names {
+		if p.cancel && i == p.afterMessages {
+			cancel()
+		}
+		if err := stream.Send(&pb.HelloRequest{Name: name}); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return c.finish(r, p, err)
+		}
+	}
+	reply, err := stream.CloseAndRecv()
+	setAttempt(r, stream.Trailer())
+	if err == nil {
+		log.Printf("%s request_id=%s", reply.Message, r.RequestID)
+		r.InstanceID = reply.InstanceId
+		c.verifyReply(r, 0, reply)
+	}
+	return c.finish(r, p, err)
+}
+
+// BidirStreaming calls StreamingGreeter.SayHelloBidirStreaming over conn, waiting for a reply to each name
+// before sending the next one.
+func (c *Client) BidirStreaming(conn *grpc.ClientConn, names []string) *CallRecord {
+	return c.bidirStreaming(context.Background(), conn, names, c.planCancel(len(names)))
+}
+
+func (c *Client) bidirStreaming(parent context.Context, conn *grpc.ClientConn, names []string, p cancelPlan) *CallRecord {
+	r := newCallRecord("SayHelloBidirStreaming")
+	r.Names = append([]string(nil), names...)
+
+	ctx, cancel := c.callContextFrom(parent)
+	defer cancel()
+	ctx = withRequestID(c.withPhases(ctx, r), r)
+
+	stream, err := pb.NewStreamingGreeterClient(conn).SayHelloBidirStreaming(ctx, withRecord(r))
+	if err != nil {
+		return c.finish(r, p, err)
+	}
+	var sum pb.StreamChecksum
+	for i, name := range names {
+		if p.cancel && i == p.afterMessages {
+			cancel()
+		}
+		if err := stream.Send(&pb.HelloRequest{Name: name}); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return c.finish(r, p, err)
+		}
+		reply, err := stream.Recv()
+		if err != nil {
+			setAttempt(r, stream.Trailer())
+		}
+		if err == io.EOF {
+			c.verifyStream(r, stream.Trailer(), sum)
+			return c.finish(r, p, nil)
+		}
+		if err != nil {
+			return c.finish(r, p, err)
+		}
+		log.Printf("%s request_id=%s seq=%d", reply.Message, r.RequestID, i)
+		r.Replies++
+		r.InstanceID = reply.InstanceId
+		c.verifyReply(r, i, reply)
+		sum.Add(reply.Message)
+	}
+	if err := stream.CloseSend(); err != nil {
+		return c.finish(r, p, err)
+	}
+	// Wait for the server to end the stream, so that the call completes with its final status.
+	for {
+		if _, err := stream.Recv(); err != nil {
+			setAttempt(r, stream.Trailer())
+			if err == io.EOF {
+				c.verifyStream(r, stream.Trailer(), sum)
+				err = nil
+			}
+			return c.finish(r, p, err)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/stats"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// serverSetup configures startServerWith. The zero value serves every greet service of a Server
+// with the default options.
+type serverSetup struct {
+	// Options are the options of the Server.
+	Options *greetworkload.ServerOptions
+	// GRPC are the options of the grpc.Server. A stats.Handler goes in Stats instead.
+	GRPC []grpc.ServerOption
+	// Stats is the stats.Handler of the grpc.Server, if any. It is wrapped by the one of the
+	// Server, which counts its context errors, as a grpc.Server only takes one.
+	Stats stats.Handler
+	// Register registers the services of the grpc.Server, in place of the greet services of
+	// greeter.
+	Register func(s *grpc.Server, greeter *greetworkload.Server)
+	// Listener is served in place of a new loopback listener.
+	Listener net.Listener
+	// Wrap wraps the listener, if not nil.
+	Wrap func(lis net.Listener) net.Listener
+	// H2C, if not nil, has the grpc.Server served as h2c by an http.Server, with these settings.
+	H2C *greetworkload.HTTP2Settings
+}
+
+// testServer is a server started by startServerWith.
+type testServer struct {
+	Greeter *greetworkload.Server
+	GRPC    *grpc.Server
+	// Addr and Port are those of the listener, before it is wrapped.
+	Addr string
+	Port int
+}
+
+// startServerWith serves a Server as set up, until the test ends.
+func startServerWith(t *testing.T, setup *serverSetup) *testServer {
+	lis := setup.Listener
+	if lis == nil {
+		var err error
+		lis, err = net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+	}
+	greeter := greetworkload.NewServer(setup.Options)
+	s := grpc.NewServer(append([]grpc.ServerOption{grpc.StatsHandler(greeter.StatsHandler(setup.Stats))}, setup.GRPC...)...)
+	register := setup.Register
+	if register == nil {
+		register = registerGreeter
+	}
+	register(s, greeter)
+	started := &testServer{Greeter: greeter, GRPC: s, Addr: lis.Addr().String()}
+	if addr, ok := lis.Addr().(*net.TCPAddr); ok {
+		started.Port = addr.Port
+	}
+	if setup.Wrap != nil {
+		lis = setup.Wrap(lis)
+	}
+	if setup.H2C != nil {
+		srv := &http.Server{Handler: greetworkload.NewH2CHandler(s, setup.H2C)}
+		go func() { _ = srv.Serve(lis) }()
+		t.Cleanup(func() { srv.Close() })
+		return started
+	}
+	go func() { _ = s.Serve(lis) }()
+	t.Cleanup(s.Stop)
+	return started
+}
+
+// registerGreeter registers every greet service of greeter on s.
+func registerGreeter(s *grpc.Server, greeter *greetworkload.Server) {
+	pb.RegisterGreeterServer(s, greeter)
+	pb.RegisterGreeter2Server(s, greeter)
+	pb.RegisterStreamingGreeterServer(s, greeter)
+}
+
+// startServer serves every greet service of a Server with opts on a loopback port, until the test
+// ends, and returns the Server and its address.
+func startServer(t *testing.T, opts *greetworkload.ServerOptions) (*greetworkload.Server, string) {
+	s := startServerWith(t, &serverSetup{Options: opts})
+	return s.Greeter, s.Addr
+}
+
+func TestClient_NoCancellation(t *testing.T) {
+	_, addr := startServer(t, nil)
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	names := []string{"a", "b", "c"}
+	for _, r := range []*greetworkload.CallRecord{
+		c.SayHello(conn, "a"),
+		c.ServerStreaming(conn, "a"),
+		c.ClientStreaming(conn, names),
+		c.BidirStreaming(conn, names),
+	} {
+		assert.True(t, r.Completed(), "%s: %s", r.Method, r.Error)
+		assert.False(t, r.Cancelled)
+	}
+}
+
+func TestClient_SizedCodec(t *testing.T) {
+	addr := startServerWith(t, &serverSetup{
+		Options: &greetworkload.ServerOptions{InstanceID: "sized", Checksums: true},
+		GRPC:    []grpc.ServerOption{grpc.ForceServerCodec(pb.SizedCodec{})},
+		Register: func(s *grpc.Server, greeter *greetworkload.Server) {
+			registerGreeter(s, greeter)
+			healthpb.RegisterHealthServer(s, health.NewServer())
+		},
+	}).Addr
+
+	// Clients with and without the codec can call a server that forces it.
+	for _, sized := range []bool{true, false} {
+		c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, SizedCodec: sized, VerifyChecksums: true})
+		conn, err := c.Dial(addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		names := []string{"a", "b", "c"}
+		for _, r := range []*greetworkload.CallRecord{
+			c.SayHello(conn, "a"),
+			c.ServerStreaming(conn, "a"),
+			c.ClientStreaming(conn, names),
+			c.BidirStreaming(conn, names),
+		} {
+			assert.True(t, r.Completed(), "%s: %s", r.Method, r.Error)
+			assert.Equal(t, "sized", r.InstanceID)
+		}
+		assert.Zero(t, c.ChecksumMismatches())
+
+		// Messages of other services fall back to the default codec.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}, grpc.ForceCodec(pb.SizedCodec{}))
+		require.NoError(t, err)
+		assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+	}
+}
+
+// payloadRecorder is a stats.Handler that keeps the bytes of every message sent and received.
+type payloadRecorder struct {
+	mu       sync.Mutex
+	sent     [][]byte
+	received [][]byte
+}
+
+func (r *payloadRecorder) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (r *payloadRecorder) HandleRPC(_ context.Context, s stats.RPCStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch s := s.(type) {
+	case *stats.OutPayload:
+		r.sent = append(r.sent, s.Data)
+	case *stats.InPayload:
+		r.received = append(r.received, s.Data)
+	}
+}
+
+func (r *payloadRecorder) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (r *payloadRecorder) HandleConn(context.Context, stats.ConnStats) {}
+
+func TestClient_DeterministicCodec(t *testing.T) {
+	// Echoes a message with a map field, which the generated greetpb messages do not have yet.
+	addr := startServerWith(t, &serverSetup{
+		GRPC: []grpc.ServerOption{grpc.ForceServerCodec(pb.DeterministicCodec{}),
+			grpc.UnknownServiceHandler(func(_ interface{}, stream grpc.ServerStream) error {
+				m := &types.Struct{}
+				if err := stream.RecvMsg(m); err != nil {
+					return err
+				}
+				return stream.SendMsg(m)
+			})},
+		Register: func(*grpc.Server, *greetworkload.Server) {},
+	}).Addr
+
+	payloads := &payloadRecorder{}
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, DeterministicCodec: true})
+	conn, err := c.Dial(addr, grpc.WithStatsHandler(payloads))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	m := &types.Struct{Fields: make(map[string]*types.Value)}
+	for i := 0; i < 32; i++ {
+		m.Fields[fmt.Sprintf("key-%02d", i)] = &types.Value{Kind: &types.Value_StringValue{StringValue: "pixie"}}
+	}
+	want, err := pb.MarshalDeterministic(m)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		reply := &types.Struct{}
+		require.NoError(t, conn.Invoke(ctx, "/px.test.Echo/Echo", m, reply))
+		cancel()
+		assert.True(t, m.Equal(reply))
+	}
+
+	// Both the requests and the echoed replies went through the codec.
+	require.Len(t, payloads.sent, 10)
+	require.Len(t, payloads.received, 10)
+	for i := range payloads.sent {
+		assert.Equal(t, want, payloads.sent[i], "request #%d", i)
+		assert.Equal(t, want, payloads.received[i], "reply #%d", i)
+	}
+}
+
+func TestClient_DeterministicCodecNotSized(t *testing.T) {
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{SizedCodec: true, DeterministicCodec: true})
+	_, err := c.Dial("127.0.0.1:1")
+	assert.ErrorIs(t, err, greetworkload.ErrBadFlagCombination)
+}
+
+func TestClient_CancelFraction(t *testing.T) {
+	greeter, addr := startServer(t, nil)
+
+	const numCalls = 300
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{
+		Timeout:        5 * time.Second,
+		CancelFraction: 0.3,
+		Seed:           1,
+	})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	names := []string{"a", "b", "c", "d", "e"}
+	var records []*greetworkload.CallRecord
+	cancelled := 0
+	for i := 0; i < numCalls; i++ {
+		r := c.BidirStreaming(conn, names)
+		require.True(t, r.Completed() || r.Cancelled, r.Error)
+		if r.Cancelled {
+			cancelled++
+		}
+		records = append(records, r)
+	}
+
+	// The fraction is only honored statistically.
+	assert.InDelta(t, 0.3*numCalls, cancelled, 0.1*numCalls)
+
+	// Streams cancelled before reaching the server are never seen by a handler.
+	const tolerance = 0.1 * numCalls
+	assert.Eventually(t, func() bool {
+		d := float64(int64(cancelled) - greeter.ContextErrors())
+		return d >= 0 && d <= tolerance
+	}, 5*time.Second, 10*time.Millisecond, "client cancelled %d, server observed %d", cancelled, greeter.ContextErrors())
+
+	var buf bytes.Buffer
+	require.NoError(t, greetworkload.WriteRecords(&buf, nil, records))
+	dec := json.NewDecoder(&buf)
+	decodedCancelled := 0
+	for dec.More() {
+		var r greetworkload.CallRecord
+		require.NoError(t, dec.Decode(&r))
+		if r.Cancelled {
+			decodedCancelled++
+		}
+	}
+	assert.Equal(t, cancelled, decodedCancelled)
+}
@@ -0,0 +1,282 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// ClockProbeHeader marks a call as a clock probe, and carries the client's wall and monotonic
+	// clocks when it sent the call, "<wall_ns>,<mono_ns>". The client's latest estimate, if any,
+	// follows as ",<offset_ns>,<rtt_ns>".
+	ClockProbeHeader = "x-clock-probe"
+	// ClockReplyHeader carries the server's wall clock when it received and answered a clock probe,
+	// and its monotonic clock, "<recv_ns>,<send_ns>,<mono_ns>".
+	ClockReplyHeader = "x-clock-reply"
+)
+
+// Clock reads the wall and monotonic clocks, in nanoseconds.
+type Clock interface {
+	// WallNS returns the wall clock, in Unix nanoseconds.
+	WallNS() int64
+	// MonoNS returns the monotonic clock, or 0 on platforms without FeatureMonotonicClock.
+	MonoNS() int64
+}
+
+type systemClock struct{}
+
+func (systemClock) WallNS() int64 {
+	return time.Now().UnixNano()
+}
+
+// SystemClock is the clock of the host.
+var SystemClock Clock = systemClock{}
+
+// ClockEstimate is how far the server's wall clock is ahead of the client's.
+type ClockEstimate struct {
+	OffsetNS int64 `json:"offset_ns"`
+	// RTTNS is the round trip of the probe the estimate comes from, not counting the time the
+	// server took to answer. The offset is off by at most half of it.
+	RTTNS int64 `json:"rtt_ns"`
+}
+
+// EstimateClockOffset estimates the offset of the server's clock from the four wall clock readings
+// of a probe: when the client sent it, when the server received and answered it, and when the
+// client received the answer. The estimate assumes the network delay is the same both ways; the
+// error is half the difference between the two, and so at most half the round trip.
+func EstimateClockOffset(clientSend, serverRecv, serverSend, clientRecv int64) ClockEstimate {
+	return ClockEstimate{
+		OffsetNS: ((serverRecv - clientSend) + (serverSend - clientRecv)) / 2,
+		RTTNS:    (clientRecv - clientSend) - (serverSend - serverRecv),
+	}
+}
+
+// ClockSample is what a side recorded of a clock probe.
+type ClockSample struct {
+	ClientSendNS     int64 `json:"client_send_ns"`
+	ClientSendMonoNS int64 `json:"client_send_mono_ns"`
+	ServerRecvNS     int64 `json:"server_recv_ns"`
+	ServerSendNS     int64 `json:"server_send_ns"`
+	ServerSendMonoNS int64 `json:"server_send_mono_ns"`
+	// ClientRecvNS is only known to the client.
+	ClientRecvNS int64 `json:"client_recv_ns,omitempty"`
+	// Estimate is, for the client, the estimate made from the probe, and for the server, the best
+	// estimate the client had made before sending it, if any.
+	Estimate *ClockEstimate `json:"estimate,omitempty"`
+}
+
+// BestClockEstimate returns the estimate with the smallest round trip among samples, which bounds
+// its error the most tightly, or nil if there is none.
+func BestClockEstimate(samples []ClockSample) *ClockEstimate {
+	var best *ClockEstimate
+	for _, s := range samples {
+		if s.Estimate != nil && (best == nil || s.Estimate.RTTNS < best.RTTNS) {
+			best = s.Estimate
+		}
+	}
+	return best
+}
+
+// parseInts parses the comma-separated integers of a clock header.
+func parseInts(s string) ([]int64, error) {
+	fields := strings.Split(s, ",")
+	v := make([]int64, len(fields))
+	for i, f := range fields {
+		var err error
+		if v[i], err = strconv.ParseInt(f, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// ProbeClock sends a clock probe over conn, as a health check, and returns what it yields. The
+// latest estimate of the client, if not nil, is sent along for the server to record.
+func ProbeClock(ctx context.Context, conn *grpc.ClientConn, clock Clock, latest *ClockEstimate) (*ClockSample, error) {
+	s := &ClockSample{ClientSendMonoNS: clock.MonoNS(), ClientSendNS: clock.WallNS()}
+	probe := fmt.Sprintf("%d,%d", s.ClientSendNS, s.ClientSendMonoNS)
+	if latest != nil {
+		probe += fmt.Sprintf(",%d,%d", latest.OffsetNS, latest.RTTNS)
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, ClockProbeHeader, probe)
+	var header metadata.MD
+	_, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Header(&header))
+	s.ClientRecvNS = clock.WallNS()
+	if err != nil {
+		return nil, err
+	}
+	v := header.Get(ClockReplyHeader)
+	if len(v) != 1 {
+		return nil, fmt.Errorf("the server did not answer the clock probe")
+	}
+	reply, err := parseInts(v[0])
+	if err == nil && len(reply) != 3 {
+		err = fmt.Errorf("expected 3 fields, got %d", len(reply))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s header: %w", ClockReplyHeader, err)
+	}
+	s.ServerRecvNS, s.ServerSendNS, s.ServerSendMonoNS = reply[0], reply[1], reply[2]
+	est := EstimateClockOffset(s.ClientSendNS, s.ServerRecvNS, s.ServerSendNS, s.ClientRecvNS)
+	s.Estimate = &est
+	return s, nil
+}
+
+// ClockSyncer probes the clock of a server periodically, for the duration of a run.
+type ClockSyncer struct {
+	conn  *grpc.ClientConn
+	clock Clock
+
+	mu      sync.Mutex
+	samples []ClockSample
+}
+
+// NewClockSyncer creates a ClockSyncer that probes the server at the other end of conn.
+func NewClockSyncer(conn *grpc.ClientConn, clock Clock) *ClockSyncer {
+	return &ClockSyncer{conn: conn, clock: clock}
+}
+
+// Run probes the server every interval until ctx is done. Failed probes are logged and skipped.
+func (s *ClockSyncer) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := s.Probe(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Clock probe failed: %v", err)
+		}
+	}
+}
+
+// Probe probes the server once.
+func (s *ClockSyncer) Probe(ctx context.Context) error {
+	sample, err := ProbeClock(ctx, s.conn, s.clock, s.Estimate())
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples = append(s.samples, *sample)
+	return nil
+}
+
+// Samples returns the samples of the probes made so far.
+func (s *ClockSyncer) Samples() []ClockSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ClockSample(nil), s.samples...)
+}
+
+// Estimate returns the best estimate so far, or nil before the first probe.
+func (s *ClockSyncer) Estimate() *ClockEstimate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return BestClockEstimate(s.samples)
+}
+
+// ClockSyncServer answers the clock probes made to a server, and records them.
+type ClockSyncServer struct {
+	clock Clock
+
+	mu      sync.Mutex
+	samples []ClockSample
+}
+
+// NewClockSyncServer creates a new ClockSyncServer.
+func NewClockSyncServer(clock Clock) *ClockSyncServer {
+	return &ClockSyncServer{clock: clock}
+}
+
+// UnaryServerInterceptor answers the unary calls that carry ClockProbeHeader. It should come first
+// in the chain, so that the readings it sends are as close as possible to the network.
+func (s *ClockSyncServer) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		v := md.Get(ClockProbeHeader)
+		if len(v) != 1 {
+			return handler(ctx, req)
+		}
+		recv := s.clock.WallNS()
+		resp, err := handler(ctx, req)
+		sample := ClockSample{ServerRecvNS: recv, ServerSendMonoNS: s.clock.MonoNS(), ServerSendNS: s.clock.WallNS()}
+		reply := fmt.Sprintf("%d,%d,%d", sample.ServerRecvNS, sample.ServerSendNS, sample.ServerSendMonoNS)
+		if setErr := grpc.SetHeader(ctx, metadata.Pairs(ClockReplyHeader, reply)); setErr != nil {
+			log.Printf("Failed to answer clock probe: %v", setErr)
+		}
+		s.record(sample, v[0])
+		return resp, err
+	}
+}
+
+// record completes sample with the client's side of probe, and records it. Invalid probes are
+// answered but not recorded.
+func (s *ClockSyncServer) record(sample ClockSample, probe string) {
+	v, err := parseInts(probe)
+	if err != nil || (len(v) != 2 && len(v) != 4) {
+		return
+	}
+	sample.ClientSendNS, sample.ClientSendMonoNS = v[0], v[1]
+	if len(v) == 4 {
+		sample.Estimate = &ClockEstimate{OffsetNS: v[2], RTTNS: v[3]}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples = append(s.samples, sample)
+}
+
+// Samples returns the samples of the probes answered so far.
+func (s *ClockSyncServer) Samples() []ClockSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ClockSample(nil), s.samples...)
+}
+
+// WriteClockSamples writes samples to w as a JSON array.
+func WriteClockSamples(w io.Writer, samples []ClockSample) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(samples)
+}
+
+// AlignRecords moves the timestamps of records, taken by the client, onto the server's clock,
+// given the estimated offset between the two.
+func AlignRecords(records []*CallRecord, est ClockEstimate) {
+	for _, r := range records {
+		r.StartTime = r.StartTime.Add(time.Duration(est.OffsetNS))
+		for i := range r.RecvTimesNS {
+			r.RecvTimesNS[i] += est.OffsetNS
+		}
+	}
+}
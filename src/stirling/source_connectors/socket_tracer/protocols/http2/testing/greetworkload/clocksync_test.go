@@ -0,0 +1,209 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// fakeClock plays back a script of wall clock readings, so that a probe sees any latency, one way
+// or the other, regardless of how long it really took.
+type fakeClock struct {
+	mu    sync.Mutex
+	walls []int64
+	mono  int64
+}
+
+func (c *fakeClock) WallNS() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v := c.walls[0]
+	c.walls = c.walls[1:]
+	return v
+}
+
+func (c *fakeClock) MonoNS() int64 {
+	return c.mono
+}
+
+// probeTimes are the readings of a probe, on the client's and the server's clocks, when the
+// server's clock is offset ahead of the client's, the probe takes up to reach the server and down
+// to come back, and the server takes process to answer.
+func probeTimes(offset, up, down, process int64) (clientSend, serverRecv, serverSend, clientRecv int64) {
+	clientSend = 1_000_000
+	serverRecv = clientSend + up + offset
+	serverSend = serverRecv + process
+	clientRecv = serverSend - offset + down
+	return
+}
+
+func TestEstimateClockOffset_AsymmetricLatency(t *testing.T) {
+	for _, tc := range []struct {
+		name                      string
+		offset, up, down, process int64
+	}{
+		{"symmetric", 5000, 100, 100, 30},
+		{"in sync", 0, 100, 100, 0},
+		{"server behind", -7000, 250, 250, 10},
+		{"slow uplink", 5000, 900, 100, 30},
+		{"slow downlink", -5000, 100, 900, 30},
+		{"one way only", 1000, 0, 600, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			est := greetworkload.EstimateClockOffset(probeTimes(tc.offset, tc.up, tc.down, tc.process))
+			assert.Equal(t, tc.up+tc.down, est.RTTNS)
+			// Half the asymmetry is mistaken for offset, which is never more than half the round trip.
+			assert.Equal(t, tc.offset+(tc.up-tc.down)/2, est.OffsetNS)
+			assert.LessOrEqual(t, abs(est.OffsetNS-tc.offset), est.RTTNS/2)
+		})
+	}
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func TestBestClockEstimate(t *testing.T) {
+	assert.Nil(t, greetworkload.BestClockEstimate(nil))
+	samples := []greetworkload.ClockSample{
+		{Estimate: &greetworkload.ClockEstimate{OffsetNS: 10, RTTNS: 300}},
+		{},
+		{Estimate: &greetworkload.ClockEstimate{OffsetNS: 4, RTTNS: 80}},
+		{Estimate: &greetworkload.ClockEstimate{OffsetNS: 7, RTTNS: 120}},
+	}
+	assert.Equal(t, &greetworkload.ClockEstimate{OffsetNS: 4, RTTNS: 80}, greetworkload.BestClockEstimate(samples))
+}
+
+func startClockSyncServer(t *testing.T, clock greetworkload.Clock) (*greetworkload.ClockSyncServer, *grpc.ClientConn) {
+	clockSync := greetworkload.NewClockSyncServer(clock)
+	s := startServerWith(t, &serverSetup{
+		GRPC: []grpc.ServerOption{grpc.UnaryInterceptor(clockSync.UnaryServerInterceptor())},
+		Register: func(s *grpc.Server, _ *greetworkload.Server) {
+			healthpb.RegisterHealthServer(s, health.NewServer())
+		},
+	})
+
+	conn, err := grpc.Dial(s.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return clockSync, conn
+}
+
+func TestProbeClock_FakeClocks(t *testing.T) {
+	// The server is 5ms ahead, and the probe takes 3ms up and 1ms down.
+	clientSend, serverRecv, serverSend, clientRecv := probeTimes(5e6, 3e6, 1e6, 2e5)
+	clockSync, conn := startClockSyncServer(t, &fakeClock{walls: []int64{serverRecv, serverSend}, mono: 42})
+	clientClock := &fakeClock{walls: []int64{clientSend, clientRecv}, mono: 7}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	latest := &greetworkload.ClockEstimate{OffsetNS: 1, RTTNS: 2}
+	sample, err := greetworkload.ProbeClock(ctx, conn, clientClock, latest)
+	require.NoError(t, err)
+	assert.Equal(t, &greetworkload.ClockSample{
+		ClientSendNS:     clientSend,
+		ClientSendMonoNS: 7,
+		ServerRecvNS:     serverRecv,
+		ServerSendNS:     serverSend,
+		ServerSendMonoNS: 42,
+		ClientRecvNS:     clientRecv,
+		Estimate:         &greetworkload.ClockEstimate{OffsetNS: 6e6, RTTNS: 4e6},
+	}, sample)
+
+	// The server records its side of the probe, and the estimate the client sent along.
+	assert.Equal(t, []greetworkload.ClockSample{{
+		ClientSendNS:     clientSend,
+		ClientSendMonoNS: 7,
+		ServerRecvNS:     serverRecv,
+		ServerSendNS:     serverSend,
+		ServerSendMonoNS: 42,
+		Estimate:         latest,
+	}}, clockSync.Samples())
+}
+
+// offsetClock is the system clock, offset by a fixed amount.
+type offsetClock struct {
+	offset int64
+}
+
+func (c offsetClock) WallNS() int64 {
+	return greetworkload.SystemClock.WallNS() + c.offset
+}
+
+func (c offsetClock) MonoNS() int64 {
+	return greetworkload.SystemClock.MonoNS()
+}
+
+func TestClockSyncer_Run(t *testing.T) {
+	const offset = int64(time.Hour)
+	clockSync, conn := startClockSyncServer(t, offsetClock{offset: offset})
+	syncer := greetworkload.NewClockSyncer(conn, greetworkload.SystemClock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		syncer.Run(ctx, 10*time.Millisecond)
+	}()
+	require.Eventually(t, func() bool { return len(syncer.Samples()) >= 5 }, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+
+	est := syncer.Estimate()
+	require.NotNil(t, est)
+	assert.LessOrEqual(t, abs(est.OffsetNS-offset), est.RTTNS/2+1)
+	for _, s := range syncer.Samples() {
+		assert.Positive(t, s.ClientSendMonoNS)
+		assert.Positive(t, s.ServerSendMonoNS)
+	}
+	// Every probe after the first carries the client's best estimate so far.
+	served := clockSync.Samples()
+	require.GreaterOrEqual(t, len(served), 5)
+	assert.Nil(t, served[0].Estimate)
+	for _, s := range served[1:] {
+		require.NotNil(t, s.Estimate)
+		assert.InDelta(t, offset, s.Estimate.OffsetNS, float64(s.Estimate.RTTNS/2+1))
+	}
+}
+
+func TestAlignRecords(t *testing.T) {
+	start := time.Unix(100, 0)
+	records := []*greetworkload.CallRecord{
+		{StartTime: start},
+		{StartTime: start, RecvTimesNS: []int64{start.UnixNano(), start.UnixNano() + 10}},
+	}
+	greetworkload.AlignRecords(records, greetworkload.ClockEstimate{OffsetNS: -int64(time.Second)})
+	assert.Equal(t, time.Unix(99, 0), records[0].StartTime)
+	assert.Equal(t, time.Unix(99, 0), records[1].StartTime)
+	assert.Equal(t, []int64{time.Unix(99, 0).UnixNano(), time.Unix(99, 0).UnixNano() + 10}, records[1].RecvTimesNS)
+}
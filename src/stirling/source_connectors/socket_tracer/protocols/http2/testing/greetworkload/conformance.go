@@ -0,0 +1,254 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// ConformanceNamePrefix starts the names of the SayHello calls that a server with
+// ServerOptions.ConformanceNames answers with the status code that follows, e.g. "status-7" with
+// PermissionDenied. See ConformanceName.
+const ConformanceNamePrefix = "status-"
+
+// ConformanceChallengeTrailer is the trailer the Unauthenticated conformance call fails with, as
+// HTTP servers send WWW-Authenticate along with a 401, and ConformanceChallenge its value.
+const (
+	ConformanceChallengeTrailer = "www-authenticate"
+	ConformanceChallenge        = `Bearer realm="greet", error="invalid_token"`
+)
+
+// DefaultConformanceDeadline is the ConformanceOptions.Deadline of options that set none.
+const DefaultConformanceDeadline = 100 * time.Millisecond
+
+// ConformanceCodes are the canonical status codes, from OK to Unauthenticated.
+var ConformanceCodes = func() []codes.Code {
+	var cs []codes.Code
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		cs = append(cs, c)
+	}
+	return cs
+}()
+
+// ConformanceName returns the name of the conformance call answered with code.
+func ConformanceName(code codes.Code) string {
+	return ConformanceNamePrefix + strconv.Itoa(int(code))
+}
+
+// ParseConformanceName returns the code of the conformance call named name, and false if name is
+// not that of one.
+func ParseConformanceName(name string) (codes.Code, bool) {
+	if !strings.HasPrefix(name, ConformanceNamePrefix) {
+		return 0, false
+	}
+	n := strings.TrimPrefix(name, ConformanceNamePrefix)
+	code, err := strconv.ParseUint(n, 10, 32)
+	if err != nil || codes.Code(code) > codes.Unauthenticated || strconv.FormatUint(code, 10) != n {
+		return 0, false
+	}
+	return codes.Code(code), true
+}
+
+// conform answers the conformance call of code. Most codes are returned as they are, but:
+//   - OK replies as SayHello does.
+//   - Unknown is the code of handlers that fail with an error that is not a status.
+//   - DeadlineExceeded holds the call until its deadline expires, rather than failing it.
+//   - Unauthenticated sends ConformanceChallenge in the ConformanceChallengeTrailer trailer.
+func (s *Server) conform(ctx context.Context, in *pb.HelloRequest, code codes.Code) (*pb.HelloReply, error) {
+	switch code {
+	case codes.OK:
+		return s.reply("Hello " + in.Name), nil
+	case codes.Unknown:
+		return nil, errors.New("conformance: not a status")
+	case codes.DeadlineExceeded:
+		if _, ok := ctx.Deadline(); !ok {
+			return nil, status.Error(codes.DeadlineExceeded, "conformance: the call has no deadline to exceed")
+		}
+		<-ctx.Done()
+		return nil, status.FromContextError(ctx.Err()).Err()
+	case codes.Unauthenticated:
+		if err := grpc.SetTrailer(ctx, metadata.Pairs(ConformanceChallengeTrailer, ConformanceChallenge)); err != nil {
+			return nil, err
+		}
+	}
+	return nil, status.Errorf(code, "conformance: %s", code)
+}
+
+// ConformanceOptions configure Client.RunConformance.
+type ConformanceOptions struct {
+	// Codes are the codes to provoke, in order. Empty provokes every one of ConformanceCodes.
+	Codes []codes.Code
+	// Deadline is the deadline of the DeadlineExceeded call, which the server holds past it. The
+	// other calls take the timeout of the client. DefaultConformanceDeadline if zero.
+	Deadline time.Duration
+}
+
+// Validate checks that the options can be run.
+func (o *ConformanceOptions) Validate() error {
+	if o.Deadline < 0 {
+		return badFlagsf("the conformance deadline must not be negative, got %v", o.Deadline)
+	}
+	for _, c := range o.Codes {
+		if c > codes.Unauthenticated {
+			return badFlagsf("conformance code %d is not a canonical status code", c)
+		}
+	}
+	return nil
+}
+
+// ConformanceResult is the outcome of the conformance call of a code.
+type ConformanceResult struct {
+	Code codes.Code `json:"code"`
+	// Observed is the code the call finished with, as named in CallRecord.Code.
+	Observed string `json:"observed"`
+	Passed   bool   `json:"passed"`
+	// Error is why the call did not pass, if it did not.
+	Error  string      `json:"error,omitempty"`
+	Record *CallRecord `json:"record"`
+}
+
+// ConformanceError reports the codes whose conformance calls did not pass.
+type ConformanceError struct {
+	Failed []codes.Code
+}
+
+func (e *ConformanceError) Error() string {
+	names := make([]string, len(e.Failed))
+	for i, c := range e.Failed {
+		names[i] = c.String()
+	}
+	return fmt.Sprintf("conformance failed for %s", strings.Join(names, ", "))
+}
+
+// RunConformance makes a SayHello call over conn for every code of opts, one after the other, that
+// a server with ServerOptions.ConformanceNames fails with the code, and checks that it did. Every
+// call is recorded with the code as CallRecord.ExpectedCode. RunConformance returns the results of
+// every call, along with a *ConformanceError if any did not pass. If ctx is done, it stops, and
+// returns ctx.Err() with the results so far.
+func (c *Client) RunConformance(ctx context.Context, conn *grpc.ClientConn, opts *ConformanceOptions) ([]*ConformanceResult, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	ctx = c.opts.Audit.root(ctx)
+	cs := opts.Codes
+	if len(cs) == 0 {
+		cs = ConformanceCodes
+	}
+	deadline := opts.Deadline
+	if deadline == 0 {
+		deadline = DefaultConformanceDeadline
+	}
+	var results []*ConformanceResult
+	var failed []codes.Code
+	for _, code := range cs {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		res := c.conformanceCall(ctx, conn, code, deadline)
+		results = append(results, res)
+		if !res.Passed {
+			failed = append(failed, code)
+		}
+	}
+	if len(failed) > 0 {
+		return results, &ConformanceError{Failed: failed}
+	}
+	return results, nil
+}
+
+func (c *Client) conformanceCall(parent context.Context, conn *grpc.ClientConn, code codes.Code, deadline time.Duration) *ConformanceResult {
+	name := ConformanceName(code)
+	r := newCallRecord("SayHello")
+	r.Names = []string{name}
+	if code != codes.OK {
+		r.ExpectedCode = code.String()
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if code == codes.DeadlineExceeded {
+		ctx, cancel = c.withTimeout(parent, deadline)
+	} else {
+		ctx, cancel = c.callContextFrom(parent)
+	}
+	defer cancel()
+	ctx = withRequestID(c.withPhases(ctx, r), r)
+
+	var trailer metadata.MD
+	reply, err := pb.NewGreeterClient(conn).SayHello(ctx, &pb.HelloRequest{Name: name}, grpc.Trailer(&trailer), withRecord(r))
+	setAttempt(r, trailer)
+	if err == nil {
+		r.InstanceID = reply.InstanceId
+	}
+	c.finish(r, cancelPlan{}, err)
+
+	res := &ConformanceResult{Code: code, Observed: r.Code, Record: r}
+	switch {
+	case r.Code != code.String():
+		res.Error = fmt.Sprintf("expected %s, got %s", code, r.Code)
+		if r.Error != "" {
+			res.Error += ": " + r.Error
+		}
+	case code == codes.Unauthenticated && !hasChallenge(trailer):
+		res.Error = fmt.Sprintf("missing %s trailer %q", ConformanceChallengeTrailer, ConformanceChallenge)
+	default:
+		res.Passed = true
+	}
+	return res
+}
+
+func hasChallenge(trailer metadata.MD) bool {
+	for _, v := range trailer.Get(ConformanceChallengeTrailer) {
+		if v == ConformanceChallenge {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteConformanceTable writes a line per result to w, with whether it passed, its code, the code
+// observed and how long the call took.
+func WriteConformanceTable(w io.Writer, results []*ConformanceResult) error {
+	for _, r := range results {
+		verdict := "PASS"
+		if !r.Passed {
+			verdict = "FAIL"
+		}
+		line := fmt.Sprintf("%s %2d %-18s observed %-18s %v", verdict, r.Code, r.Code, r.Observed, time.Duration(r.Record.DurationNS))
+		if r.Error != "" {
+			line += "  " + r.Error
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+func runConformance(t *testing.T, addr string, opts *greetworkload.ConformanceOptions) ([]*greetworkload.ConformanceResult, error) {
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	return c.RunConformance(context.Background(), conn, opts)
+}
+
+func TestRunConformance_EveryCode(t *testing.T) {
+	_, addr := startServer(t, &greetworkload.ServerOptions{ConformanceNames: true})
+	const deadline = 50 * time.Millisecond
+	results, err := runConformance(t, addr, &greetworkload.ConformanceOptions{Deadline: deadline})
+	require.NoError(t, err)
+
+	require.Len(t, results, 17)
+	for i, res := range results {
+		code := codes.Code(i)
+		assert.Equal(t, code, res.Code)
+		assert.True(t, res.Passed, "%s: %s", code, res.Error)
+		assert.Equal(t, code.String(), res.Observed)
+		assert.Equal(t, []string{greetworkload.ConformanceName(code)}, res.Record.Names)
+		// Every call is recorded as the failure it was made to provoke, rather than a failure.
+		assert.NoError(t, res.Record.Err())
+		if code != codes.OK {
+			assert.Equal(t, code.String(), res.Record.ExpectedCode)
+		}
+	}
+	assert.GreaterOrEqual(t, time.Duration(results[codes.DeadlineExceeded].Record.DurationNS), deadline)
+
+	var table strings.Builder
+	require.NoError(t, greetworkload.WriteConformanceTable(&table, results))
+	lines := strings.Split(strings.TrimSpace(table.String()), "\n")
+	require.Len(t, lines, 17)
+	assert.Regexp(t, `^PASS  7 PermissionDenied +observed PermissionDenied `, lines[7])
+}
+
+func TestRunConformance_ServerWithoutConformanceNames(t *testing.T) {
+	_, addr := startServer(t, nil)
+	results, err := runConformance(t, addr, &greetworkload.ConformanceOptions{
+		Codes: []codes.Code{codes.OK, codes.Aborted, codes.DataLoss},
+	})
+
+	var confErr *greetworkload.ConformanceError
+	require.True(t, errors.As(err, &confErr), "%v", err)
+	assert.Equal(t, []codes.Code{codes.Aborted, codes.DataLoss}, confErr.Failed)
+	require.Len(t, results, 3)
+	assert.True(t, results[0].Passed)
+	assert.False(t, results[1].Passed)
+	assert.Equal(t, codes.OK.String(), results[1].Observed)
+	assert.Equal(t, "expected Aborted, got OK", results[1].Error)
+}
+
+func TestRunConformance_MissingChallenge(t *testing.T) {
+	// Fails every call with Unauthenticated, without the challenge.
+	addr := startServerWith(t, &serverSetup{GRPC: []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(context.Context, interface{}, *grpc.UnaryServerInfo, grpc.UnaryHandler) (interface{}, error) {
+			return nil, status.Error(codes.Unauthenticated, "no")
+		}),
+	}}).Addr
+
+	results, err := runConformance(t, addr, &greetworkload.ConformanceOptions{Codes: []codes.Code{codes.Unauthenticated}})
+	require.Error(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, codes.Unauthenticated.String(), results[0].Observed)
+	assert.False(t, results[0].Passed)
+	assert.Contains(t, results[0].Error, greetworkload.ConformanceChallengeTrailer)
+}
+
+func TestRunConformance_StopsWithContext(t *testing.T) {
+	_, addr := startServer(t, &greetworkload.ServerOptions{ConformanceNames: true})
+	c, _ := newAuditedClient(t, &greetworkload.ClientOptions{})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err := c.RunConformance(ctx, conn, &greetworkload.ConformanceOptions{})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, results)
+}
+
+func TestParseConformanceName(t *testing.T) {
+	for _, code := range greetworkload.ConformanceCodes {
+		got, ok := greetworkload.ParseConformanceName(greetworkload.ConformanceName(code))
+		assert.True(t, ok)
+		assert.Equal(t, code, got)
+	}
+	for _, name := range []string{"", "status-", "status-17", "status--1", "status-07", "status-+7", "status-7 ", "Status-7", "7", "pixie"} {
+		_, ok := greetworkload.ParseConformanceName(name)
+		assert.False(t, ok, "%q", name)
+	}
+}
+
+func TestConformanceOptions_Validate(t *testing.T) {
+	assert.NoError(t, (&greetworkload.ConformanceOptions{}).Validate())
+	assert.NoError(t, (&greetworkload.ConformanceOptions{Codes: []codes.Code{codes.Unauthenticated}, Deadline: time.Second}).Validate())
+	for _, opts := range []*greetworkload.ConformanceOptions{
+		{Deadline: -time.Millisecond},
+		{Codes: []codes.Code{codes.Unauthenticated + 1}},
+	} {
+		assert.ErrorIs(t, opts.Validate(), greetworkload.ErrBadFlagCombination, "%+v", opts)
+	}
+}
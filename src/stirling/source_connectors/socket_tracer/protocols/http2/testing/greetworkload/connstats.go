@@ -0,0 +1,518 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+// ConnStats is the workload's ground truth for a single TCP connection.
+type ConnStats struct {
+	// LocalAddr and RemoteAddr are rendered by CanonicalAddr, e.g. "127.0.0.1:50051" or
+	// "[::1]:50051".
+	LocalAddr     string `json:"local_addr"`
+	RemoteAddr    string `json:"remote_addr"`
+	RPCsStarted   int64  `json:"rpcs_started"`
+	RPCsCompleted int64  `json:"rpcs_completed"`
+	// WireBytesIn and WireBytesOut count the bytes of gRPC messages received and sent, including
+	// the 5-byte message prefix, after compression. HTTP/2 framing is not included.
+	WireBytesIn  int64 `json:"wire_bytes_in"`
+	WireBytesOut int64 `json:"wire_bytes_out"`
+	// MessagesIn and MessagesOut count the gRPC messages received and sent.
+	MessagesIn  int64     `json:"messages_in"`
+	MessagesOut int64     `json:"messages_out"`
+	OpenTime    time.Time `json:"open_time"`
+	// CloseTime is nil if the connection was still open when the stats were collected.
+	CloseTime *time.Time `json:"close_time"`
+	// TLSVersion and TLSCipherSuite are negotiated by TLS connections, once an RPC is made over
+	// them. Connections secured outside of gRPC, e.g. by a TLS listener, are not seen as TLS.
+	TLSVersion     string `json:"tls_version,omitempty"`
+	TLSCipherSuite string `json:"tls_cipher_suite,omitempty"`
+	// PeerCertSerial is the serial, in hex, of the certificate the peer presented on a TLS
+	// connection, if any. Set alongside TLSVersion.
+	PeerCertSerial string `json:"peer_cert_serial,omitempty"`
+	// Termination is how the client ended the connection, if not as usual. One of the Termination
+	// constants.
+	Termination string `json:"termination,omitempty"`
+	// Settings are the HTTP/2 settings this side advertised in its first SETTINGS frame, by name,
+	// e.g. INITIAL_WINDOW_SIZE. Settings left out were left at their defaults. They are only seen on
+	// connections from a ConnStatsHandler's WrapListener or Dialer that are not secured by TLS.
+	Settings map[string]uint32 `json:"settings,omitempty"`
+	// WindowUpdatesOut counts the WINDOW_UPDATE frames this side sent, on the same connections as
+	// Settings.
+	WindowUpdatesOut int64 `json:"window_updates_out,omitempty"`
+	// ContinuationFramesOut counts the CONTINUATION frames this side sent, which carry the header
+	// blocks that do not fit a single frame, on the same connections as Settings.
+	ContinuationFramesOut int64 `json:"continuation_frames_out,omitempty"`
+	// Socket holds the TCP socket options of the connection, read back once it is set up. Only
+	// recorded on Linux, for connections from a ConnStatsHandler's WrapListener or Dialer.
+	Socket *SocketState `json:"socket,omitempty"`
+	// Shaping holds the bandwidth and delay the connection is shaped with, if by a Shaper wrapped
+	// below a ConnStatsHandler's WrapListener or Dialer.
+	Shaping *ShapingOptions `json:"shaping,omitempty"`
+	// DialAttempts are the attempts a DialRacer made to set up the connection, the aborted ones
+	// included, in the order they started. Only recorded for connections from a
+	// ConnStatsHandler's Dialer dialing with a DialRacer.
+	DialAttempts []DialAttempt `json:"dial_attempts,omitempty"`
+}
+
+type connKey struct {
+	local, remote string
+}
+
+func newConnKey(local, remote net.Addr) connKey {
+	return connKey{local: CanonicalAddr(local), remote: CanonicalAddr(remote)}
+}
+
+type connCtxKey struct{}
+
+type rpcCtxKey struct{}
+
+// rpcState links an RPC to its connection, which is only known once its headers are seen.
+type rpcState struct {
+	conn *ConnStats
+	// row is the RPCRow of the RPC, if the handler keeps them.
+	row *RPCRow
+}
+
+// ConnStatsHandler is a grpc stats.Handler that tracks the RPCs and bytes seen on every connection.
+// It works on both the client and the server side.
+type ConnStatsHandler struct {
+	mu    sync.Mutex
+	conns []*ConnStats
+	// open indexes the connections that are still open by their addresses.
+	open map[connKey]*ConnStats
+	// keepRPCs and rpcs keep an RPCRow of every RPC, see KeepRPCs.
+	keepRPCs bool
+	rpcs     []RPCRow
+}
+
+// NewConnStatsHandler creates a new ConnStatsHandler.
+func NewConnStatsHandler() *ConnStatsHandler {
+	return &ConnStatsHandler{open: make(map[connKey]*ConnStats)}
+}
+
+// KeepRPCs has the handler keep an RPCRow of every RPC to the greet services, see RPCs. It must be
+// called before the handler is used.
+func (h *ConnStatsHandler) KeepRPCs() {
+	h.keepRPCs = true
+}
+
+// RPCs returns a row of every RPC that finished so far, in the order they finished. Only kept
+// after KeepRPCs.
+func (h *ConnStatsHandler) RPCs() []RPCRow {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]RPCRow(nil), h.rpcs...)
+}
+
+// TagConn implements stats.Handler.
+func (h *ConnStatsHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := newConnKey(info.LocalAddr, info.RemoteAddr)
+	// Connections from WrapListener and Dialer are tracked from the moment they are set up.
+	c, ok := h.open[key]
+	if !ok {
+		c = h.addConn(key)
+	}
+	return context.WithValue(ctx, connCtxKey{}, c)
+}
+
+// addConn starts tracking a new open connection. h.mu must be held.
+func (h *ConnStatsHandler) addConn(key connKey) *ConnStats {
+	c := &ConnStats{LocalAddr: key.local, RemoteAddr: key.remote}
+	h.conns = append(h.conns, c)
+	h.open[key] = c
+	return c
+}
+
+// closeConn records that c is closed, unless it already was. h.mu must be held.
+func (h *ConnStatsHandler) closeConn(c *ConnStats) {
+	if c.CloseTime != nil {
+		return
+	}
+	t := time.Now()
+	c.CloseTime = &t
+	key := connKey{local: c.LocalAddr, remote: c.RemoteAddr}
+	if h.open[key] == c {
+		delete(h.open, key)
+	}
+}
+
+// HandleConn implements stats.Handler.
+func (h *ConnStatsHandler) HandleConn(ctx context.Context, s stats.ConnStats) {
+	c, ok := ctx.Value(connCtxKey{}).(*ConnStats)
+	if !ok {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch s.(type) {
+	case *stats.ConnBegin:
+		c.OpenTime = time.Now()
+	case *stats.ConnEnd:
+		h.closeConn(c)
+	}
+}
+
+// TagRPC implements stats.Handler.
+func (h *ConnStatsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	rpc := &rpcState{}
+	if h.keepRPCs && !outsideWorkload(info.FullMethodName) {
+		rpc.row = &RPCRow{Method: info.FullMethodName}
+	}
+	return context.WithValue(ctx, rpcCtxKey{}, rpc)
+}
+
+// HandleRPC implements stats.Handler.
+func (h *ConnStatsHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	// In place of the stats handler of the Client, which it replaces.
+	observePhase(ctx, s)
+	rpc, ok := ctx.Value(rpcCtxKey{}).(*rpcState)
+	if !ok {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if rpc.row != nil {
+		h.recordRPC(rpc.row, s)
+	}
+
+	// The client's outgoing headers and the server's incoming headers are the first events that
+	// carry the addresses of the connection.
+	switch s := s.(type) {
+	case *stats.OutHeader:
+		h.startRPC(ctx, rpc, s.LocalAddr, s.RemoteAddr)
+	case *stats.InHeader:
+		h.startRPC(ctx, rpc, s.LocalAddr, s.RemoteAddr)
+	}
+	if rpc.conn == nil {
+		return
+	}
+
+	switch s := s.(type) {
+	case *stats.InPayload:
+		rpc.conn.WireBytesIn += int64(s.WireLength)
+		rpc.conn.MessagesIn++
+	case *stats.OutPayload:
+		rpc.conn.WireBytesOut += int64(s.WireLength)
+		rpc.conn.MessagesOut++
+	case *stats.End:
+		if s.Error == nil {
+			rpc.conn.RPCsCompleted++
+		}
+	}
+}
+
+// recordRPC records s in the row of its RPC. h.mu must be held.
+func (h *ConnStatsHandler) recordRPC(row *RPCRow, s stats.RPCStats) {
+	switch s := s.(type) {
+	case *stats.Begin:
+		row.StartTime = s.BeginTime
+		row.Side = SideServer
+		if s.Client {
+			row.Side = SideClient
+		}
+	case *stats.OutHeader:
+		if s.Client {
+			row.setConn(s.LocalAddr, s.RemoteAddr)
+			if v := s.Header.Get(RequestIDHeader); len(v) > 0 {
+				row.RequestID = v[0]
+			}
+		}
+	case *stats.InHeader:
+		if !s.Client {
+			row.setConn(s.RemoteAddr, s.LocalAddr)
+			if v := s.Header.Get(RequestIDHeader); len(v) > 0 {
+				row.RequestID = v[0]
+			}
+		}
+	case *stats.InPayload:
+		if s.Client {
+			row.RespBytes += int64(s.WireLength)
+			row.RespMessages++
+		} else {
+			row.ReqBytes += int64(s.WireLength)
+			row.ReqMessages++
+		}
+	case *stats.OutPayload:
+		if s.Client {
+			row.ReqBytes += int64(s.WireLength)
+			row.ReqMessages++
+		} else {
+			row.RespBytes += int64(s.WireLength)
+			row.RespMessages++
+		}
+	case *stats.End:
+		row.EndTime = s.EndTime
+		row.Status = status.Code(s.Error).String()
+		h.rpcs = append(h.rpcs, *row)
+	}
+}
+
+func (h *ConnStatsHandler) startRPC(ctx context.Context, rpc *rpcState, local, remote net.Addr) {
+	if rpc.conn != nil || local == nil || remote == nil {
+		return
+	}
+	c, ok := h.open[newConnKey(local, remote)]
+	if !ok {
+		return
+	}
+	rpc.conn = c
+	c.RPCsStarted++
+
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			c.TLSVersion = TLSVersionName(info.State.Version)
+			c.TLSCipherSuite = tls.CipherSuiteName(info.State.CipherSuite)
+			if len(info.State.PeerCertificates) > 0 {
+				c.PeerCertSerial = CertSerial(info.State.PeerCertificates[0])
+			}
+		}
+	}
+}
+
+// setTermination records how the client ends the open connection between local and remote.
+func (h *ConnStatsHandler) setTermination(local, remote net.Addr, style string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c, ok := h.open[newConnKey(local, remote)]; ok {
+		c.Termination = style
+	}
+}
+
+// WrapListener wraps lis so that the connections it accepts are tracked from the moment they are
+// accepted, including those a grpc.Server never tags, such as when it is served as h2c, and so that
+// the frames the server writes to them are seen. See ConnStats.Settings.
+func (h *ConnStatsHandler) WrapListener(lis net.Listener) net.Listener {
+	return &connStatsListener{Listener: lis, h: h}
+}
+
+// Dialer returns a dialer for grpc.WithContextDialer that tracks the connections it dials, and sees
+// the frames the client writes to them. See ConnStats.Settings.
+func (h *ConnStatsHandler) Dialer() func(context.Context, string) (net.Conn, error) {
+	return h.DialerWith(nil)
+}
+
+// DialerWith is Dialer, dialing connections with the socket options opts, if not nil.
+func (h *ConnStatsHandler) DialerWith(opts *SocketOptions) func(context.Context, string) (net.Conn, error) {
+	return h.DialerFrom(opts.Dial)
+}
+
+// DialerFrom is Dialer, dialing connections with dial, such as the Dialer of a Shaper.
+func (h *ConnStatsHandler) DialerFrom(dial func(context.Context, string) (net.Conn, error)) func(context.Context, string) (net.Conn, error) {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return h.wrapConn(conn, true), nil
+	}
+}
+
+type connStatsListener struct {
+	net.Listener
+	h *ConnStatsHandler
+}
+
+func (l *connStatsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.h.wrapConn(conn, false), nil
+}
+
+func (h *ConnStatsHandler) wrapConn(conn net.Conn, client bool) net.Conn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c := h.addConn(newConnKey(conn.LocalAddr(), conn.RemoteAddr()))
+	c.OpenTime = time.Now()
+	if state, err := ReadSocketState(conn); err == nil {
+		c.Socket = state
+	}
+	c.Shaping = shapingOf(conn)
+	c.DialAttempts = dialAttemptsOf(conn)
+	sc := &connStatsConn{Conn: conn, h: h, stats: c}
+	if client {
+		sc.preface = len(http2.ClientPreface)
+	}
+	sc.frames.onHeader = sc.onHeader
+	sc.frames.onPayload = sc.onPayload
+	return sc
+}
+
+// connStatsConn follows the HTTP/2 frames written to a connection. It stops at the first sign that
+// the connection does not carry cleartext HTTP/2, such as when it is secured by TLS.
+type connStatsConn struct {
+	net.Conn
+	h     *ConnStatsHandler
+	stats *ConnStats
+
+	// mu serializes writes, which gRPC makes from a single goroutine, with Close.
+	mu       sync.Mutex
+	preface  int
+	frames   frameScanner
+	disabled bool
+	// settings holds the payload of the first SETTINGS frame, once it starts.
+	settings     []byte
+	settingsDone bool
+}
+
+func (c *connStatsConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if !c.disabled {
+		c.follow(b)
+	}
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *connStatsConn) follow(b []byte) {
+	if c.preface > 0 {
+		n := c.preface
+		if n > len(b) {
+			n = len(b)
+		}
+		start := len(http2.ClientPreface) - c.preface
+		if string(b[:n]) != http2.ClientPreface[start:start+n] {
+			c.disabled = true
+			return
+		}
+		c.preface -= n
+		b = b[n:]
+	}
+	c.frames.scan(b, nil)
+}
+
+func (c *connStatsConn) onHeader(fh http2.FrameHeader) {
+	if !c.settingsDone && c.settings == nil {
+		// Both sides start with a SETTINGS frame.
+		if fh.Type != http2.FrameSettings || fh.StreamID != 0 || fh.Length%6 != 0 || fh.Length > minMaxFrameSize {
+			c.disabled = true
+			return
+		}
+		c.settings = make([]byte, 0, fh.Length)
+		if fh.Length == 0 {
+			c.recordSettings()
+		}
+		return
+	}
+	switch fh.Type {
+	case http2.FrameWindowUpdate:
+		c.h.mu.Lock()
+		c.stats.WindowUpdatesOut++
+		c.h.mu.Unlock()
+	case http2.FrameContinuation:
+		c.h.mu.Lock()
+		c.stats.ContinuationFramesOut++
+		c.h.mu.Unlock()
+	}
+}
+
+func (c *connStatsConn) onPayload(fh http2.FrameHeader, b []byte) {
+	if c.settingsDone || c.settings == nil {
+		return
+	}
+	c.settings = append(c.settings, b...)
+	if len(c.settings) == int(fh.Length) {
+		c.recordSettings()
+	}
+}
+
+func (c *connStatsConn) recordSettings() {
+	settings := make(map[string]uint32)
+	for b := c.settings; len(b) >= 6; b = b[6:] {
+		settings[http2.SettingID(binary.BigEndian.Uint16(b)).String()] = binary.BigEndian.Uint32(b[2:])
+	}
+	c.settings, c.settingsDone = nil, true
+	c.h.mu.Lock()
+	c.stats.Settings = settings
+	c.h.mu.Unlock()
+}
+
+func (c *connStatsConn) Close() error {
+	c.h.mu.Lock()
+	c.h.closeConn(c.stats)
+	c.h.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// Conns returns a copy of the stats of every connection seen so far, in the order they were opened.
+func (h *ConnStatsHandler) Conns() []ConnStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	conns := make([]ConnStats, len(h.conns))
+	for i, c := range h.conns {
+		conns[i] = *c
+		if c.Settings != nil {
+			conns[i].Settings = make(map[string]uint32, len(c.Settings))
+			for k, v := range c.Settings {
+				conns[i].Settings[k] = v
+			}
+		}
+		conns[i].DialAttempts = append([]DialAttempt(nil), c.DialAttempts...)
+	}
+	return conns
+}
+
+// WriteConnStats writes conns to w as a JSON array, after a line holding meta, if not nil.
+func WriteConnStats(w io.Writer, meta *RunMetadata, conns []ConnStats) error {
+	if err := writeRunMetadataLine(w, meta); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(conns)
+}
+
+// ReadConnStats reads the JSON array written by WriteConnStats, skipping the RunMetadata, which
+// ReadRunMetadata reads.
+func ReadConnStats(r io.Reader) ([]ConnStats, error) {
+	dec := json.NewDecoder(r)
+	var first json.RawMessage
+	if err := dec.Decode(&first); err != nil {
+		return nil, err
+	}
+	var conns []ConnStats
+	if parseRunMetadataLine(first) != nil {
+		if err := dec.Decode(&conns); err != nil {
+			return nil, err
+		}
+		return conns, nil
+	}
+	if err := json.Unmarshal(first, &conns); err != nil {
+		return nil, err
+	}
+	return conns, nil
+}
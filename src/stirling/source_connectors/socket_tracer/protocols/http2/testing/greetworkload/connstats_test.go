@@ -0,0 +1,116 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// wireSize computes the bytes a message takes on the wire: a 5-byte prefix, then the
+// serialized message, gzipped if compressed.
+func wireSize(t *testing.T, msg interface{ Marshal() ([]byte, error) }, compressed bool) int64 {
+	b, err := msg.Marshal()
+	require.NoError(t, err)
+	if compressed {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write(b)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		b = buf.Bytes()
+	}
+	return int64(5 + len(b))
+}
+
+func TestConnStatsHandler(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		name := "uncompressed"
+		if compressed {
+			name = "compressed"
+		}
+		t.Run(name, func(t *testing.T) {
+			serverStats := greetworkload.NewConnStatsHandler()
+			addr := startServerWith(t, &serverSetup{Stats: serverStats}).Addr
+
+			clientStats := greetworkload.NewConnStatsHandler()
+			c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, Compression: compressed})
+			conn, err := c.Dial(addr, grpc.WithStatsHandler(clientStats))
+			require.NoError(t, err)
+
+			var sent, received int64
+			for _, name := range []string{"a", "pixie", "a much longer name that compresses name name name name"} {
+				r := c.SayHello(conn, name)
+				require.True(t, r.Completed(), r.Error)
+				sent += wireSize(t, &pb.HelloRequest{Name: name}, compressed)
+				received += wireSize(t, &pb.HelloReply{Message: "Hello " + name}, compressed)
+			}
+			require.NoError(t, conn.Close())
+
+			require.Eventually(t, func() bool {
+				conns := serverStats.Conns()
+				return len(conns) == 1 && conns[0].CloseTime != nil
+			}, 5*time.Second, 10*time.Millisecond)
+
+			clientConns := clientStats.Conns()
+			require.Len(t, clientConns, 1)
+			serverConns := serverStats.Conns()
+			require.Len(t, serverConns, 1)
+
+			cc, sc := clientConns[0], serverConns[0]
+			assert.Equal(t, cc.LocalAddr, sc.RemoteAddr)
+			assert.Equal(t, cc.RemoteAddr, sc.LocalAddr)
+			for _, conn := range []greetworkload.ConnStats{cc, sc} {
+				assert.Equal(t, int64(3), conn.RPCsStarted)
+				assert.Equal(t, int64(3), conn.RPCsCompleted)
+				assert.False(t, conn.OpenTime.IsZero())
+				require.NotNil(t, conn.CloseTime)
+				assert.False(t, conn.CloseTime.Before(conn.OpenTime))
+			}
+			assert.Equal(t, sent, cc.WireBytesOut)
+			assert.Equal(t, received, cc.WireBytesIn)
+			assert.Equal(t, sent, sc.WireBytesIn)
+			assert.Equal(t, received, sc.WireBytesOut)
+		})
+	}
+}
+
+func TestWriteConnStats(t *testing.T) {
+	closed := time.Unix(10, 0).UTC()
+	conns := []greetworkload.ConnStats{
+		{LocalAddr: "127.0.0.1:1", RemoteAddr: "127.0.0.1:2", RPCsStarted: 1, OpenTime: time.Unix(1, 0).UTC(), CloseTime: &closed},
+		{LocalAddr: "127.0.0.1:3", RemoteAddr: "127.0.0.1:2"},
+	}
+	var buf bytes.Buffer
+	require.NoError(t, greetworkload.WriteConnStats(&buf, nil, conns))
+
+	var decoded []greetworkload.ConnStats
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, conns, decoded)
+}
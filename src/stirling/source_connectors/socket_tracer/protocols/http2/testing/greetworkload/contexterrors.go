@@ -0,0 +1,120 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload
+
+import (
+	"context"
+	"sync/atomic"
+
+	"google.golang.org/grpc/stats"
+)
+
+type ctxErrCtxKey struct{}
+
+// ctxErrState is what a call tells of its end, to count it at most once in ContextErrors.
+type ctxErrState struct {
+	// handlerSaw is set once a handler returned after the context of the call was done.
+	handlerSaw int32
+	// wroteStatus is set once the server wrote the status of the call.
+	wroteStatus int32
+}
+
+// ContextErrors returns the number of calls that ended by a context error on the server: either
+// the handler returned after the context of the call was cancelled or expired, or the client reset
+// the stream before the server wrote the status of the call. The latter, which covers the handlers
+// that return before the cancellation reaches them, is only seen with the StatsHandler of s
+// installed on the grpc.Server.
+func (s *Server) ContextErrors() int64 {
+	return atomic.LoadInt64(&s.ctxErrs)
+}
+
+// observeContext is deferred by the handlers with the context of their call.
+func (s *Server) observeContext(ctx context.Context) {
+	if ctx.Err() == nil {
+		return
+	}
+	if st, ok := ctx.Value(ctxErrCtxKey{}).(*ctxErrState); ok {
+		// Counted when the call ends.
+		atomic.StoreInt32(&st.handlerSaw, 1)
+		return
+	}
+	atomic.AddInt64(&s.ctxErrs, 1)
+}
+
+// StatsHandler returns a grpc stats.Handler for the server of s, which counts in ContextErrors the
+// calls whose stream the client reset before the server wrote their status. Every event is passed
+// on to next, if not nil, as a grpc.Server only takes a single stats.Handler.
+//
+// A handler cannot see those calls itself: a unary handler that returns before the RST_STREAM
+// arrives sees its context done only once its response fails to be written. gRPC then skips the
+// status, which is how they are told apart from the calls that ended as usual, whose context gRPC
+// also cancels, once their status is written.
+func (s *Server) StatsHandler(next stats.Handler) stats.Handler {
+	return &ctxErrHandler{s: s, next: next}
+}
+
+type ctxErrHandler struct {
+	s    *Server
+	next stats.Handler
+}
+
+// TagConn implements stats.Handler.
+func (h *ctxErrHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	if h.next == nil {
+		return ctx
+	}
+	return h.next.TagConn(ctx, info)
+}
+
+// HandleConn implements stats.Handler.
+func (h *ctxErrHandler) HandleConn(ctx context.Context, s stats.ConnStats) {
+	if h.next != nil {
+		h.next.HandleConn(ctx, s)
+	}
+}
+
+// TagRPC implements stats.Handler.
+func (h *ctxErrHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	if h.next != nil {
+		ctx = h.next.TagRPC(ctx, info)
+	}
+	if outsideWorkload(info.FullMethodName) {
+		return ctx
+	}
+	return context.WithValue(ctx, ctxErrCtxKey{}, &ctxErrState{})
+}
+
+// HandleRPC implements stats.Handler.
+func (h *ctxErrHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	if h.next != nil {
+		h.next.HandleRPC(ctx, s)
+	}
+	st, ok := ctx.Value(ctxErrCtxKey{}).(*ctxErrState)
+	if !ok {
+		return
+	}
+	switch s.(type) {
+	case *stats.OutTrailer:
+		atomic.StoreInt32(&st.wroteStatus, 1)
+	case *stats.End:
+		if atomic.LoadInt32(&st.handlerSaw) == 1 || atomic.LoadInt32(&st.wroteStatus) == 0 {
+			atomic.AddInt64(&h.s.ctxErrs, 1)
+		}
+	}
+}
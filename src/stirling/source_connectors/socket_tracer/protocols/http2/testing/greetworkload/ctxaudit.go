@@ -0,0 +1,322 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultContextAuditGrace is the ContextAuditOptions.Grace of options that set none.
+const DefaultContextAuditGrace = 100 * time.Millisecond
+
+// auditPollInterval is how often ContextAudit.Verify looks again at the calls it waits for.
+const auditPollInterval = 5 * time.Millisecond
+
+// ContextAuditOptions configure a ContextAudit.
+type ContextAuditOptions struct {
+	// Grace is how long a call may go on once its root context is done before it is reported.
+	// DefaultContextAuditGrace if zero.
+	Grace time.Duration
+}
+
+// ContextLeak is a call that went on for longer than the grace period of its audit once its root
+// context was done.
+type ContextLeak struct {
+	// Goroutine is the ID of the goroutine that made the call.
+	Goroutine int64
+	// Started is when the call started, and RootDone when its root context was seen done, which is
+	// before for calls that started late.
+	Started  time.Time
+	RootDone time.Time
+	// Blocked is true if the call was still in flight when it was reported, Stack then being the
+	// stack of its goroutine at the time. Otherwise the call started late, on a context that was
+	// not done along with its root, and Stack is the stack it was started from.
+	Blocked bool
+	Stack   string
+}
+
+func (l *ContextLeak) String() string {
+	what := "blocked"
+	if !l.Blocked {
+		what = "started late"
+	}
+	return fmt.Sprintf("goroutine %d, %s: started %v after its root context was done\n%s",
+		l.Goroutine, what, l.Started.Sub(l.RootDone), l.Stack)
+}
+
+// ContextLeakError is the error of ContextAudit.Verify, holding the leaks found.
+type ContextLeakError struct {
+	Grace time.Duration
+	Leaks []*ContextLeak
+}
+
+func (e *ContextLeakError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d calls went on for more than %v once their root context was done", len(e.Leaks), e.Grace)
+	for _, l := range e.Leaks {
+		b.WriteString("\n\n")
+		b.WriteString(l.String())
+	}
+	return b.String()
+}
+
+// ContextAudit tracks the contexts the calls of a Client are made with, see ClientOptions.Audit,
+// to find the calls that go on once the context they were made under is done, as those made with
+// a context captured before that one, rather than derived from it.
+//
+// The context a call is made under is its root: the context passed to the Client method running
+// it, such as RunAsync or Churn, or that of the audit for the calls of methods that take none. A
+// call is reported if it is still in flight once the grace period of the audit has passed since
+// its root was done, or if it started after that on a context that was not done.
+type ContextAudit struct {
+	grace time.Duration
+	base  *auditRoot
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	watchers  sync.WaitGroup
+
+	mu sync.Mutex
+	// calls holds the calls in flight, and late the calls that started late and have finished.
+	calls map[*auditedCall]struct{}
+	late  []*ContextLeak
+}
+
+// auditRootKey is the key of the auditRoot of a ContextAudit in the contexts under it.
+type auditRootKey struct {
+	audit *ContextAudit
+}
+
+// auditRoot is a root context, and when it was seen done.
+type auditRoot struct {
+	ctx context.Context
+
+	mu   sync.Mutex
+	done time.Time
+}
+
+func (r *auditRoot) markDone(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done = t
+}
+
+// doneAt returns when the root was seen done, and false if it has not been yet.
+func (r *auditRoot) doneAt() (time.Time, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.done, !r.done.IsZero()
+}
+
+// auditedCall is a call tracked by a ContextAudit.
+type auditedCall struct {
+	root      *auditRoot
+	goroutine int64
+	started   time.Time
+	stack     string
+	// late is true if the call started on a context that was not done, after its root was.
+	late bool
+}
+
+// NewContextAudit creates a ContextAudit with ctx as the root of the calls made under no other.
+// The audit must be closed once done with.
+func NewContextAudit(ctx context.Context, opts *ContextAuditOptions) (*ContextAudit, error) {
+	if opts == nil {
+		opts = &ContextAuditOptions{}
+	}
+	if opts.Grace < 0 {
+		return nil, fmt.Errorf("context audit grace must not be negative, got %v", opts.Grace)
+	}
+	a := &ContextAudit{
+		grace:  opts.Grace,
+		closed: make(chan struct{}),
+		calls:  make(map[*auditedCall]struct{}),
+	}
+	if a.grace == 0 {
+		a.grace = DefaultContextAuditGrace
+	}
+	a.base = a.watch(ctx)
+	return a, nil
+}
+
+// watch returns the root of ctx, marked done once ctx is.
+func (a *ContextAudit) watch(ctx context.Context) *auditRoot {
+	r := &auditRoot{ctx: ctx}
+	if ctx.Done() == nil {
+		return r
+	}
+	a.watchers.Add(1)
+	go func() {
+		defer a.watchers.Done()
+		select {
+		case <-ctx.Done():
+			r.markDone(time.Now())
+		case <-a.closed:
+		}
+	}()
+	return r
+}
+
+// root returns ctx as the root of the calls made under it. A nil audit returns ctx.
+func (a *ContextAudit) root(ctx context.Context) context.Context {
+	if a == nil {
+		return ctx
+	}
+	// A context derived from a root without a cancellation of its own is under the same root.
+	if r, _ := ctx.Value(auditRootKey{a}).(*auditRoot); r != nil && r.ctx.Done() == ctx.Done() {
+		return ctx
+	}
+	return context.WithValue(ctx, auditRootKey{a}, a.watch(ctx))
+}
+
+// track tracks the call made with ctx, derived from parent, until it is cancelled, and returns the
+// cancel func of ctx to call instead of cancel. A nil audit returns cancel.
+func (a *ContextAudit) track(parent, ctx context.Context, cancel context.CancelFunc) context.CancelFunc {
+	if a == nil {
+		return cancel
+	}
+	r, _ := parent.Value(auditRootKey{a}).(*auditRoot)
+	if r == nil {
+		r = a.base
+	}
+	stack := goroutineStack(false)
+	call := &auditedCall{root: r, goroutine: goroutineID(stack), started: time.Now(), stack: stack}
+	if done, ok := r.doneAt(); ok && ctx.Err() == nil && call.started.Sub(done) >= a.grace {
+		call.late = true
+	}
+
+	a.mu.Lock()
+	a.calls[call] = struct{}{}
+	a.mu.Unlock()
+	var once sync.Once
+	return func() {
+		cancel()
+		once.Do(func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			delete(a.calls, call)
+			if call.late {
+				done, _ := r.doneAt()
+				a.late = append(a.late, &ContextLeak{Goroutine: call.goroutine, Started: call.started, RootDone: done, Stack: call.stack})
+			}
+		})
+	}
+}
+
+// check returns the leaks found at now, and the number of calls in flight whose root is done, but
+// for less than the grace period.
+func (a *ContextAudit) check(now time.Time) ([]*ContextLeak, int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	leaks := append([]*ContextLeak(nil), a.late...)
+	pending := 0
+	var stacks map[int64]string
+	for call := range a.calls {
+		done, ok := call.root.doneAt()
+		switch {
+		case !ok && call.root.ctx.Err() != nil:
+			// Done, but not yet seen so.
+			pending++
+		case !ok:
+		case now.Sub(done) < a.grace:
+			pending++
+		default:
+			if stacks == nil {
+				stacks = goroutineStacks()
+			}
+			stack, ok := stacks[call.goroutine]
+			if !ok {
+				stack = call.stack
+			}
+			leaks = append(leaks, &ContextLeak{Goroutine: call.goroutine, Started: call.started, RootDone: done, Blocked: true, Stack: stack})
+		}
+	}
+	sort.Slice(leaks, func(i, j int) bool { return leaks[i].Started.Before(leaks[j].Started) })
+	return leaks, pending
+}
+
+// Leaks returns the calls found to have gone on once their root context was done, sorted by
+// start time.
+func (a *ContextAudit) Leaks() []*ContextLeak {
+	leaks, _ := a.check(time.Now())
+	return leaks
+}
+
+// Verify returns a *ContextLeakError with every leak found, or nil if there is none. It first
+// waits for the calls whose root context was done less than the grace period ago to finish, or to
+// outlast it.
+func (a *ContextAudit) Verify() error {
+	for {
+		leaks, pending := a.check(time.Now())
+		if pending > 0 {
+			time.Sleep(auditPollInterval)
+			continue
+		}
+		if len(leaks) > 0 {
+			return &ContextLeakError{Grace: a.grace, Leaks: leaks}
+		}
+		return nil
+	}
+}
+
+// Close stops watching the root contexts, which are no longer seen done after.
+func (a *ContextAudit) Close() {
+	a.closeOnce.Do(func() { close(a.closed) })
+	a.watchers.Wait()
+}
+
+// goroutineStack returns the stacks of the current goroutine, or of every goroutine if all is set,
+// as runtime.Stack formats them.
+func goroutineStack(all bool) string {
+	buf := make([]byte, 4<<10)
+	for {
+		n := runtime.Stack(buf, all)
+		if n < len(buf) {
+			return string(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// goroutineStacks returns the stack of every goroutine by ID.
+func goroutineStacks() map[int64]string {
+	stacks := make(map[int64]string)
+	for _, stack := range strings.Split(goroutineStack(true), "\n\n") {
+		stacks[goroutineID(stack)] = stack
+	}
+	return stacks
+}
+
+// goroutineID returns the ID of the goroutine of stack, which starts with "goroutine N [", or
+// zero if it does not.
+func goroutineID(stack string) int64 {
+	line, _, _ := cut(stack, "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "goroutine" {
+		return 0
+	}
+	id, _ := strconv.ParseInt(fields[1], 10, 64)
+	return id
+}
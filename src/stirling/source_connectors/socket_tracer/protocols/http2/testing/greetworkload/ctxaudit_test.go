@@ -0,0 +1,197 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// newAuditedClient returns a client with opts, whose calls are audited until the test ends, as if
+// made under a context cancelled then. The test fails if any call goes on past it.
+func newAuditedClient(t *testing.T, opts *greetworkload.ClientOptions) (*greetworkload.Client, *greetworkload.ContextAudit) {
+	ctx, cancel := context.WithCancel(context.Background())
+	audit, err := greetworkload.NewContextAudit(ctx, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		cancel()
+		assert.NoError(t, audit.Verify())
+		audit.Close()
+	})
+	o := *opts
+	o.Audit = audit
+	return greetworkload.NewClient(&o), audit
+}
+
+// startHeldServer starts a Greeter whose unary calls are held, whatever their context, until the
+// test ends, as those of a server that does not see calls being cancelled. Every call is sent on
+// received as it arrives. It must be started before the client, so that the calls are held until
+// the client is done with.
+func startHeldServer(t *testing.T) (string, <-chan struct{}) {
+	received := make(chan struct{}, 100)
+	release := make(chan struct{})
+	s := startServerWith(t, &serverSetup{GRPC: []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+			<-release
+			return handler(ctx, req)
+		}),
+	}})
+	// Cleanups run last first, so the calls are released before the server stops.
+	t.Cleanup(func() { close(release) })
+	return s.Addr, received
+}
+
+func dialHeld(t *testing.T, c *greetworkload.Client, addr string) *grpc.ClientConn {
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestContextAudit_ReportsBlockedCalls(t *testing.T) {
+	addr, received := startHeldServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	audit, err := greetworkload.NewContextAudit(ctx, &greetworkload.ContextAuditOptions{Grace: 20 * time.Millisecond})
+	require.NoError(t, err)
+	defer audit.Close()
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: time.Minute, Audit: audit})
+	conn := dialHeld(t, c, addr)
+
+	// SayHello takes no context, so its calls are made under that of the audit, but not cancelled
+	// along with it.
+	done := make(chan *greetworkload.CallRecord, 1)
+	go func() { done <- c.SayHello(conn, "held") }()
+	<-received
+	assert.Empty(t, audit.Leaks())
+	cancel()
+
+	err = audit.Verify()
+	var leakErr *greetworkload.ContextLeakError
+	require.ErrorAs(t, err, &leakErr)
+	require.Len(t, leakErr.Leaks, 1)
+	leak := leakErr.Leaks[0]
+	assert.True(t, leak.Blocked)
+	assert.GreaterOrEqual(t, time.Since(leak.RootDone), 20*time.Millisecond)
+	// The stack is that of the goroutine where it is blocked.
+	assert.Contains(t, leak.Stack, "greetworkload.(*Client).SayHello")
+	assert.Contains(t, leak.Stack, "google.golang.org/grpc")
+	assert.Contains(t, err.Error(), "1 calls went on for more than 20ms once their root context was done")
+	select {
+	case r := <-done:
+		t.Fatalf("the held call returned: %v", r.Err())
+	default:
+	}
+
+	// Calls made under the cancelled context end with it, and are not reported.
+	r := c.Do(ctx, conn, &greetworkload.CallOverrides{Name: "bound"})
+	assert.False(t, r.Completed())
+	assert.Len(t, audit.Leaks(), 1)
+}
+
+func TestContextAudit_ReportsLateCalls(t *testing.T) {
+	conn := serveBufconn(t, nil, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	audit, err := greetworkload.NewContextAudit(ctx, &greetworkload.ContextAuditOptions{Grace: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer audit.Close()
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, Audit: audit})
+
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	r := c.SayHello(conn, "late")
+	require.True(t, r.Completed(), r.Error)
+
+	leaks := audit.Leaks()
+	require.Len(t, leaks, 1)
+	assert.False(t, leaks[0].Blocked)
+	assert.GreaterOrEqual(t, leaks[0].Started.Sub(leaks[0].RootDone), 10*time.Millisecond)
+	// The stack is that the call was made from.
+	assert.Contains(t, leaks[0].Stack, "TestContextAudit_ReportsLateCalls")
+	assert.Error(t, audit.Verify())
+}
+
+// Calls made under a context that is done, which end as soon as they start, are not reported.
+func TestContextAudit_IgnoresCallsBoundToTheirRoot(t *testing.T) {
+	conn := serveBufconn(t, nil, nil)
+	c, audit := newAuditedClient(t, &greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	time.Sleep(2 * greetworkload.DefaultContextAuditGrace)
+	r := c.Do(ctx, conn, &greetworkload.CallOverrides{Name: "cancelled"})
+	assert.False(t, r.Completed())
+	assert.Empty(t, audit.Leaks())
+}
+
+func TestContextAudit_RunsStopWithTheirContext(t *testing.T) {
+	addr, _ := startHeldServer(t)
+	c, _ := newAuditedClient(t, &greetworkload.ClientOptions{Timeout: time.Minute})
+	conn := dialHeld(t, c, addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err := c.RunAsync(ctx, conn, "held", &greetworkload.AsyncOptions{MaxInFlight: 4, Duration: time.Minute})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	records, _, err := c.RunBursts(ctx, []*grpc.ClientConn{conn}, "held", &greetworkload.BurstOptions{Size: 4, Bursts: 2, Interval: time.Minute})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Len(t, records, 4)
+}
+
+// Churn and Replay used to make their calls under no context, so that they held on to the calls
+// in flight once their context was done, for as long as the calls took.
+func TestContextAudit_ChurnAndReplayStopWithTheirContext(t *testing.T) {
+	addr, _ := startHeldServer(t)
+	c, _ := newAuditedClient(t, &greetworkload.ClientOptions{Timeout: time.Minute})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := c.Churn(ctx, addr, &greetworkload.ChurnOptions{Rate: 50, Duration: time.Minute, CallsPerConn: 3})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 10*time.Second)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	records := []*greetworkload.CallRecord{
+		{Method: "SayHello", StartTime: start, Names: []string{"a"}},
+		{Method: "SayHelloBatch", StartTime: start, Names: []string{"b", "c"}},
+	}
+	calls, err := c.Replay(ctx, addr, records, &greetworkload.ReplayOptions{NoTiming: true})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Len(t, calls, 1)
+	assert.False(t, calls[0].Replayed.Completed())
+}
+
+func TestNewContextAudit_NegativeGrace(t *testing.T) {
+	_, err := greetworkload.NewContextAudit(context.Background(), &greetworkload.ContextAuditOptions{Grace: -time.Second})
+	assert.Error(t, err)
+}
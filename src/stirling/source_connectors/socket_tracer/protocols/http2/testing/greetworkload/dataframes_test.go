@@ -0,0 +1,185 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// frameCapture keeps the bytes the server writes to every connection it accepts, so that the
+// HTTP/2 frames they carry can be read back.
+type frameCapture struct {
+	net.Listener
+
+	mu    sync.Mutex
+	conns []*bytes.Buffer
+}
+
+type capturedConn struct {
+	net.Conn
+	capture *frameCapture
+	buf     *bytes.Buffer
+}
+
+func (l *frameCapture) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	buf := &bytes.Buffer{}
+	l.conns = append(l.conns, buf)
+	return &capturedConn{Conn: conn, capture: l, buf: buf}, nil
+}
+
+func (c *capturedConn) Write(b []byte) (int, error) {
+	c.capture.mu.Lock()
+	c.buf.Write(b)
+	c.capture.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// dataFrames returns the payload of every DATA frame the server wrote that carries data, in the
+// order written.
+func (l *frameCapture) dataFrames(t *testing.T) [][]byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var frames [][]byte
+	for _, buf := range l.conns {
+		fr := http2.NewFramer(io.Discard, bytes.NewReader(buf.Bytes()))
+		for {
+			f, err := fr.ReadFrame()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			if d, ok := f.(*http2.DataFrame); ok && len(d.Data()) > 0 {
+				frames = append(frames, append([]byte(nil), d.Data()...))
+			}
+		}
+	}
+	return frames
+}
+
+// dataFrameSizes returns the payload length of every DATA frame the server wrote that carries
+// data, in the order written.
+func (l *frameCapture) dataFrameSizes(t *testing.T) []int {
+	var sizes []int
+	for _, data := range l.dataFrames(t) {
+		sizes = append(sizes, len(data))
+	}
+	return sizes
+}
+
+func TestServerOptions_ReplyFrameBytes(t *testing.T) {
+	const (
+		replyBytes = 64 << 10
+		replies    = 4
+	)
+	for _, frameBytes := range []int{1 << 10, 4 << 10, greetworkload.MaxReplyFrameBytes} {
+		frameBytes := frameBytes
+		t.Run(fmt.Sprintf("%dB", frameBytes), func(t *testing.T) {
+			opts := &greetworkload.ServerOptions{
+				InstanceID:       "instance-1",
+				StreamReplyBytes: replyBytes,
+				Checksums:        true,
+				ReplyFrameBytes:  frameBytes,
+			}
+			require.NoError(t, opts.Validate())
+			var capture *frameCapture
+			s := startServerWith(t, &serverSetup{Options: opts, Wrap: func(lis net.Listener) net.Listener {
+				capture = &frameCapture{Listener: lis}
+				return capture
+			}})
+
+			// Windows large enough for the whole stream, so that flow control does not cut frames short.
+			conn, err := grpc.Dial(s.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()),
+				grpc.WithInitialWindowSize(1<<20), grpc.WithInitialConnWindowSize(1<<20))
+			require.NoError(t, err)
+			defer conn.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			stream, err := pb.NewStreamingGreeterClient(conn).SayHelloServerStreaming(ctx, &pb.HelloRequest{Name: "pixie", Count: replies})
+			require.NoError(t, err)
+			var received strings.Builder
+			var sum pb.StreamChecksum
+			for {
+				reply, err := stream.Recv()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				require.True(t, utf8.ValidString(reply.Message))
+				require.Equal(t, pb.MessageChecksum(reply.Message), reply.Checksum)
+				received.WriteString(reply.Message)
+				sum.Add(reply.Message)
+			}
+			assert.Equal(t, []string{sum.String()}, stream.Trailer().Get(pb.StreamChecksumTrailer))
+
+			// The pieces put back together are the replies unsplit.
+			want := "Hello pixie" + strings.Repeat(".", replyBytes-len("Hello pixie"))
+			assert.Equal(t, strings.Repeat(want, replies), received.String())
+
+			// Every piece but the last of a reply fills its frame to within a few bytes.
+			sizes := capture.dataFrameSizes(t)
+			sort.Ints(sizes)
+			require.Greater(t, len(sizes), replies)
+			assert.LessOrEqual(t, sizes[len(sizes)-1], frameBytes)
+			assert.GreaterOrEqual(t, sizes[replies], frameBytes-8, "sizes: %v", sizes)
+		})
+	}
+}
+
+func TestServerStreaming_ReplyFrameBytesSplitsRunes(t *testing.T) {
+	greeter := greetworkload.NewServer(&greetworkload.ServerOptions{ReplyFrameBytes: greetworkload.MinReplyFrameBytes})
+	name := strings.Repeat("é€", 100)
+	stream := &serializingStream{keep: true}
+	require.NoError(t, greeter.SayHelloServerStreaming(&pb.HelloRequest{Name: name, Count: 1}, stream))
+	require.Greater(t, len(stream.sent), 1)
+
+	var received strings.Builder
+	for _, b := range stream.sent {
+		assert.LessOrEqual(t, len(b)+5, greetworkload.MinReplyFrameBytes)
+		reply := &pb.HelloReply{}
+		require.NoError(t, reply.Unmarshal(b))
+		assert.True(t, utf8.ValidString(reply.Message), reply.Message)
+		received.WriteString(reply.Message)
+	}
+	assert.Equal(t, "Hello "+name, received.String())
+}
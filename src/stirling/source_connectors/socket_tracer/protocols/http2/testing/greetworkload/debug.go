@@ -0,0 +1,229 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NewDebugMux returns the handlers of the read-only debug endpoint of a greet binary:
+//
+//	GET /debug/pprof/  the net/http/pprof profiles, such as goroutine and heap.
+//	GET /debug/vars    the expvar variables, among which the runtime memstats.
+//	GET /connections   the stats of the connections of conns that are still open, as a JSON array.
+//	GET /config        the effective value of every flag of flags, as a JSON object.
+func NewDebugMux(conns *ConnStatsHandler, flags *flag.FlagSet) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/connections", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = WriteConnStats(w, nil, openConns(conns.Conns()))
+	}))
+	mux.HandleFunc("/config", readOnly(func(w http.ResponseWriter, r *http.Request) {
+		config := make(map[string]string)
+		flags.VisitAll(func(f *flag.Flag) {
+			config[f.Name] = f.Value.String()
+		})
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(config)
+	}))
+	return mux
+}
+
+// readOnly rejects the requests to h that are not GETs.
+func readOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// openConns returns the connections of conns that are not closed.
+func openConns(conns []ConnStats) []ConnStats {
+	open := make([]ConnStats, 0, len(conns))
+	for _, c := range conns {
+		if c.CloseTime == nil {
+			open = append(open, c)
+		}
+	}
+	return open
+}
+
+// DebugSnapshot is the state of a greet binary, as read from its debug endpoint at a point in time.
+type DebugSnapshot struct {
+	Time       time.Time `json:"time"`
+	Goroutines int       `json:"goroutines"`
+	// HeapAllocBytes and NumGC are those of the runtime memstats.
+	HeapAllocBytes uint64      `json:"heap_alloc_bytes"`
+	NumGC          uint32      `json:"num_gc"`
+	Connections    []ConnStats `json:"connections"`
+}
+
+// DebugClient reads the debug endpoint served by NewDebugMux.
+type DebugClient struct {
+	base   string
+	client *http.Client
+}
+
+// NewDebugClient creates a DebugClient of the debug endpoint served on addr, such as
+// "localhost:6060".
+func NewDebugClient(addr string) *DebugClient {
+	return &DebugClient{base: "http://" + addr, client: &http.Client{}}
+}
+
+// get returns the body of a GET of path, which the caller must close.
+func (c *DebugClient) get(ctx context.Context, path string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (c *DebugClient) getJSON(ctx context.Context, path string, v interface{}) error {
+	body, err := c.get(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		return fmt.Errorf("GET %s: %w", path, err)
+	}
+	return nil
+}
+
+// Connections returns the stats of the open connections.
+func (c *DebugClient) Connections(ctx context.Context) ([]ConnStats, error) {
+	var conns []ConnStats
+	if err := c.getJSON(ctx, "/connections", &conns); err != nil {
+		return nil, err
+	}
+	return conns, nil
+}
+
+// Config returns the effective value of every flag, by name.
+func (c *DebugClient) Config(ctx context.Context) (map[string]string, error) {
+	var config map[string]string
+	if err := c.getJSON(ctx, "/config", &config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Profile writes the pprof profile of the given name, such as "heap" or "goroutine", to w.
+func (c *DebugClient) Profile(ctx context.Context, name string, w io.Writer) error {
+	body, err := c.get(ctx, "/debug/pprof/"+name)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(w, body)
+	return err
+}
+
+// goroutines returns the number of goroutines, from the header of the text goroutine profile.
+func (c *DebugClient) goroutines(ctx context.Context) (int, error) {
+	body, err := c.get(ctx, "/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	line, err := bufio.NewReader(body).ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	const header = "goroutine profile: total "
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, header) {
+		return 0, fmt.Errorf("unexpected goroutine profile header %q", line)
+	}
+	return strconv.Atoi(strings.TrimPrefix(line, header))
+}
+
+// Snapshot reads the number of goroutines, the heap and the open connections.
+func (c *DebugClient) Snapshot(ctx context.Context) (*DebugSnapshot, error) {
+	s := &DebugSnapshot{Time: time.Now()}
+	var err error
+	if s.Goroutines, err = c.goroutines(ctx); err != nil {
+		return nil, err
+	}
+	var vars struct {
+		MemStats struct {
+			HeapAlloc uint64
+			NumGC     uint32
+		} `json:"memstats"`
+	}
+	if err := c.getJSON(ctx, "/debug/vars", &vars); err != nil {
+		return nil, err
+	}
+	s.HeapAllocBytes = vars.MemStats.HeapAlloc
+	s.NumGC = vars.MemStats.NumGC
+	if s.Connections, err = c.Connections(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SnapshotEvery calls f with a Snapshot every interval, starting right away, until ctx is done or
+// a snapshot fails. It returns the error of the failed snapshot, or nil once ctx is done.
+func (c *DebugClient) SnapshotEvery(ctx context.Context, interval time.Duration, f func(*DebugSnapshot)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s, err := c.Snapshot(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		f(s)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// released never blocks the streams of startDebugServer.
+func released() chan struct{} {
+	release := make(chan struct{})
+	close(release)
+	return release
+}
+
+// startDebugServer serves a streaming server whose streams block after their first reply until
+// release is closed, and its debug endpoint.
+func startDebugServer(t *testing.T, flags *flag.FlagSet, release chan struct{}) (addr string, debug *httptest.Server) {
+	connStats := greetworkload.NewConnStatsHandler()
+	s := startServerWith(t, &serverSetup{
+		Options: &greetworkload.ServerOptions{
+			OnStreamSend: func(index int, _ time.Time) {
+				if index == 0 {
+					<-release
+				}
+			},
+		},
+		Stats: connStats,
+		Wrap:  connStats.WrapListener,
+	})
+	debug = httptest.NewServer(greetworkload.NewDebugMux(connStats, flags))
+	t.Cleanup(debug.Close)
+	return s.Addr, debug
+}
+
+// startBlockedStream starts a server-streaming call and waits for its first reply.
+func startBlockedStream(t *testing.T, addr string) {
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	stream, err := pb.NewStreamingGreeterClient(conn).SayHelloServerStreaming(ctx, &pb.HelloRequest{Name: "pixie", Count: 3})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+}
+
+func TestDebugMux_ConnectionsDuringStream(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	addr, debug := startDebugServer(t, flag.NewFlagSet("test", flag.ContinueOnError), release)
+	startBlockedStream(t, addr)
+
+	resp, err := http.Get(debug.URL + "/connections")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var conns []map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&conns))
+	require.Len(t, conns, 1)
+	conn := conns[0]
+	for _, key := range []string{"local_addr", "remote_addr"} {
+		assert.IsType(t, "", conn[key], key)
+	}
+	for _, key := range []string{"rpcs_started", "rpcs_completed", "wire_bytes_in", "wire_bytes_out"} {
+		assert.IsType(t, float64(0), conn[key], key)
+	}
+	_, err = time.Parse(time.RFC3339Nano, conn["open_time"].(string))
+	assert.NoError(t, err)
+	assert.Nil(t, conn["close_time"])
+	assert.Equal(t, addr, conn["local_addr"])
+	// The stream is still going.
+	assert.Equal(t, float64(1), conn["rpcs_started"])
+	assert.Equal(t, float64(0), conn["rpcs_completed"])
+	assert.Greater(t, conn["wire_bytes_out"], float64(0))
+}
+
+func TestDebugMux_ConnectionsLeaveOutClosed(t *testing.T) {
+	addr, debug := startDebugServer(t, flag.NewFlagSet("test", flag.ContinueOnError), released())
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	r := c.ServerStreaming(conn, "pixie")
+	require.True(t, r.Completed(), r.Error)
+	require.NoError(t, conn.Close())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := greetworkload.NewDebugClient(debug.Listener.Addr().String())
+	require.Eventually(t, func() bool {
+		conns, err := client.Connections(ctx)
+		require.NoError(t, err)
+		return len(conns) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestDebugMux_Config(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Int("port", 50051, "")
+	flags.Bool("https", false, "")
+	require.NoError(t, flags.Parse([]string{"--port=0"}))
+	_, debug := startDebugServer(t, flags, released())
+
+	config, err := greetworkload.NewDebugClient(debug.Listener.Addr().String()).Config(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"port": "0", "https": "false"}, config)
+}
+
+func TestDebugMux_Pprof(t *testing.T) {
+	_, debug := startDebugServer(t, flag.NewFlagSet("test", flag.ContinueOnError), released())
+	client := greetworkload.NewDebugClient(debug.Listener.Addr().String())
+	for _, name := range []string{"goroutine", "heap"} {
+		var buf bytes.Buffer
+		require.NoError(t, client.Profile(context.Background(), name, &buf))
+		assert.NotZero(t, buf.Len(), name)
+	}
+	assert.Error(t, client.Profile(context.Background(), "no_such_profile", &bytes.Buffer{}))
+}
+
+func TestDebugMux_ReadOnly(t *testing.T) {
+	_, debug := startDebugServer(t, flag.NewFlagSet("test", flag.ContinueOnError), released())
+	for _, path := range []string{"/connections", "/config"} {
+		resp, err := http.Post(debug.URL+path, "application/json", bytes.NewReader([]byte("{}")))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode, path)
+	}
+}
+
+func TestDebugClient_SnapshotEvery(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	addr, debug := startDebugServer(t, flag.NewFlagSet("test", flag.ContinueOnError), release)
+	startBlockedStream(t, addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var snapshots []*greetworkload.DebugSnapshot
+	err := greetworkload.NewDebugClient(debug.Listener.Addr().String()).SnapshotEvery(ctx, 10*time.Millisecond, func(s *greetworkload.DebugSnapshot) {
+		snapshots = append(snapshots, s)
+		if len(snapshots) == 3 {
+			cancel()
+		}
+	})
+	require.NoError(t, err)
+	require.Len(t, snapshots, 3)
+	for i, s := range snapshots {
+		assert.Greater(t, s.Goroutines, 0)
+		assert.NotZero(t, s.HeapAllocBytes)
+		require.Len(t, s.Connections, 1)
+		assert.Equal(t, int64(1), s.Connections[0].RPCsStarted)
+		if i > 0 {
+			assert.True(t, s.Time.After(snapshots[i-1].Time))
+		}
+	}
+}
+
+func TestDebugClient_SnapshotFails(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+	require.NoError(t, lis.Close())
+
+	err = greetworkload.NewDebugClient(addr).SnapshotEvery(context.Background(), time.Millisecond, func(*greetworkload.DebugSnapshot) {
+		t.Error("unexpected snapshot")
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,245 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Outcomes of a DialAttempt.
+const (
+	// DialWon is the attempt that connected first, whose connection is used.
+	DialWon = "won"
+	// DialLost is an attempt that connected after the winner, and was closed.
+	DialLost = "lost"
+	// DialAborted is an attempt that was still connecting when another won, and was cancelled.
+	DialAborted = "aborted"
+	// DialFailed is an attempt that failed before any won.
+	DialFailed = "failed"
+)
+
+// DialAttempt is an attempt of a DialRacer to connect to one of the addresses of a target.
+type DialAttempt struct {
+	// Addr is the address tried, as CanonicalAddr renders it, e.g. "[::1]:50051".
+	Addr       string    `json:"addr"`
+	StartTime  time.Time `json:"start_time"`
+	DurationNS int64     `json:"duration_ns"`
+	// Outcome is how the attempt ended. One of the Dial outcome constants.
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// DialRaceOptions configure a DialRacer.
+type DialRaceOptions struct {
+	// Stagger is how long each attempt is given to connect before the next address is tried
+	// alongside it, as the Connection Attempt Delay of RFC 8305. An attempt that fails has the next
+	// address tried at once.
+	Stagger time.Duration
+	// Dial dials a single address, e.g. SocketOptions.Dial. Nil dials TCP.
+	Dial func(context.Context, string) (net.Conn, error)
+	// Lookup resolves the host of a target. Nil uses net.DefaultResolver.
+	Lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DialRacer dials targets the way happy eyeballs clients do: it resolves the host of a target,
+// tries its addresses one after the other, alternating IPv6 and IPv4, each Stagger after the one
+// before, and uses the first to connect. The attempts still connecting are then aborted, which
+// leaves SYNs unanswered, and those that connected too are closed. Every attempt is recorded in
+// the ConnStats of the connection used, see ConnStats.DialAttempts.
+type DialRacer struct {
+	opts *DialRaceOptions
+}
+
+// NewDialRacer creates a DialRacer. Failures wrap ErrBadFlagCombination.
+func NewDialRacer(opts *DialRaceOptions) (*DialRacer, error) {
+	if opts.Stagger <= 0 {
+		return nil, badFlagsf("the dial stagger must be positive, got %v", opts.Stagger)
+	}
+	return &DialRacer{opts: opts}, nil
+}
+
+func (r *DialRacer) dial(ctx context.Context, addr string) (net.Conn, error) {
+	if r.opts.Dial != nil {
+		return r.opts.Dial(ctx, addr)
+	}
+	return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+}
+
+// addrs returns the addresses of target, in the order they are tried.
+func (r *DialRacer) addrs(ctx context.Context, target string) ([]string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IPAddr
+	if ip, zone, ok := parseIPZone(host); ok {
+		ips = []net.IPAddr{{IP: ip, Zone: zone}}
+	} else {
+		lookup := r.opts.Lookup
+		if lookup == nil {
+			lookup = net.DefaultResolver.LookupIPAddr
+		}
+		if ips, err = lookup(ctx, host); err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("%s has no addresses", host)
+		}
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range interleaveFamilies(ips) {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	return addrs, nil
+}
+
+// parseIPZone parses host as an IP address with an optional zone, e.g. "fe80::1%eth0".
+func parseIPZone(host string) (net.IP, string, bool) {
+	ip, zone, _ := cut(host, "%")
+	parsed := net.ParseIP(ip)
+	return parsed, zone, parsed != nil
+}
+
+// interleaveFamilies orders ips as RFC 8305 does: alternating families, starting with the family
+// of the first address, and otherwise in the order resolved.
+func interleaveFamilies(ips []net.IPAddr) []net.IPAddr {
+	var first, second []net.IPAddr
+	for _, ip := range ips {
+		if (ip.IP.To4() == nil) == (ips[0].IP.To4() == nil) {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	ordered := make([]net.IPAddr, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
+
+// Dial connects to target, a host and port, racing its addresses. It can be given to
+// grpc.WithContextDialer, and wrapped by ConnStatsHandler.DialerFrom to record the attempts.
+func (r *DialRacer) Dial(ctx context.Context, target string) (net.Conn, error) {
+	addrs, err := r.addrs(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		i    int
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	attempts := make([]DialAttempt, 0, len(addrs))
+	// stagger fires when the next address is due, and is nil once no more are.
+	var stagger <-chan time.Time
+	start := func() {
+		i := len(attempts)
+		attempts = append(attempts, DialAttempt{Addr: addrs[i], StartTime: time.Now()})
+		go func() {
+			conn, err := r.dial(ctx, addrs[i])
+			results <- result{i: i, conn: conn, err: err}
+		}()
+		stagger = nil
+		if len(attempts) < len(addrs) {
+			stagger = time.After(r.opts.Stagger)
+		}
+	}
+
+	start()
+	var winner net.Conn
+	var firstErr error
+	for pending := 1; pending > 0; {
+		select {
+		case <-stagger:
+			start()
+			pending++
+		case res := <-results:
+			pending--
+			a := &attempts[res.i]
+			a.DurationNS = time.Since(a.StartTime).Nanoseconds()
+			switch {
+			case res.err == nil && winner == nil:
+				winner = res.conn
+				a.Outcome = DialWon
+				// Aborts the other attempts, which are waited for so that they are recorded.
+				cancel()
+				stagger = nil
+			case res.err == nil:
+				res.conn.Close()
+				a.Outcome = DialLost
+			case winner != nil:
+				a.Outcome = DialAborted
+				a.Error = res.err.Error()
+			default:
+				a.Outcome = DialFailed
+				a.Error = res.err.Error()
+				if firstErr == nil {
+					firstErr = res.err
+				}
+				if stagger != nil {
+					start()
+					pending++
+				}
+			}
+		}
+	}
+	if winner == nil {
+		return nil, fmt.Errorf("every address of %s failed, first with: %w", target, firstErr)
+	}
+	return &racedConn{Conn: winner, attempts: attempts}, nil
+}
+
+// racedConn is the connection a DialRacer used, with the attempts made to set it up.
+type racedConn struct {
+	net.Conn
+	attempts []DialAttempt
+}
+
+// NetConn returns the connection of the attempt that won.
+func (c *racedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// dialAttemptsOf returns the attempts made to set up conn, if it is a connection of a DialRacer, or
+// wraps one.
+func dialAttemptsOf(conn net.Conn) []DialAttempt {
+	for {
+		if rc, ok := conn.(*racedConn); ok {
+			return rc.attempts
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = wrapper.NetConn()
+	}
+}
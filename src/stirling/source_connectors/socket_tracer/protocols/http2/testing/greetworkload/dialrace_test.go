@@ -0,0 +1,242 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// raceTarget is the host the dial race tests resolve with lookupRace.
+const raceTarget = "greet.test"
+
+// lookupRace resolves raceTarget to ips.
+func lookupRace(ips ...string) func(context.Context, string) ([]net.IPAddr, error) {
+	return func(_ context.Context, host string) ([]net.IPAddr, error) {
+		if host != raceTarget {
+			return nil, errors.New("unexpected host " + host)
+		}
+		addrs := make([]net.IPAddr, len(ips))
+		for i, ip := range ips {
+			addrs[i] = net.IPAddr{IP: net.ParseIP(ip)}
+		}
+		return addrs, nil
+	}
+}
+
+// raceDialer dials TCP, apart from the addresses of blackholed hosts, whose attempts hang until
+// they are aborted, and those of failing hosts, which fail at once.
+type raceDialer struct {
+	blackholed map[string]bool
+	failing    map[string]bool
+
+	mu      sync.Mutex
+	dialed  []string
+	aborted []string
+}
+
+func (d *raceDialer) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	d.mu.Lock()
+	d.dialed = append(d.dialed, addr)
+	d.mu.Unlock()
+	switch {
+	case d.blackholed[host]:
+		<-ctx.Done()
+		d.mu.Lock()
+		d.aborted = append(d.aborted, addr)
+		d.mu.Unlock()
+		return nil, ctx.Err()
+	case d.failing[host]:
+		return nil, errors.New("connection refused")
+	}
+	return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+}
+
+func startRaceServer(t *testing.T) int {
+	return startServerWith(t, &serverSetup{}).Port
+}
+
+func TestDialRacer_BlackholedAddress(t *testing.T) {
+	port := startRaceServer(t)
+	d := &raceDialer{blackholed: map[string]bool{"192.0.2.1": true}}
+	const stagger = 200 * time.Millisecond
+	racer, err := greetworkload.NewDialRacer(&greetworkload.DialRaceOptions{
+		Stagger: stagger,
+		Dial:    d.Dial,
+		Lookup:  lookupRace("192.0.2.1", "127.0.0.1"),
+	})
+	require.NoError(t, err)
+
+	connStats := greetworkload.NewConnStatsHandler()
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 10 * time.Second})
+	start := time.Now()
+	conn, err := c.Dial(net.JoinHostPort(raceTarget, strconv.Itoa(port)),
+		grpc.WithStatsHandler(connStats), grpc.WithContextDialer(connStats.DialerFrom(racer.Dial)))
+	require.NoError(t, err)
+	defer conn.Close()
+	r := c.SayHello(conn, "pixie")
+	elapsed := time.Since(start)
+	require.True(t, r.Completed(), r.Error)
+
+	// The live address is only tried once the blackholed one had its stagger, and then connects
+	// at once.
+	assert.GreaterOrEqual(t, elapsed, stagger)
+	assert.Less(t, elapsed, stagger+time.Second)
+
+	blackholed := net.JoinHostPort("192.0.2.1", strconv.Itoa(port))
+	live := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	d.mu.Lock()
+	assert.Equal(t, []string{blackholed, live}, d.dialed)
+	assert.Equal(t, []string{blackholed}, d.aborted)
+	d.mu.Unlock()
+
+	conns := connStats.Conns()
+	require.Len(t, conns, 1)
+	assert.Equal(t, live, conns[0].RemoteAddr)
+	attempts := conns[0].DialAttempts
+	require.Len(t, attempts, 2)
+	assert.Equal(t, blackholed, attempts[0].Addr)
+	assert.Equal(t, greetworkload.DialAborted, attempts[0].Outcome)
+	assert.NotEmpty(t, attempts[0].Error)
+	assert.GreaterOrEqual(t, attempts[0].DurationNS, stagger.Nanoseconds())
+	assert.Equal(t, live, attempts[1].Addr)
+	assert.Equal(t, greetworkload.DialWon, attempts[1].Outcome)
+	assert.Empty(t, attempts[1].Error)
+	assert.GreaterOrEqual(t, attempts[1].StartTime.Sub(attempts[0].StartTime), stagger)
+}
+
+func TestDialRacer_FailedAddress(t *testing.T) {
+	port := startRaceServer(t)
+	d := &raceDialer{failing: map[string]bool{"192.0.2.1": true}}
+	racer, err := greetworkload.NewDialRacer(&greetworkload.DialRaceOptions{
+		Stagger: 5 * time.Second,
+		Dial:    d.Dial,
+		Lookup:  lookupRace("192.0.2.1", "127.0.0.1"),
+	})
+	require.NoError(t, err)
+
+	// A failed attempt has the next address tried without waiting out the stagger.
+	start := time.Now()
+	conn, err := racer.Dial(context.Background(), net.JoinHostPort(raceTarget, strconv.Itoa(port)))
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Less(t, time.Since(start), time.Second)
+
+	connStats := greetworkload.NewConnStatsHandler()
+	wrapped, err := connStats.DialerFrom(func(context.Context, string) (net.Conn, error) { return conn, nil })(context.Background(), "")
+	require.NoError(t, err)
+	defer wrapped.Close()
+	attempts := connStats.Conns()[0].DialAttempts
+	require.Len(t, attempts, 2)
+	assert.Equal(t, greetworkload.DialFailed, attempts[0].Outcome)
+	assert.Equal(t, "connection refused", attempts[0].Error)
+	assert.Equal(t, greetworkload.DialWon, attempts[1].Outcome)
+}
+
+// closeTracker records that the connection it wraps is closed.
+type closeTracker struct {
+	net.Conn
+	closed chan struct{}
+}
+
+func (c *closeTracker) Close() error {
+	close(c.closed)
+	return c.Conn.Close()
+}
+
+func TestDialRacer_LateConnectionClosed(t *testing.T) {
+	port := startRaceServer(t)
+	slow := &closeTracker{closed: make(chan struct{})}
+	racer, err := greetworkload.NewDialRacer(&greetworkload.DialRaceOptions{
+		Stagger: 10 * time.Millisecond,
+		Dial: func(ctx context.Context, addr string) (net.Conn, error) {
+			if host, _, _ := net.SplitHostPort(addr); host == "::1" {
+				// Connects regardless of being aborted, after the other address won.
+				time.Sleep(200 * time.Millisecond)
+				conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+				if err != nil {
+					return nil, err
+				}
+				slow.Conn = conn
+				return slow, nil
+			}
+			return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		},
+		Lookup: lookupRace("::1", "127.0.0.1"),
+	})
+	require.NoError(t, err)
+
+	conn, err := racer.Dial(context.Background(), net.JoinHostPort(raceTarget, strconv.Itoa(port)))
+	require.NoError(t, err)
+	defer conn.Close()
+	select {
+	case <-slow.closed:
+	default:
+		t.Fatal("the connection that lost the race was left open")
+	}
+	assert.Equal(t, "127.0.0.1", conn.RemoteAddr().(*net.TCPAddr).IP.String())
+}
+
+func TestDialRacer_EveryAddressFails(t *testing.T) {
+	d := &raceDialer{failing: map[string]bool{"::1": true, "::2": true, "10.0.0.1": true, "10.0.0.2": true}}
+	racer, err := greetworkload.NewDialRacer(&greetworkload.DialRaceOptions{
+		Stagger: time.Second,
+		Dial:    d.Dial,
+		Lookup:  lookupRace("::1", "::2", "10.0.0.1", "10.0.0.2"),
+	})
+	require.NoError(t, err)
+
+	_, err = racer.Dial(context.Background(), raceTarget+":50051")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "connection refused")
+	// Families alternate, from the family resolved first.
+	assert.Equal(t, []string{"[::1]:50051", "10.0.0.1:50051", "[::2]:50051", "10.0.0.2:50051"}, d.dialed)
+}
+
+func TestDialRacer_Literal(t *testing.T) {
+	d := &raceDialer{failing: map[string]bool{"fe80::1%eth0": true}}
+	racer, err := greetworkload.NewDialRacer(&greetworkload.DialRaceOptions{
+		Stagger: time.Second,
+		Dial:    d.Dial,
+		Lookup: func(context.Context, string) ([]net.IPAddr, error) {
+			return nil, errors.New("literals are not looked up")
+		},
+	})
+	require.NoError(t, err)
+	_, err = racer.Dial(context.Background(), "[fe80::1%eth0]:50051")
+	assert.Contains(t, err.Error(), "connection refused")
+	assert.Equal(t, []string{"[fe80::1%eth0]:50051"}, d.dialed)
+}
+
+func TestNewDialRacer_Invalid(t *testing.T) {
+	_, err := greetworkload.NewDialRacer(&greetworkload.DialRaceOptions{})
+	assert.True(t, errors.Is(err, greetworkload.ErrBadFlagCombination), err)
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The errors the greet harness fails with, for callers to tell apart with errors.Is. The errors
+// returned wrap one of them along with their underlying cause.
+var (
+	// ErrDialFailed reports that a connection to a server could not be set up.
+	ErrDialFailed = errors.New("dial failed")
+	// ErrRPCFailed reports that a call failed. It is matched by every *RPCError.
+	ErrRPCFailed = errors.New("rpc failed")
+	// ErrBadFlagCombination reports options, or flags, that cannot be used together.
+	ErrBadFlagCombination = errors.New("bad flag combination")
+	// ErrStatsWrite reports that a file of the ground truth of a run, such as its stats or records,
+	// could not be written.
+	ErrStatsWrite = errors.New("failed to write stats")
+)
+
+// RPCError is a call that failed, with the status it failed with.
+type RPCError struct {
+	Method string
+	Status *status.Status
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("%s: %s: %s: %s", ErrRPCFailed, e.Method, e.Status.Code(), e.Status.Message())
+}
+
+// Is makes every RPCError match ErrRPCFailed.
+func (e *RPCError) Is(target error) bool {
+	return target == ErrRPCFailed
+}
+
+// GRPCStatus returns the status of the call, so that status.FromError and status.Code see it.
+func (e *RPCError) GRPCStatus() *status.Status {
+	return e.Status
+}
+
+// dialError wraps err, the reason a connection to target could not be set up, in ErrDialFailed.
+func dialError(target string, err error) error {
+	return fmt.Errorf("%w: %s: %w", ErrDialFailed, target, err)
+}
+
+// badFlagsf returns an ErrBadFlagCombination with a message formatted from format and args.
+func badFlagsf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrBadFlagCombination, fmt.Sprintf(format, args...))
+}
+
+// WriteOutputFile creates the file at path, and writes it with write. Errors wrap ErrStatsWrite.
+func WriteOutputFile(path string, write func(io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrStatsWrite, err)
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("%w: %s: %w", ErrStatsWrite, path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("%w: %w", ErrStatsWrite, err)
+	}
+	return nil
+}
+
+// The exit codes of the greet binaries, after sysexits.h. Other failures exit with 1.
+const (
+	ExitBadFlagCombination = 64
+	ExitDialFailed         = 69
+	ExitStatsWrite         = 74
+	ExitRPCFailed          = 76
+)
+
+// exitCauses are the errors the exit codes stand for.
+var exitCauses = []struct {
+	code int
+	err  error
+}{
+	{ExitBadFlagCombination, ErrBadFlagCombination},
+	{ExitDialFailed, ErrDialFailed},
+	{ExitStatsWrite, ErrStatsWrite},
+	{ExitRPCFailed, ErrRPCFailed},
+}
+
+// ExitCode returns the exit code a greet binary failing with err exits with.
+func ExitCode(err error) int {
+	for _, c := range exitCauses {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return 1
+}
+
+// ExitCause returns the error a greet binary that exited with code failed with, or nil if the code
+// does not stand for one.
+func ExitCause(code int) error {
+	for _, c := range exitCauses {
+		if c.code == code {
+			return c.err
+		}
+	}
+	return nil
+}
+
+// codeNames maps the names of status codes, as recorded in CallRecord.Code, back to the codes.
+var codeNames = func() map[string]codes.Code {
+	m := make(map[string]codes.Code)
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		m[c.String()] = c
+	}
+	return m
+}()
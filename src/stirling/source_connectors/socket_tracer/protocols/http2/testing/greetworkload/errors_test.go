@@ -0,0 +1,164 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+func TestCallRecord_Err(t *testing.T) {
+	addr := startServerWith(t, &serverSetup{GRPC: []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if req.(*pb.HelloRequest).Name == "fail" {
+				return nil, status.Error(codes.NotFound, "no such greeting")
+			}
+			return handler(ctx, req)
+		}),
+	}}).Addr
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ok := c.SayHello(conn, "pixie")
+	assert.NoError(t, ok.Err())
+
+	failed := c.SayHello(conn, "fail")
+	// Records read back from JSON have lost the status, but not its code and message.
+	var buf bytes.Buffer
+	require.NoError(t, greetworkload.WriteRecords(&buf, nil, []*greetworkload.CallRecord{failed}))
+	read, err := greetworkload.ReadRecords(&buf)
+	require.NoError(t, err)
+
+	for _, r := range []*greetworkload.CallRecord{failed, read[0]} {
+		err := r.Err()
+		require.Error(t, err)
+		assert.ErrorIs(t, err, greetworkload.ErrRPCFailed)
+		assert.NotErrorIs(t, err, greetworkload.ErrDialFailed)
+		var rpcErr *greetworkload.RPCError
+		require.ErrorAs(t, err, &rpcErr)
+		assert.Equal(t, "SayHello", rpcErr.Method)
+		assert.Equal(t, codes.NotFound, rpcErr.Status.Code())
+		assert.Contains(t, rpcErr.Status.Message(), "no such greeting")
+		assert.Equal(t, codes.NotFound, status.Code(err))
+		assert.Equal(t, greetworkload.ExitRPCFailed, greetworkload.ExitCode(err))
+	}
+}
+
+func TestCallRecord_ErrIgnoresExpectedFailures(t *testing.T) {
+	cancelled := &greetworkload.CallRecord{Method: "SayHello", Code: codes.Canceled.String(), Cancelled: true}
+	assert.NoError(t, cancelled.Err())
+	expected := &greetworkload.CallRecord{Method: "SayGoodbye", Code: codes.Unimplemented.String(), ExpectedCode: codes.Unimplemented.String()}
+	assert.NoError(t, expected.Err())
+	unexpected := &greetworkload.CallRecord{Method: "SayGoodbye", Code: codes.OK.String(), ExpectedCode: codes.Unimplemented.String()}
+	// Completed calls are never failures, even when they were made to fail.
+	assert.NoError(t, unexpected.Err())
+}
+
+func TestDialFailed(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+	lis.Close()
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 200 * time.Millisecond})
+	_, err = c.NewWarmCold(addr, nil)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, greetworkload.ErrDialFailed)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, greetworkload.ExitDialFailed, greetworkload.ExitCode(err))
+}
+
+func TestBadFlagCombination(t *testing.T) {
+	err := greetworkload.NewClient(&greetworkload.ClientOptions{HTTPS: true}).CheckH2CUpgrade()
+	assert.ErrorIs(t, err, greetworkload.ErrBadFlagCombination)
+
+	err = (&greetworkload.HTTP2Settings{InitialWindowSize: 1024}).Validate(false)
+	assert.ErrorIs(t, err, greetworkload.ErrBadFlagCombination)
+	err = (&greetworkload.HTTP2Settings{MaxHeaderListSize: 1024}).Validate(true)
+	assert.ErrorIs(t, err, greetworkload.ErrBadFlagCombination)
+	// Out of range whatever the transport.
+	err = (&greetworkload.HTTP2Settings{MaxFrameSize: 1}).Validate(true)
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, greetworkload.ErrBadFlagCombination)
+
+	// Rejected before dialing, so not a dial failure.
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{HTTP2: &greetworkload.HTTP2Settings{HeaderTableSize: 1024}})
+	_, err = c.Dial("localhost:1")
+	assert.ErrorIs(t, err, greetworkload.ErrBadFlagCombination)
+	assert.NotErrorIs(t, err, greetworkload.ErrDialFailed)
+	assert.Equal(t, greetworkload.ExitBadFlagCombination, greetworkload.ExitCode(err))
+}
+
+func TestWriteOutputFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "stats.json")
+	require.NoError(t, greetworkload.WriteOutputFile(path, func(w io.Writer) error {
+		_, err := io.WriteString(w, "[]")
+		return err
+	}))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "[]", string(b))
+
+	err = greetworkload.WriteOutputFile(filepath.Join(dir, "missing", "stats.json"), func(io.Writer) error { return nil })
+	assert.ErrorIs(t, err, greetworkload.ErrStatsWrite)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	errEncode := errors.New("encode failed")
+	err = greetworkload.WriteOutputFile(path, func(io.Writer) error { return errEncode })
+	assert.ErrorIs(t, err, greetworkload.ErrStatsWrite)
+	assert.ErrorIs(t, err, errEncode)
+	assert.Equal(t, greetworkload.ExitStatsWrite, greetworkload.ExitCode(err))
+}
+
+func TestExitCode(t *testing.T) {
+	for _, want := range []error{
+		greetworkload.ErrBadFlagCombination,
+		greetworkload.ErrDialFailed,
+		greetworkload.ErrStatsWrite,
+		greetworkload.ErrRPCFailed,
+	} {
+		code := greetworkload.ExitCode(fmt.Errorf("main: %w", want))
+		assert.NotEqual(t, 1, code, want)
+		assert.Equal(t, want, greetworkload.ExitCause(code))
+	}
+	assert.Equal(t, 1, greetworkload.ExitCode(errors.New("other")))
+	assert.Nil(t, greetworkload.ExitCause(1))
+	assert.Nil(t, greetworkload.ExitCause(0))
+}
@@ -0,0 +1,257 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// EscalationName is the name of the server-streaming requests a server answers with an escalation:
+// a reply for every size of a schedule, in order, with a payload of that many bytes. The schedule is
+// sent in the EscalationHeader of the request, or else is DefaultEscalationSchedule.
+const EscalationName = "escalate"
+
+// EscalationHeader is the request metadata an escalation schedule is sent in, as
+// ParseEscalationSchedule reads it.
+const EscalationHeader = "x-escalation-sizes"
+
+// MaxEscalationSize is the largest payload of an escalation reply, which leaves room for the rest
+// of the reply under the DefaultMaxRecvMsgSize that gRPC clients receive.
+const MaxEscalationSize = DefaultMaxRecvMsgSize - 1<<10
+
+// DefaultEscalationSchedule are the payload sizes of an escalation, on both sides of the sizes
+// HTTP/2 implementations buffer data by: the 16KiB default SETTINGS_MAX_FRAME_SIZE, and the 64KiB
+// default flow control windows.
+var DefaultEscalationSchedule = []int{1, 100, 1 << 10, 15 << 10, 16 << 10, 17 << 10, 64<<10 - 1, 64 << 10, 64<<10 + 1, 1 << 20}
+
+// escalationMessage is the format of the message of the index-th reply of an escalation, which
+// declares the size of its payload and its CRC-32 (IEEE).
+const escalationMessage = "escalation #%d size=%d crc32=%08x"
+
+// ParseEscalationSchedule reads a schedule of comma-separated sizes, each a number of bytes with an
+// optional B, KB or MB suffix, the latter two of 1024 and 1048576 bytes, and an optional +N or -N
+// bytes after the suffix, e.g. "1,100B,1KB,64KB-1,64KB+1,1MB". "default" is
+// DefaultEscalationSchedule.
+func ParseEscalationSchedule(spec string) ([]int, error) {
+	if strings.TrimSpace(spec) == "default" {
+		return append([]int(nil), DefaultEscalationSchedule...), nil
+	}
+	if strings.TrimSpace(spec) == "" {
+		return nil, fmt.Errorf("escalation schedule must have at least one size")
+	}
+	var sizes []int
+	for i, text := range strings.Split(spec, ",") {
+		n, err := parseEscalationSize(strings.TrimSpace(text))
+		if err != nil {
+			return nil, fmt.Errorf("size %d %q: %w", i+1, text, err)
+		}
+		if n < 0 || n > MaxEscalationSize {
+			return nil, fmt.Errorf("size %d %q: must be from 0 to %d bytes, got %d", i+1, text, MaxEscalationSize, n)
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes, nil
+}
+
+func parseEscalationSize(text string) (int, error) {
+	offset := 0
+	if i := strings.LastIndexAny(text, "+-"); i > 0 {
+		var err error
+		if offset, err = strconv.Atoi(text[i:]); err != nil {
+			return 0, fmt.Errorf("invalid offset %q", text[i:])
+		}
+		text = text[:i]
+	}
+	unit := 1
+	for _, u := range []struct {
+		suffix string
+		bytes  int
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"B", 1}} {
+		if strings.HasSuffix(text, u.suffix) {
+			text, unit = strings.TrimSuffix(text, u.suffix), u.bytes
+			break
+		}
+	}
+	n, err := strconv.Atoi(text)
+	if err != nil {
+		return 0, fmt.Errorf("expected a number of bytes, e.g. 100, 16KB or 64KB-1")
+	}
+	return n*unit + offset, nil
+}
+
+// FormatEscalationSchedule returns sizes as ParseEscalationSchedule reads them.
+func FormatEscalationSchedule(sizes []int) string {
+	texts := make([]string, len(sizes))
+	for i, n := range sizes {
+		texts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(texts, ",")
+}
+
+// escalationPayload returns the payload of the index-th reply of an escalation, n bytes that
+// differ from those of the other replies, so that bytes reassembled into the wrong reply show.
+func escalationPayload(index, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte((i + 31*index) % 251)
+	}
+	return b
+}
+
+// escalate answers an escalation, see EscalationName.
+func (s *Server) escalate(srv pb.StreamingGreeter_SayHelloServerStreamingServer) error {
+	sizes := DefaultEscalationSchedule
+	if md, _ := metadata.FromIncomingContext(srv.Context()); len(md.Get(EscalationHeader)) > 0 {
+		var err error
+		if sizes, err = ParseEscalationSchedule(md.Get(EscalationHeader)[0]); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid %s: %v", EscalationHeader, err)
+		}
+	}
+	var sum pb.StreamChecksum
+	for i, n := range sizes {
+		payload := escalationPayload(i, n)
+		reply := s.reply(fmt.Sprintf(escalationMessage, i, n, crc32.ChecksumIEEE(payload)))
+		reply.Payload = payload
+		if s.opts.Checksums {
+			sum.Add(reply.Message)
+		}
+		if err := srv.Send(reply); err != nil {
+			return err
+		}
+	}
+	s.setStreamChecksum(srv, sum)
+	return nil
+}
+
+// EscalationResult is how the replies of an escalation came through.
+type EscalationResult struct {
+	Sizes []int
+	// Intact is the number of replies received whole, in order, of the size asked for, and with
+	// their payload matching the size and checksum they declare.
+	Intact int
+	// FirstFailedSize is the size of the first reply that did not come through intact, or -1 if
+	// every reply did, and FirstFailure says how it failed.
+	FirstFailedSize int
+	FirstFailure    string
+}
+
+// OK returns true if every reply of the schedule came through intact.
+func (r *EscalationResult) OK() bool {
+	return r.FirstFailedSize < 0 && r.Intact == len(r.Sizes)
+}
+
+func (r *EscalationResult) String() string {
+	if r.OK() {
+		return fmt.Sprintf("all %d sizes intact", len(r.Sizes))
+	}
+	return fmt.Sprintf("%d of %d sizes intact, first failed at %d bytes: %s", r.Intact, len(r.Sizes), r.FirstFailedSize, r.FirstFailure)
+}
+
+// fail records the failure of the index-th reply, unless an earlier one failed.
+func (r *EscalationResult) fail(index int, format string, args ...interface{}) {
+	if r.FirstFailedSize >= 0 {
+		return
+	}
+	r.FirstFailedSize = r.Sizes[index]
+	r.FirstFailure = fmt.Sprintf("reply #%d: %s", index, fmt.Sprintf(format, args...))
+}
+
+// check checks reply, the index-th of the escalation.
+func (r *EscalationResult) check(index int, reply *pb.HelloReply) {
+	var i, n int
+	var sum uint32
+	if _, err := fmt.Sscanf(reply.Message, escalationMessage, &i, &n, &sum); err != nil {
+		r.fail(index, "malformed message %q", reply.Message)
+		return
+	}
+	switch {
+	case i != index:
+		r.fail(index, "received reply #%d in its place", i)
+	case n != r.Sizes[index]:
+		r.fail(index, "declares %d bytes", n)
+	case len(reply.Payload) != n:
+		r.fail(index, "payload of %d bytes, declared %d", len(reply.Payload), n)
+	case crc32.ChecksumIEEE(reply.Payload) != sum:
+		r.fail(index, "payload checksum %08x, declared %08x", crc32.ChecksumIEEE(reply.Payload), sum)
+	default:
+		r.Intact++
+	}
+}
+
+// Escalate calls StreamingGreeter.SayHelloServerStreaming over conn as an escalation through
+// sizes, see EscalationName, and checks every reply received. The record fails if the call does,
+// and the result tells the first size that did not come through intact.
+func (c *Client) Escalate(conn *grpc.ClientConn, sizes []int) (*CallRecord, *EscalationResult) {
+	r := newCallRecord("SayHelloServerStreaming")
+	r.Names = []string{EscalationName}
+	r.StreamCount = int32(len(sizes))
+	result := &EscalationResult{Sizes: sizes, FirstFailedSize: -1}
+
+	ctx, cancel := c.callContext()
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(withRequestID(ctx, r), EscalationHeader, FormatEscalationSchedule(sizes))
+
+	req := &pb.HelloRequest{Name: EscalationName, Count: r.StreamCount}
+	stream, err := pb.NewStreamingGreeterClient(conn).SayHelloServerStreaming(ctx, req, withRecord(r))
+	if err != nil {
+		if len(sizes) > 0 {
+			result.fail(0, "%v", err)
+		}
+		return c.finish(r, cancelPlan{}, err), result
+	}
+	var sum pb.StreamChecksum
+	for i := 0; ; i++ {
+		reply, err := stream.Recv()
+		if err != nil {
+			setAttempt(r, stream.Trailer())
+			if err == io.EOF {
+				c.verifyStream(r, stream.Trailer(), sum)
+				err = nil
+			}
+			switch {
+			case i < len(sizes) && err != nil:
+				result.fail(i, "%v", err)
+			case i < len(sizes):
+				result.fail(i, "stream ended after %d replies", i)
+			}
+			log.Printf("Escalation through %d sizes: %s request_id=%s", len(sizes), result, r.RequestID)
+			return c.finish(r, cancelPlan{}, err), result
+		}
+		r.Replies++
+		r.InstanceID = reply.InstanceId
+		c.verifyReply(r, i, reply)
+		sum.Add(reply.Message)
+		if i >= len(sizes) {
+			// Replies past the schedule are not checked, as they have no size to be checked against.
+			continue
+		}
+		result.check(i, reply)
+	}
+}
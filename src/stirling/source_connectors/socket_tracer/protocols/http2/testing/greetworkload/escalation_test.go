@@ -0,0 +1,148 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// startEscalationServer serves StreamingGreeter with checksums, over TLS if useTLS is set, and
+// with the server options given.
+func startEscalationServer(t *testing.T, useTLS bool, opts ...grpc.ServerOption) string {
+	if useTLS {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}})))
+	}
+	return startServerWith(t, &serverSetup{Options: &greetworkload.ServerOptions{Checksums: true}, GRPC: opts}).Addr
+}
+
+func TestEscalate_DefaultSchedule(t *testing.T) {
+	for _, useTLS := range []bool{false, true} {
+		useTLS := useTLS
+		name := "plaintext"
+		if useTLS {
+			name = "tls"
+		}
+		t.Run(name, func(t *testing.T) {
+			addr := startEscalationServer(t, useTLS)
+			c := greetworkload.NewClient(&greetworkload.ClientOptions{HTTPS: useTLS, VerifyChecksums: true, Timeout: 10 * time.Second})
+			conn, err := c.Dial(addr)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			r, result := c.Escalate(conn, greetworkload.DefaultEscalationSchedule)
+			assert.Equal(t, codes.OK.String(), r.Code, r.Error)
+			assert.True(t, result.OK(), "%s", result)
+			assert.Equal(t, len(greetworkload.DefaultEscalationSchedule), result.Intact)
+			assert.Equal(t, -1, result.FirstFailedSize)
+			assert.Equal(t, int64(len(greetworkload.DefaultEscalationSchedule)), int64(r.Replies))
+			assert.Empty(t, r.ChecksumMismatches)
+			assert.False(t, r.StreamChecksumMismatch)
+		})
+	}
+}
+
+// payloadCorruptingStream flips a byte of the payload of the replies of size bytes it sends.
+type payloadCorruptingStream struct {
+	grpc.ServerStream
+	size int
+}
+
+func (s *payloadCorruptingStream) SendMsg(m interface{}) error {
+	if reply, ok := m.(*pb.HelloReply); ok && len(reply.Payload) == s.size {
+		reply.Payload[s.size/2] ^= 0xff
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+func TestEscalate_ReportsFirstFailingSize(t *testing.T) {
+	const size = 17 << 10
+	corrupt := func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &payloadCorruptingStream{ServerStream: ss, size: size})
+	}
+	addr := startEscalationServer(t, false, grpc.StreamInterceptor(corrupt))
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 10 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	sizes := []int{16 << 10, size, 64 << 10, size}
+	r, result := c.Escalate(conn, sizes)
+	// The call itself goes through, only the reply is not what it declares.
+	assert.Equal(t, codes.OK.String(), r.Code, r.Error)
+	assert.False(t, result.OK())
+	assert.Equal(t, size, result.FirstFailedSize)
+	assert.Contains(t, result.FirstFailure, "reply #1: payload checksum")
+	assert.Equal(t, 2, result.Intact)
+}
+
+func TestEscalate_SizeTooLarge(t *testing.T) {
+	addr := startEscalationServer(t, false)
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 10 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	r, result := c.Escalate(conn, []int{1, greetworkload.MaxEscalationSize + 1})
+	assert.Equal(t, codes.InvalidArgument.String(), r.Code)
+	assert.Equal(t, 1, result.FirstFailedSize)
+	assert.Zero(t, result.Intact)
+}
+
+func TestParseEscalationSchedule(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []int
+		wantErr string
+	}{
+		{spec: "1,100B,1KB,15KB", want: []int{1, 100, 1024, 15 << 10}},
+		{spec: " 64KB-1 , 64KB , 64KB+1 ", want: []int{64<<10 - 1, 64 << 10, 64<<10 + 1}},
+		{spec: "1MB,0", want: []int{1 << 20, 0}},
+		{spec: "default", want: greetworkload.DefaultEscalationSchedule},
+		{spec: "", wantErr: "at least one size"},
+		{spec: "1,,2", wantErr: `size 2 "": expected a number of bytes`},
+		{spec: "16kb", wantErr: "expected a number of bytes"},
+		{spec: "1KB+x", wantErr: `invalid offset "+x"`},
+		{spec: "-1", wantErr: "must be from 0"},
+		{spec: "4MB", wantErr: "must be from 0"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.spec, func(t *testing.T) {
+			sizes, err := greetworkload.ParseEscalationSchedule(tc.spec)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, sizes)
+			again, err := greetworkload.ParseEscalationSchedule(greetworkload.FormatEscalationSchedule(sizes))
+			require.NoError(t, err)
+			assert.Equal(t, sizes, again)
+		})
+	}
+}
@@ -0,0 +1,218 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// An event log is a file of a fixed size: a header, followed by a fixed number of slots of
+// eventSlotLen bytes, each holding the binary encoding of a CallRecord. Writers reserve slots
+// with an atomic counter, so that appends take no lock, and each writes its own slot, finishing
+// with the commit marker. Slots not committed, as those of a process that died mid-write, are
+// skipped when the log is decoded.
+const (
+	// EventLogVersion is the version of the encoding of the event logs written.
+	EventLogVersion = 1
+
+	eventLogMagic     = "PXEVLOG\x00"
+	eventLogHeaderLen = 64
+	eventSlotLen      = 128
+	eventCommitted    = 1
+
+	// The offsets of the fields of a version 1 slot. Strings are stored with a length byte, and
+	// truncated to the room they have.
+	slotCommit       = 0
+	slotAttempt      = 4
+	slotCode         = 6
+	slotMethodLen    = 7
+	slotStart        = 8
+	slotDuration     = 16
+	slotRequestIDLen = 24
+	slotRequestID    = 25
+	slotMethod       = 88
+	slotEnd          = 120
+)
+
+// ErrEventLogVersion reports an event log written with an encoding this build cannot decode.
+var ErrEventLogVersion = errors.New("unsupported event log version")
+
+// codesByName maps the names of the gRPC status codes back to the codes.
+var codesByName = func() map[string]codes.Code {
+	m := make(map[string]codes.Code)
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		m[c.String()] = c
+	}
+	return m
+}()
+
+// EventLog is an append-only log of CallRecords, of a capacity fixed when it is created, that
+// calls can be recorded in at rates a JSON encoder cannot keep up with. Only the method, request
+// ID, attempt, start, duration and code of a call are kept. Records that do not fit are counted
+// rather than kept, see Dropped. On Unix, the log is a memory-mapped file, so that the records of
+// a process that dies are still there to decode.
+type EventLog struct {
+	f   *os.File
+	buf []byte
+	// sync writes buf to f where it is not mapped.
+	sync     func() error
+	unmap    func() error
+	capacity int64
+	next     int64
+	dropped  int64
+}
+
+// CreateEventLog creates, or truncates, the file at path as an event log of capacity records.
+func CreateEventLog(path string, capacity int) (*EventLog, error) {
+	if capacity < 1 {
+		return nil, badFlagsf("the event log capacity must be positive, got %d", capacity)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	size := eventLogHeaderLen + capacity*eventSlotLen
+	if err := f.Truncate(int64(size)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	l := &EventLog{f: f, capacity: int64(capacity)}
+	if err := l.mapFile(size); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to map the event log: %w", err)
+	}
+	copy(l.buf, eventLogMagic)
+	binary.LittleEndian.PutUint32(l.buf[8:], EventLogVersion)
+	binary.LittleEndian.PutUint32(l.buf[12:], eventSlotLen)
+	binary.LittleEndian.PutUint64(l.buf[16:], uint64(capacity))
+	return l, nil
+}
+
+// Append records r in the next free slot, or counts it as dropped if the log is full. It is safe
+// to call from any number of goroutines at once.
+func (l *EventLog) Append(r *CallRecord) {
+	i := atomic.AddInt64(&l.next, 1) - 1
+	if i >= l.capacity {
+		atomic.AddInt64(&l.dropped, 1)
+		return
+	}
+	slot := l.buf[eventLogHeaderLen+i*eventSlotLen:][:eventSlotLen]
+	binary.LittleEndian.PutUint16(slot[slotAttempt:], uint16(r.Attempt))
+	slot[slotCode] = byte(codesByName[r.Code])
+	slot[slotMethodLen] = byte(copy(slot[slotMethod:slotEnd], r.Method))
+	binary.LittleEndian.PutUint64(slot[slotStart:], uint64(r.StartTime.UnixNano()))
+	binary.LittleEndian.PutUint64(slot[slotDuration:], uint64(r.DurationNS))
+	slot[slotRequestIDLen] = byte(copy(slot[slotRequestID:slotMethod], r.RequestID))
+	binary.LittleEndian.PutUint32(slot[slotCommit:], eventCommitted)
+}
+
+// Len returns the number of records appended and kept so far.
+func (l *EventLog) Len() int {
+	n := atomic.LoadInt64(&l.next)
+	if n > l.capacity {
+		return int(l.capacity)
+	}
+	return int(n)
+}
+
+// Dropped returns the number of records that did not fit in the log.
+func (l *EventLog) Dropped() int64 {
+	return atomic.LoadInt64(&l.dropped)
+}
+
+// Records decodes the records appended so far, in the order their slots were reserved. It should
+// not be called with appends in flight.
+func (l *EventLog) Records() []*CallRecord {
+	// The log was encoded by this build, so it decodes.
+	records, _ := DecodeEventLog(l.buf)
+	return records
+}
+
+// Close writes the log out, and closes its file. It should not be called with appends in flight.
+func (l *EventLog) Close() error {
+	if n := l.Dropped(); n > 0 {
+		log.Printf("The event log dropped %d records that did not fit its %d slots", n, l.capacity)
+	}
+	err := l.sync()
+	if unmapErr := l.unmap(); err == nil {
+		err = unmapErr
+	}
+	if closeErr := l.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ReadEventLog decodes the event log at path.
+func ReadEventLog(path string) ([]*CallRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeEventLog(data)
+}
+
+// DecodeEventLog decodes the committed records of an event log, in the order their slots were
+// reserved. It fails with ErrEventLogVersion on logs of an encoding it does not know.
+func DecodeEventLog(data []byte) ([]*CallRecord, error) {
+	if len(data) < eventLogHeaderLen || !bytes.Equal(data[:8], []byte(eventLogMagic)) {
+		return nil, errors.New("not an event log")
+	}
+	version := binary.LittleEndian.Uint32(data[8:])
+	slotLen := int(binary.LittleEndian.Uint32(data[12:]))
+	capacity := binary.LittleEndian.Uint64(data[16:])
+	var decode func([]byte) *CallRecord
+	switch version {
+	case 1:
+		decode = decodeSlotV1
+	default:
+		return nil, fmt.Errorf("%w %d, the latest known is %d", ErrEventLogVersion, version, EventLogVersion)
+	}
+	if slotLen < slotEnd || uint64(len(data)-eventLogHeaderLen)/uint64(slotLen) < capacity {
+		return nil, fmt.Errorf("event log of %d bytes is too short for %d slots of %d bytes", len(data), capacity, slotLen)
+	}
+	var records []*CallRecord
+	for i := 0; i < int(capacity); i++ {
+		slot := data[eventLogHeaderLen+i*slotLen:][:slotLen]
+		if binary.LittleEndian.Uint32(slot[slotCommit:]) != eventCommitted {
+			continue
+		}
+		records = append(records, decode(slot))
+	}
+	return records, nil
+}
+
+func decodeSlotV1(slot []byte) *CallRecord {
+	return &CallRecord{
+		Method:     string(slot[slotMethod:][:slot[slotMethodLen]]),
+		StartTime:  time.Unix(0, int64(binary.LittleEndian.Uint64(slot[slotStart:]))),
+		DurationNS: int64(binary.LittleEndian.Uint64(slot[slotDuration:])),
+		RequestID:  string(slot[slotRequestID:][:slot[slotRequestIDLen]]),
+		Attempt:    int(binary.LittleEndian.Uint16(slot[slotAttempt:])),
+		Code:       codes.Code(slot[slotCode]).String(),
+	}
+}
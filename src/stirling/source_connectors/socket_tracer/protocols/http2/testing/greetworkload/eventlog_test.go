@@ -0,0 +1,221 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+func createEventLog(t testing.TB, capacity int) (*greetworkload.EventLog, string) {
+	path := filepath.Join(t.TempDir(), "events.bin")
+	l, err := greetworkload.CreateEventLog(path, capacity)
+	require.NoError(t, err)
+	return l, path
+}
+
+func TestEventLog_RoundTrip(t *testing.T) {
+	l, path := createEventLog(t, 4)
+	start := time.Unix(1700000000, 123456789)
+	records := []*greetworkload.CallRecord{
+		{Method: "SayHello", StartTime: start, DurationNS: 1500, RequestID: "abc", Attempt: 1, Code: "OK"},
+		{Method: "SayHelloServerStreaming", StartTime: start.Add(time.Second), DurationNS: 42, RequestID: greetworkload.NewRequestID(), Attempt: 3, Code: "DeadlineExceeded"},
+		// Only the method, request ID, attempt, start, duration and code are kept.
+		{Method: "SayHi", StartTime: start, Code: "Unavailable", Error: "gone", Authority: "a.local", Cancelled: true},
+	}
+	for _, r := range records {
+		l.Append(r)
+	}
+	assert.Equal(t, 3, l.Len())
+	assert.Zero(t, l.Dropped())
+	want := []*greetworkload.CallRecord{records[0], records[1],
+		{Method: "SayHi", StartTime: start, Code: "Unavailable"}}
+	assert.Equal(t, want, l.Records())
+	require.NoError(t, l.Close())
+
+	decoded, err := greetworkload.ReadEventLog(path)
+	require.NoError(t, err)
+	assert.Equal(t, want, decoded)
+}
+
+func TestEventLog_TruncatesLongStrings(t *testing.T) {
+	l, _ := createEventLog(t, 1)
+	defer l.Close()
+	l.Append(&greetworkload.CallRecord{Method: strings.Repeat("m", 100), RequestID: strings.Repeat("r", 100), StartTime: time.Unix(0, 0), Code: "OK"})
+	r := l.Records()[0]
+	assert.Equal(t, strings.Repeat("m", 32), r.Method)
+	assert.Equal(t, strings.Repeat("r", 63), r.RequestID)
+}
+
+func TestEventLog_CountsDropped(t *testing.T) {
+	l, path := createEventLog(t, 10)
+	for i := 0; i < 15; i++ {
+		l.Append(&greetworkload.CallRecord{Method: "SayHello", StartTime: time.Now(), Code: "OK"})
+	}
+	assert.Equal(t, 10, l.Len())
+	assert.EqualValues(t, 5, l.Dropped())
+	require.NoError(t, l.Close())
+	decoded, err := greetworkload.ReadEventLog(path)
+	require.NoError(t, err)
+	assert.Len(t, decoded, 10)
+}
+
+func TestEventLog_NoLossUnderConcurrentAppends(t *testing.T) {
+	const workers, perWorker = 16, 25000
+	l, path := createEventLog(t, workers*perWorker)
+	ids := make([][]string, workers)
+	for w := range ids {
+		ids[w] = make([]string, perWorker)
+		for i := range ids[w] {
+			ids[w][i] = fmt.Sprintf("%d-%d", w, i)
+		}
+	}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(ids []string) {
+			defer wg.Done()
+			r := &greetworkload.CallRecord{Method: "SayHello", Attempt: 1, Code: "OK"}
+			for _, id := range ids {
+				r.RequestID = id
+				r.StartTime = time.Now()
+				l.Append(r)
+			}
+		}(ids[w])
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	t.Logf("Appended %d records from %d goroutines in %v, %.0f records/s", workers*perWorker, workers, elapsed, workers*perWorker/elapsed.Seconds())
+	require.NoError(t, l.Close())
+
+	decoded, err := greetworkload.ReadEventLog(path)
+	require.NoError(t, err)
+	require.Len(t, decoded, workers*perWorker)
+	seen := make(map[string]bool, len(decoded))
+	for _, r := range decoded {
+		assert.False(t, seen[r.RequestID], "record %s decoded twice", r.RequestID)
+		seen[r.RequestID] = true
+	}
+	for _, worker := range ids {
+		for _, id := range worker {
+			if !seen[id] {
+				t.Fatalf("record %s was lost", id)
+			}
+		}
+	}
+}
+
+func TestDecodeEventLog_Versions(t *testing.T) {
+	l, path := createEventLog(t, 2)
+	l.Append(&greetworkload.CallRecord{Method: "SayHello", RequestID: "first", StartTime: time.Now(), Code: "OK"})
+	l.Append(&greetworkload.CallRecord{Method: "SayHello", RequestID: "second", StartTime: time.Now(), Code: "OK"})
+	require.NoError(t, l.Close())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	// A slot that was never committed, as one a process died writing, is skipped.
+	uncommitted := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(uncommitted[64:], 0)
+	decoded, err := greetworkload.DecodeEventLog(uncommitted)
+	require.NoError(t, err)
+	require.Len(t, decoded, 1)
+	assert.Equal(t, "second", decoded[0].RequestID)
+
+	newer := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(newer[8:], greetworkload.EventLogVersion+1)
+	_, err = greetworkload.DecodeEventLog(newer)
+	assert.ErrorIs(t, err, greetworkload.ErrEventLogVersion)
+
+	_, err = greetworkload.DecodeEventLog([]byte(`{"method":"SayHello"}`))
+	assert.Error(t, err)
+	_, err = greetworkload.DecodeEventLog(data[:len(data)-1])
+	assert.Error(t, err)
+	_, err = greetworkload.CreateEventLog(filepath.Join(t.TempDir(), "empty.bin"), 0)
+	assert.ErrorIs(t, err, greetworkload.ErrBadFlagCombination)
+}
+
+func TestRequestTracer_EventLog(t *testing.T) {
+	l, path := createEventLog(t, 16)
+	tracer := greetworkload.NewRequestTracer(&greetworkload.RequestTracerOptions{EventLog: l})
+	faults, err := greetworkload.NewFaultInjector(nil, 1)
+	require.NoError(t, err)
+	addr := startTracedServer(t, tracer, faults)
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, id := range []string{"a", "b", "c"} {
+		_, err := pb.NewGreeterClient(conn).SayHello(metadata.AppendToOutgoingContext(ctx, greetworkload.RequestIDHeader, id), &pb.HelloRequest{Name: "pixie"})
+		require.NoError(t, err)
+	}
+	records := tracer.Records()
+	require.Len(t, records, 3)
+	for i, id := range []string{"a", "b", "c"} {
+		assert.Equal(t, id, records[i].RequestID)
+		assert.Equal(t, "SayHello", records[i].Method)
+		assert.Equal(t, "OK", records[i].Code)
+		assert.Equal(t, 1, records[i].Attempt)
+	}
+	require.NoError(t, l.Close())
+	decoded, err := greetworkload.ReadEventLog(path)
+	require.NoError(t, err)
+	assert.Equal(t, records, decoded)
+}
+
+func BenchmarkEventLog_Append(b *testing.B) {
+	l, _ := createEventLog(b, b.N)
+	defer l.Close()
+	r := &greetworkload.CallRecord{Method: "SayHello", StartTime: time.Now(), DurationNS: 1000, RequestID: greetworkload.NewRequestID(), Attempt: 1, Code: "OK"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.Append(r)
+	}
+}
+
+func BenchmarkEventLog_AppendParallel(b *testing.B) {
+	l, _ := createEventLog(b, b.N)
+	defer l.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := &greetworkload.CallRecord{Method: "SayHello", StartTime: time.Now(), DurationNS: 1000, RequestID: greetworkload.NewRequestID(), Attempt: 1, Code: "OK"}
+		for pb.Next() {
+			l.Append(r)
+		}
+	})
+}
@@ -0,0 +1,36 @@
+//go:build darwin || linux
+// +build darwin linux
+
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import "syscall"
+
+// mapFile maps the size bytes of the file of the log into its buffer, shared with the file.
+func (l *EventLog) mapFile(size int) error {
+	buf, err := syscall.Mmap(int(l.f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	l.buf = buf
+	// The kernel writes the mapped pages back, even if the process dies.
+	l.sync = func() error { return nil }
+	l.unmap = func() error { return syscall.Munmap(buf) }
+	return nil
+}
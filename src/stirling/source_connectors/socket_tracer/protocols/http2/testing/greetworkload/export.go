@@ -0,0 +1,139 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// ExportCSV is the format of the files written by WriteRPCExport.
+	ExportCSV = "csv"
+	// RPCExportVersion is the version of the files written by WriteRPCExport. It is bumped
+	// whenever the columns, or the lines before them, change.
+	RPCExportVersion = 2
+	// rpcExportMagic starts the first line of the files written by WriteRPCExport, followed by
+	// their version.
+	rpcExportMagic = "# greet-rpc-export version="
+)
+
+// Sides that record an RPCRow.
+const (
+	SideClient = "client"
+	SideServer = "server"
+)
+
+// rpcExportColumns are the columns of the current RPCExportVersion.
+var rpcExportColumns = []string{
+	"side", "method", "request_id", "start_time_ns", "end_time_ns",
+	"req_bytes", "resp_bytes", "req_messages", "resp_messages", "status",
+	"client_ip", "client_port", "server_ip", "server_port",
+}
+
+// RPCExportColumns returns the columns of the current RPCExportVersion, in order.
+func RPCExportColumns() []string {
+	return append([]string(nil), rpcExportColumns...)
+}
+
+// RPCExportHeader returns the first line of the files of the given version, without its newline.
+func RPCExportHeader(version int) string {
+	return rpcExportMagic + strconv.Itoa(version)
+}
+
+// RPCRow is a single attempt of a call, as seen by one side of it. It is a row of the files
+// written by WriteRPCExport.
+type RPCRow struct {
+	// Side is the side that saw the call, SideClient or SideServer.
+	Side string
+	// Method is the full name of the method called, e.g.
+	// "/px.stirling.protocols.http2.testing.Greeter/SayHello".
+	Method string
+	// RequestID is the RequestIDHeader of the call, if any.
+	RequestID string
+	StartTime time.Time
+	EndTime   time.Time
+	// ReqBytes and RespBytes are the bytes of the gRPC messages sent each way, each counted with
+	// its 5-byte prefix, after compression. ReqMessages and RespMessages count the messages.
+	ReqBytes     int64
+	RespBytes    int64
+	ReqMessages  int64
+	RespMessages int64
+	// Status is the gRPC status code the call finished with, by name, e.g. "OK".
+	Status string
+	// ClientIP, ClientPort, ServerIP and ServerPort are the addresses of the connection the call
+	// was made over. The IPs are as CanonicalAddr renders them, without brackets, e.g. "::1" or
+	// "fe80::1%eth0".
+	ClientIP   string
+	ClientPort int
+	ServerIP   string
+	ServerPort int
+}
+
+// setConn sets the connection of r from the addresses of its client and server.
+func (r *RPCRow) setConn(client, server net.Addr) {
+	r.ClientIP, r.ClientPort = splitAddr(client)
+	r.ServerIP, r.ServerPort = splitAddr(server)
+}
+
+func splitAddr(addr net.Addr) (string, int) {
+	host, port, err := net.SplitHostPort(CanonicalAddr(addr))
+	if err != nil {
+		return CanonicalAddr(addr), 0
+	}
+	n, _ := strconv.Atoi(port)
+	return host, n
+}
+
+// WriteRPCExport writes rows to w as CSV, for tooling that loads records into tables. The first
+// line is RPCExportHeader, which versions the columns, followed by RunMetadataComment and meta,
+// if not nil, and then a line naming the columns. Times are Unix nanoseconds.
+func WriteRPCExport(w io.Writer, meta *RunMetadata, rows []RPCRow) error {
+	if _, err := fmt.Fprintln(w, RPCExportHeader(RPCExportVersion)); err != nil {
+		return err
+	}
+	if meta != nil {
+		if _, err := fmt.Fprintln(w, RunMetadataComment+meta.String()); err != nil {
+			return err
+		}
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.Write(rpcExportColumns); err != nil {
+		return err
+	}
+	for _, r := range rows {
+		err := cw.Write([]string{
+			r.Side, r.Method, r.RequestID,
+			strconv.FormatInt(r.StartTime.UnixNano(), 10), strconv.FormatInt(r.EndTime.UnixNano(), 10),
+			strconv.FormatInt(r.ReqBytes, 10), strconv.FormatInt(r.RespBytes, 10),
+			strconv.FormatInt(r.ReqMessages, 10), strconv.FormatInt(r.RespMessages, 10),
+			r.Status,
+			r.ClientIP, strconv.Itoa(r.ClientPort), r.ServerIP, strconv.Itoa(r.ServerPort),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+func TestConnStatsHandler_KeepRPCs(t *testing.T) {
+	serverStats := greetworkload.NewConnStatsHandler()
+	serverStats.KeepRPCs()
+	s := startServerWith(t, &serverSetup{Stats: serverStats})
+
+	clientStats := greetworkload.NewConnStatsHandler()
+	clientStats.KeepRPCs()
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 10 * time.Second, StreamCount: 3})
+	conn, err := c.Dial(s.Addr, grpc.WithStatsHandler(clientStats))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	records := []*greetworkload.CallRecord{
+		c.SayHello(conn, "pixie"),
+		c.ServerStreaming(conn, "pixie"),
+		c.ClientStreaming(conn, []string{"a", "b", "c"}),
+		c.BidirStreaming(conn, []string{"a", "b"}),
+	}
+	for _, r := range records {
+		require.True(t, r.Completed(), r.Error)
+	}
+	require.Eventually(t, func() bool { return len(serverStats.RPCs()) == len(records) }, 5*time.Second, 10*time.Millisecond)
+
+	// The messages each way of every call.
+	messages := [][2]int64{{1, 1}, {1, 3}, {3, 1}, {2, 2}}
+	conns := clientStats.Conns()
+	require.Len(t, conns, 1)
+	clientAddr, err := net.ResolveTCPAddr("tcp", conns[0].LocalAddr)
+	require.NoError(t, err)
+	for _, side := range []struct {
+		name  string
+		stats *greetworkload.ConnStatsHandler
+	}{{greetworkload.SideClient, clientStats}, {greetworkload.SideServer, serverStats}} {
+		rows := side.stats.RPCs()
+		require.Len(t, rows, len(records), side.name)
+		byID := make(map[string]greetworkload.RPCRow)
+		for _, r := range rows {
+			byID[r.RequestID] = r
+		}
+		for i, rec := range records {
+			r, ok := byID[rec.RequestID]
+			require.True(t, ok, "%s: no row of %s %s", side.name, rec.Method, rec.RequestID)
+			assert.Equal(t, side.name, r.Side)
+			assert.True(t, strings.HasSuffix(r.Method, "/"+rec.Method), r.Method)
+			assert.Equal(t, "OK", r.Status)
+			assert.Equal(t, messages[i][0], r.ReqMessages, "%s %s", side.name, rec.Method)
+			assert.Equal(t, messages[i][1], r.RespMessages, "%s %s", side.name, rec.Method)
+			assert.Greater(t, r.ReqBytes, 5*r.ReqMessages)
+			assert.Greater(t, r.RespBytes, 5*r.RespMessages)
+			assert.True(t, r.EndTime.After(r.StartTime))
+			assert.Equal(t, "127.0.0.1", r.ClientIP)
+			assert.Equal(t, clientAddr.Port, r.ClientPort)
+			assert.Equal(t, "127.0.0.1", r.ServerIP)
+			assert.Equal(t, s.Port, r.ServerPort)
+		}
+	}
+
+	// Rows are only kept when asked for.
+	assert.Empty(t, greetworkload.NewConnStatsHandler().RPCs())
+}
+
+func TestWriteRPCExport(t *testing.T) {
+	start := time.Unix(1700000000, 5)
+	rows := []greetworkload.RPCRow{{
+		Side:         greetworkload.SideClient,
+		Method:       "/px.stirling.protocols.http2.testing.Greeter/SayHello",
+		RequestID:    "a",
+		StartTime:    start,
+		EndTime:      start.Add(time.Millisecond),
+		ReqBytes:     12,
+		RespBytes:    20,
+		ReqMessages:  1,
+		RespMessages: 1,
+		Status:       "OK",
+		ClientIP:     "::1",
+		ClientPort:   40000,
+		ServerIP:     "::1",
+		ServerPort:   50051,
+	}}
+	var buf bytes.Buffer
+	require.NoError(t, greetworkload.WriteRPCExport(&buf, nil, rows))
+	columns := "side,method,request_id,start_time_ns,end_time_ns,req_bytes,resp_bytes,req_messages,resp_messages,status,client_ip,client_port,server_ip,server_port\n"
+	row := "client,/px.stirling.protocols.http2.testing.Greeter/SayHello,a,1700000000000000005,1700000000001000005,12,20,1,1,OK,::1,40000,::1,50051\n"
+	assert.Equal(t, "# greet-rpc-export version=2\n"+columns+row, buf.String())
+	assert.Equal(t, "# greet-rpc-export version=2", greetworkload.RPCExportHeader(greetworkload.RPCExportVersion))
+
+	// The run metadata goes between the version line and the columns.
+	buf.Reset()
+	meta := &greetworkload.RunMetadata{Seed: 1}
+	require.NoError(t, greetworkload.WriteRPCExport(&buf, meta, rows))
+	assert.Equal(t, "# greet-rpc-export version=2\n# run_metadata: "+meta.String()+"\n"+columns+row, buf.String())
+}
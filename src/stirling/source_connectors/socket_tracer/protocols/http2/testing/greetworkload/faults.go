@@ -0,0 +1,236 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FaultConfig describes the failures injected into the RPCs handled by a server.
+type FaultConfig struct {
+	// LatencyMillis delays every RPC before its handler runs.
+	LatencyMillis int64 `json:"latency_millis"`
+	// Latency is a distribution, as ParseLatencyDistribution reads it, from which every RPC draws a
+	// further delay, e.g. "lognormal(mu=2ms,sigma=0.5)".
+	Latency string `json:"latency,omitempty"`
+	// ErrorRate is the fraction of RPCs, in [0, 1], that fail with Code instead of being handled.
+	ErrorRate float64 `json:"error_rate"`
+	// Code is the status code of injected failures. Accepts either the number or the quoted
+	// name, e.g. "UNAVAILABLE", when decoded from JSON.
+	Code codes.Code `json:"code"`
+
+	// latency is Latency parsed, set once the config is applied.
+	latency LatencyDistribution
+}
+
+// Validate checks that the config can be applied.
+func (c *FaultConfig) Validate() error {
+	if c.LatencyMillis < 0 {
+		return fmt.Errorf("latency_millis must not be negative, got %d", c.LatencyMillis)
+	}
+	if c.Latency != "" {
+		if _, err := ParseLatencyDistribution(c.Latency); err != nil {
+			return fmt.Errorf("invalid latency: %w", err)
+		}
+	}
+	if c.ErrorRate < 0 || c.ErrorRate > 1 {
+		return fmt.Errorf("error_rate must be in [0, 1], got %v", c.ErrorRate)
+	}
+	if c.ErrorRate > 0 && c.Code == codes.OK {
+		return fmt.Errorf("code must not be OK when error_rate is set")
+	}
+	return nil
+}
+
+// LoadFaultConfig reads a FaultConfig from a JSON file.
+func LoadFaultConfig(path string) (*FaultConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &FaultConfig{}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// FaultReloadSignal returns the signal on which servers re-read their fault config, SIGUSR1, or an
+// UnsupportedPlatformError on platforms without one.
+func FaultReloadSignal() (os.Signal, error) {
+	if err := CheckPlatform(FeatureFaultReloadSignal); err != nil {
+		return nil, err
+	}
+	return faultReloadSignal, nil
+}
+
+// FaultInjector injects the failures described by a FaultConfig into a server's RPCs. The config
+// can be replaced at any time; each RPC uses the config that was current when it started.
+type FaultInjector struct {
+	cfg atomic.Value // *FaultConfig
+	// updateMu serializes config changes, so that read-modify-write updates are not lost.
+	updateMu sync.Mutex
+
+	mu  sync.Mutex
+	rng *rand.Rand
+	// latencyRng draws the latencies, so that which RPCs fail does not depend on them.
+	latencyRng *rand.Rand
+}
+
+// latencySeedSalt derives the seed of the latencies from that of the failures.
+const latencySeedSalt = 0x6c6174656e6379
+
+// NewFaultInjector creates a FaultInjector. A nil cfg injects nothing. The failures and latencies
+// injected are drawn from seed, so that the same seed draws them in the same order.
+func NewFaultInjector(cfg *FaultConfig, seed int64) (*FaultInjector, error) {
+	f := &FaultInjector{
+		rng:        rand.New(rand.NewSource(seed)),
+		latencyRng: rand.New(rand.NewSource(seed ^ latencySeedSalt)),
+	}
+	if cfg == nil {
+		cfg = &FaultConfig{}
+	}
+	if err := f.SetConfig(cfg); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Config returns the current config. The returned value must not be modified.
+func (f *FaultInjector) Config() *FaultConfig {
+	return f.cfg.Load().(*FaultConfig)
+}
+
+// SetConfig replaces the current config. RPCs already in progress are not affected.
+func (f *FaultInjector) SetConfig(cfg *FaultConfig) error {
+	f.updateMu.Lock()
+	defer f.updateMu.Unlock()
+	return f.setConfigLocked(cfg)
+}
+
+// UpdateConfig calls update on a copy of the current config, then replaces the current config with
+// it. Concurrent updates are applied one after the other. The config is left as it was if update
+// fails or the result is invalid.
+func (f *FaultInjector) UpdateConfig(update func(cfg *FaultConfig) error) error {
+	f.updateMu.Lock()
+	defer f.updateMu.Unlock()
+	cfg := *f.Config()
+	if err := update(&cfg); err != nil {
+		return err
+	}
+	return f.setConfigLocked(&cfg)
+}
+
+func (f *FaultInjector) setConfigLocked(cfg *FaultConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	c := *cfg
+	c.latency = nil
+	if c.Latency != "" {
+		// Cannot fail, Validate parsed it already.
+		c.latency, _ = ParseLatencyDistribution(c.Latency)
+	}
+	f.cfg.Store(&c)
+	return nil
+}
+
+func (f *FaultInjector) shouldFail(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rng.Float64() < rate
+}
+
+// delay returns how long to delay an RPC by under cfg: LatencyMillis, plus a draw from Latency.
+func (f *FaultInjector) delay(cfg *FaultConfig) time.Duration {
+	d := time.Duration(cfg.LatencyMillis) * time.Millisecond
+	if cfg.latency != nil {
+		f.mu.Lock()
+		d += cfg.latency.Sample(f.latencyRng)
+		f.mu.Unlock()
+	}
+	return d
+}
+
+// inject applies cfg to an RPC about to be handled, returning the error the RPC should fail with.
+func (f *FaultInjector) inject(ctx context.Context, cfg *FaultConfig) error {
+	if d := f.delay(cfg); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	if f.shouldFail(cfg.ErrorRate) {
+		return status.Error(cfg.Code, "injected failure")
+	}
+	return nil
+}
+
+// outsideWorkload reports whether method is left alone by the fault injector and request tracer:
+// the GreeterStats, GreeterFeatures, health and reflection services are how a workload is observed,
+// not part of it.
+func outsideWorkload(method string) bool {
+	return isObservationMethod(method) || strings.HasPrefix(method, "/grpc.reflection.")
+}
+
+// UnaryServerInterceptor returns an interceptor that injects failures into unary RPCs, apart from
+// those to GreeterStats, GreeterFeatures, health and reflection.
+func (f *FaultInjector) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if outsideWorkload(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		if err := f.inject(ctx, f.Config()); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns an interceptor that injects failures into streaming RPCs, apart
+// from those to GreeterStats, GreeterFeatures, health and reflection.
+func (f *FaultInjector) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if outsideWorkload(info.FullMethod) {
+			return handler(srv, ss)
+		}
+		if err := f.inject(ss.Context(), f.Config()); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/reflection"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+func startFaultyServer(t *testing.T, faults *greetworkload.FaultInjector) string {
+	return startServerWith(t, &serverSetup{GRPC: []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(faults.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(faults.StreamServerInterceptor()),
+	}}).Addr
+}
+
+func countCodes(c *greetworkload.Client, conn *grpc.ClientConn, n int) map[string]int {
+	tally := make(map[string]int)
+	for i := 0; i < n; i++ {
+		tally[c.SayHello(conn, "pixie").Code]++
+	}
+	return tally
+}
+
+func putFaults(t *testing.T, url string, body string) *http.Response {
+	req, err := http.NewRequest(http.MethodPut, url+"/faults", bytes.NewBufferString(body))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestFaultInjector_RuntimeReconfiguration(t *testing.T) {
+	faults, err := greetworkload.NewFaultInjector(nil, 1)
+	require.NoError(t, err)
+	addr := startFaultyServer(t, faults)
+	admin := httptest.NewServer(greetworkload.NewAdminMux(faults, nil, nil))
+	defer admin.Close()
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, map[string]int{"OK": 50}, countCodes(c, conn, 50))
+
+	resp := putFaults(t, admin.URL, `{"error_rate": 1, "code": "UNAVAILABLE"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, map[string]int{"Unavailable": 50}, countCodes(c, conn, 50))
+
+	resp, err = http.Get(admin.URL + "/faults")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	cfg := &greetworkload.FaultConfig{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(cfg))
+	assert.Equal(t, &greetworkload.FaultConfig{ErrorRate: 1, Code: codes.Unavailable}, cfg)
+
+	// Partial updates keep the other fields.
+	resp = putFaults(t, admin.URL, `{"error_rate": 0}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, codes.Unavailable, faults.Config().Code)
+	assert.Equal(t, map[string]int{"OK": 50}, countCodes(c, conn, 50))
+}
+
+func TestFaultInjector_RejectsInvalidConfig(t *testing.T) {
+	faults, err := greetworkload.NewFaultInjector(nil, 1)
+	require.NoError(t, err)
+	admin := httptest.NewServer(greetworkload.NewAdminMux(faults, nil, nil))
+	defer admin.Close()
+
+	for _, body := range []string{`{"error_rate": 2, "code": 14}`, `{"error_rate": 0.5}`, `{"latency_millis": -1}`, `not json`} {
+		resp := putFaults(t, admin.URL, body)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+	}
+	assert.Equal(t, &greetworkload.FaultConfig{}, faults.Config())
+}
+
+func TestFaultInjector_ConcurrentUpdates(t *testing.T) {
+	faults, err := greetworkload.NewFaultInjector(nil, 1)
+	require.NoError(t, err)
+
+	const numUpdates = 50
+	var wg sync.WaitGroup
+	for i := 0; i < numUpdates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := faults.UpdateConfig(func(cfg *greetworkload.FaultConfig) error {
+				latency := cfg.LatencyMillis
+				// Yield between the read and the write, so that unserialized updates would be lost.
+				runtime.Gosched()
+				cfg.LatencyMillis = latency + 1
+				return nil
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(numUpdates), faults.Config().LatencyMillis)
+}
+
+func TestFaultInjector_ConcurrentPutsKeepEveryField(t *testing.T) {
+	faults, err := greetworkload.NewFaultInjector(nil, 1)
+	require.NoError(t, err)
+	admin := httptest.NewServer(greetworkload.NewAdminMux(faults, nil, nil))
+	defer admin.Close()
+
+	var wg sync.WaitGroup
+	for _, body := range []string{`{"latency_millis": 5}`, `{"error_rate": 1, "code": "UNAVAILABLE"}`} {
+		wg.Add(1)
+		go func(body string) {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodPut, admin.URL+"/faults", bytes.NewBufferString(body))
+			if !assert.NoError(t, err) {
+				return
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}(body)
+	}
+	wg.Wait()
+	assert.Equal(t, &greetworkload.FaultConfig{LatencyMillis: 5, ErrorRate: 1, Code: codes.Unavailable}, faults.Config())
+}
+
+func TestFaultInjector_SkipsStatsAndReflection(t *testing.T) {
+	faults, err := greetworkload.NewFaultInjector(&greetworkload.FaultConfig{ErrorRate: 1, Code: codes.Unavailable}, 1)
+	require.NoError(t, err)
+	s := startServerWith(t, &serverSetup{
+		GRPC: []grpc.ServerOption{
+			grpc.ChainUnaryInterceptor(faults.UnaryServerInterceptor()),
+			grpc.ChainStreamInterceptor(faults.StreamServerInterceptor()),
+		},
+		Register: func(s *grpc.Server, greeter *greetworkload.Server) {
+			registerGreeter(s, greeter)
+			pb.RegisterGreeterStatsServer(s, greetworkload.NewCallStats())
+			reflection.Register(s)
+		},
+	})
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(s.Addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, codes.Unavailable.String(), c.SayHello(conn, "pixie").Code)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = pb.NewGreeterStatsClient(conn).GetStats(ctx, &pb.GetStatsRequest{})
+	assert.NoError(t, err)
+
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_ListServices{},
+	}))
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.NotEmpty(t, resp.GetListServicesResponse().GetService())
+}
+
+func TestFaultInjector_ConfigAppliesToNewRPCsOnly(t *testing.T) {
+	faults, err := greetworkload.NewFaultInjector(&greetworkload.FaultConfig{LatencyMillis: 200}, 1)
+	require.NoError(t, err)
+	addr := startFaultyServer(t, faults)
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr, grpc.WithBlock())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	done := make(chan *greetworkload.CallRecord)
+	go func() { done <- c.SayHello(conn, "pixie") }()
+	// Let the RPC start with the latency-only config, then make every new RPC fail.
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, faults.SetConfig(&greetworkload.FaultConfig{ErrorRate: 1, Code: codes.Internal}))
+
+	r := <-done
+	assert.True(t, r.Completed(), r.Error)
+	assert.Equal(t, codes.Internal.String(), c.SayHello(conn, "pixie").Code)
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"math"
+	"runtime"
+	"runtime/debug"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// GreeterFeaturesService is the full name of the service that reports a server's FeatureMatrix.
+const GreeterFeaturesService = pb.GreeterFeatures_ServiceName
+
+// The largest messages, in bytes, gRPC servers receive and send unless configured otherwise.
+const (
+	DefaultMaxRecvMsgSize = 4 << 20
+	DefaultMaxSendMsgSize = math.MaxInt32
+)
+
+// The codecs reported in FeatureMatrix.Codec.
+const (
+	CodecProto = "proto"
+	CodecSized = "sized"
+	// CodecDeterministic marshals with greetpb.DeterministicCodec.
+	CodecDeterministic = "deterministic"
+)
+
+// knownCompressors are the compressors looked for when reporting those registered, as gRPC cannot
+// list them.
+var knownCompressors = []string{"deflate", "gzip", "snappy", "zstd"}
+
+// FeatureServer serves the GreeterFeatures service.
+type FeatureServer struct {
+	matrix *pb.FeatureMatrix
+	faults *FaultInjector
+}
+
+// NewFeatureServer creates a FeatureServer that reports matrix, along with the compressors
+// registered and the build of the binary. The faults are read from faults, if not nil, on every
+// call, so that they follow its reloads.
+func NewFeatureServer(matrix *pb.FeatureMatrix, faults *FaultInjector) *FeatureServer {
+	m := *matrix
+	m.Compressors = RegisteredCompressors()
+	m.Build = buildInfo()
+	return &FeatureServer{matrix: &m, faults: faults}
+}
+
+// GetFeatureMatrix implements GreeterFeatures.GetFeatureMatrix.
+func (s *FeatureServer) GetFeatureMatrix(context.Context, *pb.GetFeatureMatrixRequest) (*pb.FeatureMatrix, error) {
+	m := *s.matrix
+	if s.faults != nil {
+		cfg := s.faults.Config()
+		m.Faults = &pb.FaultFeatures{LatencyMillis: cfg.LatencyMillis, ErrorRate: cfg.ErrorRate}
+		if cfg.ErrorRate > 0 {
+			m.Faults.Code = cfg.Code.String()
+		}
+	}
+	return &m, nil
+}
+
+// RegisteredCompressors returns the names of the compressors registered with gRPC, sorted.
+func RegisteredCompressors() []string {
+	var names []string
+	for _, name := range knownCompressors {
+		if encoding.GetCompressor(name) != nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func buildInfo() *pb.BuildInfo {
+	b := &pb.BuildInfo{GoVersion: runtime.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return b
+	}
+	b.Version = info.Main.Version
+	b.Revision = vcsRevision(info)
+	return b
+}
+
+// FetchFeatureMatrix asks the server at the other end of conn for its FeatureMatrix. Servers that
+// do not report one fail the call with Unimplemented.
+func FetchFeatureMatrix(ctx context.Context, conn *grpc.ClientConn) (*pb.FeatureMatrix, error) {
+	return pb.NewGreeterFeaturesClient(conn).GetFeatureMatrix(ctx, &pb.GetFeatureMatrixRequest{})
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// startFeatureServer serves Greeter, GreeterStats and GreeterFeatures, configured the way the greet
+// server configures them from its flags.
+func startFeatureServer(t *testing.T, matrix *pb.FeatureMatrix, faults *greetworkload.FaultInjector) (*greetworkload.CallStats, string) {
+	callStats := greetworkload.NewCallStats()
+	s := startServerWith(t, &serverSetup{
+		Options: &greetworkload.ServerOptions{InstanceID: matrix.InstanceId},
+		GRPC: []grpc.ServerOption{
+			grpc.ChainUnaryInterceptor(callStats.UnaryServerInterceptor(), faults.UnaryServerInterceptor()),
+			grpc.MaxRecvMsgSize(int(matrix.MaxRecvMsgSize)),
+			grpc.MaxSendMsgSize(int(matrix.MaxSendMsgSize)),
+		},
+		Register: func(s *grpc.Server, greeter *greetworkload.Server) {
+			pb.RegisterGreeterServer(s, greeter)
+			pb.RegisterGreeterStatsServer(s, callStats)
+			pb.RegisterGreeterFeaturesServer(s, greetworkload.NewFeatureServer(matrix, faults))
+		},
+	})
+	return callStats, s.Addr
+}
+
+func fetchFeatures(t *testing.T, conn *grpc.ClientConn) *pb.FeatureMatrix {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m, err := greetworkload.FetchFeatureMatrix(ctx, conn)
+	require.NoError(t, err)
+	return m
+}
+
+func TestFeatureServer_ReportsConfig(t *testing.T) {
+	faults, err := greetworkload.NewFaultInjector(&greetworkload.FaultConfig{LatencyMillis: 3}, 1)
+	require.NoError(t, err)
+	_, addr := startFeatureServer(t, &pb.FeatureMatrix{
+		Codec:            greetworkload.CodecProto,
+		MaxRecvMsgSize:   1024,
+		MaxSendMsgSize:   greetworkload.DefaultMaxSendMsgSize,
+		Checksums:        true,
+		ValidateRequests: true,
+		InstanceId:       "features",
+	}, faults)
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	m := fetchFeatures(t, conn)
+	assert.False(t, m.Tls)
+	assert.Equal(t, greetworkload.CodecProto, m.Codec)
+	assert.Contains(t, m.Compressors, "gzip")
+	assert.Equal(t, greetworkload.RegisteredCompressors(), m.Compressors)
+	assert.Equal(t, int32(1024), m.MaxRecvMsgSize)
+	assert.Equal(t, int32(greetworkload.DefaultMaxSendMsgSize), m.MaxSendMsgSize)
+	assert.Equal(t, &pb.FaultFeatures{LatencyMillis: 3}, m.Faults)
+	assert.True(t, m.Checksums)
+	assert.True(t, m.ValidateRequests)
+	assert.Equal(t, "features", m.InstanceId)
+	require.NotNil(t, m.Build)
+	assert.Equal(t, runtime.Version(), m.Build.GoVersion)
+
+	// The reported limit is the one enforced.
+	r := c.SayHello(conn, strings.Repeat("a", int(m.MaxRecvMsgSize)))
+	assert.Equal(t, codes.ResourceExhausted.String(), r.Code)
+	r = c.SayHello(conn, "pixie")
+	assert.True(t, r.Completed(), r.Error)
+}
+
+func TestFeatureServer_FollowsFaultReloads(t *testing.T) {
+	faults, err := greetworkload.NewFaultInjector(&greetworkload.FaultConfig{}, 1)
+	require.NoError(t, err)
+	callStats, addr := startFeatureServer(t, &pb.FeatureMatrix{
+		MaxRecvMsgSize: greetworkload.DefaultMaxRecvMsgSize,
+		MaxSendMsgSize: greetworkload.DefaultMaxSendMsgSize,
+	}, faults)
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, &pb.FaultFeatures{}, fetchFeatures(t, conn).Faults)
+
+	// Every call of the workload now fails, but not the feature matrix, which is not counted either.
+	require.NoError(t, faults.SetConfig(&greetworkload.FaultConfig{ErrorRate: 1, Code: codes.Unavailable}))
+	assert.Equal(t, &pb.FaultFeatures{ErrorRate: 1, Code: "Unavailable"}, fetchFeatures(t, conn).Faults)
+	assert.Empty(t, callStats.Snapshot())
+}
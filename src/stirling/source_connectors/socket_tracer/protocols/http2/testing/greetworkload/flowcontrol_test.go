@@ -0,0 +1,111 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// sendLog collects the times at which the server sent its streaming replies.
+type sendLog struct {
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func (l *sendLog) record(_ int, sent time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.times = append(l.times, sent)
+}
+
+func (l *sendLog) get() []time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]time.Time(nil), l.times...)
+}
+
+// dialSlowReader connects with a fixed 64KiB receive window. This disables the BDP estimator,
+// which would otherwise grow the window on loopback until the server never blocks.
+func dialSlowReader(t *testing.T, c *greetworkload.Client, addr string) *grpc.ClientConn {
+	conn, err := c.Dial(addr, grpc.WithInitialWindowSize(64*1024), grpc.WithInitialConnWindowSize(64*1024))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestServerStreaming_SlowReaderPacesServer(t *testing.T) {
+	sends := &sendLog{}
+	_, addr := startServer(t, &greetworkload.ServerOptions{
+		StreamReplyBytes: 32 * 1024,
+		OnStreamSend:     sends.record,
+	})
+
+	const numReplies = 40
+	const interval = 20 * time.Millisecond
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{
+		Timeout:      10 * time.Second,
+		StreamCount:  numReplies,
+		RecvInterval: interval,
+	})
+	r := c.ServerStreaming(dialSlowReader(t, c, addr), "pixie")
+	require.True(t, r.Completed(), r.Error)
+	require.Len(t, r.RecvTimesNS, numReplies)
+
+	sent := sends.get()
+	require.Len(t, sent, numReplies)
+
+	// The replies buffered by the flow control windows and the transport are the only ones the
+	// server can send ahead of the reader; every later send waits for the reader to catch up.
+	const slack = 8
+	for i := slack; i < numReplies; i++ {
+		assert.False(t, sent[i].Before(time.Unix(0, r.RecvTimesNS[i-slack])),
+			"reply %d sent before reply %d was read", i, i-slack)
+	}
+	assert.GreaterOrEqual(t, sent[numReplies-1].Sub(sent[0]), (numReplies-slack)*interval)
+}
+
+func TestServerStreaming_CancelUnblocksSend(t *testing.T) {
+	sends := &sendLog{}
+	greeter, addr := startServer(t, &greetworkload.ServerOptions{
+		StreamReplyBytes: 32 * 1024,
+		OnStreamSend:     sends.record,
+	})
+
+	const numReplies = 1000
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{
+		Timeout:      300 * time.Millisecond,
+		StreamCount:  numReplies,
+		RecvInterval: 50 * time.Millisecond,
+	})
+	r := c.ServerStreaming(dialSlowReader(t, c, addr), "pixie")
+	assert.Equal(t, codes.DeadlineExceeded.String(), r.Code)
+
+	// The server handler was blocked in Send and must return once the deadline expires.
+	assert.Eventually(t, func() bool { return greeter.ContextErrors() == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Less(t, len(sends.get()), numReplies)
+}
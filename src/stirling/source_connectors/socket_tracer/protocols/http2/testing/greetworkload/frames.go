@@ -0,0 +1,93 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/net/http2"
+)
+
+// http2FrameHeaderLen is the length of the header of every HTTP/2 frame.
+const http2FrameHeaderLen = 9
+
+// frameScanner follows the HTTP/2 frames written to a connection, across writes that may start or
+// end anywhere in a frame.
+type frameScanner struct {
+	// onHeader, if not nil, is called with the header of every frame, once it is complete.
+	onHeader func(h http2.FrameHeader)
+	// onPayload, if not nil, is called with the payload of every frame, in the pieces it is written in.
+	onPayload func(h http2.FrameHeader, b []byte)
+
+	// header holds the first headerLen bytes of the header of the frame being written.
+	header    [http2FrameHeaderLen]byte
+	headerLen int
+	// current is the header of the frame being written, once complete.
+	current http2.FrameHeader
+	// remaining is the number of payload bytes of the frame being written that are still to come.
+	remaining uint32
+	// started is set once the first frame header is complete.
+	started bool
+}
+
+// atBoundary returns true if the scanner is between frames.
+func (s *frameScanner) atBoundary() bool {
+	return s.headerLen == 0 && s.remaining == 0
+}
+
+// scan follows the frames in b. It returns early, with the number of bytes followed, at the first
+// frame boundary after a frame starts if stop, when not nil, returns true there.
+func (s *frameScanner) scan(b []byte, stop func() bool) int {
+	i := 0
+	for i < len(b) {
+		if s.remaining > 0 {
+			n := len(b) - i
+			if uint32(n) > s.remaining {
+				n = int(s.remaining)
+			}
+			if s.onPayload != nil {
+				s.onPayload(s.current, b[i:i+n])
+			}
+			s.remaining -= uint32(n)
+			i += n
+		} else {
+			n := copy(s.header[s.headerLen:], b[i:])
+			s.headerLen += n
+			i += n
+			if s.headerLen < http2FrameHeaderLen {
+				continue
+			}
+			s.headerLen = 0
+			s.started = true
+			s.current = http2.FrameHeader{
+				Length:   uint32(s.header[0])<<16 | uint32(s.header[1])<<8 | uint32(s.header[2]),
+				Type:     http2.FrameType(s.header[3]),
+				Flags:    http2.Flags(s.header[4]),
+				StreamID: binary.BigEndian.Uint32(s.header[5:]) & (1<<31 - 1),
+			}
+			s.remaining = s.current.Length
+			if s.onHeader != nil {
+				s.onHeader(s.current)
+			}
+		}
+		if stop != nil && s.started && s.atBoundary() && stop() {
+			return i
+		}
+	}
+	return i
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/jsonpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// GatewayPath is the path the gateway serves Greeter.SayHello on.
+const GatewayPath = "/say-hello"
+
+// gatewayMethod is the full method gateway calls are handled as.
+const gatewayMethod = pb.Greeter_SayHello_FullMethodName
+
+// httpStatuses maps gRPC status codes to HTTP statuses, as gRPC gateways usually do.
+var httpStatuses = map[codes.Code]int{
+	codes.OK:                 http.StatusOK,
+	codes.Canceled:           499,
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.Aborted:            http.StatusConflict,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DataLoss:           http.StatusInternalServerError,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+}
+
+// HTTPStatus returns the HTTP status the gateway answers calls failed with code with. 499 is the
+// de facto status of requests cancelled by the client.
+func HTTPStatus(code codes.Code) int {
+	if s, ok := httpStatuses[code]; ok {
+		return s
+	}
+	return http.StatusInternalServerError
+}
+
+// GatewayOptions configure the gateway.
+type GatewayOptions struct {
+	// Timeout, if positive, is the deadline of every call.
+	Timeout time.Duration
+	// Interceptors wrap every call, the first outermost, as grpc.ChainUnaryInterceptor does for
+	// the calls served over gRPC. Passing the same interceptors counts, traces and fails the
+	// gateway's calls alike.
+	Interceptors []grpc.UnaryServerInterceptor
+}
+
+// GatewayError is the JSON body of the responses to failed calls.
+type GatewayError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// NewGateway returns an HTTP/1.1 handler in front of greeter. It serves POST GatewayPath with a
+// JSON HelloRequest body by calling greeter.SayHello, and answers with the JSON HelloReply.
+//
+// Malformed bodies are answered with 400, and failed calls with the HTTPStatus of their code and a
+// GatewayError. The X-Request-Id header of the request is passed to the call as its
+// RequestIDHeader metadata, and the headers and trailers the call sets are sent back as response
+// headers.
+func NewGateway(greeter pb.GreeterServer, opts *GatewayOptions) http.Handler {
+	if opts == nil {
+		opts = &GatewayOptions{}
+	}
+	handler := sayHelloHandler(greeter, opts.Interceptors)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(GatewayPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		req := &pb.HelloRequest{}
+		if err := jsonpb.Unmarshal(r.Body, req); err != nil {
+			writeGatewayError(w, status.Newf(codes.InvalidArgument, "invalid JSON HelloRequest: %v", err))
+			return
+		}
+
+		ctx := r.Context()
+		if opts.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+			defer cancel()
+		}
+		var md metadata.MD
+		if id := r.Header.Get(RequestIDHeader); id != "" {
+			md = metadata.Pairs(RequestIDHeader, id)
+		}
+		ctx = metadata.NewIncomingContext(ctx, md)
+		stream := &gatewayStream{}
+		ctx = grpc.NewContextWithServerTransportStream(ctx, stream)
+
+		reply, err := handler(ctx, req)
+		stream.writeHeaders(w.Header())
+		if err != nil {
+			writeGatewayError(w, status.Convert(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = (&jsonpb.Marshaler{}).Marshal(w, reply.(*pb.HelloReply))
+	})
+	return mux
+}
+
+// sayHelloHandler returns the handler of the calls to greeter.SayHello made outside gRPC, wrapped
+// by interceptors, the first outermost.
+func sayHelloHandler(greeter pb.GreeterServer, interceptors []grpc.UnaryServerInterceptor) grpc.UnaryHandler {
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return greeter.SayHello(ctx, req.(*pb.HelloRequest))
+	}
+	info := &grpc.UnaryServerInfo{Server: greeter, FullMethod: gatewayMethod}
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, req interface{}) (interface{}, error) {
+			return interceptor(ctx, req, info, next)
+		}
+	}
+	return handler
+}
+
+func writeGatewayError(w http.ResponseWriter, s *status.Status) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(HTTPStatus(s.Code()))
+	_ = json.NewEncoder(w).Encode(&GatewayError{Code: s.Code().String(), Message: s.Message()})
+}
+
+// gatewayStream collects the headers and trailers set by the gateway's calls, which have no gRPC
+// stream to send them on.
+type gatewayStream struct {
+	mu sync.Mutex
+	md metadata.MD
+}
+
+func (s *gatewayStream) Method() string {
+	return gatewayMethod
+}
+
+func (s *gatewayStream) SetHeader(md metadata.MD) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.md = metadata.Join(s.md, md)
+	return nil
+}
+
+func (s *gatewayStream) SendHeader(md metadata.MD) error {
+	return s.SetHeader(md)
+}
+
+func (s *gatewayStream) SetTrailer(md metadata.MD) error {
+	return s.SetHeader(md)
+}
+
+func (s *gatewayStream) writeHeaders(h http.Header) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, vs := range s.md {
+		for _, v := range vs {
+			h.Add(k, v)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+func postGateway(t *testing.T, url, body, requestID string) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, url+greetworkload.GatewayPath, strings.NewReader(body))
+	require.NoError(t, err)
+	if requestID != "" {
+		req.Header.Set("X-Request-Id", requestID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func decodeGatewayError(t *testing.T, resp *http.Response) *greetworkload.GatewayError {
+	gwErr := &greetworkload.GatewayError{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(gwErr))
+	return gwErr
+}
+
+func TestGateway_SayHello(t *testing.T) {
+	tracer := greetworkload.NewRequestTracer(&greetworkload.RequestTracerOptions{KeepRecords: true})
+	callStats := greetworkload.NewCallStats()
+	greeter := greetworkload.NewServer(&greetworkload.ServerOptions{InstanceID: "gw"})
+	srv := httptest.NewServer(greetworkload.NewGateway(greeter, &greetworkload.GatewayOptions{
+		Interceptors: []grpc.UnaryServerInterceptor{callStats.UnaryServerInterceptor(), tracer.UnaryServerInterceptor()},
+	}))
+	defer srv.Close()
+
+	resp := postGateway(t, srv.URL, `{"name": "pixie"}`, "req-1")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	reply := &pb.HelloReply{}
+	require.NoError(t, jsonpb.Unmarshal(resp.Body, reply))
+	assert.Equal(t, &pb.HelloReply{Message: "Hello pixie", InstanceId: "gw"}, reply)
+
+	// The request ID reaches the call, and is echoed like the trailer of a gRPC call.
+	assert.Equal(t, "req-1", resp.Header.Get(greetworkload.RequestIDHeader))
+	assert.Equal(t, "1", resp.Header.Get(greetworkload.RequestAttemptTrailer))
+	records := tracer.Records()
+	require.Len(t, records, 1)
+	assert.Equal(t, "req-1", records[0].RequestID)
+	assert.Equal(t, "SayHello", records[0].Method)
+	assert.Equal(t, []*pb.CallCount{{Method: "/px.stirling.protocols.http2.testing.Greeter/SayHello", Code: "OK", Count: 1}}, callStats.Snapshot())
+}
+
+func TestGateway_ValidationFailure(t *testing.T) {
+	greeter := greetworkload.NewServer(&greetworkload.ServerOptions{ValidateRequests: true})
+	srv := httptest.NewServer(greetworkload.NewGateway(greeter, nil))
+	defer srv.Close()
+
+	resp := postGateway(t, srv.URL, `{"name": ""}`, "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	gwErr := decodeGatewayError(t, resp)
+	assert.Equal(t, codes.InvalidArgument.String(), gwErr.Code)
+	assert.Contains(t, gwErr.Message, "name")
+
+	resp = postGateway(t, srv.URL, `{"nom": "pixie"}`, "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, decodeGatewayError(t, resp).Message, "invalid JSON")
+
+	resp, err := http.Get(srv.URL + greetworkload.GatewayPath)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestGateway_HandlerTimeout(t *testing.T) {
+	faults, err := greetworkload.NewFaultInjector(&greetworkload.FaultConfig{LatencyMillis: 5000}, 1)
+	require.NoError(t, err)
+	srv := httptest.NewServer(greetworkload.NewGateway(greetworkload.NewServer(nil), &greetworkload.GatewayOptions{
+		Timeout:      50 * time.Millisecond,
+		Interceptors: []grpc.UnaryServerInterceptor{faults.UnaryServerInterceptor()},
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	resp := postGateway(t, srv.URL, `{"name": "pixie"}`, "")
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	assert.Equal(t, codes.DeadlineExceeded.String(), decodeGatewayError(t, resp).Code)
+}
+
+func TestHTTPStatus(t *testing.T) {
+	assert.Equal(t, http.StatusOK, greetworkload.HTTPStatus(codes.OK))
+	assert.Equal(t, http.StatusBadRequest, greetworkload.HTTPStatus(codes.InvalidArgument))
+	assert.Equal(t, http.StatusGatewayTimeout, greetworkload.HTTPStatus(codes.DeadlineExceeded))
+	assert.Equal(t, http.StatusServiceUnavailable, greetworkload.HTTPStatus(codes.Unavailable))
+	assert.Equal(t, http.StatusInternalServerError, greetworkload.HTTPStatus(codes.Code(100)))
+}
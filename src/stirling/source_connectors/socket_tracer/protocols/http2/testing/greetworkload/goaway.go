@@ -0,0 +1,164 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"bytes"
+	"net"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+// GoAwayListener wraps the listener of an HTTP/2 server so that GOAWAY frames of its own making,
+// with debug data, can be sent on the connections it accepts. gRPC servers only send GOAWAY when
+// they stop or a connection ages out, and never with debug data.
+//
+// The server is not told of the GOAWAY: it is written between the frames the server sends, as a
+// proxy in front of it would. Its last stream ID is the highest the server has sent HEADERS or DATA
+// on, so the client drops the streams it opened since, which the server has not answered yet, and
+// retries them elsewhere, while the server still handles them.
+//
+// The connections must carry HTTP/2 from their first byte: GoAwayListener must sit above TLS, and
+// can't be used with h2c Upgrade.
+type GoAwayListener struct {
+	net.Listener
+
+	mu    sync.Mutex
+	conns map[*goAwayConn]struct{}
+}
+
+// NewGoAwayListener wraps lis.
+func NewGoAwayListener(lis net.Listener) *GoAwayListener {
+	return &GoAwayListener{Listener: lis, conns: make(map[*goAwayConn]struct{})}
+}
+
+// Accept implements net.Listener.
+func (l *GoAwayListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := &goAwayConn{Conn: conn, lis: l}
+	c.frames.onHeader = func(h http2.FrameHeader) {
+		if (h.Type == http2.FrameHeaders || h.Type == http2.FrameData) && h.StreamID > c.maxStreamID {
+			c.maxStreamID = h.StreamID
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conns[c] = struct{}{}
+	return c, nil
+}
+
+// GoAway sends a GOAWAY frame with NO_ERROR and debugData on every open connection that was not sent
+// one yet, and returns the number of connections it was sent on. The frame is written at once if
+// the server is between frames, or else as soon as the frame being written ends.
+func (l *GoAwayListener) GoAway(debugData string) int {
+	l.mu.Lock()
+	conns := make([]*goAwayConn, 0, len(l.conns))
+	for c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.mu.Unlock()
+
+	sent := 0
+	for _, c := range conns {
+		if c.goAway([]byte(debugData)) {
+			sent++
+		}
+	}
+	return sent
+}
+
+func (l *GoAwayListener) remove(c *goAwayConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.conns, c)
+}
+
+// goAwayConn follows the frames written by the server, to find the boundaries between them and the
+// highest stream ID they were sent on.
+type goAwayConn struct {
+	net.Conn
+	lis       *GoAwayListener
+	closeOnce sync.Once
+
+	mu          sync.Mutex
+	frames      frameScanner
+	maxStreamID uint32
+	// pending is a GOAWAY frame to write once the frame being written ends.
+	pending []byte
+	sent    bool
+}
+
+// advance follows the frames in b, and returns the number of bytes up to the first frame boundary
+// if a GOAWAY is pending, or else len(b).
+func (c *goAwayConn) advance(b []byte) int {
+	return c.frames.scan(b, func() bool { return c.pending != nil })
+}
+
+func (c *goAwayConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for written < len(b) {
+		n := c.advance(b[written:])
+		m, err := c.Conn.Write(b[written : written+n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		if err := c.flushPendingLocked(); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// flushPendingLocked writes the pending GOAWAY, if any, once between frames.
+func (c *goAwayConn) flushPendingLocked() error {
+	// The server's first frame must be SETTINGS, so nothing is sent before it.
+	if c.pending == nil || !c.frames.started || !c.frames.atBoundary() {
+		return nil
+	}
+	frame := c.pending
+	c.pending = nil
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// goAway sends a GOAWAY, unless one was sent already, and returns true if it did.
+func (c *goAwayConn) goAway(debugData []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sent {
+		return false
+	}
+	c.sent = true
+	var buf bytes.Buffer
+	// Writing to a bytes.Buffer can't fail.
+	_ = http2.NewFramer(&buf, nil).WriteGoAway(c.maxStreamID, http2.ErrCodeNo, debugData)
+	c.pending = buf.Bytes()
+	return c.flushPendingLocked() == nil
+}
+
+func (c *goAwayConn) Close() error {
+	c.closeOnce.Do(func() { c.lis.remove(c) })
+	return c.Conn.Close()
+}
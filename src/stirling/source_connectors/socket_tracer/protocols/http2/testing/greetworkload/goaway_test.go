@@ -0,0 +1,280 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+type goAwayServer struct {
+	goAways *greetworkload.GoAwayListener
+	faults  *greetworkload.FaultInjector
+	// started counts the calls that reached the server.
+	started int64
+	addr    string
+}
+
+func startGoAwayServer(t *testing.T) *goAwayServer {
+	faults, err := greetworkload.NewFaultInjector(nil, 1)
+	require.NoError(t, err)
+	srv := &goAwayServer{faults: faults}
+	countStarted := func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		atomic.AddInt64(&srv.started, 1)
+		return handler(ctx, req)
+	}
+	srv.addr = startServerWith(t, &serverSetup{
+		Options: &greetworkload.ServerOptions{StreamReplyBytes: 16 * 1024},
+		GRPC:    []grpc.ServerOption{grpc.ChainUnaryInterceptor(countStarted, faults.UnaryServerInterceptor())},
+		Wrap: func(lis net.Listener) net.Listener {
+			srv.goAways = greetworkload.NewGoAwayListener(lis)
+			return srv.goAways
+		},
+	}).Addr
+	return srv
+}
+
+func TestGoAwayListener_DebugData(t *testing.T) {
+	srv := startGoAwayServer(t)
+	conn, err := net.Dial("tcp", srv.addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = conn.Write([]byte(http2.ClientPreface))
+	require.NoError(t, err)
+	fr := http2.NewFramer(conn, conn)
+	require.NoError(t, fr.WriteSettings())
+	f, err := fr.ReadFrame()
+	require.NoError(t, err)
+	require.IsType(t, &http2.SettingsFrame{}, f)
+
+	require.Equal(t, 1, srv.goAways.GoAway("drain for test"))
+	// Connections get a single GOAWAY.
+	assert.Equal(t, 0, srv.goAways.GoAway("again"))
+	for {
+		f, err := fr.ReadFrame()
+		require.NoError(t, err)
+		if goAway, ok := f.(*http2.GoAwayFrame); ok {
+			assert.Equal(t, http2.ErrCodeNo, goAway.ErrCode)
+			assert.Equal(t, uint32(0), goAway.LastStreamID)
+			assert.Equal(t, "drain for test", string(goAway.DebugData()))
+			return
+		}
+	}
+}
+
+// pipeListener accepts a single net.Pipe connection.
+type pipeListener struct {
+	net.Listener
+	conn net.Conn
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	return l.conn, nil
+}
+
+func TestGoAwayListener_WaitsForFrameBoundary(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	goAways := greetworkload.NewGoAwayListener(&pipeListener{conn: server})
+	conn, err := goAways.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// What the server writes: SETTINGS, then HEADERS and DATA on stream 3, split mid-frame.
+	var out bytes.Buffer
+	fr := http2.NewFramer(&out, nil)
+	require.NoError(t, fr.WriteSettings())
+	require.NoError(t, fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 3, BlockFragment: []byte{0x88}, EndHeaders: true}))
+	require.NoError(t, fr.WriteData(3, false, bytes.Repeat([]byte("x"), 100)))
+	frames := out.Bytes()
+	split := len(frames) - 50
+
+	// The framer reuses its frames, so only what the test checks is kept.
+	type frame struct {
+		typ          http2.FrameType
+		streamID     uint32
+		length       uint32
+		lastStreamID uint32
+		debugData    string
+	}
+	received := make(chan []frame)
+	go func() {
+		fr := http2.NewFramer(nil, client)
+		var got []frame
+		for len(got) < 4 {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				break
+			}
+			h := f.Header()
+			fi := frame{typ: h.Type, streamID: h.StreamID, length: h.Length}
+			if g, ok := f.(*http2.GoAwayFrame); ok {
+				fi.lastStreamID = g.LastStreamID
+				fi.debugData = string(g.DebugData())
+			}
+			got = append(got, fi)
+		}
+		received <- got
+	}()
+
+	_, err = conn.Write(frames[:split])
+	require.NoError(t, err)
+	require.Equal(t, 1, goAways.GoAway("mid-frame"))
+	_, err = conn.Write(frames[split:])
+	require.NoError(t, err)
+
+	got := <-received
+	require.Len(t, got, 4)
+	assert.Equal(t, http2.FrameSettings, got[0].typ)
+	assert.Equal(t, http2.FrameHeaders, got[1].typ)
+	assert.Equal(t, frame{typ: http2.FrameData, streamID: 3, length: 100}, got[2])
+	assert.Equal(t, frame{typ: http2.FrameGoAway, length: got[3].length, lastStreamID: 3, debugData: "mid-frame"}, got[3])
+}
+
+func TestGoAwayListener_NotBeforeSettings(t *testing.T) {
+	srv := startGoAwayServer(t)
+	conn, err := net.Dial("tcp", srv.addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	// The server only writes its SETTINGS once it has read the client preface.
+	require.Eventually(t, func() bool { return srv.goAways.GoAway("early") == 1 }, 5*time.Second, 10*time.Millisecond)
+	_, err = conn.Write([]byte(http2.ClientPreface))
+	require.NoError(t, err)
+	fr := http2.NewFramer(conn, conn)
+	require.NoError(t, fr.WriteSettings())
+	f, err := fr.ReadFrame()
+	require.NoError(t, err)
+	require.IsType(t, &http2.SettingsFrame{}, f)
+	f, err = fr.ReadFrame()
+	require.NoError(t, err)
+	require.IsType(t, &http2.GoAwayFrame{}, f)
+	assert.Equal(t, "early", string(f.(*http2.GoAwayFrame).DebugData()))
+}
+
+func TestGoAway_AnsweredStreamCompletes(t *testing.T) {
+	srv := startGoAwayServer(t)
+	for i := 0; i < 3; i++ {
+		conn, err := greetworkload.NewClient(&greetworkload.ClientOptions{}).Dial(srv.addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		const numReplies = 1000
+		stream, err := pb.NewStreamingGreeterClient(conn).SayHelloServerStreaming(ctx, &pb.HelloRequest{Name: "pixie", Count: numReplies})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		require.NoError(t, err)
+
+		// The stream was answered before the GOAWAY, so it goes on.
+		require.Equal(t, 1, srv.goAways.GoAway("busy"))
+		received := 1
+		for ; ; received++ {
+			if _, err := stream.Recv(); err != nil {
+				assert.Equal(t, io.EOF, err)
+				break
+			}
+		}
+		assert.Equal(t, numReplies, received)
+	}
+}
+
+func TestGoAway_StrandedCallsRetriedOnNewConnection(t *testing.T) {
+	srv := startGoAwayServer(t)
+	admin := httptest.NewServer(greetworkload.NewAdminMux(srv.faults, srv.goAways, nil))
+	defer admin.Close()
+
+	clientStats := greetworkload.NewConnStatsHandler()
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, Retries: true})
+	conn, err := c.Dial(srv.addr, grpc.WithStatsHandler(clientStats))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Warm up the first connection, then hold every call in its handler, so that the server has not
+	// answered them when the GOAWAY is sent.
+	require.True(t, c.SayHello(conn, "pixie").Completed())
+	require.NoError(t, srv.faults.SetConfig(&greetworkload.FaultConfig{LatencyMillis: 300}))
+
+	const numInFlight = 5
+	var mu sync.Mutex
+	var records []*greetworkload.CallRecord
+	var wg sync.WaitGroup
+	for i := 0; i < numInFlight; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := c.SayHello(conn, "pixie")
+			mu.Lock()
+			defer mu.Unlock()
+			records = append(records, r)
+		}()
+	}
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&srv.started) == numInFlight+1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	resp, err := http.Post(admin.URL+"/goaway?debug_data=test", "", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var sent map[string]int
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&sent))
+	assert.Equal(t, map[string]int{"connections": 1}, sent)
+
+	// Calls keep being made across the GOAWAY.
+	require.NoError(t, srv.faults.SetConfig(&greetworkload.FaultConfig{}))
+	for i := 0; i < 5; i++ {
+		r := c.SayHello(conn, "pixie")
+		assert.True(t, r.Completed(), r.Error)
+	}
+	wg.Wait()
+	for _, r := range records {
+		assert.True(t, r.Completed(), r.Error)
+	}
+
+	// The stranded calls were handled on both connections.
+	assert.Equal(t, int64(1+2*numInFlight+5), atomic.LoadInt64(&srv.started))
+	require.Eventually(t, func() bool {
+		conns := clientStats.Conns()
+		return len(conns) == 2 && conns[0].CloseTime != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	conns := clientStats.Conns()
+	assert.Equal(t, int64(1), conns[0].RPCsCompleted)
+	assert.Equal(t, int64(numInFlight+5), conns[1].RPCsCompleted)
+}
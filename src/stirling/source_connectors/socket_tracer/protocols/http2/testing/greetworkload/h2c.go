@@ -0,0 +1,250 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/http2/hpack"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// The handshakes recorded in CallRecord.Handshake.
+const (
+	HandshakeTLS               = "tls"
+	HandshakeH2CPriorKnowledge = "h2c_prior_knowledge"
+	HandshakeH2CUpgrade        = "h2c_upgrade"
+)
+
+// NewH2CHandler serves s as HTTP/2 cleartext. Unlike s.Serve, it accepts connections that start
+// with an HTTP/1.1 Upgrade, in addition to those that start with the HTTP/2 preface. The settings,
+// if not nil, must pass settings.Validate(true).
+func NewH2CHandler(s *grpc.Server, settings *HTTP2Settings) http.Handler {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The request that carried the Upgrade is answered as HTTP/2 stream 1, but keeps its
+		// HTTP/1.1 version, which grpc.Server rejects.
+		if r.ProtoMajor == 1 && strings.EqualFold(r.Header.Get("Upgrade"), "h2c") {
+			r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/2.0", 2, 0
+		}
+		s.ServeHTTP(w, r)
+	})
+	if settings == nil {
+		settings = &HTTP2Settings{}
+	}
+	return h2c.NewHandler(h, settings.h2cServer())
+}
+
+// CheckH2CUpgrade returns an ErrBadFlagCombination if the client options cannot be honored by
+// SayHelloH2CUpgrade, which speaks cleartext HTTP/2, sends uncompressed messages and never cancels
+// calls.
+func (c *Client) CheckH2CUpgrade() error {
+	switch {
+	case c.opts.HTTPS:
+		return badFlagsf("h2c upgrade does not support HTTPS")
+	case c.opts.Compression:
+		return badFlagsf("h2c upgrade does not support compression")
+	case c.opts.CancelFraction > 0:
+		return badFlagsf("h2c upgrade does not support cancelling calls")
+	}
+	return nil
+}
+
+// SayHelloH2CUpgrade calls Greeter.SayHello on a new connection to address that is upgraded from
+// HTTP/1.1 to h2c. The call itself is the upgrade request, so it is sent as HTTP/1.1 and answered
+// over HTTP/2. The call fails with FailedPrecondition if CheckH2CUpgrade rejects the client options.
+func (c *Client) SayHelloH2CUpgrade(address, name string) *CallRecord {
+	r := newCallRecord("SayHello")
+	r.Handshake = HandshakeH2CUpgrade
+	if err := c.CheckH2CUpgrade(); err != nil {
+		return c.finish(r, cancelPlan{}, status.Error(codes.FailedPrecondition, err.Error()))
+	}
+	reply, err := c.sayHelloH2CUpgrade(address, name, r.RequestID)
+	if err == nil {
+		log.Printf("Greeting: %s request_id=%s", reply.Message, r.RequestID)
+		r.InstanceID = reply.InstanceId
+	}
+	return c.finish(r, cancelPlan{}, err)
+}
+
+func (c *Client) sayHelloH2CUpgrade(address, name, requestID string) (*pb.HelloReply, error) {
+	ctx, cancel := c.callContext()
+	defer cancel()
+
+	conn, err := c.opts.Socket.Dial(ctx, address)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	msg, err := (&pb.HelloRequest{Name: name}).Marshal()
+	if err != nil {
+		return nil, err
+	}
+	// A gRPC message is prefixed with a compression flag and its length.
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	body = append(body, msg...)
+
+	// Built as a URL rather than a string, so that the zone of IPv6 addresses is escaped.
+	u := &url.URL{Scheme: "http", Host: address, Path: pb.Greeter_SayHello_FullMethodName}
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade, HTTP2-Settings")
+	req.Header.Set("Upgrade", "h2c")
+	// No settings, so that the server assumes the defaults.
+	req.Header.Set("HTTP2-Settings", "")
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set(RequestIDHeader, requestID)
+	if err := req.Write(conn); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, status.Errorf(codes.Unavailable, "h2c upgrade refused: %s", resp.Status)
+	}
+
+	// The server may have sent its first frames along with the 101, so keep reading from br.
+	if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	fr := http2.NewFramer(conn, br)
+	fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	if err := fr.WriteSettings(); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	// The reply arrives on stream 1, which the upgrade request implicitly opened.
+	var payload []byte
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				if err := fr.WriteSettingsAck(); err != nil {
+					return nil, status.Error(codes.Unavailable, err.Error())
+				}
+			}
+		case *http2.DataFrame:
+			if f.StreamID == 1 {
+				payload = append(payload, f.Data()...)
+			}
+		case *http2.MetaHeadersFrame:
+			if f.StreamID == 1 && f.StreamEnded() {
+				return decodeUnaryReply(f, payload)
+			}
+		case *http2.RSTStreamFrame:
+			if f.StreamID == 1 {
+				return nil, status.Errorf(codes.Unavailable, "stream reset: %v", f.ErrCode)
+			}
+		case *http2.GoAwayFrame:
+			return nil, status.Errorf(codes.Unavailable, "connection closed: %v", f.ErrCode)
+		}
+	}
+}
+
+// decodeGRPCMessage undoes the percent-encoding of a grpc-message trailer. Like grpc-go, it keeps
+// malformed escapes as they are rather than failing the call.
+func decodeGRPCMessage(msg string) string {
+	if !strings.Contains(msg, "%") {
+		return msg
+	}
+	var b strings.Builder
+	b.Grow(len(msg))
+	for i := 0; i < len(msg); i++ {
+		if msg[i] == '%' && i+2 < len(msg) {
+			if v, err := strconv.ParseUint(msg[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(msg[i])
+	}
+	return b.String()
+}
+
+// decodeUnaryReply decodes a unary reply from its trailers and the payload of its DATA frames.
+func decodeUnaryReply(trailers *http2.MetaHeadersFrame, payload []byte) (*pb.HelloReply, error) {
+	code, err := strconv.Atoi(trailers.PseudoValue("status"))
+	if err == nil && code != http.StatusOK {
+		return nil, status.Errorf(codes.Unavailable, "unexpected HTTP status %d", code)
+	}
+	var grpcStatus, grpcMessage string
+	for _, hf := range trailers.RegularFields() {
+		switch hf.Name {
+		case "grpc-status":
+			grpcStatus = hf.Value
+		case "grpc-message":
+			grpcMessage = decodeGRPCMessage(hf.Value)
+		}
+	}
+	n, err := strconv.Atoi(grpcStatus)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid grpc-status %q", grpcStatus)
+	}
+	if codes.Code(n) != codes.OK {
+		return nil, status.Error(codes.Code(n), grpcMessage)
+	}
+
+	if len(payload) < 5 {
+		return nil, status.Error(codes.Internal, "reply message is missing")
+	}
+	if payload[0] != 0 {
+		return nil, status.Error(codes.Internal, "compressed reply messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(payload[1:5])
+	if int(size) != len(payload)-5 {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("reply message is %d bytes, expected %d", len(payload)-5, size))
+	}
+	reply := &pb.HelloReply{}
+	if err := pb.UnmarshalUntrusted(payload[5:], reply); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return reply, nil
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+func startH2CServer(t *testing.T, opts *greetworkload.ServerOptions) string {
+	return startServerWith(t, &serverSetup{Options: opts, H2C: &greetworkload.HTTP2Settings{}}).Addr
+}
+
+func TestH2C_PriorKnowledge(t *testing.T) {
+	addr := startH2CServer(t, &greetworkload.ServerOptions{InstanceID: "h2c"})
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	r := c.SayHello(conn, "pixie")
+	require.True(t, r.Completed(), r.Error)
+	assert.Equal(t, greetworkload.HandshakeH2CPriorKnowledge, r.Handshake)
+	assert.Equal(t, "h2c", r.InstanceID)
+}
+
+func TestH2C_Upgrade(t *testing.T) {
+	addr := startH2CServer(t, &greetworkload.ServerOptions{InstanceID: "h2c"})
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+
+	r := c.SayHelloH2CUpgrade(addr, "pixie")
+	require.True(t, r.Completed(), r.Error)
+	assert.Equal(t, greetworkload.HandshakeH2CUpgrade, r.Handshake)
+	assert.Equal(t, "h2c", r.InstanceID)
+}
+
+func TestH2C_UpgradeReportsStatus(t *testing.T) {
+	addr := startH2CServer(t, &greetworkload.ServerOptions{ValidateRequests: true})
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+
+	r := c.SayHelloH2CUpgrade(addr, "")
+	assert.Equal(t, "InvalidArgument", r.Code)
+	assert.Contains(t, r.Error, "invalid name")
+}
+
+func TestH2C_UpgradeDecodesStatusMessage(t *testing.T) {
+	// grpc-message is percent-encoded on the wire.
+	const msg = "100% not found: naïve\ttab"
+	addr := startServerWith(t, &serverSetup{
+		GRPC: []grpc.ServerOption{grpc.UnaryInterceptor(func(context.Context, interface{}, *grpc.UnaryServerInfo, grpc.UnaryHandler) (interface{}, error) {
+			return nil, status.Error(codes.NotFound, msg)
+		})},
+		H2C: &greetworkload.HTTP2Settings{},
+	}).Addr
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	r := c.SayHelloH2CUpgrade(addr, "pixie")
+	assert.Equal(t, "NotFound", r.Code)
+	assert.Equal(t, status.Error(codes.NotFound, msg).Error(), r.Error)
+}
+
+func TestH2C_UpgradeRejectsUnsupportedOptions(t *testing.T) {
+	for _, opts := range []*greetworkload.ClientOptions{
+		{HTTPS: true},
+		{Compression: true},
+		{CancelFraction: 0.5},
+	} {
+		c := greetworkload.NewClient(opts)
+		assert.Error(t, c.CheckH2CUpgrade(), "%+v", opts)
+		r := c.SayHelloH2CUpgrade("localhost:1", "pixie")
+		assert.Equal(t, "FailedPrecondition", r.Code, "%+v", opts)
+	}
+	assert.NoError(t, greetworkload.NewClient(&greetworkload.ClientOptions{}).CheckH2CUpgrade())
+}
+
+func TestH2C_UpgradeRefusedByPlainServer(t *testing.T) {
+	// grpc.Server.Serve only accepts the HTTP/2 preface.
+	_, addr := startServer(t, nil)
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+
+	r := c.SayHelloH2CUpgrade(addr, "pixie")
+	assert.False(t, r.Completed())
+}
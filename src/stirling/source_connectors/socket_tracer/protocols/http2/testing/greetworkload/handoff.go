@@ -0,0 +1,232 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// The environment variables a server started by StartHandoff is passed the handoff with: its ID,
+// and how many listening sockets are passed. The sockets are passed from ListenFDsStart on, as
+// socket activation passes them, and the pipe the successor reports readiness on follows them.
+const (
+	HandoffIDEnv  = "GREET_HANDOFF_ID"
+	handoffFDsEnv = "GREET_HANDOFF_FDS"
+)
+
+// DefaultHandoffReadyTimeout is the HandoffOptions.ReadyTimeout of options that set none.
+const DefaultHandoffReadyTimeout = 10 * time.Second
+
+// ErrHandoff reports a handoff that could not be made, or was passed malformed.
+var ErrHandoff = errors.New("handoff failed")
+
+// handoffReady is what the successor writes to the readiness pipe once it serves.
+const handoffReady = "ready\n"
+
+// HandoffSignal returns the signal on which servers hand their listening sockets off to a new
+// process, SIGHUP, or an UnsupportedPlatformError on platforms without one.
+func HandoffSignal() (os.Signal, error) {
+	if err := CheckPlatform(FeatureHandoff); err != nil {
+		return nil, err
+	}
+	return handoffSignal, nil
+}
+
+// HandoffOptions configure StartHandoff.
+type HandoffOptions struct {
+	// Binary is the executable of the successor. The running one if empty, which picks up a new
+	// binary installed at its path.
+	Binary string
+	// Args are the arguments of the successor, os.Args[1:] if nil.
+	Args []string
+	// Listeners are the TCP listeners handed off, as ListenOptions.Listen or InheritedListeners
+	// returned them. The successor receives them in order.
+	Listeners []net.Listener
+	// ReadyTimeout bounds how long the successor may take to report it serves.
+	// DefaultHandoffReadyTimeout if zero.
+	ReadyTimeout time.Duration
+	// Stdout and Stderr are those of the successor, none if nil. Files are passed as they are, so
+	// that the successor keeps writing to them once the process that started it exits.
+	Stdout, Stderr *os.File
+}
+
+// StartHandoff starts a successor to the running server, passing it opts.Listeners, and waits for
+// it to call Handoff.Ready. It returns the ID of the handoff, which both sides log, and the process
+// of the successor. The successor is killed if it fails to get ready in time, and the running
+// server, which still holds the listeners, can keep serving. Otherwise it should stop serving, with
+// GracefulStop, for the successor to take over. The successor is not waited for.
+func StartHandoff(opts *HandoffOptions) (string, *os.Process, error) {
+	if err := CheckPlatform(FeatureHandoff); err != nil {
+		return "", nil, err
+	}
+	if len(opts.Listeners) == 0 {
+		return "", nil, fmt.Errorf("%w: no listeners to hand off", ErrHandoff)
+	}
+	binary := opts.Binary
+	if binary == "" {
+		var err error
+		if binary, err = os.Executable(); err != nil {
+			return "", nil, fmt.Errorf("%w: %w", ErrHandoff, err)
+		}
+	}
+	args := opts.Args
+	if args == nil {
+		args = os.Args[1:]
+	}
+	timeout := opts.ReadyTimeout
+	if timeout == 0 {
+		timeout = DefaultHandoffReadyTimeout
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, lis := range opts.Listeners {
+		f, err := listenerFile(lis)
+		if err != nil {
+			return "", nil, err
+		}
+		files = append(files, f)
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %w", ErrHandoff, err)
+	}
+	defer ready.Close()
+	files = append(files, readyW)
+
+	id := NewRequestID()
+	cmd := exec.Command(binary, args...)
+	cmd.Env = append(os.Environ(), HandoffIDEnv+"="+id, handoffFDsEnv+"="+strconv.Itoa(len(opts.Listeners)))
+	cmd.ExtraFiles = files
+	if opts.Stdout != nil {
+		cmd.Stdout = opts.Stdout
+	}
+	if opts.Stderr != nil {
+		cmd.Stderr = opts.Stderr
+	}
+	if err := cmd.Start(); err != nil {
+		return "", nil, fmt.Errorf("%w: %w", ErrHandoff, err)
+	}
+	// The successor holds the only other end of the pipe, so that reading it ends if it exits.
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	if err := awaitReady(ready, timeout); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return id, nil, fmt.Errorf("%w: successor %d: %w", ErrHandoff, cmd.Process.Pid, err)
+	}
+	return id, cmd.Process, nil
+}
+
+// awaitReady waits for the successor to write handoffReady to ready.
+func awaitReady(ready *os.File, timeout time.Duration) error {
+	if err := ready.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	b := make([]byte, len(handoffReady))
+	if _, err := io.ReadFull(ready, b); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return errors.New("exited before it was ready")
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("not ready within %s", timeout)
+		}
+		return err
+	}
+	if string(b) != handoffReady {
+		return fmt.Errorf("reported %q rather than being ready", b)
+	}
+	return nil
+}
+
+// listenerFile returns a duplicate of the socket of lis, to pass to the successor.
+func listenerFile(lis net.Listener) (*os.File, error) {
+	if sl, ok := lis.(*socketListener); ok {
+		lis = sl.Listener
+	}
+	tcp, ok := lis.(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("%w: cannot hand off a %s listener, only TCP", ErrHandoff, lis.Addr().Network())
+	}
+	f, err := tcp.File()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrHandoff, err)
+	}
+	return f, nil
+}
+
+// Handoff is a handoff the process was started with by StartHandoff.
+type Handoff struct {
+	// ID is the ID of the handoff, the same on both sides.
+	ID string
+	// Listeners are the listeners handed off, in the order they were passed.
+	Listeners []net.Listener
+	ready     *os.File
+}
+
+// InheritedHandoff returns the handoff the process was started with, or nil if it was not started
+// by StartHandoff. The variables of the handoff are unset, so that the processes the server starts
+// are not handed the sockets again.
+func InheritedHandoff() (*Handoff, error) {
+	id, ok := os.LookupEnv(HandoffIDEnv)
+	if !ok {
+		return nil, nil
+	}
+	fds := os.Getenv(handoffFDsEnv)
+	for _, env := range []string{HandoffIDEnv, handoffFDsEnv} {
+		os.Unsetenv(env)
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("%w: %s must be a positive number of file descriptors, got %q", ErrHandoff, handoffFDsEnv, fds)
+	}
+	h := &Handoff{ID: id, ready: os.NewFile(uintptr(ListenFDsStart+n), "handoff_ready")}
+	for fd := ListenFDsStart; fd < ListenFDsStart+n; fd++ {
+		lis, err := fileListener(fd)
+		if err != nil {
+			for _, l := range h.Listeners {
+				l.Close()
+			}
+			h.ready.Close()
+			return nil, fmt.Errorf("%w: %w", ErrHandoff, err)
+		}
+		h.Listeners = append(h.Listeners, lis)
+	}
+	return h, nil
+}
+
+// Ready tells the process that started this one that it serves the listeners, for it to stop.
+func (h *Handoff) Ready() error {
+	defer h.ready.Close()
+	if _, err := io.WriteString(h.ready, handoffReady); err != nil {
+		return fmt.Errorf("%w: %w", ErrHandoff, err)
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+const handoffHelperEnv = "GREET_HANDOFF_HELPER"
+
+// TestHandoffHelper is not a test: it stands in for a server run with --handoff when the test
+// binary is started with GREET_HANDOFF_HELPER set. It serves Greeter, stamping replies with its
+// PID, on the listener handed off to it, or else on a port of its own whose address it writes to
+// --address_file. On the handoff signal, it hands its listener off to a copy of itself, and stops
+// once the copy serves.
+func TestHandoffHelper(t *testing.T) {
+	if os.Getenv(handoffHelperEnv) == "" {
+		t.Skip("only run by the handoff tests")
+	}
+	args := os.Args
+	for i, arg := range args {
+		if arg == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+	fs := flag.NewFlagSet("handoff", flag.ExitOnError)
+	addressFile := fs.String("address_file", "", "")
+	_ = fs.Parse(args)
+
+	handedOff, err := greetworkload.InheritedHandoff()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(3)
+	}
+	var lis net.Listener
+	if handedOff != nil {
+		lis = handedOff.Listeners[0]
+		fmt.Fprintf(os.Stderr, "serving handed off socket, handoff_id=%s\n", handedOff.ID)
+	} else if lis, err = (&greetworkload.ListenOptions{Host: "127.0.0.1"}).Listen(0); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	s := grpc.NewServer()
+	pb.RegisterGreeterServer(s, greetworkload.NewServer(&greetworkload.ServerOptions{
+		InstanceID: greetworkload.ExpandInstanceID(greetworkload.InstanceIDPID),
+	}))
+	sig, err := greetworkload.HandoffSignal()
+	if err != nil {
+		os.Exit(2)
+	}
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, sig)
+		for range ch {
+			id, successor, err := greetworkload.StartHandoff(&greetworkload.HandoffOptions{
+				Listeners: []net.Listener{lis},
+				Stderr:    os.Stderr,
+			})
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "handed off to PID %d, handoff_id=%s\n", successor.Pid, id)
+			s.GracefulStop()
+			return
+		}
+	}()
+	if handedOff != nil {
+		if err := handedOff.Ready(); err != nil {
+			os.Exit(2)
+		}
+	} else {
+		addrs := map[string]string{greetworkload.GreeterService: greetworkload.CanonicalAddr(lis.Addr())}
+		if err := greetworkload.WriteAddressFile(*addressFile, addrs); err != nil {
+			os.Exit(2)
+		}
+	}
+	_ = s.Serve(lis)
+	os.Exit(0)
+}
+
+func TestHandoff_ServesThroughout(t *testing.T) {
+	sig, err := greetworkload.HandoffSignal()
+	if err != nil {
+		t.Skip(err)
+	}
+	addressFile := filepath.Join(t.TempDir(), "addresses.json")
+	stderr, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	require.NoError(t, err)
+	defer stderr.Close()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHandoffHelper$", "--", "--address_file", addressFile)
+	cmd.Env = append(os.Environ(), handoffHelperEnv+"=1")
+	cmd.Stderr = stderr
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	addr := readAddressFile(t, addressFile)[greetworkload.GreeterService]
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 10 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Callers keep calls in flight before, across and after the handoff, until the successor has
+	// answered enough of them.
+	predecessor := strconv.Itoa(cmd.Process.Pid)
+	var (
+		mu         sync.Mutex
+		records    []*greetworkload.CallRecord
+		calls      atomic.Int64
+		successors atomic.Int64
+		wg         sync.WaitGroup
+	)
+	deadline := time.Now().Add(30 * time.Second)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for successors.Load() < 200 && time.Now().Before(deadline) {
+				r := c.SayHello(conn, "handoff")
+				mu.Lock()
+				records = append(records, r)
+				mu.Unlock()
+				calls.Add(1)
+				if r.InstanceID != "" && r.InstanceID != predecessor {
+					successors.Add(1)
+				}
+			}
+		}()
+	}
+	require.Eventually(t, func() bool { return calls.Load() >= 100 }, 10*time.Second, time.Millisecond)
+	require.NoError(t, cmd.Process.Signal(sig))
+	wg.Wait()
+
+	instances := make(map[string]int)
+	for _, r := range records {
+		assert.Equal(t, codes.OK.String(), r.Code, r.Error)
+		instances[r.InstanceID]++
+	}
+	require.Len(t, instances, 2, "instances: %v", instances)
+	assert.NotZero(t, instances[predecessor])
+	for id := range instances {
+		if id == predecessor {
+			continue
+		}
+		pid, err := strconv.Atoi(id)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			if p, err := os.FindProcess(pid); err == nil {
+				_ = p.Kill()
+			}
+		})
+	}
+
+	// The predecessor stops once it drained.
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the predecessor did not exit after handing off")
+	}
+
+	// Both sides log the same handoff ID.
+	b, err := os.ReadFile(stderr.Name())
+	require.NoError(t, err)
+	ids := regexp.MustCompile(`handoff_id=(\S+)`).FindAllStringSubmatch(string(b), -1)
+	require.Len(t, ids, 2, string(b))
+	assert.Equal(t, ids[0][1], ids[1][1])
+}
+
+func TestStartHandoff_SuccessorFails(t *testing.T) {
+	if err := greetworkload.CheckPlatform(greetworkload.FeatureHandoff); err != nil {
+		t.Skip(err)
+	}
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found")
+	}
+	tests := []struct {
+		name    string
+		script  string
+		wantErr string
+	}{
+		{name: "exits", script: "exit 1", wantErr: "exited before it was ready"},
+		{name: "never ready", script: "sleep 10", wantErr: "not ready within 500ms"},
+		{name: "reports otherwise", script: `echo unwell >&4; sleep 10`, wantErr: `reported "unwell"`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer lis.Close()
+
+			start := time.Now()
+			id, successor, err := greetworkload.StartHandoff(&greetworkload.HandoffOptions{
+				Binary:       sh,
+				Args:         []string{"-c", tc.script},
+				Listeners:    []net.Listener{lis},
+				ReadyTimeout: 500 * time.Millisecond,
+			})
+			assert.ErrorIs(t, err, greetworkload.ErrHandoff)
+			assert.ErrorContains(t, err, tc.wantErr)
+			assert.NotEmpty(t, id)
+			assert.Nil(t, successor)
+			assert.Less(t, time.Since(start), 5*time.Second)
+
+			// The listener is still the predecessor's to serve.
+			conn, err := net.Dial("tcp", lis.Addr().String())
+			require.NoError(t, err)
+			conn.Close()
+		})
+	}
+}
+
+func TestStartHandoff_NotTCP(t *testing.T) {
+	if err := greetworkload.CheckPlatform(greetworkload.FeatureHandoff); err != nil {
+		t.Skip(err)
+	}
+	lis, err := net.Listen("unix", filepath.Join(t.TempDir(), "greet.sock"))
+	require.NoError(t, err)
+	defer lis.Close()
+	_, _, err = greetworkload.StartHandoff(&greetworkload.HandoffOptions{Listeners: []net.Listener{lis}})
+	assert.ErrorIs(t, err, greetworkload.ErrHandoff)
+	assert.ErrorContains(t, err, "cannot hand off a unix listener")
+
+	_, _, err = greetworkload.StartHandoff(&greetworkload.HandoffOptions{})
+	assert.ErrorContains(t, err, "no listeners to hand off")
+}
+
+func TestInheritedHandoff(t *testing.T) {
+	t.Run("not handed off", func(t *testing.T) {
+		t.Setenv(greetworkload.HandoffIDEnv, "")
+		os.Unsetenv(greetworkload.HandoffIDEnv)
+		h, err := greetworkload.InheritedHandoff()
+		require.NoError(t, err)
+		assert.Nil(t, h)
+	})
+	t.Run("no sockets", func(t *testing.T) {
+		t.Setenv(greetworkload.HandoffIDEnv, "id")
+		h, err := greetworkload.InheritedHandoff()
+		assert.ErrorIs(t, err, greetworkload.ErrHandoff)
+		assert.ErrorContains(t, err, "must be a positive number of file descriptors")
+		assert.Nil(t, h)
+		_, ok := os.LookupEnv(greetworkload.HandoffIDEnv)
+		assert.False(t, ok, "the handoff ID is passed on")
+	})
+}
@@ -0,0 +1,307 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// HeartbeatName is the name of the server-streaming requests that a server with a
+// ServerOptions.HeartbeatInterval answers with a heartbeat stream.
+const HeartbeatName = "heartbeat"
+
+// ErrHeartbeatStreamEnded reports a heartbeat stream that the server ended, as servers without a
+// ServerOptions.HeartbeatInterval do once they sent the replies asked for.
+var ErrHeartbeatStreamEnded = errors.New("heartbeat stream ended by the server")
+
+// heartbeat sends the same small reply every HeartbeatInterval, until the client goes away. Nothing
+// is kept per reply, so that streams can go on for hours.
+func (s *Server) heartbeat(srv pb.StreamingGreeter_SayHelloServerStreamingServer) error {
+	ctx := srv.Context()
+	reply := s.reply("Hello " + HeartbeatName)
+	ticker := time.NewTicker(s.opts.HeartbeatInterval)
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-ticker.C:
+		}
+		if err := srv.Send(reply); err != nil {
+			return err
+		}
+		if s.opts.OnStreamSend != nil {
+			s.opts.OnStreamSend(i, time.Now())
+		}
+	}
+}
+
+// defaultCheckpointInterval is the HeartbeatOptions.CheckpointInterval of options without one.
+const defaultCheckpointInterval = 10 * time.Second
+
+// HeartbeatOptions configure a heartbeat run.
+type HeartbeatOptions struct {
+	// Streams is the number of heartbeat streams held open at once.
+	Streams int
+	// Duration is how long the streams are held open for. Zero holds them until the context of the
+	// run is done.
+	Duration time.Duration
+	// CheckpointFile, if set, is written with the HeartbeatCheckpoint of the run every
+	// CheckpointInterval, and once the run is over. It is replaced at once, so that an observer
+	// never reads it half written.
+	CheckpointFile string
+	// CheckpointInterval is how often the run is checkpointed. 10s if zero.
+	CheckpointInterval time.Duration
+	// OnCheckpoint, if set, is called with every checkpoint, as it is taken.
+	OnCheckpoint func(*HeartbeatCheckpoint)
+}
+
+// Validate checks that the options are usable.
+func (o *HeartbeatOptions) Validate() error {
+	if o.Streams < 1 {
+		return fmt.Errorf("heartbeat streams must be positive, got %d", o.Streams)
+	}
+	if o.Duration < 0 || o.CheckpointInterval < 0 {
+		return fmt.Errorf("heartbeat duration and checkpoint interval must not be negative, got %v and %v", o.Duration, o.CheckpointInterval)
+	}
+	return nil
+}
+
+// HeartbeatStream is the progress of a heartbeat stream.
+type HeartbeatStream struct {
+	// Heartbeats is the number of replies received.
+	Heartbeats int64 `json:"heartbeats"`
+	// LastHeartbeat is when the last reply was received, if any.
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+	// Open is true until the stream ends.
+	Open bool `json:"open"`
+	// Error is why the stream failed, if it did. Streams ended at the end of the run did not.
+	Error string `json:"error,omitempty"`
+}
+
+// HeartbeatCheckpoint is the progress of a heartbeat run, as of Time.
+type HeartbeatCheckpoint struct {
+	Start   time.Time         `json:"start"`
+	Time    time.Time         `json:"time"`
+	Streams []HeartbeatStream `json:"streams"`
+}
+
+// Heartbeats returns the number of replies received over every stream.
+func (c *HeartbeatCheckpoint) Heartbeats() int64 {
+	var n int64
+	for _, s := range c.Streams {
+		n += s.Heartbeats
+	}
+	return n
+}
+
+// WriteHeartbeatCheckpoint writes c to path, through a temporary file renamed over it.
+func WriteHeartbeatCheckpoint(path string, c *HeartbeatCheckpoint) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(c); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// ReadHeartbeatCheckpoint reads a checkpoint written by WriteHeartbeatCheckpoint.
+func ReadHeartbeatCheckpoint(path string) (*HeartbeatCheckpoint, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &HeartbeatCheckpoint{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// heartbeatStream is the progress of a stream, updated as its replies are received.
+type heartbeatStream struct {
+	heartbeats int64
+	// last is the Unix time in nanoseconds of the last reply, or 0.
+	last int64
+
+	mu     sync.Mutex
+	closed bool
+	err    error
+}
+
+func (s *heartbeatStream) close(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed, s.err = true, err
+}
+
+func (s *heartbeatStream) progress() HeartbeatStream {
+	p := HeartbeatStream{Heartbeats: atomic.LoadInt64(&s.heartbeats)}
+	if last := atomic.LoadInt64(&s.last); last != 0 {
+		t := time.Unix(0, last)
+		p.LastHeartbeat = &t
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p.Open = !s.closed
+	if s.err != nil {
+		p.Error = s.err.Error()
+	}
+	return p
+}
+
+// Heartbeats holds opts.Streams heartbeat streams open over conn for opts.Duration, or until ctx
+// is done, checkpointing their progress every opts.CheckpointInterval. The server must be run
+// with a ServerOptions.HeartbeatInterval. The streams are not subject to ClientOptions.Timeout.
+//
+// It returns the last checkpoint, and an error if any stream failed before the end of the run, in
+// which case the others are held open regardless.
+func (c *Client) Heartbeats(ctx context.Context, conn *grpc.ClientConn, opts *HeartbeatOptions) (*HeartbeatCheckpoint, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Duration)
+		defer cancel()
+	}
+	interval := opts.CheckpointInterval
+	if interval == 0 {
+		interval = defaultCheckpointInterval
+	}
+
+	start := time.Now()
+	streams := make([]*heartbeatStream, opts.Streams)
+	var wg sync.WaitGroup
+	for i := range streams {
+		streams[i] = &heartbeatStream{}
+		wg.Add(1)
+		go func(s *heartbeatStream) {
+			defer wg.Done()
+			s.close(holdHeartbeats(ctx, conn, s))
+		}(streams[i])
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var writeErr error
+	take := func() *HeartbeatCheckpoint {
+		cp := &HeartbeatCheckpoint{Start: start, Time: time.Now(), Streams: make([]HeartbeatStream, len(streams))}
+		for i, s := range streams {
+			cp.Streams[i] = s.progress()
+		}
+		return cp
+	}
+	record := func(cp *HeartbeatCheckpoint) {
+		if opts.CheckpointFile != "" {
+			if err := WriteHeartbeatCheckpoint(opts.CheckpointFile, cp); err != nil && writeErr == nil {
+				writeErr = err
+				log.Printf("Failed to write the heartbeat checkpoint: %v", err)
+			}
+		}
+		if opts.OnCheckpoint != nil {
+			opts.OnCheckpoint(cp)
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			cp := take()
+			// Streams close once ctx is done, so a checkpoint taken before it was is of open streams.
+			// Later ones may catch some closed and others not: the final checkpoint records the end.
+			if ctx.Err() == nil {
+				record(cp)
+			}
+		case <-done:
+			break loop
+		}
+	}
+
+	cp := take()
+	record(cp)
+	failed := 0
+	var first string
+	for _, s := range cp.Streams {
+		if s.Error != "" {
+			if failed == 0 {
+				first = s.Error
+			}
+			failed++
+		}
+	}
+	if failed > 0 {
+		return cp, fmt.Errorf("%d of %d heartbeat streams failed, the first with: %s", failed, len(cp.Streams), first)
+	}
+	return cp, writeErr
+}
+
+// holdHeartbeats receives the replies of a heartbeat stream into s until ctx is done, and returns
+// why the stream failed before, if it did.
+func holdHeartbeats(ctx context.Context, conn *grpc.ClientConn, s *heartbeatStream) error {
+	stream, err := pb.NewStreamingGreeterClient(conn).SayHelloServerStreaming(ctx, &pb.HelloRequest{Name: HeartbeatName})
+	if err != nil {
+		return err
+	}
+	// A single reply is received into, so that nothing is allocated per reply beyond what gRPC does.
+	reply := &pb.HelloReply{}
+	for {
+		err := stream.RecvMsg(reply)
+		if err == nil {
+			atomic.AddInt64(&s.heartbeats, 1)
+			atomic.StoreInt64(&s.last, time.Now().UnixNano())
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == io.EOF {
+			return fmt.Errorf("%w after %d replies", ErrHeartbeatStreamEnded, atomic.LoadInt64(&s.heartbeats))
+		}
+		return err
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"context"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// dialHeartbeats serves StreamingGreeter with opts, and returns a client and a connection to it.
+func dialHeartbeats(t *testing.T, opts *greetworkload.ServerOptions) (*greetworkload.Client, *grpc.ClientConn) {
+	require.NoError(t, opts.Validate())
+	_, addr := startServer(t, opts)
+
+	// The timeout of calls does not apply to heartbeat streams.
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 50 * time.Millisecond})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return c, conn
+}
+
+func TestHeartbeatOptions_Validate(t *testing.T) {
+	assert.NoError(t, (&greetworkload.HeartbeatOptions{Streams: 1}).Validate())
+	for _, opts := range []*greetworkload.HeartbeatOptions{
+		{},
+		{Streams: 1, Duration: -time.Second},
+		{Streams: 1, CheckpointInterval: -time.Second},
+	} {
+		assert.Error(t, opts.Validate(), "%+v", opts)
+	}
+	assert.Error(t, (&greetworkload.ServerOptions{HeartbeatInterval: -time.Second}).Validate())
+}
+
+func TestHeartbeats_Checkpoints(t *testing.T) {
+	c, conn := dialHeartbeats(t, &greetworkload.ServerOptions{HeartbeatInterval: 5 * time.Millisecond, Checksums: true})
+	file := filepath.Join(t.TempDir(), "heartbeats.json")
+	var checkpoints []*greetworkload.HeartbeatCheckpoint
+	final, err := c.Heartbeats(context.Background(), conn, &greetworkload.HeartbeatOptions{
+		Streams:            3,
+		Duration:           330 * time.Millisecond,
+		CheckpointFile:     file,
+		CheckpointInterval: 50 * time.Millisecond,
+		OnCheckpoint: func(cp *greetworkload.HeartbeatCheckpoint) {
+			// Every checkpoint but the last is taken with the streams open, and is written first.
+			if len(checkpoints) == 0 {
+				written, err := greetworkload.ReadHeartbeatCheckpoint(file)
+				if assert.NoError(t, err) {
+					assert.Equal(t, cp.Heartbeats(), written.Heartbeats())
+				}
+			}
+			checkpoints = append(checkpoints, cp)
+		},
+	})
+	require.NoError(t, err)
+
+	require.Greater(t, len(checkpoints), 2)
+	assert.Same(t, final, checkpoints[len(checkpoints)-1])
+	for i, cp := range checkpoints[:len(checkpoints)-1] {
+		require.Len(t, cp.Streams, 3)
+		for _, s := range cp.Streams {
+			assert.True(t, s.Open)
+		}
+		if i > 0 {
+			assert.GreaterOrEqual(t, cp.Heartbeats(), checkpoints[i-1].Heartbeats())
+		}
+	}
+	// A reply every 5ms for 330ms, give or take.
+	for _, s := range final.Streams {
+		assert.False(t, s.Open)
+		assert.Empty(t, s.Error)
+		assert.Greater(t, s.Heartbeats, int64(10))
+		require.NotNil(t, s.LastHeartbeat)
+		assert.False(t, s.LastHeartbeat.After(final.Time))
+	}
+
+	written, err := greetworkload.ReadHeartbeatCheckpoint(file)
+	require.NoError(t, err)
+	assert.Equal(t, final.Heartbeats(), written.Heartbeats())
+	assert.True(t, final.Time.Equal(written.Time))
+	matches, err := filepath.Glob(file + ".*")
+	require.NoError(t, err)
+	assert.Empty(t, matches, "temporary checkpoint files are cleaned up")
+}
+
+func TestHeartbeats_ServerWithoutInterval(t *testing.T) {
+	c, conn := dialHeartbeats(t, &greetworkload.ServerOptions{})
+	start := time.Now()
+	cp, err := c.Heartbeats(context.Background(), conn, &greetworkload.HeartbeatOptions{Streams: 2, Duration: time.Minute})
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), 10*time.Second, "the run ends once every stream does")
+	assert.Contains(t, err.Error(), "2 of 2 heartbeat streams failed")
+	require.Len(t, cp.Streams, 2)
+	for _, s := range cp.Streams {
+		assert.False(t, s.Open)
+		// The server sent the replies asked for by default, and ended the stream.
+		assert.Equal(t, int64(3), s.Heartbeats)
+		assert.Contains(t, s.Error, greetworkload.ErrHeartbeatStreamEnded.Error())
+	}
+}
+
+// Heartbeat streams hold nothing per reply, on either side: the heap does not grow with the
+// replies sent and received.
+func TestHeartbeats_FlatMemory(t *testing.T) {
+	const (
+		warmup     = 10000
+		heartbeats = 100000
+		// About 10 bytes a heartbeat, less than keeping anything of every one would take.
+		maxGrowth = 1 << 20
+	)
+	// Heartbeats as often as the client keeps up with, so that replies do not queue up.
+	c, conn := dialHeartbeats(t, &greetworkload.ServerOptions{HeartbeatInterval: 50 * time.Microsecond})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	heapInUse := func() uint64 {
+		// Twice, so that what pools hold on to is collected too.
+		runtime.GC()
+		runtime.GC()
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return m.HeapAlloc
+	}
+	var base, baseCount, end, endCount int64
+	_, err := c.Heartbeats(ctx, conn, &greetworkload.HeartbeatOptions{
+		Streams:            8,
+		CheckpointInterval: 10 * time.Millisecond,
+		OnCheckpoint: func(cp *greetworkload.HeartbeatCheckpoint) {
+			switch n := cp.Heartbeats(); {
+			case base == 0 && n >= warmup:
+				base, baseCount = int64(heapInUse()), n
+			case base != 0 && end == 0 && n >= baseCount+heartbeats:
+				end, endCount = int64(heapInUse()), n
+				cancel()
+			}
+		},
+	})
+	require.NoError(t, err)
+	require.NotZero(t, end, "the run timed out before %d heartbeats", heartbeats)
+	t.Logf("Heap went from %d to %d bytes over %d heartbeats", base, end, endCount-baseCount)
+	assert.Less(t, end-base, int64(maxGrowth))
+}
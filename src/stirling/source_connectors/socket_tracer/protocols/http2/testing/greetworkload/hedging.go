@@ -0,0 +1,136 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// HedgeAttemptHeader carries the number, from 1, of the attempt of a hedged call. Both attempts
+// carry the RequestIDHeader of the call, and the second also carries grpc-previous-rpc-attempts,
+// as gRPC sends it with the attempts it retries or hedges, so that servers record it as attempt 2.
+const HedgeAttemptHeader = "x-hedge-attempt"
+
+// HedgeStats counts the hedged calls of a Client.
+type HedgeStats struct {
+	// Calls is the number of logical calls made, and Attempts the number of calls they made on the
+	// wire.
+	Calls    int64 `json:"calls"`
+	Attempts int64 `json:"attempts"`
+	// Hedges is the number of calls a second attempt was made for, and HedgeWins the number of
+	// those the second attempt answered.
+	Hedges    int64 `json:"hedges"`
+	HedgeWins int64 `json:"hedge_wins"`
+	// Cancelled is the number of attempts cancelled as the other attempt of their call succeeded
+	// first.
+	Cancelled int64 `json:"cancelled"`
+}
+
+// HedgeStats returns the counts of the calls hedged with ClientOptions.HedgeDelay.
+func (c *Client) HedgeStats() HedgeStats {
+	return HedgeStats{
+		Calls:     atomic.LoadInt64(&c.hedges.Calls),
+		Attempts:  atomic.LoadInt64(&c.hedges.Attempts),
+		Hedges:    atomic.LoadInt64(&c.hedges.Hedges),
+		HedgeWins: atomic.LoadInt64(&c.hedges.HedgeWins),
+		Cancelled: atomic.LoadInt64(&c.hedges.Cancelled),
+	}
+}
+
+// hedgeAttempt is the outcome of an attempt of a hedged call.
+type hedgeAttempt struct {
+	attempt int
+	reply   *pb.HelloReply
+	trailer metadata.MD
+	err     error
+}
+
+// hedge makes the unary call through call, and a second attempt of it if the first has not
+// returned within ClientOptions.HedgeDelay. The first attempt to succeed wins, and the other is
+// cancelled, and waited for. If the first attempt fails before the second is made, the call fails
+// with its error, and if both fail, with the error of the last. It records in r the number of
+// attempts made, and the one that won, if any.
+func (c *Client) hedge(ctx context.Context, r *CallRecord, in *pb.HelloRequest,
+	call func(ctx context.Context, in *pb.HelloRequest, opts ...grpc.CallOption) (*pb.HelloReply, error)) (*pb.HelloReply, metadata.MD, error) {
+	results := make(chan hedgeAttempt, 2)
+	var cancels []context.CancelFunc
+	start := func(attempt int) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancels = append(cancels, cancel)
+		kv := []string{HedgeAttemptHeader, strconv.Itoa(attempt)}
+		opts := []grpc.CallOption{}
+		if attempt == 1 {
+			// Only the first attempt records the call, so that attempts do not race on r.
+			opts = append(opts, withRecord(r))
+		} else {
+			kv = append(kv, previousAttemptsHeader, strconv.Itoa(attempt-1))
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, kv...)
+		atomic.AddInt64(&c.hedges.Attempts, 1)
+		go func() {
+			var trailer metadata.MD
+			reply, err := call(ctx, in, append(opts, grpc.Trailer(&trailer))...)
+			results <- hedgeAttempt{attempt: attempt, reply: reply, trailer: trailer, err: err}
+		}()
+	}
+	atomic.AddInt64(&c.hedges.Calls, 1)
+	start(1)
+	timer := time.NewTimer(c.opts.HedgeDelay)
+	defer timer.Stop()
+
+	pending := 1
+	var res hedgeAttempt
+	for {
+		select {
+		case <-timer.C:
+			atomic.AddInt64(&c.hedges.Hedges, 1)
+			start(2)
+			pending++
+			continue
+		case res = <-results:
+			pending--
+		}
+		if res.err == nil || pending == 0 {
+			break
+		}
+	}
+	r.Attempts = len(cancels)
+	if res.err == nil {
+		r.Attempt = res.attempt
+		if res.attempt == 2 {
+			atomic.AddInt64(&c.hedges.HedgeWins, 1)
+		}
+	}
+	for _, cancel := range cancels {
+		cancel()
+	}
+	for ; pending > 0; pending-- {
+		if loser := <-results; res.err == nil && loser.err != nil && isClientCancel(loser.err) {
+			atomic.AddInt64(&c.hedges.Cancelled, 1)
+		}
+	}
+	return res.reply, res.trailer, res.err
+}
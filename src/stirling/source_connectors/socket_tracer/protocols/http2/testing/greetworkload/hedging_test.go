@@ -0,0 +1,175 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// startHedgedServer serves Greeter, recording every attempt it handles, and injecting cfg into
+// them. If slowFirst is positive, first attempts of hedged calls are held that much longer.
+func startHedgedServer(t *testing.T, cfg *greetworkload.FaultConfig, slowFirst time.Duration) (*greetworkload.RequestTracer, string) {
+	tracer := greetworkload.NewRequestTracer(&greetworkload.RequestTracerOptions{KeepRecords: true})
+	faults, err := greetworkload.NewFaultInjector(cfg, 1)
+	require.NoError(t, err)
+	slow := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if v := md.Get(greetworkload.HedgeAttemptHeader); slowFirst > 0 && len(v) == 1 && v[0] == "1" {
+			select {
+			case <-time.After(slowFirst):
+			case <-ctx.Done():
+				return nil, status.FromContextError(ctx.Err()).Err()
+			}
+		}
+		return handler(ctx, req)
+	}
+	s := startServerWith(t, &serverSetup{GRPC: []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(tracer.UnaryServerInterceptor(), slow, faults.UnaryServerInterceptor()),
+	}})
+	return tracer, s.Addr
+}
+
+// hedgedCalls makes n SayHello calls hedged after delay, and returns their records.
+func hedgedCalls(t *testing.T, addr string, delay time.Duration, n int) (*greetworkload.Client, []*greetworkload.CallRecord) {
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 10 * time.Second, HedgeDelay: delay})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	var records []*greetworkload.CallRecord
+	for i := 0; i < n; i++ {
+		records = append(records, c.SayHello(conn, "hedge"))
+	}
+	return c, records
+}
+
+// serverAttempts waits for the server to record want attempts, and returns the codes they
+// finished with, by request ID and attempt.
+func serverAttempts(t *testing.T, tracer *greetworkload.RequestTracer, want int) map[string]map[int]string {
+	require.Eventually(t, func() bool { return len(tracer.Records()) == want }, 5*time.Second, 10*time.Millisecond)
+	attempts := make(map[string]map[int]string)
+	for _, r := range tracer.Records() {
+		if attempts[r.RequestID] == nil {
+			attempts[r.RequestID] = make(map[int]string)
+		}
+		attempts[r.RequestID][r.Attempt] = r.Code
+	}
+	return attempts
+}
+
+func TestHedging_LatencyBelowDelay(t *testing.T) {
+	tracer, addr := startHedgedServer(t, &greetworkload.FaultConfig{LatencyMillis: 10}, 0)
+	const calls = 10
+	c, records := hedgedCalls(t, addr, 500*time.Millisecond, calls)
+
+	for _, r := range records {
+		assert.Equal(t, codes.OK.String(), r.Code, r.Error)
+		assert.Equal(t, 1, r.Attempts)
+		assert.Equal(t, 1, r.Attempt)
+	}
+	assert.Equal(t, greetworkload.HedgeStats{Calls: calls, Attempts: calls}, c.HedgeStats())
+	attempts := serverAttempts(t, tracer, calls)
+	for _, r := range records {
+		assert.Equal(t, map[int]string{1: codes.OK.String()}, attempts[r.RequestID])
+	}
+}
+
+func TestHedging_LatencyAboveDelay(t *testing.T) {
+	tracer, addr := startHedgedServer(t, &greetworkload.FaultConfig{LatencyMillis: 300}, 0)
+	const calls = 5
+	c, records := hedgedCalls(t, addr, 50*time.Millisecond, calls)
+
+	// The first attempt, started first and delayed as long, wins every call, and the hedge is
+	// cancelled while the server still holds it.
+	for _, r := range records {
+		assert.Equal(t, codes.OK.String(), r.Code, r.Error)
+		assert.Equal(t, 2, r.Attempts)
+		assert.Equal(t, 1, r.Attempt)
+	}
+	assert.Equal(t, greetworkload.HedgeStats{Calls: calls, Attempts: 2 * calls, Hedges: calls, Cancelled: calls}, c.HedgeStats())
+	attempts := serverAttempts(t, tracer, 2*calls)
+	for _, r := range records {
+		assert.Equal(t, map[int]string{1: codes.OK.String(), 2: codes.Canceled.String()}, attempts[r.RequestID])
+	}
+}
+
+func TestHedging_HedgeWins(t *testing.T) {
+	tracer, addr := startHedgedServer(t, &greetworkload.FaultConfig{}, 5*time.Second)
+	const calls = 5
+	c, records := hedgedCalls(t, addr, 20*time.Millisecond, calls)
+
+	for _, r := range records {
+		assert.Equal(t, codes.OK.String(), r.Code, r.Error)
+		assert.Equal(t, 2, r.Attempts)
+		assert.Equal(t, 2, r.Attempt)
+		assert.Less(t, r.DurationNS, time.Second.Nanoseconds())
+	}
+	assert.Equal(t, greetworkload.HedgeStats{Calls: calls, Attempts: 2 * calls, Hedges: calls, HedgeWins: calls, Cancelled: calls}, c.HedgeStats())
+	attempts := serverAttempts(t, tracer, 2*calls)
+	for _, r := range records {
+		assert.Equal(t, map[int]string{1: codes.Canceled.String(), 2: codes.OK.String()}, attempts[r.RequestID])
+	}
+}
+
+func TestHedging_Failures(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		latency  int64
+		attempts int
+	}{
+		// A failure is an answer: a call failed before the delay is not hedged.
+		{name: "before the delay", latency: 0, attempts: 1},
+		// A call whose first attempt fails once it is hedged waits for the hedge.
+		{name: "after the delay", latency: 100, attempts: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &greetworkload.FaultConfig{LatencyMillis: tc.latency, ErrorRate: 1, Code: codes.Unavailable}
+			tracer, addr := startHedgedServer(t, cfg, 0)
+			c, records := hedgedCalls(t, addr, 50*time.Millisecond, 1)
+
+			r := records[0]
+			assert.Equal(t, codes.Unavailable.String(), r.Code)
+			assert.Equal(t, tc.attempts, r.Attempts)
+			stats := c.HedgeStats()
+			assert.Equal(t, int64(tc.attempts), stats.Attempts)
+			assert.Zero(t, stats.Cancelled)
+			attempts := serverAttempts(t, tracer, tc.attempts)
+			for i := 1; i <= tc.attempts; i++ {
+				assert.Equal(t, codes.Unavailable.String(), attempts[r.RequestID][i], "attempt "+strconv.Itoa(i))
+			}
+		})
+	}
+}
+
+func TestHedging_NotWithRetries(t *testing.T) {
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{HedgeDelay: time.Millisecond, Retries: true})
+	_, err := c.Dial("127.0.0.1:1")
+	assert.ErrorIs(t, err, greetworkload.ErrBadFlagCombination)
+}
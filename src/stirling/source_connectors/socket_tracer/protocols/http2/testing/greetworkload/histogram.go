@@ -0,0 +1,389 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultPercentiles are the percentiles reported by WritePercentiles.
+var DefaultPercentiles = []float64{50, 90, 99, 99.9, 99.99, 100}
+
+// HistogramOptions configure the range and precision of a Histogram.
+type HistogramOptions struct {
+	// MaxValue is the largest value tracked. Larger values are recorded as MaxValue, and counted
+	// as overflows.
+	MaxValue int64 `json:"max_value"`
+	// SignificantDigits is the number of decimal digits every value is kept to, from 1 to 5: a
+	// recorded value is reported within 10^-SignificantDigits of itself, relative to its size.
+	SignificantDigits int `json:"significant_digits"`
+}
+
+// Validate checks that the options describe a histogram.
+func (o *HistogramOptions) Validate() error {
+	if o.MaxValue < 1 {
+		return fmt.Errorf("max value must be positive, got %d", o.MaxValue)
+	}
+	if o.SignificantDigits < 1 || o.SignificantDigits > 5 {
+		return fmt.Errorf("significant digits must be in [1, 5], got %d", o.SignificantDigits)
+	}
+	return nil
+}
+
+// Histogram counts non-negative values in log-linear buckets, in the manner of an HDR histogram.
+// Values below 2^subBucketBits each have a bucket of their own. Above that, every power of two
+// range is split into 2^(subBucketBits-1) buckets of equal width, so that the width of a bucket is
+// bounded by its lowest value over 2^(subBucketBits-1).
+//
+// A Histogram is not safe for concurrent use.
+type Histogram struct {
+	opts          HistogramOptions
+	subBucketBits int
+	counts        []int64
+	total         int64
+	overflow      int64
+	min, max      int64
+}
+
+// NewHistogram creates an empty Histogram.
+func NewHistogram(opts *HistogramOptions) (*Histogram, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	// Reporting the middle of a bucket is off by at most half its width, so 2*10^digits buckets
+	// per power of two keep values within 10^-digits.
+	h := &Histogram{
+		opts:          *opts,
+		subBucketBits: bits.Len64(uint64(2*math.Pow10(opts.SignificantDigits)) - 1),
+	}
+	h.counts = make([]int64, h.index(opts.MaxValue)+1)
+	return h, nil
+}
+
+// Options returns the options the histogram was created with.
+func (h *Histogram) Options() HistogramOptions {
+	return h.opts
+}
+
+// index returns the bucket of v, which must not be negative.
+func (h *Histogram) index(v int64) int {
+	subBuckets := 1 << h.subBucketBits
+	if v < int64(subBuckets) {
+		return int(v)
+	}
+	shift := bits.Len64(uint64(v)) - h.subBucketBits
+	sub := int(v >> shift)
+	return subBuckets + (shift-1)*subBuckets/2 + sub - subBuckets/2
+}
+
+// bucketRange returns the lowest value of bucket i, and its width.
+func (h *Histogram) bucketRange(i int) (int64, int64) {
+	subBuckets := 1 << h.subBucketBits
+	if i < subBuckets {
+		return int64(i), 1
+	}
+	i -= subBuckets
+	shift := i/(subBuckets/2) + 1
+	sub := int64(i%(subBuckets/2) + subBuckets/2)
+	return sub << shift, 1 << shift
+}
+
+// Record counts v. Negative values are recorded as 0.
+func (h *Histogram) Record(v int64) {
+	h.RecordN(v, 1)
+}
+
+// RecordN counts v n times.
+func (h *Histogram) RecordN(v int64, n int64) {
+	if n <= 0 {
+		return
+	}
+	if v < 0 {
+		v = 0
+	}
+	if v > h.opts.MaxValue {
+		v = h.opts.MaxValue
+		h.overflow += n
+	}
+	if h.total == 0 || v < h.min {
+		h.min = v
+	}
+	if h.total == 0 || v > h.max {
+		h.max = v
+	}
+	h.counts[h.index(v)] += n
+	h.total += n
+}
+
+// Count returns the number of values recorded.
+func (h *Histogram) Count() int64 {
+	return h.total
+}
+
+// Overflow returns the number of values recorded as MaxValue because they were larger.
+func (h *Histogram) Overflow() int64 {
+	return h.overflow
+}
+
+// ValueAtPercentile returns the smallest value that at least p percent of the recorded values,
+// p in [0, 100], are less than or equal to, to the precision of the histogram. It returns 0 if no
+// value was recorded.
+func (h *Histogram) ValueAtPercentile(p float64) int64 {
+	if h.total == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(p / 100 * float64(h.total)))
+	// The extremes are tracked exactly.
+	if rank <= 1 {
+		return h.min
+	}
+	if rank >= h.total {
+		return h.max
+	}
+	var seen int64
+	for i, n := range h.counts {
+		seen += n
+		if seen < rank {
+			continue
+		}
+		low, width := h.bucketRange(i)
+		v := low + width/2
+		if v < h.min {
+			v = h.min
+		}
+		if v > h.max {
+			v = h.max
+		}
+		return v
+	}
+	return h.max
+}
+
+// histogramJSON is the serialized form of a Histogram. Counts are sparse, as pairs of the lowest
+// value of a bucket and its count, so that files stay readable and small.
+type histogramJSON struct {
+	HistogramOptions
+	Total    int64      `json:"total"`
+	Overflow int64      `json:"overflow"`
+	Min      int64      `json:"min"`
+	Max      int64      `json:"max"`
+	Counts   [][2]int64 `json:"counts"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (h *Histogram) MarshalJSON() ([]byte, error) {
+	out := histogramJSON{HistogramOptions: h.opts, Total: h.total, Overflow: h.overflow, Min: h.min, Max: h.max}
+	for i, n := range h.counts {
+		if n != 0 {
+			low, _ := h.bucketRange(i)
+			out.Counts = append(out.Counts, [2]int64{low, n})
+		}
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (h *Histogram) UnmarshalJSON(b []byte) error {
+	in := histogramJSON{}
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+	parsed, err := NewHistogram(&in.HistogramOptions)
+	if err != nil {
+		return err
+	}
+	for _, c := range in.Counts {
+		if c[0] < 0 || c[0] > in.MaxValue || c[1] < 0 {
+			return fmt.Errorf("invalid bucket %v", c)
+		}
+		parsed.counts[parsed.index(c[0])] += c[1]
+		parsed.total += c[1]
+	}
+	if parsed.total != in.Total {
+		return fmt.Errorf("buckets add up to %d values, expected %d", parsed.total, in.Total)
+	}
+	parsed.overflow, parsed.min, parsed.max = in.Overflow, in.Min, in.Max
+	*h = *parsed
+	return nil
+}
+
+// PercentileDelta compares a percentile of two histograms.
+type PercentileDelta struct {
+	Percentile float64 `json:"percentile"`
+	Base       int64   `json:"base"`
+	Other      int64   `json:"other"`
+	// Delta is Other - Base.
+	Delta int64 `json:"delta"`
+	// Ratio is Other / Base, or 0 if Base is 0.
+	Ratio float64 `json:"ratio"`
+}
+
+// ComparePercentiles returns, for every percentile, how the value of other differs from that of
+// base. The histograms need not have the same options.
+func ComparePercentiles(base, other *Histogram, percentiles []float64) []PercentileDelta {
+	deltas := make([]PercentileDelta, 0, len(percentiles))
+	for _, p := range percentiles {
+		d := PercentileDelta{Percentile: p, Base: base.ValueAtPercentile(p), Other: other.ValueAtPercentile(p)}
+		d.Delta = d.Other - d.Base
+		if d.Base != 0 {
+			d.Ratio = float64(d.Other) / float64(d.Base)
+		}
+		deltas = append(deltas, d)
+	}
+	return deltas
+}
+
+// LatencyHistograms record the latency of a client's calls, with a Histogram per method. Calls
+// recorded with a Connection get a Histogram per method and connection, keyed "method/connection".
+type LatencyHistograms struct {
+	opts HistogramOptions
+
+	mu       sync.Mutex
+	byMethod map[string]*Histogram
+}
+
+// NewLatencyHistograms creates empty LatencyHistograms, the histograms of which record latencies
+// in nanoseconds with opts.
+func NewLatencyHistograms(opts *HistogramOptions) (*LatencyHistograms, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return &LatencyHistograms{opts: *opts, byMethod: make(map[string]*Histogram)}, nil
+}
+
+// Record records the latency of r, if it completed.
+func (l *LatencyHistograms) Record(r *CallRecord) {
+	if !r.Completed() {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := latencyKey(r.Method, r.Connection)
+	h, ok := l.byMethod[key]
+	if !ok {
+		// The options were validated by NewLatencyHistograms.
+		h, _ = NewHistogram(&l.opts)
+		l.byMethod[key] = h
+	}
+	h.Record(r.DurationNS)
+}
+
+// latencyKey returns the key of the Histogram of the calls to method over connection.
+func latencyKey(method, connection string) string {
+	if connection == "" {
+		return method
+	}
+	return method + "/" + connection
+}
+
+// Histograms returns the histogram of every method called. They must not be modified.
+func (l *LatencyHistograms) Histograms() map[string]*Histogram {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make(map[string]*Histogram, len(l.byMethod))
+	for m, h := range l.byMethod {
+		out[m] = h
+	}
+	return out
+}
+
+func sortedMethods(byMethod map[string]*Histogram) []string {
+	methods := make([]string, 0, len(byMethod))
+	for m := range byMethod {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// WritePercentiles writes a table of the latency percentiles of every method, in nanoseconds, to w.
+func WritePercentiles(w io.Writer, byMethod map[string]*Histogram, percentiles []float64) error {
+	for _, m := range sortedMethods(byMethod) {
+		h := byMethod[m]
+		if _, err := fmt.Fprintf(w, "%s: %d calls, %d above %v\n", m, h.Count(), h.Overflow(), time.Duration(h.opts.MaxValue)); err != nil {
+			return err
+		}
+		for _, p := range percentiles {
+			if _, err := fmt.Fprintf(w, "  p%-6v %v\n", p, time.Duration(h.ValueAtPercentile(p))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteHistograms writes the histogram of every method to w as JSON.
+func WriteHistograms(w io.Writer, byMethod map[string]*Histogram) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(byMethod)
+}
+
+// ReadHistograms reads the histograms written by WriteHistograms.
+func ReadHistograms(r io.Reader) (map[string]*Histogram, error) {
+	byMethod := make(map[string]*Histogram)
+	if err := json.NewDecoder(r).Decode(&byMethod); err != nil {
+		return nil, err
+	}
+	return byMethod, nil
+}
+
+// WritePercentileDeltas writes a table comparing the latency percentiles of every method in base
+// and other to w. Methods only in one of them are listed as such.
+func WritePercentileDeltas(w io.Writer, base, other map[string]*Histogram, percentiles []float64) error {
+	all := make(map[string]*Histogram, len(base))
+	for m, h := range base {
+		all[m] = h
+	}
+	for m, h := range other {
+		all[m] = h
+	}
+	for _, m := range sortedMethods(all) {
+		b, inBase := base[m]
+		o, inOther := other[m]
+		var err error
+		switch {
+		case !inOther:
+			_, err = fmt.Fprintf(w, "%s: only in base\n", m)
+		case !inBase:
+			_, err = fmt.Fprintf(w, "%s: only in other\n", m)
+		default:
+			if _, err = fmt.Fprintf(w, "%s: %d vs %d calls\n", m, b.Count(), o.Count()); err != nil {
+				return err
+			}
+			for _, d := range ComparePercentiles(b, o, percentiles) {
+				_, err = fmt.Fprintf(w, "  p%-6v %12v %12v %+12v %7.3fx\n",
+					d.Percentile, time.Duration(d.Base), time.Duration(d.Other), time.Duration(d.Delta), d.Ratio)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
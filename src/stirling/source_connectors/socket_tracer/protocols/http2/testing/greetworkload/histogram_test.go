@@ -0,0 +1,225 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// exactPercentile is the reference for Histogram.ValueAtPercentile: the smallest value that at
+// least p percent of sorted are less than or equal to.
+func exactPercentile(sorted []int64, p float64) int64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func TestHistogram_PercentilesWithinErrorBound(t *testing.T) {
+	const maxValue = int64(time.Minute)
+	rng := rand.New(rand.NewSource(1))
+	// Log-normal latencies around 1ms, with a tail reaching into seconds.
+	values := make([]int64, 100000)
+	for i := range values {
+		values[i] = int64(math.Exp(rng.NormFloat64()*2) * float64(time.Millisecond))
+	}
+	// Small values are exact, and stress the bucket boundaries.
+	for i := 0; i < 1000; i++ {
+		values = append(values, int64(i))
+	}
+	sorted := append([]int64(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	percentiles := []float64{0, 1, 10, 25, 50, 75, 90, 99, 99.9, 99.99, 100}
+	for digits := 1; digits <= 5; digits++ {
+		h, err := greetworkload.NewHistogram(&greetworkload.HistogramOptions{MaxValue: maxValue, SignificantDigits: digits})
+		require.NoError(t, err)
+		for _, v := range values {
+			h.Record(v)
+		}
+		require.Equal(t, int64(len(values)), h.Count())
+		require.Zero(t, h.Overflow())
+
+		bound := math.Pow10(-digits)
+		for _, p := range percentiles {
+			want := exactPercentile(sorted, p)
+			got := h.ValueAtPercentile(p)
+			assert.LessOrEqual(t, math.Abs(float64(got-want)), bound*float64(want),
+				"p%v with %d digits: got %d, want %d", p, digits, got, want)
+		}
+		assert.Equal(t, sorted[0], h.ValueAtPercentile(0))
+		assert.Equal(t, sorted[len(sorted)-1], h.ValueAtPercentile(100))
+	}
+}
+
+func TestHistogram_EveryValueWithinErrorBound(t *testing.T) {
+	const maxValue = 1 << 20
+	for digits := 1; digits <= 3; digits++ {
+		bound := math.Pow10(-digits)
+		for v := int64(1); v < maxValue; v = v*17/16 + 1 {
+			// v sits between exact extremes, so that p75 reports the value of its bucket.
+			h, err := greetworkload.NewHistogram(&greetworkload.HistogramOptions{MaxValue: maxValue, SignificantDigits: digits})
+			require.NoError(t, err)
+			h.Record(0)
+			h.Record(0)
+			h.Record(v)
+			h.Record(maxValue)
+			got := h.ValueAtPercentile(75)
+			assert.LessOrEqual(t, math.Abs(float64(got-v)), bound*float64(v), "%d with %d digits: got %d", v, digits, got)
+		}
+	}
+}
+
+func TestHistogram_Overflow(t *testing.T) {
+	h, err := greetworkload.NewHistogram(&greetworkload.HistogramOptions{MaxValue: 1000, SignificantDigits: 2})
+	require.NoError(t, err)
+	h.Record(10)
+	h.Record(5000)
+	h.Record(-1)
+	assert.Equal(t, int64(3), h.Count())
+	assert.Equal(t, int64(1), h.Overflow())
+	assert.Equal(t, int64(1000), h.ValueAtPercentile(100))
+	assert.Equal(t, int64(0), h.ValueAtPercentile(0))
+}
+
+func TestHistogram_Empty(t *testing.T) {
+	h, err := greetworkload.NewHistogram(&greetworkload.HistogramOptions{MaxValue: 1000, SignificantDigits: 2})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), h.ValueAtPercentile(50))
+}
+
+func TestHistogramOptions_Validate(t *testing.T) {
+	for _, opts := range []*greetworkload.HistogramOptions{
+		{MaxValue: 0, SignificantDigits: 3},
+		{MaxValue: 1000, SignificantDigits: 0},
+		{MaxValue: 1000, SignificantDigits: 6},
+	} {
+		assert.Error(t, opts.Validate(), "%+v", opts)
+		_, err := greetworkload.NewHistogram(opts)
+		assert.Error(t, err, "%+v", opts)
+	}
+}
+
+func TestHistograms_RoundTrip(t *testing.T) {
+	h, err := greetworkload.NewHistogram(&greetworkload.HistogramOptions{MaxValue: int64(time.Minute), SignificantDigits: 3})
+	require.NoError(t, err)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		h.Record(rng.Int63n(int64(time.Second)))
+	}
+	h.Record(int64(time.Hour))
+
+	var buf bytes.Buffer
+	require.NoError(t, greetworkload.WriteHistograms(&buf, map[string]*greetworkload.Histogram{"SayHello": h}))
+	read, err := greetworkload.ReadHistograms(&buf)
+	require.NoError(t, err)
+	require.Contains(t, read, "SayHello")
+	got := read["SayHello"]
+	assert.Equal(t, h.Options(), got.Options())
+	assert.Equal(t, h.Count(), got.Count())
+	assert.Equal(t, h.Overflow(), got.Overflow())
+	for p := 0.0; p <= 100; p += 0.5 {
+		assert.Equal(t, h.ValueAtPercentile(p), got.ValueAtPercentile(p), "p%v", p)
+	}
+}
+
+func TestHistograms_ReadRejectsInconsistentCounts(t *testing.T) {
+	for _, in := range []string{
+		`{"m": {"max_value": 1000, "significant_digits": 2, "total": 2, "counts": [[10, 1]]}}`,
+		`{"m": {"max_value": 1000, "significant_digits": 2, "total": 1, "counts": [[2000, 1]]}}`,
+		`{"m": {"max_value": 0, "significant_digits": 2}}`,
+	} {
+		_, err := greetworkload.ReadHistograms(strings.NewReader(in))
+		assert.Error(t, err, in)
+	}
+}
+
+func TestComparePercentiles(t *testing.T) {
+	opts := &greetworkload.HistogramOptions{MaxValue: int64(time.Minute), SignificantDigits: 3}
+	base, err := greetworkload.NewHistogram(opts)
+	require.NoError(t, err)
+	other, err := greetworkload.NewHistogram(opts)
+	require.NoError(t, err)
+	for v := int64(1); v <= 1000; v++ {
+		base.Record(v * int64(time.Microsecond))
+		// A uniform 10% slowdown, plus a slower tail.
+		slow := v * int64(time.Microsecond) * 11 / 10
+		if v > 990 {
+			slow *= 2
+		}
+		other.Record(slow)
+	}
+
+	deltas := greetworkload.ComparePercentiles(base, other, []float64{50, 99, 100})
+	require.Len(t, deltas, 3)
+	assert.InDelta(t, 1.1, deltas[0].Ratio, 0.002)
+	assert.InDelta(t, 1.1, deltas[1].Ratio, 0.002)
+	assert.InDelta(t, 2.2, deltas[2].Ratio, 0.004)
+	for _, d := range deltas {
+		assert.Equal(t, d.Other-d.Base, d.Delta)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, greetworkload.WritePercentileDeltas(&buf,
+		map[string]*greetworkload.Histogram{"SayHello": base, "SayHi": base},
+		map[string]*greetworkload.Histogram{"SayHello": other, "SayHelloAgain": other},
+		[]float64{50}))
+	assert.Equal(t, []string{
+		"SayHello: 1000 vs 1000 calls",
+		"  p50        500.096µs    550.144µs     50.048µs   1.100x",
+		"SayHelloAgain: only in other",
+		"SayHi: only in base",
+	}, strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n"))
+}
+
+func TestLatencyHistograms(t *testing.T) {
+	l, err := greetworkload.NewLatencyHistograms(&greetworkload.HistogramOptions{MaxValue: int64(time.Minute), SignificantDigits: 3})
+	require.NoError(t, err)
+	l.Record(&greetworkload.CallRecord{Method: "SayHello", Code: "OK", DurationNS: int64(time.Millisecond)})
+	l.Record(&greetworkload.CallRecord{Method: "SayHello", Code: "OK", DurationNS: int64(2 * time.Millisecond)})
+	l.Record(&greetworkload.CallRecord{Method: "SayHello", Code: "Unavailable", DurationNS: int64(time.Second)})
+	l.Record(&greetworkload.CallRecord{Method: "SayHelloServerStreaming", Code: "OK", DurationNS: int64(time.Second)})
+
+	byMethod := l.Histograms()
+	require.Len(t, byMethod, 2)
+	// Failed calls are left out.
+	assert.Equal(t, int64(2), byMethod["SayHello"].Count())
+
+	var buf bytes.Buffer
+	require.NoError(t, greetworkload.WritePercentiles(&buf, byMethod, []float64{50, 100}))
+	assert.Equal(t, strings.Join([]string{
+		"SayHello: 2 calls, 0 above 1m0s",
+		"  p50     1ms",
+		"  p100    2ms",
+		"SayHelloServerStreaming: 1 calls, 0 above 1m0s",
+		"  p50     1s",
+		"  p100    1s",
+	}, "\n")+"\n", buf.String())
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"google.golang.org/grpc"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// TransportH3 is the CallRecord.Transport of the calls made over HTTP/3.
+const TransportH3 = "h3"
+
+// HTTP3ServerOptions configure an HTTP3Server.
+type HTTP3ServerOptions struct {
+	// TLSConfig holds the certificate of the server. It is used with TLS 1.3 and the "h3" ALPN
+	// protocol, whatever it sets.
+	TLSConfig *tls.Config
+	// Interceptors wrap every call, the first outermost, as they do in GatewayOptions.
+	Interceptors []grpc.UnaryServerInterceptor
+}
+
+// HTTP3Server serves Greeter.SayHello over HTTP/3. It is experimental: it speaks a minimal QUIC
+// and HTTP/3 of its own, only meant for loopback, which http3_go121.go documents. Only binaries
+// built with Go 1.21 or later support it, see FeatureHTTP3.
+//
+// Calls are mapped onto HTTP/3 as gRPC maps them onto HTTP/2, so that a request is the gRPC
+// request headers and length-prefixed message, and the response the headers, message and
+// grpc-status trailers of a gRPC reply. Other methods fail with Unimplemented.
+type HTTP3Server struct {
+	opts    *HTTP3ServerOptions
+	handler grpc.UnaryHandler
+}
+
+// NewHTTP3Server returns an HTTP3Server in front of greeter.
+func NewHTTP3Server(greeter pb.GreeterServer, opts *HTTP3ServerOptions) *HTTP3Server {
+	if opts == nil {
+		opts = &HTTP3ServerOptions{}
+	}
+	return &HTTP3Server{opts: opts, handler: sayHelloHandler(greeter, opts.Interceptors)}
+}
+
+// Serve serves the QUIC connections made to pc until pc is closed, and then returns nil.
+func (s *HTTP3Server) Serve(pc net.PacketConn) error {
+	if err := CheckPlatform(FeatureHTTP3); err != nil {
+		return err
+	}
+	return s.serve(pc)
+}
+
+// HTTP3Conn is an experimental HTTP/3 connection to an HTTP3Server, see Client.DialHTTP3.
+type HTTP3Conn struct {
+	*http3Conn
+}
+
+// Close closes the connection.
+func (c *HTTP3Conn) Close() error {
+	return c.close()
+}
+
+// transportKey is the context key of the transport of the calls handled outside gRPC.
+type transportKey struct{}
+
+// withTransport returns ctx, for a call handled over transport.
+func withTransport(ctx context.Context, transport string) context.Context {
+	return context.WithValue(ctx, transportKey{}, transport)
+}
+
+// callTransport returns the transport of the call handled in ctx, or "" for HTTP/2.
+func callTransport(ctx context.Context) string {
+	t, _ := ctx.Value(transportKey{}).(string)
+	return t
+}
+
+// DialHTTP3 sets up an experimental HTTP/3 connection to the HTTP3Server at address, over QUIC
+// with TLS. The server certificate is not verified, and ClientOptions.ClientCert, if set, is
+// presented. Failures to set up the connection wrap ErrDialFailed.
+func (c *Client) DialHTTP3(address string) (*HTTP3Conn, error) {
+	if err := CheckPlatform(FeatureHTTP3); err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if c.opts.ClientCert != nil {
+		tlsConfig.GetClientCertificate = c.opts.ClientCert.GetClientCertificate
+	}
+	ctx, cancel := c.callContext()
+	defer cancel()
+	conn, err := dialHTTP3(ctx, address, tlsConfig)
+	if err != nil {
+		return nil, dialError(address, err)
+	}
+	return &HTTP3Conn{conn}, nil
+}
+
+// SayHelloHTTP3 calls Greeter.SayHello over conn. The record has the Transport TransportH3.
+func (c *Client) SayHelloHTTP3(conn *HTTP3Conn, name string) *CallRecord {
+	r := c.unary(context.Background(), "SayHello", name, c.planCancel(0), conn.sayHello)
+	r.Transport = TransportH3
+	// Handshake is that of HTTP/2 connections.
+	r.Handshake = ""
+	return r
+}
@@ -0,0 +1,691 @@
+//go:build go1.21
+// +build go1.21
+
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+// This file is the HTTP/3 of HTTP3Server and HTTP3Conn, over the QUIC of quic_go121.go. A call is
+// a request stream holding a HEADERS frame with the gRPC request headers and a DATA frame with the
+// length-prefixed request, which the server answers on the same stream with a HEADERS frame, a
+// DATA frame with the length-prefixed reply, and a HEADERS frame with the grpc-status trailers,
+// or only the latter if the call failed. It is a minimal custom mapping rather than a full HTTP/3:
+//   - Field sections are encoded with QPACK literals only, without Huffman coding, static table
+//     references or the dynamic table, whose capacity both ends leave at 0. Field sections
+//     encoded otherwise are rejected.
+//   - Each end opens its control stream with an empty SETTINGS frame, and ignores the settings,
+//     and every other unidirectional stream, of its peer.
+//   - Messages are never compressed, and server push, GOAWAY and stream resets are not used.
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/proto"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+const http3Supported = true
+
+const (
+	h3ALPN = "h3"
+
+	h3FrameData     = 0x00
+	h3FrameHeaders  = 0x01
+	h3FrameSettings = 0x04
+
+	h3StreamControl = 0x00
+
+	// h3NoError is the HTTP/3 code connections are closed with, H3_NO_ERROR.
+	h3NoError = 0x100
+
+	// h3MaxFrame is the largest frame read.
+	h3MaxFrame = 16 << 20
+)
+
+// h3Field is a field of a field section.
+type h3Field struct {
+	name, value string
+}
+
+// appendQPACKInt appends v as an integer with an n bit prefix, see RFC 7541 5.1, whose first
+// byte also holds the bits of first.
+func appendQPACKInt(b []byte, first byte, n uint, v uint64) []byte {
+	limit := uint64(1)<<n - 1
+	if v < limit {
+		return append(b, first|byte(v))
+	}
+	b = append(b, first|byte(limit))
+	for v -= limit; v >= 0x80; v >>= 7 {
+		b = append(b, byte(v)|0x80)
+	}
+	return append(b, byte(v))
+}
+
+// readQPACKInt reads an integer with an n bit prefix from b, and returns what follows it.
+func readQPACKInt(b []byte, n uint) (uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, nil, errors.New("http3: truncated field section")
+	}
+	limit := uint64(1)<<n - 1
+	v := uint64(b[0]) & limit
+	b = b[1:]
+	if v < limit {
+		return v, b, nil
+	}
+	for shift := uint(0); shift < 63; shift += 7 {
+		if len(b) == 0 {
+			break
+		}
+		c := b[0]
+		b = b[1:]
+		v += uint64(c&0x7f) << shift
+		if c&0x80 == 0 {
+			return v, b, nil
+		}
+	}
+	return 0, nil, errors.New("http3: malformed integer in field section")
+}
+
+// appendFieldSection appends the QPACK field section of fields, see the file comment.
+func appendFieldSection(b []byte, fields []h3Field) []byte {
+	// Required Insert Count and Delta Base, both 0 without the dynamic table.
+	b = append(b, 0, 0)
+	for _, f := range fields {
+		// Literal Field Line with Literal Name, followed by the value.
+		b = appendQPACKInt(b, 0x20, 3, uint64(len(f.name)))
+		b = append(b, f.name...)
+		b = appendQPACKInt(b, 0, 7, uint64(len(f.value)))
+		b = append(b, f.value...)
+	}
+	return b
+}
+
+// parseFieldSection parses a field section encoded by appendFieldSection.
+func parseFieldSection(b []byte) ([]h3Field, error) {
+	if len(b) < 2 || b[0] != 0 || b[1] != 0 {
+		return nil, errors.New("http3: field section refers to the dynamic table")
+	}
+	b = b[2:]
+	var fields []h3Field
+	for len(b) > 0 {
+		if b[0]&0xe8 != 0x20 {
+			return nil, fmt.Errorf("http3: unsupported field line representation %#x", b[0])
+		}
+		var f h3Field
+		n, rest, err := readQPACKInt(b, 3)
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(rest)) < n {
+			return nil, errors.New("http3: truncated field name")
+		}
+		f.name, b = string(rest[:n]), rest[n:]
+		if len(b) > 0 && b[0]&0x80 != 0 {
+			return nil, errors.New("http3: Huffman coded field value")
+		}
+		n, rest, err = readQPACKInt(b, 7)
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(rest)) < n {
+			return nil, errors.New("http3: truncated field value")
+		}
+		f.value, b = string(rest[:n]), rest[n:]
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// fieldValue returns the value of the first field of fields named name, or "".
+func fieldValue(fields []h3Field, name string) string {
+	for _, f := range fields {
+		if f.name == name {
+			return f.value
+		}
+	}
+	return ""
+}
+
+func appendH3Frame(b []byte, typ uint64, payload []byte) []byte {
+	b = appendQUICVarint(b, typ)
+	b = appendQUICVarint(b, uint64(len(payload)))
+	return append(b, payload...)
+}
+
+// readQUICVarint reads a variable-length integer from r. It returns io.EOF only if r ends before
+// the integer does.
+func readQUICVarint(r io.ByteReader) (uint64, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	v := uint64(first & 0x3f)
+	for i := 1; i < 1<<(first>>6); i++ {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// readH3Frame reads the next frame of r. It returns io.EOF only if r ends between frames.
+func readH3Frame(r *bufio.Reader) (uint64, []byte, error) {
+	typ, err := readQUICVarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := readQUICVarint(r)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if n > h3MaxFrame {
+		return 0, nil, fmt.Errorf("http3: %d byte frame is too large", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return typ, payload, nil
+}
+
+// h3Message is a request or response read from a stream.
+type h3Message struct {
+	headers []h3Field
+	data    []byte
+	// trailers is nil if the message has none.
+	trailers []h3Field
+}
+
+// readH3Message reads the message of r, which ends with it. Frames of unknown types are skipped.
+func readH3Message(r *bufio.Reader) (*h3Message, error) {
+	m := &h3Message{}
+	for {
+		typ, payload, err := readH3Frame(r)
+		if err == io.EOF {
+			if m.headers == nil {
+				return nil, errors.New("http3: stream ended without headers")
+			}
+			return m, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case h3FrameHeaders:
+			fields, err := parseFieldSection(payload)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case m.headers == nil:
+				m.headers = fields
+			case m.trailers == nil:
+				m.trailers = fields
+			default:
+				return nil, errors.New("http3: HEADERS frame after the trailers")
+			}
+		case h3FrameData:
+			if m.headers == nil || m.trailers != nil {
+				return nil, errors.New("http3: DATA frame outside the message body")
+			}
+			m.data = append(m.data, payload...)
+		}
+	}
+}
+
+// grpcMessage returns msg with the prefix of gRPC length-prefixed messages.
+func grpcMessage(msg []byte) []byte {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// parseGRPCMessage returns the single length-prefixed message of data.
+func parseGRPCMessage(data []byte) ([]byte, error) {
+	if len(data) < 5 {
+		return nil, status.Error(codes.Internal, "truncated gRPC message")
+	}
+	if data[0] != 0 {
+		return nil, status.Error(codes.Unimplemented, "compressed messages are not supported over HTTP/3")
+	}
+	if n := binary.BigEndian.Uint32(data[1:]); uint64(n) != uint64(len(data)-5) {
+		return nil, status.Errorf(codes.Internal, "gRPC message of %d bytes in %d bytes of data", n, len(data)-5)
+	}
+	return data[5:], nil
+}
+
+// isReservedHeader is true for the headers of gRPC and HTTP that are not call metadata.
+func isReservedHeader(name string) bool {
+	switch name {
+	case "content-type", "user-agent", "te", "grpc-timeout", "grpc-encoding", "grpc-accept-encoding",
+		"grpc-status", "grpc-message", "grpc-status-details-bin":
+		return true
+	}
+	return strings.HasPrefix(name, ":")
+}
+
+// appendMetadata appends the fields of md, sorted, with the values of binary headers base64
+// encoded as gRPC sends them.
+func appendMetadata(fields []h3Field, md metadata.MD) []h3Field {
+	names := make([]string, 0, len(md))
+	for k := range md {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		for _, v := range md[k] {
+			if strings.HasSuffix(k, "-bin") {
+				v = base64.RawStdEncoding.EncodeToString([]byte(v))
+			}
+			fields = append(fields, h3Field{k, v})
+		}
+	}
+	return fields
+}
+
+// fieldMetadata returns the call metadata of fields.
+func fieldMetadata(fields []h3Field) (metadata.MD, error) {
+	md := metadata.MD{}
+	for _, f := range fields {
+		if isReservedHeader(f.name) {
+			continue
+		}
+		v := f.value
+		if strings.HasSuffix(f.name, "-bin") {
+			b, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(v, "="))
+			if err != nil {
+				return nil, fmt.Errorf("http3: malformed binary header %s: %v", f.name, err)
+			}
+			v = string(b)
+		}
+		md.Append(f.name, v)
+	}
+	return md, nil
+}
+
+// The units of grpc-timeout, finest first.
+var grpcTimeoutUnits = []struct {
+	unit   time.Duration
+	suffix string
+}{
+	{time.Nanosecond, "n"},
+	{time.Microsecond, "u"},
+	{time.Millisecond, "m"},
+	{time.Second, "S"},
+	{time.Minute, "M"},
+	{time.Hour, "H"},
+}
+
+// encodeGRPCTimeout returns the grpc-timeout of d, in the finest unit that fits its 8 digits.
+func encodeGRPCTimeout(d time.Duration) string {
+	if d <= 0 {
+		return "1n"
+	}
+	for _, u := range grpcTimeoutUnits {
+		if v := (d + u.unit - 1) / u.unit; v < 1e8 {
+			return strconv.FormatInt(int64(v), 10) + u.suffix
+		}
+	}
+	return "99999999H"
+}
+
+func decodeGRPCTimeout(s string) (time.Duration, error) {
+	if len(s) < 2 {
+		return 0, fmt.Errorf("malformed grpc-timeout %q", s)
+	}
+	v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("malformed grpc-timeout %q", s)
+	}
+	for _, u := range grpcTimeoutUnits {
+		if u.suffix == s[len(s)-1:] {
+			return time.Duration(v) * u.unit, nil
+		}
+	}
+	return 0, fmt.Errorf("malformed grpc-timeout %q", s)
+}
+
+// openControlStream opens the control stream of c, and sends its SETTINGS frame.
+func openControlStream(c *quicConn) error {
+	c.mu.Lock()
+	st := c.openStream(true)
+	c.mu.Unlock()
+	b := appendQUICVarint(nil, h3StreamControl)
+	return st.write(appendH3Frame(b, h3FrameSettings, nil), false)
+}
+
+// acceptStreams hands the request streams the peer of c opens to serve, if not nil, and discards
+// the unidirectional ones, until c is closed.
+func acceptStreams(ctx context.Context, c *quicConn, serve func(st *quicStream)) {
+	for {
+		st, err := c.acceptStream(ctx)
+		if err != nil {
+			return
+		}
+		switch {
+		case st.isUni():
+			go func() {
+				_, _ = io.Copy(io.Discard, &streamReader{ctx: ctx, st: st})
+			}()
+		case serve != nil:
+			go serve(st)
+		default:
+			// Servers do not open request streams.
+			c.mu.Lock()
+			c.closeLocked(errors.New("http3: server opened a request stream"), false)
+			c.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (s *HTTP3Server) serve(pc net.PacketConn) error {
+	config := &tls.Config{}
+	if s.opts.TLSConfig != nil {
+		config = s.opts.TLSConfig.Clone()
+	}
+	config.MinVersion = tls.VersionTLS13
+	config.MaxVersion = 0
+	config.NextProtos = []string{h3ALPN}
+
+	l := newQUICListener(pc, config)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- l.serve()
+	}()
+	for c := range l.accepted {
+		go s.serveConn(c)
+	}
+	return <-errc
+}
+
+// serveConn serves the calls made over c, once its handshake completes.
+func (s *HTTP3Server) serveConn(c *quicConn) {
+	select {
+	case <-c.ready:
+	case <-c.closed:
+		return
+	}
+	if err := openControlStream(c); err != nil {
+		return
+	}
+	// Cancels the calls in flight once the connection is closed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-c.closed
+		cancel()
+	}()
+	acceptStreams(ctx, c, func(st *quicStream) {
+		s.serveStream(ctx, st)
+	})
+}
+
+// serveStream answers the call made on st.
+func (s *HTTP3Server) serveStream(ctx context.Context, st *quicStream) {
+	stream := &h3ServerStream{}
+	reply, err := s.handle(ctx, st, stream)
+
+	var b []byte
+	if err == nil {
+		fields := appendMetadata([]h3Field{{":status", "200"}, {"content-type", "application/grpc"}}, stream.header)
+		b = appendH3Frame(b, h3FrameHeaders, appendFieldSection(nil, fields))
+		msg, err := encoding.GetCodec(proto.Name).Marshal(reply)
+		if err == nil {
+			b = appendH3Frame(b, h3FrameData, grpcMessage(msg))
+		} else {
+			err = status.Errorf(codes.Internal, "marshaling the reply: %v", err)
+		}
+		b = appendH3Frame(b, h3FrameHeaders, appendFieldSection(nil, stream.trailers(err)))
+	} else {
+		// A trailers-only response.
+		fields := append([]h3Field{{":status", "200"}, {"content-type", "application/grpc"}}, stream.trailers(err)...)
+		b = appendH3Frame(b, h3FrameHeaders, appendFieldSection(nil, appendMetadata(fields, stream.header)))
+	}
+	_ = st.write(b, true)
+}
+
+// handle reads the call made on st, and makes it.
+func (s *HTTP3Server) handle(ctx context.Context, st *quicStream, stream *h3ServerStream) (interface{}, error) {
+	m, err := readH3Message(bufio.NewReader(&streamReader{ctx: ctx, st: st}))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "reading the request: %v", err)
+	}
+	stream.method = fieldValue(m.headers, ":path")
+	if stream.method != gatewayMethod {
+		return nil, status.Errorf(codes.Unimplemented, "method %s is not served over HTTP/3", stream.method)
+	}
+	md, err := fieldMetadata(m.headers)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if authority := fieldValue(m.headers, ":authority"); authority != "" {
+		md.Set(authorityHeader, authority)
+	}
+	if v := fieldValue(m.headers, "grpc-timeout"); v != "" {
+		timeout, err := decodeGRPCTimeout(v)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	msg, err := parseGRPCMessage(m.data)
+	if err != nil {
+		return nil, err
+	}
+	req := &pb.HelloRequest{}
+	if err := encoding.GetCodec(proto.Name).Unmarshal(msg, req); err != nil {
+		return nil, status.Errorf(codes.Internal, "unmarshaling the request: %v", err)
+	}
+
+	ctx = metadata.NewIncomingContext(ctx, md)
+	ctx = grpc.NewContextWithServerTransportStream(ctx, stream)
+	return s.handler(withTransport(ctx, TransportH3), req)
+}
+
+// h3ServerStream collects the headers and trailers set by the calls served over HTTP/3, which
+// are sent once the call returns.
+type h3ServerStream struct {
+	method string
+
+	mu      sync.Mutex
+	header  metadata.MD
+	trailer metadata.MD
+}
+
+func (s *h3ServerStream) Method() string {
+	return s.method
+}
+
+func (s *h3ServerStream) SetHeader(md metadata.MD) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *h3ServerStream) SendHeader(md metadata.MD) error {
+	return s.SetHeader(md)
+}
+
+func (s *h3ServerStream) SetTrailer(md metadata.MD) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trailer = metadata.Join(s.trailer, md)
+	return nil
+}
+
+// trailers returns the trailer fields of a call that returned err.
+func (s *h3ServerStream) trailers(err error) []h3Field {
+	st := status.Convert(err)
+	fields := []h3Field{{"grpc-status", strconv.Itoa(int(st.Code()))}}
+	if st.Message() != "" {
+		fields = append(fields, h3Field{"grpc-message", url.PathEscape(st.Message())})
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return appendMetadata(fields, s.trailer)
+}
+
+// http3Conn is the QUIC connection of an HTTP3Conn.
+type http3Conn struct {
+	c         *quicConn
+	authority string
+}
+
+func dialHTTP3(ctx context.Context, address string, config *tls.Config) (*http3Conn, error) {
+	config = config.Clone()
+	config.MinVersion = tls.VersionTLS13
+	config.NextProtos = []string{h3ALPN}
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			config.ServerName = host
+		}
+	}
+	c, err := dialQUIC(ctx, address, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := openControlStream(c); err != nil {
+		c.close(h3NoError)
+		return nil, err
+	}
+	go acceptStreams(context.Background(), c, nil)
+	return &http3Conn{c: c, authority: address}, nil
+}
+
+func (conn *http3Conn) close() error {
+	conn.c.close(h3NoError)
+	return nil
+}
+
+// sayHello calls Greeter.SayHello over the connection, as a generated gRPC client does, and
+// fills in the headers and trailers asked for by opts.
+func (conn *http3Conn) sayHello(ctx context.Context, in *pb.HelloRequest, opts ...grpc.CallOption) (*pb.HelloReply, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+	msg, err := encoding.GetCodec(proto.Name).Marshal(in)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "marshaling the request: %v", err)
+	}
+	fields := []h3Field{
+		{":method", "POST"},
+		{":scheme", "https"},
+		{":authority", conn.authority},
+		{":path", gatewayMethod},
+		{"content-type", "application/grpc"},
+		{"te", "trailers"},
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		fields = append(fields, h3Field{"grpc-timeout", encodeGRPCTimeout(time.Until(deadline))})
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	fields = appendMetadata(fields, md)
+	b := appendH3Frame(nil, h3FrameHeaders, appendFieldSection(nil, fields))
+	b = appendH3Frame(b, h3FrameData, grpcMessage(msg))
+
+	conn.c.mu.Lock()
+	st := conn.c.openStream(false)
+	conn.c.mu.Unlock()
+	if err := st.write(b, true); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	m, err := readH3Message(bufio.NewReader(&streamReader{ctx: ctx, st: st}))
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, status.FromContextError(ctxErr).Err()
+		}
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	trailers := m.trailers
+	if trailers == nil {
+		trailers = m.headers
+	}
+	header, err := fieldMetadata(m.headers)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	trailer, err := fieldMetadata(trailers)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	for _, o := range opts {
+		switch o := o.(type) {
+		case grpc.HeaderCallOption:
+			*o.HeaderAddr = header
+		case grpc.TrailerCallOption:
+			*o.TrailerAddr = trailer
+		}
+	}
+
+	code, err := strconv.Atoi(fieldValue(trailers, "grpc-status"))
+	if err != nil {
+		return nil, status.Error(codes.Internal, "response without a grpc-status")
+	}
+	if code != int(codes.OK) {
+		message, err := url.PathUnescape(fieldValue(trailers, "grpc-message"))
+		if err != nil {
+			message = fieldValue(trailers, "grpc-message")
+		}
+		return nil, status.Error(codes.Code(code), message)
+	}
+	data, err := parseGRPCMessage(m.data)
+	if err != nil {
+		return nil, err
+	}
+	reply := &pb.HelloReply{}
+	if err := encoding.GetCodec(proto.Name).Unmarshal(data, reply); err != nil {
+		return nil, status.Errorf(codes.Internal, "unmarshaling the reply: %v", err)
+	}
+	return reply, nil
+}
@@ -0,0 +1,52 @@
+//go:build !go1.21
+// +build !go1.21
+
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"google.golang.org/grpc"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// The QUIC of HTTP/3 is built on the QUIC support of crypto/tls, which Go 1.21 added.
+const http3Supported = false
+
+func (s *HTTP3Server) serve(net.PacketConn) error {
+	return unsupportedPlatform(FeatureHTTP3)
+}
+
+type http3Conn struct{}
+
+func dialHTTP3(context.Context, string, *tls.Config) (*http3Conn, error) {
+	return nil, unsupportedPlatform(FeatureHTTP3)
+}
+
+func (conn *http3Conn) close() error {
+	return nil
+}
+
+func (conn *http3Conn) sayHello(context.Context, *pb.HelloRequest, ...grpc.CallOption) (*pb.HelloReply, error) {
+	return nil, unsupportedPlatform(FeatureHTTP3)
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// startHTTP3Server serves greeter over HTTP/3 on a loopback UDP port until the test ends, and
+// returns its address.
+func startHTTP3Server(t *testing.T, greeter pb.GreeterServer, interceptors ...grpc.UnaryServerInterceptor) string {
+	if err := greetworkload.CheckPlatform(greetworkload.FeatureHTTP3); err != nil {
+		t.Skip(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := greetworkload.NewHTTP3Server(greeter, &greetworkload.HTTP3ServerOptions{
+		TLSConfig:    &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}},
+		Interceptors: interceptors,
+	})
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(pc) }()
+	t.Cleanup(func() {
+		pc.Close()
+		assert.NoError(t, <-done)
+	})
+	return pc.LocalAddr().String()
+}
+
+func TestHTTP3_SayHello(t *testing.T) {
+	tracer := greetworkload.NewRequestTracer(&greetworkload.RequestTracerOptions{KeepRecords: true})
+	callStats := greetworkload.NewCallStats()
+	addr := startHTTP3Server(t, greetworkload.NewServer(&greetworkload.ServerOptions{InstanceID: "h3"}),
+		callStats.UnaryServerInterceptor(), tracer.UnaryServerInterceptor())
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.DialHTTP3(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for i := 0; i < 3; i++ {
+		r := c.SayHelloHTTP3(conn, "pixie")
+		require.True(t, r.Completed(), r.Error)
+		assert.Equal(t, "SayHello", r.Method)
+		assert.Equal(t, "h3", r.InstanceID)
+		assert.Equal(t, greetworkload.TransportH3, r.Transport)
+		assert.Empty(t, r.Handshake)
+		// The request ID was echoed in the trailers.
+		assert.Equal(t, 1, r.Attempt)
+	}
+
+	records := tracer.Records()
+	require.Len(t, records, 3)
+	for _, r := range records {
+		assert.Equal(t, greetworkload.TransportH3, r.Transport)
+		assert.Equal(t, addr, r.Authority)
+		assert.NotEmpty(t, r.RequestID)
+	}
+	assert.Equal(t, []*pb.CallCount{{Method: "/px.stirling.protocols.http2.testing.Greeter/SayHello", Code: "OK", Count: 3}}, callStats.Snapshot())
+}
+
+func TestHTTP3_FailedCall(t *testing.T) {
+	faults, err := greetworkload.NewFaultInjector(&greetworkload.FaultConfig{ErrorRate: 1, Code: codes.ResourceExhausted}, 1)
+	require.NoError(t, err)
+	addr := startHTTP3Server(t, greetworkload.NewServer(nil), faults.UnaryServerInterceptor())
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.DialHTTP3(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	r := c.SayHelloHTTP3(conn, "pixie")
+	assert.Equal(t, codes.ResourceExhausted.String(), r.Code)
+	assert.NotEmpty(t, r.Error)
+	assert.Equal(t, greetworkload.TransportH3, r.Transport)
+}
+
+func TestHTTP3_DialFailure(t *testing.T) {
+	if err := greetworkload.CheckPlatform(greetworkload.FeatureHTTP3); err != nil {
+		t.Skip(err)
+	}
+	// Nothing answers on the port of a closed socket.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := pc.LocalAddr().String()
+	pc.Close()
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 200 * time.Millisecond})
+	_, err = c.DialHTTP3(addr)
+	assert.ErrorIs(t, err, greetworkload.ErrDialFailed)
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/gogo/protobuf/jsonpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// invokeMethod calls a single method with already decoded requests, passing every reply to emit.
+type invokeMethod struct {
+	call func(ctx context.Context, conn *grpc.ClientConn, reqs []*pb.HelloRequest, emit func(*pb.HelloReply) error) error
+}
+
+func unaryMethod(call func(ctx context.Context, conn *grpc.ClientConn, req *pb.HelloRequest) (*pb.HelloReply, error)) invokeMethod {
+	return invokeMethod{
+		call: func(ctx context.Context, conn *grpc.ClientConn, reqs []*pb.HelloRequest, emit func(*pb.HelloReply) error) error {
+			reply, err := call(ctx, conn, reqs[0])
+			if err != nil {
+				return err
+			}
+			return emit(reply)
+		},
+	}
+}
+
+var invokeMethods = map[string]invokeMethod{
+	pb.Greeter_SayHello_FullMethodName: unaryMethod(func(ctx context.Context, conn *grpc.ClientConn, req *pb.HelloRequest) (*pb.HelloReply, error) {
+		return pb.NewGreeterClient(conn).SayHello(ctx, req)
+	}),
+	pb.Greeter_SayHelloAgain_FullMethodName: unaryMethod(func(ctx context.Context, conn *grpc.ClientConn, req *pb.HelloRequest) (*pb.HelloReply, error) {
+		return pb.NewGreeterClient(conn).SayHelloAgain(ctx, req)
+	}),
+	pb.Greeter2_SayHi_FullMethodName: unaryMethod(func(ctx context.Context, conn *grpc.ClientConn, req *pb.HelloRequest) (*pb.HelloReply, error) {
+		return pb.NewGreeter2Client(conn).SayHi(ctx, req)
+	}),
+	pb.StreamingGreeter_SayHelloServerStreaming_FullMethodName: {
+		call: func(ctx context.Context, conn *grpc.ClientConn, reqs []*pb.HelloRequest, emit func(*pb.HelloReply) error) error {
+			stream, err := pb.NewStreamingGreeterClient(conn).SayHelloServerStreaming(ctx, reqs[0])
+			if err != nil {
+				return err
+			}
+			for {
+				reply, err := stream.Recv()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if err := emit(reply); err != nil {
+					return err
+				}
+			}
+		},
+	},
+	pb.StreamingGreeter_SayHelloClientStreaming_FullMethodName: {
+		call: func(ctx context.Context, conn *grpc.ClientConn, reqs []*pb.HelloRequest, emit func(*pb.HelloReply) error) error {
+			stream, err := pb.NewStreamingGreeterClient(conn).SayHelloClientStreaming(ctx)
+			if err != nil {
+				return err
+			}
+			for _, req := range reqs {
+				if err := stream.Send(req); err != nil {
+					if err == io.EOF {
+						break
+					}
+					return err
+				}
+			}
+			reply, err := stream.CloseAndRecv()
+			if err != nil {
+				return err
+			}
+			return emit(reply)
+		},
+	},
+	pb.StreamingGreeter_SayHelloBidirStreaming_FullMethodName: {
+		call: invokeBidirStreaming,
+	},
+}
+
+// invokeBidirStreaming receives replies while it sends requests, since the server stops reading
+// requests once the replies it sent fill the HTTP/2 flow control window.
+func invokeBidirStreaming(ctx context.Context, conn *grpc.ClientConn, reqs []*pb.HelloRequest, emit func(*pb.HelloReply) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := pb.NewStreamingGreeterClient(conn).SayHelloBidirStreaming(ctx)
+	if err != nil {
+		return err
+	}
+
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			reply, err := stream.Recv()
+			if err == io.EOF {
+				recvErr <- nil
+				return
+			}
+			if err == nil {
+				err = emit(reply)
+			}
+			if err != nil {
+				// Unblocks any Send waiting on flow control.
+				cancel()
+				recvErr <- err
+				return
+			}
+		}
+	}()
+
+	for _, req := range reqs {
+		if err := stream.Send(req); err != nil {
+			// The stream is over; its status, or the error that ended it, comes from Recv.
+			break
+		}
+	}
+	// CloseSend fails only once the stream is over, which Recv reports as well.
+	_ = stream.CloseSend()
+	return <-recvErr
+}
+
+// InvokeMethods returns the full names of the methods Invoke can call, sorted.
+func InvokeMethods() []string {
+	methods := make([]string, 0, len(invokeMethods))
+	for m := range invokeMethods {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// InvokeInputError reports an unknown method or malformed requests passed to Invoke, found before
+// any call was made. It carries the gRPC status a server would have answered with, so that it can
+// still be told apart from an error returned by the server.
+type InvokeInputError struct {
+	status *status.Status
+}
+
+func inputErrorf(code codes.Code, format string, args ...interface{}) error {
+	return &InvokeInputError{status: status.Newf(code, format, args...)}
+}
+
+func (e *InvokeInputError) Error() string {
+	return e.status.Message()
+}
+
+// GRPCStatus returns Unimplemented for unknown methods and InvalidArgument for malformed requests.
+func (e *InvokeInputError) GRPCStatus() *status.Status {
+	return e.status
+}
+
+// Invoke calls fullMethod, e.g. pb.Greeter_SayHello_FullMethodName, over conn.
+// The requests are read from in as a sequence of JSON objects. Client-streaming methods send every
+// request, the others take exactly one. Every reply is written to out as a line of JSON.
+// The returned error is an *InvokeInputError if fullMethod or the requests are invalid, or carries
+// the gRPC status the call failed with.
+func Invoke(ctx context.Context, conn *grpc.ClientConn, fullMethod string, in io.Reader, out io.Writer) error {
+	m, ok := invokeMethods[fullMethod]
+	info, registered := pb.GreetMethods.Lookup(fullMethod)
+	if !ok || !registered {
+		return inputErrorf(codes.Unimplemented, "unknown method %q, expected one of: %s",
+			fullMethod, strings.Join(InvokeMethods(), ", "))
+	}
+
+	var reqs []*pb.HelloRequest
+	dec := json.NewDecoder(in)
+	for {
+		req := &pb.HelloRequest{}
+		err := jsonpb.UnmarshalNext(dec, req)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return inputErrorf(codes.InvalidArgument, "invalid JSON for request %d: %v", len(reqs)+1, err)
+		}
+		reqs = append(reqs, req)
+	}
+	// Client-streaming methods take any number of requests, the others exactly one.
+	if !info.Kind.ClientStreams() && len(reqs) != 1 {
+		return inputErrorf(codes.InvalidArgument, "%s takes exactly one request, got %d", fullMethod, len(reqs))
+	}
+
+	marshaler := &jsonpb.Marshaler{}
+	emit := func(reply *pb.HelloReply) error {
+		if err := marshaler.Marshal(out, reply); err != nil {
+			return err
+		}
+		_, err := io.WriteString(out, "\n")
+		return err
+	}
+	return m.call(ctx, conn, reqs, emit)
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+func dialTestServer(t *testing.T) *grpc.ClientConn {
+	_, addr := startServer(t, nil)
+	conn, err := greetworkload.NewClient(&greetworkload.ClientOptions{}).Dial(addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func invoke(conn *grpc.ClientConn, method, in string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var out bytes.Buffer
+	err := greetworkload.Invoke(ctx, conn, method, strings.NewReader(in), &out)
+	return out.String(), err
+}
+
+func TestInvoke_EveryMethod(t *testing.T) {
+	tests := []struct {
+		method string
+		in     string
+		out    string
+	}{
+		{
+			method: "/px.stirling.protocols.http2.testing.Greeter/SayHello",
+			in:     `{"name": "pixie"}`,
+			out:    `{"message":"Hello pixie"}` + "\n",
+		},
+		{
+			method: "/px.stirling.protocols.http2.testing.Greeter/SayHelloAgain",
+			in:     `{"name": "pixie"}`,
+			out:    `{"message":"Hello again, pixie, call #1"}` + "\n",
+		},
+		{
+			method: "/px.stirling.protocols.http2.testing.Greeter2/SayHi",
+			in:     `{"name": "pixie"}`,
+			out:    `{"message":"Hi pixie"}` + "\n",
+		},
+		{
+			method: "/px.stirling.protocols.http2.testing.StreamingGreeter/SayHelloServerStreaming",
+			in:     `{"name": "pixie", "count": 2}`,
+			out:    `{"message":"Hello pixie"}` + "\n" + `{"message":"Hello pixie"}` + "\n",
+		},
+		{
+			method: "/px.stirling.protocols.http2.testing.StreamingGreeter/SayHelloClientStreaming",
+			in:     `{"name": "a"} {"name": "b"}`,
+			out:    `{"message":"Hello a, b!"}` + "\n",
+		},
+		{
+			method: "/px.stirling.protocols.http2.testing.StreamingGreeter/SayHelloBidirStreaming",
+			in:     "{\"name\": \"a\"}\n{\"name\": \"b\"}\n",
+			out:    `{"message":"Hello a"}` + "\n" + `{"message":"Hello b"}` + "\n",
+		},
+	}
+
+	conn := dialTestServer(t)
+	tested := make([]string, 0, len(tests))
+	for _, tc := range tests {
+		tested = append(tested, tc.method)
+		t.Run(tc.method, func(t *testing.T) {
+			out, err := invoke(conn, tc.method, tc.in)
+			require.NoError(t, err)
+			assert.Equal(t, tc.out, out)
+		})
+	}
+	assert.ElementsMatch(t, greetworkload.InvokeMethods(), tested)
+}
+
+func TestInvoke_Errors(t *testing.T) {
+	const sayHello = "/px.stirling.protocols.http2.testing.Greeter/SayHello"
+	tests := []struct {
+		name    string
+		method  string
+		in      string
+		code    codes.Code
+		errText string
+	}{
+		{"unknown method", "/px.stirling.protocols.http2.testing.Greeter/SayGoodbye", `{"name": "a"}`, codes.Unimplemented, "unknown method"},
+		{"malformed JSON", sayHello, `{"name": `, codes.InvalidArgument, "invalid JSON for request 1"},
+		{"unknown field", sayHello, `{"nmae": "a"}`, codes.InvalidArgument, "invalid JSON for request 1"},
+		{"wrong type", sayHello, `{"count": "many"}`, codes.InvalidArgument, "invalid JSON for request 1"},
+		{"no request", sayHello, ``, codes.InvalidArgument, "exactly one request, got 0"},
+		{"too many requests", sayHello, `{"name": "a"} {"name": "b"}`, codes.InvalidArgument, "exactly one request, got 2"},
+	}
+
+	conn := dialTestServer(t)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := invoke(conn, tc.method, tc.in)
+			assert.Empty(t, out)
+			assert.Equal(t, tc.code, status.Code(err))
+			assert.Contains(t, status.Convert(err).Message(), tc.errText)
+			var inputErr *greetworkload.InvokeInputError
+			assert.ErrorAs(t, err, &inputErr)
+		})
+	}
+}
+
+func TestInvoke_ServerErrorIsNotInputError(t *testing.T) {
+	_, addr := startServer(t, &greetworkload.ServerOptions{ValidateRequests: true})
+	conn, err := greetworkload.NewClient(&greetworkload.ClientOptions{}).Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = invoke(conn, "/px.stirling.protocols.http2.testing.Greeter/SayHello", `{"name": ""}`)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	var inputErr *greetworkload.InvokeInputError
+	assert.False(t, errors.As(err, &inputErr))
+}
+
+func TestInvoke_BidirStreamingBeyondFlowControlWindow(t *testing.T) {
+	// The client's windows are pinned to 64KB so they don't grow, and 96 4KB requests and replies
+	// are several times what they and the server's initial windows hold in either direction. Sending
+	// every request before reading a reply would deadlock.
+	_, addr := startServer(t, nil)
+	conn, err := greetworkload.NewClient(&greetworkload.ClientOptions{}).Dial(addr,
+		grpc.WithInitialWindowSize(64*1024), grpc.WithInitialConnWindowSize(64*1024))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	const numRequests = 96
+	name := strings.Repeat("x", 4096)
+	var in strings.Builder
+	for i := 0; i < numRequests; i++ {
+		fmt.Fprintf(&in, "{\"name\": %q}\n", name)
+	}
+
+	out, err := invoke(conn, "/px.stirling.protocols.http2.testing.StreamingGreeter/SayHelloBidirStreaming", in.String())
+	require.NoError(t, err)
+	assert.Equal(t, numRequests, strings.Count(out, "\n"))
+}
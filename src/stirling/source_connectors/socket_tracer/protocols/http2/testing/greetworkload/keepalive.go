@@ -0,0 +1,147 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+)
+
+// gRPC clients ping no more often than this, whatever their keepalive time.
+const minKeepaliveTime = 10 * time.Second
+
+// tooManyPingsDebugData is how gRPC clients report, in the error of the calls it failed, a GOAWAY
+// sent with ENHANCE_YOUR_CALM and the debug data "too_many_pings". gRPC servers send it to clients
+// that ping more often than their keepalive enforcement policy allows.
+const tooManyPingsDebugData = `debug data: "too_many_pings"`
+
+// KeepaliveOptions are the HTTP/2 keepalive pings a greet client sends, and the policy a greet
+// server holds its clients' pings to. Zero values leave gRPC's defaults in place.
+type KeepaliveOptions struct {
+	// Time is the interval after which a client pings a connection it has heard nothing on.
+	// gRPC raises it to 10s if shorter. Clients only.
+	Time time.Duration
+	// Timeout is how long a client waits for the reply to a ping before closing the connection.
+	// Clients only.
+	Timeout time.Duration
+	// MinTime is the shortest interval between the pings of a client a server allows. Clients
+	// that ping more often are sent a GOAWAY with ENHANCE_YOUR_CALM and "too_many_pings", which
+	// fails their calls in flight. gRPC's default is 5 minutes. Servers only.
+	MinTime time.Duration
+	// PermitWithoutStream has clients ping, and servers allow pings, on connections with no calls
+	// in flight.
+	PermitWithoutStream bool
+}
+
+// Validate returns an error if the options cannot be honored, by a server served as h2c if h2c is
+// set. Options that need gRPC's own transport are then reported as ErrBadFlagCombination.
+func (k *KeepaliveOptions) Validate(h2c bool) error {
+	switch {
+	case k.Time < 0 || k.Timeout < 0 || k.MinTime < 0:
+		return badFlagsf("keepalive intervals cannot be negative")
+	case h2c && (k.MinTime != 0 || k.PermitWithoutStream):
+		return badFlagsf("h2c does not enforce a keepalive policy")
+	}
+	return nil
+}
+
+// DialOptions returns the dial options that make gRPC clients ping as set.
+func (k *KeepaliveOptions) DialOptions() []grpc.DialOption {
+	if k.Time == 0 && k.Timeout == 0 && !k.PermitWithoutStream {
+		return nil
+	}
+	return []grpc.DialOption{grpc.WithKeepaliveParams(keepalive.ClientParameters{
+		Time:                k.Time,
+		Timeout:             k.Timeout,
+		PermitWithoutStream: k.PermitWithoutStream,
+	})}
+}
+
+// ServerOptions returns the server options that make gRPC servers enforce the policy set.
+func (k *KeepaliveOptions) ServerOptions() []grpc.ServerOption {
+	if k.MinTime == 0 && !k.PermitWithoutStream {
+		return nil
+	}
+	return []grpc.ServerOption{grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+		MinTime:             k.MinTime,
+		PermitWithoutStream: k.PermitWithoutStream,
+	})}
+}
+
+// ClientTime returns the interval at which gRPC clients actually ping with the options set.
+func (k *KeepaliveOptions) ClientTime() time.Duration {
+	if k.Time != 0 && k.Time < minKeepaliveTime {
+		return minKeepaliveTime
+	}
+	return k.Time
+}
+
+// TooManyPings returns true if the call failed because a server closed its connection with a
+// GOAWAY for too many pings. Such calls are failures the client provoked with its keepalive pings,
+// rather than faults of the server.
+func (r *CallRecord) TooManyPings() bool {
+	return r.Code == codes.Unavailable.String() && strings.Contains(r.Error, tooManyPingsDebugData)
+}
+
+// TooManyPingsEvent is a GOAWAY for too many pings, as seen from the calls it failed.
+type TooManyPingsEvent struct {
+	// Time is when the first of the calls it failed ended.
+	Time time.Time
+	// Failed is the number of calls it failed.
+	Failed int
+	// InFlight is the number of calls of the run in flight at Time, including those it failed.
+	InFlight int
+}
+
+// TooManyPingsEvents returns the GOAWAYs for too many pings that failed records, in order. Failed
+// calls are put down to the same GOAWAY as long as they started before the first of them ended,
+// since a GOAWAY fails the calls in flight all at once.
+func TooManyPingsEvents(records []*CallRecord) []TooManyPingsEvent {
+	var failed []*CallRecord
+	for _, r := range records {
+		if r.TooManyPings() {
+			failed = append(failed, r)
+		}
+	}
+	sort.Slice(failed, func(i, j int) bool { return callEnd(failed[i]).Before(callEnd(failed[j])) })
+	var events []TooManyPingsEvent
+	for _, r := range failed {
+		if n := len(events); n > 0 && r.StartTime.Before(events[n-1].Time) {
+			events[n-1].Failed++
+			continue
+		}
+		events = append(events, TooManyPingsEvent{Time: callEnd(r), Failed: 1})
+	}
+	for i := range events {
+		for _, r := range records {
+			if !r.StartTime.After(events[i].Time) && !callEnd(r).Before(events[i].Time) {
+				events[i].InFlight++
+			}
+		}
+	}
+	return events
+}
+
+func callEnd(r *CallRecord) time.Time {
+	return r.StartTime.Add(time.Duration(r.DurationNS))
+}
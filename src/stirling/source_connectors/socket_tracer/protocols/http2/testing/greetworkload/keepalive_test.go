@@ -0,0 +1,194 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+func TestKeepaliveOptions(t *testing.T) {
+	none := &greetworkload.KeepaliveOptions{}
+	assert.NoError(t, none.Validate(true))
+	assert.Empty(t, none.DialOptions())
+	assert.Empty(t, none.ServerOptions())
+
+	client := &greetworkload.KeepaliveOptions{Time: time.Second}
+	assert.NoError(t, client.Validate(true))
+	assert.Len(t, client.DialOptions(), 1)
+	assert.Empty(t, client.ServerOptions())
+	assert.Equal(t, 10*time.Second, client.ClientTime())
+	assert.Equal(t, time.Minute, (&greetworkload.KeepaliveOptions{Time: time.Minute}).ClientTime())
+
+	server := &greetworkload.KeepaliveOptions{MinTime: time.Second}
+	assert.NoError(t, server.Validate(false))
+	assert.Len(t, server.ServerOptions(), 1)
+	assert.True(t, errors.Is(server.Validate(true), greetworkload.ErrBadFlagCombination))
+	assert.True(t, errors.Is((&greetworkload.KeepaliveOptions{Timeout: -1}).Validate(false), greetworkload.ErrBadFlagCombination))
+}
+
+func TestTooManyPingsEvents(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	const goAway = `rpc error: code = Unavailable desc = closing transport due to: connection error: desc = "error reading from server: EOF", received prior goaway: code: ENHANCE_YOUR_CALM, debug data: "too_many_pings"`
+	call := func(startMillis, durationMillis int64, code codes.Code, err string) *greetworkload.CallRecord {
+		return &greetworkload.CallRecord{
+			Method:     "SayHello",
+			StartTime:  start.Add(time.Duration(startMillis) * time.Millisecond),
+			DurationNS: (time.Duration(durationMillis) * time.Millisecond).Nanoseconds(),
+			Code:       code.String(),
+			Error:      err,
+		}
+	}
+	records := []*greetworkload.CallRecord{
+		call(0, 10, codes.OK, ""),
+		call(5, 95, codes.Unavailable, goAway),
+		call(20, 81, codes.Unavailable, goAway),
+		call(30, 200, codes.OK, ""),
+		// Another GOAWAY, once the client has reconnected.
+		call(150, 50, codes.Unavailable, goAway),
+		// Not for too many pings.
+		call(150, 50, codes.Unavailable, "connection refused"),
+		call(150, 50, codes.Internal, goAway),
+	}
+	assert.True(t, records[1].TooManyPings())
+	assert.False(t, records[0].TooManyPings())
+	assert.False(t, records[5].TooManyPings())
+	assert.False(t, records[6].TooManyPings())
+
+	assert.Equal(t, []greetworkload.TooManyPingsEvent{
+		{Time: start.Add(100 * time.Millisecond), Failed: 2, InFlight: 3},
+		{Time: start.Add(200 * time.Millisecond), Failed: 1, InFlight: 4},
+	}, greetworkload.TooManyPingsEvents(records))
+	assert.Empty(t, greetworkload.TooManyPingsEvents(records[:1]))
+}
+
+// pingConn is a connection that PING frames can be injected into, behind the back of gRPC.
+type pingConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (p *pingConn) dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		p.conn = conn
+	}
+	return conn, nil
+}
+
+// ping writes n PING frames to the first connection dialed. gRPC must not be writing to it.
+func (p *pingConn) ping(n int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fr := http2.NewFramer(p.conn, nil)
+	for i := 0; i < n; i++ {
+		if err := fr.WritePing(false, [8]byte{byte(i)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A client that pings more often than the server allows has its calls in flight failed by a
+// GOAWAY for too many pings, which the run records as such, and gets over.
+func TestTooManyPings_GOAWAY(t *testing.T) {
+	faults, err := greetworkload.NewFaultInjector(&greetworkload.FaultConfig{LatencyMillis: 500}, 1)
+	require.NoError(t, err)
+	handled := make(chan struct{}, 10)
+	notify := func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		handled <- struct{}{}
+		return handler(ctx, req)
+	}
+	opts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(notify, faults.UnaryServerInterceptor())}
+	opts = append(opts, (&greetworkload.KeepaliveOptions{MinTime: time.Hour}).ServerOptions()...)
+	addr := startServerWith(t, &serverSetup{GRPC: opts}).Addr
+
+	connStats := greetworkload.NewConnStatsHandler()
+	pinger := &pingConn{}
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 10 * time.Second})
+	conn, err := c.Dial(addr, grpc.WithStatsHandler(connStats), grpc.WithContextDialer(connStats.DialerFrom(pinger.dial)))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	records := []*greetworkload.CallRecord{c.SayHello(conn, "warm")}
+	require.True(t, records[0].Completed(), records[0].Error)
+	<-handled
+
+	const inFlight = 3
+	results := make(chan *greetworkload.CallRecord, inFlight)
+	for i := 0; i < inFlight; i++ {
+		go func() { results <- c.SayHello(conn, "pixie") }()
+	}
+	for i := 0; i < inFlight; i++ {
+		<-handled
+	}
+	// The calls are held back by the latency fault, and so the connection is quiet.
+	require.NoError(t, pinger.ping(5))
+	for i := 0; i < inFlight; i++ {
+		r := <-results
+		assert.True(t, r.TooManyPings(), r.Error)
+		records = append(records, r)
+	}
+
+	// The run goes on over a new connection.
+	r := c.SayHello(conn, "again")
+	require.True(t, r.Completed(), r.Error)
+	records = append(records, r)
+
+	events := greetworkload.TooManyPingsEvents(records)
+	require.Len(t, events, 1)
+	assert.Equal(t, inFlight, events[0].Failed)
+	assert.Equal(t, inFlight, events[0].InFlight)
+
+	// The stats of both connections are written out, the one closed by the GOAWAY included.
+	require.NoError(t, conn.Close())
+	var buf bytes.Buffer
+	require.NoError(t, greetworkload.WriteConnStats(&buf, nil, connStats.Conns()))
+	conns, err := greetworkload.ReadConnStats(&buf)
+	require.NoError(t, err)
+	require.Len(t, conns, 2)
+	var started, completed int64
+	for _, cs := range conns {
+		started += cs.RPCsStarted
+		completed += cs.RPCsCompleted
+	}
+	assert.Equal(t, int64(len(records)), started)
+	assert.Equal(t, int64(2), completed)
+	pinger.mu.Lock()
+	defer pinger.mu.Unlock()
+	assert.Equal(t, pinger.conn.LocalAddr().String(), conns[0].LocalAddr)
+	assert.NotNil(t, conns[0].CloseTime)
+}
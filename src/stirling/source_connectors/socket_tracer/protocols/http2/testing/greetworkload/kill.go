@@ -0,0 +1,310 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// KillAfterPrefix starts the name of the server-streaming calls whose connection a KillListener
+// kills once they were sent a number of replies: that of kill-after-3 is killed after 3.
+const KillAfterPrefix = "kill-after-"
+
+// maxKillRequestLen bounds the request messages a KillListener reads the name of.
+const maxKillRequestLen = 64 << 10
+
+// initialHeaderTableSize is the size of the HPACK dynamic table HTTP/2 connections start with.
+const initialHeaderTableSize = 4096
+
+// killMethod is the method whose calls a KillListener kills the connection of.
+const killMethod = pb.StreamingGreeter_SayHelloServerStreaming_FullMethodName
+
+// KillAfter returns the number of replies after which a KillListener kills the connection of a
+// server-streaming call with name, and false if name does not ask for it.
+func KillAfter(name string) (int, bool) {
+	if !strings.HasPrefix(name, KillAfterPrefix) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(name, KillAfterPrefix))
+	if err != nil || n < 1 {
+		return 0, false
+	}
+	return n, true
+}
+
+// KillListener wraps the listener of an HTTP/2 server to tear down connections in the middle of a
+// stream. The connection of every server-streaming call whose request is named as KillAfter asks
+// is closed as soon
+// as the frame ending the given number of reply messages was written, without RST_STREAM, trailers
+// or GOAWAY: the client sees the stream cut short, and the calls over other connections go on.
+//
+// Names are read from the first message of every stream, as the client writes it, so compressed
+// requests are left alone. As with GoAwayListener, the connections must carry HTTP/2 from their
+// first byte: KillListener must sit above TLS, and can't be used with h2c Upgrade.
+type KillListener struct {
+	net.Listener
+	killed int64
+}
+
+// NewKillListener wraps lis.
+func NewKillListener(lis net.Listener) *KillListener {
+	return &KillListener{Listener: lis}
+}
+
+// Accept implements net.Listener.
+func (l *KillListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := &killConn{
+		Conn:     conn,
+		lis:      l,
+		preface:  len(http2.ClientPreface),
+		headers:  hpack.NewDecoder(initialHeaderTableSize, nil),
+		requests: make(map[uint32][]byte),
+		kills:    make(map[uint32]*killStream),
+	}
+	c.in.onHeader = c.onRequestHeader
+	c.in.onPayload = c.onRequestPayload
+	c.out.onHeader = c.onReplyHeader
+	c.out.onPayload = c.onReplyData
+	return c, nil
+}
+
+// Killed returns the number of connections killed so far.
+func (l *KillListener) Killed() int64 {
+	return atomic.LoadInt64(&l.killed)
+}
+
+// killStream counts the reply messages written on a stream whose connection is to be killed.
+type killStream struct {
+	after int
+	sent  int
+	// prefix holds the first prefixLen bytes of the prefix of the message being written.
+	prefix    [grpcMessagePrefixLen]byte
+	prefixLen int
+	// remaining is the number of bytes of the message being written that are still to come.
+	remaining uint32
+}
+
+// add follows the message bytes in b, and returns true once after messages were written.
+func (k *killStream) add(b []byte) bool {
+	for len(b) > 0 && k.sent < k.after {
+		if k.remaining > 0 {
+			n := uint32(len(b))
+			if n > k.remaining {
+				n = k.remaining
+			}
+			k.remaining -= n
+			b = b[n:]
+			if k.remaining == 0 {
+				k.sent++
+			}
+			continue
+		}
+		n := copy(k.prefix[k.prefixLen:], b)
+		k.prefixLen += n
+		b = b[n:]
+		if k.prefixLen < grpcMessagePrefixLen {
+			continue
+		}
+		k.prefixLen = 0
+		k.remaining = binary.BigEndian.Uint32(k.prefix[1:])
+		if k.remaining == 0 {
+			k.sent++
+		}
+	}
+	return k.sent >= k.after
+}
+
+type killConn struct {
+	net.Conn
+	lis *KillListener
+
+	// The read side is only used by Read, which gRPC does not call concurrently.
+	in frameScanner
+	// preface is the number of bytes of the client preface still to be read.
+	preface int
+	// headers decodes the header blocks the client sends. Every block must be decoded, for the
+	// decoder to follow the changes to its dynamic table.
+	headers *hpack.Decoder
+	// frame holds the payload read of the HEADERS or CONTINUATION frame being read.
+	frame []byte
+	// block holds the header block fragments read of the header block being read.
+	block []byte
+	// requests holds the bytes read of the first message of the calls to killMethod, until it is
+	// complete.
+	requests map[uint32][]byte
+
+	mu  sync.Mutex
+	out frameScanner
+	// kills holds the streams whose replies are counted, by ID.
+	kills map[uint32]*killStream
+	// doomed is set once a stream was sent its replies, for the connection to be killed at the end
+	// of the frame.
+	doomed bool
+	killed bool
+}
+
+func (c *killConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	p := b[:n]
+	if c.preface > 0 {
+		skip := c.preface
+		if skip > len(p) {
+			skip = len(p)
+		}
+		c.preface -= skip
+		p = p[skip:]
+	}
+	c.in.scan(p, nil)
+	return n, err
+}
+
+func (c *killConn) onRequestHeader(h http2.FrameHeader) {
+	if h.Type != http2.FrameHeaders && h.Type != http2.FrameContinuation {
+		return
+	}
+	c.frame = c.frame[:0]
+	if h.Length == 0 {
+		c.onHeaderFrame(h)
+	}
+}
+
+func (c *killConn) onRequestPayload(h http2.FrameHeader, b []byte) {
+	switch h.Type {
+	case http2.FrameHeaders, http2.FrameContinuation:
+		c.frame = append(c.frame, b...)
+		if uint32(len(c.frame)) == h.Length {
+			c.onHeaderFrame(h)
+		}
+	case http2.FrameData:
+		c.onRequestData(h, b)
+	}
+}
+
+// onHeaderFrame follows the header block fragment of a HEADERS or CONTINUATION frame read whole,
+// and starts reading the first message of the calls to killMethod.
+func (c *killConn) onHeaderFrame(h http2.FrameHeader) {
+	fragment := c.frame
+	if h.Type == http2.FrameHeaders {
+		c.block = c.block[:0]
+		if h.Flags.Has(http2.FlagHeadersPadded) && len(fragment) > 0 {
+			pad := int(fragment[0])
+			fragment = fragment[1:]
+			if pad > len(fragment) {
+				pad = len(fragment)
+			}
+			fragment = fragment[:len(fragment)-pad]
+		}
+		if h.Flags.Has(http2.FlagHeadersPriority) && len(fragment) >= 5 {
+			fragment = fragment[5:]
+		}
+	}
+	c.block = append(c.block, fragment...)
+	if !h.Flags.Has(http2.FlagHeadersEndHeaders) {
+		return
+	}
+	fields, err := c.headers.DecodeFull(c.block)
+	if err != nil {
+		return
+	}
+	for _, f := range fields {
+		if f.Name == ":path" && f.Value == killMethod {
+			c.requests[h.StreamID] = nil
+		}
+	}
+}
+
+// onRequestData follows the DATA the client sends, to read the name of the first message of the
+// calls to killMethod.
+func (c *killConn) onRequestData(h http2.FrameHeader, b []byte) {
+	buf, ok := c.requests[h.StreamID]
+	if !ok {
+		return
+	}
+	buf = append(buf, b...)
+	if len(buf) < grpcMessagePrefixLen {
+		c.requests[h.StreamID] = buf
+		return
+	}
+	length := binary.BigEndian.Uint32(buf[1:grpcMessagePrefixLen])
+	if buf[0] != 0 || length > maxKillRequestLen {
+		delete(c.requests, h.StreamID)
+		return
+	}
+	if uint32(len(buf)-grpcMessagePrefixLen) < length {
+		c.requests[h.StreamID] = buf
+		return
+	}
+	delete(c.requests, h.StreamID)
+	req := &pb.HelloRequest{}
+	if err := pb.UnmarshalUntrusted(buf[grpcMessagePrefixLen:grpcMessagePrefixLen+int(length)], req); err != nil {
+		return
+	}
+	if n, ok := KillAfter(req.Name); ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.kills[h.StreamID] = &killStream{after: n}
+	}
+}
+
+// onReplyHeader forgets the streams that end before being sent their replies.
+func (c *killConn) onReplyHeader(h http2.FrameHeader) {
+	if h.Type == http2.FrameRSTStream || (h.Type == http2.FrameHeaders && h.Flags.Has(http2.FlagHeadersEndStream)) {
+		delete(c.kills, h.StreamID)
+	}
+}
+
+// onReplyData counts the messages written on the streams in kills.
+func (c *killConn) onReplyData(h http2.FrameHeader, b []byte) {
+	if h.Type != http2.FrameData {
+		return
+	}
+	if k, ok := c.kills[h.StreamID]; ok && k.add(b) {
+		c.doomed = true
+	}
+}
+
+func (c *killConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.killed {
+		return 0, net.ErrClosed
+	}
+	n := c.out.scan(b, func() bool { return c.doomed })
+	m, err := c.Conn.Write(b[:n])
+	if err != nil || !c.doomed {
+		return m, err
+	}
+	c.killed = true
+	atomic.AddInt64(&c.lis.killed, 1)
+	_ = c.Conn.Close()
+	return m, net.ErrClosed
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+func TestKillAfter(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		ok   bool
+	}{
+		{name: "kill-after-3", n: 3, ok: true},
+		{name: "kill-after-1", n: 1, ok: true},
+		{name: "kill-after-0"},
+		{name: "kill-after--2"},
+		{name: "kill-after-x"},
+		{name: "kill-after-"},
+		{name: "world"},
+	}
+	for _, tc := range tests {
+		n, ok := greetworkload.KillAfter(tc.name)
+		assert.Equal(t, tc.ok, ok, tc.name)
+		assert.Equal(t, tc.n, n, tc.name)
+	}
+}
+
+func startKillServer(t *testing.T) (*greetworkload.KillListener, string) {
+	var kills *greetworkload.KillListener
+	s := startServerWith(t, &serverSetup{
+		// Replies span several DATA frames each.
+		Options: &greetworkload.ServerOptions{StreamReplyBytes: 40 * 1024},
+		Wrap: func(lis net.Listener) net.Listener {
+			kills = greetworkload.NewKillListener(lis)
+			return kills
+		},
+	})
+	return kills, s.Addr
+}
+
+func dialKillServer(t *testing.T, addr string) *grpc.ClientConn {
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestKillListener_KillsAfterReplies(t *testing.T) {
+	kills, addr := startKillServer(t)
+	killed := dialKillServer(t, addr)
+	other := dialKillServer(t, addr)
+
+	// A stream over the other connection, in flight when the connection is killed.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := pb.NewStreamingGreeterClient(other).SayHelloServerStreaming(ctx, &pb.HelloRequest{Name: "world", Count: 5})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{StreamCount: 10, Timeout: 10 * time.Second})
+	r := c.ServerStreaming(killed, "kill-after-3")
+	assert.Equal(t, 3, r.Replies)
+	assert.Equal(t, codes.Unavailable.String(), r.Code, r.Error)
+	assert.True(t, r.Expected())
+	assert.NoError(t, r.Err())
+	assert.Equal(t, int64(1), kills.Killed())
+
+	// The other connection is unaffected.
+	replies := 1
+	for {
+		_, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		replies++
+	}
+	assert.Equal(t, 5, replies)
+	assert.Equal(t, connectivity.Ready, other.GetState())
+	r = c.ServerStreaming(other, "world")
+	assert.NoError(t, r.Err())
+	assert.Equal(t, 10, r.Replies)
+	assert.Equal(t, int64(1), kills.Killed())
+}
+
+func TestKillListener_LeavesOtherNamesAlone(t *testing.T) {
+	kills, addr := startKillServer(t)
+	conn := dialKillServer(t, addr)
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{StreamCount: 4, Timeout: 10 * time.Second})
+	for _, name := range []string{"world", "kill-after-x", "kill-after-5"} {
+		r := c.ServerStreaming(conn, name)
+		assert.NoError(t, r.Err(), name)
+		assert.Equal(t, 4, r.Replies, name)
+	}
+	r := c.SayHello(conn, "kill-after-1")
+	assert.NoError(t, r.Err())
+	assert.Equal(t, int64(0), kills.Killed())
+}
@@ -0,0 +1,318 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The distributions of injected latency, as ParseLatencyDistribution reads them.
+const (
+	// LatencyFixed is a single latency, e.g. "fixed(5ms)".
+	LatencyFixed = "fixed"
+	// LatencyLognormal is a log-normal latency of median mu, the log of which has a standard
+	// deviation of sigma, e.g. "lognormal(mu=2ms,sigma=0.5)".
+	LatencyLognormal = "lognormal"
+	// LatencyPareto is a Pareto latency of scale, and minimum, xm and of shape alpha, e.g.
+	// "pareto(xm=1ms,alpha=1.5)". The smaller alpha, the heavier the tail: its variance is
+	// infinite for alpha of 2 or less, and its mean too for alpha of 1 or less.
+	LatencyPareto = "pareto"
+	// LatencyBimodal is one of two latencies, each drawn with the given probability, e.g.
+	// "bimodal(1ms@90%,50ms@10%)".
+	LatencyBimodal = "bimodal"
+)
+
+// LatencyDistribution is a distribution latencies are drawn from.
+type LatencyDistribution interface {
+	// Sample draws a latency from rng.
+	Sample(rng *rand.Rand) time.Duration
+	// CDF returns the probability that a latency drawn is at most d.
+	CDF(d time.Duration) float64
+	// String returns the distribution as ParseLatencyDistribution reads it.
+	String() string
+}
+
+// ParseLatencyDistribution reads a distribution of latencies, one of:
+//
+//	fixed(D)                   always D.
+//	lognormal(mu=D,sigma=S)    log-normal, of median D, the log of which has a standard deviation of S.
+//	pareto(xm=D,alpha=A)       Pareto, of minimum D and shape A.
+//	bimodal(D1@P1%,D2@P2%)     D1 with probability P1%, and D2 with probability P2%.
+//
+// Durations are time.ParseDuration strings, and the other parameters positive numbers. The
+// probabilities of bimodal must add up to 100%, and the parameters of lognormal and pareto can be
+// given in any order.
+func ParseLatencyDistribution(spec string) (LatencyDistribution, error) {
+	spec = strings.TrimSpace(spec)
+	kind, rest, ok := cut(spec, "(")
+	if !ok || !strings.HasSuffix(rest, ")") {
+		return nil, fmt.Errorf("latency distribution %q must be KIND(PARAMS), e.g. lognormal(mu=2ms,sigma=0.5)", spec)
+	}
+	var params []string
+	for _, p := range strings.Split(strings.TrimSuffix(rest, ")"), ",") {
+		params = append(params, strings.TrimSpace(p))
+	}
+	var d LatencyDistribution
+	var err error
+	switch kind {
+	case LatencyFixed:
+		d, err = parseFixedLatency(params)
+	case LatencyLognormal:
+		d, err = parseLognormalLatency(params)
+	case LatencyPareto:
+		d, err = parseParetoLatency(params)
+	case LatencyBimodal:
+		d, err = parseBimodalLatency(params)
+	default:
+		return nil, fmt.Errorf("unknown latency distribution %q, expected %s, %s, %s or %s",
+			kind, LatencyFixed, LatencyLognormal, LatencyPareto, LatencyBimodal)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", spec, err)
+	}
+	return d, nil
+}
+
+// parseLatencyParams reads the key=value params of a distribution, which must be exactly keys.
+func parseLatencyParams(params []string, keys ...string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, p := range params {
+		k, v, ok := cut(p, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected KEY=VALUE, got %q", p)
+		}
+		if _, dup := values[k]; dup {
+			return nil, fmt.Errorf("%s is set twice", k)
+		}
+		values[k] = v
+	}
+	for _, k := range keys {
+		if _, ok := values[k]; !ok {
+			return nil, fmt.Errorf("%s must be set", k)
+		}
+	}
+	if len(values) != len(keys) {
+		return nil, fmt.Errorf("expected exactly %s", strings.Join(keys, " and "))
+	}
+	return values, nil
+}
+
+func parseLatency(name, s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s must not be negative, got %v", name, d)
+	}
+	return d, nil
+}
+
+func parsePositive(name, s string) (float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || !(v > 0) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("%s must be a positive number, got %q", name, s)
+	}
+	return v, nil
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// fixedLatency is always d.
+type fixedLatency struct {
+	d time.Duration
+}
+
+func parseFixedLatency(params []string) (LatencyDistribution, error) {
+	if len(params) != 1 {
+		return nil, fmt.Errorf("expected a single duration")
+	}
+	d, err := parseLatency("latency", params[0])
+	if err != nil {
+		return nil, err
+	}
+	return fixedLatency{d: d}, nil
+}
+
+func (l fixedLatency) Sample(*rand.Rand) time.Duration {
+	return l.d
+}
+
+func (l fixedLatency) CDF(d time.Duration) float64 {
+	if d < l.d {
+		return 0
+	}
+	return 1
+}
+
+func (l fixedLatency) String() string {
+	return fmt.Sprintf("%s(%v)", LatencyFixed, l.d)
+}
+
+// lognormalLatency is exp(N(ln(mu), sigma²)).
+type lognormalLatency struct {
+	mu    time.Duration
+	sigma float64
+}
+
+func parseLognormalLatency(params []string) (LatencyDistribution, error) {
+	values, err := parseLatencyParams(params, "mu", "sigma")
+	if err != nil {
+		return nil, err
+	}
+	l := lognormalLatency{}
+	if l.mu, err = parseLatency("mu", values["mu"]); err != nil {
+		return nil, err
+	}
+	if l.mu == 0 {
+		return nil, fmt.Errorf("mu must be positive")
+	}
+	if l.sigma, err = parsePositive("sigma", values["sigma"]); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l lognormalLatency) Sample(rng *rand.Rand) time.Duration {
+	return durationOf(float64(l.mu) * math.Exp(l.sigma*rng.NormFloat64()))
+}
+
+func (l lognormalLatency) CDF(d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return 0.5 * math.Erfc(-math.Log(float64(d)/float64(l.mu))/(l.sigma*math.Sqrt2))
+}
+
+func (l lognormalLatency) String() string {
+	return fmt.Sprintf("%s(mu=%v,sigma=%s)", LatencyLognormal, l.mu, formatFloat(l.sigma))
+}
+
+// paretoLatency is xm / U^(1/alpha), U uniform in (0, 1].
+type paretoLatency struct {
+	xm    time.Duration
+	alpha float64
+}
+
+func parseParetoLatency(params []string) (LatencyDistribution, error) {
+	values, err := parseLatencyParams(params, "xm", "alpha")
+	if err != nil {
+		return nil, err
+	}
+	l := paretoLatency{}
+	if l.xm, err = parseLatency("xm", values["xm"]); err != nil {
+		return nil, err
+	}
+	if l.xm == 0 {
+		return nil, fmt.Errorf("xm must be positive")
+	}
+	if l.alpha, err = parsePositive("alpha", values["alpha"]); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l paretoLatency) Sample(rng *rand.Rand) time.Duration {
+	return durationOf(float64(l.xm) / math.Pow(1-rng.Float64(), 1/l.alpha))
+}
+
+func (l paretoLatency) CDF(d time.Duration) float64 {
+	if d < l.xm {
+		return 0
+	}
+	return 1 - math.Pow(float64(l.xm)/float64(d), l.alpha)
+}
+
+func (l paretoLatency) String() string {
+	return fmt.Sprintf("%s(xm=%v,alpha=%s)", LatencyPareto, l.xm, formatFloat(l.alpha))
+}
+
+// bimodalLatency is low with probability p, and high otherwise.
+type bimodalLatency struct {
+	low, high time.Duration
+	// lowPercent and highPercent add up to 100.
+	lowPercent, highPercent float64
+}
+
+func parseBimodalLatency(params []string) (LatencyDistribution, error) {
+	if len(params) != 2 {
+		return nil, fmt.Errorf("expected two modes, e.g. 1ms@90%%,50ms@10%%")
+	}
+	var ds [2]time.Duration
+	var ps [2]float64
+	for i, p := range params {
+		d, percent, ok := cut(p, "@")
+		if !ok || !strings.HasSuffix(percent, "%") {
+			return nil, fmt.Errorf("mode %q must be DURATION@PERCENT%%", p)
+		}
+		percent = strings.TrimSuffix(percent, "%")
+		var err error
+		if ds[i], err = parseLatency("latency", d); err != nil {
+			return nil, err
+		}
+		if ps[i], err = parsePositive("probability", percent); err != nil {
+			return nil, err
+		}
+	}
+	if math.Abs(ps[0]+ps[1]-100) > 1e-9 {
+		return nil, fmt.Errorf("probabilities must add up to 100%%, got %s%%", formatFloat(ps[0]+ps[1]))
+	}
+	l := bimodalLatency{low: ds[0], high: ds[1], lowPercent: ps[0], highPercent: ps[1]}
+	if l.low > l.high {
+		// The modes keep their order in String, only CDF needs them sorted.
+		l = bimodalLatency{low: ds[1], high: ds[0], lowPercent: ps[1], highPercent: ps[0]}
+	}
+	return l, nil
+}
+
+func (l bimodalLatency) Sample(rng *rand.Rand) time.Duration {
+	if rng.Float64()*100 < l.lowPercent {
+		return l.low
+	}
+	return l.high
+}
+
+func (l bimodalLatency) CDF(d time.Duration) float64 {
+	switch {
+	case d < l.low:
+		return 0
+	case d < l.high:
+		return l.lowPercent / 100
+	}
+	return 1
+}
+
+func (l bimodalLatency) String() string {
+	return fmt.Sprintf("%s(%v@%s%%,%v@%s%%)", LatencyBimodal, l.low, formatFloat(l.lowPercent), l.high, formatFloat(l.highPercent))
+}
+
+// durationOf converts ns to a Duration, saturating rather than overflowing for the draws of heavy
+// tails.
+func durationOf(ns float64) time.Duration {
+	if ns >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(ns)
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// ksStatistic returns the Kolmogorov-Smirnov distance between the empirical distribution of
+// samples and dist. The CDF of dist is compared on both sides of every sample, so that the jumps
+// of discrete distributions are measured right.
+func ksStatistic(samples []time.Duration, dist greetworkload.LatencyDistribution) float64 {
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	n := float64(len(samples))
+	var d float64
+	for i, x := range samples {
+		// Ties are measured once, from the first and the last of them.
+		if i+1 < len(samples) && samples[i+1] == x {
+			continue
+		}
+		d = math.Max(d, math.Abs(float64(i+1)/n-dist.CDF(x)))
+		first := sort.Search(len(samples), func(j int) bool { return samples[j] >= x })
+		d = math.Max(d, math.Abs(dist.CDF(x-1)-float64(first)/n))
+	}
+	return d
+}
+
+func sampleLatencies(dist greetworkload.LatencyDistribution, seed int64, n int) []time.Duration {
+	rng := rand.New(rand.NewSource(seed))
+	samples := make([]time.Duration, n)
+	for i := range samples {
+		samples[i] = dist.Sample(rng)
+	}
+	return samples
+}
+
+func TestLatencyDistribution_MatchesCDF(t *testing.T) {
+	const n = 20000
+	// The critical value of the KS test at a significance of 5%.
+	critical := 1.36 / math.Sqrt(n)
+	for _, spec := range []string{
+		"fixed(5ms)",
+		"lognormal(mu=2ms,sigma=0.5)",
+		"lognormal(mu=10ms,sigma=2)",
+		"pareto(xm=1ms,alpha=1.5)",
+		"pareto(xm=100us,alpha=0.8)",
+		"bimodal(1ms@90%,50ms@10%)",
+		"bimodal(20ms@25%,2ms@75%)",
+	} {
+		t.Run(spec, func(t *testing.T) {
+			dist, err := greetworkload.ParseLatencyDistribution(spec)
+			require.NoError(t, err)
+			d := ksStatistic(sampleLatencies(dist, 1, n), dist)
+			assert.Less(t, d, critical)
+		})
+	}
+}
+
+func TestLatencyDistribution_KSTellsDistributionsApart(t *testing.T) {
+	// Guards the KS test above against passing whatever the samples.
+	const n = 20000
+	critical := 1.36 / math.Sqrt(n)
+	for _, tc := range []struct{ sampled, compared string }{
+		{"lognormal(mu=2ms,sigma=0.5)", "lognormal(mu=2ms,sigma=0.6)"},
+		{"lognormal(mu=2ms,sigma=0.5)", "lognormal(mu=2.1ms,sigma=0.5)"},
+		{"pareto(xm=1ms,alpha=1.5)", "pareto(xm=1ms,alpha=1.7)"},
+		{"bimodal(1ms@90%,50ms@10%)", "bimodal(1ms@88%,50ms@12%)"},
+	} {
+		t.Run(tc.sampled+" vs "+tc.compared, func(t *testing.T) {
+			sampled, err := greetworkload.ParseLatencyDistribution(tc.sampled)
+			require.NoError(t, err)
+			compared, err := greetworkload.ParseLatencyDistribution(tc.compared)
+			require.NoError(t, err)
+			assert.Greater(t, ksStatistic(sampleLatencies(sampled, 1, n), compared), critical)
+		})
+	}
+}
+
+func TestLatencyDistribution_Deterministic(t *testing.T) {
+	dist, err := greetworkload.ParseLatencyDistribution("pareto(xm=1ms,alpha=1.5)")
+	require.NoError(t, err)
+	assert.Equal(t, sampleLatencies(dist, 7, 100), sampleLatencies(dist, 7, 100))
+	assert.NotEqual(t, sampleLatencies(dist, 7, 100), sampleLatencies(dist, 8, 100))
+}
+
+func TestParseLatencyDistribution(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		// want is the String of the distribution, empty if spec is invalid.
+		want string
+	}{
+		{"fixed(5ms)", "fixed(5ms)"},
+		{" fixed(0s) ", "fixed(0s)"},
+		{"lognormal(mu=2ms,sigma=0.5)", "lognormal(mu=2ms,sigma=0.5)"},
+		{"lognormal(sigma=0.5, mu=2000us)", "lognormal(mu=2ms,sigma=0.5)"},
+		{"pareto(xm=1ms,alpha=1.5)", "pareto(xm=1ms,alpha=1.5)"},
+		{"pareto(alpha=3,xm=250us)", "pareto(xm=250µs,alpha=3)"},
+		{"bimodal(1ms@90%,50ms@10%)", "bimodal(1ms@90%,50ms@10%)"},
+		{"bimodal(50ms@10%, 1ms@90%)", "bimodal(1ms@90%,50ms@10%)"},
+		{"bimodal(1ms@99.5%,1s@0.5%)", "bimodal(1ms@99.5%,1s@0.5%)"},
+
+		{"", ""},
+		{"5ms", ""},
+		{"fixed(5ms", ""},
+		{"normal(mu=2ms,sigma=0.5)", ""},
+		{"fixed(-5ms)", ""},
+		{"fixed(5ms,6ms)", ""},
+		{"fixed(5)", ""},
+		{"lognormal(mu=2ms)", ""},
+		{"lognormal(mu=2ms,sigma=0.5,xm=1ms)", ""},
+		{"lognormal(mu=2ms,mu=3ms)", ""},
+		{"lognormal(mu=0s,sigma=0.5)", ""},
+		{"lognormal(mu=2ms,sigma=0)", ""},
+		{"lognormal(mu=2ms,sigma=-1)", ""},
+		{"lognormal(mu=2ms,sigma=NaN)", ""},
+		{"lognormal(mu=2ms,sigma=Inf)", ""},
+		{"lognormal(2ms,0.5)", ""},
+		{"pareto(xm=0s,alpha=1.5)", ""},
+		{"pareto(xm=1ms,alpha=0)", ""},
+		{"pareto(xm=1ms,sigma=1.5)", ""},
+		{"bimodal(1ms@90%)", ""},
+		{"bimodal(1ms@90%,50ms@20%)", ""},
+		{"bimodal(1ms@90,50ms@10)", ""},
+		{"bimodal(1ms@100%,50ms@0%)", ""},
+		{"bimodal(1ms@40%,5ms@30%,50ms@30%)", ""},
+	} {
+		t.Run(tc.spec, func(t *testing.T) {
+			dist, err := greetworkload.ParseLatencyDistribution(tc.spec)
+			if tc.want == "" {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, dist.String())
+			// String is read back as the same distribution.
+			again, err := greetworkload.ParseLatencyDistribution(dist.String())
+			require.NoError(t, err)
+			assert.Equal(t, dist, again)
+		})
+	}
+}
+
+func TestFaultConfig_ValidatesLatency(t *testing.T) {
+	cfg := &greetworkload.FaultConfig{Latency: "pareto(xm=1ms,alpha=0)"}
+	assert.Error(t, cfg.Validate())
+	_, err := greetworkload.NewFaultInjector(cfg, 1)
+	assert.Error(t, err)
+
+	cfg.Latency = "pareto(xm=1ms,alpha=2)"
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestFaultInjector_Latency(t *testing.T) {
+	faults, err := greetworkload.NewFaultInjector(&greetworkload.FaultConfig{
+		LatencyMillis: 10,
+		Latency:       "bimodal(20ms@50%,200ms@50%)",
+	}, 1)
+	require.NoError(t, err)
+	addr := startFaultyServer(t, faults)
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := pb.NewGreeterClient(conn)
+
+	// Every call is delayed by 10ms, plus either 20ms or 200ms. Both modes are drawn in 10 calls
+	// but for a chance of 2^-9, ruled out by the seed.
+	const calls = 10
+	var slow int
+	for i := 0; i < calls; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		start := time.Now()
+		_, err := client.SayHello(ctx, &pb.HelloRequest{Name: "pixie"})
+		elapsed := time.Since(start)
+		cancel()
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, elapsed, 30*time.Millisecond)
+		if elapsed >= 210*time.Millisecond {
+			slow++
+		}
+	}
+	assert.Greater(t, slow, 0)
+	assert.Less(t, slow, calls)
+}
@@ -0,0 +1,347 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// The kinds of the phases of a LoadProfile.
+const (
+	// PhaseRamp changes the rate linearly over the phase, e.g. "ramp:0-500qps/60s".
+	PhaseRamp = "ramp"
+	// PhaseHold keeps a rate, e.g. "hold:500qps/120s".
+	PhaseHold = "hold"
+	// PhaseStep jumps to a rate, and keeps it, e.g. "step:1000qps/60s".
+	PhaseStep = "step"
+)
+
+// LoadPhase is a phase of a LoadProfile, over which the target rate of calls goes linearly from
+// StartQPS to EndQPS. Holds and steps have the same StartQPS and EndQPS.
+type LoadPhase struct {
+	Kind     string
+	StartQPS float64
+	EndQPS   float64
+	Duration time.Duration
+}
+
+// String returns the phase as ParseLoadProfile reads it.
+func (p LoadPhase) String() string {
+	qps := strconv.FormatFloat(p.StartQPS, 'f', -1, 64)
+	if p.Kind == PhaseRamp {
+		qps += "-" + strconv.FormatFloat(p.EndQPS, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%s:%sqps/%v", p.Kind, qps, p.Duration)
+}
+
+// calls returns the number of calls the phase makes.
+func (p LoadPhase) calls() float64 {
+	return (p.StartQPS + p.EndQPS) / 2 * p.Duration.Seconds()
+}
+
+// callsBy returns the number of calls the phase makes in its first elapsed seconds.
+func (p LoadPhase) callsBy(elapsed float64) float64 {
+	slope := (p.EndQPS - p.StartQPS) / p.Duration.Seconds()
+	return p.StartQPS*elapsed + slope*elapsed*elapsed/2
+}
+
+// elapsedAt returns the seconds into the phase by which it has made n calls, n being at most
+// calls().
+func (p LoadPhase) elapsedAt(n float64) float64 {
+	if n <= 0 {
+		return 0
+	}
+	// Solves callsBy(elapsed) = n, in a form that does not cancel out when the slope is small.
+	slope := (p.EndQPS - p.StartQPS) / p.Duration.Seconds()
+	disc := p.StartQPS*p.StartQPS + 2*slope*n
+	if disc < 0 {
+		disc = 0
+	}
+	return 2 * n / (p.StartQPS + math.Sqrt(disc))
+}
+
+// LoadProfile is a target rate of calls that changes over time, in phases run one after the other.
+type LoadProfile struct {
+	Phases []LoadPhase
+}
+
+// ParseLoadProfile reads a profile of comma-separated phases, each one of:
+//
+//	ramp:A-Bqps/D  goes linearly from A to B calls per second over D.
+//	hold:Aqps/D    keeps A calls per second for D.
+//	step:Aqps/D    jumps to A calls per second, and keeps it for D.
+//
+// Rates are non-negative numbers, and durations are time.ParseDuration strings, e.g.
+// "ramp:0-500qps/60s,hold:500qps/2m,step:1000qps/60s".
+func ParseLoadProfile(spec string) (*LoadProfile, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, fmt.Errorf("load profile must have at least one phase")
+	}
+	profile := &LoadProfile{}
+	var start time.Duration
+	for i, text := range strings.Split(spec, ",") {
+		p, err := parseLoadPhase(strings.TrimSpace(text))
+		if err != nil {
+			return nil, fmt.Errorf("phase %d %q: %w", i+1, text, err)
+		}
+		// Every phase must end after it starts, so that phases follow each other in time.
+		if p.Duration <= 0 {
+			return nil, fmt.Errorf("phase %d %q: must end after it starts at %v, got a duration of %v", i+1, text, start, p.Duration)
+		}
+		start += p.Duration
+		profile.Phases = append(profile.Phases, p)
+	}
+	return profile, nil
+}
+
+func parseLoadPhase(text string) (LoadPhase, error) {
+	kind, rest, ok := cut(text, ":")
+	if !ok {
+		return LoadPhase{}, fmt.Errorf("expected KIND:RATE/DURATION, e.g. hold:500qps/60s")
+	}
+	rates, duration, ok := cut(rest, "/")
+	if !ok {
+		return LoadPhase{}, fmt.Errorf("expected a duration after the rate, e.g. %s/60s", rest)
+	}
+	if !strings.HasSuffix(rates, "qps") {
+		return LoadPhase{}, fmt.Errorf("rate %q must end with qps", rates)
+	}
+	rates = strings.TrimSuffix(rates, "qps")
+	p := LoadPhase{Kind: kind}
+	var err error
+	switch kind {
+	case PhaseRamp:
+		from, to, ok := cut(rates, "-")
+		if !ok {
+			return LoadPhase{}, fmt.Errorf("ramp rate %q must be FROM-TO, e.g. 0-500qps", rates+"qps")
+		}
+		if p.StartQPS, err = parseQPS(from); err != nil {
+			return LoadPhase{}, err
+		}
+		if p.EndQPS, err = parseQPS(to); err != nil {
+			return LoadPhase{}, err
+		}
+	case PhaseHold, PhaseStep:
+		if p.StartQPS, err = parseQPS(rates); err != nil {
+			return LoadPhase{}, err
+		}
+		p.EndQPS = p.StartQPS
+	default:
+		return LoadPhase{}, fmt.Errorf("unknown phase kind %q, expected %s, %s or %s", kind, PhaseRamp, PhaseHold, PhaseStep)
+	}
+	if p.Duration, err = time.ParseDuration(duration); err != nil {
+		return LoadPhase{}, err
+	}
+	return p, nil
+}
+
+func parseQPS(s string) (float64, error) {
+	qps, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	if qps < 0 || math.IsInf(qps, 0) || math.IsNaN(qps) {
+		return 0, fmt.Errorf("rate must be a non-negative number, got %q", s)
+	}
+	return qps, nil
+}
+
+// String returns the profile as ParseLoadProfile reads it.
+func (p *LoadProfile) String() string {
+	phases := make([]string, len(p.Phases))
+	for i, phase := range p.Phases {
+		phases[i] = phase.String()
+	}
+	return strings.Join(phases, ",")
+}
+
+// Duration returns how long the profile lasts.
+func (p *LoadProfile) Duration() time.Duration {
+	var d time.Duration
+	for _, phase := range p.Phases {
+		d += phase.Duration
+	}
+	return d
+}
+
+// PhaseAt returns the index of the phase in progress at offset into the profile, or -1 once the
+// profile is over.
+func (p *LoadProfile) PhaseAt(offset time.Duration) int {
+	var start time.Duration
+	for i, phase := range p.Phases {
+		if offset < start+phase.Duration {
+			return i
+		}
+		start += phase.Duration
+	}
+	return -1
+}
+
+// callsBy returns the number of calls the profile makes in its first offset.
+func (p *LoadProfile) callsBy(offset time.Duration) float64 {
+	var n float64
+	var start time.Duration
+	for _, phase := range p.Phases {
+		if offset < start+phase.Duration {
+			return n + phase.callsBy((offset - start).Seconds())
+		}
+		n += phase.calls()
+		start += phase.Duration
+	}
+	return n
+}
+
+// CallOffsets returns the offsets into the profile at which calls start, in order. The i-th call
+// starts once the profile is due i+0.5 calls, so that the calls due over any second start within
+// it.
+func (p *LoadProfile) CallOffsets() []time.Duration {
+	var offsets []time.Duration
+	var start time.Duration
+	var before float64
+	next := 0.5
+	for _, phase := range p.Phases {
+		total := phase.calls()
+		for next <= before+total {
+			elapsed := phase.elapsedAt(next - before)
+			offset := start + time.Duration(elapsed*float64(time.Second))
+			if end := start + phase.Duration; offset >= end {
+				// Rounding put the call past the end of the phase.
+				offset = end - 1
+			}
+			offsets = append(offsets, offset)
+			next++
+		}
+		before += total
+		start += phase.Duration
+	}
+	return offsets
+}
+
+// QPSSample is the target and achieved rate of calls over a second of a LoadProfile run.
+type QPSSample struct {
+	// Second is the offset of the second into the run, from 0.
+	Second int `json:"second"`
+	// Phase is the index of the phase in progress at the start of the second.
+	Phase int `json:"phase"`
+	// TargetQPS is the number of calls the profile is due over the second.
+	TargetQPS float64 `json:"target_qps"`
+	// AchievedQPS is the number of calls that started over the second, and CompletedQPS how many
+	// of them completed.
+	AchievedQPS  int64 `json:"achieved_qps"`
+	CompletedQPS int64 `json:"completed_qps"`
+}
+
+// WriteQPSSamples writes samples to w as a JSON array.
+func WriteQPSSamples(w io.Writer, samples []QPSSample) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(samples)
+}
+
+// RunProfile calls Greeter.SayHello over conn with name at the rate set by profile, starting each
+// call at its offset from CallOffsets whether or not the calls before it finished. RunProfile
+// returns once every call has finished, with their records sorted by start time, and a sample of
+// the target and achieved rates for every second of the profile.
+//
+// If ctx is done, no new call starts, and the calls in flight are cancelled. RunProfile then
+// returns ctx.Err() along with the calls made so far. Cancelled calls are recorded too.
+func (c *Client) RunProfile(ctx context.Context, conn *grpc.ClientConn, name string, profile *LoadProfile) ([]*CallRecord, []QPSSample, error) {
+	ctx = c.opts.Audit.root(ctx)
+	var (
+		mu      sync.Mutex
+		records []*CallRecord
+		wg      sync.WaitGroup
+		err     error
+	)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	start := time.Now()
+loop:
+	for _, offset := range profile.CallOffsets() {
+		if wait := time.Until(start.Add(offset)); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-ctx.Done():
+				if !timer.Stop() {
+					<-timer.C
+				}
+				err = ctx.Err()
+				break loop
+			case <-timer.C:
+			}
+		} else if ctx.Err() != nil {
+			err = ctx.Err()
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := c.Do(ctx, conn, &CallOverrides{Name: name})
+			mu.Lock()
+			defer mu.Unlock()
+			records = append(records, r)
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(records, func(i, j int) bool { return records[i].StartTime.Before(records[j].StartTime) })
+	return records, profileSamples(profile, start, records), err
+}
+
+// profileSamples tallies the calls of a run of profile started at start by the second they
+// started in.
+func profileSamples(profile *LoadProfile, start time.Time, records []*CallRecord) []QPSSample {
+	seconds := int(math.Ceil(profile.Duration().Seconds()))
+	samples := make([]QPSSample, seconds)
+	for i := range samples {
+		from, to := time.Duration(i)*time.Second, time.Duration(i+1)*time.Second
+		samples[i] = QPSSample{
+			Second:    i,
+			Phase:     profile.PhaseAt(from),
+			TargetQPS: profile.callsBy(to) - profile.callsBy(from),
+		}
+	}
+	for _, r := range records {
+		i := int(r.StartTime.Sub(start) / time.Second)
+		// Calls that started late, as the client fell behind, count towards the last second.
+		if i >= seconds {
+			i = seconds - 1
+		}
+		if i < 0 {
+			i = 0
+		}
+		samples[i].AchievedQPS++
+		if r.Completed() {
+			samples[i].CompletedQPS++
+		}
+	}
+	return samples
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+func TestParseLoadProfile(t *testing.T) {
+	p, err := greetworkload.ParseLoadProfile("ramp:0-500qps/60s, hold:500qps/2m,step:1000.5qps/500ms")
+	require.NoError(t, err)
+	assert.Equal(t, []greetworkload.LoadPhase{
+		{Kind: greetworkload.PhaseRamp, StartQPS: 0, EndQPS: 500, Duration: time.Minute},
+		{Kind: greetworkload.PhaseHold, StartQPS: 500, EndQPS: 500, Duration: 2 * time.Minute},
+		{Kind: greetworkload.PhaseStep, StartQPS: 1000.5, EndQPS: 1000.5, Duration: 500 * time.Millisecond},
+	}, p.Phases)
+	assert.Equal(t, 3*time.Minute+500*time.Millisecond, p.Duration())
+	assert.Equal(t, "ramp:0-500qps/1m0s,hold:500qps/2m0s,step:1000.5qps/500ms", p.String())
+
+	again, err := greetworkload.ParseLoadProfile(p.String())
+	require.NoError(t, err)
+	assert.Equal(t, p, again)
+}
+
+func TestParseLoadProfile_Errors(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr string
+	}{
+		{"", "at least one phase"},
+		{"hold", `phase 1 "hold": expected KIND:RATE/DURATION`},
+		{"hold:500qps", "expected a duration after the rate"},
+		{"hold:500/60s", `rate "500" must end with qps`},
+		{"hold:fastqps/60s", `invalid rate "fast"`},
+		{"hold:-5qps/60s", "rate must be a non-negative number"},
+		{"hold:NaNqps/60s", "rate must be a non-negative number"},
+		{"ramp:500qps/60s", "ramp rate \"500qps\" must be FROM-TO"},
+		{"ramp:0-xqps/60s", `invalid rate "x"`},
+		{"jump:500qps/60s", `unknown phase kind "jump"`},
+		{"hold:500qps/a minute", "time: invalid duration"},
+		{"hold:500qps/60s,,step:1000qps/60s", `phase 2 "": expected KIND:RATE/DURATION`},
+		// Phases that do not move time forward.
+		{"hold:500qps/60s,step:1000qps/0s", `phase 2 "step:1000qps/0s": must end after it starts at 1m0s, got a duration of 0s`},
+		{"ramp:0-500qps/-60s", "must end after it starts at 0s, got a duration of -1m0s"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.spec, func(t *testing.T) {
+			_, err := greetworkload.ParseLoadProfile(tc.spec)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+func mustParseLoadProfile(t *testing.T, spec string) *greetworkload.LoadProfile {
+	p, err := greetworkload.ParseLoadProfile(spec)
+	require.NoError(t, err)
+	return p
+}
+
+// countBySecond counts the offsets that fall in each second.
+func countBySecond(offsets []time.Duration, seconds int) []int {
+	counts := make([]int, seconds)
+	for _, o := range offsets {
+		counts[int(o/time.Second)]++
+	}
+	return counts
+}
+
+func TestLoadProfile_CallOffsets(t *testing.T) {
+	hold := mustParseLoadProfile(t, "hold:100qps/1s").CallOffsets()
+	require.Len(t, hold, 100)
+	for i, o := range hold {
+		assert.Equal(t, time.Duration(i)*10*time.Millisecond+5*time.Millisecond, o)
+	}
+
+	// A ramp from 0 makes a quarter of its calls over the first half of it.
+	ramp := mustParseLoadProfile(t, "ramp:0-100qps/2s").CallOffsets()
+	assert.Equal(t, []int{25, 75}, countBySecond(ramp, 2))
+	// The rate is 50t, so half a call is due once 25t² = 0.5.
+	assert.InDelta(t, math.Sqrt(0.02), ramp[0].Seconds(), 1e-9)
+
+	// Steps change the rate at their boundary.
+	steps := mustParseLoadProfile(t, "hold:10qps/1s,step:100qps/1s,step:0qps/1s,step:20qps/1s")
+	offsets := steps.CallOffsets()
+	assert.Equal(t, []int{10, 100, 0, 20}, countBySecond(offsets, 4))
+	assert.Equal(t, 950*time.Millisecond, offsets[9])
+	assert.Equal(t, time.Second+5*time.Millisecond, offsets[10])
+
+	for _, spec := range []string{"ramp:0-500qps/3s,hold:500qps/2s,step:1000qps/1s", "ramp:300-7qps/1500ms,hold:0.5qps/3s"} {
+		offsets := mustParseLoadProfile(t, spec).CallOffsets()
+		for i := 1; i < len(offsets); i++ {
+			require.Less(t, offsets[i-1], offsets[i], "%s: call %d", spec, i)
+		}
+	}
+}
+
+func TestLoadProfile_PhaseAt(t *testing.T) {
+	p := mustParseLoadProfile(t, "ramp:0-10qps/1s,hold:10qps/2s")
+	assert.Equal(t, 0, p.PhaseAt(0))
+	assert.Equal(t, 0, p.PhaseAt(999*time.Millisecond))
+	assert.Equal(t, 1, p.PhaseAt(time.Second))
+	assert.Equal(t, -1, p.PhaseAt(3*time.Second))
+}
+
+// TestClient_RunProfile runs a profile on loopback, and checks that the phases change at their
+// boundaries and that the achieved rate tracks the target.
+func TestClient_RunProfile(t *testing.T) {
+	_, addr := startServer(t, nil)
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	profile := mustParseLoadProfile(t, "ramp:0-200qps/1s,hold:200qps/1s,step:400qps/1s")
+	records, samples, err := c.RunProfile(context.Background(), conn, "pixie", profile)
+	require.NoError(t, err)
+	assert.Len(t, records, len(profile.CallOffsets()))
+	for _, r := range records {
+		require.True(t, r.Completed(), r.Error)
+	}
+
+	require.Len(t, samples, 3)
+	for i, want := range []struct {
+		phase  int
+		target float64
+	}{{0, 100}, {1, 200}, {2, 400}} {
+		s := samples[i]
+		assert.Equal(t, i, s.Second)
+		assert.Equal(t, want.phase, s.Phase, "second %d", i)
+		assert.InDelta(t, want.target, s.TargetQPS, 1e-6, "second %d", i)
+		assert.InDelta(t, want.target, float64(s.AchievedQPS), want.target*0.1, "second %d", i)
+		assert.Equal(t, s.AchievedQPS, s.CompletedQPS, "second %d", i)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, greetworkload.WriteQPSSamples(&buf, samples))
+	var decoded []greetworkload.QPSSample
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, samples, decoded)
+}
+
+func TestClient_RunProfileCancelled(t *testing.T) {
+	_, addr := startServer(t, nil)
+	c, _ := newAuditedClient(t, &greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	records, samples, err := c.RunProfile(ctx, conn, "pixie", mustParseLoadProfile(t, "hold:50qps/10s"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.InDelta(t, 10, len(records), 3)
+	assert.Len(t, samples, 10)
+	assert.Zero(t, samples[1].AchievedQPS)
+}
@@ -0,0 +1,267 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// MatrixMethods are the methods a matrix calls, as named in CallRecord.Method. Greeter2 has no
+// SayHiAgain, so SayHi stands for it alone.
+var MatrixMethods = []string{"SayHello", "SayHelloAgain", "SayHi", "SayHelloServerStreaming"}
+
+// The payload sizes of a matrix.
+const (
+	// PayloadSmall calls send a name of a few bytes.
+	PayloadSmall = "small"
+	// PayloadLarge calls send a name of greetpb.MaxNameBytes, the largest a server validating
+	// requests accepts.
+	PayloadLarge = "large"
+)
+
+// MatrixCell is a combination of method, transport, compression and payload size.
+type MatrixCell struct {
+	Method      string `json:"method"`
+	TLS         bool   `json:"tls"`
+	Compression bool   `json:"compression"`
+	// Payload is PayloadSmall or PayloadLarge.
+	Payload string `json:"payload"`
+}
+
+// String identifies the cell, e.g. "SayHi/tls/gzip/large".
+func (c MatrixCell) String() string {
+	transport, compression := "plaintext", "identity"
+	if c.TLS {
+		transport = "tls"
+	}
+	if c.Compression {
+		compression = "gzip"
+	}
+	return strings.Join([]string{c.Method, transport, compression, c.Payload}, "/")
+}
+
+// name returns the name the calls of the cell send.
+func (c MatrixCell) name() string {
+	if c.Payload == PayloadLarge {
+		return strings.Repeat("0123456789abcdef", pb.MaxNameBytes/16)
+	}
+	return "matrix"
+}
+
+// MatrixCells returns the cells of the cross product of MatrixMethods, both transports, both
+// compressions and both payload sizes. With quick, it returns 8 of the 32 cells instead, every
+// method with two, such that every pair of values of any two dimensions is covered by a cell.
+func MatrixCells(quick bool) []MatrixCell {
+	var cells []MatrixCell
+	if quick {
+		// Every method gets a row of an orthogonal array over transport, compression and payload,
+		// which covers every pair of their values, and its complement.
+		rows := [][3]bool{{false, false, false}, {false, true, true}, {true, false, true}, {true, true, false}}
+		for i, method := range MatrixMethods {
+			row := rows[i%len(rows)]
+			for _, complement := range []bool{false, true} {
+				cells = append(cells, MatrixCell{
+					Method:      method,
+					TLS:         row[0] != complement,
+					Compression: row[1] != complement,
+					Payload:     payloadSize(row[2] != complement),
+				})
+			}
+		}
+		return cells
+	}
+	for _, method := range MatrixMethods {
+		for _, tls := range []bool{false, true} {
+			for _, compression := range []bool{false, true} {
+				for _, large := range []bool{false, true} {
+					cells = append(cells, MatrixCell{Method: method, TLS: tls, Compression: compression, Payload: payloadSize(large)})
+				}
+			}
+		}
+	}
+	return cells
+}
+
+func payloadSize(large bool) string {
+	if large {
+		return PayloadLarge
+	}
+	return PayloadSmall
+}
+
+// MatrixOptions configure RunMatrix.
+type MatrixOptions struct {
+	// Address serves every service of MatrixMethods in plaintext, and TLSAddress over TLS.
+	Address    string
+	TLSAddress string
+	// Count is the number of calls made in every cell.
+	Count int
+	// Quick runs the reduced matrix of MatrixCells.
+	Quick bool
+	// Client configures the clients making the calls. HTTPS and Compression are set by every cell.
+	Client ClientOptions
+	// Latency configures the latency histogram of every cell.
+	Latency HistogramOptions
+	// DialOptions are added to those of the connection of every cell.
+	DialOptions []grpc.DialOption
+}
+
+// Validate checks that the options can be run.
+func (o *MatrixOptions) Validate() error {
+	switch {
+	case o.Address == "" || o.TLSAddress == "":
+		return badFlagsf("the matrix needs both a plaintext and a TLS address")
+	case o.Count <= 0:
+		return badFlagsf("the matrix needs a positive count of calls per cell, got %d", o.Count)
+	}
+	return o.Latency.Validate()
+}
+
+// MatrixResult is the outcome of the calls of a cell.
+type MatrixResult struct {
+	Cell   MatrixCell `json:"cell"`
+	Calls  int        `json:"calls"`
+	Passed bool       `json:"passed"`
+	// Error is why the cell failed, if it did.
+	Error string `json:"error,omitempty"`
+	// Latency is the histogram of the latency of the calls that completed, in nanoseconds.
+	Latency *Histogram `json:"latency"`
+}
+
+// MatrixError reports the cell a matrix stopped at.
+type MatrixError struct {
+	Cell MatrixCell
+	Err  error
+}
+
+func (e *MatrixError) Error() string {
+	return fmt.Sprintf("matrix cell %s failed: %v", e.Cell, e.Err)
+}
+
+func (e *MatrixError) Unwrap() error {
+	return e.Err
+}
+
+// RunMatrix makes opts.Count calls in every cell of MatrixCells(opts.Quick), one cell after the
+// other, over a connection of the cell's own. It stops at the first call that fails, or whose
+// checksum does not match, and returns a *MatrixError naming its cell, along with the results so
+// far, the last of which is the failed cell's. If ctx is done, RunMatrix stops too, and returns
+// ctx.Err().
+func RunMatrix(ctx context.Context, opts *MatrixOptions) ([]*MatrixResult, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	var results []*MatrixResult
+	for _, cell := range MatrixCells(opts.Quick) {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		res, err := runCell(ctx, cell, opts)
+		results = append(results, res)
+		if err != nil {
+			return results, &MatrixError{Cell: cell, Err: err}
+		}
+	}
+	return results, nil
+}
+
+func runCell(ctx context.Context, cell MatrixCell, opts *MatrixOptions) (*MatrixResult, error) {
+	// The options were validated by RunMatrix.
+	latency, _ := NewHistogram(&opts.Latency)
+	res := &MatrixResult{Cell: cell, Latency: latency}
+
+	clientOpts := opts.Client
+	clientOpts.HTTPS = cell.TLS
+	clientOpts.Compression = cell.Compression
+	c := NewClient(&clientOpts)
+	address := opts.Address
+	if cell.TLS {
+		address = opts.TLSAddress
+	}
+	conn, err := c.Dial(address, opts.DialOptions...)
+	if err != nil {
+		res.Error = err.Error()
+		return res, err
+	}
+	defer conn.Close()
+
+	call := matrixCall(c, cell.Method)
+	name := cell.name()
+	for i := 0; i < opts.Count && ctx.Err() == nil; i++ {
+		r := call(conn, name)
+		res.Calls++
+		err := r.Err()
+		if err == nil && (len(r.ChecksumMismatches) > 0 || r.StreamChecksumMismatch) {
+			err = fmt.Errorf("checksum mismatch in call %s", r.RequestID)
+		}
+		if err != nil {
+			res.Error = err.Error()
+			return res, err
+		}
+		if r.Completed() {
+			latency.Record(r.DurationNS)
+		}
+	}
+	res.Passed = true
+	return res, nil
+}
+
+// matrixCall returns the function making a call to method with c.
+func matrixCall(c *Client, method string) func(conn *grpc.ClientConn, name string) *CallRecord {
+	switch method {
+	case "SayHelloAgain":
+		return c.SayHelloAgain
+	case "SayHi":
+		return c.SayHi
+	case "SayHelloServerStreaming":
+		return c.ServerStreaming
+	default:
+		return c.SayHello
+	}
+}
+
+// WriteMatrixSummary writes a line per result to w, with whether its cell passed, its calls, and
+// the median, 99th percentile and largest latency of those that completed.
+func WriteMatrixSummary(w io.Writer, results []*MatrixResult) error {
+	for _, r := range results {
+		verdict := "PASS"
+		if !r.Passed {
+			verdict = "FAIL"
+		}
+		line := fmt.Sprintf("%s %-48s %4d calls", verdict, r.Cell, r.Calls)
+		if r.Latency.Count() > 0 {
+			line += fmt.Sprintf("  p50 %-12v p99 %-12v max %v", time.Duration(r.Latency.ValueAtPercentile(50)),
+				time.Duration(r.Latency.ValueAtPercentile(99)), time.Duration(r.Latency.ValueAtPercentile(100)))
+		}
+		if r.Error != "" {
+			line += "  " + r.Error
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// transportCounter counts the calls to every method by transport, e.g. "SayHi/tls".
+type transportCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (c *transportCounter) count(ctx context.Context, fullMethod string) {
+	transport := "plaintext"
+	if p, ok := peer.FromContext(ctx); ok && p.AuthInfo != nil {
+		transport = "tls"
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[fullMethod[strings.LastIndex(fullMethod, "/")+1:]+"/"+transport]++
+}
+
+func (c *transportCounter) serverOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			c.count(ctx, info.FullMethod)
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			c.count(ss.Context(), info.FullMethod)
+			return handler(srv, ss)
+		}),
+	}
+}
+
+// startMatrixServers serves services in plaintext and over TLS, and returns both addresses.
+func startMatrixServers(t *testing.T, counter *transportCounter, services ...string) (string, string) {
+	tlsCreds := credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}})
+	var addrs []string
+	for _, opts := range [][]grpc.ServerOption{nil, {grpc.Creds(tlsCreds)}} {
+		s := startServerWith(t, &serverSetup{
+			Options: &greetworkload.ServerOptions{ValidateRequests: true, Checksums: true},
+			GRPC:    append(opts, counter.serverOptions()...),
+			Register: func(s *grpc.Server, greeter *greetworkload.Server) {
+				for _, service := range services {
+					require.NoError(t, greeter.Register(s, service))
+				}
+			},
+		})
+		addrs = append(addrs, s.Addr)
+	}
+	return addrs[0], addrs[1]
+}
+
+func matrixOptions(addr, tlsAddr string, quick bool) *greetworkload.MatrixOptions {
+	return &greetworkload.MatrixOptions{
+		Address:    addr,
+		TLSAddress: tlsAddr,
+		Count:      2,
+		Quick:      quick,
+		Client:     greetworkload.ClientOptions{Timeout: 5 * time.Second, StreamCount: 3, VerifyChecksums: true},
+		Latency:    greetworkload.HistogramOptions{MaxValue: time.Minute.Nanoseconds(), SignificantDigits: 3},
+	}
+}
+
+func TestMatrixCells(t *testing.T) {
+	full := greetworkload.MatrixCells(false)
+	assert.Len(t, full, 32)
+	unique := make(map[greetworkload.MatrixCell]bool)
+	for _, c := range full {
+		unique[c] = true
+	}
+	assert.Len(t, unique, 32)
+
+	quick := greetworkload.MatrixCells(true)
+	require.Len(t, quick, 8)
+	// Every pair of values of any two dimensions is covered.
+	dims := []func(c greetworkload.MatrixCell) string{
+		func(c greetworkload.MatrixCell) string { return c.Method },
+		func(c greetworkload.MatrixCell) string { return fmt.Sprint(c.TLS) },
+		func(c greetworkload.MatrixCell) string { return fmt.Sprint(c.Compression) },
+		func(c greetworkload.MatrixCell) string { return c.Payload },
+	}
+	for i := range dims {
+		for j := i + 1; j < len(dims); j++ {
+			want, got := make(map[string]bool), make(map[string]bool)
+			for _, c := range full {
+				want[dims[i](c)+"|"+dims[j](c)] = true
+			}
+			for _, c := range quick {
+				got[dims[i](c)+"|"+dims[j](c)] = true
+			}
+			assert.Equal(t, want, got, "dimensions %d and %d", i, j)
+		}
+	}
+}
+
+func TestMatrixCell_String(t *testing.T) {
+	assert.Equal(t, "SayHi/tls/gzip/large", greetworkload.MatrixCell{Method: "SayHi", TLS: true, Compression: true, Payload: greetworkload.PayloadLarge}.String())
+	assert.Equal(t, "SayHello/plaintext/identity/small", greetworkload.MatrixCell{Method: "SayHello", Payload: greetworkload.PayloadSmall}.String())
+}
+
+func TestRunMatrix_EveryCellPasses(t *testing.T) {
+	counter := &transportCounter{counts: make(map[string]int)}
+	addr, tlsAddr := startMatrixServers(t, counter, greetworkload.GreeterService, greetworkload.Greeter2Service, greetworkload.StreamingGreeterService)
+
+	results, err := greetworkload.RunMatrix(context.Background(), matrixOptions(addr, tlsAddr, false))
+	require.NoError(t, err)
+	require.Len(t, results, 32)
+	for i, r := range results {
+		assert.Equal(t, greetworkload.MatrixCells(false)[i], r.Cell)
+		assert.True(t, r.Passed, r.Cell.String())
+		assert.Equal(t, 2, r.Calls, r.Cell.String())
+		assert.Equal(t, int64(2), r.Latency.Count(), r.Cell.String())
+	}
+	// Every method was called 8 times over each transport: 2 calls for each of 4 cells.
+	want := make(map[string]int)
+	for _, method := range greetworkload.MatrixMethods {
+		want[method+"/plaintext"] = 8
+		want[method+"/tls"] = 8
+	}
+	assert.Equal(t, want, counter.counts)
+
+	var summary strings.Builder
+	require.NoError(t, greetworkload.WriteMatrixSummary(&summary, results))
+	lines := strings.Split(strings.TrimSpace(summary.String()), "\n")
+	require.Len(t, lines, 32)
+	assert.True(t, strings.HasPrefix(lines[0], "PASS SayHello/plaintext/identity/small"), lines[0])
+}
+
+func TestRunMatrix_StopsAtFirstFailingCell(t *testing.T) {
+	counter := &transportCounter{counts: make(map[string]int)}
+	// SayHi fails with Unimplemented.
+	addr, tlsAddr := startMatrixServers(t, counter, greetworkload.GreeterService, greetworkload.StreamingGreeterService)
+
+	results, err := greetworkload.RunMatrix(context.Background(), matrixOptions(addr, tlsAddr, true))
+	var matrixErr *greetworkload.MatrixError
+	require.True(t, errors.As(err, &matrixErr), err)
+	assert.Equal(t, "SayHi", matrixErr.Cell.Method)
+	assert.ErrorIs(t, err, greetworkload.ErrRPCFailed)
+	assert.Contains(t, err.Error(), matrixErr.Cell.String())
+
+	require.NotEmpty(t, results)
+	last := results[len(results)-1]
+	assert.Equal(t, matrixErr.Cell, last.Cell)
+	assert.False(t, last.Passed)
+	assert.Equal(t, 1, last.Calls)
+	assert.Contains(t, last.Error, "Unimplemented")
+	for _, r := range results[:len(results)-1] {
+		assert.True(t, r.Passed, r.Cell.String())
+		assert.NotEqual(t, "SayHi", r.Cell.Method)
+	}
+	assert.Zero(t, counter.counts["SayHelloServerStreaming/plaintext"]+counter.counts["SayHelloServerStreaming/tls"])
+
+	var summary strings.Builder
+	require.NoError(t, greetworkload.WriteMatrixSummary(&summary, results))
+	assert.Contains(t, summary.String(), "FAIL "+matrixErr.Cell.String())
+}
+
+func TestMatrixOptions_Validate(t *testing.T) {
+	valid := matrixOptions("localhost:1", "localhost:2", false)
+	require.NoError(t, valid.Validate())
+
+	for name, modify := range map[string]func(o *greetworkload.MatrixOptions){
+		"no TLS address": func(o *greetworkload.MatrixOptions) { o.TLSAddress = "" },
+		"no calls":       func(o *greetworkload.MatrixOptions) { o.Count = 0 },
+	} {
+		t.Run(name, func(t *testing.T) {
+			opts := *valid
+			modify(&opts)
+			assert.ErrorIs(t, opts.Validate(), greetworkload.ErrBadFlagCombination)
+		})
+	}
+}
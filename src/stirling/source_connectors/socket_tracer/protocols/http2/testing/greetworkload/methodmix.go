@@ -0,0 +1,157 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+)
+
+// The methods a MethodMix picks from, by the name they are given in a mix.
+const (
+	MixSayHello      = "SayHello"
+	MixSayHelloAgain = "SayHelloAgain"
+	MixSayHi         = "SayHi"
+	// MixStream is server streaming SayHello.
+	MixStream = "Stream"
+)
+
+// MixMethods are the methods a MethodMix picks from.
+var MixMethods = []string{MixSayHello, MixSayHelloAgain, MixSayHi, MixStream}
+
+// MethodWeight is the weight of a method in a MethodMix. Methods are picked in proportion to their
+// weights.
+type MethodWeight struct {
+	Method string
+	Weight int
+}
+
+// ParseMethodMix parses a comma-separated list of METHOD:WEIGHT, e.g. SayHello:70,SayHi:20,Stream:10.
+// Weights are positive, and methods are among MixMethods, each given once.
+func ParseMethodMix(spec string) ([]MethodWeight, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, fmt.Errorf("method mix must have at least one method")
+	}
+	var weights []MethodWeight
+	seen := make(map[string]bool)
+	for _, text := range strings.Split(spec, ",") {
+		method, weight, ok := cut(strings.TrimSpace(text), ":")
+		if !ok {
+			return nil, fmt.Errorf("%q: expected METHOD:WEIGHT, e.g. SayHello:70", text)
+		}
+		if !isMixMethod(method) {
+			return nil, fmt.Errorf("%q: unknown method %q, must be one of %s", text, method, strings.Join(MixMethods, ", "))
+		}
+		if seen[method] {
+			return nil, fmt.Errorf("%q: method %s is given more than once", text, method)
+		}
+		seen[method] = true
+		w, err := strconv.Atoi(weight)
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("%q: weight must be a positive integer, got %q", text, weight)
+		}
+		weights = append(weights, MethodWeight{Method: method, Weight: w})
+	}
+	return weights, nil
+}
+
+func isMixMethod(method string) bool {
+	for _, m := range MixMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// MethodMix picks the method of every call from weighted methods. The methods picked only depend on
+// the seed, so that runs with the same seed make the same sequence of calls.
+type MethodMix struct {
+	weights []MethodWeight
+	total   int
+
+	mu     sync.Mutex
+	rng    *rand.Rand
+	counts map[string]int64
+}
+
+// NewMethodMix creates a MethodMix picking from weights, with the random choices seeded with seed.
+func NewMethodMix(weights []MethodWeight, seed int64) (*MethodMix, error) {
+	if len(weights) == 0 {
+		return nil, badFlagsf("method mix must have at least one method")
+	}
+	m := &MethodMix{rng: rand.New(rand.NewSource(seed)), counts: make(map[string]int64)}
+	for _, w := range weights {
+		if !isMixMethod(w.Method) {
+			return nil, badFlagsf("unknown method %q in method mix", w.Method)
+		}
+		if w.Weight <= 0 {
+			return nil, badFlagsf("weight of %s must be positive, got %d", w.Method, w.Weight)
+		}
+		m.total += w.Weight
+	}
+	m.weights = append(m.weights, weights...)
+	return m, nil
+}
+
+// Next picks the method of the next call, and counts it.
+func (m *MethodMix) Next() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.rng.Intn(m.total)
+	method := m.weights[len(m.weights)-1].Method
+	for _, w := range m.weights {
+		if n < w.Weight {
+			method = w.Method
+			break
+		}
+		n -= w.Weight
+	}
+	m.counts[method]++
+	return method
+}
+
+// Counts returns the number of times every method was picked.
+func (m *MethodMix) Counts() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := make(map[string]int64, len(m.counts))
+	for method, n := range m.counts {
+		counts[method] = n
+	}
+	return counts
+}
+
+// Call makes a call to the next method over conn, greeting name.
+func (m *MethodMix) Call(c *Client, conn *grpc.ClientConn, name string) *CallRecord {
+	switch m.Next() {
+	case MixSayHelloAgain:
+		return c.SayHelloAgain(conn, name)
+	case MixSayHi:
+		return c.SayHi(conn, name)
+	case MixStream:
+		return c.ServerStreaming(conn, name)
+	default:
+		return c.SayHello(conn, name)
+	}
+}
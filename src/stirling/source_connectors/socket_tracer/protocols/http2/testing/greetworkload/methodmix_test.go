@@ -0,0 +1,140 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+func TestParseMethodMix(t *testing.T) {
+	weights, err := greetworkload.ParseMethodMix("SayHello:70, SayHi:20,Stream:10")
+	require.NoError(t, err)
+	assert.Equal(t, []greetworkload.MethodWeight{
+		{Method: greetworkload.MixSayHello, Weight: 70},
+		{Method: greetworkload.MixSayHi, Weight: 20},
+		{Method: greetworkload.MixStream, Weight: 10},
+	}, weights)
+}
+
+func TestParseMethodMix_Errors(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr string
+	}{
+		{"", "at least one method"},
+		{"SayHello", `"SayHello": expected METHOD:WEIGHT`},
+		{"SayGoodbye:10", `unknown method "SayGoodbye"`},
+		{"SayHello:0", "weight must be a positive integer"},
+		{"SayHello:-5", "weight must be a positive integer"},
+		{"SayHello:0.5", "weight must be a positive integer"},
+		{"SayHello:70,SayHello:30", "method SayHello is given more than once"},
+		{"SayHello:70,,SayHi:30", `"": expected METHOD:WEIGHT`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.spec, func(t *testing.T) {
+			_, err := greetworkload.ParseMethodMix(tc.spec)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+func TestNewMethodMix_Errors(t *testing.T) {
+	for _, weights := range [][]greetworkload.MethodWeight{
+		nil,
+		{{Method: "SayGoodbye", Weight: 1}},
+		{{Method: greetworkload.MixSayHello, Weight: 0}},
+	} {
+		_, err := greetworkload.NewMethodMix(weights, 1)
+		assert.ErrorIs(t, err, greetworkload.ErrBadFlagCombination, "%v", weights)
+	}
+}
+
+func mixSequence(t *testing.T, spec string, seed int64, n int) []string {
+	weights, err := greetworkload.ParseMethodMix(spec)
+	require.NoError(t, err)
+	mix, err := greetworkload.NewMethodMix(weights, seed)
+	require.NoError(t, err)
+	seq := make([]string, n)
+	for i := range seq {
+		seq[i] = mix.Next()
+	}
+	return seq
+}
+
+func TestMethodMix_DeterministicUnderSeed(t *testing.T) {
+	const spec = "SayHello:70,SayHi:20,Stream:10"
+	first := mixSequence(t, spec, 42, 1000)
+	assert.Equal(t, first, mixSequence(t, spec, 42, 1000))
+	assert.NotEqual(t, first, mixSequence(t, spec, 43, 1000))
+}
+
+func TestMethodMix_Proportions(t *testing.T) {
+	weights, err := greetworkload.ParseMethodMix("SayHello:70,SayHi:20,Stream:10")
+	require.NoError(t, err)
+	mix, err := greetworkload.NewMethodMix(weights, 7)
+	require.NoError(t, err)
+	const n = 20000
+	for i := 0; i < n; i++ {
+		mix.Next()
+	}
+	counts := mix.Counts()
+	assert.Len(t, counts, 3)
+	assert.InDelta(t, 0.7, float64(counts[greetworkload.MixSayHello])/n, 0.02)
+	assert.InDelta(t, 0.2, float64(counts[greetworkload.MixSayHi])/n, 0.02)
+	assert.InDelta(t, 0.1, float64(counts[greetworkload.MixStream])/n, 0.02)
+	assert.Zero(t, counts[greetworkload.MixSayHelloAgain])
+}
+
+func TestMethodMix_Call(t *testing.T) {
+	_, addr := startServer(t, nil)
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	const spec = "SayHello:1,SayHelloAgain:1,SayHi:1,Stream:1"
+	weights, err := greetworkload.ParseMethodMix(spec)
+	require.NoError(t, err)
+	mix, err := greetworkload.NewMethodMix(weights, 3)
+	require.NoError(t, err)
+	// The calls are made to the methods picked, in the same order.
+	want := map[string]string{
+		greetworkload.MixSayHello:      "SayHello",
+		greetworkload.MixSayHelloAgain: "SayHelloAgain",
+		greetworkload.MixSayHi:         "SayHi",
+		greetworkload.MixStream:        "SayHelloServerStreaming",
+	}
+	picked := mixSequence(t, spec, 3, 40)
+	for _, method := range picked {
+		r := mix.Call(c, conn, "world")
+		require.NoError(t, r.Err())
+		assert.Equal(t, want[method], r.Method)
+	}
+	var total int64
+	for _, n := range mix.Counts() {
+		total += n
+	}
+	assert.Equal(t, int64(len(picked)), total)
+}
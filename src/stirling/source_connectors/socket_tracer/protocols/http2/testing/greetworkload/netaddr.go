@@ -0,0 +1,131 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The networks a server can listen on. NetworkTCP listens on both IPv4 and IPv6 when given no
+// host, or an unspecified one.
+const (
+	NetworkTCP  = "tcp"
+	NetworkTCP4 = "tcp4"
+	NetworkTCP6 = "tcp6"
+)
+
+// ListenOptions choose the address, and so the IP family, a server listens on.
+type ListenOptions struct {
+	// Network is one of the Network constants. Empty is NetworkTCP.
+	Network string
+	// Host is an IP literal, with or without brackets, and with a zone for link-local IPv6
+	// addresses, e.g. "::1", "[::1]", "0.0.0.0" or "fe80::1%eth0". Empty listens on every address.
+	Host string
+	// Socket are the socket options of the connections accepted, if not nil.
+	Socket *SocketOptions
+}
+
+func (o *ListenOptions) network() string {
+	if o.Network == "" {
+		return NetworkTCP
+	}
+	return o.Network
+}
+
+func (o *ListenOptions) host() string {
+	return strings.TrimSuffix(strings.TrimPrefix(o.Host, "["), "]")
+}
+
+// Validate checks that the host is an IP literal of the family of the network, and the socket
+// options.
+func (o *ListenOptions) Validate() error {
+	if err := o.Socket.Validate(); err != nil {
+		return err
+	}
+	network := o.network()
+	switch network {
+	case NetworkTCP, NetworkTCP4, NetworkTCP6:
+	default:
+		return fmt.Errorf("unsupported network %q, expected tcp, tcp4 or tcp6", o.Network)
+	}
+	if o.Host == "" {
+		return nil
+	}
+	ip, _, ok := parseIPZone(o.host())
+	if !ok {
+		return fmt.Errorf("host must be an IP literal, got %q", o.Host)
+	}
+	if network == NetworkTCP4 && ip.To4() == nil {
+		return badFlagsf("IPv6 host %s cannot be listened on over tcp4", o.Host)
+	}
+	// IPv4 addresses mapped into IPv6, e.g. "::ffff:127.0.0.1", are IPv6 literals.
+	if network == NetworkTCP6 && !strings.Contains(o.host(), ":") {
+		return badFlagsf("IPv4 host %s cannot be listened on over tcp6", o.Host)
+	}
+	return nil
+}
+
+// Listen validates the options and listens on port, 0 for any.
+func (o *ListenOptions) Listen(port int) (net.Listener, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	return o.Socket.listen(o.network(), net.JoinHostPort(o.host(), strconv.Itoa(port)))
+}
+
+// ListenPacket validates the options and listens for UDP datagrams on port, 0 for any, at the
+// host and in the IP family of Listen. The socket options do not apply.
+func (o *ListenOptions) ListenPacket(port int) (net.PacketConn, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	network := "udp" + strings.TrimPrefix(o.network(), NetworkTCP)
+	return net.ListenPacket(network, net.JoinHostPort(o.host(), strconv.Itoa(port)))
+}
+
+// CanonicalAddr renders addr the way connections are recorded: IPv4 addresses, including those
+// mapped into IPv6 by dual-stack sockets, in dotted form, and IPv6 addresses in brackets, compressed,
+// lowercase and with their zone, e.g. "[fe80::1%eth0]:50051". Addresses that are not IP are left
+// as is.
+func CanonicalAddr(addr net.Addr) string {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	ip, zone, ok := parseIPZone(host)
+	if !ok {
+		return addr.String()
+	}
+	host = ip.String()
+	if zone != "" {
+		host += "%" + zone
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// dialTarget returns the gRPC target of address, a host and port. gRPC parses targets as URLs, so
+// the zone of IPv6 addresses, e.g. "[fe80::1%eth0]:50051", must be escaped.
+func dialTarget(address string) string {
+	if !strings.Contains(address, "%") {
+		return address
+	}
+	return "passthrough:///" + strings.ReplaceAll(address, "%", "%25")
+}
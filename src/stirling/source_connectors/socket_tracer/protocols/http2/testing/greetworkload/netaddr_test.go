@@ -0,0 +1,192 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// skipWithoutIPv6 skips tests on hosts without an IPv6 loopback address.
+func skipWithoutIPv6(t *testing.T) {
+	lis, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	lis.Close()
+}
+
+// startListeningServer serves the greet services over the listener of opts, and returns the port
+// and the stats of the connections it accepts.
+func startListeningServer(t *testing.T, opts *greetworkload.ListenOptions) (int, *greetworkload.ConnStatsHandler) {
+	skipWithoutIPv6(t)
+	lis, err := opts.Listen(0)
+	require.NoError(t, err)
+	connStats := greetworkload.NewConnStatsHandler()
+	return startServerWith(t, &serverSetup{Stats: connStats, Listener: lis}).Port, connStats
+}
+
+// loopbackName returns the name of the loopback interface, for IPv6 zones.
+func loopbackName(t *testing.T) string {
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			return iface.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
+
+func serverRemoteAddrs(t *testing.T, connStats *greetworkload.ConnStatsHandler) []netip.AddrPort {
+	var addrs []netip.AddrPort
+	for _, c := range connStats.Conns() {
+		ap, err := netip.ParseAddrPort(c.RemoteAddr)
+		require.NoError(t, err, c.RemoteAddr)
+		assert.Equal(t, ap.String(), c.RemoteAddr, "not canonical")
+		addrs = append(addrs, ap)
+	}
+	return addrs
+}
+
+func TestListenOptions_Validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     greetworkload.ListenOptions
+		wantErr  bool
+		badFlags bool
+	}{
+		{name: "defaults"},
+		{name: "tcp4 any", opts: greetworkload.ListenOptions{Network: "tcp4", Host: "0.0.0.0"}},
+		{name: "tcp6 bracketed", opts: greetworkload.ListenOptions{Network: "tcp6", Host: "[::1]"}},
+		{name: "tcp6 zone", opts: greetworkload.ListenOptions{Network: "tcp6", Host: "fe80::1%eth0"}},
+		{name: "tcp mixed", opts: greetworkload.ListenOptions{Network: "tcp", Host: "::"}},
+		{name: "tcp4 mapped", opts: greetworkload.ListenOptions{Network: "tcp4", Host: "::ffff:127.0.0.1"}},
+		{name: "tcp6 mapped", opts: greetworkload.ListenOptions{Network: "tcp6", Host: "::ffff:127.0.0.1"}},
+		{name: "unknown network", opts: greetworkload.ListenOptions{Network: "udp"}, wantErr: true},
+		{name: "hostname", opts: greetworkload.ListenOptions{Host: "localhost"}, wantErr: true},
+		{name: "IPv6 over tcp4", opts: greetworkload.ListenOptions{Network: "tcp4", Host: "::1"}, wantErr: true, badFlags: true},
+		{name: "IPv4 over tcp6", opts: greetworkload.ListenOptions{Network: "tcp6", Host: "127.0.0.1"}, wantErr: true, badFlags: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.opts.Validate()
+			if !tc.wantErr {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Equal(t, tc.badFlags, errors.Is(err, greetworkload.ErrBadFlagCombination))
+		})
+	}
+}
+
+type stringAddr string
+
+func (a stringAddr) Network() string { return "tcp" }
+func (a stringAddr) String() string  { return string(a) }
+
+func TestCanonicalAddr(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}, "10.0.0.1:80"},
+		{stringAddr("[::ffff:10.0.0.1]:80"), "10.0.0.1:80"},
+		{stringAddr("[2001:DB8:0:0::1]:80"), "[2001:db8::1]:80"},
+		{&net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 80, Zone: "eth0"}, "[fe80::1%eth0]:80"},
+		{&net.UnixAddr{Name: "/tmp/greet.sock", Net: "unix"}, "/tmp/greet.sock"},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, greetworkload.CanonicalAddr(tc.addr), tc.addr.String())
+	}
+}
+
+func TestIPv6_UnaryAndStreaming(t *testing.T) {
+	port, connStats := startListeningServer(t, &greetworkload.ListenOptions{Network: "tcp6", Host: "::1"})
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+
+	for _, addr := range []string{
+		net.JoinHostPort("::1", strconv.Itoa(port)),
+		net.JoinHostPort("::1%"+loopbackName(t), strconv.Itoa(port)),
+	} {
+		conn, err := c.Dial(addr)
+		require.NoError(t, err, addr)
+		r := c.SayHello(conn, "pixie")
+		assert.True(t, r.Completed(), r.Error)
+		r = c.ServerStreaming(conn, "pixie")
+		assert.True(t, r.Completed(), r.Error)
+		conn.Close()
+	}
+
+	addrs := serverRemoteAddrs(t, connStats)
+	require.Len(t, addrs, 2)
+	for _, ap := range addrs {
+		assert.True(t, ap.Addr().Is6(), ap.String())
+		assert.Equal(t, netip.IPv6Loopback(), ap.Addr())
+	}
+}
+
+func TestIPv6_H2CUpgradeWithZone(t *testing.T) {
+	skipWithoutIPv6(t)
+	lis, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	s := startServerWith(t, &serverSetup{Listener: lis, H2C: &greetworkload.HTTP2Settings{}})
+
+	// The zone must be escaped in the URL of the upgrade request.
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	port := strconv.Itoa(s.Port)
+	r := c.SayHelloH2CUpgrade(net.JoinHostPort("::1%"+loopbackName(t), port), "pixie")
+	assert.True(t, r.Completed(), r.Error)
+}
+
+func TestDualStack_AcceptsBothFamilies(t *testing.T) {
+	port, connStats := startListeningServer(t, &greetworkload.ListenOptions{Network: "tcp"})
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+
+	v4, err := c.Dial(net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	require.NoError(t, err)
+	defer v4.Close()
+	v6, err := c.Dial(net.JoinHostPort("::1", strconv.Itoa(port)))
+	require.NoError(t, err)
+	defer v6.Close()
+	// Both connections are open at once.
+	for _, conn := range []*grpc.ClientConn{v4, v6} {
+		r := c.SayHello(conn, "pixie")
+		require.True(t, r.Completed(), r.Error)
+	}
+
+	addrs := serverRemoteAddrs(t, connStats)
+	require.Len(t, addrs, 2)
+	families := map[bool]bool{}
+	for _, ap := range addrs {
+		families[ap.Addr().Is4()] = true
+	}
+	assert.Equal(t, map[bool]bool{true: true, false: true}, families, "%v", addrs)
+}
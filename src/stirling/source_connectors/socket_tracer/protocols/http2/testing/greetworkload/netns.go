@@ -0,0 +1,181 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// NetnsEnv holds the NetnsTopology of a run, as JSON, in the environment of the processes the
+	// orchestrator starts in network namespaces, so that their RunMetadata records it.
+	NetnsEnv = "GREETWORKLOAD_NETNS"
+	// DefaultNetnsMTU is the MTU of the veth pair unless NetnsOptions set one.
+	DefaultNetnsMTU = 1500
+	// DefaultNetnsSubnet is the subnet of the veth pair unless NetnsOptions set one.
+	DefaultNetnsSubnet = "10.213.0.0/30"
+	// maxNetnsPrefix keeps the names of the interfaces, {prefix}-s and {prefix}-c, within the 15
+	// bytes Linux allows.
+	maxNetnsPrefix = 13
+)
+
+// NetnsOptions put the server and the clients of a run in network namespaces of their own,
+// connected by a veth pair, so that their traffic goes through a network interface rather than
+// the shortcuts the kernel takes over loopback.
+type NetnsOptions struct {
+	// Prefix names the namespaces, {prefix}-srv and {prefix}-cli, and the ends of the veth pair in
+	// them, {prefix}-s and {prefix}-c. It is at most 13 bytes. Defaults to gw{pid}.
+	Prefix string `json:"prefix,omitempty"`
+	// MTU is the MTU of both ends of the veth pair. Defaults to 1500.
+	MTU int `json:"mtu,omitempty"`
+	// Subnet is an IPv4 prefix of /30 or wider, the first two addresses of which go to the server
+	// and the client ends. Defaults to 10.213.0.0/30.
+	Subnet string `json:"subnet,omitempty"`
+}
+
+func (o *NetnsOptions) prefix() string {
+	if o.Prefix == "" {
+		return fmt.Sprintf("gw%d", os.Getpid())
+	}
+	return o.Prefix
+}
+
+func (o *NetnsOptions) mtu() int {
+	if o.MTU == 0 {
+		return DefaultNetnsMTU
+	}
+	return o.MTU
+}
+
+func (o *NetnsOptions) subnet() string {
+	if o.Subnet == "" {
+		return DefaultNetnsSubnet
+	}
+	return o.Subnet
+}
+
+// Validate checks that the options describe namespaces that can be set up.
+func (o *NetnsOptions) Validate() error {
+	_, err := o.topology()
+	return err
+}
+
+// topology returns the namespaces, interfaces and addresses the options describe.
+func (o *NetnsOptions) topology() (*NetnsTopology, error) {
+	prefix := o.prefix()
+	if len(prefix) > maxNetnsPrefix || strings.ContainsAny(prefix, "/ ") {
+		return nil, fmt.Errorf("netns prefix %q must be at most %d bytes, without slashes or spaces", prefix, maxNetnsPrefix)
+	}
+	// 68 is the smallest MTU IPv4 allows, and 65535 the largest a veth takes.
+	if mtu := o.mtu(); mtu < 68 || mtu > 65535 {
+		return nil, fmt.Errorf("netns MTU must be in [68, 65535], got %d", mtu)
+	}
+	_, subnet, err := net.ParseCIDR(o.subnet())
+	if err != nil {
+		return nil, fmt.Errorf("invalid netns subnet: %w", err)
+	}
+	prefixLen, bits := subnet.Mask.Size()
+	if bits != 8*net.IPv4len || prefixLen > 30 {
+		return nil, fmt.Errorf("netns subnet %s must be IPv4, and /30 or wider", o.subnet())
+	}
+	// The last two bits of the subnet are clear, so its first two addresses take no carry.
+	server, client := subnet.IP.To4(), make(net.IP, net.IPv4len)
+	copy(client, server)
+	server[3]++
+	client[3] += 2
+	return &NetnsTopology{
+		ServerNamespace: prefix + "-srv",
+		ClientNamespace: prefix + "-cli",
+		ServerInterface: prefix + "-s",
+		ClientInterface: prefix + "-c",
+		ServerAddr:      server.String(),
+		ClientAddr:      client.String(),
+		PrefixLen:       prefixLen,
+		MTU:             o.mtu(),
+	}, nil
+}
+
+// NetnsTopology is the network namespaces a run took place in, and the veth pair between them.
+type NetnsTopology struct {
+	ServerNamespace string `json:"server_namespace"`
+	ClientNamespace string `json:"client_namespace"`
+	ServerInterface string `json:"server_interface"`
+	ClientInterface string `json:"client_interface"`
+	// ServerAddr and ClientAddr are the IPv4 addresses of the server and client ends, in a subnet
+	// of PrefixLen bits.
+	ServerAddr string `json:"server_addr"`
+	ClientAddr string `json:"client_addr"`
+	PrefixLen  int    `json:"prefix_len"`
+	MTU        int    `json:"mtu"`
+}
+
+// netnsFromEnv returns the NetnsTopology in NetnsEnv, or nil if it is not set or not valid.
+func netnsFromEnv() *NetnsTopology {
+	s := os.Getenv(NetnsEnv)
+	if s == "" {
+		return nil
+	}
+	t := &NetnsTopology{}
+	if err := json.Unmarshal([]byte(s), t); err != nil {
+		return nil
+	}
+	return t
+}
+
+// env returns the NetnsEnv variable that holds t.
+func (t *NetnsTopology) env() string {
+	b, _ := json.Marshal(t)
+	return NetnsEnv + "=" + string(b)
+}
+
+// ErrNetnsSetup reports network namespaces that could not be set up, or torn down, most often
+// for lack of CAP_NET_ADMIN or of the ip command of iproute2.
+var ErrNetnsSetup = errors.New("network namespace setup failed")
+
+// runIP runs the ip command of iproute2 with args.
+func runIP(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: ip %s: %v: %s", ErrNetnsSetup, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// netnsCommand returns the command that runs path with args in the network namespace ns. ip
+// execs path once it entered ns, so that the command has the PID path runs as.
+func netnsCommand(ns, path string, args []string) *exec.Cmd {
+	return exec.Command("ip", append([]string{"netns", "exec", ns, path}, args...)...)
+}
+
+// dialInNetns dials the TCP address from the network namespace ns.
+func dialInNetns(ctx context.Context, ns, address string) (net.Conn, error) {
+	var conn net.Conn
+	err := inNetns(ns, func() error {
+		var err error
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", address)
+		return err
+	})
+	return conn, err
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const netnsSupported = true
+
+// netnsDir is where ip netns keeps the namespaces it names.
+const netnsDir = "/var/run/netns"
+
+// setupNetns creates the namespaces of t and the veth pair between them, addresses its ends and
+// brings them up, along with the loopback interface of each namespace. Whatever was created is
+// deleted if a step fails.
+func setupNetns(t *NetnsTopology) error {
+	if err := runIP("netns", "add", t.ServerNamespace); err != nil {
+		return err
+	}
+	if err := runIP("netns", "add", t.ClientNamespace); err != nil {
+		_ = runIP("netns", "delete", t.ServerNamespace)
+		return err
+	}
+	if err := connectNetns(t); err != nil {
+		_ = runIP("netns", "delete", t.ServerNamespace)
+		_ = runIP("netns", "delete", t.ClientNamespace)
+		return err
+	}
+	return nil
+}
+
+// connectNetns creates the veth pair between the namespaces of t, and sets up its ends.
+func connectNetns(t *NetnsTopology) error {
+	// Created in the server namespace, with its peer in the client one, so that the pair never
+	// shows up in the namespace of the orchestrator, and goes away with the server namespace.
+	err := runIP("-n", t.ServerNamespace, "link", "add", t.ServerInterface, "type", "veth",
+		"peer", "name", t.ClientInterface, "netns", t.ClientNamespace)
+	if err != nil {
+		return err
+	}
+	ends := []struct{ ns, iface, addr string }{
+		{t.ServerNamespace, t.ServerInterface, t.ServerAddr},
+		{t.ClientNamespace, t.ClientInterface, t.ClientAddr},
+	}
+	mtu := strconv.Itoa(t.MTU)
+	for _, end := range ends {
+		steps := [][]string{
+			{"-n", end.ns, "addr", "add", end.addr + "/" + strconv.Itoa(t.PrefixLen), "dev", end.iface},
+			{"-n", end.ns, "link", "set", "dev", end.iface, "mtu", mtu, "up"},
+			{"-n", end.ns, "link", "set", "dev", "lo", "up"},
+		}
+		for _, args := range steps {
+			if err := runIP(args...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// teardownNetns deletes the namespaces of t, and the veth pair along with them. It checks that
+// they are gone, rather than trust ip.
+func teardownNetns(t *NetnsTopology) error {
+	var errs []error
+	for _, ns := range []string{t.ServerNamespace, t.ClientNamespace} {
+		if err := runIP("netns", "delete", ns); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(netnsDir, ns)); !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("%w: namespace %s is still there once deleted", ErrNetnsSetup, ns))
+		}
+	}
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	// Every error is ErrNetnsSetup, or a failure to run ip, so wrapping the first one is enough.
+	var rest []string
+	for _, err := range errs[1:] {
+		rest = append(rest, err.Error())
+	}
+	return fmt.Errorf("%w; %s", errs[0], strings.Join(rest, "; "))
+}
+
+// inNetns calls f on a thread that is in the network namespace ns for the duration of the call,
+// so that the sockets f opens belong to ns. They stay in ns once f returns.
+func inNetns(ns string, f func() error) error {
+	target, err := os.Open(filepath.Join(netnsDir, ns))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetnsSetup, err)
+	}
+	defer target.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		// The thread is only unlocked once it is back in the namespace of the process. Otherwise
+		// it exits along with the goroutine, rather than run other goroutines in ns.
+		runtime.LockOSThread()
+		orig, err := os.Open("/proc/thread-self/ns/net")
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer orig.Close()
+		if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			errc <- fmt.Errorf("%w: failed to enter %s: %v", ErrNetnsSetup, ns, err)
+			return
+		}
+		err = f()
+		if unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET) == nil {
+			runtime.UnlockOSThread()
+		}
+		errc <- err
+	}()
+	return <-errc
+}
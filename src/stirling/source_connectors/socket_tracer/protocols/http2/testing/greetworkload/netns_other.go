@@ -0,0 +1,36 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload
+
+const netnsSupported = false
+
+func setupNetns(*NetnsTopology) error {
+	return unsupportedPlatform(FeatureNetns)
+}
+
+func teardownNetns(*NetnsTopology) error {
+	return unsupportedPlatform(FeatureNetns)
+}
+
+func inNetns(string, func() error) error {
+	return unsupportedPlatform(FeatureNetns)
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// skipUnlessNetns skips tests that need network namespaces where they cannot be made, trying to
+// make one with the given name.
+func skipUnlessNetns(t *testing.T, probe string) {
+	if err := greetworkload.CheckPlatform(greetworkload.FeatureNetns); err != nil {
+		t.Skip(err)
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("the ip command of iproute2 is not installed")
+	}
+	if out, err := exec.Command("ip", "netns", "add", probe).CombinedOutput(); err != nil {
+		t.Skipf("network namespaces cannot be made, which needs CAP_NET_ADMIN: %v: %s", err, out)
+	}
+	require.NoError(t, exec.Command("ip", "netns", "delete", probe).Run())
+}
+
+// assertNetnsGone checks that the namespaces and the veth pair of a run were deleted.
+func assertNetnsGone(t *testing.T, topo *greetworkload.NetnsTopology) {
+	for _, ns := range []string{topo.ServerNamespace, topo.ClientNamespace} {
+		_, err := os.Stat(filepath.Join("/var/run/netns", ns))
+		assert.True(t, os.IsNotExist(err), "namespace %s is left behind", ns)
+	}
+	out, err := exec.Command("ip", "netns", "list").Output()
+	require.NoError(t, err)
+	assert.NotContains(t, string(out), topo.ServerNamespace)
+	assert.NotContains(t, string(out), topo.ClientNamespace)
+	for _, iface := range []string{topo.ServerInterface, topo.ClientInterface} {
+		_, err := net.InterfaceByName(iface)
+		assert.Error(t, err, "interface %s is left behind", iface)
+	}
+}
+
+func netnsConfig(t *testing.T, prefix string, clients ...greetworkload.ProcessSpec) *greetworkload.OrchestratorConfig {
+	server := helperSpec("server", "server")
+	// The helper server listens on 127.0.0.1 otherwise, which the client namespace cannot reach.
+	server.Args = append(server.Args, "--listen_host=")
+	return &greetworkload.OrchestratorConfig{
+		Server:            server,
+		Clients:           clients,
+		WorkDir:           t.TempDir(),
+		StopTimeoutMillis: 5000,
+		Netns:             &greetworkload.NetnsOptions{Prefix: prefix, MTU: 9000, Subnet: "10.213.7.0/24"},
+	}
+}
+
+func TestOrchestrate_Netns(t *testing.T) {
+	prefix := fmt.Sprintf("gwt%d", os.Getpid())
+	skipUnlessNetns(t, prefix+"-probe")
+	cfg := netnsConfig(t, prefix, helperSpec("a", "client"))
+
+	results, err := greetworkload.Orchestrate(context.Background(), cfg)
+	require.NoError(t, err)
+	assertExited(t, results)
+
+	want := &greetworkload.NetnsTopology{
+		ServerNamespace: prefix + "-srv",
+		ClientNamespace: prefix + "-cli",
+		ServerInterface: prefix + "-s",
+		ClientInterface: prefix + "-c",
+		ServerAddr:      "10.213.7.1",
+		ClientAddr:      "10.213.7.2",
+		PrefixLen:       24,
+		MTU:             9000,
+	}
+	assert.Equal(t, want, results.Netns)
+	assertNetnsGone(t, want)
+
+	// The calls went over the veth pair, between the addresses of its ends.
+	require.Len(t, results.Clients, 1)
+	client := results.Clients[0]
+	require.Len(t, client.Records, 3)
+	for _, r := range client.Records {
+		assert.True(t, r.Completed(), r.Error)
+	}
+	require.Len(t, client.Conns, 1)
+	assert.Contains(t, client.Conns[0].LocalAddr, "10.213.7.2:")
+	assert.Contains(t, client.Conns[0].RemoteAddr, "10.213.7.1:")
+	require.Len(t, results.Server.Conns, 1)
+	assert.Equal(t, client.Conns[0].LocalAddr, results.Server.Conns[0].RemoteAddr)
+	assert.Len(t, results.Server.Records, 3)
+
+	// The client recorded the namespaces in its run metadata.
+	f, err := os.Open(filepath.Join(cfg.WorkDir, "a.records.json"))
+	require.NoError(t, err)
+	defer f.Close()
+	meta, err := greetworkload.ReadRunMetadata(f)
+	require.NoError(t, err)
+	assert.Equal(t, want, meta.Netns)
+}
+
+func TestOrchestrate_NetnsTornDownOnFailure(t *testing.T) {
+	prefix := fmt.Sprintf("gwf%d", os.Getpid())
+	skipUnlessNetns(t, prefix+"-probe")
+	cfg := netnsConfig(t, prefix, helperSpec("crash", "crash"), helperSpec("hang", "hang"))
+
+	results, err := greetworkload.Orchestrate(context.Background(), cfg)
+	var procErr *greetworkload.ProcessError
+	require.ErrorAs(t, err, &procErr)
+	assert.Equal(t, "crash", procErr.Name)
+	require.NotNil(t, results)
+	assertExited(t, results)
+	require.NotNil(t, results.Netns)
+	assertNetnsGone(t, results.Netns)
+}
+
+func TestOrchestrate_NetnsSetupFails(t *testing.T) {
+	prefix := fmt.Sprintf("gwe%d", os.Getpid())
+	skipUnlessNetns(t, prefix+"-probe")
+	// A namespace of the run that exists already fails the setup, which leaves it alone and
+	// deletes the one it made.
+	require.NoError(t, exec.Command("ip", "netns", "add", prefix+"-cli").Run())
+	defer func() { _ = exec.Command("ip", "netns", "delete", prefix+"-cli").Run() }()
+	cfg := netnsConfig(t, prefix, helperSpec("a", "client"))
+
+	results, err := greetworkload.Orchestrate(context.Background(), cfg)
+	assert.ErrorIs(t, err, greetworkload.ErrNetnsSetup)
+	assert.Nil(t, results)
+	_, err = os.Stat(filepath.Join("/var/run/netns", prefix+"-srv"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join("/var/run/netns", prefix+"-cli"))
+	assert.NoError(t, err)
+}
+
+func TestNetnsOptions_Validate(t *testing.T) {
+	assert.NoError(t, (&greetworkload.NetnsOptions{}).Validate())
+	assert.NoError(t, (&greetworkload.NetnsOptions{Prefix: "gw12345678901", MTU: 68, Subnet: "192.168.1.4/30"}).Validate())
+	for name, opts := range map[string]greetworkload.NetnsOptions{
+		"long prefix":   {Prefix: "gw123456789012"},
+		"slash":         {Prefix: "a/b"},
+		"small mtu":     {MTU: 67},
+		"large mtu":     {MTU: 65536},
+		"bad subnet":    {Subnet: "10.0.0.1"},
+		"narrow subnet": {Subnet: "10.0.0.0/31"},
+		"ipv6 subnet":   {Subnet: "fd00::/64"},
+	} {
+		assert.Error(t, opts.Validate(), name)
+	}
+}
@@ -0,0 +1,880 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+const (
+	defaultReadyTimeout = 10 * time.Second
+	defaultStopTimeout  = 10 * time.Second
+	readyPollInterval   = 50 * time.Millisecond
+	// maxStderrTail is how much of the end of its stderr a ProcessResult keeps.
+	maxStderrTail = 4096
+)
+
+// ProcessSpec describes a process started by Orchestrate.
+type ProcessSpec struct {
+	// Name identifies the process in the results, and names its files in the work directory.
+	Name string   `json:"name"`
+	Path string   `json:"path"`
+	Args []string `json:"args"`
+	// Env is added to the environment the orchestrator runs in.
+	Env []string `json:"env,omitempty"`
+}
+
+// OrchestratorConfig describes a workload run: a greet server and the clients that call it.
+type OrchestratorConfig struct {
+	// Server is started with --port=0, --stats_file and --records_file. Like go_grpc_server, it must
+	// print the port it listens on to stdout, serve the gRPC health service, and write its stats and
+	// records files once it exits on SIGTERM. Its name defaults to "server".
+	Server ProcessSpec `json:"server"`
+	// Workers is the number of server processes to start on the same port, each with --reuseport
+	// and --instance_id={pid}, so that every reply names the PID of the worker that sent it.
+	// Workers are named after the server, e.g. "server-1", the first started with --port=0 and
+	// the others on the port it prints. Zero or one starts the server alone.
+	Workers int `json:"workers,omitempty"`
+	// Clients are started together once the server reports SERVING, with -address, -output and
+	// -stats_file, as go_grpc_client takes them.
+	Clients []ProcessSpec `json:"clients"`
+	// HTTPS passes --https to the server and -https to the clients.
+	HTTPS bool `json:"https"`
+	// WorkDir receives the output, stats and stderr files of every process.
+	WorkDir string `json:"work_dir"`
+	// ReadyTimeoutMillis bounds how long the server may take to report SERVING. Defaults to 10s.
+	ReadyTimeoutMillis int64 `json:"ready_timeout_millis"`
+	// StopTimeoutMillis bounds how long the server may take to exit on SIGTERM, after which it is
+	// killed. Defaults to 10s.
+	StopTimeoutMillis int64 `json:"stop_timeout_millis"`
+	// Capture writes the TCP segments to and from the server's port to capture.pcapng in WorkDir,
+	// from the moment the server prints its port until it exits. The header of the file lists the
+	// arguments of every process, including any seed they are given. Capturing is only supported on
+	// Linux, with CAP_NET_RAW; if it cannot be started, the run goes on without it, with a warning.
+	Capture bool `json:"capture"`
+	// CaptureInterface is the interface captured from. Defaults to the loopback interface, lo, or
+	// with Netns to the server end of the veth pair, in the server namespace.
+	CaptureInterface string `json:"capture_interface,omitempty"`
+	// Channelz passes -channelz_file to the clients, and takes a channelz snapshot of the server
+	// once they have exited, before it is stopped, to {server}.channelz.json in WorkDir. A snapshot
+	// that cannot be taken is a warning. It only applies to a single server process.
+	Channelz bool `json:"channelz,omitempty"`
+	// Netns runs the server in a network namespace, and the clients in another, connected by a
+	// veth pair, and reaches the server over it. The namespaces are deleted once the run is over,
+	// whether it failed or not. Network namespaces are only supported on Linux, with
+	// CAP_NET_ADMIN and the ip command of iproute2; if they cannot be set up, the run fails.
+	Netns *NetnsOptions `json:"netns,omitempty"`
+}
+
+// LoadOrchestratorConfig reads an OrchestratorConfig from a JSON file.
+func LoadOrchestratorConfig(path string) (*OrchestratorConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg := &OrchestratorConfig{}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (c *OrchestratorConfig) serverName() string {
+	if c.Server.Name == "" {
+		return "server"
+	}
+	return c.Server.Name
+}
+
+// workerNames returns the names of the server processes.
+func (c *OrchestratorConfig) workerNames() []string {
+	if c.Workers <= 1 {
+		return []string{c.serverName()}
+	}
+	names := make([]string, c.Workers)
+	for i := range names {
+		names[i] = fmt.Sprintf("%s-%d", c.serverName(), i+1)
+	}
+	return names
+}
+
+// Validate checks that the config describes a run.
+func (c *OrchestratorConfig) Validate() error {
+	switch {
+	case c.Server.Path == "":
+		return errors.New("server path must be set")
+	case len(c.Clients) == 0:
+		return errors.New("at least one client must be set")
+	case c.WorkDir == "":
+		return errors.New("work dir must be set")
+	case c.ReadyTimeoutMillis < 0 || c.StopTimeoutMillis < 0:
+		return errors.New("timeouts must not be negative")
+	case c.Workers < 0:
+		return errors.New("workers must not be negative")
+	case c.Channelz && c.Workers > 1:
+		return errors.New("channelz only applies to a single server process")
+	}
+	if c.Netns != nil {
+		if err := c.Netns.Validate(); err != nil {
+			return err
+		}
+	}
+	names := map[string]bool{c.serverName(): true}
+	for _, name := range c.workerNames() {
+		names[name] = true
+	}
+	for _, client := range c.Clients {
+		switch {
+		case client.Path == "":
+			return fmt.Errorf("client %q has no path", client.Name)
+		case client.Name == "" || strings.ContainsRune(client.Name, filepath.Separator):
+			return fmt.Errorf("client name %q must be set and must not contain %q", client.Name, filepath.Separator)
+		case names[client.Name]:
+			return fmt.Errorf("process name %q is used more than once", client.Name)
+		}
+		names[client.Name] = true
+	}
+	return nil
+}
+
+func millisOrDefault(millis int64, def time.Duration) time.Duration {
+	if millis == 0 {
+		return def
+	}
+	return time.Duration(millis) * time.Millisecond
+}
+
+// ProcessResult is what a process of a run did and observed.
+type ProcessResult struct {
+	Name string `json:"name"`
+	PID  int    `json:"pid"`
+	// ExitCode is the exit code of the process, or -1 if it was ended by a signal.
+	ExitCode int `json:"exit_code"`
+	// Killed is true if the orchestrator killed the process, because the run was cancelled, another
+	// process failed, or the server did not stop in time.
+	Killed bool `json:"killed"`
+	// Stderr is the end of what the process wrote to stderr. All of it is in the work directory.
+	Stderr string `json:"stderr,omitempty"`
+	// Cause is the error the process failed with, if its exit code stands for one. See ExitCode.
+	Cause string `json:"cause,omitempty"`
+	// Records are the calls made by a client, or handled by the server.
+	Records []*CallRecord `json:"records,omitempty"`
+	// Conns are the connections seen by the process. Those of the server leave out the connection
+	// the orchestrator checks its health over.
+	Conns []ConnStats `json:"conns,omitempty"`
+	// Channelz is the channelz snapshot of the process, if the config asks for one. That of the
+	// server leaves out the connection it was taken over.
+	Channelz *ChannelzSnapshot `json:"channelz,omitempty"`
+}
+
+// RunResults merge the ground truth of every process of a run.
+type RunResults struct {
+	// Server is the server, or its first worker.
+	Server *ProcessResult `json:"server"`
+	// Workers are every worker of the server, if there are more than one.
+	Workers []*ProcessResult `json:"workers,omitempty"`
+	Clients []*ProcessResult `json:"clients"`
+	// Features is the configuration the server reported once it was ready, if it reports one.
+	Features *pb.FeatureMatrix `json:"features,omitempty"`
+	// Capture is the path of the packet capture of the run, if one was made.
+	Capture string `json:"capture,omitempty"`
+	// Netns is the network namespaces the run took place in, if the config asks for them.
+	Netns *NetnsTopology `json:"netns,omitempty"`
+	// Warnings are the problems that did not fail the run, such as a capture that could not be made.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// WriteRunResults writes results to w as JSON.
+func WriteRunResults(w io.Writer, results *RunResults) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
+
+// ProcessError reports the process whose failure ended a run.
+type ProcessError struct {
+	Name     string
+	ExitCode int
+	// Cause is the error the process failed with, if its exit code stands for one, e.g.
+	// ErrDialFailed. See ExitCode.
+	Cause error
+	// Stderr is the end of what the process wrote to stderr.
+	Stderr string
+}
+
+func (e *ProcessError) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("%s exited with code %d (%v), stderr: %s", e.Name, e.ExitCode, e.Cause, e.Stderr)
+	}
+	return fmt.Sprintf("%s exited with code %d, stderr: %s", e.Name, e.ExitCode, e.Stderr)
+}
+
+// Unwrap returns the cause of the failure, so that errors.Is matches it.
+func (e *ProcessError) Unwrap() error {
+	return e.Cause
+}
+
+// tailBuffer keeps the last maxStderrTail bytes written to it.
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > maxStderrTail {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-maxStderrTail:]...)
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(b.buf)
+}
+
+// portWriter receives the stdout of the server, the first write of which is its port.
+type portWriter struct {
+	once sync.Once
+	port chan string
+}
+
+func (w *portWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { w.port <- string(p) })
+	return len(p), nil
+}
+
+// child is a process of a run.
+type child struct {
+	name       string
+	cmd        *exec.Cmd
+	stderr     tailBuffer
+	stderrFile *os.File
+	// done is closed once the process has exited and exitCode is set.
+	done     chan struct{}
+	exitCode int
+	killed   bool
+}
+
+// startChild starts the process of spec with args, in the network namespace ns unless it is empty.
+func startChild(spec ProcessSpec, args []string, workDir, ns string, stdout io.Writer) (*child, error) {
+	name := spec.Name
+	stderrFile, err := os.Create(filepath.Join(workDir, name+".stderr"))
+	if err != nil {
+		return nil, err
+	}
+	c := &child{name: name, stderrFile: stderrFile, done: make(chan struct{})}
+	c.cmd = exec.Command(spec.Path, args...)
+	if ns != "" {
+		c.cmd = netnsCommand(ns, spec.Path, args)
+	}
+	c.cmd.Env = append(os.Environ(), spec.Env...)
+	c.cmd.Stdout = stdout
+	c.cmd.Stderr = io.MultiWriter(stderrFile, &c.stderr)
+	if err := c.cmd.Start(); err != nil {
+		stderrFile.Close()
+		return nil, fmt.Errorf("failed to start %s: %w", name, err)
+	}
+	go func() {
+		_ = c.cmd.Wait()
+		c.exitCode = c.cmd.ProcessState.ExitCode()
+		c.stderrFile.Close()
+		close(c.done)
+	}()
+	return c, nil
+}
+
+func (c *child) exited() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// kill kills the process unless it already exited, and waits for it to exit.
+func (c *child) kill() {
+	if !c.exited() {
+		c.killed = true
+		_ = c.cmd.Process.Kill()
+	}
+	<-c.done
+}
+
+// stop sends SIGTERM to the process and waits for it to exit, killing it after timeout.
+func (c *child) stop(timeout time.Duration) {
+	if c.exited() {
+		return
+	}
+	if err := c.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		// Windows has no SIGTERM to send, and the process has nothing to clean up without it.
+		c.kill()
+		return
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-c.done:
+	case <-t.C:
+		c.kill()
+	}
+}
+
+func (c *child) processError() *ProcessError {
+	return &ProcessError{Name: c.name, ExitCode: c.exitCode, Cause: ExitCause(c.exitCode), Stderr: c.stderr.String()}
+}
+
+type orchestration struct {
+	cfg *OrchestratorConfig
+	// server is the server, or its first worker, and workers every worker started.
+	server  *child
+	workers []*child
+	clients []*child
+	// healthAddr is the local address of the connection the server's health is checked over.
+	healthAddr string
+	serverArgs []string
+	capture    *packetCapture
+	features   *pb.FeatureMatrix
+	warnings   []string
+	// netns is the network namespaces of the run, if the config asks for them.
+	netns *NetnsTopology
+}
+
+// Orchestrate runs the server of cfg, waits for it to report SERVING through the health service,
+// then runs every client against it. Once the clients have exited, the server is stopped with
+// SIGTERM and the output and stats files of every process are merged into the results. Every
+// worker of a server is stopped alike, and any of them exiting early fails the run as the server
+// would.
+//
+// If ctx is done, or a client exits with a non-zero code or the server exits before the clients,
+// every process still running is killed, and the error is ctx.Err() or a *ProcessError. Results are
+// returned in every case once the processes were started, so that a failed run can be diagnosed.
+//
+// The network namespaces of cfg.Netns are deleted before Orchestrate returns, or panics, once every
+// process in them was killed. Namespaces that cannot be deleted fail a run that did not fail
+// otherwise with ErrNetnsSetup.
+func Orchestrate(ctx context.Context, cfg *OrchestratorConfig) (*RunResults, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cfg.WorkDir, 0755); err != nil {
+		return nil, err
+	}
+
+	o := &orchestration{cfg: cfg}
+	if cfg.Netns == nil {
+		return o.orchestrate(ctx)
+	}
+	t, err := cfg.Netns.topology()
+	if err != nil {
+		return nil, err
+	}
+	if err := setupNetns(t); err != nil {
+		return nil, err
+	}
+	o.netns = t
+	tornDown := false
+	defer func() {
+		// Only left to do if the run panicked.
+		if !tornDown {
+			_ = o.teardownNetns()
+		}
+	}()
+	results, err := o.orchestrate(ctx)
+	tornDown = true
+	if teardownErr := o.teardownNetns(); teardownErr != nil && err == nil {
+		err = teardownErr
+	}
+	return results, err
+}
+
+// orchestrate runs the processes of the run, and collects their results.
+func (o *orchestration) orchestrate(ctx context.Context) (*RunResults, error) {
+	err := o.run(ctx)
+	for _, c := range o.clients {
+		c.kill()
+	}
+	if o.server == nil {
+		return nil, err
+	}
+	var wg sync.WaitGroup
+	for _, w := range o.workers {
+		wg.Add(1)
+		go func(w *child) {
+			defer wg.Done()
+			w.stop(millisOrDefault(o.cfg.StopTimeoutMillis, defaultStopTimeout))
+		}(w)
+	}
+	wg.Wait()
+	captured := o.stopCapture()
+	results, collectErr := o.collect()
+	if captured {
+		results.Capture = o.captureFile()
+	}
+	results.Features = o.features
+	results.Warnings = o.warnings
+	results.Netns = o.netns
+	if err == nil {
+		err = collectErr
+	}
+	return results, err
+}
+
+// teardownNetns kills the processes still running in the network namespaces of the run, which
+// only panics leave behind, then deletes the namespaces.
+func (o *orchestration) teardownNetns() error {
+	for _, c := range append(append([]*child(nil), o.clients...), o.workers...) {
+		c.kill()
+	}
+	return teardownNetns(o.netns)
+}
+
+// namespaced returns spec to run in the server or the client namespace of the run, with NetnsEnv
+// set, and the namespace, or spec and "" if the run has no namespaces.
+func (o *orchestration) namespaced(spec ProcessSpec, server bool) (ProcessSpec, string) {
+	if o.netns == nil {
+		return spec, ""
+	}
+	spec.Env = append([]string{o.netns.env()}, spec.Env...)
+	if server {
+		return spec, o.netns.ServerNamespace
+	}
+	return spec, o.netns.ClientNamespace
+}
+
+// serverHost returns the host the server is reached at.
+func (o *orchestration) serverHost() string {
+	if o.netns != nil {
+		return o.netns.ServerAddr
+	}
+	return "localhost"
+}
+
+// dial connects the orchestrator to the server at addr, from the client namespace of the run if
+// it has one.
+func (o *orchestration) dial(ctx context.Context, addr string) (net.Conn, error) {
+	if o.netns != nil {
+		return dialInNetns(ctx, o.netns.ClientNamespace, addr)
+	}
+	return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+}
+
+func (o *orchestration) statsFile(name string) string {
+	return filepath.Join(o.cfg.WorkDir, name+".conns.json")
+}
+
+func (o *orchestration) channelzFile(name string) string {
+	return filepath.Join(o.cfg.WorkDir, name+".channelz.json")
+}
+
+func (o *orchestration) outputFile(name string) string {
+	return filepath.Join(o.cfg.WorkDir, name+".records.json")
+}
+
+func (o *orchestration) captureFile() string {
+	return filepath.Join(o.cfg.WorkDir, "capture.pcapng")
+}
+
+func (o *orchestration) clientArgs(spec ProcessSpec, addr string) []string {
+	args := append(append([]string(nil), spec.Args...),
+		"-address="+addr, "-output="+o.outputFile(spec.Name), "-stats_file="+o.statsFile(spec.Name))
+	if o.cfg.HTTPS {
+		args = append(args, "-https")
+	}
+	if o.cfg.Channelz {
+		args = append(args, "-channelz_file="+o.channelzFile(spec.Name))
+	}
+	return args
+}
+
+// startCapture starts capturing the traffic to and from the server, listening on port, if the
+// config asks for it. Failures are recorded as warnings.
+func (o *orchestration) startCapture(port int) {
+	if !o.cfg.Capture {
+		return
+	}
+	iface := o.cfg.CaptureInterface
+	if iface == "" {
+		iface = defaultCaptureInterface
+		if o.netns != nil {
+			iface = o.netns.ServerInterface
+		}
+	}
+	addr := net.JoinHostPort(o.serverHost(), strconv.Itoa(port))
+	comment := fmt.Sprintf("greetworkload run\n%s: %s", o.cfg.serverName(), strings.Join(o.serverArgs, " "))
+	for _, spec := range o.cfg.Clients {
+		comment += fmt.Sprintf("\n%s: %s", spec.Name, strings.Join(o.clientArgs(spec, addr), " "))
+	}
+	var c *packetCapture
+	start := func() error {
+		var err error
+		c, err = startPacketCapture(iface, port, o.captureFile(), comment)
+		return err
+	}
+	var err error
+	if o.netns != nil {
+		err = inNetns(o.netns.ServerNamespace, start)
+	} else {
+		err = start()
+	}
+	if err != nil {
+		o.warnings = append(o.warnings, fmt.Sprintf("packet capture on %s failed to start: %v", iface, err))
+		return
+	}
+	o.capture = c
+}
+
+// stopCapture stops the capture, if one was started, and returns true if its file is complete.
+func (o *orchestration) stopCapture() bool {
+	if o.capture == nil {
+		return false
+	}
+	if err := o.capture.Stop(); err != nil {
+		o.warnings = append(o.warnings, fmt.Sprintf("packet capture failed: %v", err))
+		return false
+	}
+	return true
+}
+
+func (o *orchestration) workerArgs(name string, port int) []string {
+	args := append(append([]string(nil), o.cfg.Server.Args...), "--port="+strconv.Itoa(port), "--stats_file="+o.statsFile(name),
+		"--records_file="+o.outputFile(name))
+	if o.cfg.Workers > 1 {
+		args = append(args, "--reuseport", "--instance_id="+InstanceIDPID)
+	}
+	if o.cfg.HTTPS {
+		args = append(args, "--https")
+	}
+	return args
+}
+
+// startWorkers starts the first worker of the server and waits for it to be ready, then starts
+// the others on its port, and waits for them to listen. It returns the address of the server.
+func (o *orchestration) startWorkers(ctx context.Context) (string, error) {
+	readyCtx, cancel := context.WithTimeout(ctx, millisOrDefault(o.cfg.ReadyTimeoutMillis, defaultReadyTimeout))
+	defer cancel()
+	var addr string
+	port := 0
+	for i, name := range o.cfg.workerNames() {
+		args := o.workerArgs(name, port)
+		stdout := &portWriter{port: make(chan string, 1)}
+		spec := o.cfg.Server
+		spec.Name = name
+		spec, ns := o.namespaced(spec, true)
+		w, err := startChild(spec, args, o.cfg.WorkDir, ns, stdout)
+		if err != nil {
+			return "", err
+		}
+		o.workers = append(o.workers, w)
+		if i > 0 {
+			// The port is shared, so health checks could reach any worker: those after the first
+			// are only waited on to listen, and accept connections from then on.
+			if _, err := waitPort(readyCtx, w, stdout); err != nil {
+				return "", err
+			}
+			continue
+		}
+		o.server = w
+		o.serverArgs = args
+		if port, err = waitPort(readyCtx, w, stdout); err != nil {
+			return "", err
+		}
+		if addr, err = o.waitReady(readyCtx, port); err != nil {
+			return "", err
+		}
+	}
+	return addr, nil
+}
+
+func (o *orchestration) run(ctx context.Context) error {
+	addr, err := o.startWorkers(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	workerExited := make(chan *child, len(o.workers))
+	for _, w := range o.workers {
+		go func(w *child) {
+			<-w.done
+			workerExited <- w
+		}(w)
+	}
+
+	exited := make(chan *child, len(o.cfg.Clients))
+	for _, spec := range o.cfg.Clients {
+		nsSpec, ns := o.namespaced(spec, false)
+		c, err := startChild(nsSpec, o.clientArgs(spec, addr), o.cfg.WorkDir, ns, io.Discard)
+		if err != nil {
+			return err
+		}
+		o.clients = append(o.clients, c)
+		go func() {
+			<-c.done
+			exited <- c
+		}()
+	}
+
+	for remaining := len(o.clients); remaining > 0; remaining-- {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case w := <-workerExited:
+			return w.processError()
+		case c := <-exited:
+			if c.exitCode != 0 {
+				return c.processError()
+			}
+		}
+	}
+	if o.cfg.Channelz {
+		o.snapshotChannelz(ctx, addr)
+	}
+	return nil
+}
+
+// snapshotChannelz writes a channelz snapshot of the server, listening on addr, leaving out the
+// connection it is taken over. Failures are recorded as warnings.
+func (o *orchestration) snapshotChannelz(ctx context.Context, addr string) {
+	var localAddr string
+	dialer := func(ctx context.Context, addr string) (net.Conn, error) {
+		conn, err := o.dial(ctx, addr)
+		if err == nil {
+			localAddr = CanonicalAddr(conn.LocalAddr())
+		}
+		return conn, err
+	}
+	snap, err := func() (*ChannelzSnapshot, error) {
+		conn, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(o.creds()), grpc.WithContextDialer(dialer))
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return FetchChannelz(ctx, conn)
+	}()
+	if err != nil {
+		o.warnings = append(o.warnings, fmt.Sprintf("failed to take a channelz snapshot of the server: %v", err))
+		return
+	}
+	for i := range snap.Servers {
+		var sockets []ChannelzSocket
+		for _, s := range snap.Servers[i].Sockets {
+			if s.RemoteAddr != localAddr {
+				sockets = append(sockets, s)
+			}
+		}
+		snap.Servers[i].Sockets = sockets
+	}
+	err = WriteOutputFile(o.channelzFile(o.server.name), func(w io.Writer) error {
+		return WriteChannelzSnapshot(w, snap)
+	})
+	if err != nil {
+		o.warnings = append(o.warnings, fmt.Sprintf("failed to write the channelz snapshot of the server: %v", err))
+	}
+}
+
+// creds returns the transport credentials the orchestrator connects to the server with.
+func (o *orchestration) creds() credentials.TransportCredentials {
+	if o.cfg.HTTPS {
+		return credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})
+	}
+	return insecure.NewCredentials()
+}
+
+// waitPort waits for the server process w to print its port, and returns it.
+func waitPort(ctx context.Context, w *child, stdout *portWriter) (int, error) {
+	select {
+	case <-ctx.Done():
+		return 0, fmt.Errorf("%s did not print its port: %w", w.name, ctx.Err())
+	case <-w.done:
+		return 0, w.processError()
+	case s := <-stdout.port:
+		port, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return 0, fmt.Errorf("%s printed %q instead of its port", w.name, s)
+		}
+		return port, nil
+	}
+}
+
+// waitReady waits for the server, listening on port, to report SERVING, and returns its address.
+func (o *orchestration) waitReady(ctx context.Context, port int) (string, error) {
+	// Started before the health checks, so that the capture sees every connection from its start.
+	o.startCapture(port)
+	addr := net.JoinHostPort(o.serverHost(), strconv.Itoa(port))
+
+	dialer := func(ctx context.Context, addr string) (net.Conn, error) {
+		conn, err := o.dial(ctx, addr)
+		if err == nil {
+			o.healthAddr = CanonicalAddr(conn.LocalAddr())
+		}
+		return conn, err
+	}
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(o.creds()), grpc.WithContextDialer(dialer))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	health := healthpb.NewHealthClient(conn)
+	for {
+		resp, err := health.Check(ctx, &healthpb.HealthCheckRequest{})
+		if err == nil && resp.Status == healthpb.HealthCheckResponse_SERVING {
+			o.fetchFeatures(ctx, conn)
+			return addr, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("server did not report SERVING: %w", ctx.Err())
+		case <-o.server.done:
+			return "", o.server.processError()
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
+
+// fetchFeatures records the FeatureMatrix of the server. Failures are recorded as warnings.
+func (o *orchestration) fetchFeatures(ctx context.Context, conn *grpc.ClientConn) {
+	m, err := FetchFeatureMatrix(ctx, conn)
+	if err != nil {
+		o.warnings = append(o.warnings, fmt.Sprintf("failed to fetch the server features: %v", err))
+		return
+	}
+	o.features = m
+}
+
+func (o *orchestration) result(c *child) *ProcessResult {
+	r := &ProcessResult{
+		Name:     c.name,
+		PID:      c.cmd.Process.Pid,
+		ExitCode: c.exitCode,
+		Killed:   c.killed,
+		Stderr:   c.stderr.String(),
+	}
+	if cause := ExitCause(c.exitCode); cause != nil {
+		r.Cause = cause.Error()
+	}
+	return r
+}
+
+// collect merges the output files of every process into the results. Missing files are skipped,
+// since failed processes may not have written them.
+func (o *orchestration) collect() (*RunResults, error) {
+	var errs []string
+	results := &RunResults{}
+	for _, w := range o.workers {
+		r := o.result(w)
+		errs = append(errs, o.readOutputs(w.name, r)...)
+		conns := r.Conns[:0]
+		for _, c := range r.Conns {
+			if c.RemoteAddr != o.healthAddr {
+				conns = append(conns, c)
+			}
+		}
+		r.Conns = conns
+		if results.Server == nil {
+			results.Server = r
+		}
+		if len(o.workers) > 1 {
+			results.Workers = append(results.Workers, r)
+		}
+	}
+
+	for _, c := range o.clients {
+		r := o.result(c)
+		errs = append(errs, o.readOutputs(c.name, r)...)
+		results.Clients = append(results.Clients, r)
+	}
+	if len(errs) > 0 {
+		return results, errors.New(strings.Join(errs, "; "))
+	}
+	return results, nil
+}
+
+// readOutputs reads the records, connection stats and channelz snapshot of the process name into
+// r, and returns the errors reading them.
+func (o *orchestration) readOutputs(name string, r *ProcessResult) []string {
+	var errs []string
+	if err := readOutput(o.outputFile(name), func(f io.Reader) error {
+		var err error
+		r.Records, err = ReadRecords(f)
+		return err
+	}); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := readOutput(o.statsFile(name), func(f io.Reader) error {
+		var err error
+		r.Conns, err = ReadConnStats(f)
+		return err
+	}); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := readOutput(o.channelzFile(name), func(f io.Reader) error {
+		var err error
+		r.Channelz, err = ReadChannelzSnapshot(f)
+		return err
+	}); err != nil {
+		errs = append(errs, err.Error())
+	}
+	return errs
+}
+
+// readOutput reads the file at path with read, unless it does not exist.
+func readOutput(path string, read func(io.Reader) error) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := read(f); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,434 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	channelzsvc "google.golang.org/grpc/channelz/service"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+const orchestratorHelperEnv = "GREET_ORCHESTRATOR_HELPER"
+
+// TestOrchestratorHelper is not a test: it stands in for the server and client binaries when the
+// test binary is run by Orchestrate, with its role in GREET_ORCHESTRATOR_HELPER.
+func TestOrchestratorHelper(t *testing.T) {
+	role := os.Getenv(orchestratorHelperEnv)
+	if role == "" {
+		t.Skip("only run by the orchestrator tests")
+	}
+	args := os.Args
+	for i, arg := range args {
+		if arg == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+	fs := flag.NewFlagSet(role, flag.ExitOnError)
+	port := fs.Int("port", 0, "")
+	reusePort := fs.Bool("reuseport", false, "")
+	statsFile := fs.String("stats_file", "", "")
+	recordsFile := fs.String("records_file", "", "")
+	address := fs.String("address", "", "")
+	output := fs.String("output", "", "")
+	instanceID := fs.String("instance_id", "", "")
+	channelzFile := fs.String("channelz_file", "", "")
+	listenHost := fs.String("listen_host", "127.0.0.1", "")
+	_ = fs.Parse(args)
+	meta := greetworkload.NewRunMetadata(0, fs)
+
+	switch role {
+	case "server":
+		helperServer(*listenHost, *port, *reusePort, *statsFile, *recordsFile, greetworkload.ExpandInstanceID(*instanceID))
+	case "client":
+		helperClient(meta, *address, *output, *statsFile, *channelzFile, 1, 3)
+	case "spread":
+		// New connections spread between the workers of a server, calls on a connection do not.
+		helperClient(meta, *address, *output, *statsFile, *channelzFile, 100, 3)
+	case "crash":
+		fmt.Fprintln(os.Stderr, "boom")
+		os.Exit(3)
+	case "dialfail":
+		os.Exit(greetworkload.ExitCode(greetworkload.ErrDialFailed))
+	case "hang":
+		select {}
+	}
+	os.Exit(0)
+}
+
+func writeHelperConnStats(path string, connStats *greetworkload.ConnStatsHandler) {
+	f, err := os.Create(path)
+	if err != nil {
+		os.Exit(2)
+	}
+	defer f.Close()
+	if err := greetworkload.WriteConnStats(f, nil, connStats.Conns()); err != nil {
+		os.Exit(2)
+	}
+}
+
+func writeHelperRecords(path string, meta *greetworkload.RunMetadata, records []*greetworkload.CallRecord) {
+	f, err := os.Create(path)
+	if err != nil {
+		os.Exit(2)
+	}
+	defer f.Close()
+	if err := greetworkload.WriteRecords(f, meta, records); err != nil {
+		os.Exit(2)
+	}
+}
+
+func helperServer(host string, port int, reusePort bool, statsFile, recordsFile, instanceID string) {
+	listenOpts := &greetworkload.ListenOptions{Host: host, Socket: &greetworkload.SocketOptions{ReusePort: reusePort}}
+	lis, err := listenOpts.Listen(port)
+	if err != nil {
+		os.Exit(2)
+	}
+	connStats := greetworkload.NewConnStatsHandler()
+	tracer := greetworkload.NewRequestTracer(&greetworkload.RequestTracerOptions{KeepRecords: true})
+	s := grpc.NewServer(grpc.StatsHandler(connStats), grpc.UnaryInterceptor(tracer.UnaryServerInterceptor()))
+	pb.RegisterGreeterServer(s, greetworkload.NewServer(&greetworkload.ServerOptions{InstanceID: instanceID}))
+	healthpb.RegisterHealthServer(s, health.NewServer())
+	pb.RegisterGreeterFeaturesServer(s, greetworkload.NewFeatureServer(&pb.FeatureMatrix{InstanceId: instanceID}, nil))
+	channelzsvc.RegisterChannelzServiceToServer(s)
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGTERM)
+		<-ch
+		s.GracefulStop()
+	}()
+	fmt.Println(lis.Addr().(*net.TCPAddr).Port)
+	_ = s.Serve(lis)
+	writeHelperConnStats(statsFile, connStats)
+	writeHelperRecords(recordsFile, nil, tracer.Records())
+}
+
+// helperClient calls SayHello calls times over each of conns connections, one after the other,
+// and writes its records with meta.
+func helperClient(meta *greetworkload.RunMetadata, address, output, statsFile, channelzFile string, conns, calls int) {
+	connStats := greetworkload.NewConnStatsHandler()
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	var records []*greetworkload.CallRecord
+	for i := 0; i < conns; i++ {
+		conn, err := c.Dial(address, grpc.WithStatsHandler(connStats))
+		if err != nil {
+			os.Exit(2)
+		}
+		for j := 0; j < calls; j++ {
+			records = append(records, c.SayHello(conn, "pixie"))
+		}
+		conn.Close()
+	}
+
+	writeHelperRecords(output, meta, records)
+	writeHelperConnStats(statsFile, connStats)
+	if channelzFile != "" {
+		writeHelperChannelz(channelzFile)
+	}
+}
+
+func writeHelperChannelz(path string) {
+	snap, err := greetworkload.LocalChannelz(context.Background())
+	if err != nil {
+		os.Exit(2)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		os.Exit(2)
+	}
+	defer f.Close()
+	if err := greetworkload.WriteChannelzSnapshot(f, snap); err != nil {
+		os.Exit(2)
+	}
+}
+
+func helperSpec(name, role string) greetworkload.ProcessSpec {
+	return greetworkload.ProcessSpec{
+		Name: name,
+		Path: os.Args[0],
+		Args: []string{"-test.run=^TestOrchestratorHelper$", "--"},
+		Env:  []string{orchestratorHelperEnv + "=" + role},
+	}
+}
+
+func orchestrate(t *testing.T, ctx context.Context, clients ...greetworkload.ProcessSpec) (*greetworkload.RunResults, error) {
+	cfg := &greetworkload.OrchestratorConfig{
+		Server:            helperSpec("server", "server"),
+		Clients:           clients,
+		WorkDir:           t.TempDir(),
+		StopTimeoutMillis: 5000,
+	}
+	return greetworkload.Orchestrate(ctx, cfg)
+}
+
+// assertExited checks that no process of the run is left behind.
+func assertExited(t *testing.T, results *greetworkload.RunResults) {
+	for _, r := range append([]*greetworkload.ProcessResult{results.Server}, results.Clients...) {
+		// Windows does not find processes that are gone, and other platforms find them done.
+		if p, err := os.FindProcess(r.PID); err == nil {
+			assert.ErrorIs(t, p.Signal(syscall.Signal(0)), os.ErrProcessDone, "%s is still running", r.Name)
+		}
+	}
+}
+
+func TestOrchestrate_MergesResults(t *testing.T) {
+	results, err := orchestrate(t, context.Background(), helperSpec("a", "client"), helperSpec("b", "client"))
+	require.NoError(t, err)
+	assertExited(t, results)
+
+	assert.Equal(t, 0, results.Server.ExitCode)
+	require.Len(t, results.Clients, 2)
+	clientAddrs := map[string]bool{}
+	requestIDs := map[string]bool{}
+	for _, c := range results.Clients {
+		assert.Equal(t, 0, c.ExitCode, c.Stderr)
+		assert.False(t, c.Killed)
+		require.Len(t, c.Records, 3)
+		for _, r := range c.Records {
+			assert.True(t, r.Completed(), r.Error)
+			assert.Equal(t, 1, r.Attempt)
+			requestIDs[r.RequestID] = true
+		}
+		require.Len(t, c.Conns, 1)
+		clientAddrs[c.Conns[0].LocalAddr] = true
+	}
+	// The health check connection is left out.
+	serverAddrs := map[string]bool{}
+	for _, c := range results.Server.Conns {
+		serverAddrs[c.RemoteAddr] = true
+	}
+	assert.Equal(t, clientAddrs, serverAddrs)
+	// Every call is in the records of both sides, and the health checks are left out.
+	serverIDs := map[string]bool{}
+	for _, r := range results.Server.Records {
+		assert.Equal(t, 1, r.Attempt)
+		serverIDs[r.RequestID] = true
+	}
+	assert.Len(t, requestIDs, 6)
+	assert.Equal(t, requestIDs, serverIDs)
+}
+
+func TestOrchestrate_ClientFailureKillsRun(t *testing.T) {
+	results, err := orchestrate(t, context.Background(), helperSpec("crash", "crash"), helperSpec("hang", "hang"))
+	var procErr *greetworkload.ProcessError
+	require.ErrorAs(t, err, &procErr)
+	assert.Equal(t, "crash", procErr.Name)
+	assert.Equal(t, 3, procErr.ExitCode)
+	assert.Contains(t, procErr.Stderr, "boom")
+
+	require.NotNil(t, results)
+	assertExited(t, results)
+	require.Len(t, results.Clients, 2)
+	assert.Equal(t, 3, results.Clients[0].ExitCode)
+	assert.False(t, results.Clients[0].Killed)
+	assert.True(t, results.Clients[1].Killed)
+	assert.Equal(t, -1, results.Clients[1].ExitCode)
+	assert.False(t, results.Server.Killed)
+}
+
+func TestOrchestrate_SurfacesCause(t *testing.T) {
+	results, err := orchestrate(t, context.Background(), helperSpec("a", "dialfail"))
+	assert.ErrorIs(t, err, greetworkload.ErrDialFailed)
+	var procErr *greetworkload.ProcessError
+	require.ErrorAs(t, err, &procErr)
+	assert.Equal(t, "a", procErr.Name)
+	assert.Equal(t, greetworkload.ExitDialFailed, procErr.ExitCode)
+
+	require.NotNil(t, results)
+	require.Len(t, results.Clients, 1)
+	assert.Equal(t, greetworkload.ErrDialFailed.Error(), results.Clients[0].Cause)
+	assert.Empty(t, results.Server.Cause)
+}
+
+func TestOrchestrate_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	results, err := orchestrate(t, ctx, helperSpec("hang", "hang"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	require.NotNil(t, results)
+	assertExited(t, results)
+	assert.True(t, results.Clients[0].Killed)
+}
+
+func TestOrchestrate_ServerNotReady(t *testing.T) {
+	cfg := &greetworkload.OrchestratorConfig{
+		Server:  helperSpec("server", "crash"),
+		Clients: []greetworkload.ProcessSpec{helperSpec("a", "client")},
+		WorkDir: t.TempDir(),
+	}
+	results, err := greetworkload.Orchestrate(context.Background(), cfg)
+	var procErr *greetworkload.ProcessError
+	require.ErrorAs(t, err, &procErr)
+	assert.Equal(t, "server", procErr.Name)
+	assert.Empty(t, results.Clients)
+	stderr, err := os.ReadFile(filepath.Join(cfg.WorkDir, "server.stderr"))
+	require.NoError(t, err)
+	assert.Contains(t, string(stderr), "boom")
+}
+
+func TestOrchestratorConfig_Validate(t *testing.T) {
+	valid := func() *greetworkload.OrchestratorConfig {
+		return &greetworkload.OrchestratorConfig{
+			Server:  greetworkload.ProcessSpec{Path: "server"},
+			Clients: []greetworkload.ProcessSpec{{Name: "a", Path: "client"}},
+			WorkDir: "/tmp",
+		}
+	}
+	assert.NoError(t, valid().Validate())
+	for name, mutate := range map[string]func(*greetworkload.OrchestratorConfig){
+		"no server":        func(c *greetworkload.OrchestratorConfig) { c.Server.Path = "" },
+		"no clients":       func(c *greetworkload.OrchestratorConfig) { c.Clients = nil },
+		"no work dir":      func(c *greetworkload.OrchestratorConfig) { c.WorkDir = "" },
+		"unnamed client":   func(c *greetworkload.OrchestratorConfig) { c.Clients[0].Name = "" },
+		"client as server": func(c *greetworkload.OrchestratorConfig) { c.Clients[0].Name = "server" },
+		"path in name":     func(c *greetworkload.OrchestratorConfig) { c.Clients[0].Name = "../a" },
+		"negative timeout": func(c *greetworkload.OrchestratorConfig) { c.StopTimeoutMillis = -1 },
+		"negative workers": func(c *greetworkload.OrchestratorConfig) { c.Workers = -1 },
+		"netns mtu":        func(c *greetworkload.OrchestratorConfig) { c.Netns = &greetworkload.NetnsOptions{MTU: 1} },
+		"channelz workers": func(c *greetworkload.OrchestratorConfig) {
+			c.Workers = 2
+			c.Channelz = true
+		},
+		"client as worker": func(c *greetworkload.OrchestratorConfig) {
+			c.Workers = 2
+			c.Clients[0].Name = "server-2"
+		},
+		"duplicate client": func(c *greetworkload.OrchestratorConfig) {
+			c.Clients = append(c.Clients, greetworkload.ProcessSpec{Name: "a", Path: "client"})
+		},
+	} {
+		cfg := valid()
+		mutate(cfg)
+		assert.Error(t, cfg.Validate(), name)
+	}
+}
+
+func TestOrchestrate_RecordsFeatures(t *testing.T) {
+	server := helperSpec("server", "server")
+	server.Args = append(server.Args, "--instance_id=orchestrated")
+	results, err := greetworkload.Orchestrate(context.Background(), &greetworkload.OrchestratorConfig{
+		Server:            server,
+		Clients:           []greetworkload.ProcessSpec{helperSpec("a", "client")},
+		WorkDir:           t.TempDir(),
+		StopTimeoutMillis: 5000,
+	})
+	require.NoError(t, err)
+	assert.Empty(t, results.Warnings)
+	require.NotNil(t, results.Features)
+	assert.Equal(t, "orchestrated", results.Features.InstanceId)
+
+	// Fetching the features is not a call of the workload.
+	assert.Len(t, results.Server.Records, 3)
+}
+
+func TestOrchestrate_Channelz(t *testing.T) {
+	results, err := greetworkload.Orchestrate(context.Background(), &greetworkload.OrchestratorConfig{
+		Server:            helperSpec("server", "server"),
+		Clients:           []greetworkload.ProcessSpec{helperSpec("a", "client")},
+		WorkDir:           t.TempDir(),
+		StopTimeoutMillis: 5000,
+		Channelz:          true,
+	})
+	require.NoError(t, err)
+	assert.Empty(t, results.Warnings)
+
+	require.NotNil(t, results.Server.Channelz)
+	require.Len(t, results.Server.Channelz.Servers, 1)
+	// The health checks and the snapshot itself are calls too.
+	assert.GreaterOrEqual(t, results.Server.Channelz.Servers[0].CallsSucceeded, int64(3))
+	// The client has closed its connection, and the one the snapshot is taken over is left out.
+	assert.Empty(t, results.Server.Channelz.Sockets())
+	require.Len(t, results.Clients, 1)
+	assert.NotNil(t, results.Clients[0].Channelz)
+}
+
+func TestOrchestrate_Workers(t *testing.T) {
+	if err := greetworkload.CheckPlatform(greetworkload.FeatureReusePort); err != nil {
+		t.Skip(err)
+	}
+	results, err := greetworkload.Orchestrate(context.Background(), &greetworkload.OrchestratorConfig{
+		Server:            helperSpec("server", "server"),
+		Workers:           3,
+		Clients:           []greetworkload.ProcessSpec{helperSpec("a", "spread")},
+		WorkDir:           t.TempDir(),
+		StopTimeoutMillis: 5000,
+	})
+	require.NoError(t, err)
+	require.Len(t, results.Workers, 3)
+	assert.Same(t, results.Workers[0], results.Server)
+	assertExited(t, &greetworkload.RunResults{Server: results.Server, Clients: results.Workers})
+
+	client := results.Clients[0]
+	require.Len(t, client.Records, 300)
+	for _, r := range client.Records {
+		require.True(t, r.Completed(), r.Error)
+	}
+	tally := greetworkload.TallyInstances(client.Records)
+	assert.Len(t, tally, 3)
+
+	var workerCalls, workerBytesIn, workerBytesOut int64
+	workerAddrs := map[string]bool{}
+	for i, w := range results.Workers {
+		assert.Equal(t, fmt.Sprintf("server-%d", i+1), w.Name)
+		assert.Equal(t, 0, w.ExitCode, w.Stderr)
+		// Every worker answered its own share, stamped with its PID.
+		served := tally[strconv.Itoa(w.PID)]
+		assert.Greater(t, served, 30, "worker %s", w.Name)
+		assert.Len(t, w.Records, served, "worker %s", w.Name)
+		for _, c := range w.Conns {
+			workerCalls += c.RPCsCompleted
+			workerBytesIn += c.WireBytesIn
+			workerBytesOut += c.WireBytesOut
+			workerAddrs[c.RemoteAddr] = true
+		}
+	}
+
+	// The workers saw, together, what the client did.
+	var clientCalls, clientBytesIn, clientBytesOut int64
+	clientAddrs := map[string]bool{}
+	for _, c := range client.Conns {
+		clientCalls += c.RPCsCompleted
+		clientBytesIn += c.WireBytesIn
+		clientBytesOut += c.WireBytesOut
+		clientAddrs[c.LocalAddr] = true
+	}
+	assert.Equal(t, int64(300), clientCalls)
+	assert.Equal(t, clientCalls, workerCalls)
+	assert.Equal(t, clientBytesOut, workerBytesIn)
+	assert.Equal(t, clientBytesIn, workerBytesOut)
+	assert.Len(t, clientAddrs, 100)
+	assert.Equal(t, clientAddrs, workerAddrs)
+}
@@ -0,0 +1,245 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+)
+
+// The budgets a call may exceed, as recorded in CallRecord.TimeoutBudget.
+const (
+	// BudgetDial is ClientOptions.DialTimeout.
+	BudgetDial = "dial"
+	// BudgetHeader is ClientOptions.HeaderTimeout.
+	BudgetHeader = "header"
+	// BudgetDeadline is the deadline of the call, ClientOptions.Timeout unless overridden.
+	BudgetDeadline = "deadline"
+)
+
+// TimeoutStats counts the calls that exceeded each of their budgets.
+type TimeoutStats struct {
+	Dial     int64
+	Header   int64
+	Deadline int64
+}
+
+// TimeoutStats returns the number of calls that exceeded each of their budgets so far.
+func (c *Client) TimeoutStats() TimeoutStats {
+	return TimeoutStats{
+		Dial:     atomic.LoadInt64(&c.timeouts.Dial),
+		Header:   atomic.LoadInt64(&c.timeouts.Header),
+		Deadline: atomic.LoadInt64(&c.timeouts.Deadline),
+	}
+}
+
+type phasesKey struct{}
+
+// callPhases follows a call through its phases, from the events the stats handler of its
+// connection sees, and ends its budget context once it spends longer than its budget in one.
+type callPhases struct {
+	start time.Time
+	// deadline is the deadline of the call, if hasDeadline.
+	deadline    time.Time
+	hasDeadline bool
+	// budget is the context of the call while it keeps to its budgets, nil without any.
+	budget        *budgetContext
+	headerTimeout time.Duration
+
+	mu sync.Mutex
+	// timer ends budget once the current phase goes over its budget.
+	timer *time.Timer
+	// dial, headers and message are how long after start the call reached each phase, zero until
+	// it does.
+	dial, headers, message time.Duration
+	exceeded               string
+}
+
+// withPhases returns ctx, which must hold the deadline of the call of r, set up to follow the call
+// through its phases, and to fail it once it exceeds ClientOptions.DialTimeout or HeaderTimeout.
+// The phases are recorded in r once c.finish records it.
+func (c *Client) withPhases(ctx context.Context, r *CallRecord) context.Context {
+	p := &callPhases{start: r.StartTime, headerTimeout: c.opts.HeaderTimeout}
+	p.deadline, p.hasDeadline = ctx.Deadline()
+	if c.opts.DialTimeout > 0 || c.opts.HeaderTimeout > 0 {
+		p.budget = newBudgetContext(ctx)
+		ctx = p.budget
+	}
+	if c.opts.DialTimeout > 0 {
+		p.timer = time.AfterFunc(c.opts.DialTimeout, func() { p.exceed(BudgetDial) })
+	}
+	r.phases = p
+	return context.WithValue(ctx, phasesKey{}, p)
+}
+
+// exceed fails the call for going over budget, unless it is no longer in the phase of budget.
+func (p *callPhases) exceed(budget string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.exceeded != "":
+		return
+	case budget == BudgetDial && p.dial != 0:
+		return
+	case budget == BudgetHeader && p.headers != 0:
+		return
+	}
+	p.exceeded = budget
+	p.budget.end(context.DeadlineExceeded)
+}
+
+// observePhase records the phase the call reaches with s, which the stats handler of its connection
+// saw with ctx.
+func observePhase(ctx context.Context, s stats.RPCStats) {
+	if !s.IsClient() {
+		return
+	}
+	p, ok := ctx.Value(phasesKey{}).(*callPhases)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	since := time.Since(p.start)
+	switch s.(type) {
+	case *stats.OutHeader:
+		// Retried attempts send headers again, the call got its connection with the first.
+		if p.dial != 0 {
+			return
+		}
+		p.dial = since
+		p.stopTimer()
+		if p.headerTimeout > 0 && p.exceeded == "" {
+			p.timer = time.AfterFunc(p.headerTimeout, func() { p.exceed(BudgetHeader) })
+		}
+	case *stats.InHeader, *stats.InTrailer:
+		// A call that fails at once gets its status in trailers alone.
+		if p.headers != 0 {
+			return
+		}
+		p.headers = since
+		p.stopTimer()
+	case *stats.InPayload:
+		if p.message == 0 {
+			p.message = since
+		}
+	}
+}
+
+// stopTimer stops the budget of the current phase. p.mu must be held.
+func (p *callPhases) stopTimer() {
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+}
+
+// record records the phases of the call of r, which finished with code, and counts in c the
+// budget it exceeded, if any.
+func (p *callPhases) record(c *Client, r *CallRecord, code codes.Code) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopTimer()
+	r.DialNS = p.dial.Nanoseconds()
+	r.HeadersNS = p.headers.Nanoseconds()
+	r.MessageNS = p.message.Nanoseconds()
+	if code != codes.DeadlineExceeded {
+		return
+	}
+	// Servers may answer with DEADLINE_EXCEEDED too, which is not a budget of the call.
+	switch {
+	case p.exceeded != "":
+		r.TimeoutBudget = p.exceeded
+	case p.hasDeadline && !time.Now().Before(p.deadline):
+		r.TimeoutBudget = BudgetDeadline
+	}
+	switch r.TimeoutBudget {
+	case BudgetDial:
+		atomic.AddInt64(&c.timeouts.Dial, 1)
+	case BudgetHeader:
+		atomic.AddInt64(&c.timeouts.Header, 1)
+	case BudgetDeadline:
+		atomic.AddInt64(&c.timeouts.Deadline, 1)
+	}
+}
+
+// phaseHandler is the stats handler of the connections a Client dials, unless they are dialed
+// with one of their own, which must pass the events of RPCs on to observePhase for calls to be
+// followed through their phases, as ConnStatsHandler does.
+type phaseHandler struct{}
+
+// TagRPC implements stats.Handler.
+func (phaseHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context { return ctx }
+
+// HandleRPC implements stats.Handler.
+func (phaseHandler) HandleRPC(ctx context.Context, s stats.RPCStats) { observePhase(ctx, s) }
+
+// TagConn implements stats.Handler.
+func (phaseHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context { return ctx }
+
+// HandleConn implements stats.Handler.
+func (phaseHandler) HandleConn(context.Context, stats.ConnStats) {}
+
+// budgetContext is a context done with its parent, or once end is called, with the error given.
+// Unlike a context made with context.WithCancel, it can end with context.DeadlineExceeded, so that
+// gRPC fails its call with DEADLINE_EXCEEDED.
+type budgetContext struct {
+	context.Context
+	done chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+func newBudgetContext(parent context.Context) *budgetContext {
+	b := &budgetContext{Context: parent, done: make(chan struct{})}
+	go func() {
+		select {
+		case <-parent.Done():
+			b.end(parent.Err())
+		case <-b.done:
+		}
+	}()
+	return b
+}
+
+func (b *budgetContext) end(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		b.err = err
+		close(b.done)
+	}
+}
+
+// Done implements context.Context.
+func (b *budgetContext) Done() <-chan struct{} {
+	return b.done
+}
+
+// Err implements context.Context.
+func (b *budgetContext) Err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// The names that have startStallingServer stall a call.
+const (
+	// stallHeaders holds the call without sending the response headers.
+	stallHeaders = "stall-headers"
+	// stallMessage sends the response headers, and holds the call without sending the reply.
+	stallMessage = "stall-message"
+	// deadlineStatus fails the call with DEADLINE_EXCEEDED at once.
+	deadlineStatus = "deadline-status"
+)
+
+// startStallingServer starts a Greeter that stalls the calls greeting stallHeaders or
+// stallMessage until they are cancelled.
+func startStallingServer(t *testing.T) string {
+	stall := func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		switch req.(*pb.HelloRequest).Name {
+		case stallHeaders:
+		case stallMessage:
+			if err := grpc.SendHeader(ctx, metadata.Pairs("stalled", "true")); err != nil {
+				return nil, err
+			}
+		case deadlineStatus:
+			return nil, status.Error(codes.DeadlineExceeded, "not the client's deadline")
+		default:
+			return handler(ctx, req)
+		}
+		<-ctx.Done()
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	return startServerWith(t, &serverSetup{GRPC: []grpc.ServerOption{grpc.UnaryInterceptor(stall)}}).Addr
+}
+
+// startSilentListener accepts connections, and never sends anything over them, not even the
+// SETTINGS frame that would have clients consider them established.
+func startSilentListener(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		lis.Close()
+		wg.Wait()
+	})
+	return lis.Addr().String()
+}
+
+func TestPhases_CompletedCall(t *testing.T) {
+	addr := startStallingServer(t)
+	for _, dialOpts := range [][]grpc.DialOption{
+		nil,
+		// A stats handler of their own replaces the Client's.
+		{grpc.WithStatsHandler(greetworkload.NewConnStatsHandler())},
+	} {
+		c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, DialTimeout: time.Second, HeaderTimeout: time.Second})
+		conn, err := c.Dial(addr, dialOpts...)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		r := c.SayHello(conn, "pixie")
+		require.True(t, r.Completed(), r.Error)
+		assert.Positive(t, r.DialNS)
+		assert.GreaterOrEqual(t, r.HeadersNS, r.DialNS)
+		assert.GreaterOrEqual(t, r.MessageNS, r.HeadersNS)
+		assert.LessOrEqual(t, r.MessageNS, r.DurationNS)
+		assert.Empty(t, r.TimeoutBudget)
+		assert.Equal(t, greetworkload.TimeoutStats{}, c.TimeoutStats())
+	}
+}
+
+func TestPhases_ClassifiesTimeouts(t *testing.T) {
+	stalling := startStallingServer(t)
+	silent := startSilentListener(t)
+	for _, tc := range []struct {
+		desc   string
+		addr   string
+		name   string
+		opts   greetworkload.ClientOptions
+		budget string
+		// reached are the phases the call reached: dial, headers, and message.
+		reached [3]bool
+		stats   greetworkload.TimeoutStats
+	}{
+		{
+			desc:   "no settings",
+			addr:   silent,
+			name:   "pixie",
+			opts:   greetworkload.ClientOptions{Timeout: 5 * time.Second, DialTimeout: 100 * time.Millisecond, HeaderTimeout: time.Second},
+			budget: greetworkload.BudgetDial,
+			stats:  greetworkload.TimeoutStats{Dial: 1},
+		},
+		{
+			desc:    "headers stalled",
+			addr:    stalling,
+			name:    stallHeaders,
+			opts:    greetworkload.ClientOptions{Timeout: 5 * time.Second, DialTimeout: time.Second, HeaderTimeout: 100 * time.Millisecond},
+			budget:  greetworkload.BudgetHeader,
+			reached: [3]bool{true, false, false},
+			stats:   greetworkload.TimeoutStats{Header: 1},
+		},
+		{
+			desc:    "message stalled",
+			addr:    stalling,
+			name:    stallMessage,
+			opts:    greetworkload.ClientOptions{Timeout: 300 * time.Millisecond, DialTimeout: time.Second, HeaderTimeout: 100 * time.Millisecond},
+			budget:  greetworkload.BudgetDeadline,
+			reached: [3]bool{true, true, false},
+			stats:   greetworkload.TimeoutStats{Deadline: 1},
+		},
+		{
+			desc:    "headers stalled without budgets",
+			addr:    stalling,
+			name:    stallHeaders,
+			opts:    greetworkload.ClientOptions{Timeout: 300 * time.Millisecond},
+			budget:  greetworkload.BudgetDeadline,
+			reached: [3]bool{true, false, false},
+			stats:   greetworkload.TimeoutStats{Deadline: 1},
+		},
+		{
+			// The server's DEADLINE_EXCEEDED is not one of the call's budgets.
+			desc:    "deadline status",
+			addr:    stalling,
+			name:    deadlineStatus,
+			opts:    greetworkload.ClientOptions{Timeout: 5 * time.Second, DialTimeout: time.Second, HeaderTimeout: time.Second},
+			reached: [3]bool{true, true, false},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := greetworkload.NewClient(&tc.opts)
+			conn, err := c.Dial(tc.addr)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			start := time.Now()
+			r := c.SayHello(conn, tc.name)
+			assert.Less(t, time.Since(start), 3*time.Second)
+			assert.Equal(t, codes.DeadlineExceeded.String(), r.Code, r.Error)
+			assert.False(t, r.Cancelled)
+			assert.Equal(t, tc.budget, r.TimeoutBudget)
+			assert.Equal(t, tc.reached, [3]bool{r.DialNS > 0, r.HeadersNS > 0, r.MessageNS > 0})
+			assert.Equal(t, tc.stats, c.TimeoutStats())
+		})
+	}
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+)
+
+// The features of the workload that only some platforms support. The client and the server
+// build and run everywhere Go does, without them.
+const (
+	// FeatureSocketBuffers sets SO_SNDBUF and SO_RCVBUF, see SocketOptions.SendBuffer.
+	FeatureSocketBuffers = "socket_buffers"
+	// FeatureReusePort sets SO_REUSEPORT, see SocketOptions.ReusePort.
+	FeatureReusePort = "reuseport"
+	// FeatureSocketState reads back the socket options of connections, see ReadSocketState.
+	FeatureSocketState = "socket_state"
+	// FeaturePacketCapture captures the packets of a run, see OrchestratorConfig.Capture.
+	FeaturePacketCapture = "packet_capture"
+	// FeatureMonotonicClock reads CLOCK_MONOTONIC, see Clock.MonoNS.
+	FeatureMonotonicClock = "monotonic_clock"
+	// FeatureFaultReloadSignal re-reads fault configs on a signal, see FaultReloadSignal.
+	FeatureFaultReloadSignal = "fault_reload_signal"
+	// FeatureNetns runs the server and clients of a run in network namespaces, see
+	// OrchestratorConfig.Netns.
+	FeatureNetns = "netns"
+	// FeatureHandoff hands the listening sockets of a server off to a new process on a signal, see
+	// StartHandoff.
+	FeatureHandoff = "handoff"
+	// FeatureRequestRingDumpSignal dumps the request ring of a server on a signal, see
+	// RequestRingDumpSignal.
+	FeatureRequestRingDumpSignal = "request_ring_dump_signal"
+	// FeatureHTTP3 serves and makes calls over the experimental HTTP/3 transport, see
+	// HTTP3Server. Only the binaries built with Go 1.21 or later support it.
+	FeatureHTTP3 = "http3"
+)
+
+// platformFeatures tells which features the platform the workload is built for supports.
+var platformFeatures = map[string]bool{
+	FeatureSocketBuffers:         socketOptionsSupported,
+	FeatureReusePort:             socketOptionsSupported,
+	FeatureSocketState:           socketOptionsSupported,
+	FeaturePacketCapture:         packetCaptureSupported,
+	FeatureMonotonicClock:        monotonicClockSupported,
+	FeatureFaultReloadSignal:     faultReloadSignal != nil,
+	FeatureNetns:                 netnsSupported,
+	FeatureHandoff:               handoffSignal != nil,
+	FeatureRequestRingDumpSignal: requestRingDumpSignal != nil,
+	FeatureHTTP3:                 http3Supported,
+}
+
+// ErrUnsupportedPlatform is what every UnsupportedPlatformError is.
+var ErrUnsupportedPlatform = errors.New("not supported on this platform")
+
+// UnsupportedPlatformError reports a feature that was asked for on a platform that does not
+// support it.
+type UnsupportedPlatformError struct {
+	// Feature is the feature asked for, e.g. FeatureReusePort.
+	Feature string
+	// GOOS is the platform, e.g. "darwin".
+	GOOS string
+}
+
+func (e *UnsupportedPlatformError) Error() string {
+	return fmt.Sprintf("%s is not supported on %s", e.Feature, e.GOOS)
+}
+
+// Is makes every UnsupportedPlatformError an ErrUnsupportedPlatform.
+func (e *UnsupportedPlatformError) Is(target error) bool {
+	return target == ErrUnsupportedPlatform
+}
+
+func unsupportedPlatform(feature string) error {
+	return &UnsupportedPlatformError{Feature: feature, GOOS: runtime.GOOS}
+}
+
+// PlatformFeatures returns every feature that only some platforms support, sorted.
+func PlatformFeatures() []string {
+	features := make([]string, 0, len(platformFeatures))
+	for f := range platformFeatures {
+		features = append(features, f)
+	}
+	sort.Strings(features)
+	return features
+}
+
+// CheckPlatform returns an UnsupportedPlatformError if the platform does not support feature.
+func CheckPlatform(feature string) error {
+	supported, ok := platformFeatures[feature]
+	if !ok {
+		return fmt.Errorf("unknown platform feature %q", feature)
+	}
+	if !supported {
+		return unsupportedPlatform(feature)
+	}
+	return nil
+}
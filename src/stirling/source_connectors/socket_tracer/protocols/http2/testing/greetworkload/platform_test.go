@@ -0,0 +1,79 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+func TestUnsupportedPlatformError(t *testing.T) {
+	var err error = &greetworkload.UnsupportedPlatformError{Feature: greetworkload.FeatureReusePort, GOOS: "plan9"}
+	assert.EqualError(t, err, "reuseport is not supported on plan9")
+	assert.ErrorIs(t, err, greetworkload.ErrUnsupportedPlatform)
+	assert.False(t, errors.Is(errors.New("other"), greetworkload.ErrUnsupportedPlatform))
+}
+
+func TestCheckPlatform(t *testing.T) {
+	features := greetworkload.PlatformFeatures()
+	assert.IsIncreasing(t, features)
+	for _, f := range features {
+		err := greetworkload.CheckPlatform(f)
+		if runtime.GOOS == "linux" {
+			assert.NoError(t, err, f)
+			continue
+		}
+		var perr *greetworkload.UnsupportedPlatformError
+		if errors.As(err, &perr) {
+			assert.Equal(t, f, perr.Feature)
+			assert.Equal(t, runtime.GOOS, perr.GOOS)
+		} else {
+			assert.NoError(t, err, f)
+		}
+	}
+
+	err := greetworkload.CheckPlatform("teleport")
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, greetworkload.ErrUnsupportedPlatform)
+}
+
+func TestCheckPlatform_AgreesWithFeatures(t *testing.T) {
+	assert.Equal(t, greetworkload.CheckPlatform(greetworkload.FeatureReusePort),
+		(&greetworkload.SocketOptions{ReusePort: true}).Validate())
+	assert.Equal(t, greetworkload.CheckPlatform(greetworkload.FeatureSocketBuffers),
+		(&greetworkload.SocketOptions{SendBuffer: 1024}).Validate())
+
+	sig, err := greetworkload.FaultReloadSignal()
+	assert.Equal(t, greetworkload.CheckPlatform(greetworkload.FeatureFaultReloadSignal), err)
+	assert.Equal(t, err == nil, sig != nil)
+
+	sig, err = greetworkload.HandoffSignal()
+	assert.Equal(t, greetworkload.CheckPlatform(greetworkload.FeatureHandoff), err)
+	assert.Equal(t, err == nil, sig != nil)
+
+	sig, err = greetworkload.RequestRingDumpSignal()
+	assert.Equal(t, greetworkload.CheckPlatform(greetworkload.FeatureRequestRingDumpSignal), err)
+	assert.Equal(t, err == nil, sig != nil)
+}
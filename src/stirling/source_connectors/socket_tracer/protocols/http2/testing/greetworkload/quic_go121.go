@@ -0,0 +1,1097 @@
+//go:build go1.21
+// +build go1.21
+
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+// This file is a minimal QUIC version 1 transport, just enough to carry the HTTP/3 calls of
+// http3_go121.go between a client and a server on the same host. The TLS handshake is that of the
+// QUIC support of crypto/tls, and packets are protected as RFC 9001 specifies, so that the
+// traffic is that of any QUIC connection up to the frames it carries. Everything that only
+// matters off loopback is left out:
+//   - Lost packets are never retransmitted. Every packet received is acknowledged, and the ACK
+//     frames received are ignored.
+//   - There is no congestion control, and no flow control beyond the large limits advertised.
+//   - Connections are told apart by the address of their peer, as nothing migrates on loopback.
+//     CRYPTO and STREAM data received out of order is dropped.
+//   - There is no Retry, version negotiation, 0-RTT, key update, idle timeout or stateless reset.
+//     The only frames understood are PADDING, PING, ACK, CRYPTO, STREAM, HANDSHAKE_DONE and
+//     CONNECTION_CLOSE, and the others close the connection.
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	quicVersion1  = 0x00000001
+	quicConnIDLen = 8
+	// Every packet is sent with a 4 byte packet number, so that header protection always finds
+	// its sample.
+	quicPacketNumberLen = 4
+	// quicMinInitialDatagram is the size client Initial packets are padded to.
+	quicMinInitialDatagram = 1200
+	// quicMaxFrameData is the most data a CRYPTO or STREAM frame carries, so that every packet
+	// fits in quicMinInitialDatagram with its headers and ACK frame.
+	quicMaxFrameData = 1000
+	// quicMaxDatagram is the largest datagram read.
+	quicMaxDatagram = 65536
+)
+
+// The long header packet types.
+const (
+	quicPacketInitial   = 0x0
+	quicPacketHandshake = 0x2
+)
+
+// The frame types, STREAM frames having the bits of quicStreamFin, quicStreamLen and
+// quicStreamOff added.
+const (
+	quicFramePadding          = 0x00
+	quicFramePing             = 0x01
+	quicFrameAck              = 0x02
+	quicFrameAckECN           = 0x03
+	quicFrameCrypto           = 0x06
+	quicFrameStream           = 0x08
+	quicFrameStreamMax        = 0x0f
+	quicFrameConnectionClose  = 0x1c
+	quicFrameApplicationClose = 0x1d
+	quicFrameHandshakeDone    = 0x1e
+
+	quicStreamFin = 0x01
+	quicStreamLen = 0x02
+	quicStreamOff = 0x04
+)
+
+// The transport error codes connections are closed with.
+const (
+	quicNoError           = 0x0
+	quicProtocolViolation = 0xa
+)
+
+// quicInitialSalt is the salt of the keys of Initial packets, see RFC 9001 5.2.
+var quicInitialSalt = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+
+// errQUICClosed is what the streams of a connection closed without an error fail with.
+var errQUICClosed = errors.New("quic: connection closed")
+
+// quicKeys protect the packets sent, or received, at an encryption level.
+type quicKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	// mask returns the 5 byte header protection mask of sample.
+	mask func(sample []byte) []byte
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label of TLS 1.3, with an empty context.
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, length int) []byte {
+	info := []byte{byte(length >> 8), byte(length), byte(len("tls13 ") + len(label))}
+	info = append(info, "tls13 "...)
+	info = append(info, label...)
+	info = append(info, 0)
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(h, secret, info), out); err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// newQUICKeys returns the keys of secret, negotiated with the TLS 1.3 cipher suite suite.
+func newQUICKeys(suite uint16, secret []byte) (*quicKeys, error) {
+	h, keyLen := sha256.New, 16
+	switch suite {
+	case tls.TLS_AES_128_GCM_SHA256:
+	case tls.TLS_AES_256_GCM_SHA384:
+		h, keyLen = sha512.New384, 32
+	case tls.TLS_CHACHA20_POLY1305_SHA256:
+		keyLen = chacha20poly1305.KeySize
+	default:
+		return nil, fmt.Errorf("quic: unsupported cipher suite %#x", suite)
+	}
+	key := hkdfExpandLabel(h, secret, "quic key", keyLen)
+	k := &quicKeys{iv: hkdfExpandLabel(h, secret, "quic iv", 12)}
+	hpKey := hkdfExpandLabel(h, secret, "quic hp", keyLen)
+
+	if suite == tls.TLS_CHACHA20_POLY1305_SHA256 {
+		var err error
+		if k.aead, err = chacha20poly1305.New(key); err != nil {
+			return nil, err
+		}
+		k.mask = func(sample []byte) []byte {
+			mask := make([]byte, 5)
+			c, err := chacha20.NewUnauthenticatedCipher(hpKey, sample[4:16])
+			if err != nil {
+				panic(err)
+			}
+			c.SetCounter(binary.LittleEndian.Uint32(sample[:4]))
+			c.XORKeyStream(mask, mask)
+			return mask
+		}
+		return k, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if k.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	hp, err := aes.NewCipher(hpKey)
+	if err != nil {
+		return nil, err
+	}
+	k.mask = func(sample []byte) []byte {
+		mask := make([]byte, aes.BlockSize)
+		hp.Encrypt(mask, sample[:aes.BlockSize])
+		return mask[:5]
+	}
+	return k, nil
+}
+
+// quicInitialKeys returns the keys of the Initial packets of the connection whose client first
+// sent them to connID, those of the client first.
+func quicInitialKeys(connID []byte) (client, server *quicKeys) {
+	initial := hkdf.Extract(sha256.New, connID, quicInitialSalt)
+	client, _ = newQUICKeys(tls.TLS_AES_128_GCM_SHA256, hkdfExpandLabel(sha256.New, initial, "client in", sha256.Size))
+	server, _ = newQUICKeys(tls.TLS_AES_128_GCM_SHA256, hkdfExpandLabel(sha256.New, initial, "server in", sha256.Size))
+	return client, server
+}
+
+func (k *quicKeys) nonce(pn uint64) []byte {
+	nonce := append([]byte(nil), k.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	return nonce
+}
+
+// appendQUICVarint appends the variable-length integer encoding of v, see RFC 9000 16.
+func appendQUICVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+// quicReader reads the fields of QUIC packets and frames. Reading past the end sets failed.
+type quicReader struct {
+	b      []byte
+	failed bool
+}
+
+func (r *quicReader) next(n int) []byte {
+	if n < 0 || n > len(r.b) {
+		r.failed = true
+		r.b = nil
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *quicReader) varint() uint64 {
+	if len(r.b) == 0 {
+		r.failed = true
+		return 0
+	}
+	b := r.next(1 << (r.b[0] >> 6))
+	if b == nil {
+		return 0
+	}
+	v := uint64(b[0] & 0x3f)
+	for _, c := range b[1:] {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// quicSpace is a packet number space, with the keys of the encryption level of its packets.
+type quicSpace struct {
+	level      tls.QUICEncryptionLevel
+	seal, open *quicKeys
+	nextPN     uint64
+	// cryptoOut holds the CRYPTO data to send at the level, cryptoSent and cryptoReceived the
+	// offsets of the data sent and received so far.
+	cryptoOut      []byte
+	cryptoSent     uint64
+	cryptoReceived uint64
+	// The packets received from ackLow to ackHigh, all of them, are acknowledged with the next
+	// packet sent. ackPending is set when they include packets that expect an ACK.
+	received        bool
+	ackLow, ackHigh uint64
+	ackPending      bool
+}
+
+// receive records that the packet pn was received.
+func (s *quicSpace) receive(pn uint64) {
+	switch {
+	case !s.received:
+		s.received, s.ackLow, s.ackHigh = true, pn, pn
+	case pn == s.ackHigh+1:
+		s.ackHigh = pn
+	case pn > s.ackHigh:
+		// Only the packets after the gap are acknowledged from then on.
+		s.ackLow, s.ackHigh = pn, pn
+	}
+}
+
+// quicConn is a QUIC connection, whose every method but those of its streams must be called with
+// mu held.
+type quicConn struct {
+	pc       net.PacketConn
+	remote   net.Addr
+	isClient bool
+	tls      *tls.QUICConn
+	// onClose, if set, is called once the connection is closed, with mu held.
+	onClose func()
+
+	mu sync.Mutex
+	// The connection IDs packets are sent to, and received at. originalDCID is the one the
+	// client first sent to.
+	dcid, scid, originalDCID []byte
+	peerCIDSet               bool
+	spaces                   [3]*quicSpace
+	streams                  map[uint64]*quicStream
+	// nextStream holds the ID of the next stream opened, bidirectional first.
+	nextStream [2]uint64
+	accepted   []*quicStream
+	// acceptReady, ready and closed are signalled when a stream can be accepted, when the
+	// handshake completes, and when the connection is closed with closeErr.
+	acceptReady chan struct{}
+	ready       chan struct{}
+	closed      chan struct{}
+	closeErr    error
+}
+
+func newQUICConnID() []byte {
+	id := make([]byte, quicConnIDLen)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// newQUICConn returns a connection to remote over pc, whose client first sent to originalDCID.
+func newQUICConn(pc net.PacketConn, remote net.Addr, isClient bool, originalDCID []byte) *quicConn {
+	c := &quicConn{
+		pc:           pc,
+		remote:       remote,
+		isClient:     isClient,
+		scid:         newQUICConnID(),
+		originalDCID: originalDCID,
+		streams:      make(map[uint64]*quicStream),
+		acceptReady:  make(chan struct{}, 1),
+		ready:        make(chan struct{}),
+		closed:       make(chan struct{}),
+	}
+	levels := []tls.QUICEncryptionLevel{tls.QUICEncryptionLevelInitial, tls.QUICEncryptionLevelHandshake, tls.QUICEncryptionLevelApplication}
+	for i, level := range levels {
+		c.spaces[i] = &quicSpace{level: level}
+	}
+	client, server := quicInitialKeys(originalDCID)
+	if isClient {
+		c.dcid = originalDCID
+		c.spaces[0].seal, c.spaces[0].open = client, server
+		// Client streams have IDs with a low bit of 0, unidirectional ones a second bit of 1.
+		c.nextStream = [2]uint64{0, 2}
+	} else {
+		c.spaces[0].seal, c.spaces[0].open = server, client
+		c.nextStream = [2]uint64{1, 3}
+	}
+	return c
+}
+
+func (c *quicConn) space(level tls.QUICEncryptionLevel) *quicSpace {
+	for _, s := range c.spaces {
+		if s.level == level {
+			return s
+		}
+	}
+	// 0-RTT, which is never offered.
+	return nil
+}
+
+// transportParameters returns the transport parameters of the connection, see RFC 9000 18.2.
+func (c *quicConn) transportParameters() []byte {
+	var b []byte
+	param := func(id uint64, v []byte) {
+		b = appendQUICVarint(b, id)
+		b = appendQUICVarint(b, uint64(len(v)))
+		b = append(b, v...)
+	}
+	limit := func(id, v uint64) {
+		param(id, appendQUICVarint(nil, v))
+	}
+	if !c.isClient {
+		param(0x00, c.originalDCID)
+	}
+	limit(0x04, 1<<40) // initial_max_data
+	limit(0x05, 1<<30) // initial_max_stream_data_bidi_local
+	limit(0x06, 1<<30) // initial_max_stream_data_bidi_remote
+	limit(0x07, 1<<30) // initial_max_stream_data_uni
+	limit(0x08, 1<<40) // initial_max_streams_bidi
+	limit(0x09, 1<<10) // initial_max_streams_uni
+	param(0x0c, nil)   // disable_active_migration
+	param(0x0f, c.scid)
+	return b
+}
+
+// startTLS starts the handshake with config.
+func (c *quicConn) startTLS(ctx context.Context, config *tls.Config) error {
+	qc := &tls.QUICConfig{TLSConfig: config}
+	if c.isClient {
+		c.tls = tls.QUICClient(qc)
+		c.tls.SetTransportParameters(c.transportParameters())
+	} else {
+		c.tls = tls.QUICServer(qc)
+	}
+	if err := c.tls.Start(ctx); err != nil {
+		return err
+	}
+	return c.handleTLSEvents()
+}
+
+// handleTLSEvents sets up the keys and queues the CRYPTO data the handshake asks for.
+func (c *quicConn) handleTLSEvents() error {
+	for {
+		e := c.tls.NextEvent()
+		switch e.Kind {
+		case tls.QUICNoEvent:
+			return nil
+		case tls.QUICSetReadSecret, tls.QUICSetWriteSecret:
+			keys, err := newQUICKeys(e.Suite, e.Data)
+			if err != nil {
+				return err
+			}
+			if s := c.space(e.Level); s == nil {
+				continue
+			} else if e.Kind == tls.QUICSetReadSecret {
+				s.open = keys
+			} else {
+				s.seal = keys
+			}
+		case tls.QUICWriteData:
+			if s := c.space(e.Level); s != nil {
+				s.cryptoOut = append(s.cryptoOut, e.Data...)
+			}
+		case tls.QUICTransportParametersRequired:
+			c.tls.SetTransportParameters(c.transportParameters())
+		case tls.QUICHandshakeDone:
+			if !c.isClient {
+				c.queueFrame([]byte{quicFrameHandshakeDone})
+			}
+			close(c.ready)
+		}
+	}
+}
+
+// queueFrame sends frame in a 1-RTT packet of its own.
+func (c *quicConn) queueFrame(frame []byte) {
+	// The application keys are set with the handshake completing.
+	if err := c.sendPacket(c.spaces[2], frame); err != nil {
+		c.closeLocked(err, false)
+	}
+}
+
+// sendPacket sends a packet of payload in s, after the ACK frame of the packets received in s,
+// if any.
+func (c *quicConn) sendPacket(s *quicSpace, payload []byte) error {
+	if s.seal == nil {
+		return fmt.Errorf("quic: no keys to send %v packets with", s.level)
+	}
+	var frames []byte
+	if s.received {
+		frames = append(frames, quicFrameAck)
+		frames = appendQUICVarint(frames, s.ackHigh)
+		frames = appendQUICVarint(frames, 0) // ACK Delay
+		frames = appendQUICVarint(frames, 0) // ACK Range Count
+		frames = appendQUICVarint(frames, s.ackHigh-s.ackLow)
+		s.ackPending = false
+	}
+	frames = append(frames, payload...)
+
+	pn := s.nextPN
+	s.nextPN++
+	var pkt []byte
+	if s.level == tls.QUICEncryptionLevelApplication {
+		pkt = append(pkt, 0x40|(quicPacketNumberLen-1))
+		pkt = append(pkt, c.dcid...)
+	} else {
+		typ := byte(quicPacketInitial)
+		if s.level == tls.QUICEncryptionLevelHandshake {
+			typ = quicPacketHandshake
+		}
+		pkt = append(pkt, 0xc0|typ<<4|(quicPacketNumberLen-1))
+		pkt = binary.BigEndian.AppendUint32(pkt, quicVersion1)
+		pkt = append(pkt, byte(len(c.dcid)))
+		pkt = append(pkt, c.dcid...)
+		pkt = append(pkt, byte(len(c.scid)))
+		pkt = append(pkt, c.scid...)
+		if typ == quicPacketInitial {
+			pkt = append(pkt, 0) // Token Length
+			if c.isClient {
+				// The length is always sent on 2 bytes, below.
+				if n := quicMinInitialDatagram - (len(pkt) + 2 + quicPacketNumberLen + len(frames) + s.seal.aead.Overhead()); n > 0 {
+					frames = append(frames, make([]byte, n)...)
+				}
+			}
+		}
+		length := quicPacketNumberLen + len(frames) + s.seal.aead.Overhead()
+		pkt = append(pkt, 0x40|byte(length>>8), byte(length))
+	}
+	pnOffset := len(pkt)
+	pkt = binary.BigEndian.AppendUint32(pkt, uint32(pn))
+	pkt = s.seal.aead.Seal(pkt, s.seal.nonce(pn), frames, pkt)
+
+	mask := s.seal.mask(pkt[pnOffset+4 : pnOffset+20])
+	if pkt[0]&0x80 != 0 {
+		pkt[0] ^= mask[0] & 0x0f
+	} else {
+		pkt[0] ^= mask[0] & 0x1f
+	}
+	for i := 0; i < quicPacketNumberLen; i++ {
+		pkt[pnOffset+i] ^= mask[1+i]
+	}
+	_, err := c.pc.WriteTo(pkt, c.remote)
+	return err
+}
+
+// flush sends the CRYPTO data queued, and acknowledges the packets that expect it.
+func (c *quicConn) flush() error {
+	for _, s := range c.spaces {
+		for len(s.cryptoOut) > 0 {
+			data := s.cryptoOut
+			if len(data) > quicMaxFrameData {
+				data = data[:quicMaxFrameData]
+			}
+			frame := []byte{quicFrameCrypto}
+			frame = appendQUICVarint(frame, s.cryptoSent)
+			frame = appendQUICVarint(frame, uint64(len(data)))
+			frame = append(frame, data...)
+			if err := c.sendPacket(s, frame); err != nil {
+				return err
+			}
+			s.cryptoSent += uint64(len(data))
+			s.cryptoOut = s.cryptoOut[len(data):]
+		}
+		if s.ackPending && s.seal != nil {
+			if err := c.sendPacket(s, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// handleDatagram handles the packets of a datagram received from the peer. Packets that cannot be
+// opened are dropped.
+func (c *quicConn) handleDatagram(d []byte) error {
+	for len(d) > 0 {
+		var s *quicSpace
+		var pkt []byte
+		var pnOffset int
+		if d[0]&0x80 != 0 {
+			r := &quicReader{b: d[1:]}
+			version := r.next(4)
+			dcid := r.next(int(r.lengthByte()))
+			scid := r.next(int(r.lengthByte()))
+			typ := d[0] >> 4 & 0x3
+			if typ == quicPacketInitial {
+				r.next(int(r.varint())) // Token
+			}
+			length := r.varint()
+			if r.failed || binary.BigEndian.Uint32(version) != quicVersion1 || !bytesEqual(dcid, c.scid) && !bytesEqual(dcid, c.originalDCID) {
+				return nil
+			}
+			pnOffset = len(d) - len(r.b)
+			if length > uint64(len(r.b)) {
+				return nil
+			}
+			switch typ {
+			case quicPacketInitial:
+				s = c.spaces[0]
+			case quicPacketHandshake:
+				s = c.spaces[1]
+			}
+			pkt, d = d[:pnOffset+int(length)], d[pnOffset+int(length):]
+			if c.isClient && !c.peerCIDSet && s != nil {
+				// The server picks the connection ID of its own that the client sends to from then on.
+				c.dcid = append([]byte(nil), scid...)
+				c.peerCIDSet = true
+			}
+		} else {
+			s = c.spaces[2]
+			pnOffset = 1 + len(c.scid)
+			pkt, d = d, nil
+		}
+		if s == nil || s.open == nil || len(pkt) < pnOffset+20 {
+			continue
+		}
+		payload, pn, ok := c.openPacket(s, pkt, pnOffset)
+		if !ok {
+			continue
+		}
+		s.receive(pn)
+		if err := c.handleFrames(s, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lengthByte reads the single byte length of a connection ID.
+func (r *quicReader) lengthByte() byte {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func bytesEqual(a, b []byte) bool {
+	return string(a) == string(b)
+}
+
+// openPacket removes the header protection of pkt, whose packet number starts at pnOffset, and
+// returns its payload and packet number.
+func (c *quicConn) openPacket(s *quicSpace, pkt []byte, pnOffset int) ([]byte, uint64, bool) {
+	mask := s.open.mask(pkt[pnOffset+4 : pnOffset+20])
+	if pkt[0]&0x80 != 0 {
+		pkt[0] ^= mask[0] & 0x0f
+	} else {
+		pkt[0] ^= mask[0] & 0x1f
+	}
+	pnLen := int(pkt[0]&0x3) + 1
+	var truncated uint64
+	for i := 0; i < pnLen; i++ {
+		pkt[pnOffset+i] ^= mask[1+i]
+		truncated = truncated<<8 | uint64(pkt[pnOffset+i])
+	}
+	pn := decodePacketNumber(s, truncated, pnLen)
+	hdr := pkt[:pnOffset+pnLen]
+	payload, err := s.open.aead.Open(nil, s.open.nonce(pn), pkt[pnOffset+pnLen:], hdr)
+	if err != nil {
+		return nil, 0, false
+	}
+	return payload, pn, true
+}
+
+// decodePacketNumber is the packet number decoding of RFC 9000 A.3.
+func decodePacketNumber(s *quicSpace, truncated uint64, pnLen int) uint64 {
+	expected := uint64(0)
+	if s.received {
+		expected = s.ackHigh + 1
+	}
+	win := uint64(1) << (8 * pnLen)
+	half := win / 2
+	candidate := expected&^(win-1) | truncated
+	switch {
+	case candidate+half <= expected && candidate < 1<<62-win:
+		return candidate + win
+	case candidate > expected+half && candidate >= win:
+		return candidate - win
+	}
+	return candidate
+}
+
+// handleFrames handles the frames of a packet received in s.
+func (c *quicConn) handleFrames(s *quicSpace, payload []byte) error {
+	r := &quicReader{b: payload}
+	for len(r.b) > 0 && !r.failed {
+		typ := r.varint()
+		if typ != quicFramePadding && typ != quicFrameAck && typ != quicFrameAckECN && typ != quicFrameConnectionClose && typ != quicFrameApplicationClose {
+			s.ackPending = true
+		}
+		switch {
+		case typ == quicFramePadding, typ == quicFramePing:
+		case typ == quicFrameAck, typ == quicFrameAckECN:
+			r.varint() // Largest Acknowledged
+			r.varint() // ACK Delay
+			ranges := r.varint()
+			r.varint() // First ACK Range
+			for i := uint64(0); i < ranges && !r.failed; i++ {
+				r.varint() // Gap
+				r.varint() // ACK Range Length
+			}
+			if typ == quicFrameAckECN {
+				r.varint()
+				r.varint()
+				r.varint()
+			}
+		case typ == quicFrameCrypto:
+			offset := r.varint()
+			data := r.next(int(r.varint()))
+			if r.failed || offset != s.cryptoReceived {
+				continue
+			}
+			s.cryptoReceived += uint64(len(data))
+			if err := c.tls.HandleData(s.level, data); err != nil {
+				return err
+			}
+			if err := c.handleTLSEvents(); err != nil {
+				return err
+			}
+		case typ >= quicFrameStream && typ <= quicFrameStreamMax:
+			id := r.varint()
+			var offset uint64
+			if typ&quicStreamOff != 0 {
+				offset = r.varint()
+			}
+			var data []byte
+			if typ&quicStreamLen != 0 {
+				data = r.next(int(r.varint()))
+			} else {
+				data = r.next(len(r.b))
+			}
+			if !r.failed {
+				c.receiveStream(id, offset, data, typ&quicStreamFin != 0)
+			}
+		case typ == quicFrameConnectionClose, typ == quicFrameApplicationClose:
+			code := r.varint()
+			if typ == quicFrameConnectionClose {
+				r.varint() // Frame Type
+			}
+			reason := r.next(int(r.varint()))
+			var err error
+			if code != quicNoError && code != h3NoError {
+				err = fmt.Errorf("quic: connection closed by peer with error %#x: %s", code, reason)
+			}
+			c.closeLocked(err, true)
+			return nil
+		case typ == quicFrameHandshakeDone:
+		default:
+			return fmt.Errorf("quic: unsupported frame type %#x", typ)
+		}
+	}
+	if r.failed {
+		return errors.New("quic: malformed frame")
+	}
+	return nil
+}
+
+// openStream opens a new stream, bidirectional unless uni is set.
+func (c *quicConn) openStream(uni bool) *quicStream {
+	i := 0
+	if uni {
+		i = 1
+	}
+	st := newQUICStream(c, c.nextStream[i])
+	c.nextStream[i] += 4
+	c.streams[st.id] = st
+	return st
+}
+
+// receiveStream adds the data of a STREAM frame to its stream, which is accepted if the peer has
+// just opened it.
+func (c *quicConn) receiveStream(id, offset uint64, data []byte, fin bool) {
+	st, ok := c.streams[id]
+	if !ok {
+		if id&1 == c.nextStream[0]&1 {
+			// A stream of ours already closed.
+			return
+		}
+		st = newQUICStream(c, id)
+		c.streams[id] = st
+		c.accepted = append(c.accepted, st)
+		wake(c.acceptReady)
+	}
+	if offset != st.received {
+		return
+	}
+	st.received += uint64(len(data))
+	st.in = append(st.in, data...)
+	st.fin = st.fin || fin
+	wake(st.readReady)
+	st.forgetIfDone()
+}
+
+// wake wakes up the goroutine waiting on ch, if any.
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// acceptStream returns the next stream the peer opened.
+func (c *quicConn) acceptStream(ctx context.Context) (*quicStream, error) {
+	for {
+		c.mu.Lock()
+		if len(c.accepted) > 0 {
+			st := c.accepted[0]
+			c.accepted = c.accepted[1:]
+			c.mu.Unlock()
+			return st, nil
+		}
+		err := c.closeErr
+		c.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case <-c.acceptReady:
+		case <-c.closed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// close closes the connection, sending a CONNECTION_CLOSE with the HTTP/3 code h3Code.
+func (c *quicConn) close(h3Code uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeErr != nil {
+		return
+	}
+	if s := c.spaces[2]; s.seal != nil {
+		frame := appendQUICVarint([]byte{quicFrameApplicationClose}, h3Code)
+		frame = appendQUICVarint(frame, 0)
+		_ = c.sendPacket(s, frame)
+	}
+	c.closeLocked(nil, true)
+}
+
+// closeLocked closes the connection with err, or errQUICClosed if nil. Unless peerClosed, the
+// peer is sent a CONNECTION_CLOSE with a protocol violation.
+func (c *quicConn) closeLocked(err error, peerClosed bool) {
+	if c.closeErr != nil {
+		return
+	}
+	if !peerClosed {
+		frame := appendQUICVarint([]byte{quicFrameConnectionClose}, quicProtocolViolation)
+		frame = appendQUICVarint(frame, 0) // Frame Type
+		frame = appendQUICVarint(frame, 0) // Reason Phrase Length
+		for i := len(c.spaces) - 1; i >= 0; i-- {
+			if c.spaces[i].seal != nil {
+				_ = c.sendPacket(c.spaces[i], frame)
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = errQUICClosed
+	}
+	c.closeErr = err
+	close(c.closed)
+	if c.tls != nil {
+		c.tls.Close()
+	}
+	if c.onClose != nil {
+		c.onClose()
+	}
+}
+
+// receive handles datagram d, and closes the connection if it breaks the protocol.
+func (c *quicConn) receive(d []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeErr != nil {
+		return
+	}
+	err := c.handleDatagram(d)
+	if err == nil && c.closeErr == nil {
+		err = c.flush()
+	}
+	if err != nil {
+		c.closeLocked(err, false)
+	}
+}
+
+// quicStream is a stream of a quicConn. It is read, and written, by a single goroutine each.
+type quicStream struct {
+	c  *quicConn
+	id uint64
+
+	// Guarded by c.mu: the data received and not read yet, up to offset received, and whether
+	// the peer has finished the stream, and the offset of the data sent, and whether it was
+	// finished.
+	in        []byte
+	received  uint64
+	fin       bool
+	sent      uint64
+	finSent   bool
+	readReady chan struct{}
+}
+
+func newQUICStream(c *quicConn, id uint64) *quicStream {
+	return &quicStream{c: c, id: id, readReady: make(chan struct{}, 1)}
+}
+
+// isUni returns true if the stream is unidirectional.
+func (st *quicStream) isUni() bool {
+	return st.id&2 != 0
+}
+
+// forgetIfDone forgets the stream once it is finished both ways, as only its peer reads
+// unidirectional streams opened by the connection, and the other way round.
+func (st *quicStream) forgetIfDone() {
+	localUni := st.isUni() && st.id&1 == st.c.nextStream[0]&1
+	if (st.fin || localUni) && (st.finSent || st.isUni() && !localUni) {
+		delete(st.c.streams, st.id)
+	}
+}
+
+// read reads the data received on the stream, until ctx is done.
+func (st *quicStream) read(ctx context.Context, p []byte) (int, error) {
+	c := st.c
+	for {
+		c.mu.Lock()
+		if len(st.in) > 0 {
+			n := copy(p, st.in)
+			st.in = st.in[n:]
+			c.mu.Unlock()
+			return n, nil
+		}
+		fin, err := st.fin, c.closeErr
+		c.mu.Unlock()
+		if fin {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		select {
+		case <-st.readReady:
+		case <-c.closed:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// write sends p on the stream, and finishes it if fin is set.
+func (st *quicStream) write(p []byte, fin bool) error {
+	c := st.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeErr != nil {
+		return c.closeErr
+	}
+	for {
+		data := p
+		if len(data) > quicMaxFrameData {
+			data = data[:quicMaxFrameData]
+		}
+		p = p[len(data):]
+		typ := byte(quicFrameStream | quicStreamOff | quicStreamLen)
+		if fin && len(p) == 0 {
+			typ |= quicStreamFin
+		}
+		frame := appendQUICVarint([]byte{typ}, st.id)
+		frame = appendQUICVarint(frame, st.sent)
+		frame = appendQUICVarint(frame, uint64(len(data)))
+		frame = append(frame, data...)
+		if err := c.sendPacket(c.spaces[2], frame); err != nil {
+			c.closeLocked(err, false)
+			return err
+		}
+		st.sent += uint64(len(data))
+		if len(p) == 0 {
+			break
+		}
+	}
+	if fin {
+		st.finSent = true
+		st.forgetIfDone()
+	}
+	return nil
+}
+
+// streamReader reads a stream until ctx is done.
+type streamReader struct {
+	ctx context.Context
+	st  *quicStream
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	return r.st.read(r.ctx, p)
+}
+
+// quicListener accepts the QUIC connections made to a PacketConn.
+type quicListener struct {
+	pc     net.PacketConn
+	config *tls.Config
+
+	mu       sync.Mutex
+	conns    map[string]*quicConn
+	accepted chan *quicConn
+}
+
+func newQUICListener(pc net.PacketConn, config *tls.Config) *quicListener {
+	return &quicListener{
+		pc:       pc,
+		config:   config,
+		conns:    make(map[string]*quicConn),
+		accepted: make(chan *quicConn, 16),
+	}
+}
+
+// serve reads the datagrams sent to the listener until its PacketConn is closed, sets up the
+// connections of the client Initial packets, and hands the others to their connection.
+func (l *quicListener) serve() error {
+	defer close(l.accepted)
+	buf := make([]byte, quicMaxDatagram)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			l.closeAll()
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		d := append([]byte(nil), buf[:n]...)
+		l.mu.Lock()
+		c, ok := l.conns[addr.String()]
+		if !ok {
+			c = l.newConn(d, addr)
+		}
+		l.mu.Unlock()
+		if c != nil {
+			c.receive(d)
+		}
+	}
+}
+
+// newConn returns the connection set up by the client Initial packet d, or nil if d is not one.
+func (l *quicListener) newConn(d []byte, addr net.Addr) *quicConn {
+	if d[0]&0xf0 != 0xc0|quicPacketInitial<<4 {
+		return nil
+	}
+	r := &quicReader{b: d[1:]}
+	r.next(4) // Version
+	dcid := r.next(int(r.lengthByte()))
+	scid := r.next(int(r.lengthByte()))
+	if r.failed || len(dcid) < quicConnIDLen {
+		return nil
+	}
+	c := newQUICConn(l.pc, addr, false, append([]byte(nil), dcid...))
+	c.dcid = append([]byte(nil), scid...)
+	key := addr.String()
+	// Asynchronously, as connections are closed with l.mu held too.
+	c.onClose = func() { go l.forget(key, c) }
+	c.mu.Lock()
+	err := c.startTLS(context.Background(), l.config)
+	c.mu.Unlock()
+	if err != nil {
+		return nil
+	}
+	l.conns[key] = c
+	select {
+	case l.accepted <- c:
+	default:
+		// Nothing accepts connections this fast on loopback.
+		c.close(h3NoError)
+		return nil
+	}
+	return c
+}
+
+// forget forgets c, the connection of the client at key, once closed.
+func (l *quicListener) forget(key string, c *quicConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[key] == c {
+		delete(l.conns, key)
+	}
+}
+
+func (l *quicListener) closeAll() {
+	l.mu.Lock()
+	conns := make([]*quicConn, 0, len(l.conns))
+	for _, c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.mu.Unlock()
+	for _, c := range conns {
+		c.close(h3NoError)
+	}
+}
+
+// dialQUIC sets up a QUIC connection to address with config, over a UDP socket of its own.
+func dialQUIC(ctx context.Context, address string, config *tls.Config) (*quicConn, error) {
+	remote, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	c := newQUICConn(pc, remote, true, newQUICConnID())
+	c.onClose = func() { pc.Close() }
+	c.mu.Lock()
+	err = c.startTLS(ctx, config)
+	if err == nil {
+		err = c.flush()
+	}
+	c.mu.Unlock()
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	go func() {
+		buf := make([]byte, quicMaxDatagram)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				c.mu.Lock()
+				c.closeLocked(err, true)
+				c.mu.Unlock()
+				return
+			}
+			if addr.String() == remote.String() {
+				c.receive(append([]byte(nil), buf[:n]...))
+			}
+		}
+	}()
+	select {
+	case <-c.ready:
+		return c, nil
+	case <-c.closed:
+		return nil, c.closeErr
+	case <-ctx.Done():
+		c.close(h3NoError)
+		return nil, ctx.Err()
+	}
+}
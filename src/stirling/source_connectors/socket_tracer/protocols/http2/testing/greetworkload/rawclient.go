@@ -0,0 +1,359 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"google.golang.org/grpc/codes"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// The deviations RawSayHello can make from a well-formed SayHello call, for negative tests of the
+// HTTP/2 peers and of the tracer, since gRPC clients never send protocol violations.
+const (
+	// DeviationNone makes a well-formed call.
+	DeviationNone = "none"
+	// DeviationContentType sends the request with a content-type of text/plain.
+	DeviationContentType = "wrong_content_type"
+	// DeviationNoTETrailers leaves out the te: trailers header.
+	DeviationNoTETrailers = "missing_te_trailers"
+	// DeviationDataBeforeHeaders sends the DATA of the request before its HEADERS, on a stream the
+	// client has not opened yet.
+	DeviationDataBeforeHeaders = "data_before_headers"
+	// DeviationBogusStreamID sends the request on stream 2, an even stream ID, which only servers
+	// may use.
+	DeviationBogusStreamID = "bogus_stream_id"
+	// DeviationOversizedPadding sends the DATA of the request padded with more bytes than its frame
+	// holds.
+	DeviationOversizedPadding = "oversized_padding"
+	// DeviationTruncatedMessage declares a request message 16 bytes longer than the one sent before
+	// the stream ends.
+	DeviationTruncatedMessage = "truncated_message"
+)
+
+// Deviations are the deviations of RawSayHello, DeviationNone first.
+var Deviations = []string{
+	DeviationNone,
+	DeviationContentType,
+	DeviationNoTETrailers,
+	DeviationDataBeforeHeaders,
+	DeviationBogusStreamID,
+	DeviationOversizedPadding,
+	DeviationTruncatedMessage,
+}
+
+// truncatedMessageMissing is the number of bytes DeviationTruncatedMessage leaves out.
+const truncatedMessageMissing = 16
+
+// RawOptions configure RawSayHello.
+type RawOptions struct {
+	// Deviation is one of the Deviations. Empty is DeviationNone.
+	Deviation string
+	// TLS speaks HTTP/2 over TLS, negotiated with ALPN, without verifying the server certificate.
+	TLS bool
+	// Timeout bounds the call, and how long the reaction of the server is waited for. Zero is 5s.
+	Timeout time.Duration
+}
+
+func (o *RawOptions) deviation() string {
+	if o.Deviation == "" {
+		return DeviationNone
+	}
+	return o.Deviation
+}
+
+func (o *RawOptions) timeout() time.Duration {
+	if o.Timeout == 0 {
+		return 5 * time.Second
+	}
+	return o.Timeout
+}
+
+// Validate checks that the deviation is known.
+func (o *RawOptions) Validate() error {
+	for _, d := range Deviations {
+		if o.deviation() == d {
+			return nil
+		}
+	}
+	return badFlagsf("unknown deviation %q, expected one of %s", o.Deviation, strings.Join(Deviations, ", "))
+}
+
+// RawReaction is how a server reacted to a call of RawSayHello.
+type RawReaction struct {
+	Deviation string `json:"deviation"`
+	RequestID string `json:"request_id"`
+	// HTTPStatus is the :status of the response, or 0 if no response headers were received.
+	HTTPStatus int `json:"http_status,omitempty"`
+	// GRPCCode and GRPCMessage are the grpc-status, by name, and grpc-message of the response, if
+	// it had them.
+	GRPCCode    string `json:"grpc_code,omitempty"`
+	GRPCMessage string `json:"grpc_message,omitempty"`
+	// Message is the message of the reply, for calls that succeeded.
+	Message string `json:"message,omitempty"`
+	// RSTStreamCode is the error code of the RST_STREAM that ended the stream, if one did.
+	RSTStreamCode string `json:"rst_stream_code,omitempty"`
+	// GoAwayCode is the error code of the GOAWAY the server sent, if it sent one.
+	GoAwayCode string `json:"goaway_code,omitempty"`
+	// ConnClosed is true if the server closed the connection before the stream ended.
+	ConnClosed bool `json:"conn_closed,omitempty"`
+	// TimedOut is true if the server had not ended the stream by the time the call timed out.
+	TimedOut bool `json:"timed_out,omitempty"`
+}
+
+// String sums up the reaction as the fields that were set, leaving out the messages, e.g.
+// "http_status=200 grpc_code=OK" or "goaway=PROTOCOL_ERROR conn_closed".
+func (r *RawReaction) String() string {
+	var parts []string
+	if r.HTTPStatus != 0 {
+		parts = append(parts, "http_status="+strconv.Itoa(r.HTTPStatus))
+	}
+	if r.GRPCCode != "" {
+		parts = append(parts, "grpc_code="+r.GRPCCode)
+	}
+	if r.RSTStreamCode != "" {
+		parts = append(parts, "rst_stream="+r.RSTStreamCode)
+	}
+	if r.GoAwayCode != "" {
+		parts = append(parts, "goaway="+r.GoAwayCode)
+	}
+	if r.ConnClosed {
+		parts = append(parts, "conn_closed")
+	}
+	if r.TimedOut {
+		parts = append(parts, "timed_out")
+	}
+	if len(parts) == 0 {
+		return "no reaction"
+	}
+	return strings.Join(parts, " ")
+}
+
+// RawSayHello calls Greeter.SayHello with name on a new connection to address, speaking HTTP/2
+// with frames crafted by hand rather than through gRPC, so that the call can deviate from the
+// protocol as opts.Deviation says. It returns how the server reacted: the response and trailers
+// of the call, the RST_STREAM or GOAWAY it sent, the connection closing, or nothing before the
+// timeout. Errors are only
+// returned for calls that could not be made, and wrap ErrDialFailed if the connection could not be
+// set up.
+func RawSayHello(ctx context.Context, address, name string, opts *RawOptions) (*RawReaction, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, opts.timeout())
+	defer cancel()
+
+	var conn net.Conn
+	var err error
+	if opts.TLS {
+		dialer := &tls.Dialer{Config: &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http2.NextProtoTLS}}}
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, dialError(address, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	reaction := &RawReaction{Deviation: opts.deviation(), RequestID: NewRequestID()}
+	fr := http2.NewFramer(conn, conn)
+	// Illegal writes are the point of some deviations.
+	fr.AllowIllegalWrites = true
+	fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+		return nil, err
+	}
+	if err := fr.WriteSettings(); err != nil {
+		return nil, err
+	}
+	streamID, err := writeRawRequest(fr, address, name, reaction.RequestID, opts)
+	if err != nil {
+		return nil, err
+	}
+	return reaction, readRawReaction(fr, streamID, reaction)
+}
+
+// writeRawRequest writes the HEADERS and DATA of the call, deviating as opts say, and returns the
+// stream they were sent on.
+func writeRawRequest(fr *http2.Framer, address, name, requestID string, opts *RawOptions) (uint32, error) {
+	deviation := opts.deviation()
+	streamID := uint32(1)
+	if deviation == DeviationBogusStreamID {
+		streamID = 2
+	}
+
+	scheme := "http"
+	if opts.TLS {
+		scheme = "https"
+	}
+	contentType := "application/grpc"
+	if deviation == DeviationContentType {
+		contentType = "text/plain"
+	}
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	fields := []hpack.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":scheme", Value: scheme},
+		{Name: ":path", Value: pb.Greeter_SayHello_FullMethodName},
+		{Name: ":authority", Value: address},
+		{Name: "content-type", Value: contentType},
+	}
+	if deviation != DeviationNoTETrailers {
+		fields = append(fields, hpack.HeaderField{Name: "te", Value: "trailers"})
+	}
+	fields = append(fields, hpack.HeaderField{Name: RequestIDHeader, Value: requestID})
+	for _, f := range fields {
+		if err := enc.WriteField(f); err != nil {
+			return 0, err
+		}
+	}
+
+	msg, err := (&pb.HelloRequest{Name: name}).Marshal()
+	if err != nil {
+		return 0, err
+	}
+	// A gRPC message is prefixed with a compression flag and its length.
+	body := make([]byte, 5, 5+len(msg))
+	declared := len(msg)
+	if deviation == DeviationTruncatedMessage {
+		declared += truncatedMessageMissing
+	}
+	binary.BigEndian.PutUint32(body[1:], uint32(declared))
+	body = append(body, msg...)
+
+	writeHeaders := func() error {
+		return fr.WriteHeaders(http2.HeadersFrameParam{StreamID: streamID, BlockFragment: block.Bytes(), EndHeaders: true})
+	}
+	writeData := func() error {
+		if deviation != DeviationOversizedPadding {
+			return fr.WriteData(streamID, true, body)
+		}
+		// The pad length comes first, and claims more bytes than the rest of the frame holds.
+		payload := append([]byte{byte(len(body) + 1)}, body...)
+		return fr.WriteRawFrame(http2.FrameData, http2.FlagDataPadded|http2.FlagDataEndStream, streamID, payload)
+	}
+	writes := []func() error{writeHeaders, writeData}
+	if deviation == DeviationDataBeforeHeaders {
+		writes = []func() error{writeData, writeHeaders}
+	}
+	for _, write := range writes {
+		if err := write(); err != nil {
+			return 0, err
+		}
+	}
+	return streamID, nil
+}
+
+// readRawReaction reads the frames of the server into reaction, until the stream ends, is reset, or
+// the server sends a GOAWAY, closes the connection, or lets the deadline of the connection pass.
+func readRawReaction(fr *http2.Framer, streamID uint32, reaction *RawReaction) error {
+	var payload []byte
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
+				reaction.ConnClosed = true
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				reaction.TimedOut = true
+				return nil
+			}
+			return fmt.Errorf("failed to read the reaction of the server: %w", err)
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				if err := fr.WriteSettingsAck(); err != nil {
+					reaction.ConnClosed = true
+					return nil
+				}
+			}
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				_ = fr.WritePing(true, f.Data)
+			}
+		case *http2.GoAwayFrame:
+			reaction.GoAwayCode = f.ErrCode.String()
+			// A server that goes away gracefully still finishes the streams it took.
+			if f.ErrCode != http2.ErrCodeNo || f.LastStreamID < streamID {
+				return nil
+			}
+		case *http2.RSTStreamFrame:
+			if f.StreamID == streamID {
+				reaction.RSTStreamCode = f.ErrCode.String()
+				return nil
+			}
+		case *http2.DataFrame:
+			if f.StreamID == streamID {
+				payload = append(payload, f.Data()...)
+			}
+		case *http2.MetaHeadersFrame:
+			if f.StreamID != streamID {
+				continue
+			}
+			if s := f.PseudoValue("status"); s != "" {
+				reaction.HTTPStatus, _ = strconv.Atoi(s)
+			}
+			if !f.StreamEnded() {
+				continue
+			}
+			for _, hf := range f.RegularFields() {
+				switch hf.Name {
+				case "grpc-status":
+					if n, err := strconv.Atoi(hf.Value); err == nil {
+						reaction.GRPCCode = codes.Code(n).String()
+					} else {
+						reaction.GRPCCode = hf.Value
+					}
+				case "grpc-message":
+					reaction.GRPCMessage = decodeGRPCMessage(hf.Value)
+				}
+			}
+			if reaction.GRPCCode == "OK" {
+				if reply, err := decodeUnaryReply(f, payload); err == nil {
+					reaction.Message = reply.Message
+				}
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// TestRawSayHelloReactions locks how grpc-go servers react to each deviation, so that a change of
+// behavior on upgrade shows up here rather than in the tracer tests that rely on it.
+func TestRawSayHelloReactions(t *testing.T) {
+	tests := []struct {
+		deviation   string
+		want        string
+		wantMessage string
+		wantGRPCMsg string
+	}{
+		{greetworkload.DeviationNone, "http_status=200 grpc_code=OK", "Hello pixie", ""},
+		{greetworkload.DeviationContentType, "rst_stream=PROTOCOL_ERROR", "", ""},
+		// grpc-go does not insist on te: trailers.
+		{greetworkload.DeviationNoTETrailers, "http_status=200 grpc_code=OK", "Hello pixie", ""},
+		// The DATA is dropped as it is on a stream that is not open, and the stream the HEADERS open
+		// then waits for a request that never comes.
+		{greetworkload.DeviationDataBeforeHeaders, "timed_out", "", ""},
+		{greetworkload.DeviationBogusStreamID, "conn_closed", "", ""},
+		{greetworkload.DeviationOversizedPadding, "conn_closed", "", ""},
+		{greetworkload.DeviationTruncatedMessage, "http_status=200 grpc_code=Unknown", "", "unexpected EOF"},
+	}
+
+	_, plainAddr := startServer(t, nil)
+	tlsAddr, _ := startTLSServer(t, &greetworkload.TLSOptions{})
+
+	for _, tls := range []bool{false, true} {
+		addr := plainAddr
+		if tls {
+			addr = tlsAddr
+		}
+		for _, tc := range tests {
+			name := tc.deviation
+			if tls {
+				name += "_tls"
+			}
+			t.Run(name, func(t *testing.T) {
+				opts := &greetworkload.RawOptions{Deviation: tc.deviation, TLS: tls, Timeout: time.Second}
+				r, err := greetworkload.RawSayHello(context.Background(), addr, "pixie", opts)
+				require.NoError(t, err)
+				assert.Equal(t, tc.want, r.String())
+				assert.Equal(t, tc.deviation, r.Deviation)
+				assert.NotEmpty(t, r.RequestID)
+				assert.Equal(t, tc.wantMessage, r.Message)
+				assert.Equal(t, tc.wantGRPCMsg, r.GRPCMessage)
+			})
+		}
+	}
+}
+
+func TestRawSayHelloErrors(t *testing.T) {
+	_, err := greetworkload.RawSayHello(context.Background(), "127.0.0.1:1", "pixie", &greetworkload.RawOptions{Deviation: "bogus"})
+	assert.True(t, errors.Is(err, greetworkload.ErrBadFlagCombination), err)
+	assert.Contains(t, err.Error(), `unknown deviation "bogus"`)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+	require.NoError(t, lis.Close())
+	_, err = greetworkload.RawSayHello(context.Background(), addr, "pixie", &greetworkload.RawOptions{})
+	assert.True(t, errors.Is(err, greetworkload.ErrDialFailed), err)
+}
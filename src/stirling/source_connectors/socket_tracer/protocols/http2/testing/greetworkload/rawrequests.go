@@ -0,0 +1,164 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// RawRequestOptions configure a RawRequests.
+type RawRequestOptions struct {
+	// Keep keeps the bytes of every unary HelloRequest, for RawRequest to return to the handler.
+	// Relays need it to forward the fields of the requests they do not know.
+	Keep bool
+	// RejectUnknownFields fails the calls whose requests hold fields greet.proto does not declare
+	// with InvalidArgument. Otherwise, they are ignored, as the generated messages skip them.
+	RejectUnknownFields bool
+}
+
+// RawRequests looks at the bytes the requests a server handles were unmarshaled from, which hold
+// the fields the generated greetpb messages skip, such as those newer clients send. Its
+// ServerCodec picks them up, and its interceptors hand them to the call of their request, so both
+// must be installed.
+type RawRequests struct {
+	opts *RawRequestOptions
+	// stash holds the bytes of the requests unmarshaled, by request, until their call picks them up.
+	stash sync.Map
+}
+
+// NewRawRequests creates a RawRequests.
+func NewRawRequests(opts *RawRequestOptions) *RawRequests {
+	return &RawRequests{opts: opts}
+}
+
+// rawRequestKey is the context key of the bytes of the request of a unary call.
+type rawRequestKey struct{}
+
+// RawRequest returns the bytes the request of the unary call made in ctx was unmarshaled from, if
+// a RawRequests with Keep picked them up.
+func RawRequest(ctx context.Context) ([]byte, bool) {
+	b, ok := ctx.Value(rawRequestKey{}).([]byte)
+	return b, ok
+}
+
+// ServerCodec returns base, picking up the bytes of the requests it unmarshals. A nil RawRequests
+// returns base itself.
+func (r *RawRequests) ServerCodec(base encoding.Codec) encoding.Codec {
+	if r == nil {
+		return base
+	}
+	return &rawRequestCodec{Codec: base, r: r}
+}
+
+type rawRequestCodec struct {
+	encoding.Codec
+	r *RawRequests
+}
+
+// Unmarshal implements encoding.Codec.
+func (c *rawRequestCodec) Unmarshal(data []byte, v interface{}) error {
+	if err := c.Codec.Unmarshal(data, v); err != nil {
+		return err
+	}
+	m, ok := v.(pb.Message)
+	if !ok {
+		return nil
+	}
+	raw := &rawRequest{}
+	if c.r.opts.RejectUnknownFields {
+		unknown, err := pb.UnknownFields(m, data)
+		if err != nil {
+			return err
+		}
+		raw.unknown = len(unknown)
+	}
+	if _, isHello := m.(*pb.HelloRequest); isHello && c.r.opts.Keep {
+		// gRPC may reuse the buffer once the message is unmarshaled.
+		raw.data = append([]byte{}, data...)
+	}
+	if raw.unknown > 0 || raw.data != nil {
+		c.r.stash.Store(v, raw)
+	}
+	return nil
+}
+
+// rawRequest is what a rawRequestCodec picked up from the bytes of a request.
+type rawRequest struct {
+	// data are the bytes, if kept.
+	data []byte
+	// unknown is the number of bytes of unknown fields they hold, if rejected.
+	unknown int
+}
+
+// pick returns what was picked up from the bytes of req, and fails it if it holds unknown fields.
+func (r *RawRequests) pick(method string, req interface{}) (*rawRequest, error) {
+	v, ok := r.stash.LoadAndDelete(req)
+	if !ok {
+		return &rawRequest{}, nil
+	}
+	raw := v.(*rawRequest)
+	if raw.unknown > 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "%s: the request holds %d bytes of unknown fields", methodName(method), raw.unknown)
+	}
+	return raw, nil
+}
+
+// UnaryServerInterceptor hands the bytes of the request of every unary call to its handler, see
+// RawRequest, and fails the requests with unknown fields if they are rejected.
+func (r *RawRequests) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		raw, err := r.pick(info.FullMethod, req)
+		if err != nil {
+			return nil, err
+		}
+		if raw.data != nil {
+			ctx = context.WithValue(ctx, rawRequestKey{}, raw.data)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor fails the streaming calls that receive a request with unknown fields, if
+// they are rejected.
+func (r *RawRequests) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &rawRequestStream{ServerStream: ss, r: r, method: info.FullMethod})
+	}
+}
+
+type rawRequestStream struct {
+	grpc.ServerStream
+	r      *RawRequests
+	method string
+}
+
+func (s *rawRequestStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	_, err := s.r.pick(s.method, m)
+	return err
+}
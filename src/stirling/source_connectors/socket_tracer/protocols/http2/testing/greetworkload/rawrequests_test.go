@@ -0,0 +1,216 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/proto"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// rawBytes is a message already marshaled, which rawBytesCodec sends as is.
+type rawBytes []byte
+
+// rawBytesCodec sends rawBytes as they are, as clients with a newer greet.proto would send
+// requests with fields the server does not know.
+type rawBytesCodec struct{}
+
+func (rawBytesCodec) Marshal(v interface{}) ([]byte, error) {
+	if b, ok := v.(rawBytes); ok {
+		return b, nil
+	}
+	return encoding.GetCodec(proto.Name).Marshal(v)
+}
+
+func (rawBytesCodec) Unmarshal(data []byte, v interface{}) error {
+	return encoding.GetCodec(proto.Name).Unmarshal(data, v)
+}
+
+func (rawBytesCodec) Name() string {
+	return proto.Name
+}
+
+// requestsWithUnknownFields returns HelloRequests named world, of count 3, with fields greet.proto
+// does not declare, of every wire type, before, between and after the known fields.
+func requestsWithUnknownFields(t *testing.T) map[string][]byte {
+	name, err := (&pb.HelloRequest{Name: "world"}).Marshal()
+	require.NoError(t, err)
+	count, err := (&pb.HelloRequest{Count: 3}).Marshal()
+	require.NoError(t, err)
+
+	varint := protowire.AppendVarint(protowire.AppendTag(nil, 15, protowire.VarintType), 1<<40)
+	fixed32 := protowire.AppendFixed32(protowire.AppendTag(nil, 16, protowire.Fixed32Type), 0xdeadbeef)
+	fixed64 := protowire.AppendFixed64(protowire.AppendTag(nil, 17, protowire.Fixed64Type), 0x0123456789abcdef)
+	bytes := protowire.AppendString(protowire.AppendTag(nil, 18, protowire.BytesType), "from a newer client")
+	group := protowire.AppendTag(nil, 19, protowire.StartGroupType)
+	group = protowire.AppendVarint(protowire.AppendTag(group, 1, protowire.VarintType), 7)
+	group = protowire.AppendTag(group, 19, protowire.EndGroupType)
+
+	join := func(parts ...[]byte) []byte {
+		var b []byte
+		for _, p := range parts {
+			b = append(b, p...)
+		}
+		return b
+	}
+	return map[string][]byte{
+		"varint after":     join(name, count, varint),
+		"fixed32 before":   join(fixed32, name, count),
+		"fixed64 between":  join(name, fixed64, count),
+		"bytes after":      join(name, count, bytes),
+		"group between":    join(name, group, count),
+		"every type":       join(varint, name, fixed32, fixed64, count, bytes, group),
+		"repeated unknown": join(name, bytes, count, bytes),
+	}
+}
+
+// startRawRequestsServer serves a Greeter and a StreamingGreeter with a RawRequests of opts, or
+// without one if opts is nil, and returns a connection to them.
+func startRawRequestsServer(t *testing.T, opts *greetworkload.RawRequestOptions, handler grpc.UnaryServerInterceptor) *grpc.ClientConn {
+	var serverOpts []grpc.ServerOption
+	var unary []grpc.UnaryServerInterceptor
+	if opts != nil {
+		raw := greetworkload.NewRawRequests(opts)
+		serverOpts = append(serverOpts, grpc.ForceServerCodec(raw.ServerCodec(encoding.GetCodec(proto.Name))),
+			grpc.ChainStreamInterceptor(raw.StreamServerInterceptor()))
+		unary = append(unary, raw.UnaryServerInterceptor())
+	}
+	if handler != nil {
+		unary = append(unary, handler)
+	}
+	s := startServerWith(t, &serverSetup{GRPC: append(serverOpts, grpc.ChainUnaryInterceptor(unary...))})
+
+	conn, err := grpc.Dial(s.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(rawBytesCodec{})))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// callWithUnknownFields makes a unary, a server streaming and a client streaming call with data,
+// and returns the replies, or the status codes of the calls that failed.
+func callWithUnknownFields(t *testing.T, conn *grpc.ClientConn, data []byte) map[string]string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	results := map[string]string{}
+	result := func(method, message string, err error) {
+		if err != nil {
+			results[method] = status.Code(err).String()
+		} else {
+			results[method] = message
+		}
+	}
+
+	reply := &pb.HelloReply{}
+	err := conn.Invoke(ctx, pb.Greeter_SayHello_FullMethodName, rawBytes(data), reply)
+	result("SayHello", reply.Message, err)
+
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, pb.StreamingGreeter_SayHelloServerStreaming_FullMethodName)
+	require.NoError(t, err)
+	require.NoError(t, stream.SendMsg(rawBytes(data)))
+	require.NoError(t, stream.CloseSend())
+	reply = &pb.HelloReply{}
+	err = stream.RecvMsg(reply)
+	result("SayHelloServerStreaming", reply.Message, err)
+
+	stream, err = conn.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true}, pb.StreamingGreeter_SayHelloClientStreaming_FullMethodName)
+	require.NoError(t, err)
+	known, err := (&pb.HelloRequest{Name: "pixie"}).Marshal()
+	require.NoError(t, err)
+	// Only the second request holds unknown fields.
+	require.NoError(t, stream.SendMsg(rawBytes(known)))
+	require.NoError(t, stream.SendMsg(rawBytes(data)))
+	require.NoError(t, stream.CloseSend())
+	reply = &pb.HelloReply{}
+	err = stream.RecvMsg(reply)
+	result("SayHelloClientStreaming", reply.Message, err)
+	return results
+}
+
+func TestRawRequests_UnknownFieldsIgnored(t *testing.T) {
+	ok := map[string]string{
+		"SayHello":                "Hello world",
+		"SayHelloServerStreaming": "Hello world",
+		"SayHelloClientStreaming": "Hello pixie, world!",
+	}
+	for _, opts := range []*greetworkload.RawRequestOptions{nil, {}, {Keep: true}} {
+		conn := startRawRequestsServer(t, opts, nil)
+		for name, data := range requestsWithUnknownFields(t) {
+			assert.Equal(t, ok, callWithUnknownFields(t, conn, data), "%s with %+v", name, opts)
+		}
+	}
+}
+
+func TestRawRequests_RejectUnknownFields(t *testing.T) {
+	conn := startRawRequestsServer(t, &greetworkload.RawRequestOptions{RejectUnknownFields: true}, nil)
+	rejected := map[string]string{
+		"SayHello":                codes.InvalidArgument.String(),
+		"SayHelloServerStreaming": codes.InvalidArgument.String(),
+		"SayHelloClientStreaming": codes.InvalidArgument.String(),
+	}
+	for name, data := range requestsWithUnknownFields(t) {
+		assert.Equal(t, rejected, callWithUnknownFields(t, conn, data), name)
+	}
+
+	// Requests without unknown fields are served.
+	known, err := (&pb.HelloRequest{Name: "world", Count: 3}).Marshal()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"SayHello":                "Hello world",
+		"SayHelloServerStreaming": "Hello world",
+		"SayHelloClientStreaming": "Hello pixie, world!",
+	}, callWithUnknownFields(t, conn, known))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = conn.Invoke(ctx, pb.Greeter_SayHello_FullMethodName, rawBytes(requestsWithUnknownFields(t)["bytes after"]), &pb.HelloReply{})
+	assert.Equal(t, "SayHello: the request holds 22 bytes of unknown fields", status.Convert(err).Message())
+}
+
+func TestRawRequest(t *testing.T) {
+	seen := make(chan []byte, 1)
+	conn := startRawRequestsServer(t, &greetworkload.RawRequestOptions{Keep: true},
+		func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			raw, ok := greetworkload.RawRequest(ctx)
+			assert.True(t, ok)
+			seen <- raw
+			return handler(ctx, req)
+		})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	data := requestsWithUnknownFields(t)["every type"]
+	require.NoError(t, conn.Invoke(ctx, pb.Greeter_SayHello_FullMethodName, rawBytes(data), &pb.HelloReply{}))
+	assert.Equal(t, data, <-seen)
+
+	_, ok := greetworkload.RawRequest(ctx)
+	assert.False(t, ok)
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CallRecord is the client's ground truth for a single call. Servers record the calls they handle
+// the same way, see RequestTracer, leaving out what only the client knows.
+type CallRecord struct {
+	Method     string    `json:"method"`
+	StartTime  time.Time `json:"start_time"`
+	DurationNS int64     `json:"duration_ns"`
+	// RequestID is the ID the client gave the call, sent in RequestIDHeader.
+	RequestID string `json:"request_id,omitempty"`
+	// Attempt is the number, from 1, of the attempt of the call the server answered, or for
+	// servers, of the attempt handled. Zero if the server never answered.
+	Attempt int `json:"attempt,omitempty"`
+	// Attempts is the number of attempts a hedged call was made with on the wire, see
+	// ClientOptions.HedgeDelay. Attempt is then the one that won.
+	Attempts int `json:"attempts,omitempty"`
+	// Cache is whether the server answered the call from its reply cache. One of CacheHit and
+	// CacheMiss, or empty if the server does not cache the call's replies.
+	Cache string `json:"cache,omitempty"`
+	// Code is the gRPC status code the call finished with.
+	Code  string `json:"code"`
+	Error string `json:"error,omitempty"`
+	// ExpectedCode is the gRPC status code the call was made to provoke, if not OK.
+	ExpectedCode string `json:"expected_code,omitempty"`
+	// Cancelled is true if the client cancelled the call before it completed.
+	Cancelled bool `json:"cancelled"`
+	// InstanceID is the ID of the server instance that answered the call, if the server reports one.
+	InstanceID string `json:"instance_id,omitempty"`
+	// Authority is the :authority of the call. Servers record the one they received, and clients
+	// the one they set, if they override gRPC's default.
+	Authority string `json:"authority,omitempty"`
+	// Handshake is how the HTTP/2 connection the call was made over was set up. One of the
+	// Handshake constants. Only known to the client.
+	Handshake string `json:"handshake,omitempty"`
+	// Transport is TransportH3 for the calls made over the experimental HTTP/3 transport, and
+	// empty for those made over HTTP/2.
+	Transport string `json:"transport,omitempty"`
+	// Termination is how the connection was ended by the call, if it was made over one of its own.
+	// One of the Termination constants.
+	Termination string `json:"termination,omitempty"`
+	// Connection is whether the call was made over a connection set up for it, or one set up
+	// beforehand. One of the Connection constants. Only recorded by WarmCold.
+	Connection string `json:"connection,omitempty"`
+	// LocalAddr is the local address of the connection the call was made over. Only recorded by
+	// WarmCold.
+	LocalAddr string `json:"local_addr,omitempty"`
+	// ChecksumMismatches holds the index, in the call, of every reply whose checksum did not match
+	// its message. Only recorded by clients that verify checksums.
+	ChecksumMismatches []int `json:"checksum_mismatches,omitempty"`
+	// StreamChecksumMismatch is true if the checksum the server sent for a reply stream did not
+	// match the messages received, or was missing. Only recorded by clients that verify checksums.
+	StreamChecksumMismatch bool `json:"stream_checksum_mismatch,omitempty"`
+	// RecvTimesNS holds the time, in Unix nanoseconds, at which each stream reply was received.
+	// Only recorded by throttled readers.
+	RecvTimesNS []int64 `json:"recv_times_ns,omitempty"`
+	// Names holds the name of every request the call sent, in order, and StreamCount the number
+	// of replies a server streaming call asked for. Only recorded by the client, so that Replay can
+	// send the same requests.
+	Names       []string `json:"names,omitempty"`
+	StreamCount int32    `json:"stream_count,omitempty"`
+	// QueueWaitNS is how long the call waited for one of the slots of RunAsync before it started.
+	QueueWaitNS int64 `json:"queue_wait_ns,omitempty"`
+	// Burst is the number, from 1, of the burst of RunBursts the call was issued in.
+	Burst int `json:"burst,omitempty"`
+	// Replies is the number of replies a server or bidirectional streaming call received.
+	Replies int `json:"replies,omitempty"`
+	// BatchFailures is the number of requests of a SayHelloBatch call that failed in their
+	// results, Names holding the name of every request of the batch.
+	BatchFailures int `json:"batch_failures,omitempty"`
+	// CancelPlanned is true if the client set out to cancel the call, whether or not it completed
+	// first. Unary calls are then cancelled CancelAfterNS after they start, and streaming calls
+	// once CancelAfterMessages messages are exchanged.
+	CancelPlanned       bool  `json:"cancel_planned,omitempty"`
+	CancelAfterNS       int64 `json:"cancel_after_ns,omitempty"`
+	CancelAfterMessages int   `json:"cancel_after_messages,omitempty"`
+	// DialNS, HeadersNS and MessageNS are how long after StartTime the call got a connection to
+	// send its headers over, received the response headers, and received its first message. Zero
+	// for the phases it did not reach, and for calls a Client did not follow through their phases.
+	DialNS    int64 `json:"dial_ns,omitempty"`
+	HeadersNS int64 `json:"headers_ns,omitempty"`
+	MessageNS int64 `json:"message_ns,omitempty"`
+	// TimeoutBudget is the budget the call exceeded, if any: BudgetDial, BudgetHeader or
+	// BudgetDeadline.
+	TimeoutBudget string `json:"timeout_budget,omitempty"`
+
+	// status is the status the call finished with, when it was recorded by this process.
+	status *status.Status
+	// phases follows the call through its phases until it is recorded.
+	phases *callPhases
+}
+
+// Completed returns true if the call finished successfully.
+func (r *CallRecord) Completed() bool {
+	return r.Code == codes.OK.String()
+}
+
+// Expected returns true if the call finished with the error it was made to provoke. Such calls are
+// not failures, even though they did not complete.
+func (r *CallRecord) Expected() bool {
+	return r.ExpectedCode != "" && r.Code == r.ExpectedCode
+}
+
+// Err returns nil if the call completed, was cancelled by the client or finished as expected, and
+// otherwise an *RPCError with the status it failed with.
+func (r *CallRecord) Err() error {
+	if r.Completed() || r.Cancelled || r.Expected() {
+		return nil
+	}
+	s := r.status
+	if s == nil {
+		code, ok := codeNames[r.Code]
+		if !ok {
+			code = codes.Unknown
+		}
+		s = status.New(code, r.Error)
+	}
+	return &RPCError{Method: r.Method, Status: s}
+}
+
+func isClientCancel(err error) bool {
+	return status.Code(err) == codes.Canceled
+}
+
+// TallyInstances counts the completed calls answered by each server instance.
+func TallyInstances(records []*CallRecord) map[string]int {
+	tally := make(map[string]int)
+	for _, r := range records {
+		if r.Completed() {
+			tally[r.InstanceID]++
+		}
+	}
+	return tally
+}
+
+// WriteRecords writes records to w as JSON lines, after a line holding meta, if not nil.
+func WriteRecords(w io.Writer, meta *RunMetadata, records []*CallRecord) error {
+	if err := writeRunMetadataLine(w, meta); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordLine is a line of the files written by WriteRecords: a CallRecord, or the RunMetadata of
+// the first line.
+type recordLine struct {
+	CallRecord
+	RunMetadata *RunMetadata `json:"run_metadata"`
+}
+
+// ReadRecords reads the JSON lines written by WriteRecords, skipping the RunMetadata, which
+// ReadRunMetadata reads.
+func ReadRecords(r io.Reader) ([]*CallRecord, error) {
+	var records []*CallRecord
+	dec := json.NewDecoder(r)
+	for first := true; dec.More(); first = false {
+		line := &recordLine{}
+		if err := dec.Decode(line); err != nil {
+			return nil, err
+		}
+		if first && line.RunMetadata != nil {
+			continue
+		}
+		records = append(records, &line.CallRecord)
+	}
+	return records, nil
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/proto"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// RelayedPrefix prefixes the message of the replies a relay wraps the replies of its upstream in.
+const RelayedPrefix = "Relayed: "
+
+// relayedHeaders are the metadata a relay forwards upstream. A SpanTracer on the upstream
+// connection replaces the trace context with that of its own client span.
+var relayedHeaders = []string{RequestIDHeader, "traceparent", "tracestate"}
+
+// DialUpstream dials the Greeter at address, in plaintext, for ServerOptions.Upstream.
+func DialUpstream(address string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	opts = append([]grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, opts...)
+	return grpc.Dial(address, opts...)
+}
+
+// relay forwards a SayHello request upstream, within the deadline of ctx, and wraps the reply. The
+// request is forwarded as it was received if a RawRequests kept its bytes, so that the fields the
+// relay does not know reach the upstream, and re-marshaled otherwise. Requests forwarded as is are
+// sent with the content-type "application/grpc+proto".
+func (s *Server) relay(ctx context.Context, in *pb.HelloRequest) (*pb.HelloReply, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var kv []string
+	for _, k := range relayedHeaders {
+		for _, v := range md.Get(k) {
+			kv = append(kv, k, v)
+		}
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, kv...)
+	reply := &pb.HelloReply{}
+	var err error
+	if raw, ok := RawRequest(ctx); ok {
+		err = s.opts.Upstream.Invoke(ctx, pb.Greeter_SayHello_FullMethodName, rawMessage(raw), reply, grpc.ForceCodec(rawCodec{}))
+	} else {
+		reply, err = pb.NewGreeterClient(s.opts.Upstream).SayHello(ctx, in)
+	}
+	if err != nil {
+		return nil, upstreamError(s.opts.Upstream.Target(), err)
+	}
+	return s.reply(RelayedPrefix + reply.Message), nil
+}
+
+// upstreamError is the error of a relayed call that failed upstream with err. Its code is kept, so
+// that a deadline that expired upstream is DeadlineExceeded and an upstream that cannot be reached
+// is Unavailable, and its message names the upstream along with the cause.
+func upstreamError(target string, err error) error {
+	s := status.Convert(err)
+	return status.Errorf(s.Code(), "upstream %s: %s", target, s.Message())
+}
+
+// rawMessage is a message already marshaled, which rawCodec sends as is.
+type rawMessage []byte
+
+// rawCodec sends rawMessages as they are, and marshals and unmarshals other messages with the
+// default codec.
+type rawCodec struct{}
+
+// Marshal implements encoding.Codec.
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(rawMessage); ok {
+		return m, nil
+	}
+	return encoding.GetCodec(proto.Name).Marshal(v)
+}
+
+// Unmarshal implements encoding.Codec.
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	return encoding.GetCodec(proto.Name).Unmarshal(data, v)
+}
+
+// Name implements encoding.Codec.
+func (rawCodec) Name() string {
+	return proto.Name
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/proto"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// serveBufconn serves a Greeter with opts and the interceptor, if any, over bufconn, and returns
+// a connection to it.
+func serveBufconn(t *testing.T, opts *greetworkload.ServerOptions, interceptor grpc.UnaryServerInterceptor) *grpc.ClientConn {
+	var serverOpts []grpc.ServerOption
+	if interceptor != nil {
+		serverOpts = append(serverOpts, grpc.UnaryInterceptor(interceptor))
+	}
+	return serveBufconnWith(t, opts, serverOpts...)
+}
+
+// serveBufconnWith is serveBufconn, with the gRPC server options serverOpts.
+func serveBufconnWith(t *testing.T, opts *greetworkload.ServerOptions, serverOpts ...grpc.ServerOption) *grpc.ClientConn {
+	lis := bufconn.Listen(1 << 20)
+	startServerWith(t, &serverSetup{Options: opts, GRPC: serverOpts, Listener: lis})
+
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// backendCall is what the backend of a relay saw of a call.
+type backendCall struct {
+	md       metadata.MD
+	deadline time.Time
+}
+
+func TestRelay_PropagatesMetadataAndDeadline(t *testing.T) {
+	calls := make(chan backendCall, 1)
+	backend := serveBufconn(t, &greetworkload.ServerOptions{InstanceID: "backend"},
+		func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			md, _ := metadata.FromIncomingContext(ctx)
+			deadline, _ := ctx.Deadline()
+			calls <- backendCall{md: md, deadline: deadline}
+			return handler(ctx, req)
+		})
+	relay := serveBufconn(t, &greetworkload.ServerOptions{InstanceID: "relay", Upstream: backend}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	ctx = metadata.AppendToOutgoingContext(ctx, greetworkload.RequestIDHeader, "relayed-id", "traceparent", traceparent)
+	reply, err := pb.NewGreeterClient(relay).SayHello(ctx, &pb.HelloRequest{Name: "chain"})
+	require.NoError(t, err)
+	assert.Equal(t, greetworkload.RelayedPrefix+"Hello chain", reply.Message)
+	assert.Equal(t, "relay", reply.InstanceId)
+
+	call := <-calls
+	assert.Equal(t, []string{"relayed-id"}, call.md.Get(greetworkload.RequestIDHeader))
+	assert.Equal(t, []string{traceparent}, call.md.Get("traceparent"))
+	require.False(t, call.deadline.IsZero(), "the deadline did not reach the backend")
+	// Every hop sends the time left as a grpc-timeout, rounded up, so the deadline may move a little.
+	assert.WithinDuration(t, deadline, call.deadline, 500*time.Millisecond)
+}
+
+func TestRelay_UpstreamDeadlineExceeded(t *testing.T) {
+	backend := serveBufconn(t, &greetworkload.ServerOptions{},
+		func(ctx context.Context, _ interface{}, _ *grpc.UnaryServerInfo, _ grpc.UnaryHandler) (interface{}, error) {
+			<-ctx.Done()
+			return nil, status.FromContextError(ctx.Err()).Err()
+		})
+	relay := serveBufconn(t, &greetworkload.ServerOptions{Upstream: backend}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := pb.NewGreeterClient(relay).SayHello(ctx, &pb.HelloRequest{Name: "slow"})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err), "%v", err)
+}
+
+func TestRelay_UpstreamRefused(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := lis.Addr().String()
+	require.NoError(t, lis.Close())
+	upstream, err := greetworkload.DialUpstream(address)
+	require.NoError(t, err)
+	defer upstream.Close()
+	relay := serveBufconn(t, &greetworkload.ServerOptions{Upstream: upstream}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err = pb.NewGreeterClient(relay).SayHello(ctx, &pb.HelloRequest{Name: "refused"})
+	s := status.Convert(err)
+	assert.Equal(t, codes.Unavailable, s.Code(), "%v", err)
+	assert.True(t, strings.HasPrefix(s.Message(), "upstream "+address+": "), s.Message())
+	assert.Contains(t, s.Message(), "connection refused")
+}
+
+// capturingCodec is the default codec, which sends the bytes of every HelloRequest it unmarshals
+// to requests.
+type capturingCodec struct {
+	encoding.Codec
+	requests chan []byte
+}
+
+func (c capturingCodec) Unmarshal(data []byte, v interface{}) error {
+	if _, ok := v.(*pb.HelloRequest); ok {
+		c.requests <- append([]byte{}, data...)
+	}
+	return c.Codec.Unmarshal(data, v)
+}
+
+func TestRelay_ForwardsUnknownFields(t *testing.T) {
+	requests := make(chan []byte, 1)
+	backend := serveBufconnWith(t, &greetworkload.ServerOptions{InstanceID: "backend"},
+		grpc.ForceServerCodec(capturingCodec{Codec: encoding.GetCodec(proto.Name), requests: requests}))
+	raw := greetworkload.NewRawRequests(&greetworkload.RawRequestOptions{Keep: true})
+	relay := serveBufconnWith(t, &greetworkload.ServerOptions{InstanceID: "relay", Upstream: backend},
+		grpc.ForceServerCodec(raw.ServerCodec(encoding.GetCodec(proto.Name))),
+		grpc.UnaryInterceptor(raw.UnaryServerInterceptor()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for name, data := range requestsWithUnknownFields(t) {
+		reply := &pb.HelloReply{}
+		require.NoError(t, relay.Invoke(ctx, pb.Greeter_SayHello_FullMethodName, rawBytes(data), reply, grpc.ForceCodec(rawBytesCodec{})), name)
+		assert.Equal(t, greetworkload.RelayedPrefix+"Hello world", reply.Message, name)
+		assert.Equal(t, data, <-requests, name)
+	}
+
+	// Requests built by the relay itself are marshaled as usual.
+	reply, err := pb.NewGreeterClient(relay).SayHello(ctx, &pb.HelloRequest{Name: "world", Count: 3})
+	require.NoError(t, err)
+	assert.Equal(t, greetworkload.RelayedPrefix+"Hello world", reply.Message)
+	known, err := (&pb.HelloRequest{Name: "world", Count: 3}).Marshal()
+	require.NoError(t, err)
+	assert.Equal(t, known, <-requests)
+}
+
+func TestRelay_WithoutRawRequestsDropsUnknownFields(t *testing.T) {
+	requests := make(chan []byte, 1)
+	backend := serveBufconnWith(t, &greetworkload.ServerOptions{},
+		grpc.ForceServerCodec(capturingCodec{Codec: encoding.GetCodec(proto.Name), requests: requests}))
+	relay := serveBufconn(t, &greetworkload.ServerOptions{Upstream: backend}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	known, err := (&pb.HelloRequest{Name: "world", Count: 3}).Marshal()
+	require.NoError(t, err)
+	for name, data := range requestsWithUnknownFields(t) {
+		require.NoError(t, relay.Invoke(ctx, pb.Greeter_SayHello_FullMethodName, rawBytes(data), &pb.HelloReply{}, grpc.ForceCodec(rawBytesCodec{})), name)
+		assert.Equal(t, known, <-requests, name)
+	}
+}
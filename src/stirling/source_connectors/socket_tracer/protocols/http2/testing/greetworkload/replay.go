@@ -0,0 +1,181 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrReplayDiverged reports that calls replayed by Replay finished with other status codes than
+// the calls they replay.
+var ErrReplayDiverged = errors.New("replay diverged")
+
+// ReplayOptions configure Replay.
+type ReplayOptions struct {
+	// NoTiming issues every call as soon as the one before it finishes, rather than at the offset
+	// from the first call it was recorded at.
+	NoTiming bool
+	// Tolerance is how much later than its recorded offset a call may start before it is reported
+	// as late.
+	Tolerance time.Duration
+	// DialOptions are added to those of the connection every call is made over.
+	DialOptions []grpc.DialOption
+}
+
+// ReplayedCall is a recorded call along with its replay.
+type ReplayedCall struct {
+	Original *CallRecord
+	Replayed *CallRecord
+	// Lag is how much later than its recorded offset from the first call the replay started. Zero
+	// with ReplayOptions.NoTiming.
+	Lag time.Duration
+	// Late is true if Lag exceeds ReplayOptions.Tolerance.
+	Late bool
+}
+
+// CodeDiverged returns true if the replay finished with another status code than the original call.
+func (c *ReplayedCall) CodeDiverged() bool {
+	return c.Original.Code != c.Replayed.Code
+}
+
+// RepliesDiverged returns true if the replay of a streaming call received another number of
+// replies than the original call.
+func (c *ReplayedCall) RepliesDiverged() bool {
+	return c.Original.Replies != c.Replayed.Replies
+}
+
+// replayable are the methods Replay knows how to call again.
+var replayable = map[string]bool{
+	"SayHello":                true,
+	"SayHelloBatch":           true,
+	"SayHelloServerStreaming": true,
+	"SayHelloClientStreaming": true,
+	"SayHelloBidirStreaming":  true,
+}
+
+// Replay makes the calls in records again, in order, each over a new connection to address. A
+// call sends the same requests as the one it replays, and is cancelled at the same point if the
+// original call was planned to be. Unless opts.NoTiming is set, every call starts at the same
+// offset from the first call as it was recorded at, or as soon as the call before it finishes.
+//
+// Only how the calls were made is replayed: records of calls made over connections set up or
+// ended in other ways, such as with TerminationReset, are replayed over a regular connection.
+// Records of other methods than Greeter.SayHello, Greeter.SayHelloBatch and those of
+// StreamingGreeter are rejected before any call is made. If ctx is done, no new call starts, the
+// call in flight is cancelled, and Replay returns ctx.Err() along with the calls made so far.
+func (c *Client) Replay(ctx context.Context, address string, records []*CallRecord, opts *ReplayOptions) ([]*ReplayedCall, error) {
+	ctx = c.opts.Audit.root(ctx)
+	for i, r := range records {
+		if !replayable[r.Method] {
+			return nil, fmt.Errorf("record %d: %s calls cannot be replayed", i, r.Method)
+		}
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	calls := make([]*ReplayedCall, 0, len(records))
+	start := time.Now()
+	for _, r := range records {
+		call := &ReplayedCall{Original: r}
+		if !opts.NoTiming {
+			at := start.Add(r.StartTime.Sub(records[0].StartTime))
+			if err := sleepUntil(ctx, at); err != nil {
+				return calls, err
+			}
+			call.Lag = time.Since(at)
+			call.Late = call.Lag > opts.Tolerance
+		} else if err := ctx.Err(); err != nil {
+			return calls, err
+		}
+		call.Replayed = c.replayCall(ctx, address, r, opts.DialOptions)
+		calls = append(calls, call)
+	}
+	return calls, nil
+}
+
+// replayCall makes the call recorded in r again, over a new connection to address, cancelled once
+// ctx is done.
+func (c *Client) replayCall(ctx context.Context, address string, r *CallRecord, dialOpts []grpc.DialOption) *CallRecord {
+	conn, err := c.Dial(address, dialOpts...)
+	if err != nil {
+		return c.finish(newCallRecord(r.Method), cancelPlan{}, status.Error(codes.Unavailable, err.Error()))
+	}
+	defer conn.Close()
+
+	p := recordedCancelPlan(r)
+	var name string
+	if len(r.Names) > 0 {
+		name = r.Names[0]
+	}
+	switch r.Method {
+	case "SayHelloServerStreaming":
+		return c.serverStreaming(ctx, conn, name, r.StreamCount, p, nil)
+	case "SayHelloClientStreaming":
+		return c.clientStreaming(ctx, conn, r.Names, p)
+	case "SayHelloBidirStreaming":
+		return c.bidirStreaming(ctx, conn, r.Names, p)
+	case "SayHelloBatch":
+		return c.sayHelloBatch(ctx, conn, r.Names, p)
+	default:
+		return c.sayHello(ctx, conn, name, p)
+	}
+}
+
+// sleepUntil waits until t, or until ctx is done.
+func sleepUntil(ctx context.Context, t time.Time) error {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CheckReplay returns an error wrapping ErrReplayDiverged if any call finished with another status
+// code than the call it replays.
+func CheckReplay(calls []*ReplayedCall) error {
+	var diverged int
+	var first *ReplayedCall
+	for _, c := range calls {
+		if c.CodeDiverged() {
+			if first == nil {
+				first = c
+			}
+			diverged++
+		}
+	}
+	if diverged == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %d of %d calls, first %s request_id=%s: %s, replayed as %s", ErrReplayDiverged,
+		diverged, len(calls), first.Original.Method, first.Original.RequestID, first.Original.Code, first.Replayed.Code)
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// recordRun makes calls with c against addr, waiting gap after each, and returns their records as
+// read back from JSON lines.
+func recordRun(t *testing.T, c *greetworkload.Client, addr string, gap time.Duration, calls ...func(*grpc.ClientConn) *greetworkload.CallRecord) []*greetworkload.CallRecord {
+	var records []*greetworkload.CallRecord
+	for _, call := range calls {
+		conn, err := c.Dial(addr)
+		require.NoError(t, err)
+		records = append(records, call(conn))
+		conn.Close()
+		time.Sleep(gap)
+	}
+	var buf bytes.Buffer
+	require.NoError(t, greetworkload.WriteRecords(&buf, nil, records))
+	read, err := greetworkload.ReadRecords(&buf)
+	require.NoError(t, err)
+	return read
+}
+
+func TestReplay_RepeatsCalls(t *testing.T) {
+	_, addr := startServer(t, nil)
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, StreamCount: 5})
+	names := []string{"a", "b", "c", "d"}
+	const gap = 50 * time.Millisecond
+	records := recordRun(t, c, addr, gap,
+		func(conn *grpc.ClientConn) *greetworkload.CallRecord { return c.SayHello(conn, "pixie") },
+		func(conn *grpc.ClientConn) *greetworkload.CallRecord { return c.ServerStreaming(conn, "pixie") },
+		func(conn *grpc.ClientConn) *greetworkload.CallRecord { return c.ClientStreaming(conn, names) },
+		func(conn *grpc.ClientConn) *greetworkload.CallRecord { return c.BidirStreaming(conn, names) },
+		func(conn *grpc.ClientConn) *greetworkload.CallRecord { return c.SayHelloBatch(conn, names) },
+	)
+	assert.Equal(t, 5, records[1].Replies)
+	assert.Equal(t, 4, records[3].Replies)
+
+	replayer := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	start := time.Now()
+	calls, err := replayer.Replay(context.Background(), addr, records, &greetworkload.ReplayOptions{Tolerance: gap})
+	require.NoError(t, err)
+	require.Len(t, calls, len(records))
+	assert.GreaterOrEqual(t, time.Since(start), records[3].StartTime.Sub(records[0].StartTime))
+
+	for i, call := range calls {
+		assert.Same(t, records[i], call.Original)
+		assert.Equal(t, call.Original.Method, call.Replayed.Method)
+		assert.Equal(t, call.Original.Names, call.Replayed.Names)
+		assert.Equal(t, call.Original.StreamCount, call.Replayed.StreamCount)
+		assert.NotEqual(t, call.Original.RequestID, call.Replayed.RequestID)
+		assert.False(t, call.CodeDiverged(), "%s: %s", call.Replayed.Method, call.Replayed.Error)
+		assert.False(t, call.RepliesDiverged(), call.Replayed.Method)
+		assert.False(t, call.Late, "%s started %v late", call.Replayed.Method, call.Lag)
+	}
+	assert.NoError(t, greetworkload.CheckReplay(calls))
+}
+
+func TestReplay_RepeatsCancellations(t *testing.T) {
+	_, addr := startServer(t, nil)
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{
+		Timeout:        5 * time.Second,
+		StreamCount:    20,
+		CancelFraction: 1,
+		Seed:           1,
+	})
+	records := recordRun(t, c, addr, 0,
+		func(conn *grpc.ClientConn) *greetworkload.CallRecord { return c.ServerStreaming(conn, "pixie") },
+		func(conn *grpc.ClientConn) *greetworkload.CallRecord { return c.ServerStreaming(conn, "pixie") },
+	)
+
+	// The replaying client never plans cancellations of its own.
+	replayer, _ := newAuditedClient(t, &greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	calls, err := replayer.Replay(context.Background(), addr, records, &greetworkload.ReplayOptions{NoTiming: true})
+	require.NoError(t, err)
+	for _, call := range calls {
+		require.True(t, call.Original.CancelPlanned)
+		assert.True(t, call.Replayed.CancelPlanned)
+		assert.Equal(t, call.Original.CancelAfterMessages, call.Replayed.CancelAfterMessages)
+		assert.Equal(t, call.Original.Cancelled, call.Replayed.Cancelled)
+		assert.Equal(t, call.Original.Code, call.Replayed.Code)
+	}
+}
+
+func TestReplay_NoTiming(t *testing.T) {
+	_, addr := startServer(t, nil)
+	start := time.Now()
+	records := []*greetworkload.CallRecord{
+		{Method: "SayHello", StartTime: start, Code: codes.OK.String(), Names: []string{"a"}},
+		{Method: "SayHello", StartTime: start.Add(time.Minute), Code: codes.OK.String(), Names: []string{"b"}},
+	}
+	c, _ := newAuditedClient(t, &greetworkload.ClientOptions{Timeout: 5 * time.Second})
+
+	calls, err := c.Replay(context.Background(), addr, records, &greetworkload.ReplayOptions{NoTiming: true})
+	require.NoError(t, err)
+	require.Len(t, calls, 2)
+	assert.Less(t, time.Since(start), 30*time.Second)
+	assert.NoError(t, greetworkload.CheckReplay(calls))
+
+	// With timing, the second call is not made before the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	calls, err = c.Replay(ctx, addr, records, &greetworkload.ReplayOptions{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Len(t, calls, 1)
+}
+
+func TestReplay_ReportsDivergence(t *testing.T) {
+	_, addr := startServer(t, nil)
+	records := []*greetworkload.CallRecord{
+		{Method: "SayHello", StartTime: time.Now(), Code: codes.OK.String(), Names: []string{"a"}},
+		{Method: "SayHello", StartTime: time.Now(), Code: codes.Unavailable.String(), Names: []string{"b"}},
+	}
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+
+	calls, err := c.Replay(context.Background(), addr, records, &greetworkload.ReplayOptions{NoTiming: true})
+	require.NoError(t, err)
+	assert.False(t, calls[0].CodeDiverged())
+	assert.True(t, calls[1].CodeDiverged())
+	err = greetworkload.CheckReplay(calls)
+	assert.True(t, errors.Is(err, greetworkload.ErrReplayDiverged), err)
+	assert.Contains(t, err.Error(), "1 of 2 calls")
+}
+
+func TestReplay_RejectsUnknownMethods(t *testing.T) {
+	records := []*greetworkload.CallRecord{
+		{Method: "SayHello", StartTime: time.Now()},
+		{Method: "SayHelloUnimplemented", StartTime: time.Now()},
+	}
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{})
+	calls, err := c.Replay(context.Background(), "localhost:0", records, &greetworkload.ReplayOptions{NoTiming: true})
+	assert.Error(t, err)
+	assert.Empty(t, calls)
+}
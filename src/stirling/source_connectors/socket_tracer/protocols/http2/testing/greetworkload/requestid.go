@@ -0,0 +1,224 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// RequestIDHeader is the metadata that carries the ID the client gave a call. Every attempt of
+	// a call carries the same ID, and the server echoes it in the trailer.
+	RequestIDHeader = "x-request-id"
+	// RequestAttemptTrailer is the trailer in which the server sends the attempt number, from 1, of
+	// the call it answered.
+	RequestAttemptTrailer = "x-request-attempt"
+	// previousAttemptsHeader is the metadata gRPC adds to the attempts it retries.
+	previousAttemptsHeader = "grpc-previous-rpc-attempts"
+)
+
+// NewRequestID returns a new random request ID.
+func NewRequestID() string {
+	return uuid.Must(uuid.NewV4()).String()
+}
+
+func newCallRecord(method string) *CallRecord {
+	return &CallRecord{Method: method, StartTime: time.Now(), RequestID: NewRequestID()}
+}
+
+// withRequestID sends the request ID of r with the call made in ctx.
+func withRequestID(ctx context.Context, r *CallRecord) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, RequestIDHeader, r.RequestID)
+}
+
+// setAttempt records in r the attempt number the server sent in trailer, if any.
+func setAttempt(r *CallRecord, trailer metadata.MD) {
+	if v := trailer.Get(RequestAttemptTrailer); len(v) == 1 {
+		if n, err := strconv.Atoi(v[0]); err == nil {
+			r.Attempt = n
+		}
+	}
+}
+
+// methodName returns the name of the method in fullMethod, e.g. "SayHello" for
+// "/px.stirling.protocols.http2.testing.Greeter/SayHello".
+func methodName(fullMethod string) string {
+	return fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+}
+
+// RequestTracerOptions configure a RequestTracer.
+type RequestTracerOptions struct {
+	// KeepRecords keeps a CallRecord of every call handled, see Records.
+	KeepRecords bool
+	// EventLog, if set, is appended the record of every call handled instead, without taking a
+	// lock, for rates at which keeping every record in memory would hold servers back.
+	EventLog *EventLog
+	// LogMessages logs every call handled, and every message of a streaming call with its
+	// sequence number in the stream.
+	LogMessages bool
+	// Ring, if set, is also added the record of every call handled, so that the last ones can be
+	// dumped.
+	Ring *RequestRing
+}
+
+// RequestTracer picks up the request ID and attempt number of the calls handled by a server,
+// echoes them in the trailer, and records them. Calls without a request ID are traced with an
+// empty one, and get no trailer, so that their trailers are those of a plain gRPC server. Calls to the GreeterStats, GreeterFeatures, health and reflection services are left
+// alone.
+type RequestTracer struct {
+	opts *RequestTracerOptions
+
+	mu      sync.Mutex
+	records []*CallRecord
+}
+
+// NewRequestTracer creates a new RequestTracer. A nil opts only echoes request IDs.
+func NewRequestTracer(opts *RequestTracerOptions) *RequestTracer {
+	if opts == nil {
+		opts = &RequestTracerOptions{}
+	}
+	return &RequestTracer{opts: opts}
+}
+
+// start returns the record of the call made in ctx, and the trailer that echoes its request ID, or
+// nil if it carried none.
+func (t *RequestTracer) start(ctx context.Context, fullMethod string) (*CallRecord, metadata.MD) {
+	r := &CallRecord{Method: methodName(fullMethod), StartTime: time.Now(), Attempt: 1, Authority: IncomingAuthority(ctx), Transport: callTransport(ctx)}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(RequestIDHeader); len(v) > 0 {
+		r.RequestID = v[0]
+	}
+	if v := md.Get(previousAttemptsHeader); len(v) > 0 {
+		if n, err := strconv.Atoi(v[0]); err == nil {
+			r.Attempt = n + 1
+		}
+	}
+	if r.RequestID == "" {
+		return r, nil
+	}
+	return r, metadata.Pairs(RequestIDHeader, r.RequestID, RequestAttemptTrailer, strconv.Itoa(r.Attempt))
+}
+
+func (t *RequestTracer) finish(r *CallRecord, err error) {
+	r.DurationNS = time.Since(r.StartTime).Nanoseconds()
+	r.Code = status.Code(err).String()
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if t.opts.LogMessages {
+		log.Printf("call method=%s request_id=%s attempt=%d authority=%s code=%s duration_ns=%d", r.Method, r.RequestID, r.Attempt, r.Authority, r.Code, r.DurationNS)
+	}
+	if t.opts.Ring != nil {
+		t.opts.Ring.Add(r)
+	}
+	if t.opts.EventLog != nil {
+		t.opts.EventLog.Append(r)
+	} else if t.opts.KeepRecords {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.records = append(t.records, r)
+	}
+}
+
+// Records returns the records of the calls handled so far, in the order they finished. Only kept
+// with KeepRecords, or decoded from the EventLog.
+func (t *RequestTracer) Records() []*CallRecord {
+	if t.opts.EventLog != nil {
+		return t.opts.EventLog.Records()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*CallRecord(nil), t.records...)
+}
+
+// UnaryServerInterceptor traces unary calls. It should come before the interceptors that fail
+// calls, so that their attempts are traced too.
+func (t *RequestTracer) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if outsideWorkload(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		r, trailer := t.start(ctx, info.FullMethod)
+		resp, err := handler(ctx, req)
+		if trailer != nil {
+			if setErr := grpc.SetTrailer(ctx, trailer); setErr != nil {
+				log.Printf("Failed to echo request ID %s: %v", r.RequestID, setErr)
+			}
+		}
+		t.finish(r, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor traces streaming calls. It should come before the interceptors that
+// fail calls, so that their attempts are traced too.
+func (t *RequestTracer) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if outsideWorkload(info.FullMethod) {
+			return handler(srv, ss)
+		}
+		r, trailer := t.start(ss.Context(), info.FullMethod)
+		err := handler(srv, &tracedStream{ServerStream: ss, record: r, log: t.opts.LogMessages})
+		if trailer != nil {
+			ss.SetTrailer(trailer)
+		}
+		t.finish(r, err)
+		return err
+	}
+}
+
+// tracedStream numbers the messages of a stream, from 0 in each direction.
+type tracedStream struct {
+	grpc.ServerStream
+	record *CallRecord
+	log    bool
+	sent   int
+	recvd  int
+}
+
+func (s *tracedStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		if s.log {
+			log.Printf("message method=%s request_id=%s attempt=%d direction=sent seq=%d", s.record.Method, s.record.RequestID, s.record.Attempt, s.sent)
+		}
+		s.sent++
+	}
+	return err
+}
+
+func (s *tracedStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		if s.log {
+			log.Printf("message method=%s request_id=%s attempt=%d direction=received seq=%d", s.record.Method, s.record.RequestID, s.record.Attempt, s.recvd)
+		}
+		s.recvd++
+	}
+	return err
+}
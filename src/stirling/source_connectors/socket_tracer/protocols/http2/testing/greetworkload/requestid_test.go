@@ -0,0 +1,180 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+func startTracedServer(t *testing.T, tracer *greetworkload.RequestTracer, faults *greetworkload.FaultInjector) string {
+	return startServerWith(t, &serverSetup{GRPC: []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(tracer.UnaryServerInterceptor(), faults.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(tracer.StreamServerInterceptor(), faults.StreamServerInterceptor()),
+	}}).Addr
+}
+
+func TestRequestTracer_EchoesRequestID(t *testing.T) {
+	faults, err := greetworkload.NewFaultInjector(nil, 1)
+	require.NoError(t, err)
+	addr := startTracedServer(t, greetworkload.NewRequestTracer(nil), faults)
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, greetworkload.RequestIDHeader, "abc")
+	var trailer metadata.MD
+	_, err = pb.NewGreeterClient(conn).SayHello(ctx, &pb.HelloRequest{Name: "pixie"}, grpc.Trailer(&trailer))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"abc"}, trailer.Get(greetworkload.RequestIDHeader))
+	assert.Equal(t, []string{"1"}, trailer.Get(greetworkload.RequestAttemptTrailer))
+}
+
+func TestRequestTracer_NoTrailerWithoutRequestID(t *testing.T) {
+	faults, err := greetworkload.NewFaultInjector(nil, 1)
+	require.NoError(t, err)
+	addr := startTracedServer(t, greetworkload.NewRequestTracer(nil), faults)
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var trailer metadata.MD
+	_, err = pb.NewGreeterClient(conn).SayHello(ctx, &pb.HelloRequest{Name: "pixie"}, grpc.Trailer(&trailer))
+	require.NoError(t, err)
+	assert.Empty(t, trailer.Get(greetworkload.RequestIDHeader))
+	assert.Empty(t, trailer.Get(greetworkload.RequestAttemptTrailer))
+}
+
+func TestRequestTracer_IDsSurviveRetries(t *testing.T) {
+	tracer := greetworkload.NewRequestTracer(&greetworkload.RequestTracerOptions{KeepRecords: true})
+	faults, err := greetworkload.NewFaultInjector(&greetworkload.FaultConfig{ErrorRate: 0.5, Code: codes.Unavailable}, 1)
+	require.NoError(t, err)
+	addr := startTracedServer(t, tracer, faults)
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, Retries: true})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var records []*greetworkload.CallRecord
+	for i := 0; i < 10; i++ {
+		records = append(records,
+			c.SayHello(conn, "pixie"),
+			c.ServerStreaming(conn, "pixie"),
+			c.ClientStreaming(conn, []string{"a", "b"}),
+			c.BidirStreaming(conn, []string{"a", "b"}))
+	}
+
+	attempts := make(map[string][]*greetworkload.CallRecord)
+	for _, r := range tracer.Records() {
+		attempts[r.RequestID] = append(attempts[r.RequestID], r)
+	}
+	require.Len(t, attempts, len(records), "every call, and only those, reached the server")
+
+	retried := 0
+	for _, r := range records {
+		require.NotEmpty(t, r.RequestID)
+		served := attempts[r.RequestID]
+		require.NotEmpty(t, served, "%s %s", r.Method, r.RequestID)
+		sort.Slice(served, func(i, j int) bool { return served[i].Attempt < served[j].Attempt })
+		for i, s := range served {
+			assert.Equal(t, r.Method, s.Method)
+			assert.Equal(t, i+1, s.Attempt, "attempts of %s are numbered in order", r.RequestID)
+			if i < len(served)-1 {
+				assert.Equal(t, codes.Unavailable.String(), s.Code)
+			}
+		}
+		// The client saw the outcome of the last attempt.
+		last := served[len(served)-1]
+		assert.Equal(t, last.Attempt, r.Attempt)
+		assert.Equal(t, last.Code, r.Code)
+		if len(served) > 1 {
+			retried++
+		}
+	}
+	assert.Greater(t, retried, 0)
+}
+
+// syncBuffer is a bytes.Buffer that can be written by the logger while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRequestTracer_LogsStreamMessages(t *testing.T) {
+	logs := &syncBuffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	tracer := greetworkload.NewRequestTracer(&greetworkload.RequestTracerOptions{LogMessages: true})
+	faults, err := greetworkload.NewFaultInjector(nil, 1)
+	require.NoError(t, err)
+	addr := startTracedServer(t, tracer, faults)
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, StreamCount: 3})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	r := c.ServerStreaming(conn, "pixie")
+	require.True(t, r.Completed(), r.Error)
+	assert.Equal(t, 1, r.Attempt)
+	// The call is only logged once the server stream ends, which may be after the client saw it end.
+	require.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), "call method=SayHelloServerStreaming request_id="+r.RequestID)
+	}, 5*time.Second, 10*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		// Both sides log every reply with its sequence number.
+		assert.Contains(t, logs.String(), fmt.Sprintf("message method=SayHelloServerStreaming request_id=%s attempt=1 direction=sent seq=%d", r.RequestID, i))
+		assert.Contains(t, logs.String(), fmt.Sprintf("request_id=%s seq=%d", r.RequestID, i))
+	}
+	assert.Contains(t, logs.String(), fmt.Sprintf("message method=SayHelloServerStreaming request_id=%s attempt=1 direction=received seq=0", r.RequestID))
+}
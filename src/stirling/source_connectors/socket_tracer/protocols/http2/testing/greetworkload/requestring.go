@@ -0,0 +1,144 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+	"unsafe"
+)
+
+// DefaultRequestRingCapacity is the capacity of the request rings of servers that set none.
+const DefaultRequestRingCapacity = 10000
+
+// RequestRingDumpSignal returns the signal on which servers dump their RequestRing to a file,
+// SIGQUIT, or an UnsupportedPlatformError on platforms without one. Go no longer dumps the stacks
+// of the goroutines on that signal once it is caught.
+func RequestRingDumpSignal() (os.Signal, error) {
+	if err := CheckPlatform(FeatureRequestRingDumpSignal); err != nil {
+		return nil, err
+	}
+	return requestRingDumpSignal, nil
+}
+
+// RequestRingEntry is a record of a RequestRing, with its sequence number: the number of records
+// added to the ring before it.
+type RequestRingEntry struct {
+	Seq uint64 `json:"seq"`
+	*CallRecord
+}
+
+// RequestRingDump is what a RequestRing holds when it is dumped.
+type RequestRingDump struct {
+	Capacity int `json:"capacity"`
+	// Written is the number of records added to the ring so far, and Dropped the number of those
+	// overwritten by newer ones, which the dump no longer holds.
+	Written uint64 `json:"written"`
+	Dropped uint64 `json:"dropped"`
+	// Records are the records the ring holds, oldest first. Records still being added when the ring
+	// is dumped may be missing.
+	Records []RequestRingEntry `json:"records"`
+}
+
+// RequestRing keeps the records of the last calls a server handled, in a fixed number of slots
+// that newer records overwrite, so that they can be dumped when something goes wrong without
+// keeping every record. Writers reserve slots with an atomic counter, and swap their record in
+// atomically, so that adding a record takes no lock and dumps never see it half written. Add it
+// to a RequestTracer with RequestTracerOptions.Ring.
+type RequestRing struct {
+	// written is first, so that it is 64-bit aligned for atomic operations on 32-bit platforms.
+	written uint64
+	// slots hold *RequestRingEntry. atomic.Pointer needs Go 1.19.
+	slots []unsafe.Pointer
+}
+
+// NewRequestRing creates a RequestRing of the given capacity.
+func NewRequestRing(capacity int) (*RequestRing, error) {
+	if capacity <= 0 {
+		return nil, badFlagsf("the request ring needs a positive capacity, got %d", capacity)
+	}
+	return &RequestRing{slots: make([]unsafe.Pointer, capacity)}, nil
+}
+
+// Add adds r to the ring, overwriting the oldest record once the ring is full. r must not be
+// modified afterwards.
+func (g *RequestRing) Add(r *CallRecord) {
+	seq := atomic.AddUint64(&g.written, 1) - 1
+	e := &RequestRingEntry{Seq: seq, CallRecord: r}
+	slot := &g.slots[seq%uint64(len(g.slots))]
+	for {
+		old := atomic.LoadPointer(slot)
+		// A writer that took as long as it takes to add as many records as the ring holds finds its
+		// slot taken by a newer record, which it leaves there.
+		if old != nil && (*RequestRingEntry)(old).Seq > seq {
+			return
+		}
+		if atomic.CompareAndSwapPointer(slot, old, unsafe.Pointer(e)) {
+			return
+		}
+	}
+}
+
+// Dump returns what the ring holds.
+func (g *RequestRing) Dump() *RequestRingDump {
+	d := &RequestRingDump{Capacity: len(g.slots), Records: make([]RequestRingEntry, 0, len(g.slots))}
+	for i := range g.slots {
+		if e := (*RequestRingEntry)(atomic.LoadPointer(&g.slots[i])); e != nil {
+			d.Records = append(d.Records, *e)
+		}
+	}
+	sort.Slice(d.Records, func(i, j int) bool { return d.Records[i].Seq < d.Records[j].Seq })
+	d.Written = atomic.LoadUint64(&g.written)
+	if d.Written > uint64(len(g.slots)) {
+		d.Dropped = d.Written - uint64(len(g.slots))
+	}
+	return d
+}
+
+// WriteJSON writes the Dump of the ring to w as JSON.
+func (g *RequestRing) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(g.Dump())
+}
+
+// DumpToFile writes the Dump of the ring to the file at path as JSON, replacing it once it is
+// complete, and returns it.
+func (g *RequestRing) DumpToFile(path string) (*RequestRingDump, error) {
+	d := g.Dump()
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(d); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return d, os.Rename(tmp, path)
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+func newRequestRing(t *testing.T, capacity int) *greetworkload.RequestRing {
+	g, err := greetworkload.NewRequestRing(capacity)
+	require.NoError(t, err)
+	return g
+}
+
+func TestRequestRing_KeepsNewest(t *testing.T) {
+	g := newRequestRing(t, 8)
+	assert.Equal(t, &greetworkload.RequestRingDump{Capacity: 8, Records: []greetworkload.RequestRingEntry{}}, g.Dump())
+
+	for i := 0; i < 5; i++ {
+		g.Add(&greetworkload.CallRecord{Method: "SayHello", RequestID: strconv.Itoa(i), Code: "OK"})
+	}
+	d := g.Dump()
+	assert.Equal(t, uint64(5), d.Written)
+	assert.Zero(t, d.Dropped)
+	require.Len(t, d.Records, 5)
+
+	for i := 5; i < 29; i++ {
+		g.Add(&greetworkload.CallRecord{Method: "SayHello", RequestID: strconv.Itoa(i), Code: "OK"})
+	}
+	d = g.Dump()
+	assert.Equal(t, 8, d.Capacity)
+	assert.Equal(t, uint64(29), d.Written)
+	assert.Equal(t, uint64(21), d.Dropped)
+	require.Len(t, d.Records, 8)
+	for i, e := range d.Records {
+		assert.Equal(t, uint64(21+i), e.Seq)
+		assert.Equal(t, strconv.Itoa(21+i), e.RequestID)
+	}
+}
+
+func TestRequestRing_ConcurrentWriters(t *testing.T) {
+	const writers, perWriter, capacity = 16, 1000, 100
+	g := newRequestRing(t, capacity)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				// Every field tells the same writer and index, for dumps to check records whole.
+				g.Add(&greetworkload.CallRecord{
+					Method:     fmt.Sprintf("m%d", w),
+					RequestID:  fmt.Sprintf("%d-%d", w, i),
+					Attempt:    w + 1,
+					DurationNS: int64(w*perWriter + i),
+				})
+				if i%100 == 0 {
+					checkRequestRingDump(t, g.Dump(), perWriter)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	d := g.Dump()
+	checkRequestRingDump(t, d, perWriter)
+	assert.Equal(t, uint64(writers*perWriter), d.Written)
+	assert.Equal(t, uint64(writers*perWriter-capacity), d.Dropped)
+	require.Len(t, d.Records, capacity)
+	for i, e := range d.Records {
+		assert.Equal(t, uint64(writers*perWriter-capacity+i), e.Seq)
+	}
+}
+
+func checkRequestRingDump(t *testing.T, d *greetworkload.RequestRingDump, perWriter int) {
+	assert.LessOrEqual(t, len(d.Records), d.Capacity)
+	for i, e := range d.Records {
+		if i > 0 {
+			assert.Less(t, d.Records[i-1].Seq, e.Seq)
+		}
+		w, n := int(e.DurationNS)/perWriter, int(e.DurationNS)%perWriter
+		assert.Equal(t, fmt.Sprintf("m%d", w), e.Method)
+		assert.Equal(t, fmt.Sprintf("%d-%d", w, n), e.RequestID)
+		assert.Equal(t, w+1, e.Attempt)
+	}
+}
+
+func TestRequestRing_Admin(t *testing.T) {
+	g := newRequestRing(t, 2)
+	tracer := greetworkload.NewRequestTracer(&greetworkload.RequestTracerOptions{Ring: g})
+	faults, err := greetworkload.NewFaultInjector(nil, 1)
+	require.NoError(t, err)
+	addr := startTracedServer(t, tracer, faults)
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, id := range []string{"a", "b", "c"} {
+		_, err := pb.NewGreeterClient(conn).SayHello(metadata.AppendToOutgoingContext(ctx, greetworkload.RequestIDHeader, id), &pb.HelloRequest{Name: "pixie"})
+		require.NoError(t, err)
+	}
+	// Without KeepRecords, the tracer keeps nothing beside the ring.
+	assert.Empty(t, tracer.Records())
+
+	admin := httptest.NewServer(greetworkload.NewAdminMux(faults, nil, g))
+	defer admin.Close()
+	resp, err := http.Get(admin.URL + "/requests")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	d := &greetworkload.RequestRingDump{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(d))
+	assert.Equal(t, 2, d.Capacity)
+	assert.Equal(t, uint64(3), d.Written)
+	assert.Equal(t, uint64(1), d.Dropped)
+	require.Len(t, d.Records, 2)
+	for i, id := range []string{"b", "c"} {
+		assert.Equal(t, uint64(i+1), d.Records[i].Seq)
+		assert.Equal(t, id, d.Records[i].RequestID)
+		assert.Equal(t, "SayHello", d.Records[i].Method)
+		assert.Equal(t, "OK", d.Records[i].Code)
+	}
+
+	resp, err = http.Post(admin.URL+"/requests", "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	noRing := httptest.NewServer(greetworkload.NewAdminMux(faults, nil, nil))
+	defer noRing.Close()
+	resp, err = http.Get(noRing.URL + "/requests")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestRequestRing_DumpToFile(t *testing.T) {
+	g := newRequestRing(t, 3)
+	for i := 0; i < 4; i++ {
+		g.Add(&greetworkload.CallRecord{Method: "SayHello", RequestID: strconv.Itoa(i), Code: "OK"})
+	}
+	path := filepath.Join(t.TempDir(), "requests.json")
+	d, err := g.DumpToFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), d.Dropped)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	read := &greetworkload.RequestRingDump{}
+	require.NoError(t, json.Unmarshal(data, read))
+	assert.Equal(t, d, read)
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = g.DumpToFile(filepath.Join(t.TempDir(), "missing", "requests.json"))
+	assert.Error(t, err)
+}
+
+func TestNewRequestRing_InvalidCapacity(t *testing.T) {
+	for _, capacity := range []int{0, -1} {
+		_, err := greetworkload.NewRequestRing(capacity)
+		assert.ErrorIs(t, err, greetworkload.ErrBadFlagCombination)
+	}
+}
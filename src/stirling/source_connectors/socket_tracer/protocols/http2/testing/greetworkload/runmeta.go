@@ -0,0 +1,224 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/payloadgen"
+)
+
+// RunMetadataComment starts the comment line that holds the RunMetadata of a file, in the formats
+// that have comments: the second line of RPC exports, and the first of fixtures.
+const RunMetadataComment = "# run_metadata: "
+
+// RedactedFlag replaces the value of the flags that hold secrets in RunMetadata.Flags.
+const RedactedFlag = "<redacted>"
+
+// secretFlags are the flags whose values are left out of RunMetadata.Flags.
+var secretFlags = map[string]bool{"payload_key": true}
+
+// ErrNoRunMetadata reports a file that does not start with a RunMetadata.
+var ErrNoRunMetadata = errors.New("no run metadata")
+
+// RunMetadata is what produced an output of the workload: the seed, flags and binary of the
+// process that wrote it. It is written at the top of the records, stats and exports of a run, so
+// that any of them can be traced back to the run, and made again.
+type RunMetadata struct {
+	// Seed is the seed of the random choices of the process, 0 for those that make none.
+	Seed int64 `json:"seed"`
+	// Flags is the value of every flag of the process, defaults included, by name. The values of
+	// the flags that hold secrets, such as -payload_key, are replaced by RedactedFlag if set.
+	Flags map[string]string `json:"flags"`
+	// Version and Revision are the version of the main module of the binary and the VCS revision
+	// it was built from, as BuildInfo reports them. Revision is empty if the binary was not
+	// stamped with one.
+	Version  string `json:"version,omitempty"`
+	Revision string `json:"revision,omitempty"`
+	// GoVersion is the Go version the binary was built with, e.g. "go1.20.3".
+	GoVersion string `json:"go_version"`
+	// PayloadGenVersion is the payloadgen.Version the binary generates payloads with.
+	PayloadGenVersion int `json:"payloadgen_version"`
+	// StartTime is when the process started.
+	StartTime time.Time `json:"start_time"`
+	Hostname  string    `json:"hostname,omitempty"`
+	// Netns is the network namespaces of the run the process took part in, if the orchestrator
+	// started it in one, as NetnsEnv tells.
+	Netns *NetnsTopology `json:"netns,omitempty"`
+	// Latency is the distribution of the latency the server injects, as
+	// LatencyDistribution.String returns it, empty if it injects none from one.
+	Latency string `json:"latency,omitempty"`
+}
+
+// runMetadataLine is the line that holds the RunMetadata of JSON files.
+type runMetadataLine struct {
+	RunMetadata *RunMetadata `json:"run_metadata"`
+}
+
+// NewRunMetadata returns the RunMetadata of the running process, started now with the given seed
+// and the flags of flags.
+func NewRunMetadata(seed int64, flags *flag.FlagSet) *RunMetadata {
+	b := buildInfo()
+	m := &RunMetadata{
+		Seed:              seed,
+		Flags:             make(map[string]string),
+		Version:           b.Version,
+		Revision:          b.Revision,
+		GoVersion:         b.GoVersion,
+		PayloadGenVersion: payloadgen.Version,
+		StartTime:         time.Now(),
+		Netns:             netnsFromEnv(),
+	}
+	m.Hostname, _ = os.Hostname()
+	flags.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if secretFlags[f.Name] && v != "" {
+			v = RedactedFlag
+		}
+		m.Flags[f.Name] = v
+	})
+	return m
+}
+
+// String returns m as a single line of JSON.
+func (m *RunMetadata) String() string {
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+
+// ParseRunMetadata parses the JSON returned by RunMetadata.String.
+func ParseRunMetadata(s string) (*RunMetadata, error) {
+	m := &RunMetadata{}
+	if err := json.Unmarshal([]byte(s), m); err != nil {
+		return nil, fmt.Errorf("invalid run metadata: %v", err)
+	}
+	return m, nil
+}
+
+// writeRunMetadataLine writes the line that holds m at the top of JSON files, if m is not nil.
+func writeRunMetadataLine(w io.Writer, m *RunMetadata) error {
+	if m == nil {
+		return nil
+	}
+	return json.NewEncoder(w).Encode(&runMetadataLine{RunMetadata: m})
+}
+
+// parseRunMetadataLine returns the RunMetadata of the line that holds it in JSON files, or nil if
+// line is another value.
+func parseRunMetadataLine(line []byte) *RunMetadata {
+	var l runMetadataLine
+	if err := json.Unmarshal(line, &l); err != nil {
+		return nil
+	}
+	return l.RunMetadata
+}
+
+// ReadRunMetadata reads the RunMetadata at the top of a file written by WriteRecords,
+// WriteConnStats or WriteRPCExport, or of a fixture. Files without one are rejected with
+// ErrNoRunMetadata.
+func ReadRunMetadata(r io.Reader) (*RunMetadata, error) {
+	br := bufio.NewReader(r)
+	for first := true; ; first = false {
+		line, err := br.ReadString('\n')
+		if err != nil && line == "" {
+			if err == io.EOF {
+				return nil, ErrNoRunMetadata
+			}
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, RunMetadataComment):
+			return ParseRunMetadata(strings.TrimPrefix(line, RunMetadataComment))
+		case first && strings.HasPrefix(line, "{"):
+			if m := parseRunMetadataLine([]byte(line)); m != nil {
+				return m, nil
+			}
+			return nil, ErrNoRunMetadata
+		case line == "" || strings.HasPrefix(line, "#"):
+			// The version line of RPC exports, or the comments that start fixtures.
+		default:
+			return nil, ErrNoRunMetadata
+		}
+	}
+}
+
+// outputFlag returns true if the flag of the given name only tells where the outputs of a run
+// go, which does not change the run.
+func outputFlag(name string) bool {
+	return name == "output" || name == "otel_out" || strings.HasSuffix(name, "_file") || strings.HasSuffix(name, "_addr")
+}
+
+// CompareRunMetadata describes, a line each, what makes the runs of a and b not comparable:
+// their seeds, the versions of the payload generator or the revisions of the binaries differ, or
+// the value of a flag does, e.g.
+//
+//	seed: 1 vs 2
+//	flag rate: "100" vs "200"
+//
+// Flags that only name outputs, such as -output and -stats_file, are left out, as are revisions
+// that are not known. It returns nil if the runs are comparable.
+func CompareRunMetadata(a, b *RunMetadata) []string {
+	var diffs []string
+	if a.Seed != b.Seed {
+		diffs = append(diffs, fmt.Sprintf("seed: %d vs %d", a.Seed, b.Seed))
+	}
+	if a.PayloadGenVersion != b.PayloadGenVersion {
+		diffs = append(diffs, fmt.Sprintf("payloadgen_version: %d vs %d", a.PayloadGenVersion, b.PayloadGenVersion))
+	}
+	if a.Revision != "" && b.Revision != "" && a.Revision != b.Revision {
+		diffs = append(diffs, fmt.Sprintf("revision: %s vs %s", a.Revision, b.Revision))
+	}
+
+	names := make(map[string]bool)
+	for name := range a.Flags {
+		names[name] = true
+	}
+	for name := range b.Flags {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		if !outputFlag(name) {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+	value := func(flags map[string]string, name string) string {
+		if v, ok := flags[name]; ok {
+			return fmt.Sprintf("%q", v)
+		}
+		return "unset"
+	}
+	for _, name := range sorted {
+		if va, vb := value(a.Flags, name), value(b.Flags, name); va != vb {
+			diffs = append(diffs, fmt.Sprintf("flag %s: %s vs %s", name, va, vb))
+		}
+	}
+	return diffs
+}
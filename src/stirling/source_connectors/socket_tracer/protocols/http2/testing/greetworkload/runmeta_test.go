@@ -0,0 +1,212 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/payloadgen"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto/testutils"
+)
+
+func testRunMetadata() *greetworkload.RunMetadata {
+	return &greetworkload.RunMetadata{
+		Seed:              42,
+		Flags:             map[string]string{"rate": "100", "output": "calls.json"},
+		Version:           "(devel)",
+		Revision:          "8300f66",
+		GoVersion:         "go1.20.3",
+		PayloadGenVersion: 1,
+		StartTime:         time.Unix(1700000000, 5).UTC(),
+		Hostname:          "pixie",
+	}
+}
+
+func TestNewRunMetadata(t *testing.T) {
+	flags := flag.NewFlagSet("client", flag.ContinueOnError)
+	flags.Int("rate", 10, "")
+	flags.String("name", "pixie", "")
+	flags.String("payload_key", "", "")
+	require.NoError(t, flags.Parse([]string{"-rate=20", "-payload_key=000102030405060708090a0b0c0d0e0f"}))
+
+	before := time.Now()
+	m := greetworkload.NewRunMetadata(7, flags)
+	assert.Equal(t, int64(7), m.Seed)
+	assert.Equal(t, map[string]string{"rate": "20", "name": "pixie", "payload_key": greetworkload.RedactedFlag}, m.Flags)
+	assert.Equal(t, runtime.Version(), m.GoVersion)
+	assert.Equal(t, payloadgen.Version, m.PayloadGenVersion)
+	assert.False(t, m.StartTime.Before(before))
+
+	parsed, err := greetworkload.ParseRunMetadata(m.String())
+	require.NoError(t, err)
+	assert.Empty(t, greetworkload.CompareRunMetadata(m, parsed))
+	assert.True(t, m.StartTime.Equal(parsed.StartTime))
+	assert.NotContains(t, m.String(), "\n")
+
+	_, err = greetworkload.ParseRunMetadata("seed=7")
+	assert.Error(t, err)
+}
+
+func TestReadRunMetadata_EveryFormat(t *testing.T) {
+	meta := testRunMetadata()
+	records := []*greetworkload.CallRecord{{Method: "SayHello", Code: "OK"}}
+	conns := []greetworkload.ConnStats{{LocalAddr: "127.0.0.1:40000", RemoteAddr: "127.0.0.1:50051"}}
+	rows := []greetworkload.RPCRow{{Side: greetworkload.SideClient, Method: "/m", Status: "OK"}}
+	calls := []*testutils.Call{{
+		Method:  "/px.stirling.protocols.http2.testing.Greeter/SayHello",
+		Request: &pb.HelloRequest{Name: "pixie"},
+		Reply:   &pb.HelloReply{Message: "Hello pixie"},
+	}}
+
+	formats := []struct {
+		name  string
+		write func(w io.Writer, meta *greetworkload.RunMetadata) error
+		// read reads the file back the way its readers do, which skip the metadata.
+		read func(r io.Reader) error
+	}{
+		{
+			name: "json lines",
+			write: func(w io.Writer, meta *greetworkload.RunMetadata) error {
+				return greetworkload.WriteRecords(w, meta, records)
+			},
+			read: func(r io.Reader) error {
+				got, err := greetworkload.ReadRecords(r)
+				if assert.Len(t, got, 1) {
+					assert.Equal(t, records[0].Method, got[0].Method)
+				}
+				return err
+			},
+		},
+		{
+			name: "stats",
+			write: func(w io.Writer, meta *greetworkload.RunMetadata) error {
+				return greetworkload.WriteConnStats(w, meta, conns)
+			},
+			read: func(r io.Reader) error {
+				got, err := greetworkload.ReadConnStats(r)
+				assert.Len(t, got, 1)
+				return err
+			},
+		},
+		{
+			name: "csv",
+			write: func(w io.Writer, meta *greetworkload.RunMetadata) error {
+				return greetworkload.WriteRPCExport(w, meta, rows)
+			},
+		},
+		{
+			name: "fixture",
+			write: func(w io.Writer, meta *greetworkload.RunMetadata) error {
+				if meta != nil {
+					if err := testutils.WriteFixtureMetadata(w, meta.String()); err != nil {
+						return err
+					}
+				}
+				return testutils.WriteFixture(w, calls)
+			},
+			read: func(r io.Reader) error {
+				got, err := testutils.ReadFixture(r)
+				assert.Len(t, got, 1)
+				return err
+			},
+		},
+	}
+	for _, f := range formats {
+		t.Run(f.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, f.write(&buf, meta))
+			got, err := greetworkload.ReadRunMetadata(bytes.NewReader(buf.Bytes()))
+			require.NoError(t, err)
+			assert.Equal(t, meta, got)
+			if f.read != nil {
+				assert.NoError(t, f.read(&buf))
+			}
+
+			buf.Reset()
+			require.NoError(t, f.write(&buf, nil))
+			_, err = greetworkload.ReadRunMetadata(bytes.NewReader(buf.Bytes()))
+			assert.ErrorIs(t, err, greetworkload.ErrNoRunMetadata)
+			if f.read != nil {
+				assert.NoError(t, f.read(&buf))
+			}
+		})
+	}
+
+	assert.Equal(t, greetworkload.RunMetadataComment, testutils.FixtureMetadataPrefix)
+	_, err := greetworkload.ReadRunMetadata(strings.NewReader(""))
+	assert.ErrorIs(t, err, greetworkload.ErrNoRunMetadata)
+}
+
+func TestCompareRunMetadata(t *testing.T) {
+	a := testRunMetadata()
+	assert.Empty(t, greetworkload.CompareRunMetadata(a, testRunMetadata()))
+
+	// Where the outputs go, when and where the run was made, and unknown revisions do not matter.
+	b := testRunMetadata()
+	b.Flags["output"] = "other.json"
+	b.Flags["stats_file"] = "stats.json"
+	b.StartTime = b.StartTime.Add(time.Hour)
+	b.Hostname = "other"
+	b.GoVersion = "go1.21.0"
+	b.Revision = ""
+	assert.Empty(t, greetworkload.CompareRunMetadata(a, b))
+
+	b = testRunMetadata()
+	b.Seed = 43
+	b.PayloadGenVersion = 2
+	b.Revision = "c0ffee0"
+	b.Flags["rate"] = "200"
+	b.Flags["name"] = "pixie"
+	assert.Equal(t, []string{
+		"seed: 42 vs 43",
+		"payloadgen_version: 1 vs 2",
+		"revision: 8300f66 vs c0ffee0",
+		`flag name: unset vs "pixie"`,
+		`flag rate: "100" vs "200"`,
+	}, greetworkload.CompareRunMetadata(a, b))
+}
+
+func TestFeatureServer_EchoesRunMetadata(t *testing.T) {
+	meta := testRunMetadata()
+	_, addr := startFeatureServer(t, &pb.FeatureMatrix{
+		MaxRecvMsgSize: greetworkload.DefaultMaxRecvMsgSize,
+		MaxSendMsgSize: greetworkload.DefaultMaxSendMsgSize,
+		RunMetadata:    meta.String(),
+	}, nil)
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	got, err := greetworkload.ParseRunMetadata(fetchFeatures(t, conn).RunMetadata)
+	require.NoError(t, err)
+	assert.Equal(t, meta, got)
+}
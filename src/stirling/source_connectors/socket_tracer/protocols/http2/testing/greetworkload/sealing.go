@@ -0,0 +1,268 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// ParsePayloadKey parses a hex encoded AES key, of 16, 24 or 32 bytes.
+func ParsePayloadKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("payload key must be hex encoded: %w", err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("payload key must be 16, 24 or 32 bytes, got %d", len(key))
+}
+
+// PayloadSealer encrypts greet calls above gRPC, as services that do not trust the transport do,
+// so that the messages on the wire are opaque to whoever reads them: the name of every request is
+// sealed into its payload, and the message of every reply into its own, with AES-GCM under a key
+// both sides are given out of band.
+//
+// Every payload is a random nonce followed by the ciphertext and its tag, authenticated along with
+// the method and the direction it is sent in, so that payloads can't be replayed on another method
+// or reflected back. A payload that fails authentication fails its call with DATA_LOSS, and is
+// counted.
+//
+// The calls to GreeterStats, GreeterFeatures, health and reflection are left as they are.
+type PayloadSealer struct {
+	aead         cipher.AEAD
+	authFailures int64
+}
+
+// NewPayloadSealer creates a PayloadSealer with an AES key of 16, 24 or 32 bytes.
+func NewPayloadSealer(key []byte) (*PayloadSealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &PayloadSealer{aead: aead}, nil
+}
+
+// AuthFailures returns the number of payloads that failed authentication so far.
+func (s *PayloadSealer) AuthFailures() int64 {
+	return atomic.LoadInt64(&s.authFailures)
+}
+
+// The directions a payload is authenticated with.
+const (
+	sealedRequest = "request"
+	sealedReply   = "reply"
+)
+
+func sealingData(method, direction string) []byte {
+	return []byte(method + " " + direction)
+}
+
+func (s *PayloadSealer) seal(method, direction string, plaintext string) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(plaintext)+s.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to draw a payload nonce: %v", err)
+	}
+	return s.aead.Seal(nonce, nonce, []byte(plaintext), sealingData(method, direction)), nil
+}
+
+func (s *PayloadSealer) open(method, direction string, payload []byte) (string, error) {
+	if len(payload) == 0 {
+		return "", status.Errorf(codes.InvalidArgument, "%s of %s has no sealed payload", direction, method)
+	}
+	n := s.aead.NonceSize()
+	if len(payload) >= n {
+		plaintext, err := s.aead.Open(nil, payload[:n], payload[n:], sealingData(method, direction))
+		if err == nil {
+			return string(plaintext), nil
+		}
+	}
+	atomic.AddInt64(&s.authFailures, 1)
+	return "", status.Errorf(codes.DataLoss, "sealed payload of the %s of %s failed authentication", direction, method)
+}
+
+func (s *PayloadSealer) sealRequest(method string, in *pb.HelloRequest) (*pb.HelloRequest, error) {
+	payload, err := s.seal(method, sealedRequest, in.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.HelloRequest{Count: in.Count, Payload: payload}, nil
+}
+
+func (s *PayloadSealer) openRequest(method string, in *pb.HelloRequest) error {
+	name, err := s.open(method, sealedRequest, in.Payload)
+	if err != nil {
+		return err
+	}
+	in.Name, in.Payload = name, nil
+	return nil
+}
+
+func (s *PayloadSealer) sealReply(method string, reply *pb.HelloReply) (*pb.HelloReply, error) {
+	payload, err := s.seal(method, sealedReply, reply.Message)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.HelloReply{InstanceId: reply.InstanceId, Checksum: reply.Checksum, Payload: payload}, nil
+}
+
+func (s *PayloadSealer) openReply(method string, reply *pb.HelloReply) error {
+	msg, err := s.open(method, sealedReply, reply.Payload)
+	if err != nil {
+		return err
+	}
+	reply.Message, reply.Payload = msg, nil
+	return nil
+}
+
+// UnaryClientInterceptor seals the requests of unary calls, and opens their replies.
+func (s *PayloadSealer) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		in, ok := req.(*pb.HelloRequest)
+		if !ok || outsideWorkload(method) {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		sealed, err := s.sealRequest(method, in)
+		if err != nil {
+			return err
+		}
+		if err := invoker(ctx, method, sealed, reply, cc, opts...); err != nil {
+			return err
+		}
+		if out, ok := reply.(*pb.HelloReply); ok {
+			return s.openReply(method, out)
+		}
+		return nil
+	}
+}
+
+// StreamClientInterceptor seals the requests of streaming calls, and opens their replies.
+func (s *PayloadSealer) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil || outsideWorkload(method) {
+			return cs, err
+		}
+		return &sealedClientStream{ClientStream: cs, s: s, method: method}, nil
+	}
+}
+
+type sealedClientStream struct {
+	grpc.ClientStream
+	s      *PayloadSealer
+	method string
+}
+
+func (cs *sealedClientStream) SendMsg(m interface{}) error {
+	if in, ok := m.(*pb.HelloRequest); ok {
+		sealed, err := cs.s.sealRequest(cs.method, in)
+		if err != nil {
+			return err
+		}
+		m = sealed
+	}
+	return cs.ClientStream.SendMsg(m)
+}
+
+func (cs *sealedClientStream) RecvMsg(m interface{}) error {
+	if err := cs.ClientStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if reply, ok := m.(*pb.HelloReply); ok {
+		return cs.s.openReply(cs.method, reply)
+	}
+	return nil
+}
+
+// UnaryServerInterceptor opens the requests of unary calls, and seals their replies. It must come
+// ahead of the interceptors that look at the names of requests, such as a ReplyCache.
+func (s *PayloadSealer) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		in, ok := req.(*pb.HelloRequest)
+		if !ok || outsideWorkload(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		if err := s.openRequest(info.FullMethod, in); err != nil {
+			return nil, err
+		}
+		resp, err := handler(ctx, in)
+		if err != nil {
+			return nil, err
+		}
+		if reply, ok := resp.(*pb.HelloReply); ok {
+			return s.sealReply(info.FullMethod, reply)
+		}
+		return resp, nil
+	}
+}
+
+// StreamServerInterceptor opens the requests of streaming calls, and seals their replies.
+func (s *PayloadSealer) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if outsideWorkload(info.FullMethod) {
+			return handler(srv, ss)
+		}
+		return handler(srv, &sealedServerStream{ServerStream: ss, s: s, method: info.FullMethod})
+	}
+}
+
+type sealedServerStream struct {
+	grpc.ServerStream
+	s      *PayloadSealer
+	method string
+}
+
+func (ss *sealedServerStream) RecvMsg(m interface{}) error {
+	if err := ss.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if in, ok := m.(*pb.HelloRequest); ok {
+		return ss.s.openRequest(ss.method, in)
+	}
+	return nil
+}
+
+// SendMsg seals a copy of m, since handlers may reuse their replies.
+func (ss *sealedServerStream) SendMsg(m interface{}) error {
+	if reply, ok := m.(*pb.HelloReply); ok {
+		sealed, err := ss.s.sealReply(ss.method, reply)
+		if err != nil {
+			return err
+		}
+		m = sealed
+	}
+	return ss.ServerStream.SendMsg(m)
+}
@@ -0,0 +1,259 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+const (
+	testPayloadKey  = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	otherPayloadKey = "0f0e0d0c0b0a09080706050403020100"
+)
+
+func newSealer(t *testing.T, hexKey string) *greetworkload.PayloadSealer {
+	key, err := greetworkload.ParsePayloadKey(hexKey)
+	require.NoError(t, err)
+	s, err := greetworkload.NewPayloadSealer(key)
+	require.NoError(t, err)
+	return s
+}
+
+// startSealedServer serves the greet services, opening and sealing their calls with sealer, or in
+// cleartext if sealer is nil, on a listener wrapped by wrap if not nil. It returns their address.
+func startSealedServer(t *testing.T, sealer *greetworkload.PayloadSealer, wrap func(net.Listener) net.Listener) string {
+	setup := &serverSetup{Wrap: wrap}
+	if sealer != nil {
+		setup.Options = &greetworkload.ServerOptions{Checksums: true}
+		setup.GRPC = []grpc.ServerOption{grpc.ChainUnaryInterceptor(sealer.UnaryServerInterceptor()),
+			grpc.ChainStreamInterceptor(sealer.StreamServerInterceptor())}
+	}
+	return startServerWith(t, setup).Addr
+}
+
+func dialSealed(t *testing.T, addr string, sealer *greetworkload.PayloadSealer, opts ...grpc.DialOption) *grpc.ClientConn {
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if sealer != nil {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(sealer.UnaryClientInterceptor()),
+			grpc.WithChainStreamInterceptor(sealer.StreamClientInterceptor()))
+	}
+	conn, err := grpc.Dial(addr, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestParsePayloadKey(t *testing.T) {
+	for _, s := range []string{otherPayloadKey, testPayloadKey[:48], testPayloadKey} {
+		key, err := greetworkload.ParsePayloadKey(s)
+		require.NoError(t, err, s)
+		assert.Len(t, key, len(s)/2)
+	}
+	for _, s := range []string{"", "0102", testPayloadKey[:40], "not hex", testPayloadKey + "00"} {
+		_, err := greetworkload.ParsePayloadKey(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestPayloadSealer_RoundTrip(t *testing.T) {
+	serverSealer := newSealer(t, testPayloadKey)
+	addr := startSealedServer(t, serverSealer, nil)
+	clientSealer := newSealer(t, testPayloadKey)
+	conn := dialSealed(t, addr, clientSealer)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	reply, err := pb.NewGreeterClient(conn).SayHello(ctx, &pb.HelloRequest{Name: "pixie"})
+	require.NoError(t, err)
+	assert.Equal(t, "Hello pixie", reply.Message)
+	assert.Equal(t, pb.MessageChecksum(reply.Message), reply.Checksum)
+	assert.Empty(t, reply.Payload)
+
+	stream, err := pb.NewStreamingGreeterClient(conn).SayHelloServerStreaming(ctx, &pb.HelloRequest{Name: "pixie", Count: 3})
+	require.NoError(t, err)
+	var sum pb.StreamChecksum
+	replies := 0
+	for {
+		reply, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		assert.Equal(t, "Hello pixie", reply.Message)
+		assert.Equal(t, pb.MessageChecksum(reply.Message), reply.Checksum)
+		sum.Add(reply.Message)
+		replies++
+	}
+	assert.Equal(t, 3, replies)
+	assert.Equal(t, []string{sum.String()}, stream.Trailer().Get(pb.StreamChecksumTrailer))
+
+	bidir, err := pb.NewStreamingGreeterClient(conn).SayHelloBidirStreaming(ctx)
+	require.NoError(t, err)
+	for _, name := range []string{"a", "", "é€"} {
+		require.NoError(t, bidir.Send(&pb.HelloRequest{Name: name}))
+		reply, err := bidir.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, "Hello "+name, reply.Message)
+	}
+	require.NoError(t, bidir.CloseSend())
+
+	assert.Zero(t, serverSealer.AuthFailures())
+	assert.Zero(t, clientSealer.AuthFailures())
+}
+
+// compressionRatio returns the size of data gzipped over its own.
+func compressionRatio(t *testing.T, data []byte) float64 {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return float64(buf.Len()) / float64(len(data))
+}
+
+func TestPayloadSealer_OpaqueOnTheWire(t *testing.T) {
+	name := strings.Repeat("pixie", 2000)
+	for _, tc := range []struct {
+		name   string
+		sealed bool
+	}{
+		{"cleartext", false},
+		{"sealed", true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var serverSealer, clientSealer *greetworkload.PayloadSealer
+			if tc.sealed {
+				serverSealer, clientSealer = newSealer(t, testPayloadKey), newSealer(t, testPayloadKey)
+			}
+			var capture *frameCapture
+			addr := startSealedServer(t, serverSealer, func(lis net.Listener) net.Listener {
+				capture = &frameCapture{Listener: lis}
+				return capture
+			})
+			conn := dialSealed(t, addr, clientSealer)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			reply, err := pb.NewGreeterClient(conn).SayHello(ctx, &pb.HelloRequest{Name: name})
+			require.NoError(t, err)
+			require.Equal(t, "Hello "+name, reply.Message)
+
+			wire := bytes.Join(capture.dataFrames(t), nil)
+			require.Greater(t, len(wire), len(name))
+			ratio := compressionRatio(t, wire)
+			if tc.sealed {
+				// Ciphertext does not compress: gzip only adds its framing.
+				assert.Greater(t, ratio, 0.95)
+				assert.NotContains(t, string(wire), "pixie")
+			} else {
+				assert.Less(t, ratio, 0.1)
+			}
+		})
+	}
+}
+
+func TestPayloadSealer_WrongKey(t *testing.T) {
+	serverSealer := newSealer(t, testPayloadKey)
+	conn := dialSealed(t, startSealedServer(t, serverSealer, nil), newSealer(t, otherPayloadKey))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := pb.NewGreeterClient(conn).SayHello(ctx, &pb.HelloRequest{Name: "pixie"})
+	assert.Equal(t, codes.DataLoss, status.Code(err), err)
+	assert.Equal(t, int64(1), serverSealer.AuthFailures())
+}
+
+func TestPayloadSealer_UnsealedRequest(t *testing.T) {
+	serverSealer := newSealer(t, testPayloadKey)
+	conn := dialSealed(t, startSealedServer(t, serverSealer, nil), nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := pb.NewGreeterClient(conn).SayHello(ctx, &pb.HelloRequest{Name: "pixie"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), err)
+	assert.Zero(t, serverSealer.AuthFailures())
+}
+
+// Flipping a bit of the sealed payloads on the wire makes them fail authentication, on the
+// server for requests and on the client for replies, rather than greet with a corrupted name.
+func TestPayloadSealer_DetectsTampering(t *testing.T) {
+	const calls = 20
+	name := strings.Repeat("pixie", 1000)
+	for _, tc := range []struct {
+		name    string
+		replies bool
+	}{
+		{"requests", false},
+		{"replies", true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			chaos := newChaos(t, &greetworkload.ChaosOptions{Probability: 1, Corruptions: []string{greetworkload.CorruptionBitFlip}})
+			serverSealer, clientSealer := newSealer(t, testPayloadKey), newSealer(t, testPayloadKey)
+			var wrap func(net.Listener) net.Listener
+			var dialOpts []grpc.DialOption
+			if tc.replies {
+				wrap = chaos.WrapListener
+			} else {
+				dialOpts = append(dialOpts, grpc.WithContextDialer(chaos.Dialer(dialTCP)))
+			}
+			addr := startSealedServer(t, serverSealer, wrap)
+
+			c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, Sealer: clientSealer})
+			conn, err := c.Dial(addr, dialOpts...)
+			require.NoError(t, err)
+			defer conn.Close()
+			dataLoss := 0
+			for i := 0; i < calls; i++ {
+				r := c.SayHello(conn, name)
+				require.False(t, r.Completed(), "a tampered call succeeded")
+				if r.Code == codes.DataLoss.String() {
+					dataLoss++
+				}
+			}
+			// The few flips that land on the gRPC or protobuf framing, rather than on the
+			// payload, fail the call otherwise.
+			assert.GreaterOrEqual(t, dataLoss, calls*9/10)
+			if tc.replies {
+				assert.Equal(t, int64(dataLoss), clientSealer.AuthFailures())
+				assert.Zero(t, serverSealer.AuthFailures())
+			} else {
+				assert.Equal(t, int64(dataLoss), serverSealer.AuthFailures())
+				assert.Zero(t, clientSealer.AuthFailures())
+			}
+			assert.Len(t, chaos.Events(), calls)
+		})
+	}
+}
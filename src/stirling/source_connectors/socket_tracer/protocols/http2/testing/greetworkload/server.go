@@ -0,0 +1,452 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// EchoHeader is the metadata SayHello echoes back, unchanged, in its response headers, so that
+// clients can check that metadata values survive HPACK coding both ways.
+const EchoHeader = "x-greet-echo"
+
+// StreamRepliesSentTrailer is the trailer of the server-streaming calls cut short by
+// ServerOptions.MaxStreamReplies: the number of reply messages sent before the call failed.
+const StreamRepliesSentTrailer = "x-greet-stream-sent"
+
+// DefaultMaxStreamReplies is the ServerOptions.MaxStreamReplies of servers that set none.
+const DefaultMaxStreamReplies = 1000000
+
+// InstanceIDPID is replaced by the PID of the process in the instance IDs given to
+// ExpandInstanceID, so that server processes started alike stamp replies of their own.
+const InstanceIDPID = "{pid}"
+
+// ExpandInstanceID replaces every InstanceIDPID in id with the PID of the process.
+func ExpandInstanceID(id string) string {
+	return strings.ReplaceAll(id, InstanceIDPID, strconv.Itoa(os.Getpid()))
+}
+
+// ServerOptions configure the behavior of a Server.
+type ServerOptions struct {
+	// ValidateRequests makes the server reject malformed requests with InvalidArgument.
+	// Disabled by default, so that existing tests see every request answered.
+	ValidateRequests bool
+	// InstanceID, if set, is stamped into every reply so that clients can tell backends apart.
+	InstanceID string
+	// StreamReplyBytes pads every server-streaming reply message to at least this many bytes.
+	StreamReplyBytes int
+	// StreamReplyVariants, if set, numbers server-streaming reply messages, e.g. "Hello name #2".
+	// Replies rotate through this many numbers, so that consecutive replies differ without every
+	// reply being built from scratch.
+	StreamReplyVariants int
+	// OnStreamSend, if set, is called after every server-streaming reply is sent, with the index of
+	// the reply in its stream.
+	OnStreamSend func(index int, sent time.Time)
+	// Checksums sets the checksum of every reply, and sends the checksum of every reply stream in
+	// the greetpb.StreamChecksumTrailer trailer.
+	Checksums bool
+	// Callers counts the calls to SayHelloAgain by name. If nil, the server keeps unbounded counts
+	// in memory.
+	Callers *CallerCounter
+	// ReplyFrameBytes, if set, splits the message of every server-streaming reply over as many
+	// reply messages as it takes for each to fit a DATA frame of at most this many bytes, since
+	// gRPC sends every message in DATA frames of its own. Every piece but the last of a message
+	// then comes within a few bytes of it. At least MinReplyFrameBytes, and at most
+	// MaxReplyFrameBytes.
+	ReplyFrameBytes int
+	// HeartbeatInterval, if set, makes the server-streaming calls named HeartbeatName heartbeat
+	// streams: a small reply every HeartbeatInterval, whatever their count, until the client goes
+	// away.
+	HeartbeatInterval time.Duration
+	// ConformanceNames makes the server fail the SayHello calls named by ConformanceName with their
+	// status code, so that clients can provoke any of them. See Client.RunConformance.
+	ConformanceNames bool
+	// MaxStreamReplies is the most reply messages a server-streaming call is sent, every piece of
+	// ReplyFrameBytes counted. Calls that ask for more are sent that many, then fail with
+	// ResourceExhausted and the StreamRepliesSentTrailer trailer. Heartbeat and escalation streams
+	// are not capped. Zero uses DefaultMaxStreamReplies.
+	MaxStreamReplies int
+	// Upstream, if set, makes the server a relay: SayHello forwards every request to the Greeter
+	// at the other end, within the deadline of the call and with its RequestIDHeader and trace
+	// context, and replies with the upstream reply wrapped in its own. Requests are forwarded as
+	// they were received with a RawRequests that keeps them, see RawRequestOptions.Keep.
+	Upstream *grpc.ClientConn
+}
+
+const (
+	// MinReplyFrameBytes is the smallest ServerOptions.ReplyFrameBytes.
+	MinReplyFrameBytes = 64
+	// MaxReplyFrameBytes is the largest ServerOptions.ReplyFrameBytes. gRPC writes no larger DATA
+	// frames, whatever the SETTINGS_MAX_FRAME_SIZE of the client.
+	MaxReplyFrameBytes = minMaxFrameSize
+	// grpcMessagePrefixLen is the length of the prefix gRPC sends every message with.
+	grpcMessagePrefixLen = 5
+)
+
+// Validate checks that the options are usable.
+func (o *ServerOptions) Validate() error {
+	if o.StreamReplyBytes < 0 {
+		return fmt.Errorf("stream reply bytes must not be negative, got %d", o.StreamReplyBytes)
+	}
+	// A stream cannot use more variants than it has replies.
+	if o.StreamReplyVariants < 0 || o.StreamReplyVariants > pb.MaxCount {
+		return fmt.Errorf("stream reply variants must be in [0, %d], got %d", pb.MaxCount, o.StreamReplyVariants)
+	}
+	if o.ReplyFrameBytes != 0 && (o.ReplyFrameBytes < MinReplyFrameBytes || o.ReplyFrameBytes > MaxReplyFrameBytes) {
+		return fmt.Errorf("reply frame bytes must be 0 or in [%d, %d], got %d", MinReplyFrameBytes, MaxReplyFrameBytes, o.ReplyFrameBytes)
+	}
+	if o.MaxStreamReplies < 0 {
+		return fmt.Errorf("max stream replies must not be negative, got %d", o.MaxStreamReplies)
+	}
+	if o.HeartbeatInterval < 0 {
+		return fmt.Errorf("heartbeat interval must not be negative, got %v", o.HeartbeatInterval)
+	}
+	if o.ReplyFrameBytes != 0 && o.replyChunkLen() <= 0 {
+		return fmt.Errorf("reply frame bytes of %d leave no room for the message beside the instance ID", o.ReplyFrameBytes)
+	}
+	return nil
+}
+
+// maxStreamReplies returns MaxStreamReplies, or its default.
+func (o *ServerOptions) maxStreamReplies() int {
+	if o.MaxStreamReplies == 0 {
+		return DefaultMaxStreamReplies
+	}
+	return o.MaxStreamReplies
+}
+
+// replyChunkLen returns the longest message a server-streaming reply fits a DATA frame of
+// ReplyFrameBytes with.
+func (o *ServerOptions) replyChunkLen() int {
+	// The reply without its message, with the largest checksum, and the tag and the longest
+	// length of the message.
+	empty := &pb.HelloReply{InstanceId: o.InstanceID}
+	if o.Checksums {
+		empty.Checksum = math.MaxUint32
+	}
+	n := o.ReplyFrameBytes - grpcMessagePrefixLen - empty.Size() - 1
+	return n - protowire.SizeVarint(uint64(n))
+}
+
+// defaultStreamReplies is the number of server-streaming replies sent when the request has no Count.
+const defaultStreamReplies = 3
+
+// Server implements the Greeter, Greeter2 and StreamingGreeter services.
+type Server struct {
+	opts    *ServerOptions
+	callers *CallerCounter
+	// ctxErrs counts the calls that ended by a context error, see ContextErrors.
+	ctxErrs int64
+}
+
+// NewServer creates a new Server. A nil opts uses the default options.
+func NewServer(opts *ServerOptions) *Server {
+	if opts == nil {
+		opts = &ServerOptions{}
+	}
+	callers := opts.Callers
+	if callers == nil {
+		// Cannot fail without a backing file.
+		callers, _ = NewCallerCounter(nil)
+	}
+	return &Server{opts: opts, callers: callers}
+}
+
+func (s *Server) validate(in *pb.HelloRequest) error {
+	if !s.opts.ValidateRequests {
+		return nil
+	}
+	if err := in.Validate(); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return nil
+}
+
+func (s *Server) reply(msg string) *pb.HelloReply {
+	reply := &pb.HelloReply{Message: msg, InstanceId: s.opts.InstanceID}
+	if s.opts.Checksums {
+		reply.SetChecksum()
+	}
+	return reply
+}
+
+// setStreamChecksum sends the checksum of the replies of a stream, if enabled.
+func (s *Server) setStreamChecksum(stream grpc.ServerStream, sum pb.StreamChecksum) {
+	if s.opts.Checksums {
+		stream.SetTrailer(metadata.Pairs(pb.StreamChecksumTrailer, sum.String()))
+	}
+}
+
+// SayHello implements greetpb.GreeterServer.
+func (s *Server) SayHello(ctx context.Context, in *pb.HelloRequest) (*pb.HelloReply, error) {
+	defer s.observeContext(ctx)
+	if err := s.validate(in); err != nil {
+		return nil, err
+	}
+	if md, _ := metadata.FromIncomingContext(ctx); len(md.Get(EchoHeader)) > 0 {
+		if err := grpc.SetHeader(ctx, metadata.MD{EchoHeader: md.Get(EchoHeader)}); err != nil {
+			return nil, err
+		}
+	}
+	if s.opts.ConformanceNames {
+		if code, ok := ParseConformanceName(in.Name); ok {
+			return s.conform(ctx, in, code)
+		}
+	}
+	if s.opts.Upstream != nil {
+		return s.relay(ctx, in)
+	}
+	return s.reply("Hello " + in.Name), nil
+}
+
+// SayHelloAgain implements greetpb.GreeterServer. Unlike SayHello, it remembers its callers and
+// replies with the number of calls made so far by the same name.
+func (s *Server) SayHelloAgain(ctx context.Context, in *pb.HelloRequest) (*pb.HelloReply, error) {
+	defer s.observeContext(ctx)
+	if err := s.validate(in); err != nil {
+		return nil, err
+	}
+	n := s.callers.Increment(in.Name)
+	return s.reply(fmt.Sprintf("Hello again, %s, call #%d", in.Name, n)), nil
+}
+
+// SayHi implements greetpb.Greeter2Server.
+func (s *Server) SayHi(ctx context.Context, in *pb.HelloRequest) (*pb.HelloReply, error) {
+	defer s.observeContext(ctx)
+	if err := s.validate(in); err != nil {
+		return nil, err
+	}
+	return s.reply("Hi " + in.Name), nil
+}
+
+// SayHelloClientStreaming implements greetpb.StreamingGreeterServer.
+func (s *Server) SayHelloClientStreaming(srv pb.StreamingGreeter_SayHelloClientStreamingServer) error {
+	defer s.observeContext(srv.Context())
+	names := []string{}
+	var received int64
+	for {
+		helloReq, err := srv.Recv()
+		if err == io.EOF {
+			reply := s.reply("Hello " + strings.Join(names, ", ") + "!")
+			reply.BytesReceived = received
+			return srv.SendAndClose(reply)
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.validate(helloReq); err != nil {
+			return err
+		}
+		received += int64(len(helloReq.Payload))
+		// An upload sends as many requests as it can, so its name is not collected into the reply.
+		if helloReq.Name != UploadName {
+			names = append(names, helloReq.Name)
+		}
+	}
+}
+
+// SayHelloServerStreaming implements greetpb.StreamingGreeterServer.
+func (s *Server) SayHelloServerStreaming(in *pb.HelloRequest, srv pb.StreamingGreeter_SayHelloServerStreamingServer) error {
+	defer s.observeContext(srv.Context())
+	log.Printf("SayHelloServerStreaming, in: %v\n", in)
+	if err := s.validate(in); err != nil {
+		return err
+	}
+	if s.opts.HeartbeatInterval > 0 && in.Name == HeartbeatName {
+		return s.heartbeat(srv)
+	}
+	if in.Name == EscalationName {
+		return s.escalate(srv)
+	}
+	// Send 3 responses by default. We do not care much about the exact number of responses, this is for executing the
+	// server streaming mechanism and observe the underlying HTTP2 framing data.
+	n := int(in.Count)
+	if n <= 0 {
+		n = defaultStreamReplies
+	}
+	msgs := s.streamMessages(in.Name, n)
+	// The pieces every message is sent in, and their checksums.
+	pieces := make([][]string, len(msgs))
+	checksums := make([][]uint32, len(msgs))
+	for k, msg := range msgs {
+		pieces[k] = s.splitMessage(msg)
+		if s.opts.Checksums {
+			checksums[k] = make([]uint32, len(pieces[k]))
+			for j, piece := range pieces[k] {
+				checksums[k][j] = pb.MessageChecksum(piece)
+			}
+		}
+	}
+	limit := s.opts.maxStreamReplies()
+	total := streamLen(n, pieces)
+	var sum pb.StreamChecksum
+	var sent int
+	// A single reply is reused for every send, so that long streams do not allocate per message. This is safe because
+	// Send serializes the reply before it returns, and nothing in this process holds on to sent messages.
+	reply := s.reply("")
+replies:
+	for i := 0; i < n; i++ {
+		k := i % len(msgs)
+		for j, piece := range pieces[k] {
+			if sent == limit {
+				break replies
+			}
+			reply.Message = piece
+			if s.opts.Checksums {
+				reply.Checksum = checksums[k][j]
+				sum.Add(piece)
+			}
+			// Send blocks once the client stops reading and the HTTP/2 flow control window is exhausted.
+			if err := srv.Send(reply); err != nil {
+				return err
+			}
+			sent++
+		}
+		if s.opts.OnStreamSend != nil {
+			s.opts.OnStreamSend(i, time.Now())
+		}
+	}
+	s.setStreamChecksum(srv, sum)
+	if total > limit {
+		srv.SetTrailer(metadata.Pairs(StreamRepliesSentTrailer, strconv.Itoa(sent)))
+		return status.Errorf(codes.ResourceExhausted, "%d replies take more than the limit of %d reply messages", n, limit)
+	}
+	return nil
+}
+
+// maxInt is the largest int, math.MaxInt from Go 1.17 on.
+const maxInt = int(^uint(0) >> 1)
+
+// streamLen returns the number of reply messages the n server-streaming replies made of pieces
+// are sent in, as pieces rotate, or maxInt if that overflows an int.
+func streamLen(n int, pieces [][]string) int {
+	// A rotation of pieces is held in memory, so its length does not overflow.
+	var rotation int
+	for _, p := range pieces {
+		rotation += len(p)
+	}
+	rotations, rest := n/len(pieces), n%len(pieces)
+	if rotations > 0 && rotation > maxInt/rotations {
+		return maxInt
+	}
+	total := rotations * rotation
+	for _, p := range pieces[:rest] {
+		if total > maxInt-len(p) {
+			return maxInt
+		}
+		total += len(p)
+	}
+	return total
+}
+
+// streamMessages builds the messages that the n server-streaming replies to name rotate through.
+// Only as many variants as there are replies are built.
+func (s *Server) streamMessages(name string, n int) []string {
+	count := 1
+	if s.opts.StreamReplyVariants > 0 {
+		count = s.opts.StreamReplyVariants
+		if n < count {
+			count = n
+		}
+	}
+	msgs := make([]string, count)
+
+	// Every message is built in the same scratch buffer, then copied out.
+	var b []byte
+	for k := range msgs {
+		b = append(b[:0], "Hello "...)
+		b = append(b, name...)
+		if s.opts.StreamReplyVariants > 0 {
+			b = append(b, " #"...)
+			b = strconv.AppendInt(b, int64(k), 10)
+		}
+		for len(b) < s.opts.StreamReplyBytes {
+			b = append(b, '.')
+		}
+		msgs[k] = string(b)
+	}
+	return msgs
+}
+
+// splitMessage splits msg into the pieces its server-streaming replies carry, see
+// ServerOptions.ReplyFrameBytes. Pieces end on rune boundaries, so that every one is valid UTF-8.
+func (s *Server) splitMessage(msg string) []string {
+	if s.opts.ReplyFrameBytes == 0 || len(msg) <= s.opts.replyChunkLen() {
+		return []string{msg}
+	}
+	chunkLen := s.opts.replyChunkLen()
+	var pieces []string
+	for len(msg) > chunkLen {
+		end := chunkLen
+		for end > 0 && !utf8.RuneStart(msg[end]) {
+			end--
+		}
+		if end == 0 {
+			// No rune starts in the chunk, which only a chunk shorter than a rune allows.
+			end = chunkLen
+		}
+		pieces = append(pieces, msg[:end])
+		msg = msg[end:]
+	}
+	return append(pieces, msg)
+}
+
+// SayHelloBidirStreaming implements greetpb.StreamingGreeterServer.
+func (s *Server) SayHelloBidirStreaming(stream pb.StreamingGreeter_SayHelloBidirStreamingServer) error {
+	defer s.observeContext(stream.Context())
+	var sum pb.StreamChecksum
+	for {
+		helloReq, err := stream.Recv()
+		if err == io.EOF {
+			s.setStreamChecksum(stream, sum)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.validate(helloReq); err != nil {
+			return err
+		}
+		reply := s.reply("Hello " + helloReq.Name)
+		if s.opts.Checksums {
+			sum.Add(reply.Message)
+		}
+		err = stream.Send(reply)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/payloadgen"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+func TestServer_ValidateRequests(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     *pb.HelloRequest
+		errText string
+	}{
+		{"empty name", &pb.HelloRequest{}, "invalid name"},
+		{"long name", &pb.HelloRequest{Name: strings.Repeat("a", pb.MaxNameBytes+1)}, "invalid name"},
+		{"invalid utf8", &pb.HelloRequest{Name: "a\xff\xfe"}, "UTF-8"},
+		{"negative count", &pb.HelloRequest{Name: "a", Count: -1}, "invalid count"},
+		{"count too large", &pb.HelloRequest{Name: "a", Count: pb.MaxCount + 1}, "invalid count"},
+	}
+
+	_, strictAddr := startServer(t, &greetworkload.ServerOptions{ValidateRequests: true})
+	_, legacyAddr := startServer(t, nil)
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{})
+	strictConn, err := c.Dial(strictAddr)
+	require.NoError(t, err)
+	defer strictConn.Close()
+	legacyConn, err := c.Dial(legacyAddr)
+	require.NoError(t, err)
+	defer legacyConn.Close()
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			_, err := pb.NewGreeterClient(strictConn).SayHello(ctx, tc.req)
+			assert.Equal(t, codes.InvalidArgument, status.Code(err))
+			assert.Contains(t, status.Convert(err).Message(), tc.errText)
+
+			_, err = pb.NewGreeterClient(legacyConn).SayHello(ctx, tc.req)
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestServer_ValidateStreamingRequests(t *testing.T) {
+	_, addr := startServer(t, &greetworkload.ServerOptions{ValidateRequests: true})
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	r := c.BidirStreaming(conn, []string{"a", ""})
+	assert.Equal(t, codes.InvalidArgument.String(), r.Code)
+	r = c.ClientStreaming(conn, []string{"a", "b"})
+	assert.True(t, r.Completed(), r.Error)
+}
+
+// TestServer_EchoStress checks that names and metadata values hard on HTTP/2 parsers come back
+// byte for byte.
+func TestServer_EchoStress(t *testing.T) {
+	_, addr := startServer(t, &greetworkload.ServerOptions{ValidateRequests: true})
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	newGen := func(alphabet, size string) *payloadgen.Generator {
+		d, err := payloadgen.ParseSizeDist(size)
+		require.NoError(t, err)
+		g, err := payloadgen.New(&payloadgen.Options{Seed: 42, Alphabet: alphabet, Size: d})
+		require.NoError(t, err)
+		return g
+	}
+	names := []*payloadgen.Generator{
+		newGen(payloadgen.AlphabetStress, "uniform:1:256"),
+		newGen(payloadgen.AlphabetStress, "boundary"),
+	}
+	values := []*payloadgen.Generator{
+		newGen(payloadgen.AlphabetHuffmanFavorable, "boundary"),
+		newGen(payloadgen.AlphabetHuffmanUnfavorable, "boundary"),
+	}
+	for i := uint64(0); i < 100; i++ {
+		for j := range names {
+			name := names[j].Name(i)
+			if name == "" {
+				// Rejected by ValidateRequests.
+				continue
+			}
+			value := values[j].MetadataValue(i)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			ctx = metadata.AppendToOutgoingContext(ctx, greetworkload.EchoHeader, value)
+			var header metadata.MD
+			reply, err := pb.NewGreeterClient(conn).SayHello(ctx, &pb.HelloRequest{Name: name}, grpc.Header(&header))
+			cancel()
+			require.NoError(t, err, "%q", name)
+			assert.Equal(t, "Hello "+name, reply.Message)
+			assert.Equal(t, []string{value}, header.Get(greetworkload.EchoHeader))
+		}
+	}
+}
+
+func TestExpandInstanceID(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	assert.Equal(t, "worker-"+pid, greetworkload.ExpandInstanceID("worker-{pid}"))
+	assert.Equal(t, pid+"/"+pid, greetworkload.ExpandInstanceID("{pid}/{pid}"))
+	assert.Equal(t, "fixed", greetworkload.ExpandInstanceID("fixed"))
+}
+
+func TestServer_ContextErrorsMatchClientCancels(t *testing.T) {
+	// The handler returns before the cancellation arrives, and only its response is held until
+	// then, so that no handler ever sees its context done.
+	returned := make(chan struct{})
+	hold := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		reply, err := handler(ctx, req)
+		if req.(*pb.HelloRequest).Name == "hold" {
+			returned <- struct{}{}
+			<-ctx.Done()
+		}
+		return reply, err
+	}
+
+	s := startServerWith(t, &serverSetup{GRPC: []grpc.ServerOption{grpc.UnaryInterceptor(hold)}})
+
+	conn, err := grpc.Dial(s.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := pb.NewGreeterClient(conn)
+
+	const numCalls = 20
+	cancelled := 0
+	for i := 0; i < numCalls; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if i%2 == 0 {
+			_, err := client.SayHello(ctx, &pb.HelloRequest{Name: "pass"})
+			require.NoError(t, err)
+			cancel()
+			continue
+		}
+		go func() {
+			<-returned
+			cancel()
+		}()
+		_, err := client.SayHello(ctx, &pb.HelloRequest{Name: "hold"})
+		require.Equal(t, codes.Canceled, status.Code(err), err)
+		cancelled++
+	}
+
+	assert.Eventually(t, func() bool { return s.Greeter.ContextErrors() == int64(cancelled) }, 5*time.Second, 10*time.Millisecond,
+		"client cancelled %d, server counted %d", cancelled, s.Greeter.ContextErrors())
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+
+	"google.golang.org/grpc"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// The full names of the services implemented by Server.
+const (
+	GreeterService          = pb.Greeter_ServiceName
+	Greeter2Service         = pb.Greeter2_ServiceName
+	StreamingGreeterService = pb.StreamingGreeter_ServiceName
+)
+
+// Register registers the named service, implemented by s, on gs.
+func (s *Server) Register(gs *grpc.Server, service string) error {
+	switch service {
+	case GreeterService:
+		pb.RegisterGreeterServer(gs, s)
+	case Greeter2Service:
+		pb.RegisterGreeter2Server(gs, s)
+	case StreamingGreeterService:
+		pb.RegisterStreamingGreeterServer(gs, s)
+	default:
+		return fmt.Errorf("unknown service %q", service)
+	}
+	return nil
+}
+
+// ServiceGroup serves every service on a listener of its own, from a single process and a
+// single Server, so that traffic can be told apart by destination port.
+type ServiceGroup struct {
+	servers   map[string]*grpc.Server
+	listeners map[string]net.Listener
+}
+
+// NewServiceGroup creates a ServiceGroup that serves each service in listeners on its listener.
+// newServer creates the grpc.Server of every service.
+func NewServiceGroup(s *Server, listeners map[string]net.Listener, newServer func() *grpc.Server) (*ServiceGroup, error) {
+	g := &ServiceGroup{
+		servers:   make(map[string]*grpc.Server),
+		listeners: listeners,
+	}
+	for service := range listeners {
+		gs := newServer()
+		if err := s.Register(gs, service); err != nil {
+			return nil, err
+		}
+		g.servers[service] = gs
+	}
+	return g, nil
+}
+
+// Addrs returns the address every service is served on.
+func (g *ServiceGroup) Addrs() map[string]string {
+	addrs := make(map[string]string)
+	for service, lis := range g.listeners {
+		addrs[service] = CanonicalAddr(lis.Addr())
+	}
+	return addrs
+}
+
+// Serve serves every service until they are all stopped. If any service fails, Serve stops the
+// others and returns its error right away.
+func (g *ServiceGroup) Serve() error {
+	errs := make(chan error, len(g.servers))
+	for service, gs := range g.servers {
+		go func(gs *grpc.Server, lis net.Listener) {
+			errs <- gs.Serve(lis)
+		}(gs, g.listeners[service])
+	}
+	for range g.servers {
+		if err := <-errs; err != nil {
+			g.Stop()
+			return err
+		}
+	}
+	return nil
+}
+
+// GracefulStop gracefully stops every service.
+func (g *ServiceGroup) GracefulStop() {
+	for _, gs := range g.servers {
+		gs.GracefulStop()
+	}
+}
+
+// Stop stops every service immediately.
+func (g *ServiceGroup) Stop() {
+	for _, gs := range g.servers {
+		gs.Stop()
+	}
+}
+
+// serviceAddr is a single entry of an address file.
+type serviceAddr struct {
+	Service string `json:"service"`
+	Address string `json:"address"`
+}
+
+// WriteAddressFile writes the address every service is served on to path, as a JSON array of
+// service/address pairs sorted by service.
+func WriteAddressFile(path string, addrs map[string]string) error {
+	entries := make([]serviceAddr, 0, len(addrs))
+	for service, addr := range addrs {
+		entries = append(entries, serviceAddr{Service: service, Address: addr})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Service < entries[j].Service })
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0666)
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+func startServiceGroup(t *testing.T) map[string]string {
+	listeners := make(map[string]net.Listener)
+	for _, service := range []string{
+		greetworkload.GreeterService,
+		greetworkload.Greeter2Service,
+		greetworkload.StreamingGreeterService,
+	} {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners[service] = lis
+	}
+
+	g, err := greetworkload.NewServiceGroup(greetworkload.NewServer(nil), listeners, func() *grpc.Server { return grpc.NewServer() })
+	require.NoError(t, err)
+	go func() { _ = g.Serve() }()
+	t.Cleanup(g.Stop)
+	return g.Addrs()
+}
+
+func TestServiceGroup_ServesEachServiceOnItsOwnPort(t *testing.T) {
+	addrs := startServiceGroup(t)
+	require.Len(t, addrs, 3)
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	dial := func(service string) *grpc.ClientConn {
+		conn, err := c.Dial(addrs[service])
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	greeterConn := dial(greetworkload.GreeterService)
+	greeter2Conn := dial(greetworkload.Greeter2Service)
+	streamingConn := dial(greetworkload.StreamingGreeterService)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req := &pb.HelloRequest{Name: "pixie"}
+
+	reply, err := pb.NewGreeterClient(greeterConn).SayHello(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello pixie", reply.Message)
+	reply, err = pb.NewGreeter2Client(greeter2Conn).SayHi(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, "Hi pixie", reply.Message)
+	r := c.ServerStreaming(streamingConn, "pixie")
+	assert.True(t, r.Completed(), r.Error)
+
+	// Each port only serves its own service.
+	_, err = pb.NewGreeter2Client(greeterConn).SayHi(ctx, req)
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = pb.NewGreeterClient(greeter2Conn).SayHello(ctx, req)
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = pb.NewGreeterClient(streamingConn).SayHello(ctx, req)
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+	r = c.ServerStreaming(greeterConn, "pixie")
+	assert.Equal(t, codes.Unimplemented.String(), r.Code)
+}
+
+// failingListener fails every Accept, like a listener whose socket broke.
+type failingListener struct {
+	net.Listener
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	return nil, errors.New("accept failed")
+}
+
+func TestServiceGroup_ServeStopsOnFirstError(t *testing.T) {
+	healthy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	broken, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer broken.Close()
+
+	g, err := greetworkload.NewServiceGroup(greetworkload.NewServer(nil), map[string]net.Listener{
+		greetworkload.GreeterService:  healthy,
+		greetworkload.Greeter2Service: &failingListener{Listener: broken},
+	}, func() *grpc.Server { return grpc.NewServer() })
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() { done <- g.Serve() }()
+	select {
+	case err := <-done:
+		assert.ErrorContains(t, err, "accept failed")
+	case <-time.After(5 * time.Second):
+		g.Stop()
+		t.Fatal("Serve did not return after a service failed")
+	}
+
+	// The healthy service was stopped along with the group, closing its listener.
+	_, err = net.DialTimeout("tcp", healthy.Addr().String(), time.Second)
+	assert.Error(t, err)
+}
+
+func TestServer_RegisterUnknownService(t *testing.T) {
+	err := greetworkload.NewServer(nil).Register(grpc.NewServer(), "px.Unknown")
+	assert.Error(t, err)
+}
+
+func TestWriteAddressFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "addrs.json")
+	require.NoError(t, greetworkload.WriteAddressFile(path, map[string]string{
+		greetworkload.StreamingGreeterService: "127.0.0.1:3",
+		greetworkload.GreeterService:          "127.0.0.1:1",
+	}))
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var entries []struct {
+		Service string `json:"service"`
+		Address string `json:"address"`
+	}
+	require.NoError(t, json.Unmarshal(b, &entries))
+	require.Len(t, entries, 2)
+	assert.Equal(t, greetworkload.GreeterService, entries[0].Service)
+	assert.Equal(t, "127.0.0.1:1", entries[0].Address)
+	assert.Equal(t, greetworkload.StreamingGreeterService, entries[1].Service)
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"fmt"
+
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+)
+
+// gRPC ignores flow control windows smaller than the HTTP/2 default.
+const minGRPCWindowSize = 65535
+
+// HTTP/2 limits the frame size a peer may advertise to this range.
+const (
+	minMaxFrameSize = 1 << 14
+	maxMaxFrameSize = 1<<24 - 1
+)
+
+// The x/net HTTP/2 server ignores connection windows smaller than this.
+const minH2CConnWindowSize = 1 << 16
+
+// HTTP2Settings are the HTTP/2 settings a greet server or client advertises to its peers. Zero
+// values leave the implementation's defaults in place. With gRPC's own transport, leaving both
+// windows unset also leaves gRPC to size them from the bandwidth-delay product it measures.
+type HTTP2Settings struct {
+	// InitialWindowSize is the flow control window of every stream.
+	InitialWindowSize uint32
+	// InitialConnWindowSize is the flow control window of the connection as a whole.
+	InitialConnWindowSize uint32
+	// MaxHeaderListSize bounds the uncompressed size of the header lists received. Larger ones are
+	// rejected.
+	MaxHeaderListSize uint32
+	// HeaderTableSize is the size of the HPACK table used to decode the headers received. Servers
+	// only.
+	HeaderTableSize uint32
+	// MaxFrameSize bounds the frames received. Servers served as h2c only.
+	MaxFrameSize uint32
+}
+
+// Validate returns an error if the settings cannot be honored, by a server served as h2c if h2c
+// is set, or else by gRPC's own transport. Settings that need the other transport are reported as
+// ErrBadFlagCombination.
+func (s *HTTP2Settings) Validate(h2c bool) error {
+	if s.MaxFrameSize != 0 && (s.MaxFrameSize < minMaxFrameSize || s.MaxFrameSize > maxMaxFrameSize) {
+		return fmt.Errorf("max frame size %d is outside [%d, %d]", s.MaxFrameSize, minMaxFrameSize, maxMaxFrameSize)
+	}
+	if h2c {
+		switch {
+		case s.InitialConnWindowSize != 0 && s.InitialConnWindowSize < minH2CConnWindowSize:
+			return fmt.Errorf("initial connection window size %d is below %d, the smallest h2c supports", s.InitialConnWindowSize, minH2CConnWindowSize)
+		case s.MaxHeaderListSize != 0:
+			return badFlagsf("h2c does not support setting the max header list size")
+		}
+		return nil
+	}
+	switch {
+	case s.InitialWindowSize != 0 && s.InitialWindowSize < minGRPCWindowSize:
+		return badFlagsf("initial window size %d is below %d, the smallest gRPC supports; serve as h2c for smaller windows", s.InitialWindowSize, minGRPCWindowSize)
+	case s.InitialConnWindowSize != 0 && s.InitialConnWindowSize < minGRPCWindowSize:
+		return fmt.Errorf("initial connection window size %d is below %d, the smallest gRPC supports", s.InitialConnWindowSize, minGRPCWindowSize)
+	case s.MaxFrameSize != 0:
+		return badFlagsf("gRPC does not support setting the max frame size; serve as h2c instead")
+	}
+	return nil
+}
+
+// ServerOptions returns the options that apply the settings to a grpc.Server.
+func (s *HTTP2Settings) ServerOptions() []grpc.ServerOption {
+	var opts []grpc.ServerOption
+	if s.InitialWindowSize != 0 {
+		opts = append(opts, grpc.InitialWindowSize(int32(s.InitialWindowSize)))
+	}
+	if s.InitialConnWindowSize != 0 {
+		opts = append(opts, grpc.InitialConnWindowSize(int32(s.InitialConnWindowSize)))
+	}
+	if s.MaxHeaderListSize != 0 {
+		opts = append(opts, grpc.MaxHeaderListSize(s.MaxHeaderListSize))
+	}
+	if s.HeaderTableSize != 0 {
+		opts = append(opts, grpc.HeaderTableSize(s.HeaderTableSize))
+	}
+	return opts
+}
+
+// DialOptions returns the options that apply the settings to a grpc.ClientConn. gRPC clients
+// cannot set their header table size.
+func (s *HTTP2Settings) DialOptions() ([]grpc.DialOption, error) {
+	if s.HeaderTableSize != 0 {
+		return nil, badFlagsf("gRPC clients do not support setting the header table size")
+	}
+	var opts []grpc.DialOption
+	if s.InitialWindowSize != 0 {
+		opts = append(opts, grpc.WithInitialWindowSize(int32(s.InitialWindowSize)))
+	}
+	if s.InitialConnWindowSize != 0 {
+		opts = append(opts, grpc.WithInitialConnWindowSize(int32(s.InitialConnWindowSize)))
+	}
+	if s.MaxHeaderListSize != 0 {
+		opts = append(opts, grpc.WithMaxHeaderListSize(s.MaxHeaderListSize))
+	}
+	return opts, nil
+}
+
+// h2cServer returns the HTTP/2 server that serves h2c with the settings.
+func (s *HTTP2Settings) h2cServer() *http2.Server {
+	return &http2.Server{
+		MaxUploadBufferPerStream:     int32(s.InitialWindowSize),
+		MaxUploadBufferPerConnection: int32(s.InitialConnWindowSize),
+		MaxReadFrameSize:             s.MaxFrameSize,
+		MaxDecoderHeaderTableSize:    s.HeaderTableSize,
+	}
+}
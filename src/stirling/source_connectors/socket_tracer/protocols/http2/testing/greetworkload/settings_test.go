@@ -0,0 +1,128 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+func TestHTTP2Settings_TinyWindow(t *testing.T) {
+	serverStats := greetworkload.NewConnStatsHandler()
+	// gRPC's own transport does not go below 64KB, so the server is served as h2c.
+	settings := &greetworkload.HTTP2Settings{InitialWindowSize: 1024}
+	require.NoError(t, settings.Validate(true))
+	addr := startServerWith(t, &serverSetup{Wrap: serverStats.WrapListener, H2C: settings}).Addr
+
+	clientStats := greetworkload.NewConnStatsHandler()
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{
+		Timeout: 10 * time.Second,
+		HTTP2:   &greetworkload.HTTP2Settings{InitialWindowSize: 1 << 20},
+	})
+	conn, err := c.Dial(addr, grpc.WithStatsHandler(clientStats), grpc.WithContextDialer(clientStats.Dialer()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Every name takes 16 windows to send.
+	name := strings.Repeat("x", 16<<10)
+	r := c.ClientStreaming(conn, []string{name, name, name})
+	require.True(t, r.Completed(), r.Error)
+
+	conns := serverStats.Conns()
+	require.Len(t, conns, 1)
+	assert.Equal(t, uint32(1024), conns[0].Settings["INITIAL_WINDOW_SIZE"])
+	// Granted back as it is read, 1KB at a time at most.
+	assert.GreaterOrEqual(t, conns[0].WindowUpdatesOut, int64(3*16))
+
+	conns = clientStats.Conns()
+	require.Len(t, conns, 1)
+	assert.Equal(t, uint32(1<<20), conns[0].Settings["INITIAL_WINDOW_SIZE"])
+	assert.EqualValues(t, 1, conns[0].RPCsCompleted)
+}
+
+func TestHTTP2Settings_MaxHeaderListSize(t *testing.T) {
+	settings := &greetworkload.HTTP2Settings{MaxHeaderListSize: 1024}
+	require.NoError(t, settings.Validate(false))
+	addr := startServerWith(t, &serverSetup{GRPC: settings.ServerOptions()}).Addr
+
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := pb.NewGreeterClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = client.SayHello(ctx, &pb.HelloRequest{Name: "pixie"})
+	require.NoError(t, err)
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-padding", strings.Repeat("x", 4096))
+	_, err = client.SayHello(ctx, &pb.HelloRequest{Name: "pixie"})
+	require.Error(t, err)
+	assert.NotEqual(t, codes.DeadlineExceeded, status.Code(err))
+}
+
+func TestHTTP2Settings_Validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings greetworkload.HTTP2Settings
+		h2c      bool
+		wantErr  bool
+	}{
+		{name: "defaults"},
+		{name: "defaults h2c", h2c: true},
+		{name: "large windows", settings: greetworkload.HTTP2Settings{InitialWindowSize: 1 << 20, InitialConnWindowSize: 1 << 20}},
+		{name: "small window", settings: greetworkload.HTTP2Settings{InitialWindowSize: 1024}, wantErr: true},
+		{name: "small window h2c", settings: greetworkload.HTTP2Settings{InitialWindowSize: 1024}, h2c: true},
+		{name: "small conn window", settings: greetworkload.HTTP2Settings{InitialConnWindowSize: 1024}, wantErr: true},
+		{name: "small conn window h2c", settings: greetworkload.HTTP2Settings{InitialConnWindowSize: 1024}, h2c: true, wantErr: true},
+		{name: "max header list size", settings: greetworkload.HTTP2Settings{MaxHeaderListSize: 1024}},
+		{name: "max header list size h2c", settings: greetworkload.HTTP2Settings{MaxHeaderListSize: 1024}, h2c: true, wantErr: true},
+		{name: "max frame size", settings: greetworkload.HTTP2Settings{MaxFrameSize: 1 << 20}, wantErr: true},
+		{name: "max frame size h2c", settings: greetworkload.HTTP2Settings{MaxFrameSize: 1 << 20}, h2c: true},
+		{name: "max frame size too small h2c", settings: greetworkload.HTTP2Settings{MaxFrameSize: 1024}, h2c: true, wantErr: true},
+		{name: "max frame size too large h2c", settings: greetworkload.HTTP2Settings{MaxFrameSize: 1 << 24}, h2c: true, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.settings.Validate(tc.h2c)
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestHTTP2Settings_DialOptionsRejectHeaderTableSize(t *testing.T) {
+	_, err := (&greetworkload.HTTP2Settings{HeaderTableSize: 1024}).DialOptions()
+	assert.Error(t, err)
+}
@@ -0,0 +1,295 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// DefaultShapingBurst is the burst of ShapingOptions that leave it at 0: a full HTTP/2 frame of the
+// default maximum size, with its header.
+const DefaultShapingBurst = minMaxFrameSize + http2FrameHeaderLen
+
+// shapingQueueLen bounds the writes held back by ShapingOptions.Delay, so that a writer faster than
+// the delay lets through is blocked rather than buffered without end.
+const shapingQueueLen = 256
+
+// shapingCloseGrace bounds how long Close waits, once every held back write is due, for them to
+// be written out, should the peer have stopped reading.
+const shapingCloseGrace = time.Second
+
+// ShapingOptions configure the bandwidth and latency a Shaper imposes on connections, as a slow
+// network would. The zero value leaves connections as they are.
+type ShapingOptions struct {
+	// BytesPerSecond limits each direction of a connection, through a token bucket of its own,
+	// counting every byte written to or read from it, framing included. Zero leaves the bandwidth
+	// unlimited.
+	BytesPerSecond int64 `json:"bytes_per_second,omitempty"`
+	// Burst is the size of the token buckets, the most bytes let through at once after a
+	// connection has been idle. Zero uses DefaultShapingBurst.
+	Burst int `json:"burst,omitempty"`
+	// Delay holds back the bytes written to a connection for this long before they are written
+	// out, like a link with this one-way latency. Writes return once the bytes are queued.
+	Delay time.Duration `json:"delay_ns,omitempty"`
+}
+
+// Validate checks that the options can be applied.
+func (o *ShapingOptions) Validate() error {
+	if o.BytesPerSecond < 0 || o.Burst < 0 || o.Delay < 0 {
+		return badFlagsf("shaping bandwidth, burst and delay cannot be negative, got %d bytes/s, %d bytes and %v", o.BytesPerSecond, o.Burst, o.Delay)
+	}
+	if o.Burst > 0 && o.BytesPerSecond == 0 {
+		return badFlagsf("a shaping burst needs a bandwidth to apply to")
+	}
+	return nil
+}
+
+// Shaper limits the bandwidth of the connections it wraps, and delays what is written to them.
+// Every connection is shaped on its own, so that connections do not share the bandwidth.
+//
+// Wrapped below TLS, and below the connections of a ConnStatsHandler, it shapes the bytes on the
+// wire, and its options are recorded in ConnStats.Shaping.
+type Shaper struct {
+	opts ShapingOptions
+}
+
+// NewShaper creates a new Shaper.
+func NewShaper(opts *ShapingOptions) (*Shaper, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	s := &Shaper{opts: *opts}
+	if s.opts.BytesPerSecond > 0 && s.opts.Burst == 0 {
+		s.opts.Burst = DefaultShapingBurst
+	}
+	return s, nil
+}
+
+// Options returns the options of the connections shaped, with the burst they default to.
+func (s *Shaper) Options() ShapingOptions {
+	return s.opts
+}
+
+// WrapListener wraps lis so that the connections it accepts are shaped.
+func (s *Shaper) WrapListener(lis net.Listener) net.Listener {
+	return &shapedListener{Listener: lis, shaper: s}
+}
+
+// Dialer wraps dial, a dialer for grpc.WithContextDialer, so that the connections it dials are
+// shaped.
+func (s *Shaper) Dialer(dial func(context.Context, string) (net.Conn, error)) func(context.Context, string) (net.Conn, error) {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return s.wrapConn(conn), nil
+	}
+}
+
+func (s *Shaper) wrapConn(conn net.Conn) net.Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &shapedConn{Conn: conn, opts: &s.opts, ctx: ctx, cancel: cancel}
+	if s.opts.BytesPerSecond > 0 {
+		c.readLimit = rate.NewLimiter(rate.Limit(s.opts.BytesPerSecond), s.opts.Burst)
+		c.writeLimit = rate.NewLimiter(rate.Limit(s.opts.BytesPerSecond), s.opts.Burst)
+	}
+	if s.opts.Delay > 0 {
+		c.queue = make(chan delayedWrite, shapingQueueLen)
+		c.drained = make(chan struct{})
+		go c.writeDelayed()
+	}
+	return c
+}
+
+type shapedListener struct {
+	net.Listener
+	shaper *Shaper
+}
+
+func (l *shapedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.shaper.wrapConn(conn), nil
+}
+
+// delayedWrite is a write held back until due.
+type delayedWrite struct {
+	b   []byte
+	due time.Time
+}
+
+type shapedConn struct {
+	net.Conn
+	opts *ShapingOptions
+	// ctx is cancelled on Close, to release the reads and writes waiting on the limiters.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// readLimit and writeLimit are nil if the bandwidth is unlimited.
+	readLimit  *rate.Limiter
+	writeLimit *rate.Limiter
+
+	// queue carries the writes held back by the delay to writeDelayed, and drained is closed once
+	// it has written them all out. Both are nil without a delay.
+	queue   chan delayedWrite
+	drained chan struct{}
+
+	// mu guards closed, so that no write is queued once the queue is closed.
+	mu     sync.Mutex
+	closed bool
+	// errMu guards writeErr, the error writeDelayed failed with, returned by the writes that
+	// follow.
+	errMu    sync.Mutex
+	writeErr error
+}
+
+// NetConn returns the connection shaped.
+func (c *shapedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// wait takes n tokens from limit, n at most the burst.
+func (c *shapedConn) wait(limit *rate.Limiter, n int) error {
+	if limit == nil {
+		return nil
+	}
+	return limit.WaitN(c.ctx, n)
+}
+
+// Read reads at most a burst at a time, and takes as many tokens as bytes read before returning
+// them.
+func (c *shapedConn) Read(b []byte) (int, error) {
+	if c.readLimit != nil && len(b) > c.opts.Burst {
+		b = b[:c.opts.Burst]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if werr := c.wait(c.readLimit, n); werr != nil && err == nil {
+			err = net.ErrClosed
+		}
+	}
+	return n, err
+}
+
+// Write writes b a burst at a time, each once the tokens it takes are there, either out or to the
+// queue of delayed writes.
+func (c *shapedConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if c.writeLimit != nil && n > c.opts.Burst {
+			n = c.opts.Burst
+		}
+		if err := c.wait(c.writeLimit, n); err != nil {
+			return written, net.ErrClosed
+		}
+		if err := c.writeOut(b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (c *shapedConn) writeOut(b []byte) error {
+	if c.queue == nil {
+		_, err := c.Conn.Write(b)
+		return err
+	}
+	c.errMu.Lock()
+	err := c.writeErr
+	c.errMu.Unlock()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	// The caller may reuse b once Write returns.
+	w := delayedWrite{b: append([]byte(nil), b...), due: time.Now().Add(c.opts.Delay)}
+	select {
+	case c.queue <- w:
+		return nil
+	case <-c.ctx.Done():
+		return net.ErrClosed
+	}
+}
+
+// writeDelayed writes out the queued writes as they are due, until the queue is closed.
+func (c *shapedConn) writeDelayed() {
+	defer close(c.drained)
+	var err error
+	for w := range c.queue {
+		if err != nil {
+			continue
+		}
+		time.Sleep(time.Until(w.due))
+		if _, err = c.Conn.Write(w.b); err != nil {
+			c.errMu.Lock()
+			c.writeErr = err
+			c.errMu.Unlock()
+		}
+	}
+}
+
+// Close writes out the writes still held back, as a link delivers what is in flight, then closes
+// the connection.
+func (c *shapedConn) Close() error {
+	c.cancel()
+	if c.queue == nil {
+		return c.Conn.Close()
+	}
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+	c.mu.Unlock()
+	t := time.NewTimer(c.opts.Delay + shapingCloseGrace)
+	defer t.Stop()
+	select {
+	case <-c.drained:
+	case <-t.C:
+	}
+	return c.Conn.Close()
+}
+
+// shapingOf returns the options conn is shaped with, if it is a connection of a Shaper, or wraps
+// one.
+func shapingOf(conn net.Conn) *ShapingOptions {
+	for {
+		if sc, ok := conn.(*shapedConn); ok {
+			return sc.opts
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = wrapper.NetConn()
+	}
+}
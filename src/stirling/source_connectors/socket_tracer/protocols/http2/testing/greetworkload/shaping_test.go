@@ -0,0 +1,182 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"google.golang.org/grpc"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// startShapedServer serves StreamingGreeter, with replies of replyBytes, over connections shaped
+// by shaper, if not nil, and tracked by the returned handler.
+func startShapedServer(t *testing.T, shaper *greetworkload.Shaper, replyBytes int) (*greetworkload.ConnStatsHandler, string) {
+	connStats := greetworkload.NewConnStatsHandler()
+	s := startServerWith(t, &serverSetup{
+		Options: &greetworkload.ServerOptions{StreamReplyBytes: replyBytes},
+		Stats:   connStats,
+		Wrap: func(lis net.Listener) net.Listener {
+			if shaper != nil {
+				lis = shaper.WrapListener(lis)
+			}
+			return connStats.WrapListener(lis)
+		},
+	})
+	return connStats, s.Addr
+}
+
+func dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+}
+
+func newShaper(t *testing.T, opts *greetworkload.ShapingOptions) *greetworkload.Shaper {
+	s, err := greetworkload.NewShaper(opts)
+	require.NoError(t, err)
+	return s
+}
+
+// A 1MB streaming response over a connection shaped to 100KB/s takes about 10 seconds, and still
+// completes.
+func TestShaper_StreamingOverSlowLink(t *testing.T) {
+	const rate = 100_000
+	serverStats, addr := startShapedServer(t, newShaper(t, &greetworkload.ShapingOptions{BytesPerSecond: rate}), 10_000)
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 30 * time.Second, StreamCount: 100})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	r := c.ServerStreaming(conn, "pixie")
+	require.True(t, r.Completed(), r.Error)
+	assert.Equal(t, 100, r.Replies)
+	took := time.Duration(r.DurationNS)
+	assert.GreaterOrEqual(t, took, 9*time.Second)
+	assert.LessOrEqual(t, took, 12*time.Second)
+
+	conns := serverStats.Conns()
+	require.Len(t, conns, 1)
+	assert.Equal(t, &greetworkload.ShapingOptions{BytesPerSecond: rate, Burst: greetworkload.DefaultShapingBurst}, conns[0].Shaping)
+	assert.GreaterOrEqual(t, conns[0].WireBytesOut, int64(1_000_000))
+}
+
+// Shaping the client's connections limits what it reads too, so that it alone slows down replies.
+func TestShaper_ClientSideBandwidth(t *testing.T) {
+	_, addr := startShapedServer(t, nil, 10_000)
+	shaper := newShaper(t, &greetworkload.ShapingOptions{BytesPerSecond: 500_000, Burst: 32 << 10})
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 10 * time.Second, StreamCount: 50})
+	clientStats := greetworkload.NewConnStatsHandler()
+	conn, err := c.Dial(addr, grpc.WithStatsHandler(clientStats), grpc.WithContextDialer(clientStats.DialerFrom(shaper.Dialer(dialTCP))))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	r := c.ServerStreaming(conn, "pixie")
+	require.True(t, r.Completed(), r.Error)
+	// 500KB at 500KB/s, less the first burst.
+	assert.GreaterOrEqual(t, time.Duration(r.DurationNS), 800*time.Millisecond)
+
+	conns := clientStats.Conns()
+	require.Len(t, conns, 1)
+	assert.Equal(t, &greetworkload.ShapingOptions{BytesPerSecond: 500_000, Burst: 32 << 10}, conns[0].Shaping)
+}
+
+// A delay on both sides adds it twice to every round trip.
+func TestShaper_Delay(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	shaper := newShaper(t, &greetworkload.ShapingOptions{Delay: delay})
+	_, addr := startShapedServer(t, shaper, 0)
+
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, StreamCount: 1})
+	conn, err := c.Dial(addr, grpc.WithContextDialer(shaper.Dialer(dialTCP)))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The first call waits for the connection to be set up.
+	require.True(t, c.ServerStreaming(conn, "warmup").Completed())
+	for i := 0; i < 3; i++ {
+		r := c.ServerStreaming(conn, "pixie")
+		require.True(t, r.Completed(), r.Error)
+		took := time.Duration(r.DurationNS)
+		assert.GreaterOrEqual(t, took, 2*delay)
+		assert.Less(t, took, 2*delay+time.Second)
+	}
+}
+
+// Closing a delayed connection still delivers what was written to it, once it is due.
+func TestShaper_CloseDeliversHeldBackWrites(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		received <- b
+	}()
+
+	const delay = 100 * time.Millisecond
+	shaper := newShaper(t, &greetworkload.ShapingOptions{BytesPerSecond: 1 << 20, Delay: delay})
+	conn, err := shaper.Dialer(dialTCP)(context.Background(), lis.Addr().String())
+	require.NoError(t, err)
+	payload := make([]byte, 100<<10)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	start := time.Now()
+	n, err := conn.Write(payload)
+	require.NoError(t, err)
+	assert.Equal(t, len(payload), n)
+	require.NoError(t, conn.Close())
+	assert.GreaterOrEqual(t, time.Since(start), delay)
+
+	assert.Equal(t, payload, <-received)
+	_, err = conn.Write([]byte("late"))
+	assert.True(t, errors.Is(err, net.ErrClosed), err)
+}
+
+func TestShapingOptions_Validate(t *testing.T) {
+	for _, opts := range []*greetworkload.ShapingOptions{
+		{BytesPerSecond: -1},
+		{BytesPerSecond: 1, Burst: -1},
+		{Delay: -time.Millisecond},
+		{Burst: 100},
+	} {
+		_, err := greetworkload.NewShaper(opts)
+		assert.True(t, errors.Is(err, greetworkload.ErrBadFlagCombination), "%+v: %v", opts, err)
+	}
+	s, err := greetworkload.NewShaper(&greetworkload.ShapingOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, greetworkload.ShapingOptions{}, s.Options())
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// SocketOptions are the TCP socket options of the connections a client dials, or a server accepts.
+// The zero value, as well as nil, leaves every option at its default.
+type SocketOptions struct {
+	// Nagle enables Nagle's algorithm, by clearing the TCP_NODELAY Go sets on every TCP connection.
+	Nagle bool
+	// SendBuffer and RecvBuffer set SO_SNDBUF and SO_RCVBUF, in bytes, if positive. Linux doubles
+	// them, and raises them to its minimums.
+	SendBuffer int
+	RecvBuffer int
+	// KeepAlive is both the idle time before the first TCP keepalive probe and the interval between
+	// probes, rounded to seconds. Zero leaves the Go defaults, and negative disables keepalives.
+	KeepAlive time.Duration
+	// ReusePort sets SO_REUSEPORT on listening sockets, so that several processes can listen on
+	// the same port, the kernel spreading the connections made to it between them. Dialed
+	// connections ignore it.
+	ReusePort bool
+}
+
+// Validate checks that the buffer sizes are not negative, and that the platform supports the
+// options set, or else returns an UnsupportedPlatformError.
+func (o *SocketOptions) Validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.SendBuffer < 0 || o.RecvBuffer < 0 {
+		return badFlagsf("socket buffer sizes cannot be negative, got send %d and receive %d", o.SendBuffer, o.RecvBuffer)
+	}
+	if o.SendBuffer > 0 || o.RecvBuffer > 0 {
+		if err := CheckPlatform(FeatureSocketBuffers); err != nil {
+			return err
+		}
+	}
+	if o.ReusePort {
+		return CheckPlatform(FeatureReusePort)
+	}
+	return nil
+}
+
+// control sets the buffer sizes on a socket before it connects or listens. Accepted connections
+// inherit them from the listening socket.
+func (o *SocketOptions) control(_, _ string, c syscall.RawConn) error {
+	if o.SendBuffer == 0 && o.RecvBuffer == 0 {
+		return nil
+	}
+	return setSocketBuffers(c, o.SendBuffer, o.RecvBuffer)
+}
+
+// listenControl is control, and sets SO_REUSEPORT if asked to.
+func (o *SocketOptions) listenControl(network, address string, c syscall.RawConn) error {
+	if o.ReusePort {
+		if err := setReusePort(c); err != nil {
+			return err
+		}
+	}
+	return o.control(network, address, c)
+}
+
+// Dial dials a TCP connection to addr with the options set. It can be given to
+// grpc.WithContextDialer.
+func (o *SocketOptions) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	if o == nil {
+		return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	conn, err := (&net.Dialer{KeepAlive: o.KeepAlive, Control: o.control}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.configure(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// configures returns true if configure changes the connections set up.
+func (o *SocketOptions) configures() bool {
+	return o.Nagle || o.KeepAlive > 0
+}
+
+// configure sets the options that Go sets itself once a connection is set up, and so cannot be
+// set by control: TCP_NODELAY, and the keepalive idle time and interval, which not every Go
+// version sets alike.
+func (o *SocketOptions) configure(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if o.Nagle {
+		if err := tcpConn.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+	if o.KeepAlive > 0 {
+		return setKeepAlive(tcpConn, o.KeepAlive)
+	}
+	return nil
+}
+
+// listen listens on address with the options set on the connections accepted.
+func (o *SocketOptions) listen(network, address string) (net.Listener, error) {
+	if o == nil {
+		return net.Listen(network, address)
+	}
+	lc := &net.ListenConfig{KeepAlive: o.KeepAlive, Control: o.listenControl}
+	lis, err := lc.Listen(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	if !o.configures() {
+		return lis, nil
+	}
+	return &socketListener{Listener: lis, opts: o}, nil
+}
+
+type socketListener struct {
+	net.Listener
+	opts *SocketOptions
+}
+
+// Accept configures the connections accepted. Failing to is not fatal to the server, and shows in
+// the SocketState of the connection.
+func (l *socketListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	_ = l.opts.configure(conn)
+	return conn, nil
+}
+
+// SocketState are the TCP socket options of a connection, as read back from its socket.
+type SocketState struct {
+	NoDelay bool `json:"no_delay"`
+	// SendBuffer and RecvBuffer are SO_SNDBUF and SO_RCVBUF, in bytes.
+	SendBuffer int  `json:"send_buffer"`
+	RecvBuffer int  `json:"recv_buffer"`
+	KeepAlive  bool `json:"keepalive"`
+	// KeepAliveIdleSecs and KeepAliveIntervalSecs are TCP_KEEPIDLE and TCP_KEEPINTVL.
+	KeepAliveIdleSecs     int `json:"keepalive_idle_secs"`
+	KeepAliveIntervalSecs int `json:"keepalive_interval_secs"`
+}
+
+// ReadSocketState reads the TCP socket options of conn. Connections that wrap a TCP connection are
+// unwrapped with their NetConn method, as for tls.Conn.
+func ReadSocketState(conn net.Conn) (*SocketState, error) {
+	for {
+		if sc, ok := conn.(syscall.Conn); ok {
+			raw, err := sc.SyscallConn()
+			if err != nil {
+				return nil, err
+			}
+			return readSocketState(raw)
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil, errors.New("not a TCP connection")
+		}
+		conn = wrapper.NetConn()
+	}
+}
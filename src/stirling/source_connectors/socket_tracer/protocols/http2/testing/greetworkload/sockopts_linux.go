@@ -0,0 +1,111 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const socketOptionsSupported = true
+
+// setKeepAlive enables keepalives on conn, with both the idle time and the interval set to d.
+func setKeepAlive(conn *net.TCPConn, d time.Duration) error {
+	secs := int(d.Round(time.Second) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	ctrlErr := raw.Control(func(fd uintptr) {
+		for _, opt := range []struct{ level, name, value int }{
+			{unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1},
+			{unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, secs},
+			{unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, secs},
+		} {
+			if sockErr = unix.SetsockoptInt(int(fd), opt.level, opt.name, opt.value); sockErr != nil {
+				return
+			}
+		}
+	})
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+	return sockErr
+}
+
+func setSocketBuffers(c syscall.RawConn, send, recv int) error {
+	var err error
+	ctrlErr := c.Control(func(fd uintptr) {
+		if send > 0 {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, send)
+		}
+		if err == nil && recv > 0 {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, recv)
+		}
+	})
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
+
+func setReusePort(c syscall.RawConn) error {
+	var err error
+	ctrlErr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
+
+func readSocketState(c syscall.RawConn) (*SocketState, error) {
+	s := &SocketState{}
+	var err error
+	ctrlErr := c.Control(func(fd uintptr) {
+		get := func(level, opt int) int {
+			if err != nil {
+				return 0
+			}
+			var v int
+			v, err = unix.GetsockoptInt(int(fd), level, opt)
+			return v
+		}
+		s.NoDelay = get(unix.IPPROTO_TCP, unix.TCP_NODELAY) != 0
+		s.SendBuffer = get(unix.SOL_SOCKET, unix.SO_SNDBUF)
+		s.RecvBuffer = get(unix.SOL_SOCKET, unix.SO_RCVBUF)
+		s.KeepAlive = get(unix.SOL_SOCKET, unix.SO_KEEPALIVE) != 0
+		s.KeepAliveIdleSecs = get(unix.IPPROTO_TCP, unix.TCP_KEEPIDLE)
+		s.KeepAliveIntervalSecs = get(unix.IPPROTO_TCP, unix.TCP_KEEPINTVL)
+	})
+	if ctrlErr != nil {
+		return nil, ctrlErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
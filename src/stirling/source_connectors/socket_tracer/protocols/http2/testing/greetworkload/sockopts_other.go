@@ -0,0 +1,51 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+const socketOptionsSupported = false
+
+// setKeepAlive enables keepalives on conn, with the period d, which Go may only apply to the idle
+// time.
+func setKeepAlive(conn *net.TCPConn, d time.Duration) error {
+	if err := conn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return conn.SetKeepAlivePeriod(d)
+}
+
+func setSocketBuffers(syscall.RawConn, int, int) error {
+	return unsupportedPlatform(FeatureSocketBuffers)
+}
+
+func setReusePort(syscall.RawConn) error {
+	return unsupportedPlatform(FeatureReusePort)
+}
+
+func readSocketState(syscall.RawConn) (*SocketState, error) {
+	return nil, unsupportedPlatform(FeatureSocketState)
+}
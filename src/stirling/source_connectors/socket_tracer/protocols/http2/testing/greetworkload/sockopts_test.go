@@ -0,0 +1,160 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// startSocketServer serves StreamingGreeter with checksums over connections accepted with the socket
+// options opts, and tracked by the returned handler.
+func startSocketServer(t *testing.T, opts *greetworkload.SocketOptions) (*greetworkload.ConnStatsHandler, string) {
+	listenOpts := &greetworkload.ListenOptions{Host: "127.0.0.1", Socket: opts}
+	lis, err := listenOpts.Listen(0)
+	require.NoError(t, err)
+	connStats := greetworkload.NewConnStatsHandler()
+	s := startServerWith(t, &serverSetup{
+		Options:  &greetworkload.ServerOptions{Checksums: true, StreamReplyBytes: 8 << 10},
+		Stats:    connStats,
+		Listener: lis,
+		Wrap:     connStats.WrapListener,
+	})
+	return connStats, s.Addr
+}
+
+func TestSocketOptions_NagleAndTinyBuffers(t *testing.T) {
+	if err := greetworkload.CheckPlatform(greetworkload.FeatureSocketState); err != nil {
+		t.Skip(err)
+	}
+	const buffer = 4 << 10
+	serverStats, addr := startSocketServer(t, &greetworkload.SocketOptions{
+		Nagle:      true,
+		SendBuffer: buffer,
+		KeepAlive:  7 * time.Second,
+	})
+	socket := &greetworkload.SocketOptions{
+		Nagle:      true,
+		SendBuffer: buffer,
+		RecvBuffer: buffer,
+		KeepAlive:  5 * time.Second,
+	}
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{
+		Timeout:         10 * time.Second,
+		StreamCount:     50,
+		VerifyChecksums: true,
+		Socket:          socket,
+	})
+	clientStats := greetworkload.NewConnStatsHandler()
+	conn, err := c.Dial(addr, grpc.WithStatsHandler(clientStats), grpc.WithContextDialer(clientStats.DialerWith(socket)))
+	require.NoError(t, err)
+
+	names := []string{"a", "b", "c", "d"}
+	for i := 0; i < 3; i++ {
+		r := c.ServerStreaming(conn, "pixie")
+		require.True(t, r.Completed(), r.Error)
+		assert.Equal(t, 50, r.Replies)
+		r = c.BidirStreaming(conn, names)
+		require.True(t, r.Completed(), r.Error)
+		assert.Equal(t, len(names), r.Replies)
+	}
+	conn.Close()
+	assert.Zero(t, c.ChecksumMismatches())
+
+	clientConns := clientStats.Conns()
+	require.Len(t, clientConns, 1)
+	got := clientConns[0].Socket
+	require.NotNil(t, got)
+	assert.False(t, got.NoDelay)
+	// Linux doubles the buffer sizes set.
+	assert.Equal(t, 2*buffer, got.SendBuffer)
+	assert.Equal(t, 2*buffer, got.RecvBuffer)
+	assert.True(t, got.KeepAlive)
+	assert.Equal(t, 5, got.KeepAliveIdleSecs)
+	assert.Equal(t, 5, got.KeepAliveIntervalSecs)
+
+	// Accepted connections inherit the buffer sizes of the listening socket.
+	require.Eventually(t, func() bool { return len(serverStats.Conns()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	got = serverStats.Conns()[0].Socket
+	require.NotNil(t, got)
+	assert.False(t, got.NoDelay)
+	assert.Equal(t, 2*buffer, got.SendBuffer)
+	assert.True(t, got.KeepAlive)
+	assert.Equal(t, 7, got.KeepAliveIdleSecs)
+	assert.Equal(t, 7, got.KeepAliveIntervalSecs)
+}
+
+func TestSocketOptions_Defaults(t *testing.T) {
+	if err := greetworkload.CheckPlatform(greetworkload.FeatureSocketState); err != nil {
+		t.Skip(err)
+	}
+	serverStats, addr := startSocketServer(t, nil)
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	clientStats := greetworkload.NewConnStatsHandler()
+	conn, err := c.Dial(addr, grpc.WithStatsHandler(clientStats), grpc.WithContextDialer(clientStats.Dialer()))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.True(t, c.ServerStreaming(conn, "pixie").Completed())
+
+	for _, conns := range [][]greetworkload.ConnStats{clientStats.Conns(), serverStats.Conns()} {
+		require.Len(t, conns, 1)
+		require.NotNil(t, conns[0].Socket)
+		assert.True(t, conns[0].Socket.NoDelay)
+		assert.True(t, conns[0].Socket.KeepAlive)
+		assert.Equal(t, 15, conns[0].Socket.KeepAliveIntervalSecs)
+	}
+}
+
+func TestSocketOptions_ReusePort(t *testing.T) {
+	if err := greetworkload.CheckPlatform(greetworkload.FeatureReusePort); err != nil {
+		t.Skip(err)
+	}
+	reuse := &greetworkload.ListenOptions{Host: "127.0.0.1", Socket: &greetworkload.SocketOptions{ReusePort: true}}
+	first, err := reuse.Listen(0)
+	require.NoError(t, err)
+	defer first.Close()
+	port := first.Addr().(*net.TCPAddr).Port
+
+	second, err := reuse.Listen(port)
+	require.NoError(t, err)
+	defer second.Close()
+	assert.Equal(t, first.Addr().String(), second.Addr().String())
+
+	// Every listener of the port must set it.
+	_, err = (&greetworkload.ListenOptions{Host: "127.0.0.1"}).Listen(port)
+	assert.Error(t, err)
+}
+
+func TestSocketOptions_Validate(t *testing.T) {
+	var opts *greetworkload.SocketOptions
+	assert.NoError(t, opts.Validate())
+	assert.NoError(t, (&greetworkload.SocketOptions{Nagle: true, KeepAlive: time.Second}).Validate())
+	err := (&greetworkload.SocketOptions{RecvBuffer: -1}).Validate()
+	assert.True(t, errors.Is(err, greetworkload.ErrBadFlagCombination), err)
+
+	_, err = (&greetworkload.ListenOptions{Socket: &greetworkload.SocketOptions{SendBuffer: -1}}).Listen(0)
+	assert.True(t, errors.Is(err, greetworkload.ErrBadFlagCombination), err)
+}
@@ -0,0 +1,311 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// The SOCKS5 protocol, RFC 1928, with the username/password authentication of RFC 1929. Only
+// CONNECT is spoken, not UDP ASSOCIATE.
+const (
+	socks5Version      = 0x05
+	socks5AuthVersion  = 0x01
+	socks5MethodNone   = 0x00
+	socks5MethodPasswd = 0x02
+	socks5NoMethod     = 0xff
+	socks5CmdConnect   = 0x01
+	socks5AddrIPv4     = 0x01
+	socks5AddrDomain   = 0x03
+	socks5AddrIPv6     = 0x04
+)
+
+// SOCKS5 reply codes, RFC 1928 section 6.
+const (
+	SOCKS5Succeeded           = 0x00
+	SOCKS5GeneralFailure      = 0x01
+	SOCKS5NotAllowed          = 0x02
+	SOCKS5NetworkUnreachable  = 0x03
+	SOCKS5HostUnreachable     = 0x04
+	SOCKS5ConnectionRefused   = 0x05
+	SOCKS5TTLExpired          = 0x06
+	SOCKS5CommandNotSupported = 0x07
+	SOCKS5AddressNotSupported = 0x08
+)
+
+var socks5Replies = map[byte]string{
+	SOCKS5Succeeded:           "succeeded",
+	SOCKS5GeneralFailure:      "general failure",
+	SOCKS5NotAllowed:          "connection not allowed by ruleset",
+	SOCKS5NetworkUnreachable:  "network unreachable",
+	SOCKS5HostUnreachable:     "host unreachable",
+	SOCKS5ConnectionRefused:   "connection refused",
+	SOCKS5TTLExpired:          "TTL expired",
+	SOCKS5CommandNotSupported: "command not supported",
+	SOCKS5AddressNotSupported: "address type not supported",
+}
+
+// The steps of setting up a connection through a SOCKS5 proxy, see SOCKS5Error.
+const (
+	// SOCKS5StepMethod is the negotiation of the authentication method.
+	SOCKS5StepMethod = "method"
+	// SOCKS5StepAuth is the username/password authentication.
+	SOCKS5StepAuth = "auth"
+	// SOCKS5StepConnect is the CONNECT to the target.
+	SOCKS5StepConnect = "connect"
+)
+
+// SOCKS5Error is a SOCKS5 proxy refusing to set up a connection. Client.Dial returns it, wrapped in
+// ErrDialFailed, when dialing with grpc.WithBlock and grpc.FailOnNonTempDialError; the calls made
+// over connections that could not be set up otherwise fail with UNAVAILABLE and its message.
+type SOCKS5Error struct {
+	Proxy  string
+	Target string
+	// Step is the step the proxy refused, one of the SOCKS5Step constants.
+	Step string
+	// Code is what the proxy answered the step with: the method it picked, the status of the
+	// authentication, or the reply code of the CONNECT, one of the SOCKS5 reply code constants.
+	Code byte
+}
+
+func (e *SOCKS5Error) Error() string {
+	msg := fmt.Sprintf("socks5 proxy %s refused %s to %s: code 0x%02x", e.Proxy, e.Step, e.Target, e.Code)
+	if e.Step == SOCKS5StepConnect {
+		if reply, ok := socks5Replies[e.Code]; ok {
+			msg += " (" + reply + ")"
+		}
+	}
+	return msg
+}
+
+// Temporary is false, so that gRPC does not retry dials the proxy refused with
+// grpc.FailOnNonTempDialError.
+func (e *SOCKS5Error) Temporary() bool {
+	return false
+}
+
+// SOCKS5Options configure a SOCKS5Dialer.
+type SOCKS5Options struct {
+	// Address is the host:port of the proxy.
+	Address string
+	// Username and Password authenticate with the proxy, if Username is not empty. Otherwise, only
+	// no authentication is offered.
+	Username string
+	Password string
+	// ConnectTimeout bounds setting up a connection through the proxy, from dialing it to its reply
+	// to the CONNECT, if positive. The deadline of the dial applies either way.
+	ConnectTimeout time.Duration
+	// Dial dials the proxy, e.g. SocketOptions.Dial. Nil dials TCP.
+	Dial func(context.Context, string) (net.Conn, error)
+}
+
+// SOCKS5Dialer dials connections through a SOCKS5 proxy, for grpc.WithContextDialer or
+// ClientOptions.SOCKS5. Host names are resolved by the proxy.
+type SOCKS5Dialer struct {
+	opts *SOCKS5Options
+}
+
+// NewSOCKS5Dialer creates a SOCKS5Dialer. Failures wrap ErrBadFlagCombination.
+func NewSOCKS5Dialer(opts *SOCKS5Options) (*SOCKS5Dialer, error) {
+	if _, _, err := net.SplitHostPort(opts.Address); err != nil {
+		return nil, badFlagsf("invalid socks5 proxy address %q: %v", opts.Address, err)
+	}
+	if opts.Username == "" && opts.Password != "" {
+		return nil, badFlagsf("a socks5 password requires a username")
+	}
+	if len(opts.Username) > 255 || len(opts.Password) > 255 {
+		return nil, badFlagsf("socks5 usernames and passwords are at most 255 bytes")
+	}
+	if opts.ConnectTimeout < 0 {
+		return nil, badFlagsf("the socks5 connect timeout cannot be negative, got %v", opts.ConnectTimeout)
+	}
+	return &SOCKS5Dialer{opts: opts}, nil
+}
+
+// Dial sets up a connection to addr through the proxy. The proxy refusing it fails with a
+// *SOCKS5Error, and the ConnectTimeout or the deadline of ctx expiring with ctx.Err().
+func (d *SOCKS5Dialer) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	if d.opts.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.opts.ConnectTimeout)
+		defer cancel()
+	}
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unblocks the handshake once ctx is done.
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	err = d.handshake(conn, addr)
+	close(done)
+	<-stopped
+	if err == nil && ctx.Err() == nil {
+		if err = conn.SetDeadline(time.Time{}); err == nil {
+			return conn, nil
+		}
+	}
+	conn.Close()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("socks5 proxy %s: %w", d.opts.Address, ctx.Err())
+	}
+	return nil, err
+}
+
+// dialProxy dials the proxy, with Dial if set.
+func (d *SOCKS5Dialer) dialProxy(ctx context.Context) (net.Conn, error) {
+	if d.opts.Dial != nil {
+		return d.opts.Dial(ctx, d.opts.Address)
+	}
+	return (&net.Dialer{}).DialContext(ctx, "tcp", d.opts.Address)
+}
+
+// handshake asks the proxy on conn to connect it to addr.
+func (d *SOCKS5Dialer) handshake(conn net.Conn, addr string) error {
+	refused := func(step string, code byte) error {
+		return &SOCKS5Error{Proxy: d.opts.Address, Target: addr, Step: step, Code: code}
+	}
+	req, err := socks5ConnectRequest(addr)
+	if err != nil {
+		return err
+	}
+
+	method := byte(socks5MethodNone)
+	if d.opts.Username != "" {
+		method = socks5MethodPasswd
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("socks5 proxy %s answered with version %d", d.opts.Address, reply[0])
+	}
+	if reply[1] != method {
+		return refused(SOCKS5StepMethod, reply[1])
+	}
+
+	if method == socks5MethodPasswd {
+		auth := []byte{socks5AuthVersion, byte(len(d.opts.Username))}
+		auth = append(auth, d.opts.Username...)
+		auth = append(auth, byte(len(d.opts.Password)))
+		auth = append(auth, d.opts.Password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return refused(SOCKS5StepAuth, reply[1])
+		}
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	// VER, REP, RSV and ATYP, then the bound address and port, which are of no use to the client.
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[1] != SOCKS5Succeeded {
+		return refused(SOCKS5StepConnect, head[1])
+	}
+	_, err = readSOCKS5Addr(conn, head[3])
+	return err
+}
+
+// socks5ConnectRequest returns the CONNECT request to addr, with its host as an IP address if it
+// is one, or else as a domain name.
+func socks5ConnectRequest(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q: %w", addr, err)
+	}
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host %q is too long for socks5", host)
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip...)
+	}
+	return append(req, byte(port>>8), byte(port)), nil
+}
+
+// readSOCKS5Addr reads an address of type atyp, and its port, as host:port.
+func readSOCKS5Addr(r io.Reader, atyp byte) (string, error) {
+	var host string
+	switch atyp {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unknown socks5 address type %d", atyp)
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
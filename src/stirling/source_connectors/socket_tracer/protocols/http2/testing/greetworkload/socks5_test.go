@@ -0,0 +1,173 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+func startSOCKS5Proxy(t *testing.T, opts *greetworkload.SOCKS5ProxyOptions) *greetworkload.SOCKS5Proxy {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	p := greetworkload.NewSOCKS5Proxy(lis, opts)
+	go func() { _ = p.Serve() }()
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func newSOCKS5Client(t *testing.T, opts *greetworkload.SOCKS5Options) *greetworkload.Client {
+	d, err := greetworkload.NewSOCKS5Dialer(opts)
+	require.NoError(t, err)
+	return greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, SOCKS5: d})
+}
+
+func TestSOCKS5Dialer_Calls(t *testing.T) {
+	_, addr := startServer(t, nil)
+	proxy := startSOCKS5Proxy(t, &greetworkload.SOCKS5ProxyOptions{Username: "pixie", Password: "s3cret"})
+
+	for _, opts := range []*greetworkload.SOCKS5Options{
+		{Address: proxy.Addr(), Username: "pixie", Password: "s3cret"},
+		{Address: proxy.Addr(), Username: "pixie", Password: "s3cret", ConnectTimeout: time.Second, Dial: (&greetworkload.SocketOptions{}).Dial},
+	} {
+		before := proxy.Connects()
+		c := newSOCKS5Client(t, opts)
+		conn, err := c.Dial(addr)
+		require.NoError(t, err)
+		r := c.SayHello(conn, "pixie")
+		require.NoError(t, r.Err())
+		r = c.ServerStreaming(conn, "pixie")
+		require.NoError(t, r.Err())
+		conn.Close()
+		assert.Equal(t, before+1, proxy.Connects())
+	}
+}
+
+func TestSOCKS5Dialer_NoAuthentication(t *testing.T) {
+	_, addr := startServer(t, nil)
+	proxy := startSOCKS5Proxy(t, nil)
+
+	c := newSOCKS5Client(t, &greetworkload.SOCKS5Options{Address: proxy.Addr()})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, c.SayHello(conn, "pixie").Err())
+	assert.Equal(t, int64(1), proxy.Connects())
+}
+
+func TestSOCKS5Dialer_Refused(t *testing.T) {
+	_, addr := startServer(t, nil)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedAddr := lis.Addr().String()
+	lis.Close()
+	proxy := startSOCKS5Proxy(t, &greetworkload.SOCKS5ProxyOptions{Username: "pixie", Password: "s3cret"})
+
+	tests := []struct {
+		name   string
+		opts   *greetworkload.SOCKS5Options
+		target string
+		step   string
+		code   byte
+	}{
+		{"wrong password", &greetworkload.SOCKS5Options{Address: proxy.Addr(), Username: "pixie", Password: "wrong"}, addr, greetworkload.SOCKS5StepAuth, 0x01},
+		{"wrong username", &greetworkload.SOCKS5Options{Address: proxy.Addr(), Username: "eve", Password: "s3cret"}, addr, greetworkload.SOCKS5StepAuth, 0x01},
+		{"no credentials", &greetworkload.SOCKS5Options{Address: proxy.Addr()}, addr, greetworkload.SOCKS5StepMethod, 0xff},
+		{"target refuses", &greetworkload.SOCKS5Options{Address: proxy.Addr(), Username: "pixie", Password: "s3cret"}, closedAddr, greetworkload.SOCKS5StepConnect, greetworkload.SOCKS5ConnectionRefused},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newSOCKS5Client(t, tc.opts)
+			start := time.Now()
+			_, err := c.Dial(tc.target, grpc.WithBlock(), grpc.FailOnNonTempDialError(true))
+			require.Error(t, err)
+			assert.Less(t, time.Since(start), 2*time.Second, "refusals are not retried")
+			assert.ErrorIs(t, err, greetworkload.ErrDialFailed)
+			assert.Equal(t, greetworkload.ExitDialFailed, greetworkload.ExitCode(err))
+			var socksErr *greetworkload.SOCKS5Error
+			require.True(t, errors.As(err, &socksErr), err)
+			assert.Equal(t, &greetworkload.SOCKS5Error{Proxy: proxy.Addr(), Target: tc.target, Step: tc.step, Code: tc.code}, socksErr)
+
+			// Without blocking, the calls fail instead.
+			conn, err := c.Dial(tc.target)
+			require.NoError(t, err)
+			defer conn.Close()
+			r := c.SayHello(conn, "pixie")
+			assert.Equal(t, codes.Unavailable.String(), r.Code)
+			assert.Contains(t, r.Error, socksErr.Error())
+		})
+	}
+	assert.Zero(t, proxy.Connects())
+	assert.Contains(t, (&greetworkload.SOCKS5Error{Step: greetworkload.SOCKS5StepConnect, Code: greetworkload.SOCKS5ConnectionRefused}).Error(), "connection refused")
+}
+
+func TestSOCKS5Dialer_ConnectTimeout(t *testing.T) {
+	// A proxy that never answers the handshake.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	d, err := greetworkload.NewSOCKS5Dialer(&greetworkload.SOCKS5Options{Address: lis.Addr().String(), ConnectTimeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+	start := time.Now()
+	_, err = d.Dial(context.Background(), "127.0.0.1:1")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	// Without a ConnectTimeout, the deadline of the dial applies.
+	d, err = greetworkload.NewSOCKS5Dialer(&greetworkload.SOCKS5Options{Address: lis.Addr().String()})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = d.Dial(ctx, "127.0.0.1:1")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestNewSOCKS5Dialer_Invalid(t *testing.T) {
+	for _, opts := range []*greetworkload.SOCKS5Options{
+		{},
+		{Address: "localhost"},
+		{Address: "localhost:1080", Password: "s3cret"},
+		{Address: "localhost:1080", Username: strings.Repeat("u", 256)},
+		{Address: "localhost:1080", ConnectTimeout: -time.Second},
+	} {
+		_, err := greetworkload.NewSOCKS5Dialer(opts)
+		assert.ErrorIs(t, err, greetworkload.ErrBadFlagCombination, "%+v", opts)
+	}
+}
@@ -0,0 +1,249 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// SOCKS5ProxyOptions configure a SOCKS5Proxy.
+type SOCKS5ProxyOptions struct {
+	// Username and Password are the credentials clients must authenticate with, if Username is not
+	// empty. Otherwise, clients must offer no authentication.
+	Username string
+	Password string
+}
+
+// SOCKS5Proxy is a SOCKS5 proxy with just enough of RFC 1928 and RFC 1929 to test clients that
+// dial through one, such as those of a SOCKS5Dialer: it only serves CONNECT, and relays the bytes
+// of every connection it sets up until either side closes it.
+type SOCKS5Proxy struct {
+	opts *SOCKS5ProxyOptions
+	lis  net.Listener
+
+	connects int64
+	wg       sync.WaitGroup
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// NewSOCKS5Proxy creates a SOCKS5Proxy serving lis. A nil opts requires no authentication.
+func NewSOCKS5Proxy(lis net.Listener, opts *SOCKS5ProxyOptions) *SOCKS5Proxy {
+	if opts == nil {
+		opts = &SOCKS5ProxyOptions{}
+	}
+	return &SOCKS5Proxy{opts: opts, lis: lis, conns: make(map[net.Conn]struct{})}
+}
+
+// Addr returns the address the proxy listens on.
+func (p *SOCKS5Proxy) Addr() string {
+	return p.lis.Addr().String()
+}
+
+// Connects returns the number of connections the proxy set up so far.
+func (p *SOCKS5Proxy) Connects() int64 {
+	return atomic.LoadInt64(&p.connects)
+}
+
+// Serve serves the listener until Close, and then returns nil.
+func (p *SOCKS5Proxy) Serve() error {
+	for {
+		conn, err := p.lis.Accept()
+		if err != nil {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if p.closed {
+				return nil
+			}
+			return err
+		}
+		if !p.track(conn) {
+			return nil
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer p.untrack(conn)
+			p.serveConn(conn)
+		}()
+	}
+}
+
+// Close stops serving, closes every connection, and waits for them to be done with.
+func (p *SOCKS5Proxy) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.mu.Unlock()
+	err := p.lis.Close()
+	p.wg.Wait()
+	return err
+}
+
+// track keeps conn to be closed by Close, or closes it and returns false if the proxy is closed.
+func (p *SOCKS5Proxy) track(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		conn.Close()
+		return false
+	}
+	p.conns[conn] = struct{}{}
+	return true
+}
+
+func (p *SOCKS5Proxy) untrack(conn net.Conn) {
+	conn.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, conn)
+}
+
+// serveConn answers the handshake of a client, and relays its connection. Clients that break the
+// protocol are hung up on.
+func (p *SOCKS5Proxy) serveConn(conn net.Conn) {
+	var head [2]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil || head[0] != socks5Version {
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	method := byte(socks5MethodNone)
+	if p.opts.Username != "" {
+		method = socks5MethodPasswd
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == method
+	}
+	if !offered {
+		conn.Write([]byte{socks5Version, socks5NoMethod})
+		return
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return
+	}
+	if method == socks5MethodPasswd {
+		username, password, err := readSOCKS5Credentials(conn)
+		if err != nil {
+			return
+		}
+		if username != p.opts.Username || password != p.opts.Password {
+			conn.Write([]byte{socks5AuthVersion, 0x01})
+			return
+		}
+		if _, err := conn.Write([]byte{socks5AuthVersion, 0}); err != nil {
+			return
+		}
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil || req[0] != socks5Version {
+		return
+	}
+	target, err := readSOCKS5Addr(conn, req[3])
+	if err != nil {
+		p.reply(conn, SOCKS5AddressNotSupported, nil)
+		return
+	}
+	if req[1] != socks5CmdConnect {
+		p.reply(conn, SOCKS5CommandNotSupported, nil)
+		return
+	}
+	upstream, err := (&net.Dialer{}).DialContext(context.Background(), "tcp", target)
+	if err != nil {
+		code := byte(SOCKS5GeneralFailure)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			code = SOCKS5ConnectionRefused
+		}
+		p.reply(conn, code, nil)
+		return
+	}
+	if !p.track(upstream) {
+		return
+	}
+	defer p.untrack(upstream)
+	if err := p.reply(conn, SOCKS5Succeeded, upstream.LocalAddr().(*net.TCPAddr)); err != nil {
+		return
+	}
+	atomic.AddInt64(&p.connects, 1)
+
+	// Each direction is closed once the other is done with, so that both copies return.
+	done := make(chan struct{}, 2)
+	relay := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		dst.Close()
+		src.Close()
+		done <- struct{}{}
+	}
+	go relay(upstream, conn)
+	go relay(conn, upstream)
+	<-done
+	<-done
+}
+
+// reply answers a CONNECT with code, and the address bound to connect to the target, if any.
+func (p *SOCKS5Proxy) reply(conn net.Conn, code byte, bound *net.TCPAddr) error {
+	rep := []byte{socks5Version, code, 0}
+	if bound == nil {
+		bound = &net.TCPAddr{IP: net.IPv4zero}
+	}
+	if ip4 := bound.IP.To4(); ip4 != nil {
+		rep = append(rep, socks5AddrIPv4)
+		rep = append(rep, ip4...)
+	} else {
+		rep = append(rep, socks5AddrIPv6)
+		rep = append(rep, bound.IP.To16()...)
+	}
+	rep = append(rep, byte(bound.Port>>8), byte(bound.Port))
+	_, err := conn.Write(rep)
+	return err
+}
+
+// readSOCKS5Credentials reads the username and password of an RFC 1929 request.
+func readSOCKS5Credentials(r io.Reader) (username, password string, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return "", "", err
+	}
+	if head[0] != socks5AuthVersion {
+		return "", "", errors.New("unknown socks5 authentication version")
+	}
+	// The username, and the length of the password.
+	b := make([]byte, int(head[1])+1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", "", err
+	}
+	passwd := make([]byte, b[len(b)-1])
+	if _, err := io.ReadFull(r, passwd); err != nil {
+		return "", "", err
+	}
+	return string(b[:len(b)-1]), string(passwd), nil
+}
@@ -0,0 +1,43 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// SpanTracer makes a span of every workload call made or handled through its interceptors, and
+// exports them. greetotel.Tracer makes OpenTelemetry spans; it is not part of this package so that
+// binaries built with Go releases the OpenTelemetry SDK does not support can leave it out.
+type SpanTracer interface {
+	UnaryClientInterceptor() grpc.UnaryClientInterceptor
+	StreamClientInterceptor() grpc.StreamClientInterceptor
+	UnaryServerInterceptor() grpc.UnaryServerInterceptor
+	StreamServerInterceptor() grpc.StreamServerInterceptor
+	// Shutdown exports the spans not exported yet, and stops the tracer.
+	Shutdown(ctx context.Context) error
+}
+
+// OutsideWorkload reports whether calls to method are left alone by SpanTracers, as they are by
+// the fault injector and request tracer: those to GreeterStats, GreeterFeatures, health and
+// reflection.
+func OutsideWorkload(method string) bool {
+	return outsideWorkload(method)
+}
@@ -0,0 +1,260 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto/testutils"
+)
+
+// serializingStream stands in for the gRPC server stream. Like gRPC, it serializes every reply
+// before Send returns, into a reused buffer unless keep is set.
+type serializingStream struct {
+	grpc.ServerStream
+	buf  []byte
+	keep bool
+	sent [][]byte
+	// trailer holds the trailers set by the handler.
+	trailer metadata.MD
+}
+
+func (s *serializingStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *serializingStream) SetTrailer(md metadata.MD) {
+	s.trailer = metadata.Join(s.trailer, md)
+}
+
+func (s *serializingStream) Send(reply *pb.HelloReply) error {
+	size := reply.Size()
+	if cap(s.buf) < size || s.keep {
+		s.buf = make([]byte, size)
+	}
+	s.buf = s.buf[:size]
+	if _, err := reply.MarshalToSizedBuffer(s.buf); err != nil {
+		return err
+	}
+	if s.keep {
+		s.sent = append(s.sent, s.buf)
+	}
+	return nil
+}
+
+func TestServerStreaming_ReplyContent(t *testing.T) {
+	greeter := greetworkload.NewServer(&greetworkload.ServerOptions{StreamReplyVariants: 4, InstanceID: "1"})
+	stream := &serializingStream{keep: true}
+	require.NoError(t, greeter.SayHelloServerStreaming(&pb.HelloRequest{Name: "pixie", Count: 10}, stream))
+
+	require.Len(t, stream.sent, 10)
+	for i, b := range stream.sent {
+		reply := &pb.HelloReply{}
+		require.NoError(t, reply.Unmarshal(b))
+		assert.Equal(t, fmt.Sprintf("Hello pixie #%d", i%4), reply.Message)
+		assert.Equal(t, "1", reply.InstanceId)
+	}
+}
+
+func TestServerStreaming_RepliesNotAliasedOverGRPC(t *testing.T) {
+	_, addr := startServer(t, &greetworkload.ServerOptions{StreamReplyVariants: 3, StreamReplyBytes: 32})
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := pb.NewStreamingGreeterClient(conn).SayHelloServerStreaming(ctx, &pb.HelloRequest{Name: "pixie", Count: 100})
+	require.NoError(t, err)
+	i := 0
+	summary, err := testutils.ConsumeStream(ctx, stream, &testutils.ConsumeOptions{
+		OnMessage: func(reply *pb.HelloReply) error {
+			prefix := fmt.Sprintf("Hello pixie #%d", i%3)
+			assert.Equal(t, prefix+strings.Repeat(".", 32-len(prefix)), reply.Message)
+			i++
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, testutils.StopEOF, summary.Reason)
+	assert.Equal(t, 100, summary.Messages)
+}
+
+func TestServerStreaming_DefaultReplies(t *testing.T) {
+	greeter := greetworkload.NewServer(nil)
+	stream := &serializingStream{keep: true}
+	require.NoError(t, greeter.SayHelloServerStreaming(&pb.HelloRequest{Name: "pixie"}, stream))
+
+	require.Len(t, stream.sent, 3)
+	for _, b := range stream.sent {
+		reply := &pb.HelloReply{}
+		require.NoError(t, reply.Unmarshal(b))
+		assert.Equal(t, "Hello pixie", reply.Message)
+	}
+}
+
+func TestServerStreaming_VariantsBoundedByReplies(t *testing.T) {
+	greeter := greetworkload.NewServer(&greetworkload.ServerOptions{StreamReplyVariants: pb.MaxCount})
+	req := &pb.HelloRequest{Name: "pixie", Count: 3}
+	stream := &serializingStream{}
+
+	// Only the 3 variants sent are built, rather than all of them.
+	allocs := testing.AllocsPerRun(10, func() {
+		require.NoError(t, greeter.SayHelloServerStreaming(req, stream))
+	})
+	assert.Less(t, allocs, 50.0)
+}
+
+func TestServerStreaming_CapsReplies(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		opts  *greetworkload.ServerOptions
+		count int32
+		// sent is the number of reply messages sent, and capped whether the call then failed.
+		sent   int
+		capped bool
+	}{
+		{"under the cap", &greetworkload.ServerOptions{MaxStreamReplies: 10}, 9, 9, false},
+		{"at the cap", &greetworkload.ServerOptions{MaxStreamReplies: 10}, 10, 10, false},
+		{"over the cap", &greetworkload.ServerOptions{MaxStreamReplies: 10}, 11, 10, true},
+		{"largest count", &greetworkload.ServerOptions{MaxStreamReplies: 10}, math.MaxInt32, 10, true},
+		// Every reply is split over 5 messages, of which the cap counts every one.
+		{"pieces at the cap", &greetworkload.ServerOptions{MaxStreamReplies: 10, StreamReplyBytes: 1000, ReplyFrameBytes: 256}, 2, 10, false},
+		{"pieces over the cap", &greetworkload.ServerOptions{MaxStreamReplies: 12, StreamReplyBytes: 1000, ReplyFrameBytes: 256}, 3, 12, true},
+		{"pieces of the largest count", &greetworkload.ServerOptions{MaxStreamReplies: 12, StreamReplyBytes: 1 << 20, ReplyFrameBytes: greetworkload.MinReplyFrameBytes}, math.MaxInt32, 12, true},
+		{"default cap", nil, greetworkload.DefaultMaxStreamReplies + 1, greetworkload.DefaultMaxStreamReplies, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			greeter := greetworkload.NewServer(tc.opts)
+			stream := &serializingStream{keep: true}
+			err := greeter.SayHelloServerStreaming(&pb.HelloRequest{Name: "pixie", Count: tc.count}, stream)
+			assert.Len(t, stream.sent, tc.sent)
+			if !tc.capped {
+				require.NoError(t, err)
+				assert.Empty(t, stream.trailer.Get(greetworkload.StreamRepliesSentTrailer))
+				return
+			}
+			assert.Equal(t, codes.ResourceExhausted, status.Code(err), "%v", err)
+			assert.Equal(t, []string{strconv.Itoa(tc.sent)}, stream.trailer.Get(greetworkload.StreamRepliesSentTrailer))
+		})
+	}
+}
+
+func TestServerStreaming_CappedOverGRPC(t *testing.T) {
+	const limit = 200000
+	const replyBytes = 1024
+	_, addr := startServer(t, &greetworkload.ServerOptions{MaxStreamReplies: limit, StreamReplyBytes: replyBytes})
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 30 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var trailer metadata.MD
+	stream, err := pb.NewStreamingGreeterClient(conn).SayHelloServerStreaming(ctx, &pb.HelloRequest{Name: "pixie", Count: math.MaxInt32}, grpc.Trailer(&trailer))
+	require.NoError(t, err)
+
+	// Both ends of the call share the heap, which grows with neither while about 200MB stream.
+	runtime.GC()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	base := mem.HeapAlloc
+	var peak uint64
+	i := 0
+	summary, err := testutils.ConsumeStream(ctx, stream, &testutils.ConsumeOptions{
+		OnMessage: func(*pb.HelloReply) error {
+			if i++; i%10000 == 0 {
+				runtime.ReadMemStats(&mem)
+				if mem.HeapAlloc > peak {
+					peak = mem.HeapAlloc
+				}
+			}
+			return nil
+		},
+	})
+	require.Error(t, err)
+	assert.Equal(t, codes.ResourceExhausted, summary.Status.Code())
+	assert.Equal(t, limit, summary.Messages)
+	assert.Equal(t, []string{strconv.Itoa(limit)}, trailer.Get(greetworkload.StreamRepliesSentTrailer))
+	assert.Less(t, int64(peak)-int64(base), int64(64<<20), "heap grew from %d to %d bytes", base, peak)
+}
+
+func TestServerOptions_Validate(t *testing.T) {
+	assert.NoError(t, (&greetworkload.ServerOptions{StreamReplyVariants: pb.MaxCount, StreamReplyBytes: 1024}).Validate())
+	assert.NoError(t, (&greetworkload.ServerOptions{ReplyFrameBytes: greetworkload.MinReplyFrameBytes, Checksums: true}).Validate())
+	for _, opts := range []*greetworkload.ServerOptions{
+		{StreamReplyVariants: -1},
+		{StreamReplyVariants: pb.MaxCount + 1},
+		{StreamReplyBytes: -1},
+		{MaxStreamReplies: -1},
+		{ReplyFrameBytes: greetworkload.MinReplyFrameBytes - 1},
+		{ReplyFrameBytes: greetworkload.MaxReplyFrameBytes + 1},
+		{ReplyFrameBytes: greetworkload.MinReplyFrameBytes, InstanceID: strings.Repeat("i", greetworkload.MinReplyFrameBytes)},
+	} {
+		assert.Error(t, opts.Validate(), "%+v", opts)
+	}
+}
+
+const benchStreamLen = 100000
+
+func BenchmarkServerStreaming(b *testing.B) {
+	greeter := greetworkload.NewServer(&greetworkload.ServerOptions{StreamReplyVariants: 16})
+	req := &pb.HelloRequest{Name: "pixie", Count: benchStreamLen}
+	stream := &serializingStream{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := greeter.SayHelloServerStreaming(req, stream); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkServerStreaming_FreshReplies is the baseline, which builds a new reply for every send.
+func BenchmarkServerStreaming_FreshReplies(b *testing.B) {
+	stream := &serializingStream{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < benchStreamLen; j++ {
+			reply := &pb.HelloReply{Message: fmt.Sprintf("Hello %s #%d", "pixie", j%16)}
+			if err := stream.Send(reply); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The termination styles recorded in CallRecord.Termination and ConnStats.Termination. Connections
+// closed by gRPC as usual, with a FIN in both directions, record none.
+const (
+	// TerminationReset closes the connection with a TCP RST, by setting SO_LINGER to 0, as soon as
+	// the reply is received.
+	TerminationReset = "reset"
+	// TerminationHalfClose shuts down the write side of the connection with a FIN while the replies
+	// are still being read, and closes the connection once they all are.
+	TerminationHalfClose = "half_close"
+)
+
+// halfCloseWindow is the HTTP/2 flow control window of half-closed connections. Once its write side
+// is shut down, the client can no longer grant the server more window, so replies beyond it stall.
+const halfCloseWindow = 16 << 20
+
+// terminatingConn is a connection dialed by a call that ends it in a given style.
+type terminatingConn struct {
+	*net.TCPConn
+
+	mu         sync.Mutex
+	halfClosed bool
+}
+
+// Write discards what gRPC writes once the write side is shut down, such as window updates, rather
+// than failing the connection.
+func (c *terminatingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.halfClosed {
+		return len(b), nil
+	}
+	return c.TCPConn.Write(b)
+}
+
+func (c *terminatingConn) closeWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.halfClosed = true
+	return c.TCPConn.CloseWrite()
+}
+
+// terminatingDialer dials the connection of a call that ends it in style, and keeps the last one
+// dialed so that the call can end it.
+type terminatingDialer struct {
+	style  string
+	socket *SocketOptions
+
+	mu   sync.Mutex
+	conn *terminatingConn
+}
+
+func (d *terminatingDialer) dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := d.socket.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	tcpConn := conn.(*net.TCPConn)
+	if d.style == TerminationReset {
+		if err := tcpConn.SetLinger(0); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	c := &terminatingConn{TCPConn: tcpConn}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.conn = c
+	return c, nil
+}
+
+func (d *terminatingDialer) last() *terminatingConn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.conn
+}
+
+// dialTerminating sets up a connection of its own to address, for a call that ends it in style.
+// The connection is tracked by connStats, if not nil.
+func (c *Client) dialTerminating(address, style string, connStats *ConnStatsHandler) (*grpc.ClientConn, *terminatingDialer, error) {
+	d := &terminatingDialer{style: style, socket: c.opts.Socket}
+	opts := []grpc.DialOption{grpc.WithContextDialer(d.dial)}
+	if style == TerminationHalfClose {
+		opts = append(opts, grpc.WithInitialWindowSize(halfCloseWindow), grpc.WithInitialConnWindowSize(halfCloseWindow))
+	}
+	if connStats != nil {
+		opts = append(opts, grpc.WithStatsHandler(connStats))
+	}
+	conn, err := c.Dial(address, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, d, nil
+}
+
+// SayHelloReset calls Greeter.SayHello on a new connection to address, which is reset with a TCP
+// RST as soon as the reply is received. The connection is tracked by connStats, if not nil.
+func (c *Client) SayHelloReset(address, name string, connStats *ConnStatsHandler) *CallRecord {
+	conn, d, err := c.dialTerminating(address, TerminationReset, connStats)
+	if err != nil {
+		r := newCallRecord("SayHello")
+		return c.finish(r, cancelPlan{}, status.Error(codes.Unavailable, err.Error()))
+	}
+	defer conn.Close()
+
+	r := c.SayHello(conn, name)
+	r.Termination = TerminationReset
+	if tc := d.last(); tc != nil && connStats != nil {
+		connStats.setTermination(tc.LocalAddr(), tc.RemoteAddr(), TerminationReset)
+	}
+	return r
+}
+
+// ServerStreamingHalfClose calls StreamingGreeter.SayHelloServerStreaming on a new connection to
+// address. Once the first reply is received, and so the request was sent in full, the write side
+// of the connection is shut down while the other replies are read. The connection is tracked by
+// connStats, if not nil.
+//
+// gRPC servers close a connection as soon as they read its FIN, so the server must be served from
+// a NewHalfCloseListener for the call to complete. The replies must also fit in 16MiB, the flow
+// control window the connection starts with.
+func (c *Client) ServerStreamingHalfClose(address, name string, connStats *ConnStatsHandler) *CallRecord {
+	conn, d, err := c.dialTerminating(address, TerminationHalfClose, connStats)
+	if err != nil {
+		r := newCallRecord("SayHelloServerStreaming")
+		return c.finish(r, cancelPlan{}, status.Error(codes.Unavailable, err.Error()))
+	}
+	defer conn.Close()
+
+	var closeErr error
+	r := c.serverStreaming(context.Background(), conn, name, c.opts.StreamCount, c.planServerStreamingCancel(), func() {
+		tc := d.last()
+		if closeErr = tc.closeWrite(); closeErr == nil && connStats != nil {
+			connStats.setTermination(tc.LocalAddr(), tc.RemoteAddr(), TerminationHalfClose)
+		}
+	})
+	r.Termination = TerminationHalfClose
+	if closeErr != nil && r.Completed() {
+		r = c.finish(r, cancelPlan{}, status.Errorf(codes.Internal, "failed to shut down the write side: %v", closeErr))
+	}
+	return r
+}
+
+// NewHalfCloseListener wraps lis so that the connections it accepts keep being served for up to
+// grace once the client shuts down their write side, as long as they are not closed first. gRPC
+// servers otherwise close a connection as soon as they read its FIN, cutting short the replies
+// still to be sent to a half-closed client.
+func NewHalfCloseListener(lis net.Listener, grace time.Duration) net.Listener {
+	return &halfCloseListener{Listener: lis, grace: grace}
+}
+
+type halfCloseListener struct {
+	net.Listener
+	grace time.Duration
+}
+
+func (l *halfCloseListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &halfCloseConn{Conn: conn, grace: l.grace, closed: make(chan struct{})}, nil
+}
+
+type halfCloseConn struct {
+	net.Conn
+	grace     time.Duration
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Read holds back the EOF of a half-closed connection for the grace period.
+func (c *halfCloseConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n == 0 && err == io.EOF {
+		t := time.NewTimer(c.grace)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-c.closed:
+		}
+	}
+	return n, err
+}
+
+// NetConn returns the connection accepted, so that its socket options can be read.
+func (c *halfCloseConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *halfCloseConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
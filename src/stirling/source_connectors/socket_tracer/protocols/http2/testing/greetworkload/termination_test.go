@@ -0,0 +1,100 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// startHalfCloseServer serves with a NewHalfCloseListener, observing how each connection ends
+// before the listener holds back its EOF.
+func startHalfCloseServer(t *testing.T, opts *greetworkload.ServerOptions) (*closeObserver, string) {
+	var observer *closeObserver
+	s := startServerWith(t, &serverSetup{Options: opts, Wrap: func(lis net.Listener) net.Listener {
+		observer = &closeObserver{Listener: lis}
+		return greetworkload.NewHalfCloseListener(observer, 5*time.Second)
+	}})
+	return observer, s.Addr
+}
+
+func waitForEnds(t *testing.T, observer *closeObserver, eofs, resets int64) {
+	assert.Eventually(t, func() bool {
+		e, r := observer.ends()
+		return e == eofs && r == resets
+	}, 5*time.Second, 10*time.Millisecond)
+	e, r := observer.ends()
+	assert.Equal(t, []int64{eofs, resets}, []int64{e, r}, "EOFs and resets seen by the server")
+}
+
+func TestClient_SayHelloReset(t *testing.T) {
+	observer, addr := startObservedServer(t)
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	connStats := greetworkload.NewConnStatsHandler()
+
+	r := c.SayHelloReset(addr, "pixie", connStats)
+	require.True(t, r.Completed(), r.Error)
+	assert.Equal(t, greetworkload.TerminationReset, r.Termination)
+
+	waitForEnds(t, observer, 0, 1)
+	conns := connStats.Conns()
+	require.Len(t, conns, 1)
+	assert.Equal(t, greetworkload.TerminationReset, conns[0].Termination)
+}
+
+func TestClient_ServerStreamingHalfClose(t *testing.T) {
+	observer, addr := startHalfCloseServer(t, &greetworkload.ServerOptions{StreamReplyBytes: 1024})
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, StreamCount: 1000})
+	connStats := greetworkload.NewConnStatsHandler()
+
+	r := c.ServerStreamingHalfClose(addr, "pixie", connStats)
+	require.True(t, r.Completed(), r.Error)
+	assert.Equal(t, greetworkload.TerminationHalfClose, r.Termination)
+
+	waitForEnds(t, observer, 1, 0)
+	conns := connStats.Conns()
+	require.Len(t, conns, 1)
+	assert.Equal(t, greetworkload.TerminationHalfClose, conns[0].Termination)
+	// Every reply was received, all but the first after the write side was shut down.
+	assert.Greater(t, conns[0].WireBytesIn, int64(1000*1024))
+}
+
+func TestClient_UsualCloseRecordsNoTermination(t *testing.T) {
+	observer, addr := startObservedServer(t)
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	connStats := greetworkload.NewConnStatsHandler()
+
+	conn, err := c.Dial(addr, grpc.WithStatsHandler(connStats))
+	require.NoError(t, err)
+	r := c.SayHello(conn, "pixie")
+	require.True(t, r.Completed(), r.Error)
+	conn.Close()
+
+	assert.Empty(t, r.Termination)
+	waitForEnds(t, observer, 1, 0)
+	conns := connStats.Conns()
+	require.Len(t, conns, 1)
+	assert.Empty(t, conns[0].Termination)
+}
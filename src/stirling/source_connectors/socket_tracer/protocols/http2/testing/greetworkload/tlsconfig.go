@@ -0,0 +1,110 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSVersionName returns the name of a TLS version, e.g. "1.3", as accepted by TLSOptions.
+func TLSVersionName(v uint16) string {
+	for name, version := range tlsVersions {
+		if version == v {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// TLSOptions pin the TLS versions and cipher suites a connection may negotiate.
+type TLSOptions struct {
+	// MinVersion and MaxVersion are "1.2" or "1.3". Empty leaves the crypto/tls default.
+	MinVersion string
+	MaxVersion string
+	// CipherSuites are the names of the TLS 1.2 cipher suites allowed, e.g.
+	// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". TLS 1.3 suites are not configurable.
+	CipherSuites []string
+}
+
+func parseTLSVersion(name string) (uint16, error) {
+	if name == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version %q, expected 1.2 or 1.3", name)
+	}
+	return v, nil
+}
+
+// Apply validates the options and sets them on cfg.
+func (o *TLSOptions) Apply(cfg *tls.Config) error {
+	minVersion, err := parseTLSVersion(o.MinVersion)
+	if err != nil {
+		return err
+	}
+	maxVersion, err := parseTLSVersion(o.MaxVersion)
+	if err != nil {
+		return err
+	}
+	if minVersion != 0 && maxVersion != 0 && minVersion > maxVersion {
+		return fmt.Errorf("TLS min version %s is above max version %s", o.MinVersion, o.MaxVersion)
+	}
+
+	var suites []uint16
+	if len(o.CipherSuites) > 0 {
+		if minVersion == tls.VersionTLS13 {
+			return fmt.Errorf("cipher suites cannot be configured for TLS 1.3")
+		}
+		known := make(map[string]*tls.CipherSuite)
+		for _, s := range tls.CipherSuites() {
+			known[s.Name] = s
+		}
+		for _, name := range o.CipherSuites {
+			s, ok := known[name]
+			if !ok {
+				return fmt.Errorf("unknown or insecure cipher suite %q", name)
+			}
+			if !supportsTLS12(s) {
+				return fmt.Errorf("cipher suite %q is TLS 1.3 only, and TLS 1.3 suites are not configurable", name)
+			}
+			suites = append(suites, s.ID)
+		}
+	}
+
+	cfg.MinVersion = minVersion
+	cfg.MaxVersion = maxVersion
+	cfg.CipherSuites = suites
+	return nil
+}
+
+func supportsTLS12(s *tls.CipherSuite) bool {
+	for _, v := range s.SupportedVersions {
+		if v == tls.VersionTLS12 {
+			return true
+		}
+	}
+	return false
+}
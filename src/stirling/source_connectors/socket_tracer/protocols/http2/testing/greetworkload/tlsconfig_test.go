@@ -0,0 +1,174 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// selfSignedCert creates an ECDSA certificate for localhost, so that only ECDSA cipher suites apply.
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func startTLSServer(t *testing.T, opts *greetworkload.TLSOptions) (string, *greetworkload.ConnStatsHandler) {
+	cfg := &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}}
+	require.NoError(t, opts.Apply(cfg))
+
+	connStats := greetworkload.NewConnStatsHandler()
+	s := startServerWith(t, &serverSetup{GRPC: []grpc.ServerOption{grpc.Creds(credentials.NewTLS(cfg))}, Stats: connStats})
+	return s.Addr, connStats
+}
+
+func TestTLSVersions(t *testing.T) {
+	const suite = "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"
+	tests := []struct {
+		name        string
+		server      greetworkload.TLSOptions
+		client      greetworkload.TLSOptions
+		wantVersion string
+		wantSuite   string
+		wantErr     string
+	}{
+		{
+			name:        "tls12_only",
+			server:      greetworkload.TLSOptions{MinVersion: "1.2", MaxVersion: "1.2", CipherSuites: []string{suite}},
+			client:      greetworkload.TLSOptions{MaxVersion: "1.2"},
+			wantVersion: "1.2",
+			wantSuite:   suite,
+		},
+		{
+			name:        "tls13_only",
+			server:      greetworkload.TLSOptions{MinVersion: "1.3"},
+			client:      greetworkload.TLSOptions{MinVersion: "1.3"},
+			wantVersion: "1.3",
+		},
+		{
+			name:    "server_tls13_client_tls12",
+			server:  greetworkload.TLSOptions{MinVersion: "1.3"},
+			client:  greetworkload.TLSOptions{MaxVersion: "1.2"},
+			wantErr: "protocol version",
+		},
+		{
+			name:    "no_common_cipher_suite",
+			server:  greetworkload.TLSOptions{MaxVersion: "1.2", CipherSuites: []string{suite}},
+			client:  greetworkload.TLSOptions{MaxVersion: "1.2", CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}},
+			wantErr: "handshake failure",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, serverStats := startTLSServer(t, &tc.server)
+
+			clientStats := greetworkload.NewConnStatsHandler()
+			c := greetworkload.NewClient(&greetworkload.ClientOptions{
+				HTTPS:   true,
+				TLS:     &tc.client,
+				Timeout: 10 * time.Second,
+			})
+			conn, err := c.Dial(addr, grpc.WithStatsHandler(clientStats))
+			require.NoError(t, err)
+			defer conn.Close()
+
+			r := c.SayHello(conn, "pixie")
+			if tc.wantErr != "" {
+				// A failed handshake fails the call right away, well within its deadline.
+				assert.Equal(t, "Unavailable", r.Code)
+				assert.Contains(t, r.Error, tc.wantErr)
+				assert.Less(t, time.Duration(r.DurationNS), 5*time.Second)
+				return
+			}
+			require.True(t, r.Completed(), r.Error)
+
+			for _, stats := range []*greetworkload.ConnStatsHandler{clientStats, serverStats} {
+				conns := stats.Conns()
+				require.Len(t, conns, 1)
+				assert.Equal(t, tc.wantVersion, conns[0].TLSVersion)
+				if tc.wantSuite != "" {
+					assert.Equal(t, tc.wantSuite, conns[0].TLSCipherSuite)
+				} else {
+					assert.NotEmpty(t, conns[0].TLSCipherSuite)
+				}
+			}
+		})
+	}
+}
+
+func TestTLSOptionsValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    greetworkload.TLSOptions
+		wantErr string
+	}{
+		{"unsupported_version", greetworkload.TLSOptions{MinVersion: "1.1"}, "unsupported TLS version"},
+		{"min_above_max", greetworkload.TLSOptions{MinVersion: "1.3", MaxVersion: "1.2"}, "above max version"},
+		{"suites_with_tls13_only", greetworkload.TLSOptions{MinVersion: "1.3", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}, "cannot be configured for TLS 1.3"},
+		{"unknown_suite", greetworkload.TLSOptions{CipherSuites: []string{"TLS_NOPE"}}, "unknown or insecure cipher suite"},
+		{"tls13_suite", greetworkload.TLSOptions{CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}}, "TLS 1.3 only"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.opts.Apply(&tls.Config{})
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+
+	cfg := &tls.Config{}
+	opts := greetworkload.TLSOptions{MinVersion: "1.2", MaxVersion: "1.2", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}
+	require.NoError(t, opts.Apply(cfg))
+	assert.Equal(t, uint16(tls.VersionTLS12), cfg.MinVersion)
+	assert.Equal(t, uint16(tls.VersionTLS12), cfg.MaxVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, cfg.CipherSuites)
+}
+
+func TestDialRejectsInvalidTLSOptions(t *testing.T) {
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{
+		HTTPS: true,
+		TLS:   &greetworkload.TLSOptions{MinVersion: "1.3", MaxVersion: "1.2"},
+	})
+	_, err := c.Dial("localhost:1")
+	assert.Error(t, err)
+}
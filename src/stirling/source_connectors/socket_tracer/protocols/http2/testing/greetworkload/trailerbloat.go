@@ -0,0 +1,221 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// TrailerBloatKey is the key of the trailer entries a TrailerBloat adds to the replies of a server.
+	TrailerBloatKey = "x-bloat"
+	// MaxTrailerBloatHeaderListSize is the largest TrailerBloatOptions.HeaderListSize. gRPC clients
+	// accept header lists of up to 16MB by default, and 4KB are left for the rest of the trailer.
+	MaxTrailerBloatHeaderListSize = 16<<20 - 4<<10
+)
+
+// TrailerBloatValues returns the count entries of size bytes sent in the trailer of the call with
+// the request ID requestID. They are hex digits, drawn from the SHA-256 of the request ID, the
+// index of the entry and the index of the block, so that the client can tell every byte is where
+// it should be.
+func TrailerBloatValues(requestID string, count, size int) []string {
+	values := make([]string, count)
+	var n [16]byte
+	for i := range values {
+		v := make([]byte, 0, size+sha256.Size*2)
+		for block := 0; len(v) < size; block++ {
+			binary.BigEndian.PutUint64(n[:8], uint64(i))
+			binary.BigEndian.PutUint64(n[8:], uint64(block))
+			sum := sha256.Sum256(append([]byte(requestID), n[:]...))
+			v = append(v, hex.EncodeToString(sum[:])...)
+		}
+		values[i] = string(v[:size])
+	}
+	return values
+}
+
+// TrailerBloatOptions configure the trailer entries of a TrailerBloat.
+type TrailerBloatOptions struct {
+	// Count is the number of entries in the trailer of every call.
+	Count int
+	// Size is the number of bytes of every entry.
+	Size int
+}
+
+// HeaderListSize returns the size the entries add to the trailer of a call, as HTTP/2
+// SETTINGS_MAX_HEADER_LIST_SIZE counts it: the value and the key of every entry, plus 32 bytes of
+// overhead each.
+func (o *TrailerBloatOptions) HeaderListSize() int {
+	return o.Count * (len(TrailerBloatKey) + o.Size + 32)
+}
+
+// Validate checks that the options are usable, and that the entries fit the header lists gRPC
+// clients accept by default.
+func (o *TrailerBloatOptions) Validate() error {
+	if o.Count <= 0 || o.Size <= 0 {
+		return badFlagsf("trailer bloat needs a positive count and size, got %d entries of %d bytes", o.Count, o.Size)
+	}
+	if n := o.HeaderListSize(); n > MaxTrailerBloatHeaderListSize {
+		return badFlagsf("%d trailer entries of %d bytes make a %d byte header list, over the %d bytes allowed", o.Count, o.Size, n, MaxTrailerBloatHeaderListSize)
+	}
+	return nil
+}
+
+// TrailerBloat adds entries of TrailerBloatKey to the trailer of the calls a server handles through
+// its server interceptors, and checks them on the calls a client makes through its client
+// interceptors, apart from those to GreeterStats, GreeterFeatures, health and reflection. The
+// entries are drawn from the RequestIDHeader of the call, see TrailerBloatValues. Calls whose
+// trailer does not hold them intact fail with DataLoss on the client.
+type TrailerBloat struct {
+	opts *TrailerBloatOptions
+
+	verified   int64
+	mismatches int64
+}
+
+// NewTrailerBloat creates a TrailerBloat of the entries opts describe.
+func NewTrailerBloat(opts *TrailerBloatOptions) (*TrailerBloat, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return &TrailerBloat{opts: opts}, nil
+}
+
+// Verified returns the number of calls whose trailer the client received intact.
+func (b *TrailerBloat) Verified() int64 {
+	return atomic.LoadInt64(&b.verified)
+}
+
+// Mismatches returns the number of calls whose trailer the client did not receive intact.
+func (b *TrailerBloat) Mismatches() int64 {
+	return atomic.LoadInt64(&b.mismatches)
+}
+
+func (b *TrailerBloat) trailer(md metadata.MD) metadata.MD {
+	var requestID string
+	if v := md.Get(RequestIDHeader); len(v) > 0 {
+		requestID = v[0]
+	}
+	return metadata.MD{TrailerBloatKey: TrailerBloatValues(requestID, b.opts.Count, b.opts.Size)}
+}
+
+// check checks the trailer of a call made in ctx, returning a DataLoss error if the entries did
+// not make it intact.
+func (b *TrailerBloat) check(ctx context.Context, trailer metadata.MD) error {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	want := b.trailer(md).Get(TrailerBloatKey)
+	got := trailer.Get(TrailerBloatKey)
+	if len(got) != len(want) {
+		atomic.AddInt64(&b.mismatches, 1)
+		return status.Errorf(codes.DataLoss, "received %d trailer entries, expected %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			atomic.AddInt64(&b.mismatches, 1)
+			return status.Errorf(codes.DataLoss, "trailer entry #%d of %d bytes does not match the %d bytes expected", i, len(got[i]), len(want[i]))
+		}
+	}
+	atomic.AddInt64(&b.verified, 1)
+	return nil
+}
+
+// UnaryServerInterceptor adds the entries to the trailer of unary calls.
+func (b *TrailerBloat) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if outsideWorkload(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		if err := grpc.SetTrailer(ctx, b.trailer(md)); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor adds the entries to the trailer of streaming calls.
+func (b *TrailerBloat) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if outsideWorkload(info.FullMethod) {
+			return handler(srv, ss)
+		}
+		md, _ := metadata.FromIncomingContext(ss.Context())
+		ss.SetTrailer(b.trailer(md))
+		return handler(srv, ss)
+	}
+}
+
+// UnaryClientInterceptor returns an interceptor that checks the trailer of unary calls that
+// complete.
+func (b *TrailerBloat) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if outsideWorkload(method) {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		var trailer metadata.MD
+		opts = append(opts, grpc.Trailer(&trailer))
+		if err := invoker(ctx, method, req, reply, cc, opts...); err != nil {
+			return err
+		}
+		return b.check(ctx, trailer)
+	}
+}
+
+// StreamClientInterceptor returns an interceptor that checks the trailer of streaming calls once
+// the client reads the end of the stream, or the only reply of a client-streaming call.
+func (b *TrailerBloat) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if outsideWorkload(method) {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return &trailerBloatStream{ClientStream: cs, ctx: ctx, b: b, serverStreams: desc.ServerStreams}, nil
+	}
+}
+
+type trailerBloatStream struct {
+	grpc.ClientStream
+	ctx context.Context
+	b   *TrailerBloat
+	// serverStreams is set if the server may send several replies. Otherwise the stream ends with
+	// the only one, and gRPC reads the end of the stream itself.
+	serverStreams bool
+}
+
+func (s *trailerBloatStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == io.EOF || (err == nil && !s.serverStreams) {
+		if checkErr := s.b.check(s.ctx, s.ClientStream.Trailer()); checkErr != nil {
+			return checkErr
+		}
+	}
+	return err
+}
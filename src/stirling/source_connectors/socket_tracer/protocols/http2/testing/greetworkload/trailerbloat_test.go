@@ -0,0 +1,139 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// startTrailerBloatServer starts a server that adds the trailer entries of opts to every call.
+func startTrailerBloatServer(t *testing.T, opts *greetworkload.TrailerBloatOptions) string {
+	b := newTrailerBloat(t, opts)
+	return startServerWith(t, &serverSetup{GRPC: []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(b.UnaryServerInterceptor()), grpc.ChainStreamInterceptor(b.StreamServerInterceptor()),
+	}}).Addr
+}
+
+func newTrailerBloat(t *testing.T, opts *greetworkload.TrailerBloatOptions) *greetworkload.TrailerBloat {
+	b, err := greetworkload.NewTrailerBloat(opts)
+	require.NoError(t, err)
+	return b
+}
+
+func dialTrailerBloat(t *testing.T, addr string, opts *greetworkload.ClientOptions) (*greetworkload.Client, *grpc.ClientConn) {
+	c := greetworkload.NewClient(opts)
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return c, conn
+}
+
+func TestTrailerBloat_Intact(t *testing.T) {
+	opts := &greetworkload.TrailerBloatOptions{Count: 8, Size: 1 << 10}
+	addr := startTrailerBloatServer(t, opts)
+	b := newTrailerBloat(t, opts)
+	c, conn := dialTrailerBloat(t, addr, &greetworkload.ClientOptions{Timeout: 5 * time.Second, TrailerBloat: b})
+	for _, r := range []*greetworkload.CallRecord{
+		c.SayHello(conn, "pixie"),
+		c.ServerStreaming(conn, "pixie"),
+		c.ClientStreaming(conn, []string{"a", "b"}),
+		c.BidirStreaming(conn, []string{"a", "b"}),
+	} {
+		require.True(t, r.Completed(), "%s: %s", r.Method, r.Error)
+	}
+	assert.EqualValues(t, 4, b.Verified())
+	assert.Zero(t, b.Mismatches())
+}
+
+func TestTrailerBloat_Largest(t *testing.T) {
+	// The largest entries 64 of them can be, just within the limit.
+	opts := &greetworkload.TrailerBloatOptions{Count: 64}
+	opts.Size = greetworkload.MaxTrailerBloatHeaderListSize/opts.Count - len(greetworkload.TrailerBloatKey) - 32
+	require.NoError(t, opts.Validate())
+	assert.Error(t, (&greetworkload.TrailerBloatOptions{Count: opts.Count, Size: opts.Size + 1}).Validate())
+
+	addr := startTrailerBloatServer(t, opts)
+	b := newTrailerBloat(t, opts)
+	c, conn := dialTrailerBloat(t, addr, &greetworkload.ClientOptions{Timeout: 30 * time.Second, TrailerBloat: b})
+	for _, r := range []*greetworkload.CallRecord{c.SayHello(conn, "pixie"), c.ServerStreaming(conn, "pixie")} {
+		require.True(t, r.Completed(), "%s: %s", r.Method, r.Error)
+	}
+	assert.EqualValues(t, 2, b.Verified())
+}
+
+func TestTrailerBloat_ClientLimit(t *testing.T) {
+	opts := &greetworkload.TrailerBloatOptions{Count: 4, Size: 32 << 10}
+	require.Greater(t, opts.HeaderListSize(), 64<<10)
+	addr := startTrailerBloatServer(t, opts)
+	b := newTrailerBloat(t, opts)
+	c, conn := dialTrailerBloat(t, addr, &greetworkload.ClientOptions{
+		Timeout:      5 * time.Second,
+		TrailerBloat: b,
+		HTTP2:        &greetworkload.HTTP2Settings{MaxHeaderListSize: 64 << 10},
+	})
+
+	// The server gives up on sending the trailer, and resets the stream, rather than cutting it
+	// short.
+	for _, r := range []*greetworkload.CallRecord{c.SayHello(conn, "pixie"), c.ServerStreaming(conn, "pixie")} {
+		assert.Equal(t, codes.Internal.String(), r.Code, "%s: %s", r.Method, r.Error)
+	}
+	assert.Zero(t, b.Verified())
+	assert.Zero(t, b.Mismatches())
+}
+
+func TestTrailerBloat_Mismatch(t *testing.T) {
+	addr := startTrailerBloatServer(t, &greetworkload.TrailerBloatOptions{Count: 2, Size: 100})
+	for _, opts := range []*greetworkload.TrailerBloatOptions{{Count: 3, Size: 100}, {Count: 2, Size: 101}} {
+		b := newTrailerBloat(t, opts)
+		c, conn := dialTrailerBloat(t, addr, &greetworkload.ClientOptions{Timeout: 5 * time.Second, TrailerBloat: b})
+		r := c.SayHello(conn, "pixie")
+		assert.Equal(t, codes.DataLoss.String(), r.Code, "%+v: %s", opts, r.Error)
+		assert.EqualValues(t, 1, b.Mismatches())
+	}
+}
+
+func TestTrailerBloatValues(t *testing.T) {
+	values := greetworkload.TrailerBloatValues("abc", 3, 100)
+	require.Len(t, values, 3)
+	for _, v := range values {
+		assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{100}$`), v)
+	}
+	assert.NotEqual(t, values[0], values[1])
+	assert.Equal(t, values, greetworkload.TrailerBloatValues("abc", 3, 100))
+	assert.NotEqual(t, values, greetworkload.TrailerBloatValues("abd", 3, 100))
+	// Shorter entries are prefixes of longer ones.
+	assert.Equal(t, values[2][:10], greetworkload.TrailerBloatValues("abc", 3, 10)[2])
+}
+
+func TestTrailerBloatOptions_Validate(t *testing.T) {
+	assert.EqualValues(t, 3*(len(greetworkload.TrailerBloatKey)+10+32), (&greetworkload.TrailerBloatOptions{Count: 3, Size: 10}).HeaderListSize())
+	for _, opts := range []*greetworkload.TrailerBloatOptions{{Count: 0, Size: 1}, {Count: 1, Size: 0}, {Count: 1, Size: 16 << 20}} {
+		_, err := greetworkload.NewTrailerBloat(opts)
+		assert.True(t, errors.Is(err, greetworkload.ErrBadFlagCombination), "%+v: %v", opts, err)
+	}
+}
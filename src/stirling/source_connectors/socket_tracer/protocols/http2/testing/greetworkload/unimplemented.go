@@ -0,0 +1,76 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// UnknownMethod is a method of Greeter that no server implements.
+const UnknownMethod = "/" + GreeterService + "/SayGoodbye"
+
+// The ways CallUnimplemented provokes Unimplemented.
+const (
+	// UnimplementedMethod calls UnknownMethod, on a service the server registers.
+	UnimplementedMethod = "method"
+	// UnimplementedService calls Greeter2.SayHi, which the server must leave unregistered.
+	UnimplementedService = "service"
+)
+
+// CheckUnimplementedMode returns an error if mode is not one of the Unimplemented constants.
+func CheckUnimplementedMode(mode string) error {
+	switch mode {
+	case UnimplementedMethod, UnimplementedService:
+		return nil
+	}
+	return fmt.Errorf("unknown unimplemented mode %q, must be %s or %s", mode, UnimplementedMethod, UnimplementedService)
+}
+
+// CallUnimplemented makes a unary call over conn that the server is expected to answer with
+// Unimplemented, in the given mode, and records it with that expected code. See CallRecord.Expected.
+func (c *Client) CallUnimplemented(conn *grpc.ClientConn, mode, name string) *CallRecord {
+	method := UnknownMethod
+	if mode == UnimplementedService {
+		method = pb.Greeter2_SayHi_FullMethodName
+	}
+	r := newCallRecord(methodName(method))
+	r.ExpectedCode = codes.Unimplemented.String()
+	if err := CheckUnimplementedMode(mode); err != nil {
+		return c.finish(r, cancelPlan{}, status.Error(codes.InvalidArgument, err.Error()))
+	}
+
+	ctx, cancel := c.callContext()
+	defer cancel()
+	ctx = withRequestID(ctx, r)
+
+	var trailer metadata.MD
+	reply := &pb.HelloReply{}
+	err := conn.Invoke(ctx, method, &pb.HelloRequest{Name: name}, reply, grpc.Trailer(&trailer), withRecord(r))
+	setAttempt(r, trailer)
+	if err == nil {
+		r.InstanceID = reply.InstanceId
+	}
+	return c.finish(r, cancelPlan{}, err)
+}
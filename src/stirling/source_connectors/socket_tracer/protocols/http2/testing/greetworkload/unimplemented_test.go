@@ -0,0 +1,104 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// startGreeterOnlyServer starts a server that only registers Greeter, like go_grpc_server run with
+// --greeter_only.
+func startGreeterOnlyServer(t *testing.T) string {
+	return startServerWith(t, &serverSetup{Register: func(s *grpc.Server, greeter *greetworkload.Server) {
+		pb.RegisterGreeterServer(s, greeter)
+	}}).Addr
+}
+
+func TestCallUnimplemented(t *testing.T) {
+	addr := startGreeterOnlyServer(t)
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for mode, method := range map[string]string{
+		greetworkload.UnimplementedMethod:  "SayGoodbye",
+		greetworkload.UnimplementedService: "SayHi",
+	} {
+		r := c.CallUnimplemented(conn, mode, "pixie")
+		assert.Equal(t, method, r.Method, mode)
+		assert.Equal(t, codes.Unimplemented.String(), r.Code, mode)
+		assert.Equal(t, codes.Unimplemented.String(), r.ExpectedCode, mode)
+		assert.True(t, r.Expected(), mode)
+		assert.False(t, r.Completed(), mode)
+		assert.Empty(t, r.InstanceID, mode)
+	}
+}
+
+func TestCallUnimplemented_RegisteredServiceIsUnexpected(t *testing.T) {
+	_, addr := startServer(t, &greetworkload.ServerOptions{InstanceID: "a"})
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Greeter2 is registered, so the call completes, which is not what it was made for.
+	r := c.CallUnimplemented(conn, greetworkload.UnimplementedService, "pixie")
+	assert.True(t, r.Completed(), r.Error)
+	assert.False(t, r.Expected())
+	assert.Equal(t, "a", r.InstanceID)
+
+	r = c.CallUnimplemented(conn, "bogus", "pixie")
+	assert.Equal(t, codes.InvalidArgument.String(), r.Code)
+	assert.False(t, r.Expected())
+}
+
+func TestUnknownMethod_EmptyReply(t *testing.T) {
+	addr := startGreeterOnlyServer(t)
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, method := range []string{greetworkload.UnknownMethod, "/" + greetworkload.Greeter2Service + "/SayHi"} {
+		reply := &pb.HelloReply{}
+		err := conn.Invoke(ctx, method, &pb.HelloRequest{Name: "pixie"}, reply)
+		assert.Equal(t, codes.Unimplemented, status.Code(err), method)
+		assert.Zero(t, reply.Size(), method)
+	}
+}
+
+func TestCheckUnimplementedMode(t *testing.T) {
+	assert.NoError(t, greetworkload.CheckUnimplementedMode(greetworkload.UnimplementedMethod))
+	assert.NoError(t, greetworkload.CheckUnimplementedMode(greetworkload.UnimplementedService))
+	assert.Error(t, greetworkload.CheckUnimplementedMode(""))
+	assert.Error(t, greetworkload.CheckUnimplementedMode("stream"))
+}
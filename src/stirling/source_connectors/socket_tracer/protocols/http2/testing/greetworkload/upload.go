@@ -0,0 +1,153 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"google.golang.org/grpc"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// UploadName is the name of the requests of an upload. Servers count the payload bytes of every
+// request of a client streaming call, but leave the names of an upload out of the reply.
+const UploadName = "upload"
+
+// UploadOptions configure an upload, a client streaming call that sends payloads as fast as flow
+// control lets it, to saturate the client to server direction.
+type UploadOptions struct {
+	// MessageSize is the payload size of each request. It must stay under the maximum message
+	// size of the server, 4MB by default.
+	MessageSize int
+	// Duration is how long requests are sent for. Zero sends until Bytes are sent.
+	Duration time.Duration
+	// Bytes is how many payload bytes are sent, the last request being cut short to match.
+	// Zero sends until Duration is over.
+	Bytes int64
+}
+
+// Validate checks that the options are usable.
+func (o *UploadOptions) Validate() error {
+	if o.MessageSize < 1 {
+		return badFlagsf("the upload message size must be positive, got %d", o.MessageSize)
+	}
+	if o.Duration < 0 || o.Bytes < 0 {
+		return badFlagsf("the upload duration and bytes must not be negative, got %v and %d", o.Duration, o.Bytes)
+	}
+	if o.Duration == 0 && o.Bytes == 0 {
+		return badFlagsf("an upload needs a duration or a number of bytes")
+	}
+	return nil
+}
+
+// UploadResult is what an upload sent, and what the server says it received.
+type UploadResult struct {
+	Messages  int64 `json:"messages"`
+	BytesSent int64 `json:"bytes_sent"`
+	// BytesReceived is the count of the server, -1 if the call did not complete.
+	BytesReceived int64         `json:"bytes_received"`
+	Elapsed       time.Duration `json:"elapsed_ns"`
+}
+
+// MBPerSecond is the throughput of the upload, in megabytes of payload a second.
+func (u *UploadResult) MBPerSecond() float64 {
+	if u.Elapsed <= 0 {
+		return 0
+	}
+	return float64(u.BytesSent) / 1e6 / u.Elapsed.Seconds()
+}
+
+// Reconciled reports whether the server received every byte that was sent.
+func (u *UploadResult) Reconciled() bool {
+	return u.BytesReceived == u.BytesSent
+}
+
+// String summarizes the upload on one line.
+func (u *UploadResult) String() string {
+	return fmt.Sprintf("sent %d bytes in %d messages over %v (%.1f MB/s), the server received %d bytes",
+		u.BytesSent, u.Messages, u.Elapsed, u.MBPerSecond(), u.BytesReceived)
+}
+
+// Upload calls StreamingGreeter.SayHelloClientStreaming over conn, sending requests of
+// opts.MessageSize until opts.Duration is over or opts.Bytes are sent. The call is not bound by
+// ClientOptions.Timeout; cancelling ctx ends it early, with the result of what was sent so far.
+func (c *Client) Upload(ctx context.Context, conn *grpc.ClientConn, opts *UploadOptions) (*CallRecord, *UploadResult) {
+	r := newCallRecord("SayHelloClientStreaming")
+	result := &UploadResult{BytesReceived: -1}
+	if err := opts.Validate(); err != nil {
+		return c.finish(r, cancelPlan{}, err), result
+	}
+
+	ctx = c.opts.Audit.root(ctx)
+	callCtx, cancel := context.WithCancel(ctx)
+	cancel = c.opts.Audit.track(ctx, callCtx, cancel)
+	defer cancel()
+	ctx = withRequestID(callCtx, r)
+
+	finish := func(err error) (*CallRecord, *UploadResult) {
+		c.finish(r, cancelPlan{}, err)
+		r.Cancelled = isClientCancel(err) && ctx.Err() != nil
+		return r, result
+	}
+
+	stream, err := pb.NewStreamingGreeterClient(conn).SayHelloClientStreaming(ctx, withRecord(r))
+	if err != nil {
+		return finish(err)
+	}
+	payload := make([]byte, opts.MessageSize)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	var deadline time.Time
+	if opts.Duration > 0 {
+		deadline = r.StartTime.Add(opts.Duration)
+	}
+	for opts.Bytes == 0 || result.BytesSent < opts.Bytes {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			break
+		}
+		n := int64(len(payload))
+		if opts.Bytes > 0 && opts.Bytes-result.BytesSent < n {
+			n = opts.Bytes - result.BytesSent
+		}
+		if err := stream.Send(&pb.HelloRequest{Name: UploadName, Payload: payload[:n]}); err != nil {
+			if err == io.EOF {
+				break
+			}
+			result.Elapsed = time.Since(r.StartTime)
+			return finish(err)
+		}
+		result.Messages++
+		result.BytesSent += n
+	}
+	reply, err := stream.CloseAndRecv()
+	result.Elapsed = time.Since(r.StartTime)
+	setAttempt(r, stream.Trailer())
+	if err == nil {
+		result.BytesReceived = reply.BytesReceived
+		log.Printf("Upload %s request_id=%s", result, r.RequestID)
+		r.InstanceID = reply.InstanceId
+		c.verifyReply(r, 0, reply)
+	}
+	return finish(err)
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+func TestUploadOptions_Validate(t *testing.T) {
+	assert.NoError(t, (&greetworkload.UploadOptions{MessageSize: 1, Bytes: 1}).Validate())
+	assert.NoError(t, (&greetworkload.UploadOptions{MessageSize: 1, Duration: time.Second}).Validate())
+	for _, opts := range []*greetworkload.UploadOptions{
+		{Bytes: 1},
+		{MessageSize: 1},
+		{MessageSize: 1, Bytes: -1},
+		{MessageSize: 1, Duration: -time.Second},
+	} {
+		err := opts.Validate()
+		assert.True(t, errors.Is(err, greetworkload.ErrBadFlagCombination), "%+v: %v", opts, err)
+	}
+}
+
+func TestUpload_Bytes(t *testing.T) {
+	c, conn := dialHeartbeats(t, &greetworkload.ServerOptions{})
+	const bytes = 100 << 20
+	r, result := c.Upload(context.Background(), conn, &greetworkload.UploadOptions{MessageSize: 1 << 20, Bytes: bytes - 1})
+	require.True(t, r.Completed(), r.Error)
+	assert.EqualValues(t, 100, result.Messages)
+	assert.EqualValues(t, bytes-1, result.BytesSent)
+	assert.True(t, result.Reconciled(), "%s", result)
+	assert.Greater(t, result.MBPerSecond(), 0.0)
+}
+
+func TestUpload_Duration(t *testing.T) {
+	c, conn := dialHeartbeats(t, &greetworkload.ServerOptions{})
+	r, result := c.Upload(context.Background(), conn, &greetworkload.UploadOptions{MessageSize: 64 << 10, Duration: 200 * time.Millisecond})
+	require.True(t, r.Completed(), r.Error)
+	assert.GreaterOrEqual(t, result.Elapsed, 200*time.Millisecond)
+	assert.Greater(t, result.Messages, int64(0))
+	assert.True(t, result.Reconciled(), "%s", result)
+}
+
+func TestUpload_Cancelled(t *testing.T) {
+	c, conn := dialHeartbeats(t, &greetworkload.ServerOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(200*time.Millisecond, cancel)
+	r, result := c.Upload(ctx, conn, &greetworkload.UploadOptions{MessageSize: 64 << 10, Duration: time.Minute})
+	assert.False(t, r.Completed())
+	assert.Equal(t, "Canceled", r.Code)
+	assert.True(t, r.Cancelled)
+	assert.Greater(t, result.BytesSent, int64(0))
+	assert.EqualValues(t, -1, result.BytesReceived)
+	assert.False(t, result.Reconciled())
+	assert.Less(t, result.Elapsed, 10*time.Second)
+	mbps := result.MBPerSecond()
+	assert.Greater(t, mbps, 0.0)
+	assert.False(t, math.IsInf(mbps, 0) || math.IsNaN(mbps))
+}
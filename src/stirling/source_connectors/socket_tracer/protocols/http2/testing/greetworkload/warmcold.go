@@ -0,0 +1,152 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// The connections recorded in CallRecord.Connection.
+const (
+	// ConnectionCold calls are made over a connection of their own, set up for the call.
+	ConnectionCold = "cold"
+	// ConnectionWarm calls are made over a connection that was set up before the first call.
+	ConnectionWarm = "warm"
+)
+
+// localAddrDialer dials with dial, and keeps the local address of the last connection dialed.
+type localAddrDialer struct {
+	dial func(context.Context, string) (net.Conn, error)
+
+	mu   sync.Mutex
+	addr string
+}
+
+func newLocalAddrDialer(connStats *ConnStatsHandler, socket *SocketOptions) *localAddrDialer {
+	if connStats != nil {
+		return &localAddrDialer{dial: connStats.DialerWith(socket)}
+	}
+	return &localAddrDialer{dial: socket.Dial}
+}
+
+func (d *localAddrDialer) dialContext(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := d.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.addr = CanonicalAddr(conn.LocalAddr())
+	return conn, nil
+}
+
+func (d *localAddrDialer) localAddr() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.addr
+}
+
+// WarmCold alternates Greeter.SayHello calls between cold connections, each set up for a single
+// call and closed after it, and a warm connection kept for every warm call. The latency of cold
+// calls thus includes the TCP, TLS and HTTP/2 handshakes, which that of warm calls never does.
+type WarmCold struct {
+	c         *Client
+	address   string
+	connStats *ConnStatsHandler
+
+	warm       *grpc.ClientConn
+	warmDialer *localAddrDialer
+	calls      int
+}
+
+// NewWarmCold sets up the warm connection to address, and waits for it to be ready. Connections
+// are tracked by connStats, if not nil.
+func (c *Client) NewWarmCold(address string, connStats *ConnStatsHandler) (*WarmCold, error) {
+	w := &WarmCold{c: c, address: address, connStats: connStats, warmDialer: newLocalAddrDialer(connStats, c.opts.Socket)}
+	conn, err := w.dial(w.warmDialer)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := c.callContext()
+	defer cancel()
+	conn.Connect()
+	for s := conn.GetState(); s != connectivity.Ready; s = conn.GetState() {
+		if !conn.WaitForStateChange(ctx, s) {
+			conn.Close()
+			return nil, dialError(address, ctx.Err())
+		}
+	}
+	w.warm = conn
+	return w, nil
+}
+
+func (w *WarmCold) dial(d *localAddrDialer) (*grpc.ClientConn, error) {
+	opts := []grpc.DialOption{grpc.WithContextDialer(d.dialContext)}
+	if w.connStats != nil {
+		opts = append(opts, grpc.WithStatsHandler(w.connStats))
+	}
+	return w.c.Dial(w.address, opts...)
+}
+
+// Call makes the next call, cold for the first and every other call from there, warm otherwise.
+// The record carries the connection the call was made over, and its local address.
+func (w *WarmCold) Call(name string) *CallRecord {
+	cold := w.calls%2 == 0
+	w.calls++
+	if !cold {
+		r := w.c.SayHello(w.warm, name)
+		r.Connection = ConnectionWarm
+		r.LocalAddr = w.warmDialer.localAddr()
+		return r
+	}
+
+	d := newLocalAddrDialer(w.connStats, w.c.opts.Socket)
+	conn, err := w.dial(d)
+	if err != nil {
+		r := newCallRecord("SayHello")
+		r.Connection = ConnectionCold
+		return w.c.finish(r, cancelPlan{}, err)
+	}
+	defer conn.Close()
+	// The connection is only set up by the call, and so within its latency.
+	r := w.c.SayHello(conn, name)
+	r.Connection = ConnectionCold
+	r.LocalAddr = d.localAddr()
+	return r
+}
+
+// Close closes the warm connection.
+func (w *WarmCold) Close() error {
+	return w.warm.Close()
+}
+
+// HandshakeOverhead compares the latency percentiles of the warm calls to method in byMethod, as
+// recorded by LatencyHistograms, with those of its cold calls. It returns nil unless both were made.
+func HandshakeOverhead(byMethod map[string]*Histogram, method string, percentiles []float64) []PercentileDelta {
+	warm, okWarm := byMethod[latencyKey(method, ConnectionWarm)]
+	cold, okCold := byMethod[latencyKey(method, ConnectionCold)]
+	if !okWarm || !okCold {
+		return nil
+	}
+	return ComparePercentiles(warm, cold, percentiles)
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+func TestWarmCold_TagsConnections(t *testing.T) {
+	_, addr := startServer(t, nil)
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	connStats := greetworkload.NewConnStatsHandler()
+	wc, err := c.NewWarmCold(addr, connStats)
+	require.NoError(t, err)
+
+	var records []*greetworkload.CallRecord
+	for i := 0; i < 10; i++ {
+		records = append(records, wc.Call("pixie"))
+	}
+	require.NoError(t, wc.Close())
+
+	coldAddrs := map[string]bool{}
+	warmAddrs := map[string]bool{}
+	for i, r := range records {
+		require.True(t, r.Completed(), r.Error)
+		require.NotEmpty(t, r.LocalAddr)
+		// Calls alternate, starting cold.
+		if i%2 == 0 {
+			assert.Equal(t, greetworkload.ConnectionCold, r.Connection, i)
+			assert.False(t, coldAddrs[r.LocalAddr], "cold call %d reused %s", i, r.LocalAddr)
+			coldAddrs[r.LocalAddr] = true
+		} else {
+			assert.Equal(t, greetworkload.ConnectionWarm, r.Connection, i)
+			warmAddrs[r.LocalAddr] = true
+		}
+	}
+	assert.Len(t, coldAddrs, 5)
+	require.Len(t, warmAddrs, 1)
+	for addr := range warmAddrs {
+		assert.False(t, coldAddrs[addr])
+	}
+
+	// The warm connection and one connection per cold call.
+	conns := connStats.Conns()
+	require.Len(t, conns, 6)
+	for _, conn := range conns {
+		if warmAddrs[conn.LocalAddr] {
+			assert.EqualValues(t, 5, conn.RPCsCompleted)
+		} else {
+			assert.EqualValues(t, 1, conn.RPCsCompleted)
+			assert.NotNil(t, conn.CloseTime)
+		}
+	}
+}
+
+func TestWarmCold_LatenciesByConnection(t *testing.T) {
+	_, addr := startServer(t, nil)
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second})
+	wc, err := c.NewWarmCold(addr, nil)
+	require.NoError(t, err)
+	defer wc.Close()
+
+	latencies, err := greetworkload.NewLatencyHistograms(&greetworkload.HistogramOptions{MaxValue: int64(time.Minute), SignificantDigits: 3})
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		latencies.Record(wc.Call("pixie"))
+	}
+	byMethod := latencies.Histograms()
+	require.Len(t, byMethod, 2)
+	assert.EqualValues(t, 2, byMethod["SayHello/cold"].Count())
+	assert.EqualValues(t, 2, byMethod["SayHello/warm"].Count())
+
+	deltas := greetworkload.HandshakeOverhead(byMethod, "SayHello", []float64{50})
+	require.Len(t, deltas, 1)
+	assert.Equal(t, byMethod["SayHello/warm"].ValueAtPercentile(50), deltas[0].Base)
+	assert.Equal(t, byMethod["SayHello/cold"].ValueAtPercentile(50), deltas[0].Other)
+	assert.Nil(t, greetworkload.HandshakeOverhead(byMethod, "SayHi", []float64{50}))
+}
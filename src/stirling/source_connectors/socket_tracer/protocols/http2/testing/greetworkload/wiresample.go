@@ -0,0 +1,462 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// DefaultWireSampleMaxBytes is the WireSamplerOptions.MaxBytes of options that set none.
+const DefaultWireSampleMaxBytes = 64 << 20
+
+// wireSampleExt is the extension of the files of the spool. Samples are written under another
+// name first, and renamed once complete, so that readers never see them half written.
+const wireSampleExt = ".sample"
+
+// WireSample is a message a WireSampler sampled, as its codec marshaled it or was given it to
+// unmarshal: before it is compressed, or once it is decompressed.
+type WireSample struct {
+	RequestID string `json:"request_id"`
+	Method    string `json:"method"`
+	// Side is the side of the call that sampled the message, "client" or "server".
+	Side string `json:"side"`
+	// Sent is set for the messages the side sent, and unset for those it received.
+	Sent bool      `json:"sent"`
+	Time time.Time `json:"time"`
+	Data []byte    `json:"-"`
+}
+
+// WireSamplerOptions configure a WireSampler.
+type WireSamplerOptions struct {
+	// Every samples one in Every messages, at random.
+	Every int
+	// Dir is the directory of the spool the samples are written to, created if need be.
+	Dir string
+	// MaxBytes bounds the size of the spool, DefaultWireSampleMaxBytes if zero. The oldest samples
+	// are removed to make room for new ones, including those found in Dir when it is opened.
+	MaxBytes int64
+	// Seed seeds the choice of the messages sampled.
+	Seed int64
+}
+
+// WireSampler writes a random sample of the messages of the calls made or handled through its
+// codec and interceptors to an on-disk spool, with their request ID, for ReadWireSamples to look
+// them up when what a tracer captured of a call does not match what the workload sent. Calls to
+// GreeterStats, GreeterFeatures, health and reflection are not sampled.
+//
+// Its codec has to be forced, with grpc.ForceCodec or grpc.ForceServerCodec, so that clients
+// that sample send the content-type "application/grpc+proto" rather than "application/grpc". A
+// nil WireSampler samples nothing, and its codecs are the codecs they wrap.
+type WireSampler struct {
+	opts  *WireSamplerOptions
+	spool *wireSpool
+
+	mu  sync.Mutex
+	rng *rand.Rand
+
+	// stash holds the bytes of the requests of unary calls the server codec sampled, by message,
+	// until the interceptor, which knows their call, gets them.
+	stash sync.Map
+
+	sampled  int64
+	dropped  int64
+	dropOnce sync.Once
+}
+
+// NewWireSampler creates a WireSampler writing to the spool in opts.Dir.
+func NewWireSampler(opts *WireSamplerOptions) (*WireSampler, error) {
+	if opts.Every <= 0 {
+		return nil, badFlagsf("wire sampling needs a positive 1-in-N rate, got %d", opts.Every)
+	}
+	if opts.Dir == "" {
+		return nil, badFlagsf("wire sampling needs a spool directory")
+	}
+	if opts.MaxBytes < 0 {
+		return nil, badFlagsf("the wire sample spool size cannot be negative, got %d", opts.MaxBytes)
+	}
+	maxBytes := opts.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = DefaultWireSampleMaxBytes
+	}
+	spool, err := openWireSpool(opts.Dir, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &WireSampler{opts: opts, spool: spool, rng: rand.New(rand.NewSource(opts.Seed))}, nil
+}
+
+// Sampled returns the number of messages written to the spool.
+func (s *WireSampler) Sampled() int64 {
+	return atomic.LoadInt64(&s.sampled)
+}
+
+// Dropped returns the number of messages sampled that could not be written to the spool.
+func (s *WireSampler) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// pick tells whether to sample the next message.
+func (s *WireSampler) pick() bool {
+	if s.opts.Every == 1 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rng.Intn(s.opts.Every) == 0
+}
+
+// wireCall is the call a message belongs to. Its request ID is only looked up in the metadata of
+// ctx once one of its messages is sampled.
+type wireCall struct {
+	ctx    context.Context
+	method string
+	client bool
+}
+
+func (c *wireCall) sample(sent bool, data []byte) *WireSample {
+	sample := &WireSample{Method: c.method, Side: "server", Sent: sent, Time: time.Now(), Data: data}
+	md, _ := metadata.FromIncomingContext(c.ctx)
+	if c.client {
+		sample.Side = "client"
+		md, _ = metadata.FromOutgoingContext(c.ctx)
+	}
+	if v := md.Get(RequestIDHeader); len(v) > 0 {
+		sample.RequestID = v[0]
+	}
+	return sample
+}
+
+// wireSampled is a message on its way between the interceptors of a WireSampler and its codec,
+// with the call it belongs to.
+type wireSampled struct {
+	msg  interface{}
+	call *wireCall
+}
+
+func (s *WireSampler) write(call *wireCall, sent bool, data []byte) {
+	if err := s.spool.write(call.sample(sent, data)); err != nil {
+		atomic.AddInt64(&s.dropped, 1)
+		s.dropOnce.Do(func() {
+			log.Printf("Failed to spool a wire sample, dropping it. Further failures are only counted: %v", err)
+		})
+		return
+	}
+	atomic.AddInt64(&s.sampled, 1)
+}
+
+// ClientCodec returns base, sampling the messages of the calls made through the client
+// interceptors.
+func (s *WireSampler) ClientCodec(base encoding.Codec) encoding.Codec {
+	if s == nil {
+		return base
+	}
+	return &wireSamplingCodec{base: base, s: s}
+}
+
+// ServerCodec returns base, sampling the messages of the calls handled through the server
+// interceptors.
+func (s *WireSampler) ServerCodec(base encoding.Codec) encoding.Codec {
+	if s == nil {
+		return base
+	}
+	return &wireSamplingCodec{base: base, s: s, server: true}
+}
+
+type wireSamplingCodec struct {
+	base   encoding.Codec
+	s      *WireSampler
+	server bool
+}
+
+// Marshal implements encoding.Codec.
+func (c *wireSamplingCodec) Marshal(v interface{}) ([]byte, error) {
+	w, ok := v.(*wireSampled)
+	if !ok {
+		return c.base.Marshal(v)
+	}
+	b, err := c.base.Marshal(w.msg)
+	if err == nil && c.s.pick() {
+		c.s.write(w.call, true, b)
+	}
+	return b, err
+}
+
+// Unmarshal implements encoding.Codec.
+func (c *wireSamplingCodec) Unmarshal(data []byte, v interface{}) error {
+	w, ok := v.(*wireSampled)
+	if !ok {
+		if !c.server || !c.s.pick() {
+			return c.unmarshal(data, v)
+		}
+		// The request of a unary call is unmarshaled before the interceptors see the call.
+		c.s.stash.Store(v, append([]byte(nil), data...))
+		err := c.unmarshal(data, v)
+		if err != nil {
+			c.s.stash.Delete(v)
+		}
+		return err
+	}
+	if c.s.pick() {
+		c.s.write(w.call, false, append([]byte(nil), data...))
+	}
+	return c.unmarshal(data, w.msg)
+}
+
+// unmarshal unmarshals the greetpb messages with pb.UnmarshalUntrusted, whatever the base codec,
+// since data comes off the wire. Other messages are left to the base codec.
+func (c *wireSamplingCodec) unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(pb.Message)
+	if !ok {
+		return c.base.Unmarshal(data, v)
+	}
+	m.Reset()
+	return pb.UnmarshalUntrusted(data, m)
+}
+
+// Name implements encoding.Codec.
+func (c *wireSamplingCodec) Name() string {
+	return c.base.Name()
+}
+
+// UnaryClientInterceptor returns an interceptor that passes the messages of unary calls to the
+// client codec with their call. It should come last in the chain, so that the codec is passed
+// the messages the other interceptors send.
+func (s *WireSampler) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if outsideWorkload(method) {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		call := &wireCall{ctx: ctx, method: method, client: true}
+		return invoker(ctx, method, &wireSampled{msg: req, call: call}, &wireSampled{msg: reply, call: call}, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor returns an interceptor that passes the messages of streaming calls to
+// the client codec with their call. It should come last in the chain.
+func (s *WireSampler) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil || outsideWorkload(method) {
+			return cs, err
+		}
+		return &wireSampledClientStream{ClientStream: cs, call: &wireCall{ctx: ctx, method: method, client: true}}, nil
+	}
+}
+
+type wireSampledClientStream struct {
+	grpc.ClientStream
+	call *wireCall
+}
+
+func (s *wireSampledClientStream) SendMsg(m interface{}) error {
+	return s.ClientStream.SendMsg(&wireSampled{msg: m, call: s.call})
+}
+
+func (s *wireSampledClientStream) RecvMsg(m interface{}) error {
+	return s.ClientStream.RecvMsg(&wireSampled{msg: m, call: s.call})
+}
+
+// UnaryServerInterceptor returns an interceptor that spools the requests of unary calls the
+// server codec sampled, and passes their replies to the codec with their call. It should come
+// first in the chain, so that the codec is passed the replies the other interceptors return.
+func (s *WireSampler) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		data, stashed := s.stash.LoadAndDelete(req)
+		if outsideWorkload(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		call := &wireCall{ctx: ctx, method: info.FullMethod}
+		if stashed {
+			s.write(call, false, data.([]byte))
+		}
+		reply, err := handler(ctx, req)
+		if err != nil || reply == nil {
+			return reply, err
+		}
+		return &wireSampled{msg: reply, call: call}, nil
+	}
+}
+
+// StreamServerInterceptor returns an interceptor that passes the messages of streaming calls to
+// the server codec with their call. It should come first in the chain.
+func (s *WireSampler) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if outsideWorkload(info.FullMethod) {
+			return handler(srv, ss)
+		}
+		call := &wireCall{ctx: ss.Context(), method: info.FullMethod}
+		return handler(srv, &wireSampledServerStream{ServerStream: ss, call: call})
+	}
+}
+
+type wireSampledServerStream struct {
+	grpc.ServerStream
+	call *wireCall
+}
+
+func (s *wireSampledServerStream) SendMsg(m interface{}) error {
+	return s.ServerStream.SendMsg(&wireSampled{msg: m, call: s.call})
+}
+
+func (s *wireSampledServerStream) RecvMsg(m interface{}) error {
+	return s.ServerStream.RecvMsg(&wireSampled{msg: m, call: s.call})
+}
+
+// A spool is a directory of one file per sample, named after the time the spool was opened, a
+// sequence number and the hex encoded request ID of the sample, so that samples sort oldest first
+// and can be looked up by request ID without being read. A file holds the JSON encoding of the
+// sample, a newline, and then its bytes.
+type wireSpool struct {
+	dir      string
+	maxBytes int64
+	prefix   string
+
+	mu    sync.Mutex
+	seq   int64
+	files []wireSpoolFile
+	size  int64
+}
+
+type wireSpoolFile struct {
+	name string
+	size int64
+}
+
+func openWireSpool(dir string, maxBytes int64) (*wireSpool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sp := &wireSpool{dir: dir, maxBytes: maxBytes, prefix: fmt.Sprintf("%019d", time.Now().UnixNano())}
+	// ReadDir sorts the entries by name, which is oldest first.
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), wireSampleExt) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		sp.files = append(sp.files, wireSpoolFile{name: e.Name(), size: info.Size()})
+		sp.size += info.Size()
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.evictLocked(0)
+	return sp, nil
+}
+
+// evictLocked removes the oldest samples until n more bytes fit.
+func (sp *wireSpool) evictLocked(n int64) {
+	for len(sp.files) > 0 && sp.size+n > sp.maxBytes {
+		f := sp.files[0]
+		sp.files = sp.files[1:]
+		sp.size -= f.size
+		if err := os.Remove(filepath.Join(sp.dir, f.name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Failed to remove wire sample %s: %v", f.name, err)
+		}
+	}
+}
+
+func (sp *wireSpool) write(sample *WireSample) error {
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(sample); err != nil {
+		return err
+	}
+	b.Write(sample.Data)
+	n := int64(b.Len())
+	if n > sp.maxBytes {
+		return fmt.Errorf("a sample of %d bytes does not fit the %d bytes of the spool", n, sp.maxBytes)
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.evictLocked(n)
+	name := fmt.Sprintf("%s-%010d-%s%s", sp.prefix, sp.seq, hex.EncodeToString([]byte(sample.RequestID)), wireSampleExt)
+	sp.seq++
+	path := filepath.Join(sp.dir, name)
+	if err := os.WriteFile(path+".tmp", b.Bytes(), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	sp.files = append(sp.files, wireSpoolFile{name: name, size: n})
+	sp.size += n
+	return nil
+}
+
+// ReadWireSamples returns the samples of the call with the given request ID spooled in dir, oldest
+// first. Samples removed from the spool while they are read are skipped.
+func ReadWireSamples(dir, requestID string) ([]*WireSample, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	suffix := "-" + hex.EncodeToString([]byte(requestID)) + wireSampleExt
+	var samples []*WireSample
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), suffix) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			return nil, fmt.Errorf("wire sample %s has no header", e.Name())
+		}
+		sample := &WireSample{}
+		if err := json.Unmarshal(b[:i], sample); err != nil {
+			return nil, fmt.Errorf("wire sample %s: %w", e.Name(), err)
+		}
+		sample.Data = b[i+1:]
+		samples = append(samples, sample)
+	}
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+	return samples, nil
+}
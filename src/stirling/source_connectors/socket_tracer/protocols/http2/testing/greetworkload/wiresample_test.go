@@ -0,0 +1,321 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetworkload_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/proto"
+	"google.golang.org/grpc/metadata"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+func newWireSampler(t testing.TB, opts *greetworkload.WireSamplerOptions) *greetworkload.WireSampler {
+	s, err := greetworkload.NewWireSampler(opts)
+	require.NoError(t, err)
+	return s
+}
+
+// startSampledServer serves Greeter and StreamingGreeter, sampling their messages with s, and
+// marshaling them with codec.
+func startSampledServer(t *testing.T, s *greetworkload.WireSampler, codec encoding.Codec) string {
+	return startServerWith(t, &serverSetup{GRPC: []grpc.ServerOption{
+		grpc.ForceServerCodec(s.ServerCodec(codec)),
+		grpc.ChainUnaryInterceptor(s.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(s.StreamServerInterceptor()),
+	}}).Addr
+}
+
+// wireSamplesBySide splits samples into those the client and the server sent and received.
+func wireSamplesBySide(samples []*greetworkload.WireSample) map[string][][]byte {
+	bySide := make(map[string][][]byte)
+	for _, s := range samples {
+		key := s.Side + " received"
+		if s.Sent {
+			key = s.Side + " sent"
+		}
+		bySide[key] = append(bySide[key], s.Data)
+	}
+	return bySide
+}
+
+func TestWireSampler_SamplesMatchUnmarshal(t *testing.T) {
+	for name, codec := range map[string]encoding.Codec{
+		"proto":         encoding.GetCodec(proto.Name),
+		"sized":         pb.SizedCodec{},
+		"deterministic": pb.DeterministicCodec{},
+	} {
+		codec := codec
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			addr := startSampledServer(t, newWireSampler(t, &greetworkload.WireSamplerOptions{Every: 1, Dir: dir}), codec)
+			client := newWireSampler(t, &greetworkload.WireSamplerOptions{Every: 1, Dir: dir})
+			c := greetworkload.NewClient(&greetworkload.ClientOptions{
+				Timeout:            5 * time.Second,
+				StreamCount:        3,
+				SizedCodec:         name == "sized",
+				DeterministicCodec: name == "deterministic",
+				WireSampler:        client,
+			})
+			conn, err := c.Dial(addr)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			unary := c.SayHello(conn, "pixie")
+			require.Equal(t, codes.OK.String(), unary.Code, unary.Error)
+			samples, err := greetworkload.ReadWireSamples(dir, unary.RequestID)
+			require.NoError(t, err)
+			require.Len(t, samples, 4)
+			for _, s := range samples {
+				assert.Equal(t, unary.RequestID, s.RequestID)
+				assert.Equal(t, pb.Greeter_SayHello_FullMethodName, s.Method)
+			}
+			bySide := wireSamplesBySide(samples)
+			require.Len(t, bySide["client sent"], 1)
+			assert.Equal(t, bySide["client sent"], bySide["server received"])
+			require.Len(t, bySide["server sent"], 1)
+			assert.Equal(t, bySide["server sent"], bySide["client received"])
+
+			// The samples are the exact bytes of the messages: unmarshaling them and marshaling the
+			// messages again gives them back.
+			req := &pb.HelloRequest{}
+			require.NoError(t, codec.Unmarshal(bySide["client sent"][0], req))
+			assert.Equal(t, "pixie", req.Name)
+			b, err := codec.Marshal(req)
+			require.NoError(t, err)
+			assert.Equal(t, bySide["client sent"][0], b)
+			reply := &pb.HelloReply{}
+			require.NoError(t, codec.Unmarshal(bySide["server sent"][0], reply))
+			assert.Equal(t, "Hello pixie", reply.Message)
+			b, err = codec.Marshal(reply)
+			require.NoError(t, err)
+			assert.Equal(t, bySide["server sent"][0], b)
+
+			stream := c.ServerStreaming(conn, "stream")
+			require.Equal(t, codes.OK.String(), stream.Code, stream.Error)
+			samples, err = greetworkload.ReadWireSamples(dir, stream.RequestID)
+			require.NoError(t, err)
+			bySide = wireSamplesBySide(samples)
+			assert.Len(t, bySide["client sent"], 1)
+			assert.Equal(t, bySide["client sent"], bySide["server received"])
+			assert.Len(t, bySide["server sent"], 3)
+			assert.Equal(t, bySide["server sent"], bySide["client received"])
+			for _, data := range bySide["client received"] {
+				reply := &pb.HelloReply{}
+				require.NoError(t, codec.Unmarshal(data, reply))
+				b, err := codec.Marshal(reply)
+				require.NoError(t, err)
+				assert.Equal(t, data, b)
+			}
+			assert.Equal(t, int64(6), client.Sampled())
+			assert.Zero(t, client.Dropped())
+		})
+	}
+}
+
+func TestWireSampler_SamplesOneInN(t *testing.T) {
+	dir := t.TempDir()
+	_, addr := startServer(t, nil)
+	s := newWireSampler(t, &greetworkload.WireSamplerOptions{Every: 4, Dir: dir, Seed: 1})
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, WireSampler: s})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	const calls = 500
+	for i := 0; i < calls; i++ {
+		r := c.SayHello(conn, "pixie")
+		require.Equal(t, codes.OK.String(), r.Code, r.Error)
+	}
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, int(s.Sampled()))
+	// A request and a reply per call, one in 4 of which are sampled: 250, with a standard deviation
+	// of about 14.
+	assert.InDelta(t, 2*calls/4, s.Sampled(), 60)
+}
+
+func TestWireSampler_SpoolIsBounded(t *testing.T) {
+	dir := t.TempDir()
+	_, addr := startServer(t, nil)
+	const maxBytes = 4096
+	s := newWireSampler(t, &greetworkload.WireSamplerOptions{Every: 1, Dir: dir, MaxBytes: maxBytes})
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, WireSampler: s})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var records []*greetworkload.CallRecord
+	for i := 0; i < 100; i++ {
+		records = append(records, c.SayHello(conn, "pixie"))
+	}
+	spoolSize := func() int64 {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		var size int64
+		for _, e := range entries {
+			info, err := e.Info()
+			require.NoError(t, err)
+			size += info.Size()
+		}
+		return size
+	}
+	assert.LessOrEqual(t, spoolSize(), int64(maxBytes))
+	assert.Equal(t, int64(200), s.Sampled())
+
+	oldest, err := greetworkload.ReadWireSamples(dir, records[0].RequestID)
+	require.NoError(t, err)
+	assert.Empty(t, oldest, "the samples of the first call are still spooled")
+	newest, err := greetworkload.ReadWireSamples(dir, records[len(records)-1].RequestID)
+	require.NoError(t, err)
+	assert.Len(t, newest, 2)
+
+	// Samples left by an earlier run count towards the bound of the next.
+	newWireSampler(t, &greetworkload.WireSamplerOptions{Every: 1, Dir: dir, MaxBytes: maxBytes / 4})
+	assert.LessOrEqual(t, spoolSize(), int64(maxBytes/4))
+	newest, err = greetworkload.ReadWireSamples(dir, records[len(records)-1].RequestID)
+	require.NoError(t, err)
+	assert.Len(t, newest, 2)
+}
+
+func TestWireSampler_DropsSamplesTooLarge(t *testing.T) {
+	dir := t.TempDir()
+	_, addr := startServer(t, nil)
+	s := newWireSampler(t, &greetworkload.WireSamplerOptions{Every: 1, Dir: dir, MaxBytes: 64})
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, WireSampler: s})
+	conn, err := c.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The call is not failed by the samples it could not spool.
+	r := c.SayHello(conn, strings.Repeat("x", 100))
+	require.Equal(t, codes.OK.String(), r.Code, r.Error)
+	assert.Zero(t, s.Sampled())
+	assert.Equal(t, int64(2), s.Dropped())
+}
+
+func TestNewWireSampler_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		opts    *greetworkload.WireSamplerOptions
+		wantErr string
+	}{
+		{name: "no rate", opts: &greetworkload.WireSamplerOptions{Dir: dir}, wantErr: "positive 1-in-N rate, got 0"},
+		{name: "negative rate", opts: &greetworkload.WireSamplerOptions{Every: -1, Dir: dir}, wantErr: "got -1"},
+		{name: "no dir", opts: &greetworkload.WireSamplerOptions{Every: 1}, wantErr: "needs a spool directory"},
+		{name: "negative size", opts: &greetworkload.WireSamplerOptions{Every: 1, Dir: dir, MaxBytes: -1}, wantErr: "cannot be negative"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := greetworkload.NewWireSampler(tc.opts)
+			assert.ErrorIs(t, err, greetworkload.ErrBadFlagCombination)
+			assert.ErrorContains(t, err, tc.wantErr)
+		})
+	}
+}
+
+func TestWireSampler_UnmarshalsUntrusted(t *testing.T) {
+	s := newWireSampler(t, &greetworkload.WireSamplerOptions{Every: 1, Dir: t.TempDir(), MaxBytes: 1 << 20})
+	// A name whose length, math.MaxUint64, runs past the 3 bytes left.
+	data := []byte{0x0a, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 'a', 'b', 'c'}
+	base := encoding.GetCodec(proto.Name)
+	for _, codec := range []encoding.Codec{s.ClientCodec(base), s.ServerCodec(base)} {
+		err := codec.Unmarshal(data, &pb.HelloRequest{})
+		var lengthErr *pb.LengthError
+		assert.True(t, errors.As(err, &lengthErr), "%v", err)
+	}
+}
+
+func TestWireSampler_NilUsesBaseCodec(t *testing.T) {
+	var s *greetworkload.WireSampler
+	base := pb.SizedCodec{}
+	assert.Equal(t, base, s.ClientCodec(base))
+	assert.Equal(t, base, s.ServerCodec(base))
+}
+
+func TestReadWireSamples(t *testing.T) {
+	dir := t.TempDir()
+	samples, err := greetworkload.ReadWireSamples(dir, "unknown")
+	require.NoError(t, err)
+	assert.Empty(t, samples)
+
+	_, err = greetworkload.ReadWireSamples(filepath.Join(dir, "missing"), "unknown")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+// BenchmarkWireSampler_Codec measures what sampling adds to the marshaling and unmarshaling of a
+// unary call on the client: nothing when it is off, and the choice of the messages to sample when
+// it is on.
+func BenchmarkWireSampler_Codec(b *testing.B) {
+	base := encoding.GetCodec(proto.Name)
+	for _, tc := range []struct {
+		name  string
+		every int
+	}{
+		{name: "off"},
+		{name: "unsampled", every: 1 << 30},
+		{name: "1in1000", every: 1000},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			var s *greetworkload.WireSampler
+			if tc.every > 0 {
+				s = newWireSampler(b, &greetworkload.WireSamplerOptions{Every: tc.every, Dir: b.TempDir(), MaxBytes: 1 << 20})
+			}
+			codec := s.ClientCodec(base)
+			// The invoker stands in for gRPC, marshaling the request and unmarshaling the reply.
+			invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				data, err := codec.Marshal(req)
+				if err != nil {
+					return err
+				}
+				return codec.Unmarshal(data, reply)
+			}
+			if s != nil {
+				interceptor := s.UnaryClientInterceptor()
+				direct := invoker
+				invoker = func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+					return interceptor(ctx, method, req, reply, cc, direct, opts...)
+				}
+			}
+			ctx := metadata.AppendToOutgoingContext(context.Background(), greetworkload.RequestIDHeader, greetworkload.NewRequestID())
+			req := &pb.HelloRequest{Name: strings.Repeat("x", 64)}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := invoker(ctx, pb.Greeter_SayHello_FullMethodName, req, &pb.HelloRequest{}, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// MessagePrefixLen is the length of the prefix of every gRPC message: a compression flag followed
+// by the 4-byte big-endian length of the message.
+const MessagePrefixLen = 5
+
+// wireMessage is a greet message, which marshals itself.
+type wireMessage interface {
+	Marshal() ([]byte, error)
+	Size() int
+}
+
+// GzipSize returns the size of b once compressed by the gzip compressor of grpc-go, which uses the
+// default compression level unless changed with its SetLevel.
+func GzipSize(b []byte) (int, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.DefaultCompression)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	return buf.Len(), nil
+}
+
+// MessageWireLength returns the length of msg as a gRPC message, as counted by the WireLength of
+// the grpc stats and in ConnStats: its marshaled size, after gzip compression if compressed, plus
+// MessagePrefixLen. HTTP/2 framing is not included.
+func MessageWireLength(msg wireMessage, compressed bool) (int, error) {
+	if !compressed {
+		return msg.Size() + MessagePrefixLen, nil
+	}
+	b, err := msg.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	n, err := GzipSize(b)
+	if err != nil {
+		return 0, err
+	}
+	return n + MessagePrefixLen, nil
+}
+
+// CallSpec describes the messages of a call, for ExpectedWireBytes.
+type CallSpec struct {
+	Requests []*pb.HelloRequest
+	Replies  []*pb.HelloReply
+	// Compressed is set for calls made with gzip compression. Servers then compress their replies
+	// with gzip too.
+	Compressed bool
+}
+
+// WireBytes count the bytes of the gRPC messages sent each way.
+type WireBytes struct {
+	// Requests is the WireBytesOut of the client and the WireBytesIn of the server.
+	Requests int64
+	// Replies is the WireBytesIn of the client and the WireBytesOut of the server.
+	Replies int64
+}
+
+// ExpectedWireBytes returns the bytes calls are expected to send in gRPC messages, as recorded in
+// the ConnStats of the connection they are made over.
+func ExpectedWireBytes(calls []CallSpec) (*WireBytes, error) {
+	total := &WireBytes{}
+	for i, c := range calls {
+		for _, req := range c.Requests {
+			n, err := MessageWireLength(req, c.Compressed)
+			if err != nil {
+				return nil, fmt.Errorf("call %d: %w", i, err)
+			}
+			total.Requests += int64(n)
+		}
+		for _, reply := range c.Replies {
+			n, err := MessageWireLength(reply, c.Compressed)
+			if err != nil {
+				return nil, fmt.Errorf("call %d: %w", i, err)
+			}
+			total.Replies += int64(n)
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetworkload_test
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+func randomName(rng *rand.Rand, n int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[rng.Intn(len(letters))]
+	}
+	return string(b)
+}
+
+// makeWireSizeCalls makes unary and streaming calls over conn, and returns their messages.
+func makeWireSizeCalls(t *testing.T, conn *grpc.ClientConn, compressed bool) []greetworkload.CallSpec {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rng := rand.New(rand.NewSource(1))
+	var calls []greetworkload.CallSpec
+
+	for _, name := range []string{"", "pixie", strings.Repeat("a", 4096), randomName(rng, 4096)} {
+		req := &pb.HelloRequest{Name: name}
+		reply, err := pb.NewGreeterClient(conn).SayHello(ctx, req)
+		require.NoError(t, err)
+		calls = append(calls, greetworkload.CallSpec{Requests: []*pb.HelloRequest{req}, Replies: []*pb.HelloReply{reply}, Compressed: compressed})
+	}
+
+	req := &pb.HelloRequest{Name: randomName(rng, 100), Count: 5}
+	stream, err := pb.NewStreamingGreeterClient(conn).SayHelloServerStreaming(ctx, req)
+	require.NoError(t, err)
+	call := greetworkload.CallSpec{Requests: []*pb.HelloRequest{req}, Compressed: compressed}
+	for {
+		reply, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		call.Replies = append(call.Replies, reply)
+	}
+	calls = append(calls, call)
+
+	bidir, err := pb.NewStreamingGreeterClient(conn).SayHelloBidirStreaming(ctx)
+	require.NoError(t, err)
+	call = greetworkload.CallSpec{Compressed: compressed}
+	for i := 0; i < 3; i++ {
+		req := &pb.HelloRequest{Name: randomName(rng, 10*(i+1))}
+		require.NoError(t, bidir.Send(req))
+		call.Requests = append(call.Requests, req)
+		reply, err := bidir.Recv()
+		require.NoError(t, err)
+		call.Replies = append(call.Replies, reply)
+	}
+	require.NoError(t, bidir.CloseSend())
+	_, err = bidir.Recv()
+	require.Equal(t, io.EOF, err)
+	return append(calls, call)
+}
+
+func TestExpectedWireBytes_MatchesStats(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		t.Run(map[bool]string{false: "identity", true: "gzip"}[compressed], func(t *testing.T) {
+			_, addr := startServer(t, &greetworkload.ServerOptions{InstanceID: "wire", StreamReplyBytes: 300})
+			connStats := greetworkload.NewConnStatsHandler()
+			opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithStatsHandler(connStats)}
+			if compressed {
+				opts = append(opts, grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)))
+			}
+			conn, err := grpc.Dial(addr, opts...)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			calls := makeWireSizeCalls(t, conn, compressed)
+			want, err := greetworkload.ExpectedWireBytes(calls)
+			require.NoError(t, err)
+
+			conns := connStats.Conns()
+			require.Len(t, conns, 1)
+			assert.Equal(t, want.Requests, conns[0].WireBytesOut)
+			assert.Equal(t, want.Replies, conns[0].WireBytesIn)
+		})
+	}
+}
+
+func TestMessageWireLength(t *testing.T) {
+	n, err := greetworkload.MessageWireLength(&pb.HelloRequest{}, false)
+	require.NoError(t, err)
+	assert.Equal(t, greetworkload.MessagePrefixLen, n)
+
+	req := &pb.HelloRequest{Name: "pixie", Count: -1}
+	n, err = greetworkload.MessageWireLength(req, false)
+	require.NoError(t, err)
+	assert.Equal(t, req.Size()+greetworkload.MessagePrefixLen, n)
+
+	// Compression pays off for repetitive names only.
+	long := &pb.HelloRequest{Name: strings.Repeat("a", 4096)}
+	n, err = greetworkload.MessageWireLength(long, true)
+	require.NoError(t, err)
+	assert.Less(t, n, long.Size())
+	n, err = greetworkload.MessageWireLength(&pb.HelloRequest{}, true)
+	require.NoError(t, err)
+	assert.Greater(t, n, greetworkload.MessagePrefixLen)
+}
@@ -0,0 +1,425 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+// Package payloadgen generates the content of greet calls deterministically from a seed, so that
+// the client can build requests, and verification code recompute them, without either storing
+// them. Every value is a function of (seed, index) alone: values can be generated in any order,
+// by any process, and come out the same.
+package payloadgen
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// Version is the version of the values generated from a seed. It is bumped whenever the values
+// generated from the same seed and options change, so that runs generated with different versions
+// are not taken for the same.
+const Version = 1
+
+// The alphabets text is generated from.
+const (
+	// AlphabetASCII generates printable ASCII, 0x20 through 0x7e.
+	AlphabetASCII = "ascii"
+	// AlphabetUTF8 generates runes of every UTF-8 encoded length, from 1 to 4 bytes.
+	AlphabetUTF8 = "utf8"
+	// AlphabetStress generates the text parsers get wrong: CJK and Hangul, right-to-left
+	// scripts, emoji with modifiers and zero-width joiners, and letters followed by combining
+	// marks. Text ends on a rune as long as the bytes left allow, so that it often ends with a
+	// multi-byte rune, or with a lone combining mark.
+	AlphabetStress = "stress"
+	// AlphabetHuffmanFavorable generates the printable ASCII with the shortest HPACK Huffman
+	// codes, 5 bits, so that HPACK encoders Huffman code it.
+	AlphabetHuffmanFavorable = "huffman_favorable"
+	// AlphabetHuffmanUnfavorable generates the printable ASCII with the longest HPACK Huffman
+	// codes, 11 to 19 bits, which Huffman coding expands, so that HPACK encoders send it raw.
+	AlphabetHuffmanUnfavorable = "huffman_unfavorable"
+)
+
+// alphabets are the valid values of Options.Alphabet.
+var alphabets = []string{AlphabetASCII, AlphabetUTF8, AlphabetStress, AlphabetHuffmanFavorable, AlphabetHuffmanUnfavorable}
+
+// The kinds of SizeDist.
+const (
+	SizeFixed   = "fixed"
+	SizeUniform = "uniform"
+	SizeZipf    = "zipf"
+	// SizeBoundary draws from boundarySizes.
+	SizeBoundary = "boundary"
+)
+
+// boundarySizes are the sizes of SizeBoundary: every UTF-8 encoded length and the sums of two,
+// and the sizes either side of 127, where the lengths of protobuf fields and HPACK strings take
+// a second byte.
+var boundarySizes = []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 126, 127, 128, 129}
+
+// maxSize bounds the sizes of SizeDist, so that Zipf tables stay small.
+const maxSize = 1 << 20
+
+// SizeDist is a distribution of payload sizes, in bytes.
+type SizeDist struct {
+	// Kind is one of SizeFixed, SizeUniform, SizeZipf and SizeBoundary.
+	Kind string
+	// Min is the smallest size of SizeUniform, and the size of SizeFixed.
+	Min int
+	// Max is the largest size of SizeUniform and SizeZipf.
+	Max int
+	// Exponent is the exponent s of SizeZipf, under which size k in [0, Max] has a probability
+	// proportional to 1/(k+1)^s.
+	Exponent float64
+}
+
+// ParseSizeDist parses a distribution written as "fixed:N", "uniform:MIN:MAX", "zipf:S:MAX" or
+// "boundary".
+func ParseSizeDist(s string) (SizeDist, error) {
+	parts := strings.Split(s, ":")
+	var d SizeDist
+	var err error
+	switch {
+	case parts[0] == SizeFixed && len(parts) == 2:
+		d = SizeDist{Kind: SizeFixed}
+		d.Min, err = strconv.Atoi(parts[1])
+		d.Max = d.Min
+	case parts[0] == SizeUniform && len(parts) == 3:
+		d = SizeDist{Kind: SizeUniform}
+		if d.Min, err = strconv.Atoi(parts[1]); err == nil {
+			d.Max, err = strconv.Atoi(parts[2])
+		}
+	case parts[0] == SizeZipf && len(parts) == 3:
+		d = SizeDist{Kind: SizeZipf}
+		if d.Exponent, err = strconv.ParseFloat(parts[1], 64); err == nil {
+			d.Max, err = strconv.Atoi(parts[2])
+		}
+	case parts[0] == SizeBoundary && len(parts) == 1:
+		d = SizeDist{Kind: SizeBoundary}
+	default:
+		return SizeDist{}, fmt.Errorf("size distribution %q must be fixed:N, uniform:MIN:MAX, zipf:S:MAX or boundary", s)
+	}
+	if err != nil {
+		return SizeDist{}, fmt.Errorf("size distribution %q: %w", s, err)
+	}
+	return d, d.Validate()
+}
+
+// Validate checks that the distribution is well formed.
+func (d SizeDist) Validate() error {
+	switch d.Kind {
+	case SizeFixed, SizeUniform:
+		if d.Min < 0 || d.Min > d.Max {
+			return fmt.Errorf("%s sizes must have 0 <= min <= max, got [%d, %d]", d.Kind, d.Min, d.Max)
+		}
+	case SizeZipf:
+		if d.Exponent <= 0 || math.IsInf(d.Exponent, 0) || math.IsNaN(d.Exponent) {
+			return fmt.Errorf("zipf exponent must be positive, got %v", d.Exponent)
+		}
+		if d.Max < 0 {
+			return fmt.Errorf("zipf max size must not be negative, got %d", d.Max)
+		}
+	case SizeBoundary:
+		if d.Min != 0 || d.Max != 0 || d.Exponent != 0 {
+			return fmt.Errorf("boundary sizes take no parameters")
+		}
+	default:
+		return fmt.Errorf("unknown size distribution %q", d.Kind)
+	}
+	if d.Max > maxSize {
+		return fmt.Errorf("sizes must be at most %d, got %d", maxSize, d.Max)
+	}
+	return nil
+}
+
+// Options configure a Generator.
+type Options struct {
+	Seed uint64
+	// Alphabet is the alphabet of names, messages and metadata values, one of the Alphabet
+	// constants.
+	Alphabet string
+	// Size is the distribution of the sizes of names, messages and payloads.
+	Size SizeDist
+}
+
+// The streams values are drawn from, so that the name, message and payload of an index are
+// independent of each other.
+const (
+	streamName uint64 = iota + 1
+	streamMessage
+	streamPayload
+	streamMetadata
+)
+
+// Generator generates names, messages and binary payloads from (seed, index). It is safe for
+// concurrent use.
+type Generator struct {
+	opts Options
+	// zipfCDF holds the cumulative probability of every size of a SizeZipf distribution.
+	zipfCDF []float64
+}
+
+// New creates a Generator.
+func New(opts *Options) (*Generator, error) {
+	valid := false
+	for _, a := range alphabets {
+		valid = valid || opts.Alphabet == a
+	}
+	if !valid {
+		return nil, fmt.Errorf("alphabet must be one of %s, got %q", strings.Join(alphabets, ", "), opts.Alphabet)
+	}
+	if err := opts.Size.Validate(); err != nil {
+		return nil, err
+	}
+	g := &Generator{opts: *opts}
+	if opts.Size.Kind == SizeZipf {
+		g.zipfCDF = make([]float64, opts.Size.Max+1)
+		var sum float64
+		for k := range g.zipfCDF {
+			sum += math.Pow(float64(k+1), -opts.Size.Exponent)
+			g.zipfCDF[k] = sum
+		}
+		for k := range g.zipfCDF {
+			g.zipfCDF[k] /= sum
+		}
+	}
+	return g, nil
+}
+
+// rng is a splitmix64 sequence, which is fast and, seeded through the same mix, well spread even
+// for adjacent seeds and indexes.
+type rng struct {
+	state uint64
+}
+
+func mix(z uint64) uint64 {
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (g *Generator) rng(stream, index uint64) *rng {
+	return &rng{state: mix(mix(g.opts.Seed) ^ mix(stream<<56^index))}
+}
+
+func (r *rng) next() uint64 {
+	r.state += 0x9e3779b97f4a7c15
+	return mix(r.state)
+}
+
+// intn returns a value in [0, n), n > 0.
+func (r *rng) intn(n int) int {
+	return int(r.next() % uint64(n))
+}
+
+// float returns a value in [0, 1).
+func (r *rng) float() float64 {
+	return float64(r.next()>>11) / (1 << 53)
+}
+
+func (g *Generator) size(r *rng) int {
+	d := g.opts.Size
+	switch d.Kind {
+	case SizeUniform:
+		return d.Min + r.intn(d.Max-d.Min+1)
+	case SizeZipf:
+		u := r.float()
+		k := sort.SearchFloat64s(g.zipfCDF, u)
+		if k > d.Max {
+			k = d.Max
+		}
+		return k
+	case SizeBoundary:
+		return boundarySizes[r.intn(len(boundarySizes))]
+	}
+	return d.Min
+}
+
+// utf8Ranges are the code point ranges AlphabetUTF8 draws from, an equal share each, so that
+// every encoded length is common.
+var utf8Ranges = [][2]rune{
+	{0x20, 0x7e},       // ASCII
+	{0xa1, 0x17f},      // Latin-1 and Latin Extended-A, 2 bytes.
+	{0x391, 0x3c9},     // Greek, 2 bytes.
+	{0x4e00, 0x9fff},   // CJK, 3 bytes.
+	{0x1f300, 0x1f5ff}, // Pictographs, 4 bytes.
+}
+
+// huffmanFavorable are the characters with 5-bit HPACK Huffman codes, RFC 7541 Appendix B.
+const huffmanFavorable = "012aceiost"
+
+// huffmanUnfavorable are the printable characters with HPACK Huffman codes of 11 bits or more.
+const huffmanUnfavorable = "#$<>@[\\]^`{|}~"
+
+// inRange returns a rune of rg.
+func (r *rng) inRange(rg [2]rune) rune {
+	return rg[0] + rune(r.intn(int(rg[1]-rg[0]+1)))
+}
+
+// The ranges AlphabetStress draws from.
+var (
+	cjk       = [2]rune{0x4e00, 0x9fff}   // 3 bytes.
+	hangul    = [2]rune{0xac00, 0xd7a3}   // 3 bytes.
+	hebrew    = [2]rune{0x5d0, 0x5ea}     // Right-to-left, 2 bytes.
+	arabic    = [2]rune{0x621, 0x64a}     // Right-to-left, 2 bytes.
+	combining = [2]rune{0x300, 0x36f}     // Combining diacritical marks, 2 bytes.
+	emoji     = [2]rune{0x1f600, 0x1f64f} // Emoticons, 4 bytes.
+	skinTone  = [2]rune{0x1f3fb, 0x1f3ff} // Emoji modifiers, 4 bytes.
+	letters   = [2]rune{'a', 'z'}
+)
+
+const (
+	variationSelect = '\ufe0f'
+	zeroWidthJoiner = '\u200d'
+)
+
+// stressCluster appends a cluster of AlphabetStress to b: a single rune, or a sequence of runes
+// rendered as one character.
+func stressCluster(r *rng, b []rune) []rune {
+	switch r.intn(8) {
+	case 0:
+		return append(b, r.inRange(cjk))
+	case 1:
+		return append(b, r.inRange(hangul))
+	case 2:
+		return append(b, r.inRange(hebrew))
+	case 3:
+		return append(b, r.inRange(arabic))
+	case 4:
+		b = append(b, r.inRange(letters))
+		for n := 1 + r.intn(3); n > 0; n-- {
+			b = append(b, r.inRange(combining))
+		}
+		return b
+	case 5:
+		return append(b, r.inRange(emoji), r.inRange(skinTone))
+	case 6:
+		return append(b, r.inRange(emoji), variationSelect)
+	default:
+		return append(b, r.inRange(emoji), zeroWidthJoiner, r.inRange(emoji))
+	}
+}
+
+// stressRune returns a rune of AlphabetStress that is n bytes long, 1 <= n <= 4.
+func stressRune(r *rng, n int) rune {
+	switch n {
+	case 1:
+		return r.inRange(letters)
+	case 2:
+		return r.inRange(combining)
+	case 3:
+		return r.inRange(cjk)
+	}
+	return r.inRange(emoji)
+}
+
+func runesLen(rs []rune) int {
+	n := 0
+	for _, c := range rs {
+		n += utf8.RuneLen(c)
+	}
+	return n
+}
+
+// text returns exactly size bytes of text. The last rune is ASCII if no longer one fits, except
+// with AlphabetStress.
+func (g *Generator) text(r *rng, size int) string {
+	var b strings.Builder
+	b.Grow(size)
+	var cluster []rune
+	for b.Len() < size {
+		left := size - b.Len()
+		switch g.opts.Alphabet {
+		case AlphabetStress:
+			cluster = stressCluster(r, cluster[:0])
+			if runesLen(cluster) > left {
+				if left > utf8.UTFMax {
+					left = utf8.UTFMax
+				}
+				cluster = append(cluster[:0], stressRune(r, left))
+			}
+			for _, c := range cluster {
+				b.WriteRune(c)
+			}
+			continue
+		case AlphabetHuffmanFavorable:
+			b.WriteByte(huffmanFavorable[r.intn(len(huffmanFavorable))])
+			continue
+		case AlphabetHuffmanUnfavorable:
+			b.WriteByte(huffmanUnfavorable[r.intn(len(huffmanUnfavorable))])
+			continue
+		}
+		c := rune(0x20 + r.intn(0x7f-0x20))
+		if g.opts.Alphabet == AlphabetUTF8 {
+			rg := utf8Ranges[r.intn(len(utf8Ranges))]
+			if c2 := r.inRange(rg); utf8.RuneLen(c2) <= left {
+				c = c2
+			}
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// Name returns the name of index.
+func (g *Generator) Name(index uint64) string {
+	r := g.rng(streamName, index)
+	return g.text(r, g.size(r))
+}
+
+// Message returns the message of index.
+func (g *Generator) Message(index uint64) string {
+	r := g.rng(streamMessage, index)
+	return g.text(r, g.size(r))
+}
+
+// MetadataValue returns the metadata value of index. Only the values of AlphabetASCII and the
+// Huffman alphabets are valid in gRPC metadata; the others must be sent under "-bin" keys.
+func (g *Generator) MetadataValue(index uint64) string {
+	r := g.rng(streamMetadata, index)
+	return g.text(r, g.size(r))
+}
+
+// Payload returns the binary payload of index.
+func (g *Generator) Payload(index uint64) []byte {
+	r := g.rng(streamPayload, index)
+	b := make([]byte, g.size(r))
+	for i := 0; i < len(b); i += 8 {
+		v := r.next()
+		for j := i; j < i+8 && j < len(b); j++ {
+			b[j] = byte(v)
+			v >>= 8
+		}
+	}
+	return b
+}
+
+// Request returns the request of index, which holds its name.
+func (g *Generator) Request(index uint64) *pb.HelloRequest {
+	return &pb.HelloRequest{Name: g.Name(index)}
+}
+
+// Requests returns the requests of indexes [first, first+n).
+func (g *Generator) Requests(first uint64, n int) []*pb.HelloRequest {
+	reqs := make([]*pb.HelloRequest, n)
+	for i := range reqs {
+		reqs[i] = g.Request(first + uint64(i))
+	}
+	return reqs
+}
@@ -0,0 +1,269 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package payloadgen_test
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/http2/hpack"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/payloadgen"
+)
+
+func mustNew(t *testing.T, seed uint64, alphabet, size string) *payloadgen.Generator {
+	d, err := payloadgen.ParseSizeDist(size)
+	require.NoError(t, err)
+	g, err := payloadgen.New(&payloadgen.Options{Seed: seed, Alphabet: alphabet, Size: d})
+	require.NoError(t, err)
+	return g
+}
+
+// outputHash hashes the names, messages and payloads of the first n indexes.
+func outputHash(g *payloadgen.Generator, n uint64) uint64 {
+	h := fnv.New64a()
+	for i := uint64(0); i < n; i++ {
+		_, _ = h.Write([]byte(g.Name(i)))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(g.Message(i)))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write(g.Payload(i))
+		_, _ = h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+// TestGenerator_Golden locks the output of the generator: traces recorded against one version of
+// it must verify against the next. A change here is a breaking change to every stored seed.
+func TestGenerator_Golden(t *testing.T) {
+	tests := []struct {
+		alphabet string
+		size     string
+		hash     uint64
+	}{
+		{payloadgen.AlphabetASCII, "fixed:16", 0xb1f33373ae79b1e5},
+		{payloadgen.AlphabetUTF8, "uniform:0:64", 0x712b46181a45092c},
+		{payloadgen.AlphabetASCII, "zipf:1.2:1024", 0x8332faa6acc9b66b},
+	}
+	for _, tc := range tests {
+		g := mustNew(t, 42, tc.alphabet, tc.size)
+		assert.Equal(t, tc.hash, outputHash(g, 1000), "%s %s", tc.alphabet, tc.size)
+	}
+	assert.Equal(t, ",0eFiFQX8\"%!+7U2", mustNew(t, 42, payloadgen.AlphabetASCII, "fixed:16").Name(0))
+}
+
+func TestGenerator_Deterministic(t *testing.T) {
+	a := mustNew(t, 7, payloadgen.AlphabetUTF8, "uniform:1:100")
+	b := mustNew(t, 7, payloadgen.AlphabetUTF8, "uniform:1:100")
+	// Indexes are independent of the order they are generated in.
+	for i := uint64(100); i > 0; i-- {
+		assert.Equal(t, a.Name(i), b.Name(i))
+		assert.Equal(t, a.Message(i), b.Message(i))
+		assert.Equal(t, a.Payload(i), b.Payload(i))
+	}
+	assert.Equal(t, a.Requests(10, 5), b.Requests(10, 5))
+	assert.Equal(t, a.Name(12), a.Requests(10, 5)[2].Name)
+
+	other := mustNew(t, 8, payloadgen.AlphabetUTF8, "uniform:1:100")
+	assert.NotEqual(t, outputHash(a, 10), outputHash(other, 10))
+	// The name, message and payload of an index are drawn apart.
+	assert.NotEqual(t, a.Name(1), a.Message(1))
+}
+
+func TestGenerator_Alphabets(t *testing.T) {
+	ascii := mustNew(t, 1, payloadgen.AlphabetASCII, "uniform:0:50")
+	utf := mustNew(t, 1, payloadgen.AlphabetUTF8, "uniform:0:50")
+	runeLens := map[int]int{}
+	for i := uint64(0); i < 1000; i++ {
+		for _, s := range []string{ascii.Name(i), ascii.Message(i)} {
+			for _, c := range []byte(s) {
+				assert.True(t, c >= 0x20 && c <= 0x7e, "%q", s)
+			}
+		}
+		for _, s := range []string{utf.Name(i), utf.Message(i)} {
+			require.True(t, utf8.ValidString(s), "%q", s)
+			for _, c := range s {
+				runeLens[utf8.RuneLen(c)]++
+			}
+		}
+	}
+	for n := 1; n <= 4; n++ {
+		assert.NotZero(t, runeLens[n], "no %d-byte runes", n)
+	}
+}
+
+func TestGenerator_Stress(t *testing.T) {
+	g := mustNew(t, 1, payloadgen.AlphabetStress, "uniform:0:64")
+	var cjk, hangul, rtl, emoji, marks, zwj, lastMultiByte int
+	for i := uint64(0); i < 1000; i++ {
+		s := g.Name(i)
+		require.True(t, utf8.ValidString(s), "%q", s)
+		for _, c := range s {
+			switch {
+			case unicode.Is(unicode.Han, c):
+				cjk++
+			case unicode.Is(unicode.Hangul, c):
+				hangul++
+			case unicode.In(c, unicode.Hebrew, unicode.Arabic):
+				rtl++
+			case c >= 0x1f300:
+				emoji++
+			case unicode.Is(unicode.Mn, c):
+				marks++
+			case c == '\u200d':
+				zwj++
+			}
+		}
+		if c, n := utf8.DecodeLastRuneInString(s); n > 1 && c != utf8.RuneError {
+			lastMultiByte++
+		}
+	}
+	for what, n := range map[string]int{"cjk": cjk, "hangul": hangul, "rtl": rtl, "emoji": emoji, "marks": marks, "zwj": zwj} {
+		assert.NotZero(t, n, "no %s", what)
+	}
+	// Most text ends on the longest rune that fits, rather than on ASCII padding.
+	assert.Greater(t, lastMultiByte, 600)
+}
+
+func TestGenerator_Boundary(t *testing.T) {
+	sizes := map[int]int{}
+	for _, alphabet := range []string{payloadgen.AlphabetUTF8, payloadgen.AlphabetStress} {
+		g := mustNew(t, 1, alphabet, "boundary")
+		for i := uint64(0); i < 1000; i++ {
+			s := g.Name(i)
+			require.True(t, utf8.ValidString(s), "%q", s)
+			sizes[len(s)]++
+		}
+	}
+	for _, n := range []int{0, 1, 2, 3, 4, 5, 126, 127, 128, 129} {
+		assert.NotZero(t, sizes[n], "size %d", n)
+	}
+	assert.Len(t, sizes, 13)
+}
+
+func TestGenerator_Huffman(t *testing.T) {
+	favorable := mustNew(t, 1, payloadgen.AlphabetHuffmanFavorable, "uniform:1:64")
+	unfavorable := mustNew(t, 1, payloadgen.AlphabetHuffmanUnfavorable, "uniform:1:64")
+	for i := uint64(0); i < 1000; i++ {
+		// Huffman coding takes 5/8 of the bytes, rounded up.
+		v := favorable.MetadataValue(i)
+		assert.Equal(t, (uint64(len(v))*5+7)/8, hpack.HuffmanEncodeLength(v), "%q", v)
+		// And at least 11/8 of them.
+		v = unfavorable.MetadataValue(i)
+		assert.GreaterOrEqual(t, hpack.HuffmanEncodeLength(v), (uint64(len(v))*11+7)/8, "%q", v)
+		for _, c := range []byte(v) {
+			assert.True(t, c > 0x20 && c <= 0x7e, "%q", v)
+		}
+	}
+	assert.NotEqual(t, favorable.Name(1), favorable.MetadataValue(1))
+}
+
+var update = flag.Bool("update", false, "Rewrite the golden files of TestGenerator_Corpora.")
+
+// TestGenerator_Corpora locks the corpora that trace expectations are written against, one
+// quoted value per line of testdata/<name>.golden. Run with -update to rewrite them.
+func TestGenerator_Corpora(t *testing.T) {
+	tests := []struct {
+		name     string
+		alphabet string
+		size     string
+		value    func(g *payloadgen.Generator, index uint64) string
+	}{
+		{"stress_names", payloadgen.AlphabetStress, "uniform:0:48", (*payloadgen.Generator).Name},
+		{"stress_boundary_names", payloadgen.AlphabetStress, "boundary", (*payloadgen.Generator).Name},
+		{"huffman_favorable_metadata", payloadgen.AlphabetHuffmanFavorable, "uniform:1:48", (*payloadgen.Generator).MetadataValue},
+		{"huffman_unfavorable_metadata", payloadgen.AlphabetHuffmanUnfavorable, "uniform:1:48", (*payloadgen.Generator).MetadataValue},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			g := mustNew(t, 42, tc.alphabet, tc.size)
+			var b strings.Builder
+			fmt.Fprintf(&b, "# %s values 0 to 31 of seed 42, size %s.\n", tc.alphabet, tc.size)
+			for i := uint64(0); i < 32; i++ {
+				b.WriteString(strconv.Quote(tc.value(g, i)) + "\n")
+			}
+			path := filepath.Join("testdata", tc.name+".golden")
+			if *update {
+				require.NoError(t, os.WriteFile(path, []byte(b.String()), 0o644))
+			}
+			want, err := os.ReadFile(path)
+			require.NoError(t, err)
+			assert.Equal(t, string(want), b.String())
+		})
+	}
+}
+
+func TestGenerator_Sizes(t *testing.T) {
+	for _, alphabet := range []string{payloadgen.AlphabetASCII, payloadgen.AlphabetUTF8} {
+		fixed := mustNew(t, 1, alphabet, "fixed:13")
+		for i := uint64(0); i < 100; i++ {
+			// Sizes are in bytes, whatever the runes.
+			assert.Len(t, fixed.Name(i), 13)
+			assert.Len(t, fixed.Message(i), 13)
+			assert.Len(t, fixed.Payload(i), 13)
+		}
+	}
+
+	uniform := mustNew(t, 1, payloadgen.AlphabetASCII, "uniform:5:9")
+	seen := map[int]int{}
+	for i := uint64(0); i < 1000; i++ {
+		seen[len(uniform.Payload(i))]++
+	}
+	assert.Len(t, seen, 5)
+	for n := 5; n <= 9; n++ {
+		assert.InDelta(t, 200, seen[n], 50, "size %d", n)
+	}
+
+	zipf := mustNew(t, 1, payloadgen.AlphabetASCII, "zipf:1.5:100")
+	seen = map[int]int{}
+	for i := uint64(0); i < 10000; i++ {
+		n := len(zipf.Payload(i))
+		require.LessOrEqual(t, n, 100)
+		seen[n]++
+	}
+	// P(0) / P(1) = 2^1.5.
+	assert.InDelta(t, 2.83, float64(seen[0])/float64(seen[1]), 0.3)
+	assert.Greater(t, seen[1], seen[10])
+}
+
+func TestParseSizeDist(t *testing.T) {
+	d, err := payloadgen.ParseSizeDist("zipf:1.1:256")
+	require.NoError(t, err)
+	assert.Equal(t, payloadgen.SizeDist{Kind: payloadgen.SizeZipf, Exponent: 1.1, Max: 256}, d)
+	d, err = payloadgen.ParseSizeDist("uniform:1:2")
+	require.NoError(t, err)
+	assert.Equal(t, payloadgen.SizeDist{Kind: payloadgen.SizeUniform, Min: 1, Max: 2}, d)
+
+	for _, s := range []string{"", "fixed", "fixed:-1", "fixed:x", "uniform:3:2", "uniform:1", "zipf:0:10", "zipf:1:-1", "normal:1:2", "fixed:2000000", "boundary:1"} {
+		_, err := payloadgen.ParseSizeDist(s)
+		assert.Error(t, err, s)
+	}
+	_, err = payloadgen.New(&payloadgen.Options{Alphabet: "latin1", Size: payloadgen.SizeDist{Kind: payloadgen.SizeFixed}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetpb
+
+import (
+	"hash/crc32"
+	"strconv"
+)
+
+// StreamChecksumTrailer is the trailer in which servers that checksum replies send the
+// StreamChecksum of every message of a reply stream, as a decimal number.
+const StreamChecksumTrailer = "greet-stream-checksum"
+
+// MessageChecksum returns the checksum of a reply message, as set in HelloReply.Checksum.
+func MessageChecksum(msg string) uint32 {
+	return crc32.ChecksumIEEE([]byte(msg))
+}
+
+// SetChecksum sets the checksum of m to that of its message.
+func (m *HelloReply) SetChecksum() {
+	m.Checksum = MessageChecksum(m.Message)
+}
+
+// VerifyChecksum returns true if the checksum of m matches its message.
+func (m *HelloReply) VerifyChecksum() bool {
+	return m.Checksum == MessageChecksum(m.Message)
+}
+
+// StreamChecksum is the running CRC-32 (IEEE) of the messages of a reply stream, as if they were
+// concatenated. The zero value is the checksum of an empty stream.
+type StreamChecksum uint32
+
+// Add adds the message of the next reply of the stream.
+func (c *StreamChecksum) Add(msg string) {
+	*c = StreamChecksum(crc32.Update(uint32(*c), crc32.IEEETable, []byte(msg)))
+}
+
+// String formats c for StreamChecksumTrailer.
+func (c StreamChecksum) String() string {
+	return strconv.FormatUint(uint64(c), 10)
+}
+
+// ParseStreamChecksum parses the value of StreamChecksumTrailer.
+func ParseStreamChecksum(s string) (StreamChecksum, error) {
+	v, err := strconv.ParseUint(s, 10, 32)
+	return StreamChecksum(v), err
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetpb_test
+
+import (
+	"hash/crc32"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+func TestHelloReply_Checksum(t *testing.T) {
+	reply := &pb.HelloReply{Message: "Hello pixie"}
+	assert.False(t, reply.VerifyChecksum())
+	reply.SetChecksum()
+	assert.Equal(t, crc32.ChecksumIEEE([]byte("Hello pixie")), reply.Checksum)
+	assert.True(t, reply.VerifyChecksum())
+
+	reply.Message = "Hello pixiE"
+	assert.False(t, reply.VerifyChecksum())
+}
+
+func TestStreamChecksum(t *testing.T) {
+	var c pb.StreamChecksum
+	assert.Equal(t, "0", c.String())
+	for _, msg := range []string{"Hello a", "Hello b", ""} {
+		c.Add(msg)
+	}
+	assert.Equal(t, crc32.ChecksumIEEE([]byte("Hello aHello b")), uint32(c))
+
+	parsed, err := pb.ParseStreamChecksum(c.String())
+	require.NoError(t, err)
+	assert.Equal(t, c, parsed)
+
+	for _, s := range []string{"", "-1", "4294967296", "abc"} {
+		_, err := pb.ParseStreamChecksum(s)
+		assert.Error(t, err, s)
+	}
+}
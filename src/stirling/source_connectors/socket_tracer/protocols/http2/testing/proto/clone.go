@@ -0,0 +1,76 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetpb
+
+// Clone returns a deep copy of m, or nil if m is nil.
+func (m *HelloRequest) Clone() *HelloRequest {
+	if m == nil {
+		return nil
+	}
+	c := &HelloRequest{}
+	m.CopyInto(c)
+	return c
+}
+
+// CopyInto overwrites dst with a deep copy of m, reusing dst's storage where possible.
+// A nil m resets dst.
+func (m *HelloRequest) CopyInto(dst *HelloRequest) {
+	if m == nil {
+		dst.Reset()
+		return
+	}
+	// Strings are immutable, so copying the header is a deep copy. Fields that carry []byte or
+	// message values must be copied explicitly here.
+	dst.Name = m.Name
+	dst.Count = m.Count
+	dst.Payload = copyBytes(dst.Payload, m.Payload)
+}
+
+// Clone returns a deep copy of m, or nil if m is nil.
+func (m *HelloReply) Clone() *HelloReply {
+	if m == nil {
+		return nil
+	}
+	c := &HelloReply{}
+	m.CopyInto(c)
+	return c
+}
+
+// CopyInto overwrites dst with a deep copy of m, reusing dst's storage where possible.
+// A nil m resets dst.
+func (m *HelloReply) CopyInto(dst *HelloReply) {
+	if m == nil {
+		dst.Reset()
+		return
+	}
+	dst.Message = m.Message
+	dst.InstanceId = m.InstanceId
+	dst.Checksum = m.Checksum
+	dst.Payload = copyBytes(dst.Payload, m.Payload)
+	dst.BytesReceived = m.BytesReceived
+}
+
+// copyBytes returns a copy of src, in the storage of dst if it is large enough. A nil src stays
+// nil.
+func copyBytes(dst, src []byte) []byte {
+	if src == nil {
+		return nil
+	}
+	return append(dst[:0], src...)
+}
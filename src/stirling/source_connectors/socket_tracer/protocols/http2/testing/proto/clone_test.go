@@ -0,0 +1,78 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetpb_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+func TestHelloRequest_Clone(t *testing.T) {
+	orig := &pb.HelloRequest{Name: "pixie", Count: 7, Payload: []byte("sealed")}
+	c := orig.Clone()
+	assert.Equal(t, orig, c)
+	assert.NotSame(t, orig, c)
+
+	orig.Name = "changed"
+	orig.Count = 1
+	orig.Payload[0] = 'S'
+	assert.Equal(t, "pixie", c.Name)
+	assert.Equal(t, int32(7), c.Count)
+	assert.Equal(t, []byte("sealed"), c.Payload)
+}
+
+func TestHelloReply_Clone(t *testing.T) {
+	orig := &pb.HelloReply{Message: "Hello pixie", InstanceId: "0", Checksum: 1, Payload: []byte("sealed"), BytesReceived: 6}
+	c := orig.Clone()
+	assert.Equal(t, orig, c)
+	assert.NotSame(t, orig, c)
+
+	orig.Message = "changed"
+	orig.InstanceId = "1"
+	orig.Checksum = 2
+	orig.Payload[0] = 'S'
+	assert.Equal(t, []byte("sealed"), c.Payload)
+	assert.Equal(t, "Hello pixie", c.Message)
+	assert.Equal(t, "0", c.InstanceId)
+	assert.Equal(t, uint32(1), c.Checksum)
+}
+
+func TestClone_Nil(t *testing.T) {
+	var req *pb.HelloRequest
+	var reply *pb.HelloReply
+	assert.Nil(t, req.Clone())
+	assert.Nil(t, reply.Clone())
+}
+
+func TestCopyInto(t *testing.T) {
+	dst := &pb.HelloRequest{Name: "old", Count: 1}
+	(&pb.HelloRequest{Name: "new"}).CopyInto(dst)
+	assert.Equal(t, &pb.HelloRequest{Name: "new"}, dst)
+
+	var nilReq *pb.HelloRequest
+	nilReq.CopyInto(dst)
+	assert.Equal(t, &pb.HelloRequest{}, dst)
+
+	replyDst := &pb.HelloReply{Message: "old"}
+	(&pb.HelloReply{Message: "new"}).CopyInto(replyDst)
+	assert.Equal(t, &pb.HelloReply{Message: "new"}, replyDst)
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetpb
+
+import (
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/proto"
+)
+
+// sizedMarshaler is implemented by the generated greetpb messages.
+type sizedMarshaler interface {
+	Size() int
+	MarshalToSizedBuffer(dAtA []byte) (int, error)
+}
+
+// SizedCodec is a gRPC codec that marshals the greetpb messages back to front, with their
+// generated MarshalToSizedBuffer, into a buffer sized by a single call to Size, and unmarshals them
+// with UnmarshalUntrusted, since they come off the wire. The default codec first wraps them into
+// protobuf API v2 messages, which costs more than marshaling them at the sizes the workload sends.
+// Other messages, such as those of the health and reflection services, are left to the default
+// codec.
+//
+// It is opt-in, with grpc.ForceCodec or grpc.ForceServerCodec. Its name is that of the default
+// codec, so that peers without it understand the calls it makes, but clients that force it send
+// the content-type "application/grpc+proto" rather than "application/grpc".
+type SizedCodec struct{}
+
+// Marshal implements encoding.Codec.
+func (SizedCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(sizedMarshaler)
+	if !ok {
+		return encoding.GetCodec(proto.Name).Marshal(v)
+	}
+	b := make([]byte, m.Size())
+	n, err := m.MarshalToSizedBuffer(b)
+	if err != nil {
+		return nil, err
+	}
+	return b[len(b)-n:], nil
+}
+
+// Unmarshal implements encoding.Codec.
+func (SizedCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(Message)
+	if !ok {
+		return encoding.GetCodec(proto.Name).Unmarshal(data, v)
+	}
+	m.Reset()
+	return UnmarshalUntrusted(data, m)
+}
+
+// Name implements encoding.Codec.
+func (SizedCodec) Name() string {
+	return proto.Name
+}
+
+// DeterministicCodec is a gRPC codec that marshals the greetpb messages with MarshalDeterministic,
+// so that the bytes on the wire are the same on every run, and unmarshals them as SizedCodec does.
+// Other messages, such as those of the health and reflection services, are left to the default
+// codec.
+//
+// Like SizedCodec, it is opt-in, with grpc.ForceCodec or grpc.ForceServerCodec, and is named after
+// the default codec.
+type DeterministicCodec struct{}
+
+// Marshal implements encoding.Codec.
+func (DeterministicCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(generatedMessage)
+	if !ok {
+		return encoding.GetCodec(proto.Name).Marshal(v)
+	}
+	return MarshalDeterministic(m)
+}
+
+// Unmarshal implements encoding.Codec.
+func (DeterministicCodec) Unmarshal(data []byte, v interface{}) error {
+	return SizedCodec{}.Unmarshal(data, v)
+}
+
+// Name implements encoding.Codec.
+func (DeterministicCodec) Name() string {
+	return proto.Name
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetpb_test
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/proto"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// codecStrings covers empty and very large fields, and the lengths at which the length prefix
+// grows by a byte.
+func codecStrings(rng *rand.Rand) []string {
+	var strs []string
+	for _, n := range []int{0, 1, 127, 128, 16383, 16384, 2097151, 2097152} {
+		strs = append(strs, strings.Repeat("x", n))
+	}
+	strs = append(strs, "héllo, 世界", string([]byte{0, 0xff, 0x80}))
+	for i := 0; i < 20; i++ {
+		b := make([]byte, rng.Intn(300))
+		rng.Read(b)
+		strs = append(strs, string(b))
+	}
+	return strs
+}
+
+// codecCorpus returns a large set of messages, mixing empty and max-size fields.
+func codecCorpus() []interface{} {
+	rng := rand.New(rand.NewSource(1))
+	strs := codecStrings(rng)
+	counts := []int32{0, 1, -1, 127, 128, pb.MaxCount, math.MaxInt32, math.MinInt32}
+	checksums := []uint32{0, 1, 127, 128, math.MaxUint32}
+
+	corpus := []interface{}{&pb.HelloRequest{}, &pb.HelloReply{}}
+	for _, name := range strs {
+		for _, count := range counts {
+			corpus = append(corpus, &pb.HelloRequest{Name: name, Count: count})
+		}
+	}
+	for i, msg := range strs {
+		for _, sum := range checksums {
+			corpus = append(corpus,
+				&pb.HelloReply{Message: msg, InstanceId: strs[(i+1)%len(strs)], Checksum: sum},
+				&pb.HelloReply{InstanceId: msg, Checksum: sum})
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		corpus = append(corpus,
+			&pb.HelloRequest{Name: strs[rng.Intn(len(strs))], Count: rng.Int31() - rng.Int31()},
+			&pb.HelloReply{Message: strs[rng.Intn(len(strs))], InstanceId: strs[rng.Intn(len(strs))], Checksum: rng.Uint32()})
+	}
+	return corpus
+}
+
+type marshaler interface {
+	Marshal() ([]byte, error)
+}
+
+func TestSizedCodec_MatchesMarshal(t *testing.T) {
+	defaultCodec := encoding.GetCodec(proto.Name)
+	for i, m := range codecCorpus() {
+		got, err := pb.SizedCodec{}.Marshal(m)
+		require.NoError(t, err)
+		want, err := m.(marshaler).Marshal()
+		require.NoError(t, err)
+		require.Equal(t, want, got, "message #%d", i)
+		want, err = defaultCodec.Marshal(m)
+		require.NoError(t, err)
+		require.Equal(t, want, got, "message #%d", i)
+	}
+}
+
+func TestSizedCodec_RoundTrip(t *testing.T) {
+	for i, m := range codecCorpus() {
+		b, err := pb.SizedCodec{}.Marshal(m)
+		require.NoError(t, err)
+		switch m := m.(type) {
+		case *pb.HelloRequest:
+			got := &pb.HelloRequest{}
+			require.NoError(t, pb.SizedCodec{}.Unmarshal(b, got))
+			require.True(t, m.Equal(got), "message #%d", i)
+		case *pb.HelloReply:
+			got := &pb.HelloReply{}
+			require.NoError(t, pb.SizedCodec{}.Unmarshal(b, got))
+			require.True(t, m.Equal(got), "message #%d", i)
+		}
+	}
+}
+
+func TestSizedCodec_UnmarshalResets(t *testing.T) {
+	b, err := pb.SizedCodec{}.Marshal(&pb.HelloReply{Message: "Hello"})
+	require.NoError(t, err)
+	got := &pb.HelloReply{Message: "stale", InstanceId: "stale", Checksum: 1}
+	require.NoError(t, pb.SizedCodec{}.Unmarshal(b, got))
+	assert.Equal(t, &pb.HelloReply{Message: "Hello"}, got)
+}
+
+func TestSizedCodec_UnmarshalChecksLengths(t *testing.T) {
+	data := lengthField(1, 1<<32+3, []byte("abc"))
+	for _, codec := range []encoding.Codec{pb.SizedCodec{}, pb.DeterministicCodec{}} {
+		err := codec.Unmarshal(data, &pb.HelloRequest{})
+		var lengthErr *pb.LengthError
+		assert.True(t, errors.As(err, &lengthErr), "%T: %v", codec, err)
+	}
+}
+
+func TestSizedCodec_OtherMessages(t *testing.T) {
+	m := &healthpb.HealthCheckRequest{Service: "greet"}
+	got, err := pb.SizedCodec{}.Marshal(m)
+	require.NoError(t, err)
+	want, err := encoding.GetCodec(proto.Name).Marshal(m)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	decoded := &healthpb.HealthCheckRequest{}
+	require.NoError(t, pb.SizedCodec{}.Unmarshal(got, decoded))
+	assert.Equal(t, "greet", decoded.Service)
+
+	_, err = pb.SizedCodec{}.Marshal("not a message")
+	assert.Error(t, err)
+}
+
+func TestDeterministicCodec_MatchesMarshalDeterministic(t *testing.T) {
+	for i, m := range codecCorpus() {
+		got, err := pb.DeterministicCodec{}.Marshal(m)
+		require.NoError(t, err)
+		want, err := pb.MarshalDeterministic(m.(deterministicMessage))
+		require.NoError(t, err)
+		require.Equal(t, want, got, "message #%d", i)
+	}
+}
+
+func TestDeterministicCodec_RoundTrip(t *testing.T) {
+	want := &pb.HelloReply{Message: "Hello pixie", InstanceId: "server-1", Checksum: 1}
+	b, err := pb.DeterministicCodec{}.Marshal(want)
+	require.NoError(t, err)
+	got := &pb.HelloReply{Message: "stale", InstanceId: "stale", Checksum: 2}
+	require.NoError(t, pb.DeterministicCodec{}.Unmarshal(b, got))
+	assert.Equal(t, want, got)
+}
+
+func TestDeterministicCodec_OtherMessages(t *testing.T) {
+	m := &healthpb.HealthCheckRequest{Service: "greet"}
+	got, err := pb.DeterministicCodec{}.Marshal(m)
+	require.NoError(t, err)
+	want, err := encoding.GetCodec(proto.Name).Marshal(m)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	_, err = pb.DeterministicCodec{}.Marshal("not a message")
+	assert.Error(t, err)
+}
+
+func benchmarkMessages() map[string]interface{} {
+	return map[string]interface{}{
+		"request": &pb.HelloRequest{Name: "pixie", Count: 3},
+		"reply":   &pb.HelloReply{Message: "Hello pixie", InstanceId: "server-1", Checksum: 0xdeadbeef},
+		"reply16KB": &pb.HelloReply{
+			Message: strings.Repeat(".", 16<<10), InstanceId: "server-1", Checksum: 0xdeadbeef,
+		},
+	}
+}
+
+func BenchmarkCodec_Marshal(b *testing.B) {
+	for _, codec := range []encoding.Codec{encoding.GetCodec(proto.Name), pb.SizedCodec{}, pb.DeterministicCodec{}} {
+		for name, m := range benchmarkMessages() {
+			b.Run(fmt.Sprintf("%T/%s", codec, name), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := codec.Marshal(m); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkCodec_Unmarshal(b *testing.B) {
+	for _, codec := range []encoding.Codec{encoding.GetCodec(proto.Name), pb.SizedCodec{}, pb.DeterministicCodec{}} {
+		for name, m := range benchmarkMessages() {
+			data, err := codec.Marshal(m)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(fmt.Sprintf("%T/%s", codec, name), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					var v interface{} = &pb.HelloRequest{}
+					if _, ok := m.(*pb.HelloReply); ok {
+						v = &pb.HelloReply{}
+					}
+					if err := codec.Unmarshal(data, v); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package descriptors resolves gRPC methods of the greet services to their message descriptors
+// at runtime, so that captured payloads can be decoded without the generated Go types.
+package descriptors
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	gogoproto "github.com/gogo/protobuf/proto"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	// Registers greet.proto.
+	_ "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// GreetProtoFile is the name greet.proto is registered under.
+const GreetProtoFile = "src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto/greet.proto"
+
+// NotFoundError is returned when a file, service or method is not known.
+type NotFoundError struct {
+	Name string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s not found", e.Name)
+}
+
+// Registry holds the descriptors of a proto file and everything it imports.
+type Registry struct {
+	files *protoregistry.Files
+}
+
+// Load parses the descriptor of filename, and of every file it imports, from the descriptors
+// registered by the generated gogo code.
+func Load(filename string) (*Registry, error) {
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := collect(filename, map[string]bool{}, set); err != nil {
+		return nil, err
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, err
+	}
+	return &Registry{files: files}, nil
+}
+
+// LoadGreet loads the descriptors of greet.proto.
+func LoadGreet() (*Registry, error) {
+	return Load(GreetProtoFile)
+}
+
+// collect adds filename and its imports to set, imports first.
+func collect(filename string, seen map[string]bool, set *descriptorpb.FileDescriptorSet) error {
+	if seen[filename] {
+		return nil
+	}
+	seen[filename] = true
+
+	gz := gogoproto.FileDescriptor(filename)
+	if gz == nil {
+		return &NotFoundError{Name: filename}
+	}
+	r, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		return fmt.Errorf("failed to decompress descriptor of %s: %w", filename, err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to decompress descriptor of %s: %w", filename, err)
+	}
+	fd := &descriptorpb.FileDescriptorProto{}
+	if err := proto.Unmarshal(b, fd); err != nil {
+		return fmt.Errorf("failed to parse descriptor of %s: %w", filename, err)
+	}
+
+	for _, dep := range fd.GetDependency() {
+		if err := collect(dep, seen, set); err != nil {
+			return err
+		}
+	}
+	set.File = append(set.File, fd)
+	return nil
+}
+
+// MethodInfo describes a single gRPC method.
+type MethodInfo struct {
+	Method protoreflect.MethodDescriptor
+	Input  protoreflect.MessageDescriptor
+	Output protoreflect.MessageDescriptor
+}
+
+// MethodInfo resolves a gRPC method path, in the form "/package.Service/Method", as seen in the
+// :path header of a request.
+func (r *Registry) MethodInfo(fullMethod string) (*MethodInfo, error) {
+	service := strings.TrimPrefix(fullMethod, "/")
+	i := strings.Index(service, "/")
+	if i < 0 {
+		return nil, &NotFoundError{Name: fullMethod}
+	}
+	service, method := service[:i], service[i+1:]
+	d, err := r.files.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil, &NotFoundError{Name: fullMethod}
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, &NotFoundError{Name: fullMethod}
+	}
+	md := sd.Methods().ByName(protoreflect.Name(method))
+	if md == nil {
+		return nil, &NotFoundError{Name: fullMethod}
+	}
+	return &MethodInfo{Method: md, Input: md.Input(), Output: md.Output()}, nil
+}
+
+// DecodeRequest decodes the serialized request message of the method.
+func (m *MethodInfo) DecodeRequest(b []byte) (*dynamicpb.Message, error) {
+	return decode(m.Input, b)
+}
+
+// DecodeResponse decodes the serialized response message of the method.
+func (m *MethodInfo) DecodeResponse(b []byte) (*dynamicpb.Message, error) {
+	return decode(m.Output, b)
+}
+
+func decode(d protoreflect.MessageDescriptor, b []byte) (*dynamicpb.Message, error) {
+	msg := dynamicpb.NewMessage(d)
+	if err := proto.Unmarshal(b, msg); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", d.FullName(), err)
+	}
+	return msg, nil
+}
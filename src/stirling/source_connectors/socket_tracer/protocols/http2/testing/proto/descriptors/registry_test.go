@@ -0,0 +1,132 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package descriptors_test
+
+import (
+	"encoding/hex"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto/descriptors"
+)
+
+func TestRegistry_DecodeRequest(t *testing.T) {
+	r, err := descriptors.LoadGreet()
+	require.NoError(t, err)
+
+	info, err := r.MethodInfo("/px.stirling.protocols.http2.testing.Greeter/SayHello")
+	require.NoError(t, err)
+	assert.Equal(t, "px.stirling.protocols.http2.testing.HelloRequest", string(info.Input.FullName()))
+	assert.Equal(t, "px.stirling.protocols.http2.testing.HelloReply", string(info.Output.FullName()))
+
+	// HelloRequest{name: "pixie", count: 3}, as captured off the wire.
+	payload := []byte{0x0a, 0x05, 'p', 'i', 'x', 'i', 'e', 0x10, 0x03}
+	msg, err := info.DecodeRequest(payload)
+	require.NoError(t, err)
+
+	fields := info.Input.Fields()
+	assert.Equal(t, "pixie", msg.Get(fields.ByName("name")).String())
+	assert.Equal(t, int64(3), msg.Get(fields.ByName("count")).Int())
+}
+
+func TestRegistry_DecodeStreamingResponse(t *testing.T) {
+	r, err := descriptors.LoadGreet()
+	require.NoError(t, err)
+
+	info, err := r.MethodInfo("/px.stirling.protocols.http2.testing.StreamingGreeter/SayHelloServerStreaming")
+	require.NoError(t, err)
+	assert.True(t, info.Method.IsStreamingServer())
+	assert.False(t, info.Method.IsStreamingClient())
+
+	// HelloReply{message: "Hello"}.
+	msg, err := info.DecodeResponse([]byte{0x0a, 0x05, 'H', 'e', 'l', 'l', 'o'})
+	require.NoError(t, err)
+	assert.Equal(t, "Hello", msg.Get(info.Output.Fields().ByName("message")).String())
+}
+
+func TestRegistry_NotFound(t *testing.T) {
+	r, err := descriptors.LoadGreet()
+	require.NoError(t, err)
+
+	for _, method := range []string{
+		"/px.stirling.protocols.http2.testing.Greeter/SayGoodbye",
+		"/px.stirling.protocols.http2.testing.Farewell/SayGoodbye",
+		"/px.stirling.protocols.http2.testing.HelloRequest/SayHello",
+		"SayHello",
+	} {
+		_, err := r.MethodInfo(method)
+		var notFound *descriptors.NotFoundError
+		assert.True(t, errors.As(err, &notFound), method)
+	}
+
+	_, err = descriptors.Load("missing.proto")
+	var notFound *descriptors.NotFoundError
+	assert.True(t, errors.As(err, &notFound))
+}
+
+func TestRegistry_DecodeMalformed(t *testing.T) {
+	r, err := descriptors.LoadGreet()
+	require.NoError(t, err)
+	info, err := r.MethodInfo("/px.stirling.protocols.http2.testing.Greeter/SayHello")
+	require.NoError(t, err)
+
+	// A length-delimited name that runs past the end of the payload.
+	_, err = info.DecodeRequest([]byte{0x0a, 0x10, 'p'})
+	assert.Error(t, err)
+}
+
+// TestRegistry_CountInterop checks that the gogo encoding of HelloRequest.Count, negative values
+// included, is the one google.golang.org/protobuf reads and writes.
+func TestRegistry_CountInterop(t *testing.T) {
+	r, err := descriptors.LoadGreet()
+	require.NoError(t, err)
+	info, err := r.MethodInfo("/px.stirling.protocols.http2.testing.Greeter/SayHello")
+	require.NoError(t, err)
+	countField := info.Input.Fields().ByName("count")
+
+	for _, count := range []int32{1, math.MaxInt32, -1, -2, math.MinInt32} {
+		ours, err := (&pb.HelloRequest{Name: "pixie", Count: count}).Marshal()
+		require.NoError(t, err)
+		msg, err := info.DecodeRequest(ours)
+		require.NoError(t, err)
+		assert.Equal(t, int64(count), msg.Get(countField).Int())
+
+		theirs := dynamicpb.NewMessage(info.Input)
+		theirs.Set(info.Input.Fields().ByName("name"), protoreflect.ValueOfString("pixie"))
+		theirs.Set(countField, protoreflect.ValueOfInt32(count))
+		b, err := proto.MarshalOptions{Deterministic: true}.Marshal(theirs)
+		require.NoError(t, err)
+		assert.Equal(t, hex.EncodeToString(ours), hex.EncodeToString(b), "count %d", count)
+	}
+
+	// The 5-byte encoding of -1 some encoders write decodes the same on both sides.
+	truncated, err := hex.DecodeString("10ffffffff0f")
+	require.NoError(t, err)
+	msg, err := info.DecodeRequest(truncated)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), msg.Get(countField).Int())
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetpb
+
+import (
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/runtime/protoimpl"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// generatedMessage is implemented by the generated gogo/protobuf messages, such as those of
+// greetpb.
+type generatedMessage interface {
+	Reset()
+	String() string
+	ProtoMessage()
+	Descriptor() ([]byte, []int)
+	Marshal() ([]byte, error)
+}
+
+// MarshalDeterministic marshals m so that equal messages always marshal to the same bytes, whatever
+// the build or the run: map entries are sorted by key, where the generated Marshal writes them in
+// map iteration order. gogo/protobuf cannot do it itself, as its deterministic mode still calls the
+// generated Marshal. The messages without map fields, at any depth, marshal to the same bytes as
+// with Marshal.
+//
+// The messages with map fields are marshaled, then decoded into a dynamic message and marshaled
+// again by the protobuf API v2 runtime, which is much slower than Marshal. So it is meant for the
+// bytes that are recorded or compared against goldens rather than for every call.
+func MarshalDeterministic(m generatedMessage) ([]byte, error) {
+	b, err := m.Marshal()
+	if err != nil || len(b) == 0 {
+		return b, err
+	}
+	desc := protoimpl.X.MessageDescriptorOf(m)
+	if !hasMapFields(desc) {
+		return b, nil
+	}
+	dyn := dynamicpb.NewMessage(desc)
+	if err := proto.Unmarshal(b, dyn); err != nil {
+		return nil, err
+	}
+	return proto.MarshalOptions{Deterministic: true}.Marshal(dyn)
+}
+
+// mapFields caches whether messages have map fields, by descriptor.
+var mapFields sync.Map
+
+// hasMapFields returns whether desc, or any message it holds, has a map field.
+func hasMapFields(desc protoreflect.MessageDescriptor) bool {
+	if has, ok := mapFields.Load(desc); ok {
+		return has.(bool)
+	}
+	has := findMapFields(desc, map[protoreflect.FullName]bool{})
+	mapFields.Store(desc, has)
+	return has
+}
+
+func findMapFields(desc protoreflect.MessageDescriptor, seen map[protoreflect.FullName]bool) bool {
+	if seen[desc.FullName()] {
+		return false
+	}
+	seen[desc.FullName()] = true
+	fields := desc.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		f := fields.Get(i)
+		if f.IsMap() {
+			return true
+		}
+		if f.Message() != nil && findMapFields(f.Message(), seen) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetpb_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gogo/protobuf/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+var update = flag.Bool("update", false, "Rewrite the golden files of TestMarshalDeterministic_Golden and TestString_Golden.")
+
+type deterministicMessage interface {
+	Reset()
+	String() string
+	ProtoMessage()
+	Descriptor() ([]byte, []int)
+	Marshal() ([]byte, error)
+}
+
+// goldenMessages are a representative set of the greetpb messages: empty, scalar, repeated and
+// nested fields, and the lengths at which a length prefix grows by a byte.
+var goldenMessages = []struct {
+	name string
+	msg  deterministicMessage
+}{
+	{"empty_request", &pb.HelloRequest{}},
+	{"request", &pb.HelloRequest{Name: "pixie", Count: 3}},
+	{"request_negative_count", &pb.HelloRequest{Name: "pixie", Count: -1}},
+	{"request_utf8", &pb.HelloRequest{Name: "héllo, 世界"}},
+	{"request_128_byte_name", &pb.HelloRequest{Name: strings.Repeat("x", 128), Count: pb.MaxCount}},
+	{"reply", &pb.HelloReply{Message: "Hello pixie", InstanceId: "server-1", Checksum: 0xdeadbeef}},
+	{"reply_max_checksum", &pb.HelloReply{Message: "Hello", Checksum: math.MaxUint32}},
+	{"stats_reply", &pb.GetStatsReply{Counts: []*pb.CallCount{
+		{Method: "/px.stirling.protocols.http2.testing.Greeter/SayHello", Code: "OK", Count: 42},
+		{Method: "/px.stirling.protocols.http2.testing.Greeter/SayHello", Code: "Unavailable", Count: 1},
+	}}},
+	{"feature_matrix", &pb.FeatureMatrix{
+		Tls:              true,
+		TlsMinVersion:    "1.2",
+		TlsMaxVersion:    "1.3",
+		Compressors:      []string{"gzip", "zstd"},
+		Codec:            "deterministic",
+		MaxRecvMsgSize:   math.MaxInt32,
+		MaxSendMsgSize:   4 << 20,
+		Faults:           &pb.FaultFeatures{LatencyMillis: 25, ErrorRate: 0.5, Code: "Unavailable"},
+		Checksums:        true,
+		ValidateRequests: true,
+		InstanceId:       "server-1",
+		Build:            &pb.BuildInfo{GoVersion: "go1.20.3", Version: "(devel)", Revision: "8300f66"},
+	}},
+}
+
+// TestMarshalDeterministic_Golden locks the wire bytes of goldenMessages, one "name hex" line per
+// message of testdata/marshal.golden, so that any codegen or runtime change that alters them
+// fails. Run with -update to rewrite it.
+func TestMarshalDeterministic_Golden(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("# The wire bytes of the greetpb messages of goldenMessages, in hex.\n")
+	for _, tc := range goldenMessages {
+		got, err := pb.MarshalDeterministic(tc.msg)
+		require.NoError(t, err)
+		want, err := tc.msg.Marshal()
+		require.NoError(t, err)
+		assert.Equal(t, want, got, tc.name)
+		fmt.Fprintf(&b, "%s %s\n", tc.name, hex.EncodeToString(got))
+	}
+	path := filepath.Join("testdata", "marshal.golden")
+	if *update {
+		require.NoError(t, os.WriteFile(path, []byte(b.String()), 0o644))
+	}
+	want, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, string(want), b.String())
+}
+
+func TestMarshalDeterministic_MatchesMarshal(t *testing.T) {
+	for i, m := range codecCorpus() {
+		got, err := pb.MarshalDeterministic(m.(deterministicMessage))
+		require.NoError(t, err)
+		want, err := m.(marshaler).Marshal()
+		require.NoError(t, err)
+		require.Equal(t, want, got, "message #%d", i)
+	}
+}
+
+// types.Struct has a map field, which its generated Marshal writes in map iteration order, as
+// the generated greetpb messages would.
+func TestMarshalDeterministic_SortsMapEntries(t *testing.T) {
+	m := &types.Struct{Fields: make(map[string]*types.Value)}
+	var keys []string
+	for i := 0; i < 32; i++ {
+		key := fmt.Sprintf("key-%02d", 31-i)
+		keys = append(keys, key)
+		m.Fields[key] = &types.Value{Kind: &types.Value_NumberValue{NumberValue: float64(i)}}
+	}
+	sort.Strings(keys)
+
+	want, err := pb.MarshalDeterministic(m)
+	require.NoError(t, err)
+	last := -1
+	for _, key := range keys {
+		i := bytes.Index(want, []byte(key))
+		require.Greater(t, i, last, "%s is out of order", key)
+		last = i
+	}
+	for i := 0; i < 20; i++ {
+		got, err := pb.MarshalDeterministic(m)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+
+	decoded := &types.Struct{}
+	require.NoError(t, decoded.Unmarshal(want))
+	assert.True(t, m.Equal(decoded))
+}
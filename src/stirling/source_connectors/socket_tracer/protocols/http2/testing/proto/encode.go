@@ -0,0 +1,38 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetpb
+
+import "fmt"
+
+// EncodeCanonical marshals m with MarshalDeterministic, rejecting a negative Count with a
+// *ValidationError.
+//
+// Like every proto3 int32, a negative Count is sign-extended to 64 bits and encoded as a 10-byte
+// varint, which Size and MarshalTo agree on and conforming runtimes decode back to the same value.
+// Decoders that read int32 varints as 32 bits, or that reject 10-byte ones, still get it wrong, and
+// greet clients never mean to send a negative count. So canonical encodings leave them out rather
+// than normalize them, e.g. to 0, which would silently change the request.
+func EncodeCanonical(m *HelloRequest) ([]byte, error) {
+	if m == nil {
+		return nil, &ValidationError{Field: "request", Reason: "must not be nil"}
+	}
+	if m.Count < 0 {
+		return nil, &ValidationError{Field: "count", Reason: fmt.Sprintf("must not be negative, got %d", m.Count)}
+	}
+	return MarshalDeterministic(m)
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetpb_test
+
+import (
+	"encoding/hex"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// countEncodings are the wire encodings of HelloRequest{Count: count}: the tag of field 2, 0x10,
+// followed by the varint of count sign-extended to 64 bits.
+var countEncodings = []struct {
+	count int32
+	hex   string
+}{
+	{0, ""},
+	{1, "1001"},
+	{math.MaxInt32, "10ffffffff07"},
+	{-1, "10ffffffffffffffffff01"},
+	{-2, "10feffffffffffffffff01"},
+	{math.MinInt32, "1080808080f8ffffffff01"},
+}
+
+func TestHelloRequest_CountWireEncoding(t *testing.T) {
+	for _, tc := range countEncodings {
+		req := &pb.HelloRequest{Count: tc.count}
+		b, err := req.Marshal()
+		require.NoError(t, err)
+		assert.Equal(t, tc.hex, hex.EncodeToString(b), "count %d", tc.count)
+		assert.Equal(t, len(b), req.Size(), "count %d", tc.count)
+
+		decoded := &pb.HelloRequest{}
+		require.NoError(t, decoded.Unmarshal(b))
+		assert.Equal(t, tc.count, decoded.Count)
+	}
+}
+
+func TestHelloRequest_DecodesTruncatedNegativeCount(t *testing.T) {
+	// Some encoders write a negative int32 as its 32-bit two's complement, in 5 bytes. proto3
+	// decoders truncate varints to 32 bits for int32 fields, so it still reads back as -1.
+	b, err := hex.DecodeString("10ffffffff0f")
+	require.NoError(t, err)
+	req := &pb.HelloRequest{}
+	require.NoError(t, req.Unmarshal(b))
+	assert.Equal(t, int32(-1), req.Count)
+}
+
+func TestEncodeCanonical(t *testing.T) {
+	req := &pb.HelloRequest{Name: "pixie", Count: 3}
+	b, err := pb.EncodeCanonical(req)
+	require.NoError(t, err)
+	want, err := req.Marshal()
+	require.NoError(t, err)
+	assert.Equal(t, want, b)
+
+	for _, req := range []*pb.HelloRequest{nil, {Name: "pixie", Count: -1}, {Count: math.MinInt32}} {
+		_, err := pb.EncodeCanonical(req)
+		var validationErr *pb.ValidationError
+		assert.True(t, errors.As(err, &validationErr), "%v", req)
+	}
+}
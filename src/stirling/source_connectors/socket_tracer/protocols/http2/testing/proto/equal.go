@@ -0,0 +1,79 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetpb
+
+// The generated Equal methods can only be called on a typed message, so code comparing interface
+// values can't call them on an untyped nil, and gets different results depending on which side it
+// calls Equal on. The functions below take both sides as an interface{}, and answer the same in
+// either order:
+//   - an untyped nil and a typed nil message are equal;
+//   - nil is not equal to an empty message, as Hash and Compare also tell them apart;
+//   - a message and a pointer to it are equal;
+//   - anything that is not the message type is not equal to anything, itself included.
+
+func asHelloRequest(v interface{}) (*HelloRequest, bool) {
+	switch m := v.(type) {
+	case nil:
+		return nil, true
+	case *HelloRequest:
+		return m, true
+	case HelloRequest:
+		return &m, true
+	}
+	return nil, false
+}
+
+// EqualHelloRequest returns true if a and b are the same request. Either may be nil, a
+// *HelloRequest or a HelloRequest.
+func EqualHelloRequest(a, b interface{}) bool {
+	ma, ok := asHelloRequest(a)
+	if !ok {
+		return false
+	}
+	mb, ok := asHelloRequest(b)
+	if !ok {
+		return false
+	}
+	return ma.Equal(mb)
+}
+
+func asHelloReply(v interface{}) (*HelloReply, bool) {
+	switch m := v.(type) {
+	case nil:
+		return nil, true
+	case *HelloReply:
+		return m, true
+	case HelloReply:
+		return &m, true
+	}
+	return nil, false
+}
+
+// EqualHelloReply returns true if a and b are the same reply. Either may be nil, a *HelloReply or
+// a HelloReply.
+func EqualHelloReply(a, b interface{}) bool {
+	ma, ok := asHelloReply(a)
+	if !ok {
+		return false
+	}
+	mb, ok := asHelloReply(b)
+	if !ok {
+		return false
+	}
+	return ma.Equal(mb)
+}
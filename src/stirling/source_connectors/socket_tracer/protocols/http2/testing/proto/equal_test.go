@@ -0,0 +1,137 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetpb_test
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// equalClass is a set of values that must all be equal to each other, and unequal to those of
+// every other class.
+type equalClass []interface{}
+
+// checkEqualMatrix checks equal over every ordered pair of values of classes.
+func checkEqualMatrix(t *testing.T, equal func(a, b interface{}) bool, classes []equalClass) {
+	for i, ci := range classes {
+		for j, cj := range classes {
+			for _, a := range ci {
+				for _, b := range cj {
+					assert.Equal(t, i == j, equal(a, b), "%#v vs %#v", a, b)
+				}
+			}
+		}
+	}
+}
+
+func TestEqualHelloRequest(t *testing.T) {
+	checkEqualMatrix(t, pb.EqualHelloRequest, []equalClass{
+		{nil, (*pb.HelloRequest)(nil)},
+		{&pb.HelloRequest{}, pb.HelloRequest{}},
+		{&pb.HelloRequest{Name: "pixie"}, pb.HelloRequest{Name: "pixie"}},
+		{&pb.HelloRequest{Name: "pixie", Count: 3}, pb.HelloRequest{Name: "pixie", Count: 3}},
+		{&pb.HelloRequest{Count: 3}},
+		{&pb.HelloRequest{Payload: []byte("x")}, pb.HelloRequest{Payload: []byte("x")}},
+	})
+}
+
+func TestEqualHelloReply(t *testing.T) {
+	checkEqualMatrix(t, pb.EqualHelloReply, []equalClass{
+		{nil, (*pb.HelloReply)(nil)},
+		{&pb.HelloReply{}, pb.HelloReply{}},
+		{&pb.HelloReply{Message: "Hello"}, pb.HelloReply{Message: "Hello"}},
+		{&pb.HelloReply{Message: "Hello", InstanceId: "1"}},
+		{&pb.HelloReply{Message: "Hello", InstanceId: "1", Checksum: 1}},
+		{&pb.HelloReply{Payload: []byte("x")}},
+	})
+}
+
+func TestEqual_OtherTypes(t *testing.T) {
+	for _, v := range []interface{}{"pixie", &pb.HelloReply{}, (*pb.HelloReply)(nil)} {
+		assert.False(t, pb.EqualHelloRequest(v, v), "%#v", v)
+		assert.False(t, pb.EqualHelloRequest(v, nil), "%#v", v)
+		assert.False(t, pb.EqualHelloRequest(nil, v), "%#v", v)
+	}
+	assert.False(t, pb.EqualHelloReply(&pb.HelloRequest{}, &pb.HelloRequest{}))
+	assert.False(t, pb.EqualHelloReply((*pb.HelloRequest)(nil), nil))
+}
+
+// setEveryField returns a copy of every exported field of m set on its own to a non-zero value,
+// and fails the test on a field kind it doesn't know how to set.
+func setEveryField(t *testing.T, m interface{}) map[string]interface{} {
+	typ := reflect.TypeOf(m).Elem()
+	mutated := make(map[string]interface{})
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if !f.IsExported() || strings.HasPrefix(f.Name, "XXX_") {
+			continue
+		}
+		v := reflect.New(typ)
+		field := v.Elem().Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString("x")
+		case reflect.Int32, reflect.Int64:
+			field.SetInt(1)
+		case reflect.Uint32, reflect.Uint64:
+			field.SetUint(1)
+		case reflect.Bool:
+			field.SetBool(true)
+		case reflect.Slice:
+			require.Equal(t, reflect.Uint8, field.Type().Elem().Kind(), "%s.%s is not a []byte", typ.Name(), f.Name)
+			field.SetBytes([]byte("x"))
+		default:
+			require.Failf(t, "unsupported field kind", "%s.%s is a %s", typ.Name(), f.Name, field.Kind())
+		}
+		mutated[f.Name] = v.Interface()
+	}
+	return mutated
+}
+
+// TestEveryFieldIsCompared catches fields added to the messages without updating the hand-written
+// Hash, Compare and CopyInto: every field set on its own must make a message differ from an empty
+// one, and survive Clone.
+func TestEveryFieldIsCompared(t *testing.T) {
+	for name, m := range setEveryField(t, &pb.HelloRequest{}) {
+		req := m.(*pb.HelloRequest)
+		empty := &pb.HelloRequest{}
+		msg := fmt.Sprintf("HelloRequest.%s", name)
+		assert.False(t, pb.EqualHelloRequest(req, empty), msg)
+		assert.False(t, pb.EqualHelloRequest(empty, req), msg)
+		assert.NotEqual(t, empty.Hash(), req.Hash(), msg)
+		assert.NotEqual(t, 0, pb.CompareHelloRequest(req, empty), msg)
+		assert.True(t, pb.EqualHelloRequest(req, req.Clone()), msg)
+	}
+	for name, m := range setEveryField(t, &pb.HelloReply{}) {
+		reply := m.(*pb.HelloReply)
+		empty := &pb.HelloReply{}
+		msg := fmt.Sprintf("HelloReply.%s", name)
+		assert.False(t, pb.EqualHelloReply(reply, empty), msg)
+		assert.False(t, pb.EqualHelloReply(empty, reply), msg)
+		assert.NotEqual(t, empty.Hash(), reply.Hash(), msg)
+		assert.NotEqual(t, 0, pb.CompareHelloReply(reply, empty), msg)
+		assert.True(t, pb.EqualHelloReply(reply, reply.Clone()), msg)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetpb_test
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+type stringer interface {
+	String() string
+	GoString() string
+}
+
+// stringMessages are the messages whose String and GoString are locked by TestString_Golden.
+var stringMessages = []struct {
+	name string
+	msg  stringer
+}{
+	{"nil_request", (*pb.HelloRequest)(nil)},
+	{"empty_request", &pb.HelloRequest{}},
+	{"request", &pb.HelloRequest{Name: "pixie", Count: 3}},
+	{"request_utf8", &pb.HelloRequest{Name: "héllo, 世界"}},
+	{"request_control_chars", &pb.HelloRequest{Name: "a\nb\tc\x00"}},
+	{"request_max_count", &pb.HelloRequest{Name: "pixie", Count: pb.MaxCount}},
+	{"request_max_int32_count", &pb.HelloRequest{Count: math.MaxInt32}},
+	{"request_min_int32_count", &pb.HelloRequest{Count: math.MinInt32}},
+	{"request_payload", &pb.HelloRequest{Name: "pixie", Payload: []byte{0, 1, 0xff}}},
+	{"nil_reply", (*pb.HelloReply)(nil)},
+	{"empty_reply", &pb.HelloReply{}},
+	{"reply", &pb.HelloReply{Message: "Hello pixie", InstanceId: "server-1", Checksum: 0xdeadbeef}},
+	{"reply_utf8", &pb.HelloReply{Message: "Hello 世界", Checksum: math.MaxUint32, Payload: []byte("x")}},
+	{"stats_reply", &pb.GetStatsReply{Counts: []*pb.CallCount{
+		{Method: "/px.stirling.protocols.http2.testing.Greeter/SayHello", Code: "OK", Count: 42},
+		{Method: "/px.stirling.protocols.http2.testing.Greeter/SayHello", Code: "Unavailable", Count: math.MaxInt64},
+	}}},
+	{"empty_feature_matrix", &pb.FeatureMatrix{}},
+	{"feature_matrix", &pb.FeatureMatrix{
+		Tls:         true,
+		Compressors: []string{"gzip"},
+		Faults:      &pb.FaultFeatures{LatencyMillis: 25, ErrorRate: 0.5, Code: "Unavailable"},
+		InstanceId:  "server-1",
+		Build:       &pb.BuildInfo{GoVersion: "go1.20.3", Version: "(devel)", Revision: "8300f66"},
+		RunMetadata: `{"seed":1}`,
+	}},
+}
+
+// TestString_Golden locks the String and GoString output of stringMessages, quoted one per line of
+// testdata/string.golden, so that regenerating greet.pb.go with other flags cannot change it
+// unnoticed. Run with -update to rewrite it, once the change is intended.
+func TestString_Golden(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("# The String and GoString of the greetpb messages of stringMessages, quoted.\n")
+	for _, tc := range stringMessages {
+		fmt.Fprintf(&b, "%s String %s\n", tc.name, strconv.Quote(tc.msg.String()))
+		fmt.Fprintf(&b, "%s GoString %s\n", tc.name, strconv.Quote(tc.msg.GoString()))
+	}
+	path := filepath.Join("testdata", "string.golden")
+	if *update {
+		require.NoError(t, os.WriteFile(path, []byte(b.String()), 0o644))
+	}
+	want, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, string(want), b.String())
+}
+
+func TestFormatCompact(t *testing.T) {
+	for _, tc := range []struct {
+		msg  interface{ FormatCompact() string }
+		want string
+	}{
+		{(*pb.HelloRequest)(nil), `v1 HelloRequest nil`},
+		{&pb.HelloRequest{}, `v1 HelloRequest name="" count=0 payload_len=0`},
+		{&pb.HelloRequest{Name: "pixie", Count: 3}, `v1 HelloRequest name="pixie" count=3 payload_len=0`},
+		{&pb.HelloRequest{Name: "héllo, 世界"}, `v1 HelloRequest name="h\u00e9llo, \u4e16\u754c" count=0 payload_len=0`},
+		{&pb.HelloRequest{Name: "a\nb \"c\"", Count: math.MinInt32}, `v1 HelloRequest name="a\nb \"c\"" count=-2147483648 payload_len=0`},
+		{&pb.HelloRequest{Count: math.MaxInt32, Payload: make([]byte, 1024)}, `v1 HelloRequest name="" count=2147483647 payload_len=1024`},
+		{(*pb.HelloReply)(nil), `v1 HelloReply nil`},
+		{&pb.HelloReply{}, `v1 HelloReply message="" instance_id="" checksum=0x00000000 payload_len=0`},
+		{&pb.HelloReply{Message: "Hello 世界", InstanceId: "server-1", Checksum: 0xbeef, Payload: []byte("x")},
+			`v1 HelloReply message="Hello \u4e16\u754c" instance_id="server-1" checksum=0x0000beef payload_len=1`},
+	} {
+		got := tc.msg.FormatCompact()
+		assert.Equal(t, tc.want, got)
+		assert.NotContains(t, got, "\n")
+		assert.True(t, strings.HasPrefix(got, "v"+strconv.Itoa(pb.CompactFormatVersion)+" "), got)
+	}
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetv2_test
+
+import (
+	"math"
+	"math/rand"
+
+	"google.golang.org/protobuf/proto"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/payloadgen"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto/greetv2"
+)
+
+// gogoMessage is implemented by the gogo generated greetpb messages.
+type gogoMessage interface {
+	Reset()
+	Marshal() ([]byte, error)
+	Unmarshal(dAtA []byte) error
+}
+
+// pair is a message built with both sets of stubs, with the same field values.
+type pair struct {
+	gogo gogoMessage
+	v2   proto.Message
+}
+
+// corpusTexts returns the names and messages of the corpus: text of every payloadgen alphabet, at
+// sizes around the boundaries of varint lengths and up to several frames.
+func corpusTexts(perGenerator int) []string {
+	sizes := []payloadgen.SizeDist{
+		{Kind: payloadgen.SizeBoundary},
+		{Kind: payloadgen.SizeUniform, Min: 0, Max: 300},
+		{Kind: payloadgen.SizeZipf, Exponent: 1.1, Max: 40000},
+	}
+	alphabets := []string{
+		payloadgen.AlphabetASCII,
+		payloadgen.AlphabetUTF8,
+		payloadgen.AlphabetStress,
+		payloadgen.AlphabetHuffmanFavorable,
+		payloadgen.AlphabetHuffmanUnfavorable,
+	}
+	var texts []string
+	for i, alphabet := range alphabets {
+		for j, size := range sizes {
+			g, err := payloadgen.New(&payloadgen.Options{Seed: uint64(i*len(sizes) + j), Alphabet: alphabet, Size: size})
+			if err != nil {
+				panic(err)
+			}
+			for k := 0; k < perGenerator; k++ {
+				texts = append(texts, g.Name(uint64(k)), g.Message(uint64(k)))
+			}
+		}
+	}
+	return texts
+}
+
+// pick returns one of the values at random.
+func pick[T any](rng *rand.Rand, values []T) T {
+	return values[rng.Intn(len(values))]
+}
+
+var (
+	corpusInt32s   = []int32{0, 1, -1, 127, 128, math.MaxInt32, math.MinInt32, 1 << 20}
+	corpusInt64s   = []int64{0, 1, -1, 127, 128, math.MaxInt64, math.MinInt64, 1 << 40}
+	corpusUint32s  = []uint32{0, 1, 127, 128, math.MaxUint32, 1 << 28}
+	corpusFloat64s = []float64{0, 1, 0.5, math.SmallestNonzeroFloat64, math.MaxFloat64, math.Inf(1), math.Inf(-1), 1e-300}
+)
+
+// corpus returns a large set of messages of every type of greet.proto, with the same seed, so the
+// same messages, on every run. Doubles are never negative zero, nor NaN, which TestNegativeZero
+// covers and which proto.Equal does not compare equal.
+func corpus(perGenerator int) []pair {
+	rng := rand.New(rand.NewSource(1))
+	texts := corpusTexts(perGenerator)
+	text := func() string {
+		if rng.Intn(4) == 0 {
+			return ""
+		}
+		return texts[rng.Intn(len(texts))]
+	}
+
+	pairs := []pair{
+		{&pb.HelloRequest{}, &greetv2.HelloRequest{}},
+		{&pb.HelloReply{}, &greetv2.HelloReply{}},
+		{&pb.GetStatsRequest{}, &greetv2.GetStatsRequest{}},
+		{&pb.GetStatsReply{}, &greetv2.GetStatsReply{}},
+		{&pb.GetFeatureMatrixRequest{}, &greetv2.GetFeatureMatrixRequest{}},
+		{&pb.FeatureMatrix{}, &greetv2.FeatureMatrix{}},
+	}
+	for _, name := range texts {
+		count := pick(rng, corpusInt32s)
+		pairs = append(pairs, pair{
+			&pb.HelloRequest{Name: name, Count: count},
+			&greetv2.HelloRequest{Name: name, Count: count},
+		})
+		reply := &pb.HelloReply{Message: name, InstanceId: text(), Checksum: pick(rng, corpusUint32s), BytesReceived: pick(rng, corpusInt64s)}
+		pairs = append(pairs, pair{reply, &greetv2.HelloReply{Message: reply.Message, InstanceId: reply.InstanceId, Checksum: reply.Checksum, BytesReceived: reply.BytesReceived}})
+	}
+	for i := 0; i < len(texts)/4; i++ {
+		stats := &pb.GetStatsReply{}
+		statsV2 := &greetv2.GetStatsReply{}
+		for j := rng.Intn(4); j > 0; j-- {
+			c := &pb.CallCount{Method: text(), Code: text(), Count: pick(rng, corpusInt64s)}
+			stats.Counts = append(stats.Counts, c)
+			statsV2.Counts = append(statsV2.Counts, &greetv2.CallCount{Method: c.Method, Code: c.Code, Count: c.Count})
+		}
+		pairs = append(pairs, pair{stats, statsV2})
+
+		m := &pb.FeatureMatrix{
+			Tls:              rng.Intn(2) == 0,
+			TlsMinVersion:    text(),
+			TlsMaxVersion:    text(),
+			Codec:            text(),
+			MaxRecvMsgSize:   pick(rng, corpusInt32s),
+			MaxSendMsgSize:   pick(rng, corpusInt32s),
+			Streaming:        rng.Intn(2) == 0,
+			H2C:              rng.Intn(2) == 0,
+			Checksums:        rng.Intn(2) == 0,
+			ValidateRequests: rng.Intn(2) == 0,
+			InstanceId:       text(),
+			RunMetadata:      text(),
+		}
+		for j := rng.Intn(3); j > 0; j-- {
+			m.Compressors = append(m.Compressors, text())
+		}
+		mV2 := &greetv2.FeatureMatrix{
+			Tls:              m.Tls,
+			TlsMinVersion:    m.TlsMinVersion,
+			TlsMaxVersion:    m.TlsMaxVersion,
+			Compressors:      m.Compressors,
+			Codec:            m.Codec,
+			MaxRecvMsgSize:   m.MaxRecvMsgSize,
+			MaxSendMsgSize:   m.MaxSendMsgSize,
+			Streaming:        m.Streaming,
+			H2C:              m.H2C,
+			Checksums:        m.Checksums,
+			ValidateRequests: m.ValidateRequests,
+			InstanceId:       m.InstanceId,
+			RunMetadata:      m.RunMetadata,
+		}
+		// Leave out, set empty, or fill the nested messages.
+		switch rng.Intn(3) {
+		case 1:
+			m.Faults, mV2.Faults = &pb.FaultFeatures{}, &greetv2.FaultFeatures{}
+		case 2:
+			m.Faults = &pb.FaultFeatures{LatencyMillis: pick(rng, corpusInt64s), ErrorRate: pick(rng, corpusFloat64s), Code: text()}
+			mV2.Faults = &greetv2.FaultFeatures{LatencyMillis: m.Faults.LatencyMillis, ErrorRate: m.Faults.ErrorRate, Code: m.Faults.Code}
+		}
+		switch rng.Intn(3) {
+		case 1:
+			m.Build, mV2.Build = &pb.BuildInfo{}, &greetv2.BuildInfo{}
+		case 2:
+			m.Build = &pb.BuildInfo{GoVersion: text(), Version: text(), Revision: text()}
+			mV2.Build = &greetv2.BuildInfo{GoVersion: m.Build.GoVersion, Version: m.Build.Version, Revision: m.Build.Revision}
+		}
+		pairs = append(pairs, pair{m, mV2})
+	}
+	return pairs
+}
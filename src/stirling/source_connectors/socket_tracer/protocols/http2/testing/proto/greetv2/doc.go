@@ -0,0 +1,33 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package greetv2 holds the greet stubs generated with protoc-gen-go and protoc-gen-go-grpc, the
+// protobuf API v2 generators, from the same greet.proto as the gogo generated greetpb.
+//
+// It exists so that greetpb can be migrated off gogo: its tests check that the two sets of stubs
+// agree on the wire and over gRPC, and record where they do not. Workload code should keep using
+// greetpb until that migration.
+//
+// greet.pb.go and greet_grpc.pb.go are generated with greet.proto mapped to this package:
+//
+//	protoc --go_out=. --go-grpc_out=. \
+//	  --go_opt=M$GREET_PROTO=$PKG --go-grpc_opt=M$GREET_PROTO=$PKG $GREET_PROTO
+//
+// with GREET_PROTO the path of greet.proto from the repo root, and PKG the import path of this
+// package followed by ";greetv2".
+package greetv2
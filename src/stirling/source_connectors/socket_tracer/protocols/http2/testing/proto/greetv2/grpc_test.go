@@ -0,0 +1,609 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetv2_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto/greetv2"
+)
+
+// failPrefix makes the servers fail a call with the status code that follows it, e.g. "fail:14".
+const failPrefix = "fail:"
+
+// greeting is the message of the reply to a call greeting name, or the error the call fails with.
+// Both servers implement every method with it, so that they answer every call the same way.
+func greeting(prefix, name string) (string, error) {
+	if s, ok := strings.CutPrefix(name, failPrefix); ok {
+		code, err := strconv.Atoi(s)
+		if err != nil {
+			return "", status.Errorf(codes.InvalidArgument, "bad code %q", s)
+		}
+		return "", status.Errorf(codes.Code(code), "failed to greet %s", name)
+	}
+	return prefix + " " + name, nil
+}
+
+// gogoServer serves the greet services with the gogo stubs.
+type gogoServer struct{}
+
+func (gogoServer) SayHello(_ context.Context, req *pb.HelloRequest) (*pb.HelloReply, error) {
+	msg, err := greeting("Hello", req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.HelloReply{Message: msg}, nil
+}
+
+func (gogoServer) SayHelloAgain(_ context.Context, req *pb.HelloRequest) (*pb.HelloReply, error) {
+	msg, err := greeting("Hello again", req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.HelloReply{Message: msg}, nil
+}
+
+func (gogoServer) SayHelloBatch(_ context.Context, req *pb.HelloBatchRequest) (*pb.HelloBatchReply, error) {
+	resp := &pb.HelloBatchReply{}
+	for _, r := range req.Requests {
+		msg, err := greeting("Hello", r.Name)
+		if err != nil {
+			s := status.Convert(err)
+			resp.Results = append(resp.Results, &pb.HelloBatchResult{Code: int32(s.Code()), Error: s.Message()})
+			continue
+		}
+		resp.Results = append(resp.Results, &pb.HelloBatchResult{Reply: &pb.HelloReply{Message: msg}})
+	}
+	return resp, nil
+}
+
+func (gogoServer) SayHelloClientStreaming(stream pb.StreamingGreeter_SayHelloClientStreamingServer) error {
+	var names []string
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		names = append(names, req.Name)
+	}
+	msg, err := greeting("Hello", strings.Join(names, ", "))
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(&pb.HelloReply{Message: msg})
+}
+
+// SayHelloServerStreaming sends Count greetings, then fails the call if the name asks to, so that
+// statuses follow messages.
+func (gogoServer) SayHelloServerStreaming(req *pb.HelloRequest, stream pb.StreamingGreeter_SayHelloServerStreamingServer) error {
+	for i := 0; i < int(req.Count); i++ {
+		if err := stream.Send(&pb.HelloReply{Message: fmt.Sprintf("Hello %d", i)}); err != nil {
+			return err
+		}
+	}
+	_, err := greeting("Hello", req.Name)
+	return err
+}
+
+func (gogoServer) SayHelloBidirStreaming(stream pb.StreamingGreeter_SayHelloBidirStreamingServer) error {
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		msg, err := greeting("Hello", req.Name)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&pb.HelloReply{Message: msg}); err != nil {
+			return err
+		}
+	}
+}
+
+// v2Server serves the greet services with the v2 stubs, as gogoServer does with the gogo ones.
+type v2Server struct {
+	greetv2.UnimplementedGreeterServer
+	greetv2.UnimplementedStreamingGreeterServer
+}
+
+func (v2Server) SayHello(_ context.Context, req *greetv2.HelloRequest) (*greetv2.HelloReply, error) {
+	msg, err := greeting("Hello", req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &greetv2.HelloReply{Message: msg}, nil
+}
+
+func (v2Server) SayHelloAgain(_ context.Context, req *greetv2.HelloRequest) (*greetv2.HelloReply, error) {
+	msg, err := greeting("Hello again", req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &greetv2.HelloReply{Message: msg}, nil
+}
+
+func (v2Server) SayHelloBatch(_ context.Context, req *greetv2.HelloBatchRequest) (*greetv2.HelloBatchReply, error) {
+	resp := &greetv2.HelloBatchReply{}
+	for _, r := range req.Requests {
+		msg, err := greeting("Hello", r.Name)
+		if err != nil {
+			s := status.Convert(err)
+			resp.Results = append(resp.Results, &greetv2.HelloBatchResult{Code: int32(s.Code()), Error: s.Message()})
+			continue
+		}
+		resp.Results = append(resp.Results, &greetv2.HelloBatchResult{Reply: &greetv2.HelloReply{Message: msg}})
+	}
+	return resp, nil
+}
+
+func (v2Server) SayHelloClientStreaming(stream greetv2.StreamingGreeter_SayHelloClientStreamingServer) error {
+	var names []string
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		names = append(names, req.Name)
+	}
+	msg, err := greeting("Hello", strings.Join(names, ", "))
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(&greetv2.HelloReply{Message: msg})
+}
+
+func (v2Server) SayHelloServerStreaming(req *greetv2.HelloRequest, stream greetv2.StreamingGreeter_SayHelloServerStreamingServer) error {
+	for i := 0; i < int(req.Count); i++ {
+		if err := stream.Send(&greetv2.HelloReply{Message: fmt.Sprintf("Hello %d", i)}); err != nil {
+			return err
+		}
+	}
+	_, err := greeting("Hello", req.Name)
+	return err
+}
+
+func (v2Server) SayHelloBidirStreaming(stream greetv2.StreamingGreeter_SayHelloBidirStreamingServer) error {
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		msg, err := greeting("Hello", req.Name)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&greetv2.HelloReply{Message: msg}); err != nil {
+			return err
+		}
+	}
+}
+
+// dialBufconn serves s over an in-memory listener, and returns a connection to it. Both are
+// closed when the test ends.
+func dialBufconn(t *testing.T, s *grpc.Server) *grpc.ClientConn {
+	lis := bufconn.Listen(1 << 20)
+	go func() {
+		_ = s.Serve(lis)
+	}()
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+		s.Stop()
+	})
+	return conn
+}
+
+// serveGogo serves gogoServer, registered with the gogo stubs.
+func serveGogo(t *testing.T) *grpc.ClientConn {
+	s := grpc.NewServer()
+	pb.RegisterGreeterServer(s, gogoServer{})
+	pb.RegisterStreamingGreeterServer(s, gogoServer{})
+	return dialBufconn(t, s)
+}
+
+// serveV2 serves v2Server, registered with the v2 stubs.
+func serveV2(t *testing.T) *grpc.ClientConn {
+	s := grpc.NewServer()
+	greetv2.RegisterGreeterServer(s, v2Server{})
+	greetv2.RegisterStreamingGreeterServer(s, v2Server{})
+	return dialBufconn(t, s)
+}
+
+// outcome is what a call got back: the messages of its replies, and its status.
+type outcome struct {
+	Replies []string
+	Code    codes.Code
+	Message string
+}
+
+func newOutcome(replies []string, err error) outcome {
+	s := status.Convert(err)
+	return outcome{Replies: replies, Code: s.Code(), Message: s.Message()}
+}
+
+// batchResult formats a result of a batch as a reply of an outcome.
+func batchResult(message string, code int32, err string) string {
+	if code != int32(codes.OK) {
+		return fmt.Sprintf("%s: %s", codes.Code(code), err)
+	}
+	return message
+}
+
+// caller makes the calls of the six greet methods, with one set of stubs.
+type caller interface {
+	SayHello(ctx context.Context, name string) outcome
+	SayHelloAgain(ctx context.Context, name string) outcome
+	Batch(ctx context.Context, names []string) outcome
+	ClientStreaming(ctx context.Context, names []string) outcome
+	ServerStreaming(ctx context.Context, name string, count int32) outcome
+	BidirStreaming(ctx context.Context, names []string) outcome
+}
+
+type gogoCaller struct {
+	greeter   pb.GreeterClient
+	streaming pb.StreamingGreeterClient
+}
+
+func newGogoCaller(conn *grpc.ClientConn) caller {
+	return gogoCaller{pb.NewGreeterClient(conn), pb.NewStreamingGreeterClient(conn)}
+}
+
+func (c gogoCaller) SayHello(ctx context.Context, name string) outcome {
+	resp, err := c.greeter.SayHello(ctx, &pb.HelloRequest{Name: name})
+	if err != nil {
+		return newOutcome(nil, err)
+	}
+	return newOutcome([]string{resp.Message}, nil)
+}
+
+func (c gogoCaller) SayHelloAgain(ctx context.Context, name string) outcome {
+	resp, err := c.greeter.SayHelloAgain(ctx, &pb.HelloRequest{Name: name})
+	if err != nil {
+		return newOutcome(nil, err)
+	}
+	return newOutcome([]string{resp.Message}, nil)
+}
+
+func (c gogoCaller) Batch(ctx context.Context, names []string) outcome {
+	req := &pb.HelloBatchRequest{}
+	for _, name := range names {
+		req.Requests = append(req.Requests, &pb.HelloRequest{Name: name})
+	}
+	resp, err := c.greeter.SayHelloBatch(ctx, req)
+	if err != nil {
+		return newOutcome(nil, err)
+	}
+	var replies []string
+	for _, r := range resp.Results {
+		replies = append(replies, batchResult(r.GetReply().GetMessage(), r.Code, r.Error))
+	}
+	return newOutcome(replies, nil)
+}
+
+func (c gogoCaller) ClientStreaming(ctx context.Context, names []string) outcome {
+	stream, err := c.streaming.SayHelloClientStreaming(ctx)
+	if err != nil {
+		return newOutcome(nil, err)
+	}
+	for _, name := range names {
+		if err := stream.Send(&pb.HelloRequest{Name: name}); err != nil {
+			break
+		}
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return newOutcome(nil, err)
+	}
+	return newOutcome([]string{resp.Message}, nil)
+}
+
+func (c gogoCaller) ServerStreaming(ctx context.Context, name string, count int32) outcome {
+	stream, err := c.streaming.SayHelloServerStreaming(ctx, &pb.HelloRequest{Name: name, Count: count})
+	if err != nil {
+		return newOutcome(nil, err)
+	}
+	var replies []string
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return newOutcome(replies, nil)
+		}
+		if err != nil {
+			return newOutcome(replies, err)
+		}
+		replies = append(replies, resp.Message)
+	}
+}
+
+func (c gogoCaller) BidirStreaming(ctx context.Context, names []string) outcome {
+	stream, err := c.streaming.SayHelloBidirStreaming(ctx)
+	if err != nil {
+		return newOutcome(nil, err)
+	}
+	// Send every request before reading any reply, so that the replies do not depend on timing.
+	for _, name := range names {
+		if err := stream.Send(&pb.HelloRequest{Name: name}); err != nil {
+			break
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return newOutcome(nil, err)
+	}
+	var replies []string
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return newOutcome(replies, nil)
+		}
+		if err != nil {
+			return newOutcome(replies, err)
+		}
+		replies = append(replies, resp.Message)
+	}
+}
+
+type v2Caller struct {
+	greeter   greetv2.GreeterClient
+	streaming greetv2.StreamingGreeterClient
+}
+
+func newV2Caller(conn *grpc.ClientConn) caller {
+	return v2Caller{greetv2.NewGreeterClient(conn), greetv2.NewStreamingGreeterClient(conn)}
+}
+
+func (c v2Caller) SayHello(ctx context.Context, name string) outcome {
+	resp, err := c.greeter.SayHello(ctx, &greetv2.HelloRequest{Name: name})
+	if err != nil {
+		return newOutcome(nil, err)
+	}
+	return newOutcome([]string{resp.Message}, nil)
+}
+
+func (c v2Caller) SayHelloAgain(ctx context.Context, name string) outcome {
+	resp, err := c.greeter.SayHelloAgain(ctx, &greetv2.HelloRequest{Name: name})
+	if err != nil {
+		return newOutcome(nil, err)
+	}
+	return newOutcome([]string{resp.Message}, nil)
+}
+
+func (c v2Caller) Batch(ctx context.Context, names []string) outcome {
+	req := &greetv2.HelloBatchRequest{}
+	for _, name := range names {
+		req.Requests = append(req.Requests, &greetv2.HelloRequest{Name: name})
+	}
+	resp, err := c.greeter.SayHelloBatch(ctx, req)
+	if err != nil {
+		return newOutcome(nil, err)
+	}
+	var replies []string
+	for _, r := range resp.Results {
+		replies = append(replies, batchResult(r.GetReply().GetMessage(), r.Code, r.Error))
+	}
+	return newOutcome(replies, nil)
+}
+
+func (c v2Caller) ClientStreaming(ctx context.Context, names []string) outcome {
+	stream, err := c.streaming.SayHelloClientStreaming(ctx)
+	if err != nil {
+		return newOutcome(nil, err)
+	}
+	for _, name := range names {
+		if err := stream.Send(&greetv2.HelloRequest{Name: name}); err != nil {
+			break
+		}
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return newOutcome(nil, err)
+	}
+	return newOutcome([]string{resp.Message}, nil)
+}
+
+func (c v2Caller) ServerStreaming(ctx context.Context, name string, count int32) outcome {
+	stream, err := c.streaming.SayHelloServerStreaming(ctx, &greetv2.HelloRequest{Name: name, Count: count})
+	if err != nil {
+		return newOutcome(nil, err)
+	}
+	var replies []string
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return newOutcome(replies, nil)
+		}
+		if err != nil {
+			return newOutcome(replies, err)
+		}
+		replies = append(replies, resp.Message)
+	}
+}
+
+func (c v2Caller) BidirStreaming(ctx context.Context, names []string) outcome {
+	stream, err := c.streaming.SayHelloBidirStreaming(ctx)
+	if err != nil {
+		return newOutcome(nil, err)
+	}
+	for _, name := range names {
+		if err := stream.Send(&greetv2.HelloRequest{Name: name}); err != nil {
+			break
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return newOutcome(nil, err)
+	}
+	var replies []string
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return newOutcome(replies, nil)
+		}
+		if err != nil {
+			return newOutcome(replies, err)
+		}
+		replies = append(replies, resp.Message)
+	}
+}
+
+// callAll makes calls of every method with names, and failing ones with every status code, and
+// returns what they got back.
+func callAll(ctx context.Context, c caller, names []string) []outcome {
+	var failing []string
+	for code := codes.Canceled; code <= codes.Unauthenticated; code++ {
+		failing = append(failing, fmt.Sprintf("%s%d", failPrefix, code))
+	}
+
+	var outcomes []outcome
+	for i, name := range append(append([]string{}, names...), failing...) {
+		outcomes = append(outcomes,
+			c.SayHello(ctx, name),
+			c.SayHelloAgain(ctx, name),
+			c.ServerStreaming(ctx, name, int32(i%4)))
+	}
+	outcomes = append(outcomes, c.Batch(ctx, nil))
+	for i := 0; i+3 <= len(names); i += 3 {
+		outcomes = append(outcomes,
+			c.ClientStreaming(ctx, names[i:i+3]),
+			c.BidirStreaming(ctx, names[i:i+3]),
+			c.Batch(ctx, names[i:i+3]))
+	}
+	for _, name := range failing {
+		// The failing request of a batch fails in its result, and the call succeeds.
+		outcomes = append(outcomes,
+			c.ClientStreaming(ctx, []string{name}),
+			c.BidirStreaming(ctx, []string{names[0], name, names[1]}),
+			c.Batch(ctx, []string{names[0], name, names[1]}))
+	}
+	return outcomes
+}
+
+// Every pairing of client and server stubs gets the same replies and statuses back, for every
+// method.
+func TestGRPC_CrossVersion(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var names []string
+	for _, name := range corpusTexts(4) {
+		// Names that the servers would take as a code to fail with are left out.
+		if name != "" && !strings.HasPrefix(name, failPrefix) {
+			names = append(names, name)
+		}
+	}
+
+	ctx := context.Background()
+	// The servers and connections are closed as the subtest ends, before goleak looks for leaks.
+	t.Run("all methods", func(t *testing.T) {
+		servers := map[string]*grpc.ClientConn{"gogo": serveGogo(t), "v2": serveV2(t)}
+		want := callAll(ctx, newGogoCaller(servers["gogo"]), names)
+
+		// The baseline answers as the servers are written to.
+		assert.Equal(t, outcome{Replies: []string{"Hello " + names[0]}, Code: codes.OK}, want[0])
+		assert.Equal(t, outcome{Replies: []string{"Hello again " + names[0]}, Code: codes.OK}, want[1])
+		var failed int
+		for _, o := range want {
+			if o.Code != codes.OK {
+				failed++
+				assert.Contains(t, o.Message, "failed to greet "+failPrefix)
+			}
+		}
+		// SayHello, SayHelloAgain and SayHelloServerStreaming, then the two client streaming
+		// methods, fail once for each of the 16 codes.
+		assert.Equal(t, 5*16, failed)
+
+		for server, conn := range servers {
+			for client, newCaller := range map[string]func(*grpc.ClientConn) caller{"gogo": newGogoCaller, "v2": newV2Caller} {
+				assert.Equal(t, want, callAll(ctx, newCaller(conn), names), "%s client, %s server", client, server)
+			}
+		}
+	})
+}
+
+// The unimplemented servers of both stubs fail calls with the same status.
+func TestGRPC_Unimplemented(t *testing.T) {
+	gogoSrv := grpc.NewServer()
+	pb.RegisterGreeterServer(gogoSrv, &pb.UnimplementedGreeterServer{})
+	v2Srv := grpc.NewServer()
+	greetv2.RegisterGreeterServer(v2Srv, greetv2.UnimplementedGreeterServer{})
+
+	ctx := context.Background()
+	for _, conn := range []*grpc.ClientConn{dialBufconn(t, gogoSrv), dialBufconn(t, v2Srv)} {
+		for _, c := range []caller{newGogoCaller(conn), newV2Caller(conn)} {
+			assert.Equal(t, outcome{Code: codes.Unimplemented, Message: "method SayHello not implemented"}, c.SayHello(ctx, "world"))
+			// Neither server registers StreamingGreeter.
+			assert.Equal(t, outcome{
+				Code:    codes.Unimplemented,
+				Message: "unknown service px.stirling.protocols.http2.testing.StreamingGreeter",
+			}, c.ServerStreaming(ctx, "world", 1))
+		}
+	}
+}
+
+// Divergence: the v2 stubs reject strings that are not valid UTF-8, so v2 clients fail calls with
+// such names before sending them, and v2 servers fail the calls of gogo clients that send them.
+// gogo clients and servers pass them through.
+func TestGRPC_InvalidUTF8(t *testing.T) {
+	invalid := string([]byte{'h', 0xff, 'i'})
+	ctx := context.Background()
+	gogoConn := serveGogo(t)
+	v2Conn := serveV2(t)
+
+	assert.Equal(t, outcome{Replies: []string{"Hello " + invalid}, Code: codes.OK}, newGogoCaller(gogoConn).SayHello(ctx, invalid))
+
+	o := newGogoCaller(v2Conn).SayHello(ctx, invalid)
+	assert.Equal(t, codes.Internal, o.Code)
+	assert.Contains(t, o.Message, "grpc: error unmarshalling request")
+
+	for _, conn := range []*grpc.ClientConn{gogoConn, v2Conn} {
+		o := newV2Caller(conn).SayHello(ctx, invalid)
+		assert.Equal(t, codes.Internal, o.Code)
+		assert.Contains(t, o.Message, "grpc: error while marshaling")
+	}
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetv2_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+
+	gogoproto "github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto/greetv2"
+)
+
+// Both sets of stubs must be generated from the same greet.proto, so the descriptors they register
+// must match, but for the source info gogo leaves out, and the gogoproto file options the gogoslick
+// generator sets.
+func TestDescriptorsMatch(t *testing.T) {
+	file := greetv2.File_src_stirling_source_connectors_socket_tracer_protocols_http2_testing_proto_greet_proto
+	v2 := protodesc.ToFileDescriptorProto(file)
+	v2.SourceCodeInfo = nil
+
+	zr, err := gzip.NewReader(bytes.NewReader(gogoproto.FileDescriptor(file.Path())))
+	require.NoError(t, err)
+	b, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	gogo := &descriptorpb.FileDescriptorProto{}
+	require.NoError(t, proto.Unmarshal(b, gogo))
+	// The gogoproto extensions are not registered, so they are unknown fields of the options.
+	gogo.Options.ProtoReflect().SetUnknown(nil)
+
+	assert.True(t, proto.Equal(gogo, v2), "gogo:\n%v\nv2:\n%v", gogo, v2)
+}
+
+// Every message marshals to the same bytes with either stubs, and unmarshals from the bytes of
+// the other back to the message it was built as.
+func TestCorpus_CrossMarshal(t *testing.T) {
+	pairs := corpus(100)
+	require.Greater(t, len(pairs), 5000)
+	for i, p := range pairs {
+		gogoBytes, err := p.gogo.Marshal()
+		require.NoError(t, err)
+		v2Bytes, err := proto.MarshalOptions{Deterministic: true}.Marshal(p.v2)
+		require.NoError(t, err)
+		require.Equal(t, gogoBytes, v2Bytes, "message %d, %T", i, p.gogo)
+		require.Equal(t, len(gogoBytes), proto.Size(p.v2), "message %d, %T", i, p.gogo)
+
+		v2 := p.v2.ProtoReflect().New().Interface()
+		require.NoError(t, proto.Unmarshal(gogoBytes, v2), "message %d, %T", i, p.gogo)
+		require.True(t, proto.Equal(p.v2, v2), "message %d, %T", i, p.gogo)
+
+		gogo := reflect.New(reflect.TypeOf(p.gogo).Elem()).Interface().(gogoMessage)
+		require.NoError(t, gogo.Unmarshal(v2Bytes), "message %d, %T", i, p.gogo)
+		require.Equal(t, p.gogo, gogo, "message %d, %T", i, p.gogo)
+	}
+}
+
+// Empty messages, and messages with only default values, encode to no bytes. Nested messages
+// that are set but empty encode to an empty field, which both decode back to a set message.
+func TestEmptyMessages(t *testing.T) {
+	b, err := (&pb.HelloRequest{Name: "", Count: 0}).Marshal()
+	require.NoError(t, err)
+	assert.Empty(t, b)
+	b, err = proto.Marshal(&greetv2.HelloRequest{Name: "", Count: 0})
+	require.NoError(t, err)
+	assert.Empty(t, b)
+
+	want := []byte{0x42, 0x00}
+	b, err = (&pb.FeatureMatrix{Faults: &pb.FaultFeatures{}}).Marshal()
+	require.NoError(t, err)
+	assert.Equal(t, want, b)
+	b, err = proto.Marshal(&greetv2.FeatureMatrix{Faults: &greetv2.FaultFeatures{}})
+	require.NoError(t, err)
+	assert.Equal(t, want, b)
+
+	gogo := &pb.FeatureMatrix{}
+	require.NoError(t, gogo.Unmarshal(want))
+	assert.NotNil(t, gogo.Faults)
+	v2 := &greetv2.FeatureMatrix{}
+	require.NoError(t, proto.Unmarshal(want, v2))
+	assert.NotNil(t, v2.Faults)
+}
+
+// A field repeated in the encoding is the last value for scalars, and the merge of every value for
+// messages, and every value in order for repeated fields, with either stubs.
+func TestRepeatedFieldsMerge(t *testing.T) {
+	var b []byte
+	for _, m := range []*pb.FeatureMatrix{
+		{Codec: "proto", Compressors: []string{"gzip"}, Faults: &pb.FaultFeatures{LatencyMillis: 5}},
+		{Codec: "sized", Compressors: []string{"snappy"}, Faults: &pb.FaultFeatures{Code: "Unavailable"}},
+	} {
+		mb, err := m.Marshal()
+		require.NoError(t, err)
+		b = append(b, mb...)
+	}
+
+	gogo := &pb.FeatureMatrix{}
+	require.NoError(t, gogo.Unmarshal(b))
+	v2 := &greetv2.FeatureMatrix{}
+	require.NoError(t, proto.Unmarshal(b, v2))
+
+	assert.Equal(t, "sized", gogo.Codec)
+	assert.Equal(t, []string{"gzip", "snappy"}, gogo.Compressors)
+	assert.Equal(t, &pb.FaultFeatures{LatencyMillis: 5, Code: "Unavailable"}, gogo.Faults)
+	assert.True(t, proto.Equal(&greetv2.FeatureMatrix{
+		Codec:       "sized",
+		Compressors: []string{"gzip", "snappy"},
+		Faults:      &greetv2.FaultFeatures{LatencyMillis: 5, Code: "Unavailable"},
+	}, v2), "%v", v2)
+}
+
+// Negative int32s are sign-extended to 10-byte varints by both.
+func TestNegativeInt32(t *testing.T) {
+	gogoBytes, err := (&pb.HelloRequest{Count: -1}).Marshal()
+	require.NoError(t, err)
+	v2Bytes, err := proto.Marshal(&greetv2.HelloRequest{Count: -1})
+	require.NoError(t, err)
+	assert.Equal(t, gogoBytes, v2Bytes)
+	assert.Len(t, v2Bytes, 11)
+}
+
+// Divergence: gogo leaves out a double field that compares equal to zero, so drops negative zero,
+// while v2 only leaves out positive zero, and keeps the sign. The decoded values still compare
+// equal to 0.
+func TestNegativeZero(t *testing.T) {
+	negZero := math.Copysign(0, -1)
+	gogoBytes, err := (&pb.FaultFeatures{ErrorRate: negZero}).Marshal()
+	require.NoError(t, err)
+	assert.Empty(t, gogoBytes)
+
+	v2Bytes, err := proto.Marshal(&greetv2.FaultFeatures{ErrorRate: negZero})
+	require.NoError(t, err)
+	assert.Len(t, v2Bytes, 9)
+
+	gogo := &pb.FaultFeatures{}
+	require.NoError(t, gogo.Unmarshal(v2Bytes))
+	assert.True(t, math.Signbit(gogo.ErrorRate))
+}
+
+// appendUnknown appends a varint field 15 and a bytes field 16, which greet.proto does not define.
+func appendUnknown(b []byte) []byte {
+	b = protowire.AppendTag(b, 15, protowire.VarintType)
+	b = protowire.AppendVarint(b, 42)
+	b = protowire.AppendTag(b, 16, protowire.BytesType)
+	return protowire.AppendString(b, "unknown")
+}
+
+// Divergence: gogo was generated without XXX_unrecognized, so it skips unknown fields and drops
+// them when it marshals the message again, while v2 keeps them, and marshals them after the known
+// fields.
+func TestUnknownFields(t *testing.T) {
+	known, err := (&pb.HelloRequest{Name: "world", Count: 3}).Marshal()
+	require.NoError(t, err)
+	withUnknown := appendUnknown(append([]byte{}, known...))
+
+	gogo := &pb.HelloRequest{}
+	require.NoError(t, gogo.Unmarshal(withUnknown))
+	assert.Equal(t, &pb.HelloRequest{Name: "world", Count: 3}, gogo)
+	b, err := gogo.Marshal()
+	require.NoError(t, err)
+	assert.Equal(t, known, b)
+
+	v2 := &greetv2.HelloRequest{}
+	require.NoError(t, proto.Unmarshal(withUnknown, v2))
+	assert.Equal(t, "world", v2.Name)
+	assert.Equal(t, int32(3), v2.Count)
+	assert.Equal(t, appendUnknown(nil), []byte(v2.ProtoReflect().GetUnknown()))
+	b, err = proto.Marshal(v2)
+	require.NoError(t, err)
+	assert.Equal(t, withUnknown, b)
+	// Unknown fields make otherwise equal messages differ.
+	assert.False(t, proto.Equal(v2, &greetv2.HelloRequest{Name: "world", Count: 3}))
+}
+
+// Divergence: proto3 strings must be valid UTF-8. v2 checks it, and fails to marshal or unmarshal
+// messages whose strings are not, while gogo marshals and unmarshals them as they are.
+func TestInvalidUTF8(t *testing.T) {
+	invalid := string([]byte{'h', 0xff, 'i'})
+
+	b, err := (&pb.HelloRequest{Name: invalid}).Marshal()
+	require.NoError(t, err)
+	gogo := &pb.HelloRequest{}
+	require.NoError(t, gogo.Unmarshal(b))
+	assert.Equal(t, invalid, gogo.Name)
+
+	err = proto.Unmarshal(b, &greetv2.HelloRequest{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid UTF-8")
+
+	_, err = proto.Marshal(&greetv2.HelloRequest{Name: invalid})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid UTF-8")
+}
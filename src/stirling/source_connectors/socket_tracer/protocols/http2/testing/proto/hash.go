@@ -0,0 +1,189 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetpb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// hashString writes a length-prefixed string, so that adjacent fields can't run into each other.
+func hashString(d *xxhash.Digest, s string) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(len(s)))
+	_, _ = d.Write(buf[:])
+	_, _ = d.WriteString(s)
+}
+
+// hashBytes writes a length-prefixed b, if it is not empty, so that messages without it keep the
+// hash they had before it was added.
+func hashBytes(d *xxhash.Digest, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(len(b)))
+	_, _ = d.Write(buf[:])
+	_, _ = d.Write(b)
+}
+
+// hashNonZeroInt64 writes v, if it is not zero, so that messages without it keep the hash they
+// had before it was added.
+func hashNonZeroInt64(d *xxhash.Digest, v int64) {
+	if v == 0 {
+		return
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(v))
+	_, _ = d.Write(buf[:])
+}
+
+// hashNonZeroUint32 writes v, if it is not zero, so that messages without it keep the hash they
+// had before it was added.
+func hashNonZeroUint32(d *xxhash.Digest, v uint32) {
+	if v == 0 {
+		return
+	}
+	hashUint32(d, v)
+}
+
+func hashInt32(d *xxhash.Digest, v int32) {
+	hashUint32(d, uint32(v))
+}
+
+func hashUint32(d *xxhash.Digest, v uint32) {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	_, _ = d.Write(buf[:])
+}
+
+// Hash returns a hash of every field of m. It is stable across runs and processes, and messages
+// that are Equal hash equal. A nil message hashes to 0, apart from an empty one, as Equal and
+// CompareHelloRequest also tell them apart.
+func (m *HelloRequest) Hash() uint64 {
+	if m == nil {
+		return 0
+	}
+	var d xxhash.Digest
+	d.Reset()
+	hashString(&d, m.Name)
+	hashInt32(&d, m.Count)
+	hashBytes(&d, m.Payload)
+	return d.Sum64()
+}
+
+// Hash returns a hash of every field of m. It is stable across runs and processes, and messages
+// that are Equal hash equal. A nil message hashes to 0, apart from an empty one, as Equal and
+// CompareHelloReply also tell them apart.
+func (m *HelloReply) Hash() uint64 {
+	if m == nil {
+		return 0
+	}
+	var d xxhash.Digest
+	d.Reset()
+	hashString(&d, m.Message)
+	hashString(&d, m.InstanceId)
+	hashNonZeroUint32(&d, m.Checksum)
+	hashBytes(&d, m.Payload)
+	hashNonZeroInt64(&d, m.BytesReceived)
+	return d.Sum64()
+}
+
+func compareInt32(a, b int32) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareUint32(a, b uint32) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareNil orders nil before non-nil. The second return value is false if neither is nil.
+func compareNil(aNil, bNil bool) (int, bool) {
+	switch {
+	case aNil && bNil:
+		return 0, true
+	case aNil:
+		return -1, true
+	case bNil:
+		return 1, true
+	}
+	return 0, false
+}
+
+// CompareHelloRequest is a total ordering of requests, by Name, Count then Payload, with nil first.
+// It returns -1, 0 or 1.
+func CompareHelloRequest(a, b *HelloRequest) int {
+	if c, ok := compareNil(a == nil, b == nil); ok {
+		return c
+	}
+	if c := strings.Compare(a.Name, b.Name); c != 0 {
+		return c
+	}
+	if c := compareInt32(a.Count, b.Count); c != 0 {
+		return c
+	}
+	return bytes.Compare(a.Payload, b.Payload)
+}
+
+// CompareHelloReply is a total ordering of replies, by Message, InstanceId, Checksum, Payload then
+// BytesReceived, with nil first.
+// It returns -1, 0 or 1.
+func CompareHelloReply(a, b *HelloReply) int {
+	if c, ok := compareNil(a == nil, b == nil); ok {
+		return c
+	}
+	if c := strings.Compare(a.Message, b.Message); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.InstanceId, b.InstanceId); c != 0 {
+		return c
+	}
+	if c := compareUint32(a.Checksum, b.Checksum); c != 0 {
+		return c
+	}
+	if c := bytes.Compare(a.Payload, b.Payload); c != 0 {
+		return c
+	}
+	return compareInt64(a.BytesReceived, b.BytesReceived)
+}
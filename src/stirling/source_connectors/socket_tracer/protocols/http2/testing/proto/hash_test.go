@@ -0,0 +1,109 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetpb_test
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+func TestHelloRequest_Hash(t *testing.T) {
+	a := &pb.HelloRequest{Name: "pixie", Count: 3}
+	assert.Equal(t, a.Hash(), (&pb.HelloRequest{Name: "pixie", Count: 3}).Hash())
+	// The hash is stable across runs; this catches accidental changes to the algorithm.
+	assert.Equal(t, uint64(0x99e1cd49e4fd6ce4), a.Hash())
+
+	distinct := []*pb.HelloRequest{
+		{},
+		{Name: "pixie"},
+		{Name: "pixie", Count: 4},
+		{Name: "pixi", Count: 3},
+		{Name: "a,b"},
+		{Name: "a", Count: 44},
+		{Count: 3},
+	}
+	seen := map[uint64]*pb.HelloRequest{a.Hash(): a}
+	for _, m := range distinct {
+		prev, ok := seen[m.Hash()]
+		assert.False(t, ok, "%v collides with %v", m, prev)
+		seen[m.Hash()] = m
+	}
+
+	// nil is not Equal to an empty message, and sorts before it, so it hashes apart from it too.
+	var nilReq *pb.HelloRequest
+	assert.Equal(t, uint64(0), nilReq.Hash())
+	assert.NotEqual(t, (&pb.HelloRequest{}).Hash(), nilReq.Hash())
+}
+
+func TestHelloReply_Hash(t *testing.T) {
+	a := &pb.HelloReply{Message: "Hello", InstanceId: "1"}
+	assert.Equal(t, a.Hash(), (&pb.HelloReply{Message: "Hello", InstanceId: "1"}).Hash())
+	// The hash replies had before Checksum, Payload and BytesReceived were added.
+	assert.Equal(t, uint64(0x4275cd796e1f657f), a.Hash())
+	// Length prefixes keep field boundaries from being ambiguous.
+	assert.NotEqual(t, a.Hash(), (&pb.HelloReply{Message: "Hello1"}).Hash())
+	assert.NotEqual(t, a.Hash(), (&pb.HelloReply{Message: "Hell", InstanceId: "o1"}).Hash())
+	assert.NotEqual(t, a.Hash(), (&pb.HelloReply{Message: "Hello", InstanceId: "1", Checksum: 1}).Hash())
+	assert.NotEqual(t, a.Hash(), (&pb.HelloReply{Message: "Hello", InstanceId: "1", BytesReceived: 1}).Hash())
+
+	var nilReply *pb.HelloReply
+	assert.Equal(t, uint64(0), nilReply.Hash())
+	assert.NotEqual(t, (&pb.HelloReply{}).Hash(), nilReply.Hash())
+}
+
+func TestCompareHelloRequest(t *testing.T) {
+	sorted := []*pb.HelloRequest{
+		nil,
+		{},
+		{Count: 1},
+		{Name: "a"},
+		{Name: "a", Count: 2},
+		{Name: "a,b"},
+		{Name: "b", Count: -1},
+	}
+	for i := range sorted {
+		for j := range sorted {
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			assert.Equal(t, want, pb.CompareHelloRequest(sorted[i], sorted[j]), "%v vs %v", sorted[i], sorted[j])
+		}
+	}
+
+	shuffled := []*pb.HelloRequest{sorted[4], sorted[0], sorted[6], sorted[2], sorted[5], sorted[1], sorted[3]}
+	sort.Slice(shuffled, func(i, j int) bool { return pb.CompareHelloRequest(shuffled[i], shuffled[j]) < 0 })
+	assert.Equal(t, sorted, shuffled)
+}
+
+func TestCompareHelloReply(t *testing.T) {
+	assert.Equal(t, 0, pb.CompareHelloReply(nil, nil))
+	assert.Equal(t, -1, pb.CompareHelloReply(nil, &pb.HelloReply{}))
+	assert.Equal(t, 1, pb.CompareHelloReply(&pb.HelloReply{Message: "b"}, &pb.HelloReply{Message: "a", InstanceId: "z"}))
+	assert.Equal(t, -1, pb.CompareHelloReply(&pb.HelloReply{Message: "a", InstanceId: "1"}, &pb.HelloReply{Message: "a", InstanceId: "2"}))
+	assert.Equal(t, -1, pb.CompareHelloReply(&pb.HelloReply{Message: "a", Checksum: 1}, &pb.HelloReply{Message: "a", Checksum: 2}))
+	assert.Equal(t, 1, pb.CompareHelloReply(&pb.HelloReply{Message: "a", BytesReceived: 2}, &pb.HelloReply{Message: "a", BytesReceived: 1}))
+	assert.Equal(t, 0, pb.CompareHelloReply(&pb.HelloReply{Message: "a"}, &pb.HelloReply{Message: "a"}))
+}
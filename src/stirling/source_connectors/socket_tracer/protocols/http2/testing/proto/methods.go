@@ -0,0 +1,185 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetpb
+
+import (
+	"sort"
+	"strings"
+)
+
+// The full names of the services of greet.proto.
+//
+//nolint:revive // Named like the constants protoc-gen-go-grpc generates.
+const (
+	Greeter_ServiceName          = "px.stirling.protocols.http2.testing.Greeter"
+	Greeter2_ServiceName         = "px.stirling.protocols.http2.testing.Greeter2"
+	GreeterStats_ServiceName     = "px.stirling.protocols.http2.testing.GreeterStats"
+	GreeterFeatures_ServiceName  = "px.stirling.protocols.http2.testing.GreeterFeatures"
+	StreamingGreeter_ServiceName = "px.stirling.protocols.http2.testing.StreamingGreeter"
+)
+
+// The full names of the methods of greet.proto, which are also the HTTP/2 :path of their calls.
+//
+//nolint:revive // Named like the constants protoc-gen-go-grpc generates.
+const (
+	Greeter_SayHello_FullMethodName                         = "/" + Greeter_ServiceName + "/SayHello"
+	Greeter_SayHelloAgain_FullMethodName                    = "/" + Greeter_ServiceName + "/SayHelloAgain"
+	Greeter_SayHelloBatch_FullMethodName                    = "/" + Greeter_ServiceName + "/SayHelloBatch"
+	Greeter2_SayHi_FullMethodName                           = "/" + Greeter2_ServiceName + "/SayHi"
+	GreeterStats_GetStats_FullMethodName                    = "/" + GreeterStats_ServiceName + "/GetStats"
+	GreeterFeatures_GetFeatureMatrix_FullMethodName         = "/" + GreeterFeatures_ServiceName + "/GetFeatureMatrix"
+	StreamingGreeter_SayHelloClientStreaming_FullMethodName = "/" + StreamingGreeter_ServiceName + "/SayHelloClientStreaming"
+	StreamingGreeter_SayHelloServerStreaming_FullMethodName = "/" + StreamingGreeter_ServiceName + "/SayHelloServerStreaming"
+	StreamingGreeter_SayHelloBidirStreaming_FullMethodName  = "/" + StreamingGreeter_ServiceName + "/SayHelloBidirStreaming"
+)
+
+// StreamingKind tells which sides of a method stream messages.
+type StreamingKind int
+
+// The streaming kinds of methods.
+const (
+	Unary StreamingKind = iota
+	ClientStreaming
+	ServerStreaming
+	BidiStreaming
+)
+
+func (k StreamingKind) String() string {
+	switch k {
+	case Unary:
+		return "unary"
+	case ClientStreaming:
+		return "client_streaming"
+	case ServerStreaming:
+		return "server_streaming"
+	case BidiStreaming:
+		return "bidi_streaming"
+	}
+	return "unknown"
+}
+
+// ClientStreams returns true if the client of the method sends a stream of requests.
+func (k StreamingKind) ClientStreams() bool {
+	return k == ClientStreaming || k == BidiStreaming
+}
+
+// ServerStreams returns true if the server of the method sends a stream of replies.
+func (k StreamingKind) ServerStreams() bool {
+	return k == ServerStreaming || k == BidiStreaming
+}
+
+// Message is implemented by the generated greetpb messages.
+type Message interface {
+	Reset()
+	String() string
+	ProtoMessage()
+	Marshal() ([]byte, error)
+	Unmarshal(dAtA []byte) error
+}
+
+// MethodInfo describes a method of greet.proto.
+type MethodInfo struct {
+	// FullName is the full name of the method, e.g. Greeter_SayHello_FullMethodName.
+	FullName string
+	// Service is the full name of its service, e.g. Greeter_ServiceName, and Method its own name,
+	// e.g. "SayHello".
+	Service string
+	Method  string
+	Kind    StreamingKind
+	// NewRequest and NewResponse return an empty request and reply of the method.
+	NewRequest  func() Message
+	NewResponse func() Message
+}
+
+// MethodRegistry holds the methods of greet.proto by full name.
+type MethodRegistry struct {
+	byFullName map[string]*MethodInfo
+	byName     map[string]*MethodInfo
+	sorted     []*MethodInfo
+}
+
+func newMethodRegistry(methods ...*MethodInfo) *MethodRegistry {
+	r := &MethodRegistry{byFullName: make(map[string]*MethodInfo), byName: make(map[string]*MethodInfo)}
+	for _, m := range methods {
+		r.byFullName[m.FullName] = m
+		r.byName[m.Method] = m
+		r.sorted = append(r.sorted, m)
+	}
+	sort.Slice(r.sorted, func(i, j int) bool { return r.sorted[i].FullName < r.sorted[j].FullName })
+	return r
+}
+
+// Lookup returns the method of the given full name, e.g. Greeter_SayHello_FullMethodName.
+func (r *MethodRegistry) Lookup(fullName string) (*MethodInfo, bool) {
+	m, ok := r.byFullName[fullName]
+	return m, ok
+}
+
+// LookupName returns the method of the given name, e.g. "SayHello", which no two methods of
+// greet.proto share.
+func (r *MethodRegistry) LookupName(name string) (*MethodInfo, bool) {
+	m, ok := r.byName[name]
+	return m, ok
+}
+
+// Methods returns every method, sorted by full name.
+func (r *MethodRegistry) Methods() []*MethodInfo {
+	return append([]*MethodInfo(nil), r.sorted...)
+}
+
+// ServiceMethods returns the methods of the service of the given full name, sorted by full name.
+func (r *MethodRegistry) ServiceMethods(service string) []*MethodInfo {
+	var methods []*MethodInfo
+	for _, m := range r.sorted {
+		if m.Service == service {
+			methods = append(methods, m)
+		}
+	}
+	return methods
+}
+
+func method(fullName string, kind StreamingKind, newRequest, newResponse func() Message) *MethodInfo {
+	service, name := strings.TrimPrefix(fullName, "/"), ""
+	if i := strings.Index(service, "/"); i >= 0 {
+		service, name = service[:i], service[i+1:]
+	}
+	return &MethodInfo{FullName: fullName, Service: service, Method: name, Kind: kind, NewRequest: newRequest, NewResponse: newResponse}
+}
+
+func newHelloRequest() Message            { return &HelloRequest{} }
+func newHelloReply() Message              { return &HelloReply{} }
+func newHelloBatchRequest() Message       { return &HelloBatchRequest{} }
+func newHelloBatchReply() Message         { return &HelloBatchReply{} }
+func newGetStatsRequest() Message         { return &GetStatsRequest{} }
+func newGetStatsReply() Message           { return &GetStatsReply{} }
+func newGetFeatureMatrixRequest() Message { return &GetFeatureMatrixRequest{} }
+func newFeatureMatrix() Message           { return &FeatureMatrix{} }
+
+// GreetMethods holds every method of greet.proto. A test checks it against the service
+// descriptors, so that it cannot drift from them.
+var GreetMethods = newMethodRegistry(
+	method(Greeter_SayHello_FullMethodName, Unary, newHelloRequest, newHelloReply),
+	method(Greeter_SayHelloAgain_FullMethodName, Unary, newHelloRequest, newHelloReply),
+	method(Greeter_SayHelloBatch_FullMethodName, Unary, newHelloBatchRequest, newHelloBatchReply),
+	method(Greeter2_SayHi_FullMethodName, Unary, newHelloRequest, newHelloReply),
+	method(GreeterStats_GetStats_FullMethodName, Unary, newGetStatsRequest, newGetStatsReply),
+	method(GreeterFeatures_GetFeatureMatrix_FullMethodName, Unary, newGetFeatureMatrixRequest, newFeatureMatrix),
+	method(StreamingGreeter_SayHelloClientStreaming_FullMethodName, ClientStreaming, newHelloRequest, newHelloReply),
+	method(StreamingGreeter_SayHelloServerStreaming_FullMethodName, ServerStreaming, newHelloRequest, newHelloReply),
+	method(StreamingGreeter_SayHelloBidirStreaming_FullMethodName, BidiStreaming, newHelloRequest, newHelloReply),
+)
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetpb_test
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	gogoproto "github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto/descriptors"
+)
+
+// The servers below implement every method of the greet services, naming the registry entry of
+// each. A method added to greet.proto adds one to a server interface, which breaks the build here
+// until it is implemented, and added to GreetMethods along with it.
+var (
+	_ pb.GreeterServer          = exhaustiveServer{}
+	_ pb.Greeter2Server         = exhaustiveServer{}
+	_ pb.GreeterStatsServer     = exhaustiveServer{}
+	_ pb.GreeterFeaturesServer  = exhaustiveServer{}
+	_ pb.StreamingGreeterServer = exhaustiveServer{}
+)
+
+type exhaustiveServer struct{}
+
+func (exhaustiveServer) SayHello(context.Context, *pb.HelloRequest) (*pb.HelloReply, error) {
+	return nil, registered(pb.Greeter_SayHello_FullMethodName)
+}
+
+func (exhaustiveServer) SayHelloAgain(context.Context, *pb.HelloRequest) (*pb.HelloReply, error) {
+	return nil, registered(pb.Greeter_SayHelloAgain_FullMethodName)
+}
+
+func (exhaustiveServer) SayHelloBatch(context.Context, *pb.HelloBatchRequest) (*pb.HelloBatchReply, error) {
+	return nil, registered(pb.Greeter_SayHelloBatch_FullMethodName)
+}
+
+func (exhaustiveServer) SayHi(context.Context, *pb.HelloRequest) (*pb.HelloReply, error) {
+	return nil, registered(pb.Greeter2_SayHi_FullMethodName)
+}
+
+func (exhaustiveServer) GetStats(context.Context, *pb.GetStatsRequest) (*pb.GetStatsReply, error) {
+	return nil, registered(pb.GreeterStats_GetStats_FullMethodName)
+}
+
+func (exhaustiveServer) GetFeatureMatrix(context.Context, *pb.GetFeatureMatrixRequest) (*pb.FeatureMatrix, error) {
+	return nil, registered(pb.GreeterFeatures_GetFeatureMatrix_FullMethodName)
+}
+
+func (exhaustiveServer) SayHelloClientStreaming(pb.StreamingGreeter_SayHelloClientStreamingServer) error {
+	return registered(pb.StreamingGreeter_SayHelloClientStreaming_FullMethodName)
+}
+
+func (exhaustiveServer) SayHelloServerStreaming(*pb.HelloRequest, pb.StreamingGreeter_SayHelloServerStreamingServer) error {
+	return registered(pb.StreamingGreeter_SayHelloServerStreaming_FullMethodName)
+}
+
+func (exhaustiveServer) SayHelloBidirStreaming(pb.StreamingGreeter_SayHelloBidirStreamingServer) error {
+	return registered(pb.StreamingGreeter_SayHelloBidirStreaming_FullMethodName)
+}
+
+// registered is never called: it only makes every method of exhaustiveServer name its entry.
+func registered(string) error {
+	return nil
+}
+
+func TestGreetMethods_MatchServiceDescs(t *testing.T) {
+	s := grpc.NewServer()
+	pb.RegisterGreeterServer(s, exhaustiveServer{})
+	pb.RegisterGreeter2Server(s, exhaustiveServer{})
+	pb.RegisterGreeterStatsServer(s, exhaustiveServer{})
+	pb.RegisterGreeterFeaturesServer(s, exhaustiveServer{})
+	pb.RegisterStreamingGreeterServer(s, exhaustiveServer{})
+
+	want := map[string]pb.StreamingKind{}
+	for service, info := range s.GetServiceInfo() {
+		for _, m := range info.Methods {
+			kind := pb.Unary
+			switch {
+			case m.IsClientStream && m.IsServerStream:
+				kind = pb.BidiStreaming
+			case m.IsClientStream:
+				kind = pb.ClientStreaming
+			case m.IsServerStream:
+				kind = pb.ServerStreaming
+			}
+			want["/"+service+"/"+m.Name] = kind
+		}
+	}
+	got := map[string]pb.StreamingKind{}
+	for _, m := range pb.GreetMethods.Methods() {
+		got[m.FullName] = m.Kind
+	}
+	assert.Equal(t, want, got)
+}
+
+func TestGreetMethods_MatchDescriptors(t *testing.T) {
+	reg, err := descriptors.LoadGreet()
+	require.NoError(t, err)
+	for _, m := range pb.GreetMethods.Methods() {
+		t.Run(m.Method, func(t *testing.T) {
+			d, err := reg.MethodInfo(m.FullName)
+			require.NoError(t, err)
+			assert.Equal(t, m.Service, string(d.Method.Parent().FullName()))
+			assert.Equal(t, m.Method, string(d.Method.Name()))
+			assert.Equal(t, m.Kind.ClientStreams(), d.Method.IsStreamingClient())
+			assert.Equal(t, m.Kind.ServerStreams(), d.Method.IsStreamingServer())
+			assert.Equal(t, string(d.Input.FullName()), gogoproto.MessageName(m.NewRequest()))
+			assert.Equal(t, string(d.Output.FullName()), gogoproto.MessageName(m.NewResponse()))
+		})
+	}
+}
+
+func TestGreetMethods_Lookup(t *testing.T) {
+	m, ok := pb.GreetMethods.Lookup("/px.stirling.protocols.http2.testing.Greeter/SayHello")
+	require.True(t, ok)
+	assert.Equal(t, pb.Greeter_SayHello_FullMethodName, m.FullName)
+	assert.Equal(t, pb.Greeter_ServiceName, m.Service)
+	assert.Equal(t, "SayHello", m.Method)
+	assert.Equal(t, pb.Unary, m.Kind)
+	assert.IsType(t, &pb.HelloRequest{}, m.NewRequest())
+	assert.NotSame(t, m.NewRequest(), m.NewRequest())
+
+	byName, ok := pb.GreetMethods.LookupName("SayHelloBidirStreaming")
+	require.True(t, ok)
+	assert.Equal(t, pb.StreamingGreeter_SayHelloBidirStreaming_FullMethodName, byName.FullName)
+	assert.Equal(t, "bidi_streaming", byName.Kind.String())
+
+	_, ok = pb.GreetMethods.Lookup("/px.stirling.protocols.http2.testing.Greeter/SayBye")
+	assert.False(t, ok)
+	_, ok = pb.GreetMethods.LookupName("Greeter/SayHello")
+	assert.False(t, ok)
+
+	var names []string
+	for _, m := range pb.GreetMethods.ServiceMethods(pb.StreamingGreeter_ServiceName) {
+		names = append(names, m.Method)
+	}
+	assert.Equal(t, []string{"SayHelloBidirStreaming", "SayHelloClientStreaming", "SayHelloServerStreaming"}, names)
+	all := pb.GreetMethods.Methods()
+	assert.Len(t, all, 9)
+	assert.True(t, sort.SliceIsSorted(all, func(i, j int) bool { return all[i].FullName < all[j].FullName }))
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package testutils
+
+import (
+	"context"
+	"hash/fnv"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// DefaultEphemeralStopTimeout is the default EphemeralOptions.StopTimeout.
+const DefaultEphemeralStopTimeout = time.Second
+
+// bufconnAddr is the address of the servers served over bufconn.
+const bufconnAddr = "bufconn"
+
+// ephemeralBufSize is the size of the in-memory buffers of bufconn connections.
+const ephemeralBufSize = 1 << 20
+
+// EphemeralOptions configure a server started with NewEphemeralServer.
+type EphemeralOptions struct {
+	// Server configures the greet services. Nil uses the default options. An empty InstanceID
+	// takes the name of the test, so that replies tell which test's server sent them.
+	Server *greetworkload.ServerOptions
+	// TCP serves on a random port of the loopback interface, rather than in memory over bufconn,
+	// for tests that need a socket.
+	TCP bool
+	// Seed is EphemeralServer.Seed. Zero derives it from the name of the test.
+	Seed int64
+	// StopTimeout bounds how long teardown lets the calls in flight finish before it cuts them
+	// off. Zero uses DefaultEphemeralStopTimeout.
+	StopTimeout time.Duration
+}
+
+// EphemeralServer is a greet server started for a single test, which shares no state with the
+// servers of other tests, and is torn down when the test ends.
+type EphemeralServer struct {
+	// Server implements the greet services, with counters of its own.
+	Server *greetworkload.Server
+	// Stats follows the connections to the server, and keeps a row of every call it handled.
+	Stats *greetworkload.ConnStatsHandler
+	// Addr is the address the server is served at, a loopback address with EphemeralOptions.TCP.
+	Addr string
+	// Seed is the seed the test makes its random choices with, e.g. those of a
+	// greetworkload.Client, the same on every run of the test and distinct from those of other
+	// tests.
+	Seed int64
+
+	// Conn is a connection to the server, which the clients of the three services share.
+	Conn             *grpc.ClientConn
+	Greeter          pb.GreeterClient
+	Greeter2         pb.Greeter2Client
+	StreamingGreeter pb.StreamingGreeterClient
+
+	lis net.Listener
+	gs  *grpc.Server
+
+	mu    sync.Mutex
+	conns []*grpc.ClientConn
+}
+
+// NewEphemeralServer starts a server of the Greeter, Greeter2 and StreamingGreeter services for
+// t, with a grpc.Server, a greetworkload.Server and stats of its own, and connects to it. It
+// stops the server when t ends, within EphemeralOptions.StopTimeout and a little more, whatever
+// calls are still in flight. Cheap enough to start one per subtest, see
+// BenchmarkNewEphemeralServer. A nil opts uses the default options.
+func NewEphemeralServer(t testing.TB, opts *EphemeralOptions) *EphemeralServer {
+	t.Helper()
+	if opts == nil {
+		opts = &EphemeralOptions{}
+	}
+	serverOpts := greetworkload.ServerOptions{}
+	if opts.Server != nil {
+		serverOpts = *opts.Server
+	}
+	if serverOpts.InstanceID == "" {
+		serverOpts.InstanceID = t.Name()
+	}
+	if err := serverOpts.Validate(); err != nil {
+		t.Fatalf("Invalid server options: %v", err)
+	}
+
+	e := &EphemeralServer{
+		Server: greetworkload.NewServer(&serverOpts),
+		Stats:  greetworkload.NewConnStatsHandler(),
+		Seed:   opts.Seed,
+	}
+	if e.Seed == 0 {
+		e.Seed = testSeed(t.Name())
+	}
+	if opts.TCP {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		e.lis = lis
+		e.Addr = lis.Addr().String()
+	} else {
+		e.lis = bufconn.Listen(ephemeralBufSize)
+		e.Addr = bufconnAddr
+	}
+
+	e.Stats.KeepRPCs()
+	e.gs = grpc.NewServer(grpc.StatsHandler(e.Server.StatsHandler(e.Stats)))
+	pb.RegisterGreeterServer(e.gs, e.Server)
+	pb.RegisterGreeter2Server(e.gs, e.Server)
+	pb.RegisterStreamingGreeterServer(e.gs, e.Server)
+	go func() { _ = e.gs.Serve(e.lis) }()
+
+	stopTimeout := opts.StopTimeout
+	if stopTimeout == 0 {
+		stopTimeout = DefaultEphemeralStopTimeout
+	}
+	t.Cleanup(func() { e.stop(stopTimeout) })
+
+	conn, err := e.Dial()
+	if err != nil {
+		t.Fatalf("Failed to dial the ephemeral server: %v", err)
+	}
+	e.Conn = conn
+	e.Greeter = pb.NewGreeterClient(conn)
+	e.Greeter2 = pb.NewGreeter2Client(conn)
+	e.StreamingGreeter = pb.NewStreamingGreeterClient(conn)
+	return e
+}
+
+// Dial opens another connection to the server, with opts on top of those it takes, which is
+// closed when the test ends.
+func (e *EphemeralServer) Dial(opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	conn, err := grpc.Dial(e.Addr, append(e.DialOptions(), opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.conns = append(e.conns, conn)
+	return conn, nil
+}
+
+// DialOptions are the options connections to the server take, e.g. those of a
+// greetworkload.Client dialing e.Addr.
+func (e *EphemeralServer) DialOptions() []grpc.DialOption {
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	if lis, ok := e.lis.(*bufconn.Listener); ok {
+		opts = append(opts, grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}))
+	}
+	return opts
+}
+
+// stop closes the connections of Dial, lets the calls still in flight over other connections
+// finish within timeout, and then cuts them off.
+func (e *EphemeralServer) stop(timeout time.Duration) {
+	e.mu.Lock()
+	for _, conn := range e.conns {
+		conn.Close()
+	}
+	e.mu.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		e.gs.GracefulStop()
+		close(stopped)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-stopped:
+	case <-timer.C:
+		// Closes every connection, which has GracefulStop return.
+		e.gs.Stop()
+		<-stopped
+	}
+}
+
+// testSeed derives a seed from the name of a test.
+func testSeed(name string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	if seed := int64(h.Sum64()); seed != 0 {
+		return seed
+	}
+	return 1
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package testutils_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto/testutils"
+)
+
+func TestNewEphemeralServer(t *testing.T) {
+	for _, tcp := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tcp=%v", tcp), func(t *testing.T) {
+			e := testutils.NewEphemeralServer(t, &testutils.EphemeralOptions{TCP: tcp})
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			reply, err := e.Greeter.SayHello(ctx, &pb.HelloRequest{Name: "pixie"})
+			require.NoError(t, err)
+			assert.Equal(t, t.Name(), reply.InstanceId)
+			_, err = e.Greeter2.SayHi(ctx, &pb.HelloRequest{Name: "pixie"})
+			require.NoError(t, err)
+			stream, err := e.StreamingGreeter.SayHelloServerStreaming(ctx, &pb.HelloRequest{Name: "pixie", Count: 2})
+			require.NoError(t, err)
+			summary, err := testutils.ConsumeStream(ctx, stream, nil)
+			require.NoError(t, err)
+			assert.Equal(t, 2, summary.Messages)
+			assert.Len(t, e.Stats.RPCs(), 3)
+
+			// Other clients connect with the options of the server.
+			c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 5 * time.Second, Seed: e.Seed})
+			conn, err := c.Dial(e.Addr, e.DialOptions()...)
+			require.NoError(t, err)
+			defer conn.Close()
+			assert.True(t, c.SayHello(conn, "pixie").Completed())
+		})
+	}
+}
+
+func TestNewEphemeralServer_Seed(t *testing.T) {
+	a := testutils.NewEphemeralServer(t, nil)
+	b := testutils.NewEphemeralServer(t, nil)
+	assert.NotZero(t, a.Seed)
+	assert.Equal(t, a.Seed, b.Seed)
+
+	var other int64
+	t.Run("other", func(t *testing.T) {
+		other = testutils.NewEphemeralServer(t, nil).Seed
+	})
+	assert.NotEqual(t, a.Seed, other)
+	assert.Equal(t, int64(7), testutils.NewEphemeralServer(t, &testutils.EphemeralOptions{Seed: 7}).Seed)
+}
+
+func TestEphemeralServer_TeardownWithOpenStreams(t *testing.T) {
+	const stopTimeout = 100 * time.Millisecond
+	var conn *grpc.ClientConn
+	var stream pb.StreamingGreeter_SayHelloServerStreamingClient
+	start := time.Now()
+	t.Run("server", func(t *testing.T) {
+		e := testutils.NewEphemeralServer(t, &testutils.EphemeralOptions{
+			Server:      &greetworkload.ServerOptions{HeartbeatInterval: 10 * time.Millisecond},
+			TCP:         true,
+			StopTimeout: stopTimeout,
+		})
+		// A connection of its own, which the server does not close at teardown, holding a stream
+		// that never ends.
+		var err error
+		conn, err = grpc.Dial(e.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		stream, err = pb.NewStreamingGreeterClient(conn).SayHelloServerStreaming(context.Background(), &pb.HelloRequest{Name: greetworkload.HeartbeatName})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		require.NoError(t, err)
+	})
+	defer conn.Close()
+	// Teardown waited for the stream, and then cut it off.
+	assert.GreaterOrEqual(t, time.Since(start), stopTimeout)
+	assert.Less(t, time.Since(start), stopTimeout+2*time.Second)
+
+	// The stream was cut off.
+	for {
+		if _, err := stream.Recv(); err != nil {
+			assert.NotEqual(t, io.EOF, err)
+			break
+		}
+	}
+}
+
+func TestEphemeralServer_ParallelIsolation(t *testing.T) {
+	const servers, calls = 32, 20
+	for i := 0; i < servers; i++ {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			t.Parallel()
+			e := testutils.NewEphemeralServer(t, nil)
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			// Every server counts the callers of SayHelloAgain from scratch.
+			for n := 1; n <= calls; n++ {
+				reply, err := e.Greeter.SayHelloAgain(ctx, &pb.HelloRequest{Name: "pixie"})
+				require.NoError(t, err)
+				assert.Equal(t, fmt.Sprintf("Hello again, pixie, call #%d", n), reply.Message)
+				assert.Equal(t, t.Name(), reply.InstanceId)
+			}
+			assert.Len(t, e.Stats.RPCs(), calls)
+			assert.Zero(t, e.Server.ContextErrors())
+		})
+	}
+}
+
+// cleanups is a testing.TB that runs its cleanups when asked, rather than when the benchmark
+// ends, so that the servers of every iteration are not kept until then.
+type cleanups struct {
+	testing.TB
+	fns []func()
+}
+
+func (c *cleanups) Cleanup(fn func()) {
+	c.fns = append(c.fns, fn)
+}
+
+func (c *cleanups) run() {
+	for i := len(c.fns) - 1; i >= 0; i-- {
+		c.fns[i]()
+	}
+	c.fns = nil
+}
+
+// BenchmarkNewEphemeralServer measures starting a server, up to the reply of a first call over its
+// connection. It should take less than 5ms.
+func BenchmarkNewEphemeralServer(b *testing.B) {
+	c := &cleanups{TB: b}
+	ctx := context.Background()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		e := testutils.NewEphemeralServer(c, nil)
+		if _, err := e.Greeter.SayHello(ctx, &pb.HelloRequest{Name: "pixie"}); err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		c.run()
+		b.StartTimer()
+	}
+}
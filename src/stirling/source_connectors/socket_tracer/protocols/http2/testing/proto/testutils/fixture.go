@@ -0,0 +1,279 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package testutils
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// FixtureMethods are the methods that fixtures can hold: the unary methods taking a HelloRequest
+// and returning a HelloReply.
+var FixtureMethods = []string{
+	pb.Greeter_SayHello_FullMethodName,
+	pb.Greeter_SayHelloAgain_FullMethodName,
+	pb.Greeter2_SayHi_FullMethodName,
+}
+
+// FixtureError reports a malformed fixture.
+type FixtureError struct {
+	// Line is the 1-based line the error was found at.
+	Line int
+	Err  error
+}
+
+func (e *FixtureError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *FixtureError) Unwrap() error {
+	return e.Err
+}
+
+func fixtureErrorf(line int, format string, args ...interface{}) error {
+	return &FixtureError{Line: line, Err: fmt.Errorf(format, args...)}
+}
+
+var codesByName = func() map[string]codes.Code {
+	m := make(map[string]codes.Code)
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		m[c.String()] = c
+	}
+	return m
+}()
+
+func isFixtureMethod(method string) bool {
+	for _, m := range FixtureMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// fixtureCall is a call being parsed, along with what is needed to validate it once complete.
+type fixtureCall struct {
+	call *Call
+	line int
+	seen map[string]bool
+	code codes.Code
+	msg  string
+}
+
+func (f *fixtureCall) finish() (*Call, error) {
+	if f.call.Request == nil {
+		return nil, fixtureErrorf(f.line, "call to %s has no request", f.call.Method)
+	}
+	if f.code == codes.OK {
+		if f.call.Reply == nil {
+			return nil, fixtureErrorf(f.line, "successful call to %s has no reply", f.call.Method)
+		}
+		return f.call, nil
+	}
+	if f.call.Reply != nil {
+		return nil, fixtureErrorf(f.line, "call to %s has both a reply and status %s", f.call.Method, f.code)
+	}
+	f.call.Err = status.Error(f.code, f.msg)
+	return f.call, nil
+}
+
+// ReadFixture parses the calls of a fixture from r.
+//
+// A fixture holds a sequence of unary greet calls, each a block of "key: value"
+// lines:
+//
+//	method: /px.stirling.protocols.http2.testing.Greeter/SayHello
+//	request: name: "pixie"
+//	reply: message: "Hello pixie"
+//	status: OK
+//
+// method starts a new call, and must be one of FixtureMethods. request and reply hold a HelloRequest
+// and a HelloReply in protobuf text format, on a single line. reply is required for successful
+// calls, and omitted for failed ones.
+// status is a gRPC code name, optionally followed by the error message, and defaults to OK.
+// Blank lines and lines starting with '#' are ignored.
+func ReadFixture(r io.Reader) ([]*Call, error) {
+	var calls []*Call
+	var cur *fixtureCall
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.Index(text, ":")
+		if i < 0 {
+			return nil, fixtureErrorf(line, "expected \"key: value\", got %q", text)
+		}
+		key, value := text[:i], strings.TrimSpace(text[i+1:])
+
+		if key == "method" {
+			if cur != nil {
+				c, err := cur.finish()
+				if err != nil {
+					return nil, err
+				}
+				calls = append(calls, c)
+			}
+			if !isFixtureMethod(value) {
+				return nil, fixtureErrorf(line, "unknown method %q", value)
+			}
+			cur = &fixtureCall{call: &Call{Method: value}, line: line, seen: map[string]bool{}}
+			continue
+		}
+		if cur == nil {
+			return nil, fixtureErrorf(line, "%s before the first method", key)
+		}
+		if cur.seen[key] {
+			return nil, fixtureErrorf(line, "duplicate %s", key)
+		}
+		cur.seen[key] = true
+
+		switch key {
+		case "request":
+			cur.call.Request = &pb.HelloRequest{}
+			if err := proto.UnmarshalText(value, cur.call.Request); err != nil {
+				return nil, fixtureErrorf(line, "invalid request: %v", err)
+			}
+		case "reply":
+			cur.call.Reply = &pb.HelloReply{}
+			if err := proto.UnmarshalText(value, cur.call.Reply); err != nil {
+				return nil, fixtureErrorf(line, "invalid reply: %v", err)
+			}
+		case "status":
+			name, msg := value, ""
+			if i := strings.Index(value, " "); i >= 0 {
+				name, msg = value[:i], value[i+1:]
+			}
+			code, ok := codesByName[name]
+			if !ok {
+				return nil, fixtureErrorf(line, "unknown status code %q", name)
+			}
+			cur.code = code
+			cur.msg = strings.TrimSpace(msg)
+		default:
+			return nil, fixtureErrorf(line, "unknown key %q", key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if cur != nil {
+		c, err := cur.finish()
+		if err != nil {
+			return nil, err
+		}
+		calls = append(calls, c)
+	}
+	return calls, nil
+}
+
+// WriteFixture writes calls to w in the canonical fixture format, which ReadFixture reads back
+// into the same calls.
+func WriteFixture(w io.Writer, calls []*Call) error {
+	var buf bytes.Buffer
+	for i, c := range calls {
+		if !isFixtureMethod(c.Method) {
+			return fmt.Errorf("call %d: unknown method %q", i, c.Method)
+		}
+		if c.Request == nil {
+			return fmt.Errorf("call %d: no request", i)
+		}
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		fmt.Fprintf(&buf, "method: %s\n", c.Method)
+		writeFixtureMessage(&buf, "request", c.Request)
+		s := status.Convert(c.Err)
+		if strings.Contains(s.Message(), "\n") {
+			return fmt.Errorf("call %d: status message spans several lines", i)
+		}
+		if s.Code() == codes.OK && c.Reply == nil {
+			return fmt.Errorf("call %d: successful call has no reply", i)
+		}
+		if s.Code() == codes.OK {
+			writeFixtureMessage(&buf, "reply", c.Reply)
+		}
+		if s.Message() != "" {
+			fmt.Fprintf(&buf, "status: %s %s\n", s.Code(), s.Message())
+		} else {
+			fmt.Fprintf(&buf, "status: %s\n", s.Code())
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeFixtureMessage(buf *bytes.Buffer, key string, msg proto.Message) {
+	text := strings.TrimSpace(proto.CompactTextString(msg))
+	if text == "" {
+		fmt.Fprintf(buf, "%s:\n", key)
+		return
+	}
+	fmt.Fprintf(buf, "%s: %s\n", key, text)
+}
+
+// FixtureMetadataPrefix starts the comment line that holds the metadata of the run a fixture was
+// recorded from, as the single line of JSON of a greetworkload.RunMetadata, which
+// greetworkload.ReadRunMetadata reads back.
+const FixtureMetadataPrefix = "# run_metadata: "
+
+// WriteFixtureMetadata writes the comment line holding metadata, to be written before the calls
+// of a fixture so that ReadFixture skips it.
+func WriteFixtureMetadata(w io.Writer, metadata string) error {
+	if strings.Contains(metadata, "\n") {
+		return errors.New("fixture metadata spans several lines")
+	}
+	_, err := fmt.Fprintf(w, "%s%s\n", FixtureMetadataPrefix, metadata)
+	return err
+}
+
+// LoadFixture reads the fixture at path.
+func LoadFixture(path string) ([]*Call, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	calls, err := ReadFixture(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return calls, nil
+}
+
+// SaveFixture writes calls to the fixture at path.
+func SaveFixture(path string, calls []*Call) error {
+	var buf bytes.Buffer
+	if err := WriteFixture(&buf, calls); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0666)
+}
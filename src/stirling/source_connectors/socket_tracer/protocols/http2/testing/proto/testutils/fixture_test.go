@@ -0,0 +1,181 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package testutils_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto/testutils"
+)
+
+const canonicalFixture = `method: /px.stirling.protocols.http2.testing.Greeter/SayHello
+request: name:"pixie" count:2
+reply: message:"Hello pixie" instance_id:"a"
+status: OK
+
+method: /px.stirling.protocols.http2.testing.Greeter2/SayHi
+request:
+status: InvalidArgument invalid name: must not be empty
+
+method: /px.stirling.protocols.http2.testing.Greeter/SayHelloAgain
+request: name:"quoted \"name\" \303\251"
+reply:
+status: OK
+`
+
+func TestReadFixture(t *testing.T) {
+	calls, err := testutils.ReadFixture(strings.NewReader(`
+# Comments and blank lines are ignored, and status defaults to OK.
+method: /px.stirling.protocols.http2.testing.Greeter/SayHello
+request: name: "pixie"
+reply: message: "Hello pixie"
+
+method: /px.stirling.protocols.http2.testing.Greeter2/SayHi
+  request: name: ""
+  status: NotFound
+`))
+	require.NoError(t, err)
+	require.Len(t, calls, 2)
+
+	assert.Equal(t, "/px.stirling.protocols.http2.testing.Greeter/SayHello", calls[0].Method)
+	assert.Equal(t, &pb.HelloRequest{Name: "pixie"}, calls[0].Request)
+	assert.Equal(t, &pb.HelloReply{Message: "Hello pixie"}, calls[0].Reply)
+	assert.NoError(t, calls[0].Err)
+
+	assert.Equal(t, &pb.HelloRequest{}, calls[1].Request)
+	assert.Nil(t, calls[1].Reply)
+	assert.Equal(t, codes.NotFound, status.Code(calls[1].Err))
+}
+
+func TestFixture_RoundTrip(t *testing.T) {
+	calls, err := testutils.ReadFixture(strings.NewReader(canonicalFixture))
+	require.NoError(t, err)
+	require.Len(t, calls, 3)
+
+	var buf bytes.Buffer
+	require.NoError(t, testutils.WriteFixture(&buf, calls))
+	assert.Equal(t, canonicalFixture, buf.String())
+
+	path := filepath.Join(t.TempDir(), "calls.fixture")
+	require.NoError(t, testutils.SaveFixture(path, calls))
+	loaded, err := testutils.LoadFixture(path)
+	require.NoError(t, err)
+	require.NoError(t, testutils.SaveFixture(path, loaded))
+	reloaded, err := testutils.LoadFixture(path)
+	require.NoError(t, err)
+	assert.Equal(t, loaded, reloaded)
+}
+
+func TestFixture_RecordedCalls(t *testing.T) {
+	r := testutils.NewRecorder()
+	r.Record("/px.stirling.protocols.http2.testing.Greeter/SayHello", &pb.HelloRequest{Name: "pixie"}, &pb.HelloReply{Message: "Hello pixie"}, nil)
+	r.Record("/px.stirling.protocols.http2.testing.Greeter/SayHello", &pb.HelloRequest{}, nil, status.Error(codes.InvalidArgument, "bad"))
+
+	var buf bytes.Buffer
+	require.NoError(t, testutils.WriteFixture(&buf, r.Calls()))
+	calls, err := testutils.ReadFixture(&buf)
+	require.NoError(t, err)
+	require.Len(t, calls, 2)
+	assert.Equal(t, r.Calls()[0], calls[0])
+	assert.Equal(t, "rpc error: code = InvalidArgument desc = bad", calls[1].Err.Error())
+}
+
+func TestFixture_Metadata(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, testutils.WriteFixtureMetadata(&buf, `{"seed":1}`))
+	require.NoError(t, testutils.WriteFixture(&buf, []*testutils.Call{{
+		Method:  "/px.stirling.protocols.http2.testing.Greeter/SayHello",
+		Request: &pb.HelloRequest{Name: "pixie"},
+		Reply:   &pb.HelloReply{Message: "Hello pixie"},
+	}}))
+	assert.True(t, strings.HasPrefix(buf.String(), "# run_metadata: {\"seed\":1}\nmethod: "), buf.String())
+
+	// The metadata is a comment, which ReadFixture skips.
+	calls, err := testutils.ReadFixture(&buf)
+	require.NoError(t, err)
+	require.Len(t, calls, 1)
+
+	assert.Error(t, testutils.WriteFixtureMetadata(&bytes.Buffer{}, "{\n}"))
+}
+
+func TestReadFixture_Malformed(t *testing.T) {
+	const sayHello = "method: /px.stirling.protocols.http2.testing.Greeter/SayHello\n"
+	tests := []struct {
+		name     string
+		fixture  string
+		wantLine int
+		wantErr  string
+	}{
+		{"unknown method", "\nmethod: /px.stirling.protocols.http2.testing.Greeter/SayBye\n", 2, "unknown method"},
+		{"streaming method", "method: /px.stirling.protocols.http2.testing.StreamingGreeter/SayHelloBidirStreaming\n", 1, "unknown method"},
+		{"key before method", "request: name: \"a\"\n", 1, "before the first method"},
+		{"not key value", sayHello + "request\n", 2, "key: value"},
+		{"unknown key", sayHello + "request: name: \"a\"\nheaders: x\n", 3, "unknown key"},
+		{"duplicate key", sayHello + "request: name: \"a\"\nrequest: name: \"b\"\n", 3, "duplicate request"},
+		{"bad request", sayHello + "request: nom: \"a\"\n", 2, "invalid request"},
+		{"bad reply", sayHello + "request:\nreply: message: 1\n", 3, "invalid reply"},
+		{"unknown code", sayHello + "request:\nstatus: Oops\n", 3, "unknown status code"},
+		{"missing request", sayHello + "\n" + sayHello + "request:\n", 1, "has no request"},
+		{"missing request at end", sayHello + "request:\nreply:\n# last\n" + sayHello, 5, "has no request"},
+		{"reply with error", sayHello + "request:\nreply:\nstatus: Internal\n", 1, "both a reply and status"},
+		{"no reply", sayHello + "request:\nstatus: OK\n", 1, "has no reply"},
+		{"no reply or status", sayHello + "request:\n\n" + sayHello + "request:\nreply:\n", 1, "has no reply"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := testutils.ReadFixture(strings.NewReader(tc.fixture))
+			var fixtureErr *testutils.FixtureError
+			require.True(t, errors.As(err, &fixtureErr), "got %v", err)
+			assert.Equal(t, tc.wantLine, fixtureErr.Line)
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+func TestLoadFixture_ReportsPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.fixture")
+	require.NoError(t, os.WriteFile(path, []byte("# header\nmethod: /unknown/Method\n"), 0666))
+	_, err := testutils.LoadFixture(path)
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), path+": line 2: "), err.Error())
+}
+
+func TestWriteFixture_RejectsUnknownMethod(t *testing.T) {
+	err := testutils.WriteFixture(&bytes.Buffer{}, []*testutils.Call{{Method: "/unknown/Method", Request: &pb.HelloRequest{}}})
+	assert.Error(t, err)
+}
+
+func TestWriteFixture_RejectsSuccessWithoutReply(t *testing.T) {
+	err := testutils.WriteFixture(&bytes.Buffer{}, []*testutils.Call{{
+		Method:  "/px.stirling.protocols.http2.testing.Greeter/SayHello",
+		Request: &pb.HelloRequest{},
+	}})
+	assert.Error(t, err)
+}
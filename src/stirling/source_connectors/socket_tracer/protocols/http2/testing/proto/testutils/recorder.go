@@ -0,0 +1,107 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package testutils
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// Call is a unary greet call captured by a Recorder.
+type Call struct {
+	Method  string
+	Request *pb.HelloRequest
+	Reply   *pb.HelloReply
+	Err     error
+}
+
+// Recorder keeps the history of the greet calls that pass through it. Messages are cloned on
+// capture, so callers are free to mutate or reuse them afterwards.
+type Recorder struct {
+	mu    sync.Mutex
+	calls []*Call
+}
+
+// NewRecorder creates an empty Recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Record captures a call.
+func (r *Recorder) Record(method string, req *pb.HelloRequest, reply *pb.HelloReply, err error) {
+	c := &Call{
+		Method:  method,
+		Request: req.Clone(),
+		Reply:   reply.Clone(),
+		Err:     err,
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, c)
+}
+
+// Calls returns the calls captured so far, in capture order.
+func (r *Recorder) Calls() []*Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	calls := make([]*Call, len(r.calls))
+	copy(calls, r.calls)
+	return calls
+}
+
+// Reset drops every captured call.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = nil
+}
+
+func (r *Recorder) recordMessages(method string, req, reply interface{}, err error) {
+	in, ok := req.(*pb.HelloRequest)
+	if !ok {
+		return
+	}
+	out, _ := reply.(*pb.HelloReply)
+	r.Record(method, in, out, err)
+}
+
+// UnaryClientInterceptor returns an interceptor that records every unary greet call made by a client.
+func (r *Recorder) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if err != nil {
+			reply = nil
+		}
+		r.recordMessages(method, req, reply, err)
+		return err
+	}
+}
+
+// UnaryServerInterceptor returns an interceptor that records every unary greet call handled by a server.
+func (r *Recorder) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		reply, err := handler(ctx, req)
+		r.recordMessages(info.FullMethod, req, reply, err)
+		return reply, err
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package testutils_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto/testutils"
+)
+
+func TestRecorder_MutationAfterCapture(t *testing.T) {
+	r := testutils.NewRecorder()
+	req := &pb.HelloRequest{Name: "pixie", Count: 3}
+	reply := &pb.HelloReply{Message: "Hello pixie"}
+	r.Record("/px.stirling.protocols.http2.testing.Greeter/SayHello", req, reply, nil)
+
+	req.Name = "mutated"
+	req.Count = 10
+	reply.Message = "mutated"
+
+	calls := r.Calls()
+	require.Len(t, calls, 1)
+	assert.Equal(t, &pb.HelloRequest{Name: "pixie", Count: 3}, calls[0].Request)
+	assert.Equal(t, &pb.HelloReply{Message: "Hello pixie"}, calls[0].Reply)
+}
+
+func TestRecorder_UnaryServerInterceptor(t *testing.T) {
+	r := testutils.NewRecorder()
+	interceptor := r.UnaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/px.stirling.protocols.http2.testing.Greeter/SayHello"}
+
+	req := &pb.HelloRequest{Name: "a"}
+	handler := func(ctx context.Context, in interface{}) (interface{}, error) {
+		return &pb.HelloReply{Message: "Hello " + in.(*pb.HelloRequest).Name}, nil
+	}
+	_, err := interceptor(context.Background(), req, info, handler)
+	require.NoError(t, err)
+
+	// Callers commonly reuse request objects across calls.
+	req.Name = "b"
+	failing := func(ctx context.Context, in interface{}) (interface{}, error) {
+		return nil, errors.New("failed")
+	}
+	_, err = interceptor(context.Background(), req, info, failing)
+	require.Error(t, err)
+
+	calls := r.Calls()
+	require.Len(t, calls, 2)
+	assert.Equal(t, info.FullMethod, calls[0].Method)
+	assert.Equal(t, "a", calls[0].Request.Name)
+	assert.Equal(t, "Hello a", calls[0].Reply.Message)
+	assert.Equal(t, "b", calls[1].Request.Name)
+	assert.Nil(t, calls[1].Reply)
+	assert.Error(t, calls[1].Err)
+
+	r.Reset()
+	assert.Empty(t, r.Calls())
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package testutils
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// ReplyStream is the receiving side of a greet call streaming replies, such as
+// greetpb.StreamingGreeter_SayHelloServerStreamingClient or
+// greetpb.StreamingGreeter_SayHelloBidirStreamingClient.
+type ReplyStream interface {
+	Recv() (*pb.HelloReply, error)
+	grpc.ClientStream
+}
+
+// StopReason is why ConsumeStream stopped reading a stream.
+type StopReason int
+
+const (
+	// StopEOF is a stream the server ended with OK.
+	StopEOF StopReason = iota
+	// StopError is a stream the call failed on, with the status the server or gRPC ended it with.
+	StopError
+	// StopLimit is a stream left once ConsumeOptions.MaxMessages were read.
+	StopLimit
+	// StopCallback is a stream left because ConsumeOptions.OnMessage returned an error.
+	StopCallback
+	// StopContext is a stream left because the context of ConsumeStream was done.
+	StopContext
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case StopEOF:
+		return "eof"
+	case StopError:
+		return "error"
+	case StopLimit:
+		return "limit"
+	case StopCallback:
+		return "callback"
+	case StopContext:
+		return "context"
+	}
+	return "unknown"
+}
+
+// ConsumeOptions tune how ConsumeStream reads a stream.
+type ConsumeOptions struct {
+	// MaxMessages, if positive, stops reading after this many messages.
+	MaxMessages int
+	// OnMessage, if set, is called with every message as it is received. Returning an error stops
+	// reading, and ConsumeStream returns that error.
+	OnMessage func(reply *pb.HelloReply) error
+	// Cancel, if set, is the cancel function of the context the stream was created with. Reading
+	// stopped before the call ended then closes the send side of the stream and cancels the call,
+	// so that the server sees it end rather than blocking on flow control. Without it, the stream
+	// is left as is for the caller to carry on with, and a done ctx only stops reading between
+	// messages.
+	Cancel context.CancelFunc
+}
+
+// StreamSummary describes a stream read by ConsumeStream.
+type StreamSummary struct {
+	Reason StopReason
+	// Messages and Bytes count the messages received and their marshaled size.
+	Messages int
+	Bytes    int
+	// Status is the status the call ended with: OK on EOF, the status it failed with, or Canceled
+	// once cancelled through ConsumeOptions.Cancel. It is nil if the call was left running.
+	Status   *status.Status
+	Duration time.Duration
+}
+
+// ConsumeStream reads the replies of stream until the server ends it, the call fails, the options
+// say to stop, or ctx is done. It returns nil for streams ended by the server with OK or stopped at
+// ConsumeOptions.MaxMessages, and otherwise the status error of the call, the error of
+// ConsumeOptions.OnMessage, or ctx.Err(). The summary is returned in every case.
+func ConsumeStream(ctx context.Context, stream ReplyStream, opts *ConsumeOptions) (*StreamSummary, error) {
+	if opts == nil {
+		opts = &ConsumeOptions{}
+	}
+	start := time.Now()
+	summary := &StreamSummary{}
+	defer func() { summary.Duration = time.Since(start) }()
+
+	if opts.Cancel != nil {
+		// Interrupts a blocked Recv once ctx is done.
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				opts.Cancel()
+			case <-stop:
+			}
+		}()
+	}
+
+	for {
+		if opts.MaxMessages > 0 && summary.Messages >= opts.MaxMessages {
+			summary.Reason = StopLimit
+			stopEarly(stream, opts, summary)
+			return summary, nil
+		}
+		if err := ctx.Err(); err != nil {
+			summary.Reason = StopContext
+			if stopEarly(stream, opts, summary) {
+				summary.Status = status.FromContextError(err)
+			}
+			return summary, err
+		}
+		reply, err := stream.Recv()
+		if err == io.EOF {
+			summary.Reason = StopEOF
+			summary.Status = status.New(codes.OK, "")
+			return summary, nil
+		}
+		if err != nil {
+			summary.Status = status.Convert(err)
+			// The call was cancelled because ctx is done, rather than failed on its own.
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				summary.Reason = StopContext
+				return summary, ctxErr
+			}
+			summary.Reason = StopError
+			return summary, err
+		}
+		summary.Messages++
+		summary.Bytes += reply.Size()
+		if opts.OnMessage != nil {
+			if err := opts.OnMessage(reply); err != nil {
+				summary.Reason = StopCallback
+				stopEarly(stream, opts, summary)
+				return summary, err
+			}
+		}
+	}
+}
+
+// stopEarly ends the call of a stream left before its end, and returns true, if opts allow it.
+func stopEarly(stream ReplyStream, opts *ConsumeOptions, summary *StreamSummary) bool {
+	if opts.Cancel == nil {
+		return false
+	}
+	// Lets a bidirectional call know no more requests are coming, before cancelling it.
+	_ = stream.CloseSend()
+	opts.Cancel()
+	summary.Status = status.New(codes.Canceled, context.Canceled.Error())
+	return true
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package testutils_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto/testutils"
+)
+
+// streamServer streams Count replies, and then ends the call the way the request name says:
+// "fail" with Internal, "block" by waiting for the call to be cancelled.
+type streamServer struct {
+	pb.UnimplementedStreamingGreeterServer
+	// ended receives the context error of every call that ended by being cancelled.
+	ended chan error
+}
+
+func (s *streamServer) SayHelloServerStreaming(req *pb.HelloRequest, stream pb.StreamingGreeter_SayHelloServerStreamingServer) error {
+	for i := 0; i < int(req.Count); i++ {
+		if err := stream.Send(&pb.HelloReply{Message: fmt.Sprintf("Hello %s #%d", req.Name, i)}); err != nil {
+			return err
+		}
+	}
+	switch req.Name {
+	case "fail":
+		return status.Error(codes.Internal, "boom")
+	case "block":
+		<-stream.Context().Done()
+		s.ended <- stream.Context().Err()
+		return stream.Context().Err()
+	}
+	return nil
+}
+
+func (s *streamServer) SayHelloBidirStreaming(stream pb.StreamingGreeter_SayHelloBidirStreamingServer) error {
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			s.ended <- stream.Context().Err()
+			return err
+		}
+		if err := stream.Send(&pb.HelloReply{Message: "Hello " + req.Name}); err != nil {
+			return err
+		}
+	}
+}
+
+func startStreamServer(t *testing.T) (*streamServer, pb.StreamingGreeterClient) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &streamServer{ended: make(chan error, 1)}
+	s := grpc.NewServer()
+	pb.RegisterStreamingGreeterServer(s, srv)
+	go func() { _ = s.Serve(lis) }()
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return srv, pb.NewStreamingGreeterClient(conn)
+}
+
+func TestConsumeStream_EOF(t *testing.T) {
+	_, client := startStreamServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.SayHelloServerStreaming(ctx, &pb.HelloRequest{Name: "pixie", Count: 5})
+	require.NoError(t, err)
+
+	var messages []string
+	bytes := 0
+	summary, err := testutils.ConsumeStream(ctx, stream, &testutils.ConsumeOptions{
+		OnMessage: func(reply *pb.HelloReply) error {
+			messages = append(messages, reply.Message)
+			bytes += reply.Size()
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, testutils.StopEOF, summary.Reason)
+	assert.Equal(t, 5, summary.Messages)
+	assert.Equal(t, bytes, summary.Bytes)
+	assert.Equal(t, codes.OK, summary.Status.Code())
+	assert.Positive(t, summary.Duration)
+	assert.Equal(t, []string{"Hello pixie #0", "Hello pixie #1", "Hello pixie #2", "Hello pixie #3", "Hello pixie #4"}, messages)
+}
+
+func TestConsumeStream_ServerErrorMidStream(t *testing.T) {
+	_, client := startStreamServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.SayHelloServerStreaming(ctx, &pb.HelloRequest{Name: "fail", Count: 2})
+	require.NoError(t, err)
+
+	summary, err := testutils.ConsumeStream(ctx, stream, nil)
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Equal(t, testutils.StopError, summary.Reason)
+	assert.Equal(t, 2, summary.Messages)
+	assert.Equal(t, codes.Internal, summary.Status.Code())
+	assert.Equal(t, "boom", summary.Status.Message())
+}
+
+func TestConsumeStream_LimitCancels(t *testing.T) {
+	srv, client := startStreamServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	streamCtx, cancelStream := context.WithCancel(ctx)
+	defer cancelStream()
+	stream, err := client.SayHelloServerStreaming(streamCtx, &pb.HelloRequest{Name: "block", Count: 10})
+	require.NoError(t, err)
+
+	summary, err := testutils.ConsumeStream(ctx, stream, &testutils.ConsumeOptions{MaxMessages: 3, Cancel: cancelStream})
+	require.NoError(t, err)
+	assert.Equal(t, testutils.StopLimit, summary.Reason)
+	assert.Equal(t, 3, summary.Messages)
+	assert.Equal(t, codes.Canceled, summary.Status.Code())
+	// The server sees the call end rather than wait for the rest to be read.
+	select {
+	case err := <-srv.ended:
+		assert.Equal(t, context.Canceled, err)
+	case <-ctx.Done():
+		t.Fatal("the server did not see the call cancelled")
+	}
+}
+
+func TestConsumeStream_LimitLeavesStream(t *testing.T) {
+	_, client := startStreamServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.SayHelloServerStreaming(ctx, &pb.HelloRequest{Name: "pixie", Count: 4})
+	require.NoError(t, err)
+
+	summary, err := testutils.ConsumeStream(ctx, stream, &testutils.ConsumeOptions{MaxMessages: 3})
+	require.NoError(t, err)
+	assert.Equal(t, testutils.StopLimit, summary.Reason)
+	assert.Nil(t, summary.Status)
+
+	summary, err = testutils.ConsumeStream(ctx, stream, nil)
+	require.NoError(t, err)
+	assert.Equal(t, testutils.StopEOF, summary.Reason)
+	assert.Equal(t, 1, summary.Messages)
+}
+
+func TestConsumeStream_ContextTimeout(t *testing.T) {
+	_, client := startStreamServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	stream, err := client.SayHelloServerStreaming(ctx, &pb.HelloRequest{Name: "block", Count: 1})
+	require.NoError(t, err)
+
+	summary, err := testutils.ConsumeStream(ctx, stream, nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, testutils.StopContext, summary.Reason)
+	assert.Equal(t, 1, summary.Messages)
+	assert.Equal(t, codes.DeadlineExceeded, summary.Status.Code())
+}
+
+func TestConsumeStream_ContextTimeoutCancelsStream(t *testing.T) {
+	srv, client := startStreamServer(t)
+	// The stream outlives the context it is read under, so only Cancel can interrupt Recv.
+	streamCtx, cancelStream := context.WithCancel(context.Background())
+	defer cancelStream()
+	stream, err := client.SayHelloServerStreaming(streamCtx, &pb.HelloRequest{Name: "block", Count: 1})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	summary, err := testutils.ConsumeStream(ctx, stream, &testutils.ConsumeOptions{Cancel: cancelStream})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, testutils.StopContext, summary.Reason)
+	assert.Equal(t, 1, summary.Messages)
+	assert.Equal(t, codes.Canceled, summary.Status.Code())
+	assert.Equal(t, context.Canceled, <-srv.ended)
+}
+
+func TestConsumeStream_CallbackStopsBidir(t *testing.T) {
+	srv, client := startStreamServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	streamCtx, cancelStream := context.WithCancel(ctx)
+	defer cancelStream()
+	stream, err := client.SayHelloBidirStreaming(streamCtx)
+	require.NoError(t, err)
+	for _, name := range []string{"a", "b", "c"} {
+		require.NoError(t, stream.Send(&pb.HelloRequest{Name: name}))
+	}
+
+	errStop := errors.New("stop")
+	summary, err := testutils.ConsumeStream(ctx, stream, &testutils.ConsumeOptions{
+		OnMessage: func(reply *pb.HelloReply) error {
+			if reply.Message == "Hello b" {
+				return errStop
+			}
+			return nil
+		},
+		Cancel: cancelStream,
+	})
+	assert.Equal(t, errStop, err)
+	assert.Equal(t, testutils.StopCallback, summary.Reason)
+	assert.Equal(t, 2, summary.Messages)
+	assert.Equal(t, codes.Canceled, summary.Status.Code())
+	select {
+	case <-srv.ended:
+	case <-ctx.Done():
+		t.Fatal("the server did not see the call end")
+	}
+}
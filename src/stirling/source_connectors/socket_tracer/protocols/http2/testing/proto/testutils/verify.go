@@ -0,0 +1,103 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package testutils
+
+import (
+	"sort"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/payloadgen"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// RequestDiff lists the differences between an expected and an actual multiset of requests.
+// Both slices are sorted with greetpb.CompareHelloRequest.
+type RequestDiff struct {
+	// Missing holds the expected requests that did not appear in actual.
+	Missing []*pb.HelloRequest
+	// Extra holds the actual requests that were not expected.
+	Extra []*pb.HelloRequest
+}
+
+// Empty returns true if expected and actual matched exactly.
+func (d *RequestDiff) Empty() bool {
+	return len(d.Missing) == 0 && len(d.Extra) == 0
+}
+
+type requestBucket struct {
+	req   *pb.HelloRequest
+	count int
+}
+
+// DiffRequests compares expected and actual as multisets, ignoring order. Requests are keyed by
+// their Hash, and compared with greetpb.EqualHelloRequest within a bucket so that hash collisions can't hide a diff.
+func DiffRequests(expected, actual []*pb.HelloRequest) *RequestDiff {
+	buckets := make(map[uint64][]requestBucket, len(expected))
+	for _, req := range expected {
+		h := req.Hash()
+		b := buckets[h]
+		found := false
+		for i := range b {
+			if pb.EqualHelloRequest(b[i].req, req) {
+				b[i].count++
+				found = true
+				break
+			}
+		}
+		if !found {
+			buckets[h] = append(b, requestBucket{req: req, count: 1})
+		}
+	}
+
+	diff := &RequestDiff{}
+	for _, req := range actual {
+		b := buckets[req.Hash()]
+		found := false
+		for i := range b {
+			if b[i].count > 0 && pb.EqualHelloRequest(b[i].req, req) {
+				b[i].count--
+				found = true
+				break
+			}
+		}
+		if !found {
+			diff.Extra = append(diff.Extra, req)
+		}
+	}
+	for _, b := range buckets {
+		for _, e := range b {
+			for i := 0; i < e.count; i++ {
+				diff.Missing = append(diff.Missing, e.req)
+			}
+		}
+	}
+
+	sortRequests(diff.Missing)
+	sortRequests(diff.Extra)
+	return diff
+}
+
+// DiffGeneratedRequests compares actual, ignoring order, with the n requests gen makes from index
+// first on, which are recomputed rather than stored.
+func DiffGeneratedRequests(gen *payloadgen.Generator, first uint64, n int, actual []*pb.HelloRequest) *RequestDiff {
+	return DiffRequests(gen.Requests(first, n), actual)
+}
+
+func sortRequests(reqs []*pb.HelloRequest) {
+	sort.Slice(reqs, func(i, j int) bool { return pb.CompareHelloRequest(reqs[i], reqs[j]) < 0 })
+}
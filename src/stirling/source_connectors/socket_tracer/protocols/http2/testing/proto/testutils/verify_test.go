@@ -0,0 +1,114 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package testutils_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/payloadgen"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto/testutils"
+)
+
+func TestDiffRequests(t *testing.T) {
+	expected := []*pb.HelloRequest{
+		{Name: "a", Count: 1},
+		{Name: "a", Count: 1},
+		{Name: "b,c"},
+		{Name: "d"},
+	}
+	actual := []*pb.HelloRequest{
+		{Name: "d"},
+		{Name: "a", Count: 1},
+		{Name: "b"},
+		{Name: "b,c"},
+	}
+	diff := testutils.DiffRequests(expected, actual)
+	assert.False(t, diff.Empty())
+	assert.Equal(t, []*pb.HelloRequest{{Name: "a", Count: 1}}, diff.Missing)
+	assert.Equal(t, []*pb.HelloRequest{{Name: "b"}}, diff.Extra)
+
+	reordered := []*pb.HelloRequest{expected[3], expected[2], expected[1], expected[0]}
+	assert.True(t, testutils.DiffRequests(expected, reordered).Empty())
+}
+
+func TestDiffRequests_NilIsNotEmpty(t *testing.T) {
+	diff := testutils.DiffRequests([]*pb.HelloRequest{nil, {}}, []*pb.HelloRequest{{}, {}})
+	assert.Equal(t, []*pb.HelloRequest{nil}, diff.Missing)
+	assert.Equal(t, []*pb.HelloRequest{{}}, diff.Extra)
+	assert.True(t, testutils.DiffRequests([]*pb.HelloRequest{nil, {}}, []*pb.HelloRequest{{}, nil}).Empty())
+}
+
+func TestDiffGeneratedRequests(t *testing.T) {
+	gen, err := payloadgen.New(&payloadgen.Options{
+		Seed:     1,
+		Alphabet: payloadgen.AlphabetUTF8,
+		Size:     payloadgen.SizeDist{Kind: payloadgen.SizeUniform, Min: 1, Max: 32},
+	})
+	require.NoError(t, err)
+
+	// What a traced client sent, in another order, as seen by a separate process.
+	actual := []*pb.HelloRequest{gen.Request(12), gen.Request(10), gen.Request(11)}
+	assert.True(t, testutils.DiffGeneratedRequests(gen, 10, 3, actual).Empty())
+
+	actual[0] = &pb.HelloRequest{Name: "corrupted"}
+	diff := testutils.DiffGeneratedRequests(gen, 10, 3, actual)
+	assert.Equal(t, []*pb.HelloRequest{gen.Request(12)}, diff.Missing)
+	assert.Equal(t, []*pb.HelloRequest{{Name: "corrupted"}}, diff.Extra)
+}
+
+func makeRequests(n int) []*pb.HelloRequest {
+	reqs := make([]*pb.HelloRequest, n)
+	for i := range reqs {
+		reqs[i] = &pb.HelloRequest{Name: fmt.Sprintf("name-%d", i%100), Count: int32(i)}
+	}
+	return reqs
+}
+
+func BenchmarkDiffRequests(b *testing.B) {
+	expected := makeRequests(10000)
+	actual := makeRequests(10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		testutils.DiffRequests(expected, actual)
+	}
+}
+
+// BenchmarkDiffRequestsByString is a baseline for DiffRequests: the same multiset diff, keyed by
+// String() instead of Hash.
+func BenchmarkDiffRequestsByString(b *testing.B) {
+	expected := makeRequests(10000)
+	actual := makeRequests(10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		counts := make(map[string]int)
+		for _, r := range expected {
+			counts[r.String()]++
+		}
+		for _, r := range actual {
+			counts[r.String()]--
+		}
+	}
+}
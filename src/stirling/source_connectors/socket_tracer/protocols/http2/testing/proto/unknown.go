@@ -0,0 +1,48 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetpb
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/runtime/protoimpl"
+)
+
+// UnknownFields returns the fields of data, the wire encoding of a message of the type of m, that
+// the message does not declare, in the order data holds them, or nil if there are none. The
+// generated greetpb messages skip them when they unmarshal, and so drop them when they are
+// marshaled again. Only the fields of the message itself are checked, not those of the messages
+// it holds. Errors report data that is not a valid wire encoding.
+func UnknownFields(m Message, data []byte) ([]byte, error) {
+	fields := protoimpl.X.MessageDescriptorOf(m).Fields()
+	var unknown []byte
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		v := protowire.ConsumeFieldValue(num, typ, data[n:])
+		if v < 0 {
+			return nil, protowire.ParseError(v)
+		}
+		if fields.ByNumber(num) == nil {
+			unknown = append(unknown, data[:n+v]...)
+		}
+		data = data[n+v:]
+	}
+	return unknown, nil
+}
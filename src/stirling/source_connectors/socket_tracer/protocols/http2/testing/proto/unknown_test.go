@@ -0,0 +1,116 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetpb_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// unknownFieldsOfEveryType are fields greet.proto does not declare, one of every wire type.
+func unknownFieldsOfEveryType() [][]byte {
+	var fields [][]byte
+	b := protowire.AppendTag(nil, 15, protowire.VarintType)
+	fields = append(fields, protowire.AppendVarint(b, 1<<40))
+	b = protowire.AppendTag(nil, 16, protowire.Fixed32Type)
+	fields = append(fields, protowire.AppendFixed32(b, 0xdeadbeef))
+	b = protowire.AppendTag(nil, 17, protowire.Fixed64Type)
+	fields = append(fields, protowire.AppendFixed64(b, 0x0123456789abcdef))
+	b = protowire.AppendTag(nil, 18, protowire.BytesType)
+	fields = append(fields, protowire.AppendString(b, "from a newer client"))
+	b = protowire.AppendTag(nil, 19, protowire.StartGroupType)
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, 7)
+	fields = append(fields, protowire.AppendTag(b, 19, protowire.EndGroupType))
+	// The largest field number.
+	b = protowire.AppendTag(nil, protowire.MaxValidNumber, protowire.BytesType)
+	fields = append(fields, protowire.AppendBytes(b, nil))
+	return fields
+}
+
+func TestUnknownFields(t *testing.T) {
+	known, err := (&pb.HelloRequest{Name: "world", Count: 3, Payload: []byte{1, 2}}).Marshal()
+	require.NoError(t, err)
+	// The fields of known, one by one.
+	name, count, payload := known[:7], known[7:9], known[9:]
+
+	var all []byte
+	for _, f := range unknownFieldsOfEveryType() {
+		all = append(all, f...)
+		for _, data := range [][]byte{
+			append(append([]byte{}, f...), known...),
+			concat(name, f, count, payload),
+			concat(known, f),
+		} {
+			unknown, err := pb.UnknownFields(&pb.HelloRequest{}, data)
+			require.NoError(t, err)
+			assert.Equal(t, f, unknown)
+
+			// The generated messages skip them.
+			m := &pb.HelloRequest{}
+			require.NoError(t, m.Unmarshal(data))
+			assert.Equal(t, &pb.HelloRequest{Name: "world", Count: 3, Payload: []byte{1, 2}}, m)
+		}
+	}
+	// Interleaved with the known fields, they are returned in order.
+	fs := unknownFieldsOfEveryType()
+	unknown, err := pb.UnknownFields(&pb.HelloRequest{}, concat(fs[0], fs[1], name, fs[2], count, fs[3], fs[4], payload, fs[5]))
+	require.NoError(t, err)
+	assert.Equal(t, all, unknown)
+
+	unknown, err = pb.UnknownFields(&pb.HelloRequest{}, known)
+	require.NoError(t, err)
+	assert.Nil(t, unknown)
+	unknown, err = pb.UnknownFields(&pb.HelloRequest{}, nil)
+	require.NoError(t, err)
+	assert.Nil(t, unknown)
+
+	// The fields of one message are unknown to another.
+	unknown, err = pb.UnknownFields(&pb.GetStatsRequest{}, known)
+	require.NoError(t, err)
+	assert.Equal(t, known, unknown)
+}
+
+func TestUnknownFields_Invalid(t *testing.T) {
+	f := unknownFieldsOfEveryType()[3]
+	for _, data := range [][]byte{
+		f[:len(f)-1],
+		{0x80},
+		// Field number 0.
+		{0x00, 0x01},
+		// An unterminated group.
+		unknownFieldsOfEveryType()[4][:5],
+	} {
+		_, err := pb.UnknownFields(&pb.HelloRequest{}, data)
+		assert.Error(t, err, "%x", data)
+	}
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
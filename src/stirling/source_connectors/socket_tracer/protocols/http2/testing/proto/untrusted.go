@@ -0,0 +1,136 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package greetpb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/runtime/protoimpl"
+)
+
+// LengthError reports a length-delimited field whose length runs past the end of the data, or of
+// the message holding it.
+type LengthError struct {
+	// Offset is that of the first byte of the field's value.
+	Offset int
+	// Length is the length the field claims.
+	Length uint64
+	// Remaining is the number of bytes left from Offset.
+	Remaining int
+}
+
+func (e *LengthError) Error() string {
+	return fmt.Sprintf("proto: length %d at offset %d runs past the %d bytes left", e.Length, e.Offset, e.Remaining)
+}
+
+// Unwrap returns ErrInvalidLengthGreet, which the generated Unmarshal fails with for some of the
+// same lengths.
+func (e *LengthError) Unwrap() error {
+	return ErrInvalidLengthGreet
+}
+
+// UnmarshalUntrusted unmarshals data into m, as m.Unmarshal does, once it checks that no length
+// in data runs past the end of the bytes left, for data read off the wire or from files. The
+// generated Unmarshal adds lengths to offsets as ints, which wraps around on 32-bit platforms for
+// lengths near math.MaxInt32, so that some are accepted there. The lengths are compared here as
+// uint64s, to the same effect on every platform, and those that run past the end are reported as a
+// *LengthError. The fields of the messages that m holds are checked too, but not those of unknown
+// fields.
+func UnmarshalUntrusted(data []byte, m Message) error {
+	if err := checkLengths(data, 0, protoimpl.X.MessageDescriptorOf(m)); err != nil {
+		return err
+	}
+	return m.Unmarshal(data)
+}
+
+// checkLengths checks the lengths of the fields in data, the wire encoding of a message of desc
+// found at offset.
+func checkLengths(data []byte, offset int, desc protoreflect.MessageDescriptor) error {
+	for i := 0; i < len(data); {
+		tag, n, err := consumeVarint(data[i:])
+		if err != nil {
+			return err
+		}
+		i += n
+		num, typ := protowire.Number(tag>>3), protowire.Type(tag&7)
+		switch typ {
+		case protowire.VarintType:
+			_, n, err := consumeVarint(data[i:])
+			if err != nil {
+				return err
+			}
+			i += n
+		case protowire.Fixed32Type, protowire.Fixed64Type:
+			n := 4
+			if typ == protowire.Fixed64Type {
+				n = 8
+			}
+			if len(data)-i < n {
+				return io.ErrUnexpectedEOF
+			}
+			i += n
+		case protowire.BytesType:
+			length, n, err := consumeVarint(data[i:])
+			if err != nil {
+				return err
+			}
+			i += n
+			// Never added to i before it is known to fit.
+			if length > uint64(len(data)-i) {
+				return &LengthError{Offset: offset + i, Length: length, Remaining: len(data) - i}
+			}
+			end := i + int(length)
+			if fd := desc.Fields().ByNumber(num); fd != nil && fd.Kind() == protoreflect.MessageKind {
+				if err := checkLengths(data[i:end], offset+i, fd.Message()); err != nil {
+					return err
+				}
+			}
+			i = end
+		case protowire.StartGroupType:
+			// Groups are only found in unknown fields, which protowire skips with the same checks.
+			n := protowire.ConsumeFieldValue(num, typ, data[i:])
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			i += n
+		default:
+			return fmt.Errorf("proto: illegal wire type %d at offset %d", typ, offset+i)
+		}
+	}
+	return nil
+}
+
+// consumeVarint decodes the varint at the start of b, and returns it and its length. A varint
+// that does not fit in a uint64, with a 10th byte over 1 or an 11th byte, is ErrIntOverflowGreet.
+func consumeVarint(b []byte) (uint64, int, error) {
+	var v uint64
+	for i := 0; i < len(b); i++ {
+		if i == binary.MaxVarintLen64 || i == binary.MaxVarintLen64-1 && b[i] > 1 {
+			return 0, 0, ErrIntOverflowGreet
+		}
+		v |= uint64(b[i]&0x7f) << (7 * i)
+		if b[i] < 0x80 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, io.ErrUnexpectedEOF
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetpb_test
+
+import (
+	"errors"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// lengthField encodes field num as a length-delimited field claiming length, followed by value.
+func lengthField(num protowire.Number, length uint64, value []byte) []byte {
+	b := protowire.AppendTag(nil, num, protowire.BytesType)
+	b = protowire.AppendVarint(b, length)
+	return append(b, value...)
+}
+
+func TestUnmarshalUntrusted_LengthsPastTheEnd(t *testing.T) {
+	const nameField, payloadField, requestsField = 1, 3, 1
+	// The generated Unmarshal of 32-bit platforms takes 1<<32+3 for the 3 bytes left, as it
+	// truncates lengths to ints.
+	for _, length := range []uint64{math.MaxInt32, math.MaxInt64, math.MaxUint64, 1<<32 + 3, 4} {
+		nested := lengthField(nameField, length, []byte("abc"))
+		for _, tc := range []struct {
+			desc   string
+			data   []byte
+			m      pb.Message
+			offset int
+		}{
+			{"name", lengthField(nameField, length, []byte("abc")), &pb.HelloRequest{}, len(nested) - 3},
+			{"payload", lengthField(payloadField, length, []byte("abc")), &pb.HelloRequest{}, len(nested) - 3},
+			{
+				desc: "nested name",
+				// The request fits the batch, but its name runs past the end of the request.
+				data:   lengthField(requestsField, uint64(len(nested)), nested),
+				m:      &pb.HelloBatchRequest{},
+				offset: 2 + len(nested) - 3,
+			},
+		} {
+			err := pb.UnmarshalUntrusted(tc.data, tc.m)
+			assert.ErrorIs(t, err, pb.ErrInvalidLengthGreet, "%s of length %d", tc.desc, length)
+			var lengthErr *pb.LengthError
+			require.True(t, errors.As(err, &lengthErr), "%s of length %d", tc.desc, length)
+			assert.Equal(t, &pb.LengthError{Offset: tc.offset, Length: length, Remaining: 3}, lengthErr)
+		}
+	}
+}
+
+func TestUnmarshalUntrusted_MalformedVarints(t *testing.T) {
+	// The length of the name is cut short.
+	err := pb.UnmarshalUntrusted([]byte{0x0a, 0xff, 0xff}, &pb.HelloRequest{})
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// The length of the name is longer than any varint.
+	data := []byte{0x0a, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}
+	err = pb.UnmarshalUntrusted(data, &pb.HelloRequest{})
+	assert.ErrorIs(t, err, pb.ErrIntOverflowGreet)
+
+	// The 10th byte of a varint holds only the top bit of a uint64, so 2 would wrap around to a
+	// length of 1, rather than overflow.
+	data = []byte{0x0a, 0x81, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x02, 'a'}
+	err = pb.UnmarshalUntrusted(data, &pb.HelloRequest{})
+	assert.ErrorIs(t, err, pb.ErrIntOverflowGreet)
+
+	// While 1 is math.MaxUint64, the longest varint there is.
+	data = []byte{0x0a, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 'a'}
+	err = pb.UnmarshalUntrusted(data, &pb.HelloRequest{})
+	var lengthErr *pb.LengthError
+	require.True(t, errors.As(err, &lengthErr))
+	assert.Equal(t, uint64(math.MaxUint64), lengthErr.Length)
+
+	// Fixed-size fields that are cut short, here unknown to the message.
+	err = pb.UnmarshalUntrusted(protowire.AppendTag(nil, 9, protowire.Fixed64Type), &pb.HelloRequest{})
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestUnmarshalUntrusted_ValidMessages(t *testing.T) {
+	for _, tc := range []struct {
+		m, empty pb.Message
+	}{
+		{&pb.HelloRequest{Name: "pixie", Count: 3, Payload: []byte("payload")}, &pb.HelloRequest{}},
+		{&pb.HelloBatchRequest{Requests: []*pb.HelloRequest{{Name: "a"}, {Name: "b", Payload: []byte{0}}}}, &pb.HelloBatchRequest{}},
+		{&pb.HelloBatchReply{Results: []*pb.HelloBatchResult{{Reply: &pb.HelloReply{Message: "Hello a"}}, {Code: 3, Error: "invalid"}}}, &pb.HelloBatchReply{}},
+	} {
+		data, err := tc.m.Marshal()
+		require.NoError(t, err)
+		// With an unknown group, which is skipped.
+		data = protowire.AppendTag(data, 15, protowire.StartGroupType)
+		data = protowire.AppendTag(data, 1, protowire.VarintType)
+		data = protowire.AppendVarint(data, 7)
+		data = protowire.AppendTag(data, 15, protowire.EndGroupType)
+
+		require.NoError(t, pb.UnmarshalUntrusted(data, tc.empty))
+		assert.Equal(t, tc.m.String(), tc.empty.String())
+	}
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetpb
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+const (
+	// MaxNameBytes is the largest HelloRequest.Name accepted by Validate.
+	MaxNameBytes = 4 * 1024
+	// MaxCount is the largest HelloRequest.Count accepted by Validate.
+	MaxCount = 10000
+)
+
+// ValidationError describes the first field of a message that failed validation.
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Reason)
+}
+
+// Validate checks that the request is well formed: Name must be non-empty, valid UTF-8 and at most
+// MaxNameBytes long, and Count must be in [0, MaxCount]. It returns a *ValidationError otherwise.
+func (m *HelloRequest) Validate() error {
+	switch {
+	case m == nil:
+		return &ValidationError{Field: "request", Reason: "must not be nil"}
+	case m.Name == "":
+		return &ValidationError{Field: "name", Reason: "must not be empty"}
+	case len(m.Name) > MaxNameBytes:
+		return &ValidationError{Field: "name", Reason: fmt.Sprintf("must be at most %d bytes, got %d", MaxNameBytes, len(m.Name))}
+	case !utf8.ValidString(m.Name):
+		return &ValidationError{Field: "name", Reason: "must be valid UTF-8"}
+	case m.Count < 0 || m.Count > MaxCount:
+		return &ValidationError{Field: "count", Reason: fmt.Sprintf("must be in [0, %d], got %d", MaxCount, m.Count)}
+	}
+	return nil
+}
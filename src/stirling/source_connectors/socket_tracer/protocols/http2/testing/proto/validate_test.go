@@ -0,0 +1,74 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package greetpb_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+func TestHelloRequest_Validate(t *testing.T) {
+	tests := []struct {
+		name  string
+		req   *pb.HelloRequest
+		field string
+	}{
+		{"valid", &pb.HelloRequest{Name: "pixie", Count: 3}, ""},
+		{"valid unicode", &pb.HelloRequest{Name: "日本語"}, ""},
+		{"max count", &pb.HelloRequest{Name: "pixie", Count: pb.MaxCount}, ""},
+		{"max name", &pb.HelloRequest{Name: strings.Repeat("a", pb.MaxNameBytes)}, ""},
+		{"nil", nil, "request"},
+		{"empty name", &pb.HelloRequest{}, "name"},
+		{"long name", &pb.HelloRequest{Name: strings.Repeat("a", pb.MaxNameBytes+1)}, "name"},
+		{"negative count", &pb.HelloRequest{Name: "pixie", Count: -1}, "count"},
+		{"count too large", &pb.HelloRequest{Name: "pixie", Count: pb.MaxCount + 1}, "count"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.req.Validate()
+			if tc.field == "" {
+				assert.NoError(t, err)
+				return
+			}
+			var verr *pb.ValidationError
+			require.True(t, errors.As(err, &verr))
+			assert.Equal(t, tc.field, verr.Field)
+		})
+	}
+}
+
+func TestHelloRequest_ValidateInvalidUTF8FromWire(t *testing.T) {
+	// Field 1 (name), wire type 2, length 3, followed by bytes that are not valid UTF-8.
+	wire := []byte{0x0a, 0x03, 'a', 0xff, 0xfe}
+	req := &pb.HelloRequest{}
+	require.NoError(t, req.Unmarshal(wire))
+
+	err := req.Validate()
+	var verr *pb.ValidationError
+	require.True(t, errors.As(err, &verr))
+	assert.Equal(t, "name", verr.Field)
+	assert.Contains(t, err.Error(), "UTF-8")
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package verify
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+)
+
+// ErrExportFormat reports a file that is not an RPC export this package reads.
+var ErrExportFormat = errors.New("not a supported RPC export")
+
+// ReadRPCExport reads the CSV written by greetworkload.WriteRPCExport, skipping the run metadata,
+// which greetworkload.ReadRunMetadata reads. Files of another version than
+// greetworkload.RPCExportVersion, or whose columns are not those of the version, are rejected
+// with ErrExportFormat.
+func ReadRPCExport(r io.Reader) ([]greetworkload.RPCRow, error) {
+	br := bufio.NewReader(r)
+	header, err := br.ReadString('\n')
+	if err != nil && !(err == io.EOF && header != "") {
+		return nil, fmt.Errorf("%w: missing the version line: %v", ErrExportFormat, err)
+	}
+	header = strings.TrimRight(header, "\r\n")
+	if want := greetworkload.RPCExportHeader(greetworkload.RPCExportVersion); header != want {
+		return nil, fmt.Errorf("%w: expected the version line %q, got %q", ErrExportFormat, want, header)
+	}
+	// The lines the CSV reader skips, for the line numbers of errors.
+	skipped := 1
+	if prefix, _ := br.Peek(len(greetworkload.RunMetadataComment)); string(prefix) == greetworkload.RunMetadataComment {
+		if _, err := br.ReadString('\n'); err != nil {
+			return nil, fmt.Errorf("%w: missing the column names: %v", ErrExportFormat, err)
+		}
+		skipped++
+	}
+
+	cr := csv.NewReader(br)
+	columns, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: missing the column names: %v", ErrExportFormat, err)
+	}
+	if want := greetworkload.RPCExportColumns(); strings.Join(columns, ",") != strings.Join(want, ",") {
+		return nil, fmt.Errorf("%w: expected the columns %s, got %s", ErrExportFormat, strings.Join(want, ","), strings.Join(columns, ","))
+	}
+
+	var rows []greetworkload.RPCRow
+	for {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		row, err := parseRPCRow(fields)
+		if err != nil {
+			line, _ := cr.FieldPos(0)
+			return nil, fmt.Errorf("line %d: %w", line+skipped, err)
+		}
+		rows = append(rows, row)
+	}
+}
+
+// rpcRowParser parses the fields of a row, one column at a time, keeping the first error.
+type rpcRowParser struct {
+	fields []string
+	col    int
+	err    error
+}
+
+func (p *rpcRowParser) next() string {
+	p.col++
+	return p.fields[p.col-1]
+}
+
+func (p *rpcRowParser) fail(err error) {
+	if p.err == nil {
+		p.err = fmt.Errorf("column %s: %w", greetworkload.RPCExportColumns()[p.col-1], err)
+	}
+}
+
+func (p *rpcRowParser) int64() int64 {
+	n, err := strconv.ParseInt(p.next(), 10, 64)
+	if err != nil {
+		p.fail(err)
+	}
+	return n
+}
+
+func (p *rpcRowParser) int() int {
+	n, err := strconv.Atoi(p.next())
+	if err != nil {
+		p.fail(err)
+	}
+	return n
+}
+
+func (p *rpcRowParser) time() time.Time {
+	return time.Unix(0, p.int64())
+}
+
+func parseRPCRow(fields []string) (greetworkload.RPCRow, error) {
+	p := &rpcRowParser{fields: fields}
+	row := greetworkload.RPCRow{
+		Side:         p.next(),
+		Method:       p.next(),
+		RequestID:    p.next(),
+		StartTime:    p.time(),
+		EndTime:      p.time(),
+		ReqBytes:     p.int64(),
+		RespBytes:    p.int64(),
+		ReqMessages:  p.int64(),
+		RespMessages: p.int64(),
+		Status:       p.next(),
+		ClientIP:     p.next(),
+		ClientPort:   p.int(),
+		ServerIP:     p.next(),
+		ServerPort:   p.int(),
+	}
+	if p.err != nil {
+		return row, p.err
+	}
+	if row.Side != greetworkload.SideClient && row.Side != greetworkload.SideServer {
+		return row, fmt.Errorf("column side: expected %s or %s, got %q", greetworkload.SideClient, greetworkload.SideServer, row.Side)
+	}
+	return row, nil
+}
+
+// ExportRecords returns the records of the rows seen by side, in order, for Verify.
+func ExportRecords(rows []greetworkload.RPCRow, side string) []Record {
+	var records []Record
+	for _, r := range rows {
+		if r.Side != side {
+			continue
+		}
+		records = append(records, Record{
+			Method:    r.Method,
+			RequestID: r.RequestID,
+			ReqBytes:  r.ReqBytes,
+			RespBytes: r.RespBytes,
+			Status:    r.Status,
+			StartTime: r.StartTime,
+			EndTime:   r.EndTime,
+			Conn: Conn{
+				Client: net.JoinHostPort(r.ClientIP, strconv.Itoa(r.ClientPort)),
+				Server: net.JoinHostPort(r.ServerIP, strconv.Itoa(r.ServerPort)),
+			},
+		})
+	}
+	return records
+}
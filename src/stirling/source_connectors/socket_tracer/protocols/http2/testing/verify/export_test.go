@@ -0,0 +1,157 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package verify_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/verify"
+)
+
+// runExported makes a unary call and a call of every streaming kind against a server, and returns
+// the rows of the client and then those of the server.
+func runExported(t *testing.T) []greetworkload.RPCRow {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	serverStats := greetworkload.NewConnStatsHandler()
+	serverStats.KeepRPCs()
+	s := grpc.NewServer(grpc.StatsHandler(serverStats))
+	greeter := greetworkload.NewServer(nil)
+	pb.RegisterGreeterServer(s, greeter)
+	pb.RegisterStreamingGreeterServer(s, greeter)
+	go func() { _ = s.Serve(lis) }()
+	defer s.Stop()
+
+	clientStats := greetworkload.NewConnStatsHandler()
+	clientStats.KeepRPCs()
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 10 * time.Second, StreamCount: 3})
+	conn, err := c.Dial(lis.Addr().String(), grpc.WithStatsHandler(clientStats))
+	require.NoError(t, err)
+	defer conn.Close()
+	for _, r := range []*greetworkload.CallRecord{
+		c.SayHello(conn, "pixie"),
+		c.ServerStreaming(conn, "pixie"),
+		c.ClientStreaming(conn, []string{"a", "b"}),
+		c.BidirStreaming(conn, []string{"a", "b", "c"}),
+	} {
+		require.True(t, r.Completed(), r.Error)
+	}
+	require.Eventually(t, func() bool { return len(serverStats.RPCs()) == 4 }, 5*time.Second, 10*time.Millisecond)
+	return append(clientStats.RPCs(), serverStats.RPCs()...)
+}
+
+func TestReadRPCExport_RoundTrip(t *testing.T) {
+	rows := runExported(t)
+	var buf bytes.Buffer
+	require.NoError(t, greetworkload.WriteRPCExport(&buf, &greetworkload.RunMetadata{Seed: 1}, rows))
+	got, err := verify.ReadRPCExport(&buf)
+	require.NoError(t, err)
+
+	// Times are kept to the nanosecond, without the monotonic clock reading or location.
+	want := make([]greetworkload.RPCRow, len(rows))
+	for i, r := range rows {
+		r.StartTime = time.Unix(0, r.StartTime.UnixNano())
+		r.EndTime = time.Unix(0, r.EndTime.UnixNano())
+		want[i] = r
+	}
+	assert.Equal(t, want, got)
+
+	// The streaming rows carry their message counts.
+	var streamed int
+	for _, r := range got {
+		if strings.HasSuffix(r.Method, "/SayHelloBidirStreaming") {
+			assert.EqualValues(t, 3, r.ReqMessages, r.Side)
+			assert.EqualValues(t, 3, r.RespMessages, r.Side)
+			streamed++
+		}
+	}
+	assert.Equal(t, 2, streamed)
+
+	// The rows of either side make records that match those of the other.
+	diff, err := verify.Verify(verify.ExportRecords(got, greetworkload.SideClient), verify.ExportRecords(got, greetworkload.SideServer), nil)
+	require.NoError(t, err)
+	assert.True(t, diff.Clean(), diff.Summary())
+}
+
+func TestReadRPCExport_Empty(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, greetworkload.WriteRPCExport(&buf, nil, nil))
+	rows, err := verify.ReadRPCExport(&buf)
+	require.NoError(t, err)
+	assert.Empty(t, rows)
+}
+
+func TestReadRPCExport_Invalid(t *testing.T) {
+	columns := strings.Join(greetworkload.RPCExportColumns(), ",")
+	row := "client,/m,a,1,2,3,4,1,1,OK,::1,40000,::1,50051"
+	tests := []struct {
+		name    string
+		file    string
+		format  bool
+		wantErr string
+	}{
+		{name: "empty", file: "", format: true},
+		{name: "no version", file: columns + "\n" + row + "\n", format: true},
+		{name: "future version", file: "# greet-rpc-export version=3\n" + columns + "\n", format: true},
+		{name: "version 1", file: "# greet-rpc-export version=1\n" + columns + "\n", format: true},
+		{name: "no columns", file: "# greet-rpc-export version=2\n", format: true},
+		{name: "other columns", file: "# greet-rpc-export version=2\n" + strings.Replace(columns, "req_bytes", "request_bytes", 1) + "\n", format: true},
+		{name: "bad number", file: "# greet-rpc-export version=2\n" + columns + "\n" + strings.Replace(row, ",3,", ",x,", 1) + "\n", wantErr: "line 3: column req_bytes"},
+		{name: "bad number after metadata", file: "# greet-rpc-export version=2\n# run_metadata: {}\n" + columns + "\n" + strings.Replace(row, ",3,", ",x,", 1) + "\n", wantErr: "line 4: column req_bytes"},
+		{name: "bad side", file: "# greet-rpc-export version=2\n" + columns + "\n" + row + "\n" + strings.Replace(row, "client", "proxy", 1) + "\n", wantErr: "line 4: column side"},
+		{name: "missing field", file: "# greet-rpc-export version=2\n" + columns + "\n" + strings.TrimSuffix(row, ",50051") + "\n", wantErr: "wrong number of fields"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := verify.ReadRPCExport(strings.NewReader(test.file))
+			require.Error(t, err)
+			assert.Equal(t, test.format, errors.Is(err, verify.ErrExportFormat), err.Error())
+			assert.Contains(t, err.Error(), test.wantErr)
+		})
+	}
+}
+
+func TestExportRecords(t *testing.T) {
+	rows := []greetworkload.RPCRow{
+		{Side: greetworkload.SideClient, Method: "/m", RequestID: "a", ReqBytes: 3, RespBytes: 4, Status: "OK", StartTime: t0, EndTime: t0.Add(time.Millisecond),
+			ClientIP: "::1", ClientPort: 40000, ServerIP: "::1", ServerPort: 50051},
+		{Side: greetworkload.SideServer, Method: "/m", RequestID: "a"},
+	}
+	assert.Equal(t, []verify.Record{{
+		Method:    "/m",
+		RequestID: "a",
+		ReqBytes:  3,
+		RespBytes: 4,
+		Status:    "OK",
+		StartTime: t0,
+		EndTime:   t0.Add(time.Millisecond),
+		Conn:      verify.Conn{Client: "[::1]:40000", Server: "[::1]:50051"},
+	}}, verify.ExportRecords(rows, greetworkload.SideClient))
+}
@@ -0,0 +1,240 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package verify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// GoldenVersion is the version of the golden files written by WriteGolden. It is bumped whenever
+// the fields of a GoldenEvent change.
+const GoldenVersion = 1
+
+// ErrGoldenFormat reports a file that is not a golden file this package reads.
+var ErrGoldenFormat = errors.New("not a supported golden file")
+
+// methodPath returns the HTTP/2 :path of a method given by full name, or by the name the client
+// records it under, or "" if there is no telling.
+func methodPath(method string) string {
+	if strings.HasPrefix(method, "/") {
+		return method
+	}
+	if m, ok := pb.GreetMethods.LookupName(method); ok {
+		return m.FullName
+	}
+	return ""
+}
+
+// latencyBuckets are the upper bounds of the latency buckets of GoldenEvents but the last, which
+// is unbounded.
+var latencyBuckets = []struct {
+	bound time.Duration
+	name  string
+}{
+	{time.Millisecond, "<1ms"},
+	{10 * time.Millisecond, "<10ms"},
+	{100 * time.Millisecond, "<100ms"},
+	{time.Second, "<1s"},
+}
+
+// LatencyBucket returns the bucket of GoldenEvent.LatencyBucket that d falls in.
+func LatencyBucket(d time.Duration) string {
+	for _, b := range latencyBuckets {
+		if d < b.bound {
+			return b.name
+		}
+	}
+	return ">=1s"
+}
+
+// GoldenEvent is a request and its response, as the tracer tests expect them to be traced. Its
+// fields are named after the columns of the HTTP/2 events the tracer exports, where there is one.
+// Fields left unknown match any value: the zero value, or -1 for sizes.
+type GoldenEvent struct {
+	// Method is the name of the method called, e.g. "SayHello".
+	Method string `json:"method"`
+	// ReqPath is the HTTP/2 :path of the call, e.g.
+	// "/px.stirling.protocols.http2.testing.Greeter/SayHello".
+	ReqPath string `json:"req_path"`
+	// ReqBodySize and RespBodySize are the bytes of the gRPC messages sent each way, each counted
+	// with its 5-byte prefix.
+	ReqBodySize  int64 `json:"req_body_size"`
+	RespBodySize int64 `json:"resp_body_size"`
+	// GRPCStatus is the gRPC status code, by name, e.g. "OK".
+	GRPCStatus string `json:"grpc_status,omitempty"`
+	// LatencyBucket is the LatencyBucket of the time from the request to the end of the response.
+	LatencyBucket string `json:"latency_bucket"`
+}
+
+// Golden is the golden file of a run: the events a tracer is expected to capture of it, in the
+// order the calls were made.
+type Golden struct {
+	// Version is the GoldenVersion of the file.
+	Version int `json:"version"`
+	// Seed is the seed of the run, so that it can be made again.
+	Seed int64 `json:"seed"`
+	// RunMetadata is the metadata of the client of the run, if known, which tells the flags and
+	// binary it was made with.
+	RunMetadata *greetworkload.RunMetadata `json:"run_metadata,omitempty"`
+	Events      []GoldenEvent              `json:"events"`
+}
+
+// GoldenOf returns the golden file of a run of the given seed from its records, in order.
+func GoldenOf(records []Record, seed int64) *Golden {
+	g := &Golden{Version: GoldenVersion, Seed: seed, Events: make([]GoldenEvent, 0, len(records))}
+	for _, r := range records {
+		g.Events = append(g.Events, GoldenEvent{
+			Method:        shortMethod(r.Method),
+			ReqPath:       methodPath(r.Method),
+			ReqBodySize:   r.ReqBytes,
+			RespBodySize:  r.RespBytes,
+			GRPCStatus:    statusName(r.Status),
+			LatencyBucket: LatencyBucket(r.EndTime.Sub(r.StartTime)),
+		})
+	}
+	return g
+}
+
+// Golden returns the golden file of the run of t, made with the given seed, from the records it
+// is Expected to be traced as.
+func (t *GroundTruth) Golden(seed int64) (*Golden, error) {
+	records, err := t.Expected()
+	if err != nil {
+		return nil, err
+	}
+	return GoldenOf(records, seed), nil
+}
+
+// WriteGolden writes g to w as JSON, one event per line, so that golden files diff well.
+func WriteGolden(w io.Writer, g *Golden) error {
+	if _, err := fmt.Fprintf(w, "{\n  \"version\": %d,\n  \"seed\": %d,\n", g.Version, g.Seed); err != nil {
+		return err
+	}
+	if g.RunMetadata != nil {
+		if _, err := fmt.Fprintf(w, "  \"run_metadata\": %s,\n", g.RunMetadata); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(w, "  \"events\": ["); err != nil {
+		return err
+	}
+	for i := range g.Events {
+		// Latency buckets are written as they are, e.g. "<1ms" rather than "\u003c1ms".
+		var b bytes.Buffer
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(&g.Events[i]); err != nil {
+			return err
+		}
+		sep := ","
+		if i == len(g.Events)-1 {
+			sep = ""
+		}
+		if _, err := fmt.Fprintf(w, "\n    %s%s", bytes.TrimSuffix(b.Bytes(), []byte("\n")), sep); err != nil {
+			return err
+		}
+	}
+	if len(g.Events) > 0 {
+		if _, err := io.WriteString(w, "\n  "); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]\n}\n")
+	return err
+}
+
+// ReadGolden reads a golden file written by WriteGolden. Files of another version than
+// GoldenVersion, or with fields it does not know, are rejected with ErrGoldenFormat.
+func ReadGolden(r io.Reader) (*Golden, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	g := &Golden{}
+	if err := dec.Decode(g); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrGoldenFormat, err)
+	}
+	if g.Version != GoldenVersion {
+		return nil, fmt.Errorf("%w: expected version %d, got %d", ErrGoldenFormat, GoldenVersion, g.Version)
+	}
+	return g, nil
+}
+
+// DiffGolden compares the events of got to those of want, in order, and describes every
+// difference in a line of its own, e.g.
+//
+//	event 3 (SayHello): resp_body_size: want 17, got 21
+//
+// It returns nil if got matches want. Fields want leaves unknown match any value, as does the
+// RunMetadata of either, if not known; otherwise what makes the runs not comparable is described
+// too, see greetworkload.CompareRunMetadata.
+func DiffGolden(want, got *Golden) []string {
+	var diffs []string
+	if want.Version != got.Version {
+		diffs = append(diffs, fmt.Sprintf("version: want %d, got %d", want.Version, got.Version))
+	}
+	if want.Seed != got.Seed {
+		diffs = append(diffs, fmt.Sprintf("seed: want %d, got %d", want.Seed, got.Seed))
+	}
+	if want.RunMetadata != nil && got.RunMetadata != nil {
+		for _, d := range greetworkload.CompareRunMetadata(want.RunMetadata, got.RunMetadata) {
+			diffs = append(diffs, "run_metadata: "+d)
+		}
+	}
+	for i := 0; i < len(want.Events) || i < len(got.Events); i++ {
+		switch {
+		case i >= len(got.Events):
+			diffs = append(diffs, fmt.Sprintf("event %d (%s): missing", i, want.Events[i].Method))
+		case i >= len(want.Events):
+			diffs = append(diffs, fmt.Sprintf("event %d (%s): unexpected", i, got.Events[i].Method))
+		default:
+			for _, d := range diffGoldenEvent(&want.Events[i], &got.Events[i]) {
+				diffs = append(diffs, fmt.Sprintf("event %d (%s): %s", i, want.Events[i].Method, d))
+			}
+		}
+	}
+	return diffs
+}
+
+func diffGoldenEvent(want, got *GoldenEvent) []string {
+	var diffs []string
+	str := func(field, w, g string) {
+		if w != "" && w != g {
+			diffs = append(diffs, fmt.Sprintf("%s: want %q, got %q", field, w, g))
+		}
+	}
+	size := func(field string, w, g int64) {
+		if w >= 0 && w != g {
+			diffs = append(diffs, fmt.Sprintf("%s: want %d, got %d", field, w, g))
+		}
+	}
+	str("method", want.Method, got.Method)
+	str("req_path", want.ReqPath, got.ReqPath)
+	size("req_body_size", want.ReqBodySize, got.ReqBodySize)
+	size("resp_body_size", want.RespBodySize, got.RespBodySize)
+	str("grpc_status", want.GRPCStatus, got.GRPCStatus)
+	str("latency_bucket", want.LatencyBucket, got.LatencyBucket)
+	return diffs
+}
@@ -0,0 +1,211 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package verify_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/verify"
+)
+
+func TestLatencyBucket(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		0:                        "<1ms",
+		999 * time.Microsecond:   "<1ms",
+		time.Millisecond:         "<10ms",
+		50 * time.Millisecond:    "<100ms",
+		999 * time.Millisecond:   "<1s",
+		time.Second:              ">=1s",
+		time.Hour:                ">=1s",
+		100 * time.Millisecond:   "<1s",
+		9999 * time.Microsecond:  "<10ms",
+		10000 * time.Microsecond: "<100ms",
+	} {
+		assert.Equal(t, want, verify.LatencyBucket(d), d)
+	}
+}
+
+func TestGoldenOf(t *testing.T) {
+	full := call("b", 10)
+	full.Method = "/px.stirling.protocols.http2.testing.StreamingGreeter/SayHelloBidirStreaming"
+	full.Status = "2"
+	full.EndTime = full.StartTime.Add(20 * time.Millisecond)
+	cancelled := call("c", 20)
+	cancelled.Method = "SayHi"
+	cancelled.Status = ""
+	cancelled.RespBytes = -1
+
+	g := verify.GoldenOf([]verify.Record{call("a", 0), full, cancelled}, 42)
+	assert.Equal(t, &verify.Golden{
+		Version: verify.GoldenVersion,
+		Seed:    42,
+		Events: []verify.GoldenEvent{
+			{Method: "SayHello", ReqPath: "/px.stirling.protocols.http2.testing.Greeter/SayHello", ReqBodySize: 12, RespBodySize: 20, GRPCStatus: "OK", LatencyBucket: "<10ms"},
+			{Method: "SayHelloBidirStreaming", ReqPath: full.Method, ReqBodySize: 12, RespBodySize: 20, GRPCStatus: "Unknown", LatencyBucket: "<100ms"},
+			{Method: "SayHi", ReqPath: "/px.stirling.protocols.http2.testing.Greeter2/SayHi", ReqBodySize: 12, RespBodySize: -1, LatencyBucket: "<10ms"},
+		},
+	}, g)
+}
+
+func TestGolden_RoundTrip(t *testing.T) {
+	withMetadata := verify.GoldenOf([]verify.Record{call("a", 0)}, 4)
+	withMetadata.RunMetadata = &greetworkload.RunMetadata{
+		Seed:      4,
+		Flags:     map[string]string{"rate": "10"},
+		GoVersion: "go1.20.3",
+		StartTime: time.Unix(1700000000, 0).UTC(),
+	}
+	for _, g := range []*verify.Golden{
+		verify.GoldenOf(nil, 1),
+		verify.GoldenOf([]verify.Record{call("a", 0)}, 2),
+		verify.GoldenOf([]verify.Record{call("a", 0), call("b", 10), call("c", 20)}, -3),
+		withMetadata,
+	} {
+		var buf bytes.Buffer
+		require.NoError(t, verify.WriteGolden(&buf, g))
+		// One line per event, unescaped.
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if strings.Contains(line, `"method"`) {
+				assert.Equal(t, 1, strings.Count(line, `"method"`), line)
+				assert.Contains(t, line, `"latency_bucket":"<10ms"`)
+			}
+		}
+		assert.Equal(t, len(g.Events), strings.Count(buf.String(), `"method"`))
+		got, err := verify.ReadGolden(&buf)
+		require.NoError(t, err)
+		assert.Equal(t, g, got)
+		assert.Empty(t, verify.DiffGolden(g, got))
+	}
+}
+
+func TestReadGolden_Invalid(t *testing.T) {
+	for name, file := range map[string]string{
+		"empty":          "",
+		"not json":       "version=1",
+		"no version":     `{"seed": 1, "events": []}`,
+		"future version": `{"version": 2, "seed": 1, "events": []}`,
+		"unknown field":  `{"version": 1, "seed": 1, "events": [{"method": "SayHello", "latency_ms": 3}]}`,
+	} {
+		_, err := verify.ReadGolden(strings.NewReader(file))
+		assert.True(t, errors.Is(err, verify.ErrGoldenFormat), "%s: %v", name, err)
+	}
+}
+
+func TestDiffGolden(t *testing.T) {
+	want := verify.GoldenOf([]verify.Record{call("a", 0), call("b", 10), call("c", 20)}, 1)
+	want.Events[1].RespBodySize = -1
+	want.Events[1].GRPCStatus = ""
+
+	got := verify.GoldenOf([]verify.Record{call("a", 0), call("b", 10)}, 2)
+	got.Events[0].RespBodySize = 21
+	got.Events[0].LatencyBucket = "<100ms"
+	// Unknown in want, and so not a difference.
+	got.Events[1].RespBodySize = 99
+	got.Events[1].GRPCStatus = "Internal"
+	assert.Equal(t, []string{
+		"seed: want 1, got 2",
+		`event 0 (SayHello): resp_body_size: want 20, got 21`,
+		`event 0 (SayHello): latency_bucket: want "<10ms", got "<100ms"`,
+		"event 2 (SayHello): missing",
+	}, verify.DiffGolden(want, got))
+
+	got.Seed = 1
+	got.Events = append(want.Events, want.Events[0])
+	assert.Equal(t, []string{"event 3 (SayHello): unexpected"}, verify.DiffGolden(want, got))
+
+	// Run metadata is compared once both sides have some.
+	got.Events = want.Events
+	got.RunMetadata = &greetworkload.RunMetadata{Seed: 1, PayloadGenVersion: 2}
+	assert.Empty(t, verify.DiffGolden(want, got))
+	want.RunMetadata = &greetworkload.RunMetadata{Seed: 1, PayloadGenVersion: 1}
+	assert.Equal(t, []string{"run_metadata: payloadgen_version: 1 vs 2"}, verify.DiffGolden(want, got))
+}
+
+// A short run is exported as a golden file, which the run then verifies against.
+func TestGolden_ExampleRun(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := grpc.NewServer()
+	greeter := greetworkload.NewServer(nil)
+	pb.RegisterGreeterServer(s, greeter)
+	pb.RegisterStreamingGreeterServer(s, greeter)
+	go func() { _ = s.Serve(lis) }()
+	defer s.Stop()
+
+	const seed = 7
+	c := greetworkload.NewClient(&greetworkload.ClientOptions{Timeout: 10 * time.Second, StreamCount: 2, Seed: seed})
+	conn, err := c.Dial(lis.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	var calls []*greetworkload.CallRecord
+	for _, r := range []*greetworkload.CallRecord{
+		c.SayHello(conn, "pixie"),
+		c.SayHelloAgain(conn, "pixie"),
+		c.ServerStreaming(conn, "pixie"),
+		c.ClientStreaming(conn, []string{"a", "b"}),
+	} {
+		require.True(t, r.Completed(), r.Error)
+		calls = append(calls, r)
+	}
+
+	dir := t.TempDir()
+	files := &verify.Files{ClientRecords: filepath.Join(dir, "client_records.json")}
+	writeFile(t, files.ClientRecords, func(w io.Writer) error { return greetworkload.WriteRecords(w, nil, calls) })
+	truth, err := verify.ReadGroundTruth(files)
+	require.NoError(t, err)
+	golden, err := truth.Golden(seed)
+	require.NoError(t, err)
+	goldenFile := filepath.Join(dir, "run.golden.json")
+	writeFile(t, goldenFile, func(w io.Writer) error { return verify.WriteGolden(w, golden) })
+
+	f, err := os.Open(goldenFile)
+	require.NoError(t, err)
+	defer f.Close()
+	want, err := verify.ReadGolden(f)
+	require.NoError(t, err)
+	require.Len(t, want.Events, 4)
+	assert.Equal(t, "/px.stirling.protocols.http2.testing.Greeter/SayHelloAgain", want.Events[1].ReqPath)
+	assert.Equal(t, "OK", want.Events[2].GRPCStatus)
+	assert.Equal(t, int64(-1), want.Events[3].RespBodySize, "reply sizes are unknown to the workload")
+
+	// The run verifies against its own golden file...
+	got, err := truth.Golden(seed)
+	require.NoError(t, err)
+	assert.Empty(t, verify.DiffGolden(want, got))
+
+	// ... and a request traced with a wrong size does not.
+	got.Events[0].ReqBodySize++
+	assert.Equal(t, []string{
+		"event 0 (SayHello): req_body_size: want " + strconv.FormatInt(want.Events[0].ReqBodySize, 10) + ", got " + strconv.FormatInt(got.Events[0].ReqBodySize, 10),
+	}, verify.DiffGolden(want, got))
+}
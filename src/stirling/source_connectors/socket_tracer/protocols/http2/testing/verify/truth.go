@@ -0,0 +1,205 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package verify
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+)
+
+// GroundTruth is what the greet workload recorded of a run. Only Calls is required.
+type GroundTruth struct {
+	// Calls are the calls made by the client, as written with -output.
+	Calls []*greetworkload.CallRecord
+	// ServerCalls are the calls handled by the server, as written with --records_file. They tell
+	// how many attempts of each call reached the server.
+	ServerCalls []*greetworkload.CallRecord
+	// ClientConns and ServerConns are the connection stats written with stats_file by the client
+	// and the server. They tell which connection each call was made over.
+	ClientConns []greetworkload.ConnStats
+	ServerConns []greetworkload.ConnStats
+	// Compressed is set for runs made with gzip compression, whose request sizes are then counted
+	// compressed.
+	Compressed bool
+}
+
+// Files are the paths of the files of a GroundTruth. Empty paths are skipped.
+type Files struct {
+	ClientRecords string
+	ServerRecords string
+	ClientStats   string
+	ServerStats   string
+}
+
+func readFile(path string, read func(f *os.File) error) error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := read(f); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// ReadGroundTruth reads the ground truth of a run from its files.
+func ReadGroundTruth(files *Files) (*GroundTruth, error) {
+	t := &GroundTruth{}
+	for _, step := range []struct {
+		path string
+		read func(f *os.File) error
+	}{
+		{files.ClientRecords, func(f *os.File) (err error) { t.Calls, err = greetworkload.ReadRecords(f); return }},
+		{files.ServerRecords, func(f *os.File) (err error) { t.ServerCalls, err = greetworkload.ReadRecords(f); return }},
+		{files.ClientStats, func(f *os.File) (err error) { t.ClientConns, err = greetworkload.ReadConnStats(f); return }},
+		{files.ServerStats, func(f *os.File) (err error) { t.ServerConns, err = greetworkload.ReadConnStats(f); return }},
+	} {
+		if err := readFile(step.path, step.read); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// connSpan is a connection and the time it was open for. close is zero if it was still open
+// when the stats were collected.
+type connSpan struct {
+	conn        Conn
+	open, close time.Time
+}
+
+func (s *connSpan) covers(start, end time.Time) bool {
+	return !s.open.After(start) && (s.close.IsZero() || !s.close.Before(end))
+}
+
+// connSpans returns the connections of t, from the stats of the client and then those only the
+// server saw.
+func (t *GroundTruth) connSpans() []connSpan {
+	var spans []connSpan
+	seen := make(map[Conn]bool)
+	add := func(c Conn, s *greetworkload.ConnStats) {
+		if seen[c] {
+			return
+		}
+		seen[c] = true
+		span := connSpan{conn: c, open: s.OpenTime}
+		if s.CloseTime != nil {
+			span.close = *s.CloseTime
+		}
+		spans = append(spans, span)
+	}
+	for i := range t.ClientConns {
+		add(Conn{Client: t.ClientConns[i].LocalAddr, Server: t.ClientConns[i].RemoteAddr}, &t.ClientConns[i])
+	}
+	for i := range t.ServerConns {
+		add(Conn{Client: t.ServerConns[i].RemoteAddr, Server: t.ServerConns[i].LocalAddr}, &t.ServerConns[i])
+	}
+	return spans
+}
+
+// callConn returns the connection r was made over: the one with its local address, if recorded,
+// or else the only one open for the whole call. It returns the zero Conn if there is no telling.
+func callConn(spans []connSpan, r *Record, localAddr string) Conn {
+	var found Conn
+	n := 0
+	for i := range spans {
+		if localAddr != "" && spans[i].conn.Client != localAddr {
+			continue
+		}
+		if spans[i].covers(r.StartTime, r.EndTime) {
+			found = spans[i].conn
+			n++
+		}
+	}
+	if n != 1 {
+		return Conn{}
+	}
+	return found
+}
+
+// requestBytes returns the bytes of the gRPC messages the requests of r were sent in, or -1 if
+// they were not recorded.
+func requestBytes(r *greetworkload.CallRecord, compressed bool) (int64, error) {
+	if len(r.Names) == 0 {
+		return -1, nil
+	}
+	var total int64
+	for _, name := range r.Names {
+		req := &pb.HelloRequest{Name: name}
+		if r.Method == "SayHelloServerStreaming" {
+			req.Count = r.StreamCount
+		}
+		n, err := greetworkload.MessageWireLength(req, compressed)
+		if err != nil {
+			return 0, err
+		}
+		total += int64(n)
+	}
+	return total, nil
+}
+
+// Expected returns the records a tracer is expected to capture for the calls of t, in the order
+// of t.Calls. Reply sizes are unknown to the workload, and so left out. So is the status of the
+// calls the client cancelled, which the server may never have sent.
+func (t *GroundTruth) Expected() ([]Record, error) {
+	attempts := make(map[string]int)
+	for _, r := range t.ServerCalls {
+		if r.RequestID != "" {
+			attempts[r.RequestID]++
+		}
+	}
+	spans := t.connSpans()
+
+	records := make([]Record, 0, len(t.Calls))
+	for i, c := range t.Calls {
+		r := Record{
+			Method:    c.Method,
+			RequestID: c.RequestID,
+			Attempts:  c.Attempt,
+			RespBytes: -1,
+			Status:    c.Code,
+			StartTime: c.StartTime,
+			EndTime:   c.StartTime.Add(time.Duration(c.DurationNS)),
+		}
+		if t.ServerCalls != nil {
+			r.Attempts = attempts[c.RequestID]
+		}
+		if r.Attempts < 1 {
+			r.Attempts = 1
+		}
+		if c.Cancelled {
+			r.Status = ""
+		}
+		var err error
+		if r.ReqBytes, err = requestBytes(c, t.Compressed); err != nil {
+			return nil, fmt.Errorf("call %d: %w", i, err)
+		}
+		r.Conn = callConn(spans, &r, c.LocalAddr)
+		records = append(records, r)
+	}
+	return records, nil
+}
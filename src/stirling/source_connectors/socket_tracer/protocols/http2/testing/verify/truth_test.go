@@ -0,0 +1,159 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package verify_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/greetworkload"
+	pb "px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/proto"
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/verify"
+)
+
+func record(method, id string, ms int) *greetworkload.CallRecord {
+	return &greetworkload.CallRecord{
+		Method:     method,
+		RequestID:  id,
+		StartTime:  t0.Add(time.Duration(ms) * time.Millisecond),
+		DurationNS: int64(2 * time.Millisecond),
+		Code:       "OK",
+		Attempt:    1,
+	}
+}
+
+func connStats(c verify.Conn, openMS, closeMS int) greetworkload.ConnStats {
+	s := greetworkload.ConnStats{LocalAddr: c.Client, RemoteAddr: c.Server, OpenTime: t0.Add(time.Duration(openMS) * time.Millisecond)}
+	if closeMS >= 0 {
+		closed := t0.Add(time.Duration(closeMS) * time.Millisecond)
+		s.CloseTime = &closed
+	}
+	return s
+}
+
+func TestGroundTruth_Expected(t *testing.T) {
+	unary := record("SayHello", "a", 10)
+	unary.Names = []string{"pixie"}
+	streaming := record("SayHelloServerStreaming", "b", 10)
+	streaming.Names = []string{"pixie"}
+	streaming.StreamCount = 5
+	cancelled := record("SayHello", "c", 100)
+	cancelled.Code = "Canceled"
+	cancelled.Cancelled = true
+	pinned := record("SayHello", "d", 10)
+	pinned.LocalAddr = connB.Client
+	retried := record("SayHello", "e", 100)
+	retried.Attempt = 3
+
+	truth := &verify.GroundTruth{
+		Calls: []*greetworkload.CallRecord{unary, streaming, cancelled, pinned, retried},
+		// connA is the only connection open for the calls at 100ms.
+		ClientConns: []greetworkload.ConnStats{connStats(connA, 0, -1), connStats(connB, 0, 50)},
+	}
+	expected, err := truth.Expected()
+	require.NoError(t, err)
+	require.Len(t, expected, 5)
+
+	assert.Equal(t, verify.Record{
+		Method:    "SayHello",
+		RequestID: "a",
+		Attempts:  1,
+		ReqBytes:  int64((&pb.HelloRequest{Name: "pixie"}).Size() + greetworkload.MessagePrefixLen),
+		RespBytes: -1,
+		Status:    "OK",
+		StartTime: unary.StartTime,
+		EndTime:   unary.StartTime.Add(2 * time.Millisecond),
+	}, expected[0], "two connections were open")
+	assert.Equal(t, int64((&pb.HelloRequest{Name: "pixie", Count: 5}).Size()+greetworkload.MessagePrefixLen), expected[1].ReqBytes)
+	assert.Equal(t, "", expected[2].Status)
+	assert.Equal(t, connA, expected[2].Conn)
+	assert.Equal(t, int64(-1), expected[2].ReqBytes)
+	assert.Equal(t, connB, expected[3].Conn)
+	assert.Equal(t, 3, expected[4].Attempts)
+
+	// The server tells how many attempts reached it, and which connections only it saw.
+	truth.ServerCalls = []*greetworkload.CallRecord{record("SayHello", "e", 100), record("SayHello", "e", 101), record("SayHello", "", 0)}
+	truth.ClientConns = nil
+	truth.ServerConns = []greetworkload.ConnStats{{LocalAddr: connA.Server, RemoteAddr: connA.Client, OpenTime: t0}}
+	expected, err = truth.Expected()
+	require.NoError(t, err)
+	assert.Equal(t, 1, expected[0].Attempts)
+	assert.Equal(t, 2, expected[4].Attempts)
+	assert.Equal(t, connA, expected[0].Conn)
+	assert.Equal(t, verify.Conn{}, expected[3].Conn, "the connection of the local address is unknown")
+
+	truth.Compressed = true
+	expected, err = truth.Expected()
+	require.NoError(t, err)
+	n, err := greetworkload.MessageWireLength(&pb.HelloRequest{Name: "pixie"}, true)
+	require.NoError(t, err)
+	assert.Equal(t, int64(n), expected[0].ReqBytes)
+}
+
+func writeFile(t *testing.T, path string, write func(w io.Writer) error) {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, write(f))
+}
+
+func TestReadGroundTruth(t *testing.T) {
+	dir := t.TempDir()
+	files := &verify.Files{
+		ClientRecords: filepath.Join(dir, "client_records.json"),
+		ClientStats:   filepath.Join(dir, "client_stats.json"),
+		ServerStats:   filepath.Join(dir, "server_stats.json"),
+	}
+	calls := []*greetworkload.CallRecord{record("SayHello", "a", 0), record("SayHello", "b", 10)}
+	conns := []greetworkload.ConnStats{connStats(connA, 0, 20)}
+	// The run metadata at the top of the files is skipped.
+	meta := &greetworkload.RunMetadata{Seed: 7}
+	writeFile(t, files.ClientRecords, func(w io.Writer) error { return greetworkload.WriteRecords(w, meta, calls) })
+	writeFile(t, files.ClientStats, func(w io.Writer) error { return greetworkload.WriteConnStats(w, meta, conns) })
+	writeFile(t, files.ServerStats, func(w io.Writer) error { return greetworkload.WriteConnStats(w, nil, nil) })
+
+	truth, err := verify.ReadGroundTruth(files)
+	require.NoError(t, err)
+	require.Len(t, truth.Calls, 2)
+	assert.Equal(t, "b", truth.Calls[1].RequestID)
+	assert.Nil(t, truth.ServerCalls)
+	require.Len(t, truth.ClientConns, 1)
+	assert.Equal(t, connA.Client, truth.ClientConns[0].LocalAddr)
+	assert.Empty(t, truth.ServerConns)
+
+	// A trace of the run verifies against it.
+	expected, err := truth.Expected()
+	require.NoError(t, err)
+	traced := []verify.Record{call("b", 10), call("a", 0)}
+	d, err := verify.Verify(expected, traced, nil)
+	require.NoError(t, err)
+	assert.True(t, d.Clean(), d.Summary())
+
+	writeFile(t, files.ServerStats, func(w io.Writer) error { _, err := w.Write([]byte("{")); return err })
+	_, err = verify.ReadGroundTruth(files)
+	assert.ErrorContains(t, err, "server_stats.json")
+	_, err = verify.ReadGroundTruth(&verify.Files{ClientRecords: filepath.Join(dir, "missing.json")})
+	assert.Error(t, err)
+}
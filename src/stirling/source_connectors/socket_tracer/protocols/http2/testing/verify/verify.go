@@ -0,0 +1,403 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package verify compares what a tracer captured of a greet workload run to the ground truth the
+// workload recorded of it. Records are matched in two phases: by request ID first, and then, for
+// those left, by connection, start time and size. Matched records are then compared field by
+// field.
+package verify
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// ErrMismatch reports that traced records do not match the ground truth.
+var ErrMismatch = errors.New("traced records do not match the ground truth")
+
+// Conn is a TCP connection, by the addresses of its client and server, e.g. "127.0.0.1:50051".
+// The zero Conn is an unknown connection.
+type Conn struct {
+	Client string `json:"client"`
+	Server string `json:"server"`
+}
+
+// Record is a call, as expected from the ground truth or as traced. Fields left unknown match
+// any value: the zero value, or -1 for sizes.
+type Record struct {
+	// Method is the name of the method called, e.g. "SayHello", or its full name, e.g.
+	// "/px.stirling.protocols.http2.testing.Greeter/SayHello".
+	Method string `json:"method"`
+	// RequestID is the greetworkload.RequestIDHeader of the call.
+	RequestID string `json:"request_id,omitempty"`
+	// Attempts is the number of attempts of an expected call, each of which may be traced. Zero
+	// counts as one. Ignored in traced records.
+	Attempts int `json:"attempts,omitempty"`
+	// ReqBytes and RespBytes are the bytes of the gRPC messages sent each way, each counted with
+	// its 5-byte prefix, as by greetworkload.MessageWireLength.
+	ReqBytes  int64 `json:"req_bytes"`
+	RespBytes int64 `json:"resp_bytes"`
+	// Status is the gRPC status code, by name, e.g. "OK", or by number, e.g. "0".
+	Status    string    `json:"status,omitempty"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	Conn      Conn      `json:"conn"`
+}
+
+// Options configure Verify.
+type Options struct {
+	// Window bounds how far apart the start times of records without a request ID in common may
+	// be, and still be matched.
+	Window time.Duration
+	// Timing bounds how far apart the start and end times of matched records may be before they
+	// are reported as outliers.
+	Timing time.Duration
+	// Bytes bounds how far apart the sizes of matched records may be before they are reported as
+	// mismatches. Records without a request ID in common must be within it to be matched.
+	Bytes int64
+	// Offset is added to the times of traced records before they are compared, e.g. to bring
+	// them from the clock of the tracer to that of the workload.
+	Offset time.Duration
+}
+
+// defaultOptions are used when Verify is given no options.
+var defaultOptions = Options{Window: time.Second, Timing: 100 * time.Millisecond}
+
+// Validate checks that the options are usable.
+func (o *Options) Validate() error {
+	if o.Window < 0 || o.Timing < 0 || o.Bytes < 0 {
+		return fmt.Errorf("tolerances must not be negative, got window %v, timing %v and bytes %d", o.Window, o.Timing, o.Bytes)
+	}
+	return nil
+}
+
+// Match is an expected record and the traced record it was matched to.
+type Match struct {
+	Expected Record `json:"expected"`
+	Traced   Record `json:"traced"`
+	// ByRequestID is true if the records were matched by request ID, rather than by connection,
+	// time and size.
+	ByRequestID bool `json:"by_request_id"`
+	// Retries are the traced records of the attempts of the call before the one matched.
+	Retries []Record `json:"retries,omitempty"`
+}
+
+// Mismatch is a field that differs between matched records.
+type Mismatch struct {
+	Expected Record `json:"expected"`
+	Traced   Record `json:"traced"`
+	Field    string `json:"field"`
+	Want     string `json:"want"`
+	Got      string `json:"got"`
+}
+
+// Outlier is a time of a traced record further than Options.Timing from the one expected.
+type Outlier struct {
+	Expected Record `json:"expected"`
+	Traced   Record `json:"traced"`
+	// Field is "start_time" or "end_time".
+	Field string `json:"field"`
+	// Delta is the traced time, offset, minus the expected time.
+	Delta time.Duration `json:"delta"`
+}
+
+// Diff is the outcome of Verify.
+type Diff struct {
+	Matched []Match `json:"matched"`
+	// Missing are the expected records that were not traced, in the order given.
+	Missing []Record `json:"missing"`
+	// Extra are the traced records that were not expected, in the order given.
+	Extra      []Record   `json:"extra"`
+	Mismatches []Mismatch `json:"mismatches"`
+	Outliers   []Outlier  `json:"outliers"`
+}
+
+// Clean returns true if every expected record was traced as expected, and nothing else was.
+func (d *Diff) Clean() bool {
+	return len(d.Missing) == 0 && len(d.Extra) == 0 && len(d.Mismatches) == 0 && len(d.Outliers) == 0
+}
+
+// Summary counts the records in each part of the diff.
+func (d *Diff) Summary() string {
+	return fmt.Sprintf("%d matched, %d missing, %d extra, %d mismatches, %d timing outliers",
+		len(d.Matched), len(d.Missing), len(d.Extra), len(d.Mismatches), len(d.Outliers))
+}
+
+// Err returns nil if the diff is clean, and otherwise an error wrapping ErrMismatch.
+func (d *Diff) Err() error {
+	if d.Clean() {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrMismatch, d.Summary())
+}
+
+// shortMethod returns the name of the method of a full method name, and other names unchanged.
+func shortMethod(method string) string {
+	return method[strings.LastIndex(method, "/")+1:]
+}
+
+// statusName returns the name of a gRPC status code given by name or by number.
+func statusName(s string) string {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return codes.Code(n).String()
+	}
+	return s
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+func absBytes(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// verifier holds the state of a Verify.
+type verifier struct {
+	opts     Options
+	expected []Record
+	traced   []Record
+	// matchedTraced marks the traced records matched, or attributed to retries.
+	matchedTraced []bool
+	// matchOf holds, for every expected record, its match, or nil.
+	matchOf []*Match
+}
+
+// Verify matches traced records to expected ones, e.g. from GroundTruth.Expected, and reports
+// how they differ. A nil opts uses a window of 1s, a timing tolerance of 100ms and exact sizes.
+func Verify(expected, traced []Record, opts *Options) (*Diff, error) {
+	if opts == nil {
+		opts = &defaultOptions
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	v := &verifier{
+		opts:          *opts,
+		expected:      expected,
+		traced:        make([]Record, len(traced)),
+		matchedTraced: make([]bool, len(traced)),
+		matchOf:       make([]*Match, len(expected)),
+	}
+	for i, t := range traced {
+		t.StartTime = offsetTime(t.StartTime, opts.Offset)
+		t.EndTime = offsetTime(t.EndTime, opts.Offset)
+		v.traced[i] = t
+	}
+	v.matchByRequestID()
+	v.matchFuzzy()
+	return v.diff(), nil
+}
+
+func offsetTime(t time.Time, d time.Duration) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	return t.Add(d)
+}
+
+// matchByRequestID matches expected records to the traced records with their request ID. Of
+// those, the one that started last is the attempt the call finished with, and up to
+// Attempts-1 others are its retries.
+func (v *verifier) matchByRequestID() {
+	byID := make(map[string][]int)
+	for i := range v.traced {
+		if id := v.traced[i].RequestID; id != "" {
+			byID[id] = append(byID[id], i)
+		}
+	}
+	for ei := range v.expected {
+		e := &v.expected[ei]
+		if e.RequestID == "" {
+			continue
+		}
+		candidates := byID[e.RequestID]
+		if len(candidates) == 0 {
+			continue
+		}
+		sort.SliceStable(candidates, func(a, b int) bool {
+			return v.traced[candidates[a]].StartTime.Before(v.traced[candidates[b]].StartTime)
+		})
+		last := candidates[len(candidates)-1]
+		m := &Match{Expected: *e, Traced: v.traced[last], ByRequestID: true}
+		v.matchedTraced[last] = true
+		retries := candidates[:len(candidates)-1]
+		keep := e.Attempts - 1
+		if keep < 0 {
+			keep = 0
+		}
+		if len(retries) > keep {
+			// The earliest records are the least likely to be retries, and are left extra.
+			retries = retries[len(retries)-keep:]
+		}
+		for _, ti := range retries {
+			m.Retries = append(m.Retries, v.traced[ti])
+			v.matchedTraced[ti] = true
+		}
+		v.matchOf[ei] = m
+		// Another expected record with the same ID is not matched again.
+		delete(byID, e.RequestID)
+	}
+}
+
+// candidate is an expected and a traced record that may be matched, at a distance score.
+type candidate struct {
+	ei, ti int
+	score  time.Duration
+}
+
+// compatible returns true if e and t may be the same call: the same method, no request IDs that
+// differ, the same connection if both are known, start times within the window and sizes
+// within tolerance.
+func (v *verifier) compatible(e, t *Record) bool {
+	if shortMethod(e.Method) != shortMethod(t.Method) {
+		return false
+	}
+	if e.RequestID != "" && t.RequestID != "" {
+		return false
+	}
+	if e.Conn != (Conn{}) && t.Conn != (Conn{}) && e.Conn != t.Conn {
+		return false
+	}
+	if absDuration(t.StartTime.Sub(e.StartTime)) > v.opts.Window {
+		return false
+	}
+	for _, sizes := range [][2]int64{{e.ReqBytes, t.ReqBytes}, {e.RespBytes, t.RespBytes}} {
+		if sizes[0] >= 0 && sizes[1] >= 0 && absBytes(sizes[0]-sizes[1]) > v.opts.Bytes {
+			return false
+		}
+	}
+	return true
+}
+
+// matchFuzzy matches the records left, closest start times first.
+func (v *verifier) matchFuzzy() {
+	var candidates []candidate
+	for ei := range v.expected {
+		if v.matchOf[ei] != nil {
+			continue
+		}
+		for ti := range v.traced {
+			if v.matchedTraced[ti] || !v.compatible(&v.expected[ei], &v.traced[ti]) {
+				continue
+			}
+			score := absDuration(v.traced[ti].StartTime.Sub(v.expected[ei].StartTime))
+			candidates = append(candidates, candidate{ei: ei, ti: ti, score: score})
+		}
+	}
+	sort.Slice(candidates, func(a, b int) bool {
+		ca, cb := candidates[a], candidates[b]
+		if ca.score != cb.score {
+			return ca.score < cb.score
+		}
+		if ca.ei != cb.ei {
+			return ca.ei < cb.ei
+		}
+		return ca.ti < cb.ti
+	})
+	for _, c := range candidates {
+		if v.matchOf[c.ei] != nil || v.matchedTraced[c.ti] {
+			continue
+		}
+		v.matchOf[c.ei] = &Match{Expected: v.expected[c.ei], Traced: v.traced[c.ti]}
+		v.matchedTraced[c.ti] = true
+	}
+}
+
+func (v *verifier) diff() *Diff {
+	d := &Diff{}
+	for ei, m := range v.matchOf {
+		if m == nil {
+			d.Missing = append(d.Missing, v.expected[ei])
+			continue
+		}
+		d.Matched = append(d.Matched, *m)
+		d.Mismatches = append(d.Mismatches, v.mismatches(m)...)
+		d.Outliers = append(d.Outliers, v.outliers(m)...)
+	}
+	for ti, matched := range v.matchedTraced {
+		if !matched {
+			d.Extra = append(d.Extra, v.traced[ti])
+		}
+	}
+	return d
+}
+
+// mismatches compares the fields of the records of m that are known on both sides.
+func (v *verifier) mismatches(m *Match) []Mismatch {
+	e, t := &m.Expected, &m.Traced
+	var out []Mismatch
+	add := func(field, want, got string) {
+		out = append(out, Mismatch{Expected: *e, Traced: *t, Field: field, Want: want, Got: got})
+	}
+	if want, got := shortMethod(e.Method), shortMethod(t.Method); want != got {
+		add("method", want, got)
+	}
+	if e.Status != "" && t.Status != "" {
+		if want, got := statusName(e.Status), statusName(t.Status); want != got {
+			add("status", want, got)
+		}
+	}
+	for _, f := range []struct {
+		field     string
+		want, got int64
+	}{
+		{"req_bytes", e.ReqBytes, t.ReqBytes},
+		{"resp_bytes", e.RespBytes, t.RespBytes},
+	} {
+		if f.want >= 0 && f.got >= 0 && absBytes(f.want-f.got) > v.opts.Bytes {
+			add(f.field, strconv.FormatInt(f.want, 10), strconv.FormatInt(f.got, 10))
+		}
+	}
+	if e.Conn != (Conn{}) && t.Conn != (Conn{}) && e.Conn != t.Conn {
+		add("conn", e.Conn.Client+" -> "+e.Conn.Server, t.Conn.Client+" -> "+t.Conn.Server)
+	}
+	return out
+}
+
+// outliers compares the times of the records of m that are known on both sides.
+func (v *verifier) outliers(m *Match) []Outlier {
+	var out []Outlier
+	for _, f := range []struct {
+		field     string
+		want, got time.Time
+	}{
+		{"start_time", m.Expected.StartTime, m.Traced.StartTime},
+		{"end_time", m.Expected.EndTime, m.Traced.EndTime},
+	} {
+		if f.want.IsZero() || f.got.IsZero() {
+			continue
+		}
+		if delta := f.got.Sub(f.want); absDuration(delta) > v.opts.Timing {
+			out = append(out, Outlier{Expected: m.Expected, Traced: m.Traced, Field: f.field, Delta: delta})
+		}
+	}
+	return out
+}
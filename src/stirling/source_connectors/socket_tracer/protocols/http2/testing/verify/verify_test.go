@@ -0,0 +1,246 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package verify_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"px.dev/pixie/src/stirling/source_connectors/socket_tracer/protocols/http2/testing/verify"
+)
+
+var (
+	t0    = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	connA = verify.Conn{Client: "127.0.0.1:40000", Server: "127.0.0.1:50051"}
+	connB = verify.Conn{Client: "127.0.0.1:40001", Server: "127.0.0.1:50051"}
+)
+
+// call returns a record of a SayHello call over connA, starting at ms milliseconds past t0 and
+// lasting 2ms.
+func call(id string, ms int) verify.Record {
+	start := t0.Add(time.Duration(ms) * time.Millisecond)
+	return verify.Record{
+		Method:    "SayHello",
+		RequestID: id,
+		ReqBytes:  12,
+		RespBytes: 20,
+		Status:    "OK",
+		StartTime: start,
+		EndTime:   start.Add(2 * time.Millisecond),
+		Conn:      connA,
+	}
+}
+
+func mustVerify(t *testing.T, expected, traced []verify.Record, opts *verify.Options) *verify.Diff {
+	d, err := verify.Verify(expected, traced, opts)
+	require.NoError(t, err)
+	return d
+}
+
+func TestVerify_Clean(t *testing.T) {
+	expected := []verify.Record{call("a", 0), call("b", 10), call("c", 20)}
+	// Traced out of order, with full method names, numeric statuses and sizes the workload could
+	// not know.
+	traced := []verify.Record{call("c", 20), call("a", 0), call("b", 10)}
+	for i := range traced {
+		traced[i].Method = "/px.stirling.protocols.http2.testing.Greeter/SayHello"
+		traced[i].Status = "0"
+	}
+	expected[1].RespBytes = -1
+
+	d := mustVerify(t, expected, traced, nil)
+	assert.True(t, d.Clean(), d.Summary())
+	assert.NoError(t, d.Err())
+	require.Len(t, d.Matched, 3)
+	for i, m := range d.Matched {
+		assert.True(t, m.ByRequestID)
+		assert.Equal(t, expected[i].RequestID, m.Traced.RequestID)
+	}
+}
+
+func TestVerify_MissingAndExtra(t *testing.T) {
+	expected := []verify.Record{call("a", 0), call("b", 10), call("c", 20)}
+	other := call("z", 15)
+	other.Method = "SayHelloAgain"
+	traced := []verify.Record{call("a", 0), other, call("c", 20)}
+
+	d := mustVerify(t, expected, traced, nil)
+	assert.Equal(t, []verify.Record{call("b", 10)}, d.Missing)
+	assert.Equal(t, []verify.Record{other}, d.Extra)
+	assert.Len(t, d.Matched, 2)
+	assert.Equal(t, "2 matched, 1 missing, 1 extra, 0 mismatches, 0 timing outliers", d.Summary())
+	err := d.Err()
+	assert.True(t, errors.Is(err, verify.ErrMismatch))
+	assert.Contains(t, err.Error(), "1 missing")
+}
+
+func TestVerify_Mismatches(t *testing.T) {
+	expected := []verify.Record{call("a", 0), call("b", 10), call("c", 20), call("d", 30)}
+	traced := []verify.Record{call("a", 0), call("b", 10), call("c", 20), call("d", 30)}
+	traced[0].Status = "14"
+	traced[1].ReqBytes = 15
+	traced[2].Conn = connB
+	traced[3].Method = "SayHi"
+	// Unknown on one side only, so not compared.
+	expected[0].RespBytes = -1
+	traced[0].RespBytes = 999
+	traced[1].Status = ""
+
+	d := mustVerify(t, expected, traced, nil)
+	assert.Empty(t, d.Missing)
+	assert.Empty(t, d.Extra)
+	var got []string
+	for _, m := range d.Mismatches {
+		got = append(got, m.Traced.RequestID+" "+m.Field+": "+m.Want+" != "+m.Got)
+	}
+	assert.Equal(t, []string{
+		"a status: OK != Unavailable",
+		"b req_bytes: 12 != 15",
+		"c conn: 127.0.0.1:40000 -> 127.0.0.1:50051 != 127.0.0.1:40001 -> 127.0.0.1:50051",
+		"d method: SayHello != SayHi",
+	}, got)
+
+	// Sizes within tolerance match.
+	d = mustVerify(t, expected[1:2], traced[1:2], &verify.Options{Window: time.Second, Timing: time.Second, Bytes: 3})
+	assert.True(t, d.Clean(), d.Summary())
+}
+
+func TestVerify_Outliers(t *testing.T) {
+	expected := []verify.Record{call("a", 0), call("b", 100)}
+	traced := []verify.Record{call("a", 3), call("b", 100)}
+	traced[1].EndTime = traced[1].EndTime.Add(-20 * time.Millisecond)
+
+	opts := &verify.Options{Window: time.Second, Timing: 5 * time.Millisecond}
+	d := mustVerify(t, expected, traced, opts)
+	require.Len(t, d.Outliers, 1)
+	assert.Equal(t, "b", d.Outliers[0].Expected.RequestID)
+	assert.Equal(t, "end_time", d.Outliers[0].Field)
+	assert.Equal(t, -20*time.Millisecond, d.Outliers[0].Delta)
+
+	// A tracer clock 1 hour behind, brought back by Offset.
+	for i := range traced {
+		traced[i].StartTime = traced[i].StartTime.Add(-time.Hour)
+		traced[i].EndTime = traced[i].EndTime.Add(-time.Hour)
+	}
+	d = mustVerify(t, expected, traced, opts)
+	assert.Len(t, d.Outliers, 4)
+	opts.Offset = time.Hour
+	d = mustVerify(t, expected, traced, opts)
+	assert.Len(t, d.Outliers, 1)
+	// Records keep their traced times, offset.
+	assert.Equal(t, t0.Add(3*time.Millisecond), d.Matched[0].Traced.StartTime)
+
+	// Unknown times are not compared.
+	traced[0].EndTime = time.Time{}
+	traced[1].EndTime = time.Time{}
+	d = mustVerify(t, expected, traced, opts)
+	assert.Empty(t, d.Outliers)
+}
+
+func TestVerify_Fuzzy(t *testing.T) {
+	// Two calls at the same time over different connections, and two over the same connection,
+	// told apart by time, none of them traced with a request ID.
+	expected := []verify.Record{call("a", 0), call("b", 0), call("c", 50), call("d", 60)}
+	expected[1].Conn = connB
+	traced := []verify.Record{call("", 62), call("", 48), call("", 1), call("", 1)}
+	traced[3].Conn = connB
+
+	d := mustVerify(t, expected, traced, nil)
+	assert.True(t, d.Clean(), d.Summary())
+	require.Len(t, d.Matched, 4)
+	for i, want := range []int{2, 3, 1, 0} {
+		m := d.Matched[i]
+		assert.False(t, m.ByRequestID)
+		assert.Equal(t, traced[want], m.Traced, "call %s", m.Expected.RequestID)
+	}
+}
+
+func TestVerify_FuzzyBounds(t *testing.T) {
+	expected := []verify.Record{call("a", 0), call("b", 0), call("c", 0), call("d", 0)}
+	expected[3].Conn = verify.Conn{}
+	traced := []verify.Record{call("", 0), call("", 0), call("x", 0), call("", 0)}
+	// Outside the window.
+	traced[0].StartTime = t0.Add(2 * time.Second)
+	// Another size.
+	traced[1].ReqBytes = 13
+	// Another request ID.
+	traced[2].RequestID = "x"
+	// Another connection, but the expected one is unknown.
+	traced[3].Conn = connB
+
+	d := mustVerify(t, expected, traced, &verify.Options{Window: time.Second, Timing: 5 * time.Second})
+	require.Len(t, d.Matched, 1)
+	assert.Equal(t, "d", d.Matched[0].Expected.RequestID)
+	assert.Equal(t, traced[3], d.Matched[0].Traced)
+	assert.Empty(t, d.Mismatches)
+	assert.Len(t, d.Missing, 3)
+	assert.Len(t, d.Extra, 3)
+
+	// A wider window and size tolerance match two more; the request ID still sets x apart.
+	d = mustVerify(t, expected, traced, &verify.Options{Window: 3 * time.Second, Timing: time.Second, Bytes: 1})
+	assert.Len(t, d.Matched, 3)
+	assert.Equal(t, []verify.Record{traced[2]}, d.Extra)
+	require.Len(t, d.Outliers, 1)
+	assert.Equal(t, "start_time", d.Outliers[0].Field)
+	assert.Equal(t, 2*time.Second, d.Outliers[0].Delta)
+}
+
+func TestVerify_Retries(t *testing.T) {
+	e := call("a", 0)
+	e.Attempts = 2
+	first, second, last := call("a", 0), call("a", 5), call("a", 10)
+	first.Status, second.Status = "Unavailable", "Unavailable"
+
+	d := mustVerify(t, []verify.Record{e}, []verify.Record{last, first, second}, &verify.Options{Window: time.Second, Timing: time.Second})
+	require.Len(t, d.Matched, 1)
+	// The last attempt is the one the call finished with.
+	assert.Equal(t, last, d.Matched[0].Traced)
+	assert.Equal(t, []verify.Record{second}, d.Matched[0].Retries)
+	// One attempt more than the call made.
+	assert.Equal(t, []verify.Record{first}, d.Extra)
+	assert.Empty(t, d.Mismatches)
+
+	e.Attempts = 3
+	d = mustVerify(t, []verify.Record{e}, []verify.Record{last, first, second}, &verify.Options{Window: time.Second, Timing: time.Second})
+	assert.True(t, d.Clean(), d.Summary())
+	assert.Equal(t, []verify.Record{first, second}, d.Matched[0].Retries)
+}
+
+func TestVerify_DuplicateRequestIDs(t *testing.T) {
+	// Two expected records with the same ID: the second is matched fuzzily, if at all.
+	expected := []verify.Record{call("a", 0), call("a", 500)}
+	traced := []verify.Record{call("a", 0), call("", 500)}
+	d := mustVerify(t, expected, traced, nil)
+	require.Len(t, d.Matched, 2)
+	assert.False(t, d.Matched[1].ByRequestID)
+	assert.Equal(t, traced[1], d.Matched[1].Traced)
+}
+
+func TestOptions_Validate(t *testing.T) {
+	for _, opts := range []*verify.Options{{Window: -1}, {Timing: -1}, {Bytes: -1}} {
+		_, err := verify.Verify(nil, nil, opts)
+		assert.Error(t, err, "%+v", opts)
+	}
+	d := mustVerify(t, nil, nil, &verify.Options{})
+	assert.True(t, d.Clean())
+}